@@ -18,7 +18,9 @@ package cli
 
 import (
 	"fmt"
+	"time"
 
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/cli-runtime/pkg/genericclioptions"
 	"k8s.io/client-go/rest"
 )
@@ -34,6 +36,130 @@ type PromQFlags struct {
 	Output     string
 	HostNames       []string
 	Continuous bool
+	FuzzyMatch bool
+	// IgnoreCase matches metric and label names regardless of case
+	IgnoreCase bool
+	// IgnoreSeparators matches metric and label names treating '.', '-' and '_' alike
+	IgnoreSeparators bool
+	// Start and End make the query a range query between them, rather than an instant one
+	Start string
+	End   string
+	// Step is how far apart the points of a range query are, the scrape period if not set
+	Step time.Duration
+	// PrometheusURL is a prometheus server to run queries against, through its HTTP API,
+	// rather than scraping anything
+	PrometheusURL string
+	// RemoteRead is the remote read endpoint of a prometheus server to fetch the
+	// series the query needs from
+	RemoteRead string
+	// RemoteReadLookback is how far back RemoteRead fetches series from
+	RemoteReadLookback time.Duration
+	// Record appends every scrape to this file, for Replay to play back
+	Record string
+	// Replay plays back the scrapes recorded in this file, rather than scraping anything
+	Replay string
+	// ReplaySpeed is how many times faster than it was recorded Replay plays back
+	ReplaySpeed float64
+	// DiscardRawData drops the samples of long windows once they're downsampled
+	DiscardRawData bool
+	// MaxSeries and MaxMemory are how many series and how much memory we keep what we
+	// scrape in, if it's kept in memory, zero for no limit
+	MaxSeries int
+	MaxMemory resource.QuantityValue
+	// MaxSamples is how many samples a query can have in memory at once
+	MaxSamples int
+	// LookbackDelta is how far back a query looks for the latest sample of a series
+	LookbackDelta time.Duration
+	// TableColumns are the labels shown by the table output format, every label if
+	// there aren't any
+	TableColumns []string
+	// QueryTimeout is how long a query can take, zero for the scrape period
+	QueryTimeout time.Duration
+	// Sink appends the results charted continuously to this file, in SinkFormat,
+	// rotating it once it's SinkMaxSize or SinkRotateEvery old
+	Sink            string
+	SinkFormat      string
+	SinkMaxSize     resource.QuantityValue
+	SinkRotateEvery time.Duration
+	// Compare also runs the query as it was this long ago, charted over now
+	Compare time.Duration
+	// WALFile is where an interactive session keeps its window of data and its query,
+	// for Resume to pick up after a crash, empty to not keep them
+	WALFile string
+	// Resume restores the window of data and the query kept in WALFile
+	Resume bool
+	// DataDir is where we keep what we scrape, so that it survives restarts, empty to
+	// keep it in memory
+	DataDir string
+	// Retention is how long we keep what we scrape in DataDir
+	Retention time.Duration
+	// FormatQuery prints the query formatted, rather than running it
+	FormatQuery bool
+	// MaxSuggestions caps how many completions we show at once
+	MaxSuggestions int
+	// UnstableMetrics is one of show, demote or hide
+	UnstableMetrics string
+	// ListenAddress is where we serve autocompletion over HTTP
+	ListenAddress string
+	// Components are kubernetes components to scrape, and the nodes they're on, i.e.
+	// kubelet-cadvisor=worker-1
+	Components []string
+	// TargetConfig is a file of targets to scrape with their own TLS and auth, rather
+	// than the kubeconfig's
+	TargetConfig string
+	// RelabelConfig is a file of relabel configs, like prometheus' metric_relabel_configs,
+	// to apply to what we scrape
+	RelabelConfig string
+	// DropLabels are labels to drop from what we scrape
+	DropLabels []string
+	// RuleFiles are prometheus rules files, whose recording rules we index, and whose
+	// alerting rules we evaluate
+	RuleFiles []string
+	// Alerts are ad-hoc alerts to evaluate, i.e. 'rate(errors_total[5m]) > 1 for 1m'
+	Alerts []string
+	// Bell rings the terminal bell when an alert starts firing
+	Bell bool
+	// LegendStats shows each series' current, min, max and average value in the key
+	// of the chart, under its title
+	LegendStats bool
+	// Theme names the palette the series are charted in
+	Theme string
+	// Stats prints what it took to run the query
+	Stats bool
+	// IndexTTL is how long a series can go unscraped before we stop suggesting it
+	IndexTTL time.Duration
+	// Cardinality reports the metrics with the most series, and the labels with the
+	// most values
+	Cardinality bool
+	// Protobuf asks endpoints for the protobuf exposition format
+	Protobuf bool
+	// Lenient skips the lines of a scrape which can't be parsed, rather than failing
+	// the whole scrape
+	Lenient bool
+	// Dedup merges the series of replicas, i.e. of an HA pair, which only differ by
+	// their ReplicaLabels
+	Dedup         bool
+	ReplicaLabels []string
+	// ExternalLabels are added to every series of every target, each name=value
+	ExternalLabels []string
+	// MetricAllow and MetricDeny are regexes of the metric families to keep, and to
+	// drop, as scrapes are parsed, empty for all of them and none of them
+	MetricAllow string
+	MetricDeny  string
+	// Headers are sent with every scrape of the targets scraped directly, and to the
+	// prometheus we query or remote read, each name: value
+	Headers []string
+	// ScrapeTimeout is how long a scrape of a target can take
+	ScrapeTimeout time.Duration
+	// ScrapeJitter spreads the scrapes of the targets over up to this long
+	ScrapeJitter time.Duration
+	// AlignScrapes scrapes on wall clock boundaries, i.e. on the second, so that the
+	// samples of every scrape line up
+	AlignScrapes bool
+	// ScrapeRetries is how many more times a failed scrape of a target is tried
+	ScrapeRetries int
+	// HistoryFile persists the queries we've run, empty to not persist them
+	HistoryFile string
 }
 
 type PQableCommand interface {
@@ -44,3 +170,9 @@ type PQableCommand interface {
 func (c *PromQCommand) Fprintf(format string, args ...interface{}) {
 	_, _ = fmt.Fprintf(c.Streams.Out, format, args...)
 }
+
+// Eprintf writes to the error stream, so that warnings don't end up mixed
+// in with our output.
+func (c *PromQCommand) Eprintf(format string, args ...interface{}) {
+	_, _ = fmt.Fprintf(c.Streams.ErrOut, format, args...)
+}
@@ -17,6 +17,9 @@ limitations under the License.
 package metrics
 
 import (
+	"fmt"
+	"strings"
+
     "github.com/c-bata/go-prompt"
 
 	"sigs.k8s.io/instrumentation-tools/promq/autocomplete"
@@ -25,7 +28,7 @@ import (
 const (
 	// spaces can't individually demarcate individual lexical units
 	// in promql.
-	PromQLTokenSeparators = " []{}()=!~,"
+	PromQLTokenSeparators = " \t\r\n[]{}()=!~,@"
 )
 
 type Completer struct {
@@ -40,10 +43,61 @@ func (c *Completer) Complete(d prompt.Document) []prompt.Suggest {
 	if d.TextBeforeCursor() == "" {
 		return []prompt.Suggest{}
 	}
-	ret := c.promCompleter.GenerateSuggestions(d.Text, d.DisplayCursorPosition())
+	// the completer wants a byte offset, not a position on screen
+	cursor := len(d.TextBeforeCursor())
+	ret := c.promCompleter.GenerateSuggestions(d.Text, cursor)
+	// go-prompt swaps the word before the cursor for the text of the suggestion
+	wordStart := cursor - len(d.GetWordBeforeCursorUntilSeparator(PromQLTokenSeparators))
 	suggests := make([]prompt.Suggest, len(ret))
 	for i, s := range ret {
-		suggests[i] = prompt.Suggest{Text: s.GetValue(), Description: s.GetDetail()}
+		suggests[i] = prompt.Suggest{Text: spliceText(d.Text, cursor, wordStart, s), Description: s.GetDetail()}
 	}
 	return suggests
 }
+
+// spliceText works out what go-prompt has to insert in place of the word before the
+// cursor, so that the match ends up replacing its range of the query instead. go-prompt
+// can't delete anything after the cursor, so if the cursor is in the middle of a word
+// we can only avoid repeating the rest of it, i.e. for 'apiserver_re|quest_total'.
+func spliceText(query string, cursor, wordStart int, m autocomplete.Match) string {
+	r := m.GetRange()
+	text := m.GetValue()
+	if r.Offset > wordStart && r.Offset <= cursor {
+		// i.e. 'a+b', where we only replace the 'b'
+		text = query[wordStart:r.Offset] + text
+	}
+	if end := r.Offset + r.Length; end > cursor && end <= len(query) {
+		text = strings.TrimSuffix(text, query[cursor:end])
+	}
+	return text
+}
+
+// RecordQuery passes an executed query on to the underlying completer, so
+// that the terms in it are ranked higher in future suggestions.
+func (c *Completer) RecordQuery(query string) {
+	c.promCompleter.RecordQuery(query)
+}
+
+// Explain points out where a query stops being valid, underlining the offending
+// text, or returns an empty string if the query looks fine to us.
+func (c *Completer) Explain(query string) string {
+	var sb strings.Builder
+	for _, d := range c.promCompleter.Diagnose(query) {
+		length := d.Length
+		if length == 0 {
+			length = 1
+		}
+		// only show the line with the problem on it, so that the underline lines up
+		start := strings.LastIndex(query[:d.Offset], "\n") + 1
+		line := query[start:]
+		if end := strings.IndexByte(line, '\n'); end >= 0 {
+			line = line[:end]
+		}
+		fmt.Fprintf(&sb, "%s\n%s%s %s", line, strings.Repeat(" ", d.Offset-start), strings.Repeat("^", length), d.Message)
+		if len(d.Expected) > 0 {
+			fmt.Fprintf(&sb, ", expected one of: %s", strings.Join(d.Expected, ", "))
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
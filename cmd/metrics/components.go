@@ -0,0 +1,83 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// component is where a kubernetes component serves its metrics, so that they can be
+// scraped by name rather than by URL.
+type component struct {
+	// pod is the name of the component's static pod in kube-system, less the node
+	// it's on, and empty for what the kubelet serves itself, which we get to through
+	// the node's proxy, with the apiserver's credentials for the kubelet
+	pod string
+	// scheme is that of the pod's port, if it's not http
+	scheme string
+	port   string
+	path   string
+}
+
+// components are the components we know where to scrape, by what they're called in
+// --component. The control plane ones are where kubeadm puts them.
+var components = map[string]component{
+	"kubelet":            {path: "metrics"},
+	"kubelet-cadvisor":   {path: "metrics/cadvisor"},
+	"kubelet-resource":   {path: "metrics/resource"},
+	"kubelet-probes":     {path: "metrics/probes"},
+	"scheduler":          {pod: "kube-scheduler", scheme: "https", port: "10259", path: "metrics"},
+	"controller-manager": {pod: "kube-controller-manager", scheme: "https", port: "10257", path: "metrics"},
+	"etcd":               {pod: "etcd", port: "2381", path: "metrics"},
+}
+
+// componentNames lists the components we know, for help and errors.
+func componentNames() string {
+	names := make([]string, 0, len(components))
+	for name := range components {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// componentTarget turns a component and the node it's on, i.e. kubelet-cadvisor=worker-1,
+// into a pod:// or node:// target, to be scraped through the apiserver's proxy.
+func componentTarget(spec string) (string, error) {
+	name, node := spec, ""
+	if i := strings.Index(spec, "="); i >= 0 {
+		name, node = spec[:i], spec[i+1:]
+	}
+	c, ok := components[name]
+	if !ok {
+		return "", fmt.Errorf("unknown component %q, expected one of %s", name, componentNames())
+	}
+	if node == "" {
+		return "", fmt.Errorf("expected the node %s is on, i.e. --component %s=<node>", name, name)
+	}
+	if c.pod == "" {
+		return fmt.Sprintf("node://%s/%s", node, c.path), nil
+	}
+	pod := fmt.Sprintf("%s-%s:%s", c.pod, node, c.port)
+	if c.scheme != "" {
+		// the proxy takes the scheme before the pod's name
+		pod = c.scheme + ":" + pod
+	}
+	return fmt.Sprintf("pod://kube-system/%s/%s", pod, c.path), nil
+}
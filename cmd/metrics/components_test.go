@@ -0,0 +1,67 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestComponentTarget(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    string
+		want    string
+		wantErr string
+	}{
+		{name: "kubelet", spec: "kubelet=worker-1", want: "node://worker-1/metrics"},
+		{name: "kubelet's cadvisor", spec: "kubelet-cadvisor=worker-1", want: "node://worker-1/metrics/cadvisor"},
+		{name: "kubelet's probes", spec: "kubelet-probes=worker-1", want: "node://worker-1/metrics/probes"},
+		{name: "an https static pod", spec: "scheduler=control-plane", want: "pod://kube-system/https:kube-scheduler-control-plane:10259/metrics"},
+		{name: "another https static pod", spec: "controller-manager=control-plane", want: "pod://kube-system/https:kube-controller-manager-control-plane:10257/metrics"},
+		{name: "an http static pod", spec: "etcd=control-plane", want: "pod://kube-system/etcd-control-plane:2381/metrics"},
+		{name: "no node", spec: "etcd", wantErr: "expected the node etcd is on"},
+		{name: "an empty node", spec: "kubelet=", wantErr: "expected the node kubelet is on"},
+		{name: "unknown component", spec: "kube-proxy=worker-1", wantErr: `unknown component "kube-proxy"`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := componentTarget(test.spec)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Errorf("got %q, %v, want an error containing %q", got, err, test.wantErr)
+				}
+				return
+			}
+			if err != nil || got != test.want {
+				t.Errorf("got %q, %v, want %q", got, err, test.want)
+			}
+		})
+	}
+}
+
+func TestComponentTargetsAreProxied(t *testing.T) {
+	for name := range components {
+		target, err := componentTarget(name + "=worker-1")
+		if err != nil {
+			t.Fatalf("unable to get the target of %s: %v", name, err)
+		}
+		if _, proxied, err := proxyURL("https://apiserver", target); !proxied || err != nil {
+			t.Errorf("got %v, %v for %s's target %q, want it to go through the proxy", proxied, err, name, target)
+		}
+	}
+}
@@ -18,10 +18,14 @@ package metrics
 
 import (
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
 
+	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/promql"
 
+	"sigs.k8s.io/instrumentation-tools/notstdlib/sets"
 	"sigs.k8s.io/instrumentation-tools/promq/term/plot"
 )
 
@@ -33,14 +37,23 @@ type PromSeriesSet promql.Matrix
 
 // PromResultToPromSeriesSet copies res and converts it to a format suitable
 // for use with the terminal plotting library.  It copies since query results
-// are generally not usable beyond the lifetime of the query.
+// are generally not usable beyond the lifetime of the query.  The series of an
+// instant vector each have the one point.
 func PromResultToPromSeriesSet(res *promql.Result) (plot.SeriesSet, error) {
 	if res.Err != nil {
 		return nil, res.Err
 	}
-	rawSeriesSet, err := res.Matrix()
-	if err != nil {
-		return nil, fmt.Errorf("data was not a Prometheus Matrix: %w", err)
+	var rawSeriesSet promql.Matrix
+	switch value := res.Value.(type) {
+	case promql.Matrix:
+		rawSeriesSet = value
+	case promql.Vector:
+		rawSeriesSet = make(promql.Matrix, len(value))
+		for i, sample := range value {
+			rawSeriesSet[i] = promql.Series{Metric: sample.Metric, Points: []promql.Point{sample.Point}}
+		}
+	default:
+		return nil, fmt.Errorf("data was not a Prometheus Matrix or Vector, but a %s", res.Value.Type())
 	}
 
 	set := make(plot.SeriesSet, len(rawSeriesSet))
@@ -63,6 +76,7 @@ func PromResultToPromSeriesSet(res *promql.Result) (plot.SeriesSet, error) {
 		series := &PromSeries{
 			title: title,
 			id: id,
+			labels: origSeries.Metric.String(),
 		}
 
 		series.points = make([]plot.Point, len(origSeries.Points))
@@ -76,9 +90,65 @@ func PromResultToPromSeriesSet(res *promql.Result) (plot.SeriesSet, error) {
 	return set, nil
 }
 
+// PromResultToHeatmap converts res to a heatmap, if it's the _bucket series of a
+// classic histogram, or a rate of them, i.e. if every series has an le label, and
+// either a name ending in _bucket or none at all.  The buckets with the same le
+// are added up, as 'sum by (le)' would.  (The Prometheus we're built against has
+// no native histograms.)
+func PromResultToHeatmap(res *promql.Result) (*plot.Heatmap, bool) {
+	matrix, isMatrix := res.Value.(promql.Matrix)
+	if res.Err != nil || !isMatrix || len(matrix) == 0 {
+		return nil, false
+	}
+
+	// the buckets count everything up to their bound, so they're cumulative
+	cumulative := make(map[float64]map[int64]float64)
+	times := sets.NewInt64()
+	for _, series := range matrix {
+		if name := series.Metric.Get(labels.MetricName); name != "" && !strings.HasSuffix(name, "_bucket") {
+			return nil, false
+		}
+		bound, err := strconv.ParseFloat(series.Metric.Get(labels.BucketLabel), 64)
+		if err != nil {
+			return nil, false
+		}
+		if cumulative[bound] == nil {
+			cumulative[bound] = make(map[int64]float64)
+		}
+		for _, point := range series.Points {
+			cumulative[bound][point.T] += point.V
+			times.Insert(point.T)
+		}
+	}
+
+	heatmap := &plot.Heatmap{Times: times.List()}
+	for bound := range cumulative {
+		heatmap.Bounds = append(heatmap.Bounds, bound)
+	}
+	sort.Float64s(heatmap.Bounds)
+	heatmap.Counts = make([][]float64, len(heatmap.Bounds))
+	for i, bound := range heatmap.Bounds {
+		heatmap.Counts[i] = make([]float64, len(heatmap.Times))
+		for j, t := range heatmap.Times {
+			count := cumulative[bound][t]
+			if i > 0 {
+				count -= cumulative[heatmap.Bounds[i-1]][t]
+			}
+			// i.e. when the buckets weren't all scraped at quite the same time
+			if count < 0 {
+				count = 0
+			}
+			heatmap.Counts[i][j] = count
+		}
+	}
+	return heatmap, true
+}
+
 type PromSeries struct {
 	title string
 	id plot.SeriesId
+	// labels are the series' labels, which, unlike its id, tell it apart
+	labels string
 	points []plot.Point
 }
 
@@ -89,6 +159,15 @@ func (s *PromSeries) Id() plot.SeriesId {
 	return s.id
 }
 
+// seriesKey is what tells a series apart from the others in the key, its id is only a
+// hash of its labels, which can collide.
+func seriesKey(series plot.Series) string {
+	if s, ok := series.(*PromSeries); ok {
+		return s.labels
+	}
+	return series.Title()
+}
+
 func (s *PromSeries) Points() []plot.Point {
 	return s.points
 }
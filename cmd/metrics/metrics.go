@@ -18,10 +18,13 @@ package metrics
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
-
+	"os"
+	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
@@ -31,18 +34,28 @@ import (
 	"github.com/fatih/color"
 	"github.com/gdamore/tcell"
 	_ "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/config"
 	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/relabel"
+	"github.com/prometheus/prometheus/pkg/textparse"
 	promtime "github.com/prometheus/prometheus/pkg/timestamp"
 	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/storage"
 
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	"k8s.io/client-go/rest"
 	"sigs.k8s.io/instrumentation-tools/cmd/cli"
 	"sigs.k8s.io/instrumentation-tools/notstdlib/sets"
+	"sigs.k8s.io/instrumentation-tools/promq/autocomplete"
 	"sigs.k8s.io/instrumentation-tools/promq/autocomplete/earley"
+	"sigs.k8s.io/instrumentation-tools/promq/autocomplete/service"
+	"sigs.k8s.io/instrumentation-tools/promq/lint"
+	"sigs.k8s.io/instrumentation-tools/promq/lsp"
 	"sigs.k8s.io/instrumentation-tools/promq/prom"
 	"sigs.k8s.io/instrumentation-tools/promq/term"
 	"sigs.k8s.io/instrumentation-tools/promq/term/plot"
+	"sigs.k8s.io/instrumentation-tools/promq/validate"
 )
 
 type MetricsCommand struct {
@@ -50,7 +63,37 @@ type MetricsCommand struct {
 	Period       time.Duration
 	Window       time.Duration
 	outputFormat string
-	sources      DataSources
+	// tableColumns are the labels shown by the table output format
+	tableColumns []string
+	fuzzyMatch   bool
+	// matching loosens how metric and label names are matched
+	matching autocomplete.MatchOptions
+	// maxSuggestions caps how many completions we show at once
+	maxSuggestions  int
+	unstableMetrics earley.UnstableMetricsPolicy
+	// ruleFiles have recording rules to suggest alongside the metrics we scrape
+	ruleFiles []string
+	// history has the queries run before, to suggest them again
+	history *autocomplete.History
+	sources prom.DataSource
+	// IndexFactory makes the index of what we scrape, the in-memory one if it's nil
+	IndexFactory prom.IndexFactory
+	// indexTTL is how long a series can go unscraped before it's dropped from the index
+	indexTTL time.Duration
+	// bell rings the terminal bell when an alert starts firing
+	bell bool
+	// legendStats shows each series' current, min, max and average value in the key
+	legendStats bool
+	// palette is the colors the series are charted in
+	palette term.Palette
+	// sink, if set, has the results we chart appended to it
+	sink *prom.ResultsSink
+	// alignScrapes scrapes on wall clock boundaries rather than whenever
+	alignScrapes bool
+	// prefetch scrapes the targets ahead of each scrape, when they're jittered
+	prefetch func(context.Context, time.Time)
+	// recording is what the scrapes are being recorded to, if anything, closed on exit
+	recording *prom.RecordingSource
 }
 
 const (
@@ -65,19 +108,233 @@ var (
 
 type DataSources struct {
 	sources []prom.DataSource
+	// jitter, if set, spreads the scrapes of the sources over up to this long, in
+	// Prefetch
+	jitter time.Duration
+	// prefetched is what Prefetch scraped for the next scrape, if anything
+	prefetched *prefetchedScrapes
+}
+
+// prefetchedScrapes are the scrapes of the sources Prefetch did ahead of a scrape.
+type prefetchedScrapes struct {
+	mu sync.Mutex
+	// at is the scrape they're for, they're only handed over to it
+	at        time.Time
+	results   [][]prom.ParsedSeries
+	errs      []error
+	malformed []error
 }
 
+// maxConcurrentScrapes is how many targets we scrape at once.
+const maxConcurrentScrapes = 8
+
+// ScrapePrometheusEndpoint scrapes every source at once, well, a few at a time, adding
+// the up series and such of each, like prometheus. If any of them fail, we get the
+// series of the rest, and a prom.PartialScrapeError, which is also how we hear of the
+// lines a lenient scrape skipped.
 func (d DataSources) ScrapePrometheusEndpoint(ctx context.Context, ts time.Time) ([]prom.ParsedSeries, error) {
-	accumMetrics := make([]prom.ParsedSeries, 0)
-	for _, src := range d.sources {
-		m, err := src.ScrapePrometheusEndpoint(ctx, ts)
-		if err != nil {
-			return accumMetrics, err
+	if prefetched := d.takePrefetched(ts); prefetched != nil {
+		return flattenScrapes(prefetched.results), d.scrapeError(prefetched.errs, prefetched.malformed)
+	}
+	results, errs, malformed := d.scrapeEach(ctx, func(int) time.Time { return ts })
+	return flattenScrapes(results), d.scrapeError(errs, malformed)
+}
+
+// Prefetch scrapes each source its jitter after the given scrape, stamping what it
+// scrapes with that time, for the scrape to hand over. It's called ahead of the
+// scrape, with nothing locked, i.e. not the storage the scrape is stored in, so that
+// waiting out the jitter doesn't hold up queries. Without jitter there's nothing to
+// wait for, so it leaves the scrape to scrape the sources.
+func (d DataSources) Prefetch(ctx context.Context, ts time.Time) {
+	if d.jitter <= 0 || d.prefetched == nil {
+		return
+	}
+	results, errs, malformed := d.scrapeEach(ctx, func(i int) time.Time {
+		jitter := prom.ScrapeJitter(sourceName(d.sources[i], i), d.jitter)
+		timer := time.NewTimer(jitter)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+		case <-timer.C:
 		}
+		return ts.Add(jitter)
+	})
+	d.prefetched.mu.Lock()
+	defer d.prefetched.mu.Unlock()
+	d.prefetched.at, d.prefetched.results, d.prefetched.errs, d.prefetched.malformed = ts, results, errs, malformed
+}
+
+// takePrefetched hands over what Prefetch scraped for the scrape at ts, if anything.
+func (d DataSources) takePrefetched(ts time.Time) *prefetchedScrapes {
+	if d.prefetched == nil {
+		return nil
+	}
+	d.prefetched.mu.Lock()
+	defer d.prefetched.mu.Unlock()
+	if d.prefetched.results == nil || !d.prefetched.at.Equal(ts) {
+		return nil
+	}
+	taken := &prefetchedScrapes{at: ts, results: d.prefetched.results, errs: d.prefetched.errs, malformed: d.prefetched.malformed}
+	d.prefetched.results, d.prefetched.errs, d.prefetched.malformed = nil, nil, nil
+	return taken
+}
+
+// scrapeEach scrapes every source at once, well, a few at a time, each once it's
+// waited until the time scrapeTime gives back, which what it scrapes is stamped with,
+// adding the up series and such of each.
+func (d DataSources) scrapeEach(ctx context.Context, scrapeTime func(i int) time.Time) (results [][]prom.ParsedSeries, errs, malformed []error) {
+	results = make([][]prom.ParsedSeries, len(d.sources))
+	errs = make([]error, len(d.sources))
+	malformed = make([]error, len(d.sources))
+	limit := make(chan struct{}, maxConcurrentScrapes)
+	var wg sync.WaitGroup
+	for i, src := range d.sources {
+		wg.Add(1)
+		go func(i int, src prom.DataSource) {
+			defer wg.Done()
+			ts := scrapeTime(i)
+			if err := ctx.Err(); err != nil {
+				errs[i] = err
+				return
+			}
+			limit <- struct{}{}
+			defer func() { <-limit }()
+			start := time.Now()
+			series, err := src.ScrapePrometheusEndpoint(ctx, ts)
+			errs[i], malformed[i] = splitScrapeError(err)
+			if errs[i] != nil {
+				series = nil
+			}
+			health := prom.ScrapeHealth(sourceLabels(src, i), ts, time.Since(start), len(series), errs[i])
+			results[i] = append(series, health...)
+		}(i, src)
+	}
+	wg.Wait()
+	return results, errs, malformed
+}
+
+// flattenScrapes puts the series of each source's scrape together.
+func flattenScrapes(results [][]prom.ParsedSeries) []prom.ParsedSeries {
+	accumMetrics := make([]prom.ParsedSeries, 0)
+	for _, m := range results {
 		accumMetrics = append(accumMetrics, m...)
 	}
+	return accumMetrics
+}
+
+// StreamPrometheusEndpoint streams every source at once, well, a few at a time, adding
+// the series of each, and its up series and such, once it's done, like
+// ScrapePrometheusEndpoint, but without waiting for the rest. A source which fails
+// part of the way through has none of its series added, only its up series, so that
+// it isn't half scraped and down at once. What Prefetch scraped for this scrape is
+// handed over as is.
+func (d DataSources) StreamPrometheusEndpoint(ctx context.Context, ts time.Time, add func(prom.ParsedSeries) error) error {
+	if prefetched := d.takePrefetched(ts); prefetched != nil {
+		for _, ps := range flattenScrapes(prefetched.results) {
+			if err := add(ps); err != nil {
+				return err
+			}
+		}
+		return d.scrapeError(prefetched.errs, prefetched.malformed)
+	}
+	// the sources stream at once, but whatever we're adding to only takes them one at a time
+	var addMu sync.Mutex
+	errs := make([]error, len(d.sources))
+	malformed := make([]error, len(d.sources))
+	limit := make(chan struct{}, maxConcurrentScrapes)
+	var wg sync.WaitGroup
+	for i, src := range d.sources {
+		wg.Add(1)
+		go func(i int, src prom.DataSource) {
+			defer wg.Done()
+			limit <- struct{}{}
+			defer func() { <-limit }()
+			start := time.Now()
+			var series []prom.ParsedSeries
+			err := prom.StreamSource(ctx, src, ts, func(ps prom.ParsedSeries) error {
+				series = append(series, ps)
+				return nil
+			})
+			errs[i], malformed[i] = splitScrapeError(err)
+			if errs[i] != nil {
+				series = nil
+			}
+			addMu.Lock()
+			defer addMu.Unlock()
+			for _, ps := range series {
+				if err := add(ps); err != nil {
+					errs[i], series = err, nil
+					break
+				}
+			}
+			for _, h := range prom.ScrapeHealth(sourceLabels(src, i), ts, time.Since(start), len(series), errs[i]) {
+				if err := add(h); err != nil && errs[i] == nil {
+					errs[i] = err
+				}
+			}
+		}(i, src)
+	}
+	wg.Wait()
+	return d.scrapeError(errs, malformed)
+}
+
+// scrapeError is the prom.PartialScrapeError for the targets which failed to be
+// scraped, and those which had lines skipped, or nil if they're all fine.
+func (d DataSources) scrapeError(errs, malformed []error) error {
+	partial := &prom.PartialScrapeError{Targets: len(d.sources)}
+	for i := range d.sources {
+		if errs[i] != nil {
+			partial.Errors = append(partial.Errors, fmt.Errorf("%s: %w", sourceName(d.sources[i], i), errs[i]))
+		}
+		if malformed[i] != nil {
+			partial.Malformed = append(partial.Malformed, fmt.Errorf("%s: %w", sourceName(d.sources[i], i), malformed[i]))
+		}
+	}
+	if len(partial.Errors) == 0 && len(partial.Malformed) == 0 {
+		return nil
+	}
+	return partial
+}
+
+// splitScrapeError tells why scraping a target failed, if it did, from the lines a
+// lenient scrape of it skipped, which it didn't fail over.
+func splitScrapeError(err error) (failed, malformed error) {
+	var m *prom.MalformedLinesError
+	if errors.As(err, &m) {
+		return nil, err
+	}
+	return err, nil
+}
+
+// sourceName is what we call a source in errors, i.e. the URL it scrapes.
+func sourceName(src prom.DataSource, i int) string {
+	if s, ok := src.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprintf("target %d", i+1)
+}
 
-	return accumMetrics, nil
+// sourceLabels are the labels of the i'th source's target, for its up series and such,
+// at least its instance.
+func sourceLabels(src prom.DataSource, i int) map[string]string {
+	if ts, ok := src.(prom.TargetSource); ok {
+		if ls := ts.TargetLabels(); ls != nil {
+			return ls
+		}
+	}
+	return map[string]string{labels.InstanceName: sourceName(src, i)}
+}
+
+// SetQuery passes the query on to the sources which only fetch what it needs.
+func (d DataSources) SetQuery(query string) error {
+	for _, src := range d.sources {
+		if qs, ok := src.(prom.QueryAwareSource); ok {
+			if err := qs.SetQuery(query); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 func (c *MetricsCommand) getClient() (*http.Client, error) {
@@ -91,129 +348,921 @@ func (c *MetricsCommand) getClient() (*http.Client, error) {
 type httpSource struct {
 	url    string
 	client *http.Client
+	// protobuf asks for the protobuf exposition format rather than OpenMetrics
+	protobuf bool
+	// lenient skips the lines which can't be parsed rather than failing the scrape
+	lenient bool
+	// instance is what we call the target, if not its URL, i.e. the pod:// target
+	// it's the apiserver proxy URL of
+	instance string
+	// labels are added to every series of the target, i.e. the cluster it's in
+	labels map[string]string
+	// headers are sent with every scrape, i.e. for an auth proxy in front of the target
+	headers map[string]string
+	// filter drops the metric families we don't want as the scrape's parsed
+	filter *prom.MetricFilter
 }
 
-func (s *httpSource) getInstanceLabel() map[string]string {
-	return map[string]string{
-		labels.InstanceName: s.url,
+func (s *httpSource) String() string {
+	if s.instance != "" {
+		return s.instance
 	}
+	return s.url
+}
+
+// TargetLabels are the labels every series of the target gets.
+func (s *httpSource) TargetLabels() map[string]string {
+	return prom.TargetLabels(s.String(), s.labels)
 }
 
 func (s *httpSource) ScrapePrometheusEndpoint(ctx context.Context, nowish time.Time) ([]prom.ParsedSeries, error) {
+	metrics := make([]prom.ParsedSeries, 0)
+	err := s.StreamPrometheusEndpoint(ctx, nowish, func(ps prom.ParsedSeries) error {
+		metrics = append(metrics, ps)
+		return nil
+	})
+	if _, ok := prom.ScrapeWarnings(err); !ok {
+		return nil, err
+	}
+	return metrics, err
+}
+
+// StreamPrometheusEndpoint parses the scrape as it comes in, the apiserver's metrics
+// can be dozens of megabytes.
+func (s *httpSource) StreamPrometheusEndpoint(ctx context.Context, nowish time.Time, add func(prom.ParsedSeries) error) error {
 	req, err := http.NewRequestWithContext(ctx, "GET", s.url, nil)
 	if err != nil {
-		return nil, fmt.Errorf("unable to construct metrics HTTP request: %w", err)
+		return fmt.Errorf("unable to construct metrics HTTP request: %w", err)
+	}
+	prom.SetScrapeHeaders(req, s.protobuf)
+	for name, value := range s.headers {
+		req.Header.Set(name, value)
 	}
 	resp, err := s.client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("unable to fetch raw metrics data: %w", err)
+		return fmt.Errorf("unable to fetch raw metrics data: %w", err)
 	}
 	defer resp.Body.Close()
 
-	body, err := ioutil.ReadAll(resp.Body)
+	body, err := prom.OpenScrapeBody(resp)
+	if err != nil {
+		return err
+	}
+
+	stream := prom.NewSeriesStream(body, resp.Header.Get("Content-Type"), nowish, s.TargetLabels())
+	stream.Lenient, stream.Filter = s.lenient, s.filter
+	for stream.Next() {
+		if err := add(stream.At()); err != nil {
+			return err
+		}
+	}
+	if err := stream.Err(); err != nil {
+		return fmt.Errorf("unable to parse metrics: %w", err)
+	}
+	return stream.Malformed()
+}
+
+// this the the hook for the interactive prompt, if we detect an exit string
+// we quit the program, otherwise we will invoke a function with the query
+// string.
+func promptExecutor(execFunc func(string)) prompt.Executor {
+	return func(qs string) {
+		if cli.ExitFunc(qs) {
+			return
+		}
+		execFunc(qs)
+	}
+}
+func (c *MetricsCommand) setupSources(flags cli.PromQFlags) error {
+	// a prometheus server has its own data, it's queried rather than scraped, so none of
+	// what we'd scrape, or where we'd keep it, would be used
+	if flags.PrometheusURL != "" {
+		var conflicting []string
+		for flag, set := range map[string]bool{
+			"--targets":       len(flags.HostNames) > 0,
+			"--component":     len(flags.Components) > 0,
+			"--target-config": flags.TargetConfig != "",
+			"--remote-read":   flags.RemoteRead != "",
+			"--replay":        flags.Replay != "",
+			"--record":        flags.Record != "",
+			"--data-dir":      flags.DataDir != "",
+		} {
+			if set {
+				conflicting = append(conflicting, flag)
+			}
+		}
+		if len(conflicting) > 0 {
+			sort.Strings(conflicting)
+			return fmt.Errorf("--prometheus-url can't be used with %s, the server's queried for its own data rather than anything being scraped", strings.Join(conflicting, ", "))
+		}
+	}
+	// a replay stands in for the endpoints it was recorded from
+	if flags.Replay != "" {
+		if flags.Record != "" {
+			return errors.New("--record can't be used with --replay, which plays back what's been recorded already")
+		}
+		replay, err := prom.NewReplaySource(flags.Replay, flags.ReplaySpeed)
+		if err != nil {
+			return err
+		}
+		c.sources = replay
+		return nil
+	}
+	client, err := c.getClient()
+	if err != nil {
+		return err
+	}
+	// i.e. X-Scope-OrgID, for the targets we scrape directly, and the prometheus (or
+	// Cortex, or Mimir) we query or remote read, the apiserver has no use for them
+	headers, err := prom.ParseHeaders(flags.Headers)
+	if err != nil {
+		return err
+	}
+	// so does a prometheus server, which has its own data
+	if flags.PrometheusURL != "" {
+		api := prom.NewAPIBackend(flags.PrometheusURL, client)
+		api.Headers = headers
+		c.sources = api
+		return nil
+	}
+	// i.e. cluster=prod, so that several clusters can be compared in a single query
+	external, err := prom.ParseExternalLabels(flags.ExternalLabels)
+	if err != nil {
+		return err
+	}
+	// i.e. only apiserver_.*, so that a giant endpoint doesn't fill up memory and
+	// autocompletion with what we don't care about
+	filter, err := prom.NewMetricFilter(flags.MetricAllow, flags.MetricDeny)
+	if err != nil {
+		return err
+	}
+	targets := append([]string(nil), flags.HostNames...)
+	for _, spec := range flags.Components {
+		target, err := componentTarget(spec)
+		if err != nil {
+			return err
+		}
+		targets = append(targets, target)
+	}
+	sources := make([]prom.DataSource, len(targets))
+	for i, url := range targets {
+		// i.e. file:///tmp/dump.txt, from 'kubectl get --raw /metrics > /tmp/dump.txt'
+		if path := strings.TrimPrefix(url, "file://"); path != url {
+			src, err := prom.NewFileSource(path)
+			if err != nil {
+				return err
+			}
+			src.Lenient, src.ExternalLabels, src.Filter = flags.Lenient, external, filter
+			sources[i] = src
+			continue
+		}
+		// i.e. synthetic://sine,walk?seed=42, for demos without a cluster
+		if strings.HasPrefix(url, "synthetic://") {
+			src, err := prom.NewSyntheticSource(url)
+			if err != nil {
+				return err
+			}
+			src.ExternalLabels = external
+			sources[i] = src
+			continue
+		}
+		// i.e. pod://kube-system/coredns-abc:9153, through the apiserver
+		proxied, ok, err := proxyURL(c.RestConfig.Host, url)
+		if err != nil {
+			return err
+		}
+		if ok {
+			sources[i] = &httpSource{url: proxied, client: client, protobuf: flags.Protobuf, lenient: flags.Lenient, filter: filter, instance: url, labels: external}
+			continue
+		}
+		src := &httpSource{url: url, client: client, protobuf: flags.Protobuf, lenient: flags.Lenient, filter: filter, labels: external, headers: headers}
+		sources[i] = src
+	}
+	targetConfigs, err := loadTargetConfigs(flags)
+	if err != nil {
+		return err
+	}
+	// i.e. a node_exporter behind mTLS, which is none of the kubeconfig's business
+	for _, t := range targetConfigs {
+		// the header would silently take the place of the target's own credentials
+		if _, ok := headers["Authorization"]; ok && t.HasAuth() {
+			return fmt.Errorf("unable to send the Authorization --header to %s, it has its own auth in %s", t.URL, flags.TargetConfig)
+		}
+		targetClient, err := config.NewClientFromConfig(t.HTTPClientConfig, "promq")
+		if err != nil {
+			return fmt.Errorf("unable to set up a client for %s: %w", t.URL, err)
+		}
+		// the target's own labels and headers take precedence over the flags'
+		sources = append(sources, &httpSource{url: t.URL, client: targetClient, protobuf: flags.Protobuf, lenient: flags.Lenient, filter: filter, labels: mergeMaps(external, t.Labels), headers: mergeMaps(headers, t.Headers)})
+	}
+	if flags.RemoteRead != "" {
+		remote := prom.NewRemoteReadSource(flags.RemoteRead, client, flags.RemoteReadLookback)
+		remote.Headers = headers
+		sources = append(sources, remote)
+	}
+	if len(sources) == 0 {
+		kubeCfgHost := metricsURL(c.RestConfig.Host)
+		sources = append(sources, &httpSource{url: kubeCfgHost, client: client, protobuf: flags.Protobuf, lenient: flags.Lenient, filter: filter, labels: external})
+	}
+	// a target which hangs or is down shouldn't hold up the rest
+	policy := prom.DefaultRetryPolicy()
+	policy.Timeout, policy.Retries = flags.ScrapeTimeout, flags.ScrapeRetries
+	for i, src := range sources {
+		sources[i] = prom.NewRetryingSource(src, policy)
+	}
+	if flags.ScrapeJitter >= c.Period {
+		return fmt.Errorf("--scrape-jitter (%v) has to be shorter than the scrape period (%v)", flags.ScrapeJitter, c.Period)
+	}
+	targets := DataSources{
+		sources:    sources,
+		jitter:     flags.ScrapeJitter,
+		prefetched: &prefetchedScrapes{},
+	}
+	c.sources, c.prefetch = targets, targets.Prefetch
+	// i.e. two schedulers, one of them the leader
+	if flags.Dedup {
+		c.sources = prom.NewDedupingSource(c.sources, flags.ReplicaLabels...)
+	}
+	relabelConfigs, err := loadRelabelConfigs(flags)
+	if err != nil {
+		return err
+	}
+	if len(relabelConfigs) > 0 {
+		c.sources = prom.NewRelabelingSource(c.sources, relabelConfigs)
+	}
+	if flags.Record != "" {
+		rec, err := prom.NewRecordingSource(c.sources, flags.Record)
+		if err != nil {
+			return err
+		}
+		c.sources, c.recording = rec, rec
+	}
+	return nil
+}
+
+// closeSources closes what the sources have open, i.e. the file the scrapes are being
+// recorded to.
+func (c *MetricsCommand) closeSources() {
+	if c.recording == nil {
+		return
+	}
+	if err := c.recording.Close(); err != nil {
+		c.Eprintf("%s unable to close the recording: %v\n", yellow("warning:"), err)
+	}
+}
+
+// setCompletionOptions picks up how we should autocomplete from the flags.
+func (c *MetricsCommand) setCompletionOptions(flags cli.PromQFlags) error {
+	c.fuzzyMatch = flags.FuzzyMatch
+	c.matching = autocomplete.MatchOptions{IgnoreCase: flags.IgnoreCase, IgnoreSeparators: flags.IgnoreSeparators}
+	c.maxSuggestions = flags.MaxSuggestions
+	c.ruleFiles = flags.RuleFiles
+	c.indexTTL = flags.IndexTTL
+	history, err := autocomplete.NewHistory(flags.HistoryFile, autocomplete.DefaultHistorySize)
+	if err != nil {
+		return err
+	}
+	c.history = history
+	switch flags.UnstableMetrics {
+	case "", "show":
+		c.unstableMetrics = earley.ShowUnstableMetrics
+	case "demote":
+		c.unstableMetrics = earley.DemoteUnstableMetrics
+	case "hide":
+		c.unstableMetrics = earley.HideUnstableMetrics
+	default:
+		return fmt.Errorf("unknown --unstable-metrics %q, expected one of show, demote or hide", flags.UnstableMetrics)
+	}
+	return nil
+}
+
+func (c *MetricsCommand) completerOptions() earley.CompleterOptions {
+	filter := autocomplete.FilterPrefix
+	if c.fuzzyMatch {
+		filter = autocomplete.FilterFuzzy
+	}
+	return earley.CompleterOptions{
+		Filter:          filter,
+		Matching:        c.matching,
+		ScrapeInterval:  c.Period,
+		Window:          c.Window,
+		MaxResults:      c.maxSuggestions,
+		UnstableMetrics: c.unstableMetrics,
+		Sources:         []autocomplete.SuggestionSource{c.history},
+	}
+}
+
+func (c *MetricsCommand) Run(flags cli.PromQFlags) error {
+	c.outputFormat = flags.Output
+	c.tableColumns = flags.TableColumns
+	c.alignScrapes = flags.AlignScrapes
+	if err := c.setCompletionOptions(flags); err != nil {
+		return err
+	}
+	if flags.FormatQuery {
+		c.Fprintf("%s\n", earley.FormatQuery(flags.PromQuery))
+		return nil
+	}
+	// don't bother scraping anything for a query which can't run, we haven't scraped
+	// anything to check its metrics against yet, so that's left to the linter
+	if flags.PromQuery != "" {
+		if err := validate.ValidateQuery(flags.PromQuery, earley.NewPromQLCompleter(prom.NewIndex())).Err(); err != nil {
+			return err
+		}
+	}
+	times, err := c.queryTimes(flags, time.Now())
+	if err != nil {
+		return err
+	}
+	if err := c.setupSources(flags); err != nil {
+		return err
+	}
+	defer c.closeSources()
+
+	metrics, err := c.sources.ScrapePrometheusEndpoint(context.Background(), time.Now())
+	// we can do without some of the targets, but not all of them
+	var partial *prom.PartialScrapeError
+	if errors.As(err, &partial) && len(partial.Errors) < partial.Targets {
+		c.Eprintf("%s %v\n", yellow("warning:"), err)
+	} else if err != nil {
+		return err
+	}
+
+	if flags.List {
+		return c.outputMetricNames(metrics)
+	}
+	if flags.Cardinality {
+		return c.outputCardinality(metrics)
+	}
+	query := flags.PromQuery
+	opts, err := engineOptions(flags, c.Period)
+	if err != nil {
+		return err
+	}
+	wal, resumed, err := c.setupWAL(flags)
+	if err != nil {
+		return err
+	}
+	if wal != nil {
+		// exiting cleanly leaves nothing to resume, dying leaves the WAL
+		defer wal.Discard()
+	}
+	runner, err := c.newRunner(flags, opts)
+	if err != nil {
+		return err
+	}
+	defer runner.Close()
+	// carry on where the last session left off, unless we were given a new query
+	if err := runner.Backfill(resumed.Points); err != nil {
+		return err
+	}
+	if query == "" {
+		query = resumed.Query
+	}
+	if err := c.loadRuleFiles(runner.GetIndex()); err != nil {
+		return err
+	}
+
+	if runner.Alerter, err = loadAlerts(flags); err != nil {
+		return err
+	}
+	c.bell = flags.Bell
+	c.legendStats = flags.LegendStats
+	if c.palette = term.Palettes[flags.Theme]; c.palette == nil {
+		return fmt.Errorf("unknown --theme %q, it can be one of %s", flags.Theme, strings.Join(term.PaletteNames(), ", "))
+	}
+
+	ctx := context.Background()
+	runner.Times = times
+	runner.IndexTTL = c.indexTTL
+	runner.DiscardRawData = flags.DiscardRawData
+	if flags.Compare < 0 {
+		return fmt.Errorf("--compare has to be positive, not %v", flags.Compare)
+	}
+	runner.CompareOffset = flags.Compare
+	if flags.Sink != "" {
+		if !flags.Continuous {
+			return errors.New("--sink is for --continuous, redirect the output to keep it otherwise")
+		}
+		c.sink, err = prom.NewResultsSink(flags.Sink, prom.SinkOptions{
+			Format:      flags.SinkFormat,
+			MaxSize:     flags.SinkMaxSize.Value(),
+			RotateEvery: flags.SinkRotateEvery,
+		})
+		if err != nil {
+			return err
+		}
+		defer c.sink.Close()
+	}
+
+	// scrape in the background from now on, a scrape which fails is tried again next
+	// time, so there's nothing to do with its error
+	if _, err := runner.Start(ctx, prom.ScheduleOptions{Period: c.Period, Align: c.alignScrapes, BeforeScrape: c.prefetch}); err != nil {
+		return err
+	}
+
+	//c := NewPromQLCompleter(index)
+	if flags.Continuous {
+		// it's valid, let's try drawing
+		if err := c.runInteractiveChart(ctx, runner, query); err != nil {
+			return err
+		}
+	} else {
+		if query == "" {
+			query = "{__name__=~\"..*\"}" // match everything
+		}
+		if err := runner.SetQuery(ctx, query); err != nil {
+			return err
+		}
+		if flags.Stats {
+			runner.StatsCallback = func(s prom.QueryStats) {
+				if out, err := prom.FormatStats(s, c.outputFormat); err == nil {
+					c.Eprintf("%s\n", out)
+				}
+			}
+		}
+		// set our callback for our prom engine runner
+		// to an output format string, since we're only
+		// going to return actual datapoints
+		runner.Callback = func(res *promql.Result) error {
+			// the API's format says what went wrong itself, like prometheus would
+			if res.Err != nil && c.outputFormat != "prometheus-api" {
+				return res.Err
+			}
+			var o *string
+			var err error
+			if c.outputFormat == "table" {
+				o, err = prom.ToTable(res, c.tableColumns)
+			} else {
+				o, err = prom.ToPrettyFormat(res, c.outputFormat, true)
+			}
+			if err != nil {
+				return err
+			}
+			c.Fprintf("%s\n", *o)
+			return res.Err
+		}
+		// the prometheus format is a line per series, so thousands of them needn't
+		// all be formatted before the first is printed
+		if c.outputFormat == "prometheus" {
+			runner.Callback = c.streamPrometheusFormat(runner.Callback)
+		}
+		// trigger a scrape
+		if err := runner.Scrape(ctx); err != nil {
+			return err
+		}
+		// now that we've indexed what's out there, we can point out likely mistakes
+		c.Eprintf("%s", lintWarnings(query, runner.GetIndex()))
+	}
+	return nil
+}
+
+// streamPrometheusFormat prints the results in the prometheus format a series at a
+// time, as they're given, and anything which isn't series with other.
+func (c *MetricsCommand) streamPrometheusFormat(other prom.ResultsCallback) prom.ResultsCallback {
+	var typ parser.ValueType
+	return prom.StreamResults(prom.ResultStream{
+		Start: func(t parser.ValueType, warnings storage.Warnings) error {
+			typ = t
+			for _, warning := range warnings {
+				c.Eprintf("warning: %v\n", warning)
+			}
+			return nil
+		},
+		Series: func(series promql.Series) error {
+			c.Fprintf("%s\n", prom.ToPrometheusSeriesFormat(typ, series))
+			return nil
+		},
+		Other: other,
+	})
+}
+
+// setupWAL keeps what an interactive session scrapes, and its query, in the WAL, so
+// that the next session can resume, and gives back what the last session kept if this
+// one's resuming. A prometheus server, or a TSDB in --data-dir, keeps its own data.
+func (c *MetricsCommand) setupWAL(flags cli.PromQFlags) (*prom.WALSource, prom.WALState, error) {
+	var state prom.WALState
+	_, api := c.sources.(*prom.APIBackend)
+	if !flags.Continuous || flags.WALFile == "" || flags.DataDir != "" || api {
+		if flags.Resume {
+			return nil, state, errors.New("--resume needs --continuous and a --wal-file, and doesn't work with --data-dir or --prometheus-url, which keep their own data")
+		}
+		return nil, state, nil
+	}
+	if flags.Resume {
+		var err error
+		if state, err = prom.ReadWAL(flags.WALFile, time.Now().Add(-c.Window)); err != nil {
+			return nil, state, err
+		}
+	} else if info, err := os.Stat(flags.WALFile); err == nil && info.Size() > 0 {
+		// starting over would throw away what --resume needs
+		return nil, state, fmt.Errorf("%s has what a session which died (or is still running) scraped, --resume it, remove it, or give this session its own --wal-file", flags.WALFile)
+	}
+	wal, err := prom.NewWALSource(c.sources, flags.WALFile, c.Window, state)
+	if err != nil {
+		return nil, state, err
+	}
+	c.sources = wal
+	return wal, state, nil
+}
+
+// newRunner keeps what it scrapes in memory, or on disk if we were given somewhere to,
+// unless we're querying a prometheus server.
+func (c *MetricsCommand) newRunner(flags cli.PromQFlags, opts promql.EngineOpts) (*prom.PeriodicData, error) {
+	index, err := c.newIndex()
+	if err != nil {
+		return nil, err
+	}
+	var runner *prom.PeriodicData
+	if api, ok := c.sources.(*prom.APIBackend); ok {
+		runner = prom.NewPeriodicDataWithBackend(api, api)
+	} else if flags.DataDir == "" {
+		budget := prom.Budget{MaxSeries: flags.MaxSeries, MaxBytes: flags.MaxMemory.Value()}
+		runner = prom.NewPeriodicDataWithStorage(c.sources, opts, prom.NewRangeStorageWithBudget(budget))
+	} else {
+		s, err := prom.NewTSDBStorage(flags.DataDir, flags.Retention)
+		if err != nil {
+			return nil, err
+		}
+		runner = prom.NewPeriodicDataWithStorage(c.sources, opts, s)
+	}
+	runner.SetIndex(index)
+	return runner, nil
+}
+
+// engineOptions are the limits our engine runs queries with, from the flags, a query
+// can take as long as the scrape period unless told otherwise.
+func engineOptions(flags cli.PromQFlags, period time.Duration) (promql.EngineOpts, error) {
+	if flags.MaxSamples <= 0 {
+		return promql.EngineOpts{}, fmt.Errorf("--max-samples has to be positive, not %d", flags.MaxSamples)
+	}
+	if flags.LookbackDelta <= 0 {
+		return promql.EngineOpts{}, fmt.Errorf("--lookback-delta has to be positive, not %v", flags.LookbackDelta)
+	}
+	timeout := flags.QueryTimeout
+	if timeout <= 0 {
+		timeout = period
+	}
+	return prom.EngineOptions(timeout, flags.MaxSamples, flags.LookbackDelta), nil
+}
+
+// newIndex makes the index of what we scrape with our index factory, if we have one.
+func (c *MetricsCommand) newIndex() (prom.Indexer, error) {
+	if c.IndexFactory == nil {
+		return prom.NewIndex(), nil
+	}
+	index, err := c.IndexFactory()
+	if err != nil {
+		return nil, fmt.Errorf("unable to create index: %w", err)
+	}
+	return index, nil
+}
+
+// queryTimes works out what times the query is run over from the flags, a rolling
+// window for charts, a fixed range if we were given a start or an end, and otherwise
+// an instant.
+func (c *MetricsCommand) queryTimes(flags cli.PromQFlags, now time.Time) (prom.Range, error) {
+	times := prom.Range{
+		Window:   c.Window,
+		Interval: c.Period,
+		Instant:  !flags.Continuous,
+	}
+	if flags.Start == "" && flags.End == "" {
+		return times, nil
+	}
+	if flags.Continuous {
+		return prom.Range{}, fmt.Errorf("--start and --end can't be used with --continuous, which charts the last %v", c.Window)
+	}
+	times.Instant = false
+	if flags.Step != 0 {
+		times.Interval = flags.Step
+	}
+	var err error
+	if flags.Start != "" {
+		if times.Start, err = prom.ParseTime(flags.Start, now); err != nil {
+			return prom.Range{}, fmt.Errorf("invalid --start: %w", err)
+		}
+	}
+	if flags.End != "" {
+		if times.End, err = prom.ParseTime(flags.End, now); err != nil {
+			return prom.Range{}, fmt.Errorf("invalid --end: %w", err)
+		}
+	}
+	if err := times.Validate(now); err != nil {
+		return prom.Range{}, err
+	}
+	return times, nil
+}
+
+// RunRuleTests runs the promql_expr_test of 'promtool test rules' unit test files,
+// and reports how they went like promtool does.
+func (c *MetricsCommand) RunRuleTests(files []string) error {
+	ctx := context.Background()
+	failed := false
+	for _, path := range files {
+		c.Fprintf("Unit Testing:  %s\n", path)
+		file, err := prom.LoadRuleTestFile(path)
+		if err != nil {
+			c.Fprintf("  FAILED:\n    %v\n", err)
+			failed = true
+			continue
+		}
+		failures, err := file.Run(ctx)
+		if err != nil {
+			failures = append(failures, err)
+		}
+		if len(failures) == 0 {
+			c.Fprintf("  SUCCESS\n")
+			continue
+		}
+		failed = true
+		c.Fprintf("  FAILED:\n")
+		for _, failure := range failures {
+			c.Fprintf("    %v\n", failure)
+		}
+	}
+	if failed {
+		return errors.New("some rule tests failed")
+	}
+	return nil
+}
+
+// RunLanguageServer speaks the language server protocol over stdin and stdout, so that
+// editors can complete queries against the metrics our sources expose.
+func (c *MetricsCommand) RunLanguageServer(flags cli.PromQFlags) error {
+	if err := c.setCompletionOptions(flags); err != nil {
+		return err
+	}
+	if err := c.setupSources(flags); err != nil {
+		return err
+	}
+	defer c.closeSources()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// we don't run queries, so there's no need for a prometheus engine, just an index
+	index, err := c.newIndex()
+	if err != nil {
+		return err
+	}
+	if err := c.loadRuleFiles(index); err != nil {
+		return err
+	}
+	go c.indexSources(ctx, index)
+
+	server := lsp.NewServer(earley.NewPromQLCompleterWithOptions(index, c.completerOptions()))
+	return server.Serve(ctx, c.Streams.In, c.Streams.Out)
+}
+
+// RunAutocompleteServer serves autocompletion over HTTP, against the metrics our
+// sources expose, until it fails.
+func (c *MetricsCommand) RunAutocompleteServer(flags cli.PromQFlags) error {
+	if err := c.setCompletionOptions(flags); err != nil {
+		return err
+	}
+	if err := c.setupSources(flags); err != nil {
+		return err
+	}
+	defer c.closeSources()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	index, err := c.newIndex()
+	if err != nil {
+		return err
+	}
+	if err := c.loadRuleFiles(index); err != nil {
+		return err
+	}
+	go c.indexSources(ctx, index)
+
+	listener, err := net.Listen("tcp", flags.ListenAddress)
+	if err != nil {
+		return fmt.Errorf("unable to listen on %s: %w", flags.ListenAddress, err)
+	}
+	c.Eprintf("serving autocompletion on http://%s/complete\n", listener.Addr())
+	handler := service.NewHandler(earley.NewPromQLCompleterWithOptions(index, c.completerOptions()))
+	return http.Serve(listener, handler)
+}
+
+// indexSources scrapes our sources into the index every period, starting straight
+// away, until the context is done.
+func (c *MetricsCommand) indexSources(ctx context.Context, index prom.Indexer) {
+	ticker := time.NewTicker(c.Period)
+	defer ticker.Stop()
+	var lastExpired time.Time
+	for {
+		now := time.Now()
+		metrics, err := c.sources.ScrapePrometheusEndpoint(ctx, now)
+		if err != nil {
+			// stdout is the editor's, and what we did get is still worth indexing
+			c.Eprintf("unable to scrape metrics: %v\n", err)
+		}
+		for _, m := range metrics {
+			index.UpdateMetric(m)
+		}
+		if _, ok := prom.ScrapeWarnings(err); ok {
+			index.EndScrape(prom.PromTimestamp(now))
+		}
+		// it's a walk over every series, so not worth doing every time
+		if c.indexTTL > 0 && now.Sub(lastExpired) >= time.Minute {
+			index.Expire(prom.PromTimestamp(now.Add(-c.indexTTL)))
+			lastExpired = now
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// loadRuleFiles indexes the recording rules of the rules files we were given.
+func (c *MetricsCommand) loadRuleFiles(index prom.Indexer) error {
+	for _, path := range c.ruleFiles {
+		if _, err := loadRules(index, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadRelabelConfigs loads the relabel configs from the file we were given, if any,
+// and adds one for the labels we were told to drop.
+func loadRelabelConfigs(flags cli.PromQFlags) ([]*relabel.Config, error) {
+	var configs []*relabel.Config
+	if flags.RelabelConfig != "" {
+		data, err := ioutil.ReadFile(flags.RelabelConfig)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read relabel configs: %w", err)
+		}
+		configs, err = prom.ParseRelabelConfigs(data)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load relabel configs from %s: %w", flags.RelabelConfig, err)
+		}
+	}
+	if len(flags.DropLabels) > 0 {
+		configs = append(configs, prom.DropLabelsConfig(flags.DropLabels...))
+	}
+	return configs, nil
+}
+
+// mergeMaps merges sets of labels, or headers, the later ones taking precedence.
+func mergeMaps(sets ...map[string]string) map[string]string {
+	merged := map[string]string{}
+	for _, ls := range sets {
+		for name, value := range ls {
+			merged[name] = value
+		}
+	}
+	return merged
+}
+
+// loadTargetConfigs loads the targets to scrape with their own TLS and auth from the
+// file we were given, if any.
+func loadTargetConfigs(flags cli.PromQFlags) ([]prom.TargetConfig, error) {
+	if flags.TargetConfig == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(flags.TargetConfig)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read target configs: %w", err)
+	}
+	targets, err := prom.ParseTargetConfigs(data, filepath.Dir(flags.TargetConfig))
+	if err != nil {
+		return nil, fmt.Errorf("unable to load target configs from %s: %w", flags.TargetConfig, err)
+	}
+	return targets, nil
+}
+
+// loadAlerts loads the alerting rules of the rules files we were given, and the ad-hoc
+// alerts, if there are any.
+func loadAlerts(flags cli.PromQFlags) (*prom.Alerter, error) {
+	var rules []prom.AlertingRule
+	for _, path := range flags.RuleFiles {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read rules: %w", err)
+		}
+		fileRules, err := prom.ParseAlertingRules(data)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load rules from %s: %w", path, err)
+		}
+		rules = append(rules, fileRules...)
+	}
+	for _, spec := range flags.Alerts {
+		rule, err := prom.ParseAlert(spec)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	return prom.NewAlerter(rules)
+}
+
+// loadRules indexes the recording rules of a prometheus rules file, so that we suggest
+// them like any other metric, and returns how many there were.
+func loadRules(index prom.Indexer, path string) (int, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("unable to read rules: %w", err)
+	}
+	// they're never scraped, so a zero timestamp keeps them from expiring
+	series, err := prom.ParseRecordingRules(data, time.Unix(0, 0))
 	if err != nil {
-		return nil, fmt.Errorf("unable to read metrics response body: %w", err)
+		return 0, fmt.Errorf("unable to load rules from %s: %w", path, err)
 	}
+	for _, s := range series {
+		index.UpdateMetric(s)
+	}
+	return len(series), nil
+}
 
-	metrics, err := prom.ParseTextDataWithAdditionalLabels(body, nowish, s.getInstanceLabel())
+// rulesCommand handles ':rules', which only knows how to load rules files so far.
+func rulesCommand(index prom.Indexer, args []string) string {
+	if len(args) != 2 || args[0] != "load" {
+		return "usage: :rules load <file>\n"
+	}
+	n, err := loadRules(index, args[1])
 	if err != nil {
-		return nil, fmt.Errorf("unable to parse metrics: %w", err)
+		return fmt.Sprintf("%v\n", err)
 	}
-	return metrics, nil
+	return fmt.Sprintf("loaded %d recording rules from %s\n", n, args[1])
 }
 
-// this the the hook for the interactive prompt, if we detect an exit string
-// we quit the program, otherwise we will invoke a function with the query
-// string.
-func promptExecutor(execFunc func(string)) prompt.Executor {
-	return func(qs string) {
-		if cli.ExitFunc(qs) {
-			return
-		}
-		execFunc(qs)
+// diffCommand handles ':diff', which lists the series which appeared and disappeared
+// between the last two scrapes, of every metric or just the given one.
+func diffCommand(index prom.Indexer, args []string) string {
+	if len(args) > 1 {
+		return "usage: :diff [metric]\n"
 	}
+	churn := index.Churn()
+	if len(args) == 1 {
+		churn = churn.ForMetric(args[0])
+	}
+	return prom.FormatChurn(churn, maxDiffSeries)
 }
-func (c *MetricsCommand) setupSources(flags cli.PromQFlags) error {
-	client, err := c.getClient()
-	if err != nil {
-		return err
+
+// maxDiffSeries is how many of the series which appeared, and disappeared, ':diff'
+// lists, a label explosion would otherwise scroll everything else away.
+const maxDiffSeries = 20
+
+// exportCommand writes everything we've stored to a file in the OpenMetrics format.
+func exportCommand(ctx context.Context, runner *prom.PeriodicData, args []string) string {
+	if len(args) != 1 {
+		return "usage: :export <file>\n"
 	}
-	sources := make([]prom.DataSource, len(flags.HostNames))
-	for i, url := range flags.HostNames {
-		src := &httpSource{url: url, client: client}
-		sources[i] = src
+	f, err := os.Create(args[0])
+	if err != nil {
+		return fmt.Sprintf("unable to export: %v\n", err)
 	}
-	if len(sources) == 0 {
-		kubeCfgHost := metricsURL(c.RestConfig.Host)
-		sources = append(sources, &httpSource{url: kubeCfgHost, client: client})
+	n, err := runner.Export(ctx, f)
+	if closeErr := f.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("unable to write the export: %w", closeErr)
 	}
-	c.sources = DataSources{
-		sources: sources,
+	if err != nil {
+		return fmt.Sprintf("%v\n", err)
 	}
-	return nil
+	return fmt.Sprintf("exported %d series to %s (hint: 'promtool tsdb create-blocks-from openmetrics %s' backfills them into a prometheus)\n", n, args[0], args[0])
 }
 
-func (c *MetricsCommand) Run(flags cli.PromQFlags) error {
-	c.outputFormat = flags.Output
-	if err := c.setupSources(flags); err != nil {
-		return err
-	}
+// queryRunner is what running a query from the prompt needs of the runner.
+type queryRunner interface {
+	SetQuery(ctx context.Context, query string) error
+	GetIndex() prom.Indexer
+}
 
-	metrics, err := c.sources.ScrapePrometheusEndpoint(context.Background(), time.Now())
-	if err != nil {
-		return err
-	}
+// queryHistory is what running a query from the prompt needs of the completer.
+type queryHistory interface {
+	RecordQuery(query string)
+	Explain(query string) string
+}
 
-	if flags.List {
-		return c.outputMetricNames(metrics)
+// runQuery makes the query the one plotted, and adds it to the history, returning
+// what to tell about it and whether it was valid.
+func runQuery(ctx context.Context, runner queryRunner, history queryHistory, query string) (string, bool) {
+	if err := runner.SetQuery(ctx, query); err != nil {
+		return fmt.Sprintf("Unable to set query: %v\n", err) + history.Explain(query), false
 	}
-	query := flags.PromQuery
-	timeoutDur := c.Period
-	runner := prom.NewPeriodicData(c.sources, prom.DefaultEngineOptions(timeoutDur, 100000))
-
-	ctx := context.Background()
-	runner.Times = prom.Range{
-		Window:   c.Window,
-		Interval: c.Period,
-		Instant:  !flags.Continuous,
+	history.RecordQuery(query)
+	msg := fmt.Sprintf("Plotting %q...\n", query)
+	if strings.Contains(query, "\n") {
+		msg = fmt.Sprintf("Plotting\n%s\n", query)
 	}
+	return msg + lintWarnings(query, runner.GetIndex()), true
+}
 
-	// asyncronously trigger scrape
-	go c.scrape(ctx, runner)
-
-	//c := NewPromQLCompleter(index)
-	if flags.Continuous {
-		// it's valid, let's try drawing
-		if err := c.runInteractiveChart(ctx, runner, query); err != nil {
-			return err
-		}
-	} else {
-		if query == "" {
-			query = "{__name__=~\"..*\"}" // match everything
-		}
-		if err := runner.SetQuery(ctx, query); err != nil {
-			return err
-		}
-		// set our callback for our prom engine runner
-		// to an output format string, since we're only
-		// going to return actual datapoints
-		runner.Callback = func(res *promql.Result) error {
-			if res.Err != nil {
-				return res.Err
-			}
-			o, err := prom.ToPrettyFormat(res, c.outputFormat, true)
-			if err != nil {
-				return err
-			}
-			c.Fprintf("%s\n", *o)
-			return nil
-		}
-		// trigger a scrape
-		if err := runner.Scrape(ctx); err != nil {
-			return err
-		}
+// fmtCommand formats a query and plots it in place of the current one, so that the
+// query in the history is the formatted one.
+func fmtCommand(ctx context.Context, runner queryRunner, history queryHistory, query string) (string, bool) {
+	formatted := earley.FormatQuery(query)
+	if formatted == "" {
+		return "usage: :fmt <query>\n", false
 	}
-	return nil
+	return runQuery(ctx, runner, history, formatted)
 }
 
 func (c *MetricsCommand) triggerPrompt(ctx context.Context, runner *prom.PeriodicData, timeoutDur time.Duration, updateText chan string, comp func(prompt.Document) []prompt.Suggest) {
@@ -249,7 +1298,7 @@ func (c *MetricsCommand) outputMetricNames(metrics []prom.ParsedSeries) error {
 			// create a ordered list from the keys
 			keys := getSortedKeys(labelsMap)
 			// create our output string for this metric. use set for uniqueness
-			metricNames.Insert(fmt.Sprintf("%s { %s }", cyan(n), yellow(strings.Join(keys, ", "))))
+			metricNames.Insert(fmt.Sprintf("%s%s { %s }", cyan(n), metadataSuffix(m), yellow(strings.Join(keys, ", "))))
 		}
 	}
 	// iterate through a sorted list of our set (our output is deterministic).
@@ -259,6 +1308,46 @@ func (c *MetricsCommand) outputMetricNames(metrics []prom.ParsedSeries) error {
 	return nil
 }
 
+// maxCardinalityReport is how many metrics and labels the cardinality report lists.
+const maxCardinalityReport = 10
+
+func (c *MetricsCommand) outputCardinality(metrics []prom.ParsedSeries) error {
+	index := prom.NewIndex()
+	for _, m := range metrics {
+		index.UpdateMetric(m)
+	}
+	card := index.GetCardinality(maxCardinalityReport)
+	c.Fprintf("%d series, %d label pairs\n\n", card.TotalSeries, card.TotalLabelPairs)
+	c.Fprintf("metrics with the most series:\n")
+	for _, m := range card.SeriesCountByMetricName {
+		var labelCounts []string
+		for _, l := range index.GetLabelCardinalityForMetric(m.Name) {
+			labelCounts = append(labelCounts, fmt.Sprintf("%s: %d", l.Name, l.Count))
+		}
+		c.Fprintf("%8d %s { %s }\n", m.Count, cyan(m.Name), yellow(strings.Join(labelCounts, ", ")))
+	}
+	c.Fprintf("\nlabels with the most values:\n")
+	for _, l := range card.LabelValueCountByLabelName {
+		c.Fprintf("%8d %s\n", l.Count, yellow(l.Name))
+	}
+	return nil
+}
+
+// metadataSuffix says what type a series' metric is, and its unit, if we know.
+func metadataSuffix(m prom.ParsedSeries) string {
+	var metadata []string
+	if m.Type != "" && m.Type != textparse.MetricTypeUnknown {
+		metadata = append(metadata, string(m.Type))
+	}
+	if m.Unit != "" {
+		metadata = append(metadata, m.Unit)
+	}
+	if len(metadata) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(metadata, ", ") + ")"
+}
+
 func getSortedKeys(m map[string]string) []string {
 	keys := make([]string, 0)
 	for k, _ := range m {
@@ -270,15 +1359,57 @@ func getSortedKeys(m map[string]string) []string {
 
 // we are going to assume that the query here is valid
 func (c *MetricsCommand) runInteractiveChart(ctx context.Context, runner *prom.PeriodicData, qs string) error {
-	ac := NewCompleter(earley.NewPromQLCompleter(runner.GetIndex()))
+	ac := NewCompleter(earley.NewPromQLCompleterWithOptions(runner.GetIndex(), c.completerOptions()))
 	comp := ac.Complete
 
-	makeView := func(promptView term.View, keyView term.View, graph *plot.PlatonicGraph, keySize int) *term.SplitView {
+	// what we chart of what we keep, which is zoomed and panned, and which the
+	// labels of the time axis are chosen for
+	var viewMu sync.Mutex
+	view := prom.View{Window: c.Window}
+
+	// what the mouse has picked out: the series whose key was clicked, and the
+	// point on the graph which was, along with the key & graph they're shown in,
+	// and the table shown instead of the graph in ':table' mode, or the bars shown
+	// for an instant vector (i.e. in ':bars' mode), or the heatmap shown for the
+	// buckets of a histogram in ':heatmap' mode
+	var mouseMu sync.Mutex
+	var highlighted string
+	var crosshair *term.GraphPoint
+	var shownKey *term.TextBox
+	var shownGraph *term.GraphView
+	var tableMode bool
+	var heatmapMode bool
+	var shownTable *term.TableView
+	var shownBars *term.BarsView
+
+	// which series are hidden from the graph, and the order they're listed in the
+	// key, which ctrl+↑/↓ selects (i.e. highlights) a series from, for space to
+	// hide or show and enter to solo, until some other key's pressed. They're all
+	// by seriesKey, and keySeriesIds are the ids they're drawn with.
+	var hidden map[string]bool
+	var keySeries []string
+	var keySeriesIds map[string]plot.SeriesId
+	var selecting bool
+	// the colors are handed out to the series in the key, by their labels
+	keyPalette := c.palette
+	highlightedId := func() plot.SeriesId {
+		if id, ok := keySeriesIds[highlighted]; ok {
+			return id
+		}
+		return plot.NoSeries
+	}
+
+	makeView := func(promptView term.View, keyView *term.TextBox, graph *plot.PlatonicGraph, table *term.TableView, bars *term.BarsView, heatmap *term.HeatmapView, keySize int) *term.SplitView {
 		if keyView == nil {
 			keyView = &term.TextBox{}
 		}
+		mouseMu.Lock()
+		defer mouseMu.Unlock()
 		graphView := &term.GraphView{
-			Graph: graph,
+			Graph:       graph,
+			Highlighted: highlightedId(),
+			Crosshair:   crosshair,
+			Palette:     keyPalette,
 			RangeLabeler: func(v float64) string {
 				return fmt.Sprintf("%5.5g", v)
 			},
@@ -287,17 +1418,20 @@ func (c *MetricsCommand) runInteractiveChart(ctx context.Context, runner *prom.P
 				// NB: time.Format uses a "canonical time" of 1 2 3 4 5 6 -7,
 				// because this is clearly easier to read out of context than
 				// mm:ss and such :-/
+				viewMu.Lock()
+				span := view.Window
+				viewMu.Unlock()
 				switch {
-				case c.Window >= 10*24*time.Hour:
+				case span >= 10*24*time.Hour:
 					// span is in days, show month/day
 					return promtime.Time(v).Format("Jan _2")
-				case c.Window >= 24*time.Hour:
+				case span >= 24*time.Hour:
 					// span is in short number of days, show day/hour
 					return promtime.Time(v).Format("_2 15h")
-				case c.Window >= 1*time.Hour:
+				case span >= 1*time.Hour:
 					// span is in hours, show hours/minutes
 					return promtime.Time(v).Format("15:04")
-				case c.Window >= 1*time.Minute:
+				case span >= 1*time.Minute:
 					// span is in minutes, show minutes/seconds
 					return promtime.Time(v).Format("04:05")
 				default:
@@ -306,13 +1440,25 @@ func (c *MetricsCommand) runInteractiveChart(ctx context.Context, runner *prom.P
 				}
 			},
 		}
+		shownKey, shownGraph, shownTable, shownBars = keyView, graphView, table, bars
+		var mainView term.View = graphView
+		switch {
+		case table != nil:
+			mainView = table
+		case bars != nil:
+			bars.Highlighted = highlightedId()
+			mainView = bars
+		case heatmap != nil:
+			heatmap.DomainLabeler = graphView.DomainLabeler
+			mainView = heatmap
+		}
 		return &term.SplitView{
 			DockSize: 9,
 			Dock: term.PosBelow,
 			Docked: promptView,
 			Flexed: &term.SplitView{
 				Docked: keyView,
-				Flexed: graphView,
+				Flexed: mainView,
 
 				Dock: term.PosLeft,
 				DockSize: keySize,
@@ -323,6 +1469,30 @@ func (c *MetricsCommand) runInteractiveChart(ctx context.Context, runner *prom.P
 
 	var axesMu sync.Mutex
 	lastAxes := plot.AutoAxes()
+	// reset the axes when we change query, or what's shown of it
+	resetAxes := func() {
+		axesMu.Lock()
+		lastAxes = plot.AutoAxes()
+		axesMu.Unlock()
+	}
+
+	// changing the view waits for any scrape in progress, so it's done in the
+	// background, a change at a time
+	var changeMu sync.Mutex
+	changeView := func(change func(prom.View) prom.View) {
+		changeMu.Lock()
+		defer changeMu.Unlock()
+		viewMu.Lock()
+		changed := change(view)
+		viewMu.Unlock()
+
+		runner.SetView(changed)
+		viewMu.Lock()
+		view = changed
+		viewMu.Unlock()
+		// a failed query is shown on the next scrape anyway
+		_ = runner.Requery(ctx)
+	}
 
 	promptView := &term.PromptView{
 		SetupPrompt: func(requiredOpts ...prompt.Option) *prompt.Prompt {
@@ -340,6 +1510,78 @@ func (c *MetricsCommand) runInteractiveChart(ctx context.Context, runner *prom.P
 			if input == "" {
 				return nil, false
 			}
+			// i.e. ':fmt sum(rate(foo[5m]))', which plots the query formatted, but not
+			// ':fmtx', which is no command of ours
+			if query := strings.TrimPrefix(input, ":fmt"); query != input && (query == "" || query[0] == ' ') {
+				msg, ok := fmtCommand(ctx, runner, ac, query)
+				if ok {
+					resetAxes()
+				}
+				return &msg, false
+			}
+			// i.e. ':rules load rules.yaml', after which we suggest its recording rules
+			if args := strings.Fields(input); len(args) > 0 && args[0] == ":rules" {
+				msg := rulesCommand(runner.GetIndex(), args[1:])
+				return &msg, false
+			}
+			// i.e. ':diff kube_pod_info', to see which pods came and went since the last scrape
+			if args := strings.Fields(input); len(args) > 0 && args[0] == ":diff" {
+				msg := diffCommand(runner.GetIndex(), args[1:])
+				return &msg, false
+			}
+			// i.e. ':export scraped.om', for promtool to backfill into a prometheus
+			if args := strings.Fields(input); len(args) > 0 && args[0] == ":export" {
+				msg := exportCommand(ctx, runner, args[1:])
+				return &msg, false
+			}
+			// i.e. ':table', to see the latest sample of each series rather than their
+			// graph, until ':table' again
+			if input == ":table" {
+				mouseMu.Lock()
+				tableMode = !tableMode
+				msg := "Back to the graph\n"
+				if tableMode {
+					msg = "Showing the latest sample of each series (shift+↑/↓ scrolls, shift+←/→ sorts)\n"
+				}
+				mouseMu.Unlock()
+				go func() {
+					// a failed query is shown on the next scrape anyway
+					_ = runner.Requery(ctx)
+				}()
+				return &msg, false
+			}
+			// i.e. ':heatmap', to see the buckets of a histogram (i.e. 'rate(foo_bucket[5m])')
+			// shaded by how many observations fell in them rather than their graph, until
+			// ':heatmap' again
+			if input == ":heatmap" {
+				mouseMu.Lock()
+				heatmapMode = !heatmapMode
+				msg := "Back to the graph\n"
+				if heatmapMode {
+					msg = "Showing the buckets of a histogram as a heatmap\n"
+				}
+				mouseMu.Unlock()
+				go func() {
+					// a failed query is shown on the next scrape anyway
+					_ = runner.Requery(ctx)
+				}()
+				return &msg, false
+			}
+			// i.e. ':bars', to see the latest value of each series as a bar, as an instant
+			// query, until ':bars' again
+			if input == ":bars" {
+				msg := "Back to the graph\n"
+				viewMu.Lock()
+				if !view.Instant {
+					msg = "Showing the latest value of each series as a bar\n"
+				}
+				viewMu.Unlock()
+				go changeView(func(v prom.View) prom.View {
+					v.Instant = !v.Instant
+					return v
+				})
+				return &msg, false
+			}
 			if input[0] == ':' {
 				switch input {
 				case ":quit", ":q":
@@ -350,15 +1592,11 @@ func (c *MetricsCommand) runInteractiveChart(ctx context.Context, runner *prom.P
 				}
 			}
 
-			if err := runner.SetQuery(ctx, input); err != nil {
-				msg := fmt.Sprintf("Unable to set query: %v\n", err)
+			msg, ok := runQuery(ctx, runner, ac, input)
+			if !ok {
 				return &msg, false
 			}
-			axesMu.Lock()
-			lastAxes = plot.AutoAxes()  // reset the axes when we change query
-			axesMu.Unlock()
-
-			msg := fmt.Sprintf("Plotting %q...\n", input)
+			resetAxes()
 			if input == "quit" {
 				msg += "(hint: use \":quit\" to quit)\n"
 			}
@@ -368,35 +1606,278 @@ func (c *MetricsCommand) runInteractiveChart(ctx context.Context, runner *prom.P
 		},
 	}
 
-	termRunner := &term.Runner{
-		KeyHandler: promptView.HandleKey,
+	zoom := func(by float64) {
+		changeView(func(v prom.View) prom.View {
+			v.Window = zoomWindow(v.Window, by, c.Period, c.Window)
+			return v
+		})
+	}
+	pan := func(by float64) {
+		changeView(func(v prom.View) prom.View {
+			return panView(v, by, time.Now())
+		})
 	}
+
+	termRunner := &term.Runner{}
 	promptView.Screen = termRunner
 
-	runner.Callback = func(res *promql.Result) error {
-		// expecting a matrix
-		_, err := res.Matrix()
-		if err != nil {
-			// TODO: signal to terminal
-			return err
+	// chartKey handles shift and the arrows, which zoom and pan the graph, or scroll
+	// and sort the table, page up and down, which scroll the key (as do shift and
+	// home and end, which are otherwise the prompt's), and ctrl and up and down, which
+	// select a series in the key to hide or solo, saying whether it did
+	chartKey := func(evt *tcell.EventKey) bool {
+		shifted := evt.Modifiers()&tcell.ModShift != 0
+		mouseMu.Lock()
+		defer mouseMu.Unlock()
+		switch key := evt.Key(); {
+		case evt.Modifiers()&tcell.ModCtrl != 0 && (key == tcell.KeyUp || key == tcell.KeyDown):
+			by := 1
+			if key == tcell.KeyUp {
+				by = -1
+			}
+			highlighted = stepSeries(keySeries, highlighted, by)
+			selecting = highlighted != ""
+			shownGraph.Highlighted = highlightedId()
+			if shownBars != nil {
+				shownBars.Highlighted = highlightedId()
+			}
+			// the key's redrawn with the selection on the next update
+			go func() {
+				_ = runner.Requery(ctx)
+			}()
+			return true
+		case selecting && highlighted != "" && (key == tcell.KeyEnter || key == tcell.KeyRune && evt.Rune() == ' '):
+			if key == tcell.KeyEnter {
+				hidden = soloSeries(keySeries, hidden, highlighted)
+			} else {
+				hidden = toggleSeries(hidden, highlighted)
+			}
+			// what's left is rescaled to fit
+			resetAxes()
+			go func() {
+				_ = runner.Requery(ctx)
+			}()
+			return true
+		case selecting && key == tcell.KeyEscape:
+			selecting = false
+			go func() {
+				_ = runner.Requery(ctx)
+			}()
+			return true
+		case key == tcell.KeyPgUp || key == tcell.KeyPgDn, shifted && (key == tcell.KeyHome || key == tcell.KeyEnd):
+			shownKey.HandleKey(evt)
+			termRunner.RequestRepaint()
+			return true
+		case !shifted:
+			return false
+		}
+		if shownTable == nil {
+			switch evt.Key() {
+			case tcell.KeyUp:
+				go zoom(0.5)
+			case tcell.KeyDown:
+				go zoom(2)
+			case tcell.KeyLeft:
+				go pan(-0.5)
+			case tcell.KeyRight:
+				go pan(0.5)
+			default:
+				return false
+			}
+			return true
+		}
+		switch evt.Key() {
+		case tcell.KeyUp:
+			shownTable.ScrollBy(-1)
+		case tcell.KeyDown:
+			shownTable.ScrollBy(1)
+		case tcell.KeyLeft:
+			stepSort(shownTable, -1)
+		case tcell.KeyRight:
+			stepSort(shownTable, 1)
+		default:
+			return false
+		}
+		termRunner.RequestRepaint()
+		return true
+	}
+	// every other key is for the prompt, and stops selecting series from the key
+	termRunner.KeyHandler = func(evt *tcell.EventKey) {
+		if !chartKey(evt) {
+			mouseMu.Lock()
+			selecting = false
+			mouseMu.Unlock()
+			promptView.HandleKey(evt)
+		}
+	}
+
+	// the wheel zooms (or scrolls the table), clicking a series' key highlights it
+	// (and clicking it again stops), clicking the graph marks a point with a
+	// crosshair, right-clicking clears both, and clicking a column of the table
+	// sorts it by that column
+	termRunner.MouseHandler = func(evt *tcell.EventMouse) {
+		col, row := evt.Position()
+		mouseMu.Lock()
+		defer mouseMu.Unlock()
+		switch buttons := evt.Buttons(); {
+		case buttons&tcell.WheelUp != 0 && shownTable != nil:
+			shownTable.ScrollBy(-tableScrollRows)
+		case buttons&tcell.WheelDown != 0 && shownTable != nil:
+			shownTable.ScrollBy(tableScrollRows)
+		case buttons&tcell.WheelUp != 0:
+			go zoom(0.5)
+		case buttons&tcell.WheelDown != 0:
+			go zoom(2)
+		case buttons&tcell.Button3 != 0:
+			highlighted, crosshair = "", nil
+		case buttons&tcell.Button1 != 0 && shownTable != nil:
+			if column, isHeader := shownTable.ColumnAt(col, row); isHeader {
+				shownTable.SortBy(column)
+			}
+		case buttons&tcell.Button1 != 0:
+			if key, isKey := shownKey.TagAt(col, row).(string); isKey {
+				if key == highlighted {
+					key = ""
+				}
+				highlighted = key
+			} else if pt, onGraph := shownGraph.PointAt(col, row); onGraph {
+				crosshair = &pt
+			}
+		default:
+			return
+		}
+		shownGraph.Highlighted, shownGraph.Crosshair = highlightedId(), crosshair
+		if shownBars != nil {
+			shownBars.Highlighted = highlightedId()
+		}
+		termRunner.RequestRepaint()
+	}
+
+	// the counter resets over the graph, so that we can say why a rate spikes
+	var resetsMu sync.Mutex
+	var lastResets []prom.CounterReset
+	runner.ResetsCallback = func(resets []prom.CounterReset) {
+		resetsMu.Lock()
+		defer resetsMu.Unlock()
+		lastResets = resets
+	}
+
+	// the active alerts, for the status pane, ringing the bell when one starts firing
+	var alertsMu sync.Mutex
+	var lastAlerts []prom.Alert
+	firing := sets.NewString()
+	runner.AlertsCallback = func(alerts []prom.Alert) {
+		alertsMu.Lock()
+		defer alertsMu.Unlock()
+		lastAlerts = alerts
+		nowFiring := sets.NewString()
+		for _, alert := range alerts {
+			if alert.State == prom.AlertFiring {
+				nowFiring.Insert(alert.Labels.String())
+			}
+		}
+		if c.bell && !firing.IsSuperset(nowFiring) {
+			c.Eprintf("\a")
 		}
-		// transform data in a better structure.
+		firing = nowFiring
+	}
+
+	// what the last query took, for the bottom of the key
+	var statsMu sync.Mutex
+	var lastStats *prom.QueryStats
+	runner.StatsCallback = func(s prom.QueryStats) {
+		statsMu.Lock()
+		defer statsMu.Unlock()
+		lastStats = &s
+	}
+
+	runner.Callback = func(res *promql.Result) error {
+		// transform data in a better structure, expecting a matrix, or a vector,
+		// which is drawn as bars
 		seriesSet, err := PromResultToPromSeriesSet(res)
 		if err != nil {
+			// TODO: signal to terminal
 			return err
 		}
+		_, instant := res.Value.(promql.Vector)
 
-		for _, warning := range res.Warnings {
-			// TODO: signal to terminal
-			c.Fprintf("Warning running query: %v", warning)
+		// hidden series are still in the key, to show again, but not graphed
+		mouseMu.Lock()
+		keySeries = make([]string, 0, len(seriesSet))
+		keySeriesIds = make(map[string]plot.SeriesId, len(seriesSet))
+		for _, series := range seriesSet {
+			keySeries = append(keySeries, seriesKey(series))
+			keySeriesIds[seriesKey(series)] = series.Id()
+		}
+		keyPalette = c.palette.Ranked(rankedSeries(seriesSet))
+		palette := keyPalette
+		hiddenNow, selected := hidden, ""
+		if selecting {
+			selected = highlighted
 		}
+		mouseMu.Unlock()
 
 		// write to our lc object with all the label and chart information.
 		axesMu.Lock()
-		platGraph := plot.DataToPlatonicGraph(seriesSet, plot.AutoAxes().WithPreviousRange(lastAxes))
+		platGraph := plot.DataToPlatonicGraph(visibleSeries(seriesSet, hiddenNow), plot.AutoAxes().WithPreviousRange(lastAxes))
 		lastAxes = platGraph.PlatonicAxes
 		axesMu.Unlock()
 
+		resetsMu.Lock()
+		resets := lastResets
+		resetsMu.Unlock()
+
+		alertsMu.Lock()
+		alerts := lastAlerts
+		alertsMu.Unlock()
+
+		statsMu.Lock()
+		stats := lastStats
+		statsMu.Unlock()
+
+		viewMu.Lock()
+		paused := view.End
+		viewMu.Unlock()
+
+		// the key and the table carry on scrolled (and sorted) as they were
+		keyView := &term.TextBox{}
+		var table *term.TableView
+		mouseMu.Lock()
+		showHeatmap := heatmapMode
+		if shownKey != nil {
+			keyView.Scroll = shownKey.Scroll
+		}
+		if tableMode {
+			table = &term.TableView{}
+			if shownTable != nil {
+				table.SortColumn, table.SortDescending, table.Scroll = shownTable.SortColumn, shownTable.SortDescending, shownTable.Scroll
+			}
+		}
+		mouseMu.Unlock()
+		if table != nil {
+			if table.Header, table.Rows, err = prom.LatestTable(res, c.tableColumns, time.Now()); err != nil {
+				return err
+			}
+		}
+		var bars *term.BarsView
+		if instant {
+			bars = &term.BarsView{
+				Bars:    plot.DataToBars(visibleSeries(seriesSet, hiddenNow)),
+				Palette: palette,
+				ValueLabeler: func(v float64) string {
+					return fmt.Sprintf("%.5g", v)
+				},
+			}
+		}
+		// the buckets of a histogram (i.e. 'rate(foo_bucket[5m])') are shaded by how
+		// many observations fell in them over time, anything else is graphed as usual
+		var heatmap *term.HeatmapView
+		if showHeatmap {
+			if buckets, isHistogram := PromResultToHeatmap(res); isHistogram {
+				heatmap = &term.HeatmapView{Heatmap: buckets}
+			}
+		}
+
 		// size key
 		maxSize := 1
 		for _, series := range seriesSet {
@@ -405,50 +1886,270 @@ func (c *MetricsCommand) runInteractiveChart(ctx context.Context, runner *prom.P
 				maxSize = len(title) + 3
 			}
 		}
+		if c.legendStats && len(legendStatsHeader)+1 > maxSize {
+			maxSize = len(legendStatsHeader) + 1
+		}
+		for _, reset := range resets {
+			if title := resetTitle(reset); len(title)+3 > maxSize {
+				maxSize = len(title) + 3
+			}
+		}
+		for _, alert := range alerts {
+			if title := alertTitle(alert); len(title)+3 > maxSize {
+				maxSize = len(title) + 3
+			}
+		}
 		// TODO(sollyross): cap this to a reasonable width, and wrap after
 
-		keyView := &term.TextBox{}
-		mainView := makeView(promptView, keyView, platGraph, maxSize)
+		mainView := makeView(promptView, keyView, platGraph, table, bars, heatmap, maxSize)
 
 		// set key
+		if c.legendStats && len(seriesSet) > 0 {
+			keyView.WriteString(legendStatsHeader+"\n", tcell.StyleDefault.Dim(true))
+		}
 		for _, series := range seriesSet {
 			title := series.Title()
-			sty := tcell.StyleDefault.Foreground(tcell.Color(series.Id() % 256))
-			keyView.WriteString("• ", sty)
-			keyView.WriteString(title, sty)
+			sty, bullet := tcell.StyleDefault.Foreground(palette.Color(series.Id())), "• "
+			key := seriesKey(series)
+			if hiddenNow[key] {
+				sty, bullet = sty.Dim(true), "◦ "
+			}
+			keyView.WriteTaggedString(bullet, sty, key)
+			keyView.WriteTaggedString(title, sty.Reverse(key == selected), key)
+			if summary, ok := plot.Summarize(series); c.legendStats && ok {
+				keyView.WriteTaggedString("\n"+formatLegendStats(summary), tcell.StyleDefault, key)
+			}
 			keyView.WriteString("\n\n", tcell.StyleDefault)
 		}
+		// i.e. that we're over the memory budget, so what's charted is incomplete
+		for _, warning := range res.Warnings {
+			keyView.WriteString(fmt.Sprintf("warning: %v\n\n", warning), tcell.StyleDefault.Foreground(tcell.ColorYellow))
+		}
+		if len(alerts) > 0 {
+			keyView.WriteString("alerts\n", tcell.StyleDefault.Bold(true))
+			for _, alert := range alerts {
+				sty := tcell.StyleDefault.Foreground(tcell.ColorYellow)
+				if alert.State == prom.AlertFiring {
+					sty = tcell.StyleDefault.Foreground(tcell.ColorRed)
+				}
+				keyView.WriteString("▲ ", sty)
+				keyView.WriteString(alertTitle(alert), tcell.StyleDefault)
+				keyView.WriteString("\n", tcell.StyleDefault)
+				if summary := alert.Annotations["summary"]; summary != "" {
+					keyView.WriteString("  "+summary+"\n", tcell.StyleDefault.Dim(true))
+				}
+			}
+			keyView.WriteString("\n", tcell.StyleDefault)
+		}
+		if len(resets) > 0 {
+			keyView.WriteString("restarts\n", tcell.StyleDefault.Bold(true))
+			for _, reset := range resets {
+				keyView.WriteString("↺ ", tcell.StyleDefault.Foreground(tcell.ColorYellow))
+				keyView.WriteString(resetTitle(reset), tcell.StyleDefault)
+				keyView.WriteString("\n", tcell.StyleDefault)
+			}
+		}
+
+		if stats != nil {
+			keyView.WriteString("query: "+stats.String()+"\n", tcell.StyleDefault.Dim(true))
+		}
+		if !paused.IsZero() {
+			keyView.WriteString("paused at "+paused.Format("15:04:05")+" (shift+→ to catch up)\n", tcell.StyleDefault.Foreground(tcell.ColorYellow))
+		}
+		if selected != "" {
+			keyView.WriteString("space hides or shows, enter solos (esc when done)\n", tcell.StyleDefault.Dim(true))
+		}
 
 		// and request that we redraw everything
 		termRunner.RequestUpdate(mainView)
 
 		return nil
 	}
+	// what's charted is also written down, for after the terminal's gone
+	if c.sink != nil {
+		runner.Callback = c.sink.Wrap(runner.Callback)
+	}
 
 	ctx, stopScreen := context.WithCancel(ctx)
 	go promptView.Run(ctx, &qs, stopScreen)
 
-	if err := termRunner.Run(ctx, makeView(promptView, nil, nil, 10)); err != nil {
+	if err := termRunner.Run(ctx, makeView(promptView, nil, nil, nil, nil, nil, 10)); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (c *MetricsCommand) scrape(ctx context.Context, runner *prom.PeriodicData) error {
-	ticker := time.NewTicker(c.Period)
-	defer ticker.Stop()
-	for {
-		select {
-		case <-ctx.Done():
-			return nil
-		case <-ticker.C:
-			if err := runner.Scrape(ctx); err != nil {
-				// TODO: send to terminal
-				// let's swallow this one, we can try next scrape.
-				//return fmt.Errorf("unable to run periodic query: %w", err)
-			}
+// zoomWindow zooms the given window by the given factor, keeping it to at least a
+// few scrapes, and no longer than a week, or the window we started with if longer.
+func zoomWindow(window time.Duration, by float64, period, initial time.Duration) time.Duration {
+	longest := maxZoomWindow
+	if initial > longest {
+		longest = initial
+	}
+	zoomed := time.Duration(float64(window) * by).Truncate(time.Second)
+	switch {
+	case zoomed < minZoomScrapes*period:
+		return minZoomScrapes * period
+	case zoomed > longest:
+		return longest
+	default:
+		return zoomed
+	}
+}
+
+// panView pans the view by the given fraction of its window, back in time if
+// negative. Panning pauses it, until it's panned forward to now again.
+func panView(view prom.View, by float64, now time.Time) prom.View {
+	end := view.End
+	if !view.Paused() {
+		end = now
+	}
+	end = end.Add(time.Duration(float64(view.Window) * by))
+	if !end.Before(now) {
+		end = time.Time{}
+	}
+	view.End = end
+	return view
+}
+
+// stepSeries steps the selection through the series listed in the key, by their
+// seriesKey, forward or backward by the given number of steps, from the first (or
+// last) if nothing's selected yet.
+func stepSeries(ids []string, selected string, by int) string {
+	if len(ids) == 0 {
+		return ""
+	}
+	step := -1
+	if by < 0 {
+		step = 0
+	}
+	for i, id := range ids {
+		if id == selected {
+			step = i
+		}
+	}
+	step = ((step+by)%len(ids) + len(ids)) % len(ids)
+	return ids[step]
+}
+
+// toggleSeries hides the given series if it's shown, and shows it if hidden. The
+// hidden series are copied rather than changed, as they may be being charted.
+func toggleSeries(hidden map[string]bool, id string) map[string]bool {
+	toggled := make(map[string]bool, len(hidden)+1)
+	for hiddenId := range hidden {
+		toggled[hiddenId] = true
+	}
+	if toggled[id] {
+		delete(toggled, id)
+	} else {
+		toggled[id] = true
+	}
+	return toggled
+}
+
+// soloSeries hides every series but the given one, or, if that's all that's
+// shown already, shows them all again, like clicking a series in Grafana's legend.
+func soloSeries(ids []string, hidden map[string]bool, id string) map[string]bool {
+	soloed := make(map[string]bool, len(ids))
+	alreadySolo := !hidden[id]
+	for _, other := range ids {
+		if other == id {
+			continue
+		}
+		alreadySolo = alreadySolo && hidden[other]
+		soloed[other] = true
+	}
+	if alreadySolo {
+		return nil
+	}
+	return soloed
+}
+
+// rankedSeries is the ids of the given series, sorted by their labels, for the
+// palette to hand its colors out in that order.
+func rankedSeries(seriesSet plot.SeriesSet) []plot.SeriesId {
+	sorted := make(plot.SeriesSet, len(seriesSet))
+	copy(sorted, seriesSet)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return seriesKey(sorted[i]) < seriesKey(sorted[j])
+	})
+	ids := make([]plot.SeriesId, len(sorted))
+	for i, series := range sorted {
+		ids[i] = series.Id()
+	}
+	return ids
+}
+
+// visibleSeries is the given series but the hidden ones.
+func visibleSeries(seriesSet plot.SeriesSet, hidden map[string]bool) plot.SeriesSet {
+	if len(hidden) == 0 {
+		return seriesSet
+	}
+	visible := make(plot.SeriesSet, 0, len(seriesSet))
+	for _, series := range seriesSet {
+		if !hidden[seriesKey(series)] {
+			visible = append(visible, series)
 		}
 	}
+	return visible
+}
+
+// legendStatsHeader heads the columns of --legend-stats in the key, lined up with
+// formatLegendStats.
+const legendStatsHeader = "  now      min      max      avg"
+
+// formatLegendStats lines up a series' summary under legendStatsHeader.
+func formatLegendStats(summary plot.Summary) string {
+	return fmt.Sprintf("  %-8.3g %-8.3g %-8.3g %.3g", summary.Current, summary.Min, summary.Max, summary.Avg)
+}
+
+// stepSort steps the table through being sorted by each of its columns one way and
+// then the other, forward or backward by the given number of steps.
+func stepSort(table *term.TableView, by int) {
+	steps := 2 * len(table.Header)
+	if steps == 0 {
+		return
+	}
+	step := 2 * table.SortColumn
+	if table.SortDescending {
+		step++
+	}
+	step = ((step+by)%steps + steps) % steps
+	table.SortColumn, table.SortDescending = step/2, step%2 == 1
+}
+
+const (
+	// tableScrollRows is how many rows of the table a turn of the scroll wheel scrolls
+	tableScrollRows = 3
+	// minZoomScrapes is how many scrapes we can zoom in to, any fewer is hardly a graph
+	minZoomScrapes = 4
+	// maxZoomWindow is how far we can zoom out to
+	maxZoomWindow = 7 * 24 * time.Hour
+)
+
+// resetTitle says when a counter was reset, and which.
+func resetTitle(reset prom.CounterReset) string {
+	return promtime.Time(reset.Timestamp).Format("15:04:05") + " " + reset.Series.String()
+}
+
+// alertTitle says which alert is pending or firing, and since when.
+func alertTitle(alert prom.Alert) string {
+	ls := labels.NewBuilder(alert.Labels).Del(prom.AlertNameLabel).Labels()
+	return fmt.Sprintf("%s %s since %s %s", strings.ToUpper(string(alert.State)), alert.Labels.Get(prom.AlertNameLabel), alert.ActiveAt.Format("15:04:05"), ls)
+}
+
+// lintWarnings formats the likely mistakes in a query, one per line.
+func lintWarnings(query string, index autocomplete.QueryIndex) string {
+	// invalid queries are reported when we try to run them
+	findings, err := lint.Lint(query, index)
+	if err != nil {
+		return ""
+	}
+	var sb strings.Builder
+	for _, f := range findings {
+		fmt.Fprintf(&sb, "%s %v\n", yellow("warning:"), f)
+	}
+	return sb.String()
 }
 
 func metricsURL(endpoint string) string {
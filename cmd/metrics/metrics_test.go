@@ -0,0 +1,298 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"context"
+	"errors"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+
+	"sigs.k8s.io/instrumentation-tools/cmd/cli"
+	"sigs.k8s.io/instrumentation-tools/promq/autocomplete/earley"
+	"sigs.k8s.io/instrumentation-tools/promq/prom"
+	"sigs.k8s.io/instrumentation-tools/promq/term/plot"
+)
+
+func TestStepSeries(t *testing.T) {
+	ids := []string{`{job="a"}`, `{job="b"}`, `{job="c"}`}
+	tests := []struct {
+		name     string
+		ids      []string
+		selected string
+		by       int
+		want     string
+	}{
+		{name: "nothing to select", ids: nil, by: 1, want: ""},
+		{name: "first when nothing's selected", ids: ids, by: 1, want: `{job="a"}`},
+		{name: "last when nothing's selected", ids: ids, by: -1, want: `{job="c"}`},
+		{name: "forward", ids: ids, selected: `{job="a"}`, by: 1, want: `{job="b"}`},
+		{name: "backward", ids: ids, selected: `{job="b"}`, by: -1, want: `{job="a"}`},
+		{name: "wraps forward", ids: ids, selected: `{job="c"}`, by: 1, want: `{job="a"}`},
+		{name: "wraps backward", ids: ids, selected: `{job="a"}`, by: -1, want: `{job="c"}`},
+		{name: "first when the selection's gone", ids: ids, selected: `{job="d"}`, by: 1, want: `{job="a"}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := stepSeries(test.ids, test.selected, test.by); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSoloSeries(t *testing.T) {
+	ids := []string{`{job="a"}`, `{job="b"}`, `{job="c"}`}
+	tests := []struct {
+		name   string
+		hidden map[string]bool
+		id     string
+		want   map[string]bool
+	}{
+		{name: "solos", id: `{job="a"}`, want: map[string]bool{`{job="b"}`: true, `{job="c"}`: true}},
+		{name: "shows all again once soloed", hidden: map[string]bool{`{job="b"}`: true, `{job="c"}`: true}, id: `{job="a"}`, want: nil},
+		{name: "solos another", hidden: map[string]bool{`{job="b"}`: true, `{job="c"}`: true}, id: `{job="b"}`, want: map[string]bool{`{job="a"}`: true, `{job="c"}`: true}},
+		{name: "solos a hidden one", hidden: map[string]bool{`{job="a"}`: true}, id: `{job="a"}`, want: map[string]bool{`{job="b"}`: true, `{job="c"}`: true}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := soloSeries(ids, test.hidden, test.id); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestVisibleSeriesAreByLabels(t *testing.T) {
+	// the same id, as when the hashes of their labels collide
+	set := plot.SeriesSet{
+		&PromSeries{title: "a", id: 1, labels: `{job="a"}`},
+		&PromSeries{title: "b", id: 1, labels: `{job="b"}`},
+	}
+	visible := visibleSeries(set, toggleSeries(nil, `{job="a"}`))
+	if len(visible) != 1 || visible[0].Title() != "b" {
+		t.Errorf("got %v, want only b shown", visible)
+	}
+}
+
+func TestPrometheusURLConflicts(t *testing.T) {
+	tests := []struct {
+		name  string
+		flags cli.PromQFlags
+		want  string
+	}{
+		{
+			name:  "targets",
+			flags: cli.PromQFlags{PrometheusURL: "http://prometheus:9090", HostNames: []string{"http://node:9100/metrics"}},
+			want:  "--prometheus-url can't be used with --targets, the server's queried for its own data rather than anything being scraped",
+		},
+		{
+			name:  "where we'd keep the data",
+			flags: cli.PromQFlags{PrometheusURL: "http://prometheus:9090", DataDir: "/tmp/promq", Record: "incident.jsonl", RemoteRead: "http://prometheus:9090/api/v1/read"},
+			want:  "--prometheus-url can't be used with --data-dir, --record, --remote-read, the server's queried for its own data rather than anything being scraped",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := (&MetricsCommand{}).setupSources(test.flags)
+			if err == nil || err.Error() != test.want {
+				t.Errorf("got %v, want %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestRecordingAReplay(t *testing.T) {
+	err := (&MetricsCommand{}).setupSources(cli.PromQFlags{Replay: "incident.jsonl", Record: "again.jsonl"})
+	if want := "--record can't be used with --replay, which plays back what's been recorded already"; err == nil || err.Error() != want {
+		t.Errorf("got %v, want %q", err, want)
+	}
+}
+
+func TestFormatLegendStats(t *testing.T) {
+	nan := math.NaN()
+	tests := []struct {
+		name    string
+		summary plot.Summary
+		want    string
+	}{
+		{name: "values", summary: plot.Summary{Current: 1.5, Min: 0.25, Max: 1234567, Avg: 42}, want: "  1.5      0.25     1.23e+06 42"},
+		{name: "NaNs", summary: plot.Summary{Current: nan, Min: nan, Max: nan, Avg: nan}, want: "  NaN      NaN      NaN      NaN"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := formatLegendStats(test.summary); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+// brokenSource streams a couple of series, and then, if it's broken, fails.
+type brokenSource struct {
+	name   string
+	broken bool
+}
+
+func (s brokenSource) String() string { return s.name }
+
+func (s brokenSource) ScrapePrometheusEndpoint(ctx context.Context, nowish time.Time) ([]prom.ParsedSeries, error) {
+	var series []prom.ParsedSeries
+	err := s.StreamPrometheusEndpoint(ctx, nowish, func(ps prom.ParsedSeries) error {
+		series = append(series, ps)
+		return nil
+	})
+	return series, err
+}
+
+func (s brokenSource) StreamPrometheusEndpoint(_ context.Context, nowish time.Time, add func(prom.ParsedSeries) error) error {
+	for _, job := range []string{"a", "b"} {
+		ps := prom.ParsedSeries{Labels: labels.FromStrings(labels.MetricName, "requests_total", "job", job, "source", s.name), Value: 1, Timestamp: prom.PromTimestamp(nowish)}
+		if err := add(ps); err != nil {
+			return err
+		}
+	}
+	if s.broken {
+		return errors.New("connection reset")
+	}
+	return nil
+}
+
+func TestStreamingLeavesOutFailedSources(t *testing.T) {
+	sources := DataSources{sources: []prom.DataSource{brokenSource{name: "ok"}, brokenSource{name: "broken", broken: true}}}
+	var added []prom.ParsedSeries
+	err := sources.StreamPrometheusEndpoint(context.TODO(), time.Unix(1000, 0), func(ps prom.ParsedSeries) error {
+		added = append(added, ps)
+		return nil
+	})
+	var partial *prom.PartialScrapeError
+	if !errors.As(err, &partial) || len(partial.Errors) != 1 {
+		t.Fatalf("got %v, want the broken source's error", err)
+	}
+	scraped := map[string]int{}
+	up := map[string]float64{}
+	for _, ps := range added {
+		switch ps.Labels.Get(labels.MetricName) {
+		case "requests_total":
+			scraped[ps.Labels.Get("source")]++
+		case "up":
+			up[ps.Labels.Get(labels.InstanceName)] = ps.Value
+		}
+	}
+	if want := map[string]int{"ok": 2}; !reflect.DeepEqual(scraped, want) {
+		t.Errorf("got series of %v, want only those of the source which didn't fail, %v", scraped, want)
+	}
+	if want := map[string]float64{"ok": 1, "broken": 0}; !reflect.DeepEqual(up, want) {
+		t.Errorf("got up %v, want %v", up, want)
+	}
+}
+
+// fakeRunner takes any query with balanced parentheses.
+type fakeRunner struct {
+	query string
+}
+
+func (r *fakeRunner) SetQuery(_ context.Context, query string) error {
+	if strings.Count(query, "(") != strings.Count(query, ")") {
+		return errors.New("unclosed left parenthesis")
+	}
+	r.query = query
+	return nil
+}
+
+func (r *fakeRunner) GetIndex() prom.Indexer {
+	return prom.NewIndex()
+}
+
+type fakeHistory struct {
+	queries []string
+}
+
+func (h *fakeHistory) RecordQuery(query string) {
+	h.queries = append(h.queries, query)
+}
+
+func (h *fakeHistory) Explain(string) string {
+	return ""
+}
+
+func TestFmtCommand(t *testing.T) {
+	query := " sum(rate(requests_total{code=~'5..'}[5m]))by(job)"
+	formatted := earley.FormatQuery(query)
+	if formatted == query {
+		t.Fatalf("expected %q to need formatting", query)
+	}
+	runner := &fakeRunner{query: "up"}
+	history := &fakeHistory{}
+	if _, ok := fmtCommand(context.TODO(), runner, history, query); !ok {
+		t.Fatalf("expected %q to be plotted", query)
+	}
+	if runner.query != formatted {
+		t.Errorf("plotting %q, want the formatted %q", runner.query, formatted)
+	}
+	if want := []string{formatted}; !reflect.DeepEqual(history.queries, want) {
+		t.Errorf("got history %q, want %q", history.queries, want)
+	}
+
+	// neither an invalid query nor no query at all replace the one plotted
+	for _, query := range []string{"sum(", ""} {
+		if _, ok := fmtCommand(context.TODO(), runner, history, query); ok {
+			t.Errorf("didn't expect %q to be plotted", query)
+		}
+		if runner.query != formatted {
+			t.Errorf("plotting %q, want %q still", runner.query, formatted)
+		}
+		if len(history.queries) != 1 {
+			t.Errorf("got history %q, didn't expect %q in it", history.queries, query)
+		}
+	}
+}
+
+func TestSourceLabels(t *testing.T) {
+	synthetic, err := prom.NewSyntheticSource("synthetic://sine")
+	if err != nil {
+		t.Fatalf("didn't expect this to err %v", err)
+	}
+	synthetic.ExternalLabels = map[string]string{"cluster": "prod"}
+	for _, tc := range []struct {
+		name string
+		src  prom.DataSource
+		want map[string]string
+	}{
+		{
+			name: "a retried source with external labels",
+			src:  prom.NewRetryingSource(synthetic, prom.DefaultRetryPolicy()),
+			want: map[string]string{labels.InstanceName: "synthetic://sine", "cluster": "prod"},
+		},
+		{
+			name: "a source which doesn't know its labels",
+			src:  brokenSource{name: "ok"},
+			want: map[string]string{labels.InstanceName: "ok"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := sourceLabels(tc.src, 0); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
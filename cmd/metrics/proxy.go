@@ -0,0 +1,61 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// proxyURL turns a pod:// or node:// target into the URL of its metrics through the
+// apiserver's proxy subresource, so that pods we've no network path to can still be
+// scraped, i.e. pod://kube-system/coredns-abc:9153 is scraped from
+// <host>/api/v1/namespaces/kube-system/pods/coredns-abc:9153/proxy/metrics, and
+// node://worker-1/metrics/cadvisor from <host>/api/v1/nodes/worker-1/proxy/metrics/cadvisor.
+// It returns false for any other target.
+func proxyURL(host, target string) (string, bool, error) {
+	var resource, path string
+	switch {
+	case strings.HasPrefix(target, "pod://"):
+		// namespace/pod[:port][/path]
+		parts := strings.SplitN(strings.TrimPrefix(target, "pod://"), "/", 3)
+		if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+			return "", true, fmt.Errorf("expected pod://<namespace>/<pod>[:<port>][/<path>], not %q", target)
+		}
+		resource = "namespaces/" + url.PathEscape(parts[0]) + "/pods/" + url.PathEscape(parts[1])
+		if len(parts) == 3 {
+			path = parts[2]
+		}
+	case strings.HasPrefix(target, "node://"):
+		// node[/path]
+		parts := strings.SplitN(strings.TrimPrefix(target, "node://"), "/", 2)
+		if parts[0] == "" {
+			return "", true, fmt.Errorf("expected node://<node>[/<path>], not %q", target)
+		}
+		resource = "nodes/" + url.PathEscape(parts[0])
+		if len(parts) == 2 {
+			path = parts[1]
+		}
+	default:
+		return "", false, nil
+	}
+	if path == "" {
+		path = "metrics"
+	}
+	return fmt.Sprintf("%s/api/v1/%s/proxy/%s", strings.TrimSuffix(host, "/"), resource, path), true, nil
+}
@@ -0,0 +1,51 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import "testing"
+
+func TestProxyURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		target  string
+		want    string
+		proxied bool
+		wantErr bool
+	}{
+		{name: "pod", target: "pod://kube-system/coredns-abc", want: "https://apiserver/api/v1/namespaces/kube-system/pods/coredns-abc/proxy/metrics", proxied: true},
+		{name: "pod with a port and a path", target: "pod://monitoring/node-exporter-x:9100/stats/metrics", want: "https://apiserver/api/v1/namespaces/monitoring/pods/node-exporter-x:9100/proxy/stats/metrics", proxied: true},
+		{name: "pod with a scheme", target: "pod://kube-system/https:kube-scheduler-a:10259/metrics", want: "https://apiserver/api/v1/namespaces/kube-system/pods/https:kube-scheduler-a:10259/proxy/metrics", proxied: true},
+		{name: "pod without a namespace", target: "pod://coredns-abc", proxied: true, wantErr: true},
+		{name: "pod with an empty namespace", target: "pod:///coredns-abc", proxied: true, wantErr: true},
+		{name: "pod with an empty name", target: "pod://kube-system/", proxied: true, wantErr: true},
+		{name: "node", target: "node://worker-1", want: "https://apiserver/api/v1/nodes/worker-1/proxy/metrics", proxied: true},
+		{name: "node with a path", target: "node://worker-1/metrics/cadvisor", want: "https://apiserver/api/v1/nodes/worker-1/proxy/metrics/cadvisor", proxied: true},
+		{name: "node without a name", target: "node:///metrics", proxied: true, wantErr: true},
+		{name: "anything else", target: "http://node-exporter:9100/metrics"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, proxied, err := proxyURL("https://apiserver/", test.target)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, want an error: %v", err, test.wantErr)
+			}
+			if got != test.want || proxied != test.proxied {
+				t.Errorf("got %q, %v, want %q, %v", got, proxied, test.want, test.proxied)
+			}
+		})
+	}
+}
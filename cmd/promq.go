@@ -17,6 +17,8 @@ limitations under the License.
 package cmd
 
 import (
+    "os"
+    "path/filepath"
     "time"
 
     _ "github.com/prometheus/client_golang/prometheus"
@@ -27,6 +29,7 @@ import (
     "k8s.io/client-go/tools/clientcmd/api"
     "sigs.k8s.io/instrumentation-tools/cmd/cli"
     "sigs.k8s.io/instrumentation-tools/cmd/metrics"
+    "sigs.k8s.io/instrumentation-tools/promq/prom"
 )
 
 // PromQOptions provides information required to updat
@@ -54,9 +57,80 @@ type RootPromQCmd struct {
 func addFlags(cmd *cobra.Command, options *PromQOptions) {
     cmd.Flags().BoolVarP(&options.flags.Continuous, "continuous", "c", options.flags.Continuous, "if true, runs continuously (i.e. gathers samples in mem)")
     cmd.Flags().BoolVarP(&options.flags.List, "list", "l", options.flags.List, "if true, lists out observed metric names.")
+    cmd.Flags().BoolVar(&options.flags.Cardinality, "cardinality", options.flags.Cardinality, "if true, reports the metrics with the most series, and the labels with the most values, to spot label explosions")
     cmd.Flags().StringVarP(&options.flags.PromQuery, "query", "q", "", "if specified, uses this query for analyzing a prometheus endpoint.")
-    cmd.Flags().StringVarP(&options.flags.Output, "output", "o", "json", "Output format for data, defaults to json")
-    cmd.Flags().StringArrayVarP(&options.flags.HostNames, "targets", "t", options.flags.HostNames, "By default uses the prometheus target from the master kubernetes from kubeconfig, override to target an arbitrary prometheus endpoint")
+    cmd.Flags().StringVarP(&options.flags.Output, "output", "o", "json", "Output format for data, one of json, yaml, prometheus, prometheus-api (the response of prometheus' query API, envelope and all) table (aligned, for people to read, see --columns) or csv (a row per sample), defaults to json")
+    cmd.Flags().StringSliceVar(&options.flags.TableColumns, "columns", nil, "the labels to show as columns of -o table, defaults to every label")
+    cmd.Flags().StringVar(&options.flags.Start, "start", "", "if specified, runs --query as a range query from this time (an RFC 3339 or unix timestamp, or a duration relative to now, e.g. -1h) over the stored data, returning a matrix")
+    cmd.Flags().StringVar(&options.flags.End, "end", "", "the end of a range query, in the same formats as --start, defaults to now")
+    cmd.Flags().DurationVar(&options.flags.Step, "step", 0, "how far apart the points of a range query are, defaults to the scrape period")
+    cmd.Flags().StringVar(&options.flags.DataDir, "data-dir", "", "if specified, keeps the scraped data in a prometheus TSDB in this directory rather than in memory, so that it survives restarts")
+    cmd.Flags().DurationVar(&options.flags.Retention, "retention", 24*time.Hour, "how long to keep the scraped data in --data-dir for")
+    cmd.Flags().IntVar(&options.flags.MaxSeries, "max-series", 0, "if specified, keeps at most this many series in memory, dropping those queried least recently, e.g. for endpoints with a lot of them")
+    cmd.Flags().Var(&options.flags.MaxMemory, "max-memory", "if specified, keeps roughly at most this much scraped data in memory (e.g. 512Mi), dropping the series queried least recently")
+    cmd.Flags().IntVar(&options.flags.MaxSamples, "max-samples", prom.DefaultMaxSamples, "how many samples a query can have in memory at once before it fails, raise it for queries over a lot of series, or lower it on a small machine")
+    cmd.Flags().DurationVar(&options.flags.LookbackDelta, "lookback-delta", prom.DefaultLookbackDelta, "how far back a query looks for the latest sample of a series, like prometheus' --query.lookback-delta")
+    cmd.Flags().DurationVar(&options.flags.QueryTimeout, "query-timeout", 0, "how long a query can take before it's given up on, defaults to the scrape period")
+    cmd.Flags().StringVar(&options.flags.Sink, "sink", "", "if specified with --continuous, also appends every sample charted to this file (each only once), so that what was charted is left behind after the terminal's gone")
+    cmd.Flags().StringVar(&options.flags.SinkFormat, "sink-format", "jsonl", "the format of --sink, jsonl (a JSON object per sample) or csv (a row per sample)")
+    cmd.Flags().Var(&options.flags.SinkMaxSize, "sink-max-size", "if specified, moves --sink aside (to <file>.<time>) and starts a new one once it's this big (e.g. 100Mi)")
+    cmd.Flags().DurationVar(&options.flags.SinkRotateEvery, "sink-rotate-every", 0, "if specified, moves --sink aside (to <file>.<time>) and starts a new one this often (e.g. 1h)")
+    cmd.Flags().DurationVar(&options.flags.Compare, "compare", 0, "if specified, also runs the query as it was this long ago (e.g. 24h), shifted onto now and told apart by a \""+prom.ComparisonLabel+"\" label, to chart today over yesterday")
+    cmd.Flags().StringVar(&options.flags.WALFile, "wal-file", options.flags.WALFile, "if set, where --continuous keeps what it scrapes over the last window, and the query, for --resume to restore if promq or the terminal dies (i.e. ~/.promq_wal), it's removed when promq exits cleanly, and can't be shared by two sessions at once")
+    cmd.Flags().BoolVar(&options.flags.Resume, "resume", options.flags.Resume, "if true with --continuous, restores the window of data and the query kept in --wal-file by the last session, rather than starting from an empty graph")
+    cmd.Flags().BoolVar(&options.flags.AlignScrapes, "align-scrapes", options.flags.AlignScrapes, "if true, scrapes on wall clock boundaries (i.e. on the second), with the samples of a scrape all at the boundary, so that they line up across series and sessions")
+    cmd.Flags().BoolVar(&options.flags.DiscardRawData, "discard-raw-data", false, "if true, only keeps the downsampled data of windows too long to chart every sample of (e.g. 24h at 1s), rather than every sample as well, to save memory")
+    cmd.Flags().BoolVar(&options.flags.FormatQuery, "format-query", options.flags.FormatQuery, "if true, prints the query given by --query formatted (i.e. split over lines if it's long) instead of running it")
+    addCompletionFlags(cmd, options)
+}
+
+// addCompletionFlags adds the flags for where we get metrics from and how we autocomplete
+// them, which all of our commands share
+func addCompletionFlags(cmd *cobra.Command, options *PromQOptions) {
+    cmd.Flags().BoolVar(&options.flags.FuzzyMatch, "fuzzy", options.flags.FuzzyMatch, "if true, autocompletion matches suggestions by subsequence rather than by prefix (e.g. 'apireqtot' matches 'apiserver_request_total')")
+    cmd.Flags().BoolVar(&options.flags.IgnoreCase, "ignore-case", options.flags.IgnoreCase, "if true, autocompletion matches metric and label names regardless of case (e.g. 'ApiServer' matches 'apiserver_request_total')")
+    cmd.Flags().BoolVar(&options.flags.IgnoreSeparators, "ignore-separators", options.flags.IgnoreSeparators, "if true, autocompletion treats '.', '-' and '_' in metric and label names alike (e.g. 'apiserver.request' matches 'apiserver_request_total')")
+    cmd.Flags().IntVar(&options.flags.MaxSuggestions, "max-suggestions", 100, "the most autocompletion suggestions to give at once, 0 gives them all")
+    cmd.Flags().StringVar(&options.flags.UnstableMetrics, "unstable-metrics", "show", "how autocompletion treats alpha, internal and deprecated metrics, one of show, demote (suggest them last) or hide")
+    cmd.Flags().StringArrayVarP(&options.flags.HostNames, "targets", "t", options.flags.HostNames, "By default uses the prometheus target from the master kubernetes from kubeconfig, override to target an arbitrary prometheus endpoint, a metrics dump on disk with file:// (a directory is taken to have a dump per file), generated series with synthetic://[sine,walk,counter,histogram][?seed=<n>&series=<n>], or a pod or node through the apiserver's proxy with pod://<namespace>/<pod>:<port> or node://<node>, optionally followed by the path of their metrics")
+    cmd.Flags().StringVar(&options.flags.PrometheusURL, "prometheus-url", "", "if specified, runs queries against this prometheus server (e.g. http://prometheus:9090) through its HTTP API, and completes the metrics it has, rather than scraping any endpoints (so it can't be used with the flags which say what to scrape, or where to keep it)")
+    cmd.Flags().StringVar(&options.flags.RemoteRead, "remote-read", "", "if specified, also fetches the series the query selects from this prometheus remote read endpoint (e.g. http://prometheus:9090/api/v1/read), to graph what it's kept")
+    cmd.Flags().DurationVar(&options.flags.RemoteReadLookback, "remote-read-lookback", time.Hour, "how far back to fetch series from --remote-read")
+    cmd.Flags().StringVar(&options.flags.Record, "record", "", "if specified, appends every scrape to this file, for --replay to play back later")
+    cmd.Flags().StringVar(&options.flags.Replay, "replay", "", "if specified, plays back the scrapes recorded by --record in this file instead of scraping the targets")
+    cmd.Flags().Float64Var(&options.flags.ReplaySpeed, "replay-speed", 1, "how many times faster than it was recorded to play back --replay")
+    cmd.Flags().DurationVar(&options.flags.ScrapeTimeout, "scrape-timeout", prom.DefaultRetryPolicy().Timeout, "how long a scrape of a target can take before it's given up on")
+    cmd.Flags().DurationVar(&options.flags.ScrapeJitter, "scrape-jitter", 0, "if specified, spreads the scrapes of the targets over up to this long (less than the scrape period), each target always the same amount later, so that they aren't all scraped at once")
+    cmd.Flags().IntVar(&options.flags.ScrapeRetries, "scrape-retries", prom.DefaultRetryPolicy().Retries, "how many more times a failed scrape of a target is tried, backing off in between, targets which keep on failing aren't tried for a while")
+    cmd.Flags().BoolVar(&options.flags.Protobuf, "protobuf", options.flags.Protobuf, "if true, asks endpoints for the protobuf exposition format, which loses units (native histograms aren't supported, only the classic buckets of a histogram are read, and a histogram without any fails the scrape unless --lenient)")
+    cmd.Flags().BoolVar(&options.flags.Lenient, "lenient", options.flags.Lenient, "if true, skips the lines of a scrape (or file:// dump) which can't be parsed, and the native histograms of a --protobuf one, and warns about them, rather than failing the whole scrape")
+    cmd.Flags().BoolVar(&options.flags.Dedup, "dedup", options.flags.Dedup, "if true, merges the series of replicas of a component which only differ by their --replica-label, keeping the samples of one replica per series until that replica goes missing, like Thanos does for HA pairs, so that sums don't count everything twice and counters don't reset when switching replicas")
+    cmd.Flags().StringArrayVar(&options.flags.ReplicaLabels, "replica-label", []string{"instance"}, "the labels replicas differ by, dropped by --dedup")
+    cmd.Flags().StringVar(&options.flags.HistoryFile, "history-file", defaultHistoryFile(), "where to keep the queries run interactively, which autocompletion suggests again, empty to not keep them")
+    cmd.Flags().StringArrayVar(&options.flags.Components, "component", options.flags.Components, "kubernetes components to scrape through the apiserver's proxy, as well as any targets, and the node they're on, e.g. kubelet-cadvisor=worker-1, one of kubelet, kubelet-cadvisor, kubelet-resource, kubelet-probes, or scheduler, controller-manager or etcd as kubeadm runs them (whose metrics have to be readable through the proxy)")
+    cmd.Flags().StringVar(&options.flags.TargetConfig, "target-config", "", "if specified, also scrapes the targets in this YAML file, a list of a url with the tls_config, basic_auth, authorization or bearer_token_file to scrape it with, like prometheus' scrape configs, e.g. for a node_exporter behind mTLS, labels to add to its series and headers to send with its scrapes")
+    cmd.Flags().StringArrayVar(&options.flags.ExternalLabels, "external-label", options.flags.ExternalLabels, "labels to add to every series of every target, like prometheus' external labels, e.g. cluster=prod, so that several clusters can be compared in a single query (a target's --target-config labels take precedence)")
+    cmd.Flags().StringVar(&options.flags.MetricAllow, "metric-allow", "", "if specified, only keeps the metric families (or series) whose names match this regex, e.g. 'apiserver_.*', as the endpoints and dumps are parsed, so that a giant endpoint doesn't fill up memory and autocompletion with the rest")
+    cmd.Flags().StringVar(&options.flags.MetricDeny, "metric-deny", "", "if specified, drops the metric families (or series) whose names match this regex, e.g. '.*_bucket', as the endpoints and dumps are parsed, even if --metric-allow matches them")
+    cmd.Flags().StringArrayVar(&options.flags.Headers, "header", options.flags.Headers, "headers to send with every scrape of the targets scraped directly (not through the apiserver), and to --prometheus-url and --remote-read, e.g. 'X-Scope-OrgID: tenant-1' for Cortex or Mimir, or what an auth proxy wants (a --target-config target's headers take precedence, and an Authorization header can't be sent to one with its own auth)")
+    cmd.Flags().StringVar(&options.flags.RelabelConfig, "relabel-config", "", "if specified, applies the relabel configs in this YAML file (a list, like prometheus' metric_relabel_configs) to the scraped series, e.g. to drop noisy ones")
+    cmd.Flags().StringArrayVar(&options.flags.DropLabels, "drop-label", options.flags.DropLabels, "labels to drop from the scraped series, e.g. huge uids which would bloat the index and the graph key")
+    cmd.Flags().DurationVar(&options.flags.IndexTTL, "index-ttl", 15*time.Minute, "how long a series can go without being scraped before it's no longer suggested, i.e. those of deleted pods, 0 to suggest everything ever scraped")
+    cmd.Flags().StringArrayVar(&options.flags.RuleFiles, "rules", options.flags.RuleFiles, "prometheus rules files whose recording rules autocompletion should suggest, as if they were scraped metrics, and whose alerting rules are evaluated on every scrape")
+    cmd.Flags().StringArrayVar(&options.flags.Alerts, "alert", options.flags.Alerts, "an alert to evaluate on every scrape, an expression and optionally how long it has to hold to fire, e.g. 'rate(errors_total[5m]) > 1 for 1m', pending and firing alerts are shown while charting, and can be queried as ALERTS like prometheus'")
+    cmd.Flags().BoolVar(&options.flags.Stats, "stats", options.flags.Stats, "if true, prints how many series and samples the query read and how long it took, to stderr in the output format, so that a query can be checked before it's run against a real prometheus (they're always shown while charting)")
+    cmd.Flags().BoolVar(&options.flags.Bell, "bell", options.flags.Bell, "if true, rings the terminal bell when an alert starts firing")
+    cmd.Flags().StringVar(&options.flags.Theme, "theme", "default", "the colors series are charted in: default, high-contrast or colorblind (the Okabe-Ito palette, which those with the common kinds of colorblindness can tell apart)")
+    cmd.Flags().BoolVar(&options.flags.LegendStats, "legend-stats", options.flags.LegendStats, "if true, shows each series' current, min, max and average value over the charted window under it in the key, so that it doubles as a table of the results")
+}
+
+// defaultHistoryFile is in the home directory, like a shell's, if there is one
+func defaultHistoryFile() string {
+    home, err := os.UserHomeDir()
+    if err != nil {
+        return ""
+    }
+    return filepath.Join(home, ".promq_history")
 }
 
 // NewCmdPromQ provides a cobra command wrapping AnalyzeOptions
@@ -67,8 +141,31 @@ func NewCmdPromQ(streams genericclioptions.IOStreams) *RootPromQCmd {
         Example:      `
 promq                                               # for interactive mode
 promq -l                                            # to list metrics  
+promq --cardinality                                 # to find the metrics and labels with the most series
 promq -q "apiserver_request_total" -ojson           # to query for all metrics matching the promql query in json
+promq -t pod://kube-system/coredns-abc12:9153      # to explore a pod's metrics through the apiserver, no port-forward needed
+promq --component kubelet-cadvisor=worker-1        # to explore the container metrics of a node
+promq -t file:///tmp/metrics.txt                    # to explore a dump, i.e. from 'kubectl get --raw /metrics > /tmp/metrics.txt'
+promq -c -t 'synthetic://?seed=42'                  # to chart generated series, no cluster needed
 promq -q "apiserver_request_total" -oyaml           # to query for all metrics matching the promql query in yaml
+promq -q "sum(rate(apiserver_request_total[5m]))" --format-query  # to format a query
+promq -q "up" --start -5m --step 15s                # to query for the values of up over the last five minutes
+promq -q "sum(rate(apiserver_request_total[5m]))" --stats  # to see what a query takes to run
+promq -c --record incident.jsonl                     # to record the scrapes while charting
+promq -c --replay incident.jsonl --replay-speed 10  # to chart them again later, ten times as fast
+promq -c --wal-file ~/.promq_wal --resume           # to carry on charting where a session that died left off
+promq --prometheus-url http://prometheus:9090       # to query a prometheus server
+promq --target-config node-exporters.yaml          # to also explore endpoints with their own TLS and auth, i.e. mTLS
+promq --prometheus-url https://mimir/prometheus --header 'X-Scope-OrgID: tenant-1'  # to query a Mimir tenant
+promq -c --drop-label uid                           # to chart without the noisy uid label
+promq --metric-allow 'apiserver_.*'                 # to only keep the apiserver's own metrics
+promq --rules rules.yaml                            # to also complete the recording rules in rules.yaml
+promq -c --alert 'up == 0 for 30s' --bell           # to be told when a target goes down
+promq -c --legend-stats                             # to see each series' current, min, max and average by its title
+promq -c --theme colorblind                         # to chart in colors which are easier to tell apart
+promq lsp -t http://localhost:8080/metrics          # to serve completion to editors over the language server protocol
+promq test-rules rules_test.yaml                    # to run the unit tests of recording rules, like 'promtool test rules'
+promq autocomplete-server --listen-address :8099    # to serve completion over HTTP, i.e. curl ':8099/complete?query=sum(rate('
 `,
         SilenceUsage: true,
 
@@ -99,10 +196,90 @@ promq -q "apiserver_request_total" -oyaml           # to query for all metrics m
     promq := &RootPromQCmd{Command: cmd, options: o}
 
     addFlags(cmd, o)
+    cmd.AddCommand(newCmdLanguageServer(o))
+    cmd.AddCommand(newCmdAutocompleteServer(o))
+    cmd.AddCommand(newCmdTestRules(o))
 
     return promq
 }
 
+// newCmdLanguageServer provides a subcommand which serves completion, diagnostics, hover
+// docs and formatting to editors over stdio
+func newCmdLanguageServer(o *PromQOptions) *cobra.Command {
+    cmd := &cobra.Command{
+        Use:          "lsp [options]",
+        Short:        "speaks the language server protocol over stdio, for editing PromQL queries",
+        SilenceUsage: true,
+
+        RunE: func(c *cobra.Command, args []string) error {
+            if err := o.Complete(c, args); err != nil {
+                return err
+            }
+            ac, err := o.toPromQCmd()
+            if err != nil {
+                return err
+            }
+            metricCmd := metrics.MetricsCommand{
+                PromQCommand: ac,
+                // editors don't need metrics to be as fresh as a chart does
+                Period: 30 * time.Second,
+                Window: 1 * time.Minute,
+            }
+            return metricCmd.RunLanguageServer(o.flags)
+        },
+    }
+    addCompletionFlags(cmd, o)
+    return cmd
+}
+
+// newCmdAutocompleteServer provides a subcommand which serves autocompletion over HTTP
+func newCmdAutocompleteServer(o *PromQOptions) *cobra.Command {
+    cmd := &cobra.Command{
+        Use:          "autocomplete-server [options]",
+        Short:        "serves autocompletion of PromQL queries over HTTP, at /complete",
+        SilenceUsage: true,
+
+        RunE: func(c *cobra.Command, args []string) error {
+            if err := o.Complete(c, args); err != nil {
+                return err
+            }
+            ac, err := o.toPromQCmd()
+            if err != nil {
+                return err
+            }
+            metricCmd := metrics.MetricsCommand{
+                PromQCommand: ac,
+                Period:       30 * time.Second,
+                Window:       1 * time.Minute,
+            }
+            return metricCmd.RunAutocompleteServer(o.flags)
+        },
+    }
+    cmd.Flags().StringVar(&o.flags.ListenAddress, "listen-address", "localhost:8099", "the address to serve autocompletion on")
+    addCompletionFlags(cmd, o)
+    return cmd
+}
+
+// newCmdTestRules provides a subcommand which runs the unit tests of rules, like
+// 'promtool test rules' does, without needing promtool
+func newCmdTestRules(o *PromQOptions) *cobra.Command {
+    cmd := &cobra.Command{
+        Use:          "test-rules <test-file>...",
+        Short:        "runs the promql_expr_test of 'promtool test rules' unit test files",
+        Args:         cobra.MinimumNArgs(1),
+        SilenceUsage: true,
+
+        RunE: func(c *cobra.Command, args []string) error {
+            // the tests bring their own series, there's no cluster to talk to
+            metricCmd := metrics.MetricsCommand{
+                PromQCommand: cli.PromQCommand{Streams: o.IOStreams},
+            }
+            return metricCmd.RunRuleTests(args)
+        },
+    }
+    return cmd
+}
+
 // Complete sets all information required for updating the current context
 func (o *PromQOptions) Complete(cmd *cobra.Command, args []string) error {
     o.args = args
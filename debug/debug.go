@@ -16,7 +16,10 @@ limitations under the License.
 
 package debug
 
-import "log"
+import (
+	"io/ioutil"
+	"log"
+)
 
 var (
 	debugLogger *log.Logger
@@ -26,6 +29,12 @@ func init() {
 	debugLogger = NewDebugLogger("debug.log")
 }
 
+// Enabled is whether debug logs go anywhere, so that callers can skip building
+// expensive log messages (i.e. the whole earley chart) when they don't.
+func Enabled() bool {
+	return debugLogger.Writer() != ioutil.Discard
+}
+
 func Debugf(format string, v ...interface{}) {
 	debugLogger.Printf(format, v...)
 }
@@ -0,0 +1,113 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package autocomplete
+
+import (
+	"container/list"
+	"sync"
+)
+
+// CacheKey identifies a completion request: the (normalized) query up to the
+// autocomplete prefix, and the prefix itself.
+type CacheKey struct {
+	Query  string
+	Prefix string
+}
+
+type cacheEntry struct {
+	key     CacheKey
+	matches []Match
+}
+
+// SuggestionCache is a LRU cache of suggestions. Suggestions depend on the
+// contents of the index, so the cache is only valid for a single generation
+// of the index (see QueryIndex.Generation) and is dropped when that changes.
+type SuggestionCache struct {
+	mu         sync.Mutex
+	size       int
+	generation uint64
+	entries    *list.List
+	keys       map[CacheKey]*list.Element
+}
+
+func NewSuggestionCache(size int) *SuggestionCache {
+	return &SuggestionCache{
+		size:    size,
+		entries: list.New(),
+		keys:    map[CacheKey]*list.Element{},
+	}
+}
+
+// Get returns the cached suggestions for key, if they were computed against
+// the given generation of the index.
+func (c *SuggestionCache) Get(key CacheKey, generation uint64) ([]Match, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checkGeneration(generation)
+	e, ok := c.keys[key]
+	if !ok {
+		return nil, false
+	}
+	c.entries.MoveToFront(e)
+	return copyMatches(e.Value.(*cacheEntry).matches), true
+}
+
+// Add caches the suggestions for key, evicting the least recently used
+// suggestions if the cache is full.
+func (c *SuggestionCache) Add(key CacheKey, generation uint64, matches []Match) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checkGeneration(generation)
+	if e, ok := c.keys[key]; ok {
+		e.Value.(*cacheEntry).matches = copyMatches(matches)
+		c.entries.MoveToFront(e)
+		return
+	}
+	c.keys[key] = c.entries.PushFront(&cacheEntry{key: key, matches: copyMatches(matches)})
+	for c.entries.Len() > c.size {
+		oldest := c.entries.Back()
+		c.entries.Remove(oldest)
+		delete(c.keys, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// Purge drops all cached suggestions.
+func (c *SuggestionCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.purge()
+}
+
+func (c *SuggestionCache) checkGeneration(generation uint64) {
+	if generation != c.generation {
+		c.purge()
+		c.generation = generation
+	}
+}
+
+func (c *SuggestionCache) purge() {
+	c.entries.Init()
+	c.keys = map[CacheKey]*list.Element{}
+}
+
+// callers are free to reorder the suggestions they get, so don't hand out our copy
+func copyMatches(matches []Match) []Match {
+	if matches == nil {
+		return nil
+	}
+	return append(make([]Match, 0, len(matches)), matches...)
+}
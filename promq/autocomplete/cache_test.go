@@ -0,0 +1,68 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package autocomplete
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSuggestionCache(t *testing.T) {
+	one := CacheKey{Query: "sum (", Prefix: "m"}
+	two := CacheKey{Query: "sum (", Prefix: "me"}
+	three := CacheKey{Query: "rate (", Prefix: "m"}
+	oneMatches := []Match{testMatch("metric_name_one"), testMatch("max")}
+	twoMatches := []Match{testMatch("metric_name_one")}
+	threeMatches := []Match{testMatch("metric_name_two")}
+
+	c := NewSuggestionCache(2)
+	c.Add(one, 1, oneMatches)
+	c.Add(two, 1, twoMatches)
+	if got, ok := c.Get(one, 1); !ok || !reflect.DeepEqual(got, oneMatches) {
+		t.Errorf("Get(%v) = %v, %v, want %v", one, got, ok, oneMatches)
+	}
+
+	// two is now the least recently used
+	c.Add(three, 1, threeMatches)
+	if _, ok := c.Get(two, 1); ok {
+		t.Errorf("Get(%v) should have been evicted", two)
+	}
+	if got, ok := c.Get(three, 1); !ok || !reflect.DeepEqual(got, threeMatches) {
+		t.Errorf("Get(%v) = %v, %v, want %v", three, got, ok, threeMatches)
+	}
+
+	// callers can't mess with what we've cached
+	got, _ := c.Get(one, 1)
+	got[0] = testMatch("oops")
+	if got, _ := c.Get(one, 1); !reflect.DeepEqual(got, oneMatches) {
+		t.Errorf("Get(%v) = %v, want %v", one, got, oneMatches)
+	}
+
+	// a new generation of the index invalidates everything
+	if _, ok := c.Get(one, 2); ok {
+		t.Errorf("Get(%v) should miss for a new generation", one)
+	}
+	if _, ok := c.Get(three, 1); ok {
+		t.Errorf("Get(%v) should miss once the cache has moved on to a new generation", three)
+	}
+
+	c.Add(one, 2, oneMatches)
+	c.Purge()
+	if _, ok := c.Get(one, 2); ok {
+		t.Errorf("Get(%v) should miss after a purge", one)
+	}
+}
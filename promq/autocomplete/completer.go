@@ -16,7 +16,13 @@ limitations under the License.
 
 package autocomplete
 
-import "sigs.k8s.io/instrumentation-tools/notstdlib/sets"
+import (
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/textparse"
+
+	"sigs.k8s.io/instrumentation-tools/notstdlib/sets"
+	"sigs.k8s.io/instrumentation-tools/promq/prom"
+)
 
 // in order to generate completion results, we require some store
 // to implement an interface for retrieving metric names, their
@@ -26,13 +32,60 @@ type QueryIndex interface {
 	GetMetricNames() sets.String
 	GetStoredDimensionsForMetric(string) sets.String
 	GetStoredValuesForMetricAndDimension(string, string) sets.String
+	// like GetStoredValuesForMetricAndDimension, but only for series the matchers match
+	GetStoredValuesForMetricAndDimensionMatching(string, string, ...*labels.Matcher) sets.String
+	// the metrics with a label, or a value of one, whichever series it's on
+	GetMetricsWithLabel(string) sets.String
+	GetMetricsWithLabelValue(string, string) sets.String
+	GetMetricType(string) textparse.MetricType
+	GetMetricHelp(string) string
+	GetMetricStability(string) prom.StabilityLevel
+	GetMetricUnit(string) string
+	// Generation changes whenever the contents of the index do, so that
+	// anything derived from the index knows when it's stale.
+	Generation() uint64
 }
 type Match interface {
 	GetValue() string
 	GetKind() string
 	GetDetail() string
+	// GetRange is the part of the query the value replaces, which may carry on
+	// past the cursor when it's in the middle of a word.
+	GetRange() Range
+}
+
+// Range locates some text in a query, in bytes.
+type Range struct {
+	Offset int
+	Length int
 }
 type PromQLCompleter interface {
 	QueryIndex
 	GenerateSuggestions(query string, pos int) []Match
+	// RecordQuery lets the completer know a query was used, so that
+	// the terms in it can be ranked higher in future suggestions.
+	RecordQuery(query string)
+	// Diagnose reports the syntax errors in a query, or nothing if it's valid.
+	Diagnose(query string) []Diagnostic
+}
+
+// SuggestionSource offers expressions to complete with from somewhere other than
+// the index, i.e. the queries which were run before.
+type SuggestionSource interface {
+	// Suggest returns the expressions on offer, unfiltered. wholeQuery is set when
+	// nothing comes before the expression being completed, so that whole queries
+	// make sense too.
+	Suggest(wholeQuery bool) []Match
+	// Record lets the source know a query was run.
+	Record(query string)
+}
+
+// Diagnostic points out a syntax error in a query, i.e. to underline it.
+type Diagnostic struct {
+	// Offset and Length locate the offending text in the query, in bytes.
+	Offset  int
+	Length  int
+	Message string
+	// Expected has the kinds of token which would have been valid instead.
+	Expected []string
 }
@@ -0,0 +1,107 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package autocomplete
+
+import (
+	"fmt"
+	"strings"
+
+	"sigs.k8s.io/instrumentation-tools/notstdlib/sets"
+)
+
+// DidYouMean finds what a name which isn't one of the candidates was most likely
+// meant to be, i.e. 'temperature' for 'temprature', like git does for commands. It
+// returns the candidates closest to the name, in order, or nothing if none of them
+// are close enough to be worth mentioning.
+func DidYouMean(name string, candidates sets.String) []string {
+	// a typo or two, anything more and it's likely a different name altogether
+	maxDistance := len(name) / 4
+	if maxDistance < 1 {
+		maxDistance = 1
+	}
+	var closest []string
+	for _, c := range candidates.List() {
+		if abs(len(c)-len(name)) > maxDistance {
+			continue
+		}
+		d := editDistance(name, c)
+		switch {
+		case d > maxDistance:
+		case d < maxDistance || len(closest) == 0:
+			maxDistance = d
+			closest = []string{c}
+		default:
+			closest = append(closest, c)
+		}
+	}
+	return closest
+}
+
+// DidYouMeanHint phrases what DidYouMean came up with, to tack on to a message about
+// the name, i.e. 'did you mean temperature?'. It's empty if there's nothing close.
+func DidYouMeanHint(name string, candidates sets.String) string {
+	closest := DidYouMean(name, candidates)
+	switch len(closest) {
+	case 0:
+		return ""
+	case 1:
+		return fmt.Sprintf("did you mean %s?", closest[0])
+	default:
+		return fmt.Sprintf("did you mean one of %s?", strings.Join(closest, ", "))
+	}
+}
+
+// editDistance counts the insertions, deletions, substitutions and transpositions of
+// adjacent characters it takes to turn a into b. Names are ASCII, so bytes will do.
+func editDistance(a, b string) int {
+	// we only ever need the last two rows
+	prev2 := make([]int, len(b)+1)
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(min(prev[j]+1, cur[j-1]+1), prev[j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				cur[j] = min(cur[j], prev2[j-2]+1)
+			}
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(b)]
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func abs(a int) int {
+	if a < 0 {
+		return -a
+	}
+	return a
+}
@@ -0,0 +1,58 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package autocomplete
+
+import (
+	"reflect"
+	"testing"
+
+	"sigs.k8s.io/instrumentation-tools/notstdlib/sets"
+)
+
+func TestDidYouMean(t *testing.T) {
+	names := sets.NewString("temperature", "requests_total", "request_total", "errors_total", "up")
+	testCases := []struct {
+		name string
+		want []string
+	}{
+		{name: "temprature", want: []string{"temperature"}},
+		{name: "tempreature", want: []string{"temperature"}},
+		{name: "requsts_total", want: []string{"requests_total"}},
+		{name: "requests_tota", want: []string{"requests_total"}},
+		{name: "requests_totl", want: []string{"requests_total"}},
+		{name: "reqest_total", want: []string{"request_total"}},
+		{name: "requestz_total", want: []string{"request_total", "requests_total"}},
+		{name: "ip", want: []string{"up"}},
+		{name: "latency_seconds", want: nil},
+		{name: "x", want: nil},
+	}
+	for _, tc := range testCases {
+		if got := DidYouMean(tc.name, names); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("DidYouMean(%q) = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestDidYouMeanHint(t *testing.T) {
+	names := sets.NewString("requests_total", "request_total")
+	if got, want := DidYouMeanHint("requestz_total", names), "did you mean one of request_total, requests_total?"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got := DidYouMeanHint("latency_seconds", names); got != "" {
+		t.Errorf("got %q for a name nothing is close to", got)
+	}
+}
@@ -42,11 +42,16 @@ type EarleyChart interface {
 	States() []*StateSet
 	GetState(insertionOrderZeroIndexed int) *StateSet
 	String() string
+	ParseTrees() []*ParseNode
+	Derivation(id ItemId) *ParseNode
 }
 
 type earleyChart struct {
 	inputWords Tokens
 	state      []*StateSet
+	// spare has the state sets we've truncated, to reuse rather than allocate new ones
+	// on every keystroke
+	spare []*StateSet
 }
 
 func initializeChart(g Grammar) *earleyChart {
@@ -55,12 +60,16 @@ func initializeChart(g Grammar) *earleyChart {
 	initialSets := []*StateSet{
 		initialSet,
 	}
-	return &earleyChart{[]Tokhan{}, initialSets}
+	return &earleyChart{inputWords: []Tokhan{}, state: initialSets}
 }
 
 // truncate the stateset and keep the stateset before index
 func (c *earleyChart) resetChartBeforeIndex(index int) {
 	c.inputWords = c.inputWords[:index]
+	for i := index + 1; i < len(c.state); i++ {
+		c.spare = append(c.spare, c.state[i])
+		c.state[i] = nil
+	}
 	c.state = c.state[:index+1]
 }
 
@@ -107,9 +116,7 @@ func (c *earleyChart) GetValidTerminalTypesAtStateSet(wordIndex int) (types []Co
 			tknCtx := &ContextualToken{TokenType: tkn}
 			if _, ok := terminalTypes[tkn]; !ok {
 				terminalTypes[tkn] = true
-				if tkn != METRIC_ID {
-					tknCtx.ctx = item.ctx
-				}
+				tknCtx.ctx = item.ctx
 				types = append(types, *tknCtx)
 			}
 		default:
@@ -137,6 +144,19 @@ func (c *earleyChart) String() string {
 	return sb.String()
 }
 
+// appendStateSet adds an empty state set to the end of the chart, reusing a spare one
+// if we have one.
+func (c *earleyChart) appendStateSet() {
+	if n := len(c.spare); n > 0 {
+		set := c.spare[n-1]
+		c.spare = c.spare[:n-1]
+		set.reset()
+		c.append(set)
+		return
+	}
+	c.append(NewStateSet())
+}
+
 func (c *earleyChart) append(set *StateSet) {
 	set.stateNo = len(c.state)
 	c.state = append(c.state, set)
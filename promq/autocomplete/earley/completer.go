@@ -17,23 +17,77 @@ limitations under the License.
 package earley
 
 import (
+	"context"
+	"fmt"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/textparse"
 
 	"sigs.k8s.io/instrumentation-tools/debug"
 	"sigs.k8s.io/instrumentation-tools/notstdlib/sets"
 	"sigs.k8s.io/instrumentation-tools/promq/autocomplete"
+	"sigs.k8s.io/instrumentation-tools/promq/prom"
 )
 
 const (
-	PromQLTokenSeparators = " []{}()+-*/%^=!><~,"
+	PromQLTokenSeparators = " \t\r\n[]{}()+-*/%^=!><~,@"
+
+	// how many distinct completion requests we remember the suggestions for
+	suggestionCacheSize = 128
+
+	// a common scrape interval, for when we aren't told what it actually is
+	defaultScrapeInterval = 15 * time.Second
+
+	// providers are asked for suggestions on every keystroke, so can't take long
+	providerTimeout = 200 * time.Millisecond
+)
+
+var (
+	// functions which only make sense when applied to counters
+	counterFunctions = sets.NewString("rate", "irate", "increase", "resets")
+
+	// these only make sense on native histograms
+	nativeHistogramFunctions = sets.NewString("histogram_count", "histogram_sum", "histogram_fraction", "histogram_stddev", "histogram_stdvar")
+
+	// the parameters we suggest for the aggregations and functions which take a number
+	// first, i.e. topk(5, ...) or quantile(0.9, ...)
+	numberParameters = map[string]map[string]string{
+		"topk":               {"5": "the 5 largest series", "10": "the 10 largest series"},
+		"bottomk":            {"5": "the 5 smallest series", "10": "the 10 smallest series"},
+		"quantile":           quantileParameters,
+		"quantile_over_time": quantileParameters,
+		"histogram_quantile": quantileParameters,
+	}
+	quantileParameters = map[string]string{
+		"0.5":  "the median",
+		"0.9":  "the 90th percentile",
+		"0.95": "the 95th percentile",
+		"0.99": "the 99th percentile",
+	}
+
+	// likewise for those which take a string first, i.e. count_values("version", ...)
+	stringParameters = map[string]map[string]string{
+		"count_values": {`"value"`: "the label to count each distinct value under"},
+	}
+
+	// subquery resolutions are suggested in multiples of the scrape interval
+	resolutionMultiples = []int{1, 2, 5, 10, 30, 60}
+
+	// ranges people commonly select, on top of the shortest one rate() can work with
+	commonRanges = []time.Duration{time.Minute, 5 * time.Minute, 15 * time.Minute, time.Hour}
 )
 
 type matchResult struct {
 	Value  string // this is the text for completion
 	Kind   string // type of match from which this result is populated
 	Detail string // additional information that may be displayed for auto-complete
+	// the part of the query the value replaces
+	Range autocomplete.Range
 }
 
 func (m matchResult) GetValue() string {
@@ -48,19 +102,107 @@ func (m matchResult) GetDetail() string {
 	return m.Detail
 }
 
+func (m matchResult) GetRange() autocomplete.Range {
+	return m.Range
+}
+
 func NewPartialMatch(name, kind, detail string) autocomplete.Match {
 	return &matchResult{Value: name, Kind: kind, Detail: detail}
 }
 
 func NewPromQLCompleter(index autocomplete.QueryIndex) autocomplete.PromQLCompleter {
+	return NewPromQLCompleterWithFilter(index, autocomplete.FilterPrefix)
+}
+
+// NewPromQLCompleterWithFilter returns a completer which uses the given matching strategy
+// (e.g. autocomplete.FilterFuzzy) to filter suggestions against the autocomplete prefix.
+func NewPromQLCompleterWithFilter(index autocomplete.QueryIndex, filter autocomplete.FilterFunc) autocomplete.PromQLCompleter {
+	return NewPromQLCompleterWithOptions(index, CompleterOptions{Filter: filter})
+}
+
+// CompleterOptions tweak how a PromQL completer generates suggestions. The zero
+// value gives the defaults.
+type CompleterOptions struct {
+	// Filter matches suggestions against the autocomplete prefix, autocomplete.FilterPrefix
+	// if not set.
+	Filter autocomplete.FilterFunc
+	// Matching loosens how metric and label names are matched, i.e. to ignore case.
+	Matching autocomplete.MatchOptions
+	// ScrapeInterval is how often the index is updated, which subquery resolutions
+	// are suggested in multiples of.
+	ScrapeInterval time.Duration
+	// Window is how far back the data we query goes, so there's no point in suggesting
+	// ranges any longer than it. Unlimited if not set.
+	Window time.Duration
+	// MaxResults caps how many suggestions we return, the rest are summed up by a
+	// single match of kind "overflow". Unlimited if not set.
+	MaxResults int
+	// UnstableMetrics is what we do with alpha, internal and deprecated metrics.
+	UnstableMetrics UnstableMetricsPolicy
+	// Sources offer expressions on top of what's in the index, wherever a metric could
+	// go, i.e. an autocomplete.History. Queries are recorded to them too.
+	Sources []autocomplete.SuggestionSource
+	// Providers are consulted for every kind of token we suggest, on top of the index.
+	Providers *autocomplete.Registry
+}
+
+// UnstableMetricsPolicy decides how metrics which may go away are suggested.
+type UnstableMetricsPolicy int
+
+const (
+	// ShowUnstableMetrics ranks unstable metrics like any other, the default
+	ShowUnstableMetrics UnstableMetricsPolicy = iota
+	// DemoteUnstableMetrics suggests unstable metrics after the rest
+	DemoteUnstableMetrics
+	// HideUnstableMetrics doesn't suggest unstable metrics at all
+	HideUnstableMetrics
+)
+
+func NewPromQLCompleterWithOptions(index autocomplete.QueryIndex, opts CompleterOptions) autocomplete.PromQLCompleter {
+	if opts.Filter == nil {
+		opts.Filter = autocomplete.FilterPrefix
+	}
+	if opts.ScrapeInterval <= 0 {
+		opts.ScrapeInterval = defaultScrapeInterval
+	}
 	return &promQLCompleter{
-		index: index,
+		index:          index,
+		filter:         opts.Filter,
+		nameFilter:     autocomplete.Loosely(opts.Filter, opts.Matching),
+		scrapeInterval: opts.ScrapeInterval,
+		window:         opts.Window,
+		maxResults:     opts.MaxResults,
+		unstable:       opts.UnstableMetrics,
+		sources:        opts.Sources,
+		providers:      opts.Providers,
+		ranker:         autocomplete.NewRanker(),
+		lexer:          newLuthor(),
+		parser:         NewEarleyParser(*promQLGrammar),
+		cache:          autocomplete.NewSuggestionCache(suggestionCacheSize),
 	}
 }
 
 type promQLCompleter struct {
 	autocomplete.PromQLCompleter
-	index autocomplete.QueryIndex
+	index  autocomplete.QueryIndex
+	filter autocomplete.FilterFunc
+	// like filter, but as loose as we were asked to be, for metric and label names
+	nameFilter autocomplete.FilterFunc
+	// subquery resolutions are suggested in multiples of this
+	scrapeInterval time.Duration
+	// ranges are suggested up to this long
+	window time.Duration
+	// we return at most this many suggestions, if set
+	maxResults int
+	unstable   UnstableMetricsPolicy
+	sources    []autocomplete.SuggestionSource
+	providers  *autocomplete.Registry
+	ranker     *autocomplete.Ranker
+	// successive queries tend to share a prefix, so hang on to our lexer
+	lexer *luthor
+	// likewise, our parser only reparses from the first token which changed
+	parser *Earley
+	cache  *autocomplete.SuggestionCache
 }
 
 func (c *promQLCompleter) GetMetricNames() sets.String {
@@ -75,6 +217,66 @@ func (c *promQLCompleter) GetStoredValuesForMetricAndDimension(mName, lName stri
 	return autocomplete.Enquote(c.index.GetStoredValuesForMetricAndDimension(mName, lName))
 }
 
+func (c *promQLCompleter) GetStoredValuesForMetricAndDimensionMatching(mName, lName string, matchers ...*labels.Matcher) sets.String {
+	return autocomplete.Enquote(c.index.GetStoredValuesForMetricAndDimensionMatching(mName, lName, matchers...))
+}
+
+func (c *promQLCompleter) GetMetricsWithLabel(lName string) sets.String {
+	return c.index.GetMetricsWithLabel(lName)
+}
+
+func (c *promQLCompleter) GetMetricsWithLabelValue(lName, value string) sets.String {
+	return c.index.GetMetricsWithLabelValue(lName, value)
+}
+
+// metricNamesMatching returns the metric names, but only those with series which the
+// equality matchers could select, i.e. for '{namespace="kube-system", __name__="', the
+// metrics with namespace="kube-system".
+func (c *promQLCompleter) metricNamesMatching(matchers []*labels.Matcher) sets.String {
+	names := c.GetMetricNames()
+	for _, m := range matchers {
+		if m.Type != labels.MatchEqual || m.Name == labels.MetricName || m.Value == "" {
+			continue
+		}
+		names = names.Intersection(c.GetMetricsWithLabelValue(m.Name, m.Value))
+	}
+	return names
+}
+
+func (c *promQLCompleter) GetMetricType(mName string) textparse.MetricType {
+	return c.index.GetMetricType(mName)
+}
+
+func (c *promQLCompleter) GetMetricHelp(mName string) string {
+	return c.index.GetMetricHelp(mName)
+}
+
+func (c *promQLCompleter) GetMetricStability(mName string) prom.StabilityLevel {
+	return c.index.GetMetricStability(mName)
+}
+
+func (c *promQLCompleter) GetMetricUnit(mName string) string {
+	return c.index.GetMetricUnit(mName)
+}
+
+// isUnstable checks whether a metric may change or go away without notice.
+func (c *promQLCompleter) isUnstable(mName string) bool {
+	switch c.GetMetricStability(mName) {
+	case prom.StabilityAlpha, prom.StabilityInternal, prom.StabilityDeprecated:
+		return true
+	}
+	return false
+}
+
+// Generation changes whenever the index does, or what our providers suggest might have.
+func (c *promQLCompleter) Generation() uint64 {
+	if c.providers == nil {
+		return c.index.Generation()
+	}
+	// both only ever go up, so their sum changes whenever either does
+	return c.index.Generation() + c.providers.Generation()
+}
+
 func (c *promQLCompleter) SuggestParens(query string, pos int, isPrecededByWhiteSpace bool) sets.String {
 	if isPrecededByWhiteSpace {
 		return sets.NewString("(")
@@ -86,52 +288,166 @@ func (c *promQLCompleter) SuggestParens(query string, pos int, isPrecededByWhite
 // them to a concrete list of suggestion via our indexer. We compute our autocomplete
 // prefix (i.e. the incomplete text at the cursor position) and use that to filter
 // against our concrete list.
+//
+// The query may span multiple lines, pos is the byte offset of the cursor in it. If the
+// cursor is in the middle of a word, we match against the part before it, but each
+// suggestion replaces the whole word.
 func (c *promQLCompleter) GenerateSuggestions(query string, pos int) []autocomplete.Match {
 	var matches []autocomplete.Match
 	q := query[0:pos]
 	autocompletePrefix := getPrefix(q)
-	debug.Debugf("\n\nautocomplete prefix: '%v'\n\n", autocompletePrefix)
+	autocompleteSuffix := getSuffix(query[pos:])
+	debug.Debugf("\n\nautocomplete prefix: '%v', suffix: '%v'\n\n", autocompletePrefix, autocompleteSuffix)
+	replace := autocomplete.Range{Offset: pos - len(autocompletePrefix), Length: len(autocompletePrefix) + len(autocompleteSuffix)}
 
 	q = q[0 : len(q)-len(autocompletePrefix)]
-	tokens := extractWords(q)
-	suggestions := PromQLParser.GetSuggestedTokenType(tokens)
+	tokens := c.lexer.lex(q)
+	tokens.Print()
 
+	// i.e. when paging through suggestions, nothing has changed since last time
+	cacheKey := autocomplete.CacheKey{Query: strings.Join(tokens.Vals(), "\x00"), Prefix: autocompletePrefix}
+	generation := c.Generation()
+	if cached, ok := c.cache.Get(cacheKey, generation); ok {
+		return withRange(cached, replace, pos)
+	}
+
+	suggestions := c.parser.GetSuggestedTokenType(tokens)
+
+	// the providers have providerTimeout between them, however many token types
+	// they're asked about
+	providerCtx, cancel := context.WithTimeout(context.Background(), providerTimeout)
+	defer cancel()
+	offeredSources := false
 	for _, s := range suggestions {
+		matches = append(matches, c.providerMatches(providerCtx, s, autocompletePrefix)...)
 		switch {
 		case s.TokenType == METRIC_LABEL_SUBTYPE:
 			if s.ctx.HasMetric() {
 				metricName := s.ctx.GetMetric()
-				for _, d := range autocomplete.FilterPrefix(c.GetStoredDimensionsForMetric(metricName), autocompletePrefix, false).List() {
-					values := c.GetStoredValuesForMetricAndDimension(metricName, d).List()
+				// labels like "label.name" have to be quoted
+				dims := map[string]string{}
+				for _, d := range c.GetStoredDimensionsForMetric(metricName).List() {
+					dims[quoteLabelName(d)] = d
+				}
+				for _, d := range c.nameFilter(sets.StringKeySet(dims), autocompletePrefix, false).List() {
+					values := c.GetStoredValuesForMetricAndDimension(metricName, dims[d]).List()
 					newMatch := NewPartialMatch(d, "metric-label", strings.Join(values, ","))
 					matches = append(matches, newMatch)
 				}
+			} else if inLabelMatchers(tokens) && c.nameFilter(sets.NewString(labels.MetricName), autocompletePrefix, false).Len() > 0 {
+				// i.e. '{', we don't know what labels there are until we know the metric
+				matches = append(matches, NewPartialMatch(labels.MetricName, "metric-label", "the metric name"))
 			}
 		case s.TokenType == METRIC_ID:
-			metricMatches := autocomplete.FilterPrefix(c.GetMetricNames(), autocompletePrefix, false)
+			var function string
+			if s.ctx != nil && s.ctx.HasFunction() {
+				function = s.ctx.GetFunction()
+			}
+			metricMatches := c.nameFilter(c.GetMetricNames(), autocompletePrefix, false)
 			for _, m := range metricMatches.List() {
-				dims := c.GetStoredDimensionsForMetric(m).List()
-				newMatch := NewPartialMatch(m, "metric-id", strings.Join(dims, ","))
+				if c.unstable == HideUnstableMetrics && c.isUnstable(m) {
+					continue
+				}
+				metricType := c.GetMetricType(m)
+				// i.e. don't suggest gauges inside of rate(
+				if counterFunctions.Has(function) && !prom.IsCounter(m, metricType) {
+					continue
+				}
+				if nativeHistogramFunctions.Has(function) && !isNativeHistogram(m, metricType) {
+					continue
+				}
+				// prefer the metric's help text, falling back to its dimensions
+				detail := c.GetMetricHelp(m)
+				if detail == "" {
+					detail = strings.Join(c.GetStoredDimensionsForMetric(m).List(), ",")
+				}
+				if unit := c.GetMetricUnit(m); unit != "" {
+					detail += " (" + unit + ")"
+				}
+				newMatch := NewPartialMatch(metricSelector(m), "metric-id", detail)
 				matches = append(matches, newMatch)
+				// buckets are pretty useless without histogram_quantile, so offer up the whole expression
+				if function == "" && isHistogramBucket(m, metricType) {
+					q := fmt.Sprintf("histogram_quantile(0.95, rate(%s[5m]))", metricSelector(m))
+					detail := fmt.Sprintf("the 95th percentile of %s over the last 5 minutes", strings.TrimSuffix(m, "_bucket"))
+					matches = append(matches, NewPartialMatch(q, "histogram-quantile", detail))
+				}
+				// native histograms carry their buckets, count and sum in the one series
+				if function == "" && isNativeHistogram(m, metricType) {
+					q := fmt.Sprintf("histogram_quantile(0.95, rate(%s[5m]))", metricSelector(m))
+					detail := fmt.Sprintf("the 95th percentile of %s over the last 5 minutes", m)
+					matches = append(matches, NewPartialMatch(q, "histogram-quantile", detail))
+					q = fmt.Sprintf("histogram_count(rate(%s[5m]))", metricSelector(m))
+					detail = fmt.Sprintf("the per-second rate of %s observations over the last 5 minutes", m)
+					matches = append(matches, NewPartialMatch(q, "histogram-count", detail))
+				}
+			}
+			// expressions from elsewhere go wherever a metric does, so long as they aren't
+			// the argument of a function, which may well want a range vector instead
+			if function == "" && !offeredSources {
+				offeredSources = true
+				// the query is the only token, besides EOF, so far
+				matches = append(matches, c.sourceMatches(len(tokens) == 1, autocompletePrefix)...)
+			}
+		case s.TokenType == QUOTED_METRIC_ID:
+			// i.e. '{"my.', names which don't need quoting are suggested as plain metric names
+			quoted := map[string]string{}
+			for _, m := range c.GetMetricNames().List() {
+				if !model.IsValidMetricName(model.LabelValue(m)) {
+					quoted[strconv.Quote(m)] = m
+				}
+			}
+			for _, m := range c.nameFilter(sets.StringKeySet(quoted), autocompletePrefix, false).List() {
+				matches = append(matches, NewPartialMatch(m, "metric-id", c.GetMetricHelp(quoted[m])))
+			}
+		case s.TokenType == STRING && s.ctx.HasMetricLabel() && s.ctx.GetMetricLabel() == labels.MetricName:
+			names := c.metricNamesMatching(s.ctx.GetMetricLabelMatchers())
+			for _, m := range c.nameFilter(autocomplete.Enquote(names), autocompletePrefix, false).List() {
+				matches = append(matches, NewPartialMatch(m, "metric-id", c.GetMetricHelp(unquote(m))))
 			}
+		case s.TokenType == NUM:
+			matches = append(matches, c.parameterMatches(numberParameters, s.ctx, tokens, autocompletePrefix)...)
 		case s.TokenType == STRING:
+			matches = append(matches, c.parameterMatches(stringParameters, s.ctx, tokens, autocompletePrefix)...)
 			if s.ctx.HasMetric() && s.ctx.HasMetricLabel() {
-				for _, m := range autocomplete.FilterPrefix(c.GetStoredValuesForMetricAndDimension(s.ctx.GetMetric(), s.ctx.GetMetricLabel()), autocompletePrefix, false).List() {
+				// only suggest values which go with the other matchers, i.e. for 'metric{dima="1", dimb="'
+				// the values of dimb amongst the series with dima="1"
+				var matchers []*labels.Matcher
+				for _, m := range s.ctx.GetMetricLabelMatchers() {
+					if m.Name != s.ctx.GetMetricLabel() {
+						matchers = append(matchers, m)
+					}
+				}
+				values := c.GetStoredValuesForMetricAndDimensionMatching(s.ctx.GetMetric(), s.ctx.GetMetricLabel(), matchers...)
+				for _, m := range c.filter(values, autocompletePrefix, false).List() {
 					dims := c.GetStoredDimensionsForMetric(m).List()
 					newMatch := NewPartialMatch(m, "metric-id", strings.Join(dims, ","))
 					matches = append(matches, newMatch)
 				}
 			}
 		case s.TokenType == DURATION:
+			durationPrefix := autocompletePrefix
+			// subquery expression has range and resolution that are split by ":"
+			if i := strings.Index(autocompletePrefix, ":"); i >= 0 {
+				durationPrefix = autocompletePrefix[i+1:]
+				subqueryRange := autocompletePrefix[:i]
+				if !isRangeStart(tokens) {
+					// the prefix is only the last term of a composed range, i.e. '[5m+30s:'
+					subqueryRange = ""
+				}
+				matches = append(matches, c.resolutionMatches(subqueryRange, autocompletePrefix[:i+1], durationPrefix)...)
+			} else if subqueryRange, ok := getSubqueryRange(tokens); ok && autocompletePrefix == "" {
+				// i.e. 'metric[5m: '
+				matches = append(matches, c.resolutionMatches(subqueryRange, "", "")...)
+			} else if isRangeStart(tokens) && autocompletePrefix == "" {
+				// i.e. 'metric['
+				matches = append(matches, c.rangeMatches()...)
+			}
 			// add time units to match is the prefix is number
-			if autocompletePrefix == "" {
+			if durationPrefix == "" {
 				continue
 			}
-			// subquery expression has range and resolution that are split by ":"
-			if strings.Contains(autocompletePrefix, ":") {
-				autocompletePrefix = strings.Split(autocompletePrefix, ":")[1]
-			}
-			if _, err := strconv.Atoi(autocompletePrefix); err == nil {
+			if _, err := strconv.Atoi(durationPrefix); err == nil {
 				for _, ao := range sets.StringKeySet(timeUnits).List() {
 					newMatch := NewPartialMatch(ao, "time-unit", timeUnits[ao])
 					matches = append(matches, newMatch)
@@ -139,29 +455,344 @@ func (c *promQLCompleter) GenerateSuggestions(query string, pos int) []autocompl
 			}
 		case tokenTypeStringSet.Has(string(s.TokenType)):
 			mapping := tokenTypeMatching[s.TokenType]
-			for _, ao := range autocomplete.FilterPrefix(sets.StringKeySet(mapping), autocompletePrefix, false).List() {
+			for _, ao := range c.filter(sets.StringKeySet(mapping), autocompletePrefix, false).List() {
 				newMatch := NewPartialMatch(ao, string(s.TokenType), mapping[ao])
 				matches = append(matches, newMatch)
 			}
 		}
-		sort.Slice(matches, func(i, j int) bool {
-			return matches[i].GetValue() > matches[j].GetValue()
+	}
+	// order by relevance, so that the best matches are shown first
+	c.ranker.Sort(matches, autocompletePrefix)
+	if c.unstable == DemoteUnstableMetrics {
+		sort.SliceStable(matches, func(i, j int) bool {
+			return !c.isUnstableMatch(matches[i]) && c.isUnstableMatch(matches[j])
 		})
 	}
+	matches = truncateMatches(matches, c.maxResults)
+	c.cache.Add(cacheKey, generation, matches)
+	return withRange(matches, replace, pos)
+}
+
+// resolutionMatches suggests subquery resolutions in multiples of the scrape interval, since
+// sampling more often than the data is scraped doesn't tell us anything new. valuePrefix is
+// the text before the resolution which the completion should retain.
+func (c *promQLCompleter) resolutionMatches(subqueryRange, valuePrefix, resolutionPrefix string) []autocomplete.Match {
+	rng, err := model.ParseDuration(subqueryRange)
+	details := map[string]string{}
+	for _, m := range resolutionMultiples {
+		res := time.Duration(m) * c.scrapeInterval
+		// we'd only get the one sample
+		if err == nil && res >= time.Duration(rng) {
+			break
+		}
+		detail := "the scrape interval"
+		if m > 1 {
+			detail = fmt.Sprintf("%d times the scrape interval", m)
+		}
+		details[model.Duration(res).String()] = detail
+	}
+	var matches []autocomplete.Match
+	for _, r := range c.filter(sets.StringKeySet(details), resolutionPrefix, false).List() {
+		matches = append(matches, NewPartialMatch(valuePrefix+r, "subquery-resolution", details[r]))
+	}
 	return matches
 }
 
+func (c *promQLCompleter) isUnstableMatch(m autocomplete.Match) bool {
+	return m.GetKind() == "metric-id" && c.isUnstable(m.GetValue())
+}
+
+// withRange sets the part of the query that the matches replace. The same matches are
+// cached wherever the cursor is, so we hand back copies rather than changing them.
+func withRange(matches []autocomplete.Match, r autocomplete.Range, pos int) []autocomplete.Match {
+	ranged := make([]autocomplete.Match, len(matches))
+	for i, m := range matches {
+		mr := &matchResult{Value: m.GetValue(), Kind: m.GetKind(), Detail: m.GetDetail(), Range: r}
+		// selecting the overflow match shouldn't change the query
+		if mr.Kind == "overflow" {
+			mr.Range = autocomplete.Range{Offset: pos}
+		}
+		ranged[i] = mr
+	}
+	return ranged
+}
+
+// truncateMatches keeps the first max matches, replacing the rest with a match which
+// says how many there are. Selecting it inserts nothing.
+func truncateMatches(matches []autocomplete.Match, max int) []autocomplete.Match {
+	if max <= 0 || len(matches) <= max {
+		return matches
+	}
+	overflow := len(matches) - max
+	matches = matches[:max:max]
+	return append(matches, NewPartialMatch("", "overflow", fmt.Sprintf("… %s more, keep typing", formatCount(overflow))))
+}
+
+// parameterMatches suggests values for the first argument of an aggregation or function,
+// if it's one that takes a parameter there.
+func (c *promQLCompleter) parameterMatches(parameters map[string]map[string]string, ctx *completionContext, tokens Tokens, prefix string) []autocomplete.Match {
+	// the last token is always EOF, so it's the one before it that we're after
+	if ctx == nil || !ctx.HasFunction() || len(tokens) < 2 || tokens[len(tokens)-2].Type != LEFT_PAREN {
+		return nil
+	}
+	params := parameters[ctx.GetFunction()]
+	var matches []autocomplete.Match
+	for _, p := range c.filter(sets.StringKeySet(params), prefix, false).List() {
+		matches = append(matches, NewPartialMatch(p, "parameter", params[p]))
+	}
+	return matches
+}
+
+// formatCount writes out a count with thousands separators, i.e. 4,987
+func formatCount(n int) string {
+	s := strconv.Itoa(n)
+	for i := len(s) - 3; i > 0; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	return s
+}
+
+// rangeMatches suggests ranges to select, starting with the shortest one which has
+// the two samples that rate() and friends need.
+func (c *promQLCompleter) rangeMatches() []autocomplete.Match {
+	shortest := 2 * c.scrapeInterval
+	ranges := []time.Duration{shortest}
+	for _, r := range commonRanges {
+		if r > shortest {
+			ranges = append(ranges, r)
+		}
+	}
+	var matches []autocomplete.Match
+	for _, r := range ranges {
+		if c.window > 0 && r > c.window {
+			break
+		}
+		detail := ""
+		if r%c.scrapeInterval == 0 {
+			detail = fmt.Sprintf("%d times the scrape interval", r/c.scrapeInterval)
+		}
+		matches = append(matches, NewPartialMatch(model.Duration(r).String(), "range", detail))
+	}
+	return matches
+}
+
+// isRangeStart checks whether the tokens end in the bracket which opens a range.
+func isRangeStart(tokens Tokens) bool {
+	n := len(tokens)
+	// the last token is always EOF
+	return n >= 2 && tokens[n-2].Type == LEFT_BRACKET
+}
+
+// metricSelector selects a metric by name, quoting it if it isn't a valid identifier.
+func metricSelector(name string) string {
+	if model.IsValidMetricName(model.LabelValue(name)) {
+		return name
+	}
+	return fmt.Sprintf("{%s}", strconv.Quote(name))
+}
+
+// quoteLabelName quotes a label name if it isn't a valid identifier.
+func quoteLabelName(name string) string {
+	if model.LabelName(name).IsValid() {
+		return name
+	}
+	return strconv.Quote(name)
+}
+
+// inLabelMatchers checks whether the tokens end inside the braces of a selector, rather
+// than i.e. the label list of a by clause.
+func inLabelMatchers(tokens Tokens) bool {
+	for i := len(tokens) - 1; i >= 0; i-- {
+		switch tokens[i].Type {
+		case LEFT_BRACE:
+			return true
+		case RIGHT_BRACE, LEFT_PAREN, RIGHT_PAREN:
+			return false
+		}
+	}
+	return false
+}
+
+// getSubqueryRange returns the range of the subquery, if the tokens end in one
+// which is missing its resolution.
+func getSubqueryRange(tokens Tokens) (string, bool) {
+	n := len(tokens)
+	// the last token is always EOF
+	if n < 4 || tokens[n-4].Type != LEFT_BRACKET || tokens[n-3].Type != DURATION || tokens[n-2].Type != COLON {
+		return "", false
+	}
+	return tokens[n-3].Val, true
+}
+
+// providerMatches asks our providers for matches for the suggested token, until the
+// context is done, and filters them against the prefix.
+func (c *promQLCompleter) providerMatches(ctx context.Context, s ContextualToken, prefix string) []autocomplete.Match {
+	if c.providers == nil {
+		return nil
+	}
+	// a nil *completionContext isn't a nil CompletionContext
+	var completion autocomplete.CompletionContext
+	if s.ctx != nil {
+		completion = s.ctx
+	}
+	provided := map[string]autocomplete.Match{}
+	for _, m := range c.providers.Provide(ctx, string(s.TokenType), completion) {
+		provided[m.GetValue()] = m
+	}
+	var matches []autocomplete.Match
+	for _, v := range c.filter(sets.StringKeySet(provided), prefix, false).List() {
+		matches = append(matches, NewPartialMatch(v, provided[v].GetKind(), provided[v].GetDetail()))
+	}
+	return matches
+}
+
+// sourceMatches filters what our sources have to offer against the prefix.
+func (c *promQLCompleter) sourceMatches(wholeQuery bool, prefix string) []autocomplete.Match {
+	if prefix == "" && !wholeQuery {
+		// there's no telling which of them would be any use
+		return nil
+	}
+	var matches []autocomplete.Match
+	for _, src := range c.sources {
+		offered := map[string]autocomplete.Match{}
+		for _, m := range src.Suggest(wholeQuery) {
+			offered[m.GetValue()] = m
+		}
+		for _, v := range c.filter(sets.StringKeySet(offered), prefix, false).List() {
+			matches = append(matches, NewPartialMatch(v, offered[v].GetKind(), offered[v].GetDetail()))
+		}
+	}
+	return matches
+}
+
+// RecordQuery marks the terms of a query as recently used, and passes it on to our
+// sources.
+func (c *promQLCompleter) RecordQuery(query string) {
+	for _, src := range c.sources {
+		src.Record(query)
+	}
+	var used []string
+	for _, t := range extractWords(query) {
+		if t.isEof() || t.Val == "" {
+			continue
+		}
+		used = append(used, t.Val)
+	}
+	c.ranker.MarkUsed(used...)
+	// our cached suggestions were ranked without these
+	c.cache.Purge()
+}
+
+// Diagnose parses the whole query and reports the first token which our grammar can't
+// make sense of, along with the tokens it would have accepted there. Parsing can't
+// carry on past that point, so there is at most one diagnostic.
+func (c *promQLCompleter) Diagnose(query string) []autocomplete.Diagnostic {
+	tokens := extractWords(query)
+	// use a parser of our own, so that we don't throw away the chart we complete with
+	chart := NewEarleyParser(*promQLGrammar).ParseTokens(tokens)
+	for i, t := range tokens {
+		// nothing could scan the token, so there's nothing in the set after it
+		if chart.GetState(i+1).Length() > 0 {
+			continue
+		}
+		msg := fmt.Sprintf("unexpected %q", t.Val)
+		if t.isEof() {
+			msg = "unexpected end of query"
+		}
+		expected := sets.NewString()
+		for _, e := range chart.GetValidTerminalTypesAtStateSet(i) {
+			expected.Insert(expectedName(e.TokenType))
+		}
+		return []autocomplete.Diagnostic{{
+			Offset:   t.StartPos,
+			Length:   t.EndPos - t.StartPos,
+			Message:  msg,
+			Expected: expected.List(),
+		}}
+	}
+	return nil
+}
+
+// expectedNames are what the tokens our grammar expects are called in diagnostics,
+// rather than what we call them.
+var expectedNames = map[TokenType]string{
+	ID:                   "identifier",
+	METRIC_ID:            "metric name",
+	METRIC_LABEL_SUBTYPE: "label name",
+	QUOTED_METRIC_ID:     "quoted metric name",
+	QUOTED_LABEL_ID:      "quoted label name",
+	FUNCTION_SCALAR_ID:   "function",
+	FUNCTION_VECTOR_ID:   "function",
+	ARITHMETIC:           "arithmetic operator",
+	COMPARISION:          "comparison operator",
+	SET:                  "set operator",
+	LABELMATCH:           "label matcher",
+	UNARY_OP:             "unary operator",
+	AGGR_OP:              "aggregation",
+	AGGR_KW:              "by or without",
+	BOOL_KW:              "bool",
+	OFFSET_KW:            "offset",
+	GROUP_SIDE:           "group_left or group_right",
+	GROUP_KW:             "on or ignoring",
+	OFFSET_SIGN:          "-",
+	DURATION_OP:          "duration operator",
+	AT_MODIFIER:          "@",
+	AT_PREPROCESSOR:      "start() or end()",
+	SELECTOR_LEFT_BRACE:  "{",
+	LEFT_BRACE:           "{",
+	RIGHT_BRACE:          "}",
+	LEFT_PAREN:           "(",
+	RIGHT_PAREN:          ")",
+	LEFT_BRACKET:         "[",
+	RIGHT_BRACKET:        "]",
+	COMMA:                ",",
+	COLON:                ":",
+	STRING:               "string",
+	NUM:                  "number",
+	DURATION:             "duration",
+	EOF:                  "end of query",
+}
+
+// expectedName is what a token our grammar expects is called in diagnostics.
+func expectedName(t TokenType) string {
+	if name, ok := expectedNames[t]; ok {
+		return name
+	}
+	return strings.ReplaceAll(string(t), "-", " ")
+}
+
 func getPrefix(query string) string {
 	if len(query) == 0 {
 		return ""
 	}
-	for i := len(query) - 1; i >= 0; i-- {
-		c := []rune(query)[i]
-		if strings.ContainsRune(PromQLTokenSeparators, c) {
-			// Todo(yuchen): what if the input is sum(metric_a and metric_a is the completed metric name?
-			// Should we return metric_a as a prefix or return the next suggested token of metric name?
-			return query[i+1:]
-		}
+	// the separators are all ASCII, so we can safely search bytes rather than runes
+	// Todo(yuchen): what if the input is sum(metric_a and metric_a is the completed metric name?
+	// Should we return metric_a as a prefix or return the next suggested token of metric name?
+	return query[strings.LastIndexAny(query, PromQLTokenSeparators)+1:]
+}
+
+// getSuffix is the rest of the word the cursor is in, given the query after the cursor
+func getSuffix(query string) string {
+	if i := strings.IndexAny(query, PromQLTokenSeparators); i >= 0 {
+		return query[:i]
 	}
 	return query
 }
+
+func isHistogramBucket(metricName string, metricType textparse.MetricType) bool {
+	return metricType == textparse.MetricTypeHistogram && strings.HasSuffix(metricName, "_bucket")
+}
+
+// isNativeHistogram checks whether a metric is a native histogram, which unlike a classic
+// histogram is exposed as a single series under the family name.
+func isNativeHistogram(metricName string, metricType textparse.MetricType) bool {
+	if metricType != textparse.MetricTypeHistogram {
+		return false
+	}
+	for _, suffix := range []string{"_bucket", "_sum", "_count", "_created"} {
+		if strings.HasSuffix(metricName, suffix) {
+			return false
+		}
+	}
+	return true
+}
@@ -17,10 +17,15 @@ limitations under the License.
 package earley
 
 import (
+	"context"
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/prometheus/prometheus/pkg/labels"
+
 	"sigs.k8s.io/instrumentation-tools/notstdlib/sets"
 	"sigs.k8s.io/instrumentation-tools/promq/autocomplete"
 	"sigs.k8s.io/instrumentation-tools/promq/prom"
@@ -47,6 +52,11 @@ func TestGetPrefix(t *testing.T) {
 			query: "asdfsdfa{fff=",
 			want:  "",
 		},
+		{
+			name:  "'sum(\\n\\tmetric_na' should have 'metric_na' as a prefix",
+			query: "sum(\n\tmetric_na",
+			want:  "metric_na",
+		},
 		{
 			name:  "'sum(metric_name_one{' should have '' as a prefix",
 			query: "sum(metric_name_one{",
@@ -169,7 +179,7 @@ func TestEndToEndAutoCompletion(t *testing.T) {
 			desc: "complete on binary expression - vector binary with set operation",
 			expectedMatchesQueryMap: map[string][]sets.String{
 				"metric_name_one ": {
-					sets.NewString("offset"),
+					sets.NewString("offset", "@"),
 					sets.StringKeySet(arithmeticOperators),
 					sets.StringKeySet(setOperators),
 					sets.StringKeySet(comparisionOperators),
@@ -204,8 +214,9 @@ func TestEndToEndAutoCompletion(t *testing.T) {
 				"metric_name_one * on(dima,) m": {
 					sets.NewString("metric_name_one", "metric_name_two", "max_over_time", "min_over_time", "minute", "month", "max", "min"),
 				},
+				// the right hand side can be a group() aggregation too
 				"metric_name_one * on(dima,) g": {
-					sets.NewString("group_right", "group_left"),
+					sets.NewString("group_right", "group_left", "group"),
 				},
 				"metric_name_one * on(dima,) metric_name_two{": {
 					sets.NewString("dima", "dim2"),
@@ -219,7 +230,10 @@ func TestEndToEndAutoCompletion(t *testing.T) {
 			desc: "complete on binary expression - one_to_one vector match with set operator",
 			expectedMatchesQueryMap: map[string][]sets.String{
 				"metric_name_one a": {
-					sets.NewString("and"),
+					sets.NewString("and", "atan2"),
+				},
+				"metric_name_one atan2 metric_name_two o": {
+					sets.NewString("or", "offset"),
 				},
 				"metric_name_one and o": {
 					sets.NewString("on"),
@@ -231,7 +245,7 @@ func TestEndToEndAutoCompletion(t *testing.T) {
 					sets.NewString("metric_name_one", "metric_name_two", "max_over_time", "min_over_time", "minute", "month", "max", "min"),
 				},
 				"metric_name_one and on(dima,) g": {
-					sets.NewString(),
+					sets.NewString("group"),
 				},
 			},
 		},
@@ -239,10 +253,10 @@ func TestEndToEndAutoCompletion(t *testing.T) {
 			desc: "complete on binary expression - one_to_many vector match",
 			expectedMatchesQueryMap: map[string][]sets.String{
 				"metric_name_one / on(dima,dima) g": {
-					sets.NewString("group_right", "group_left"),
+					sets.NewString("group_right", "group_left", "group"),
 				},
 				"metric_name_one / on(dima,dima) group_left(d": {
-					sets.NewString("dima", "dimb", "day_of_month", "day_of_week", "days_in_month", "delta", "deriv"),
+					sets.NewString("dima", "dimb", "day_of_month", "day_of_week", "days_in_month", "deg", "delta", "deriv"),
 				},
 				"metric_name_one / on(dima,dima) group_left(m": {
 					sets.NewString("metric_name_one", "metric_name_two", "max_over_time", "min_over_time", "minute", "month", "max", "min"),
@@ -283,17 +297,70 @@ func TestEndToEndAutoCompletion(t *testing.T) {
 				"metric_name_one offset 5": {
 					sets.StringKeySet(timeUnits),
 				},
+				"metric_name_one offset ": {
+					sets.NewString("-"),
+				},
+				"metric_name_one offset -5": {
+					sets.StringKeySet(timeUnits),
+				},
+			},
+		},
+		{
+			desc: "complete on metric expression - with @ modifier",
+			expectedMatchesQueryMap: map[string][]sets.String{
+				"metric_name_one @ ": {
+					sets.StringKeySet(atPreprocessors),
+					sets.StringKeySet(unaryOperators),
+				},
+				"metric_name_one @ st": {
+					sets.NewString("start"),
+				},
+				"metric_name_one @ end() ": {
+					sets.NewString("offset"),
+					sets.StringKeySet(arithmeticOperators),
+					sets.StringKeySet(setOperators),
+					sets.StringKeySet(comparisionOperators),
+				},
+				"metric_name_one[5m] offset 1h ": {
+					sets.NewString("@"),
+				},
 			},
 		},
 		{
 			desc: "complete on metric expression - range vector selector",
 			expectedMatchesQueryMap: map[string][]sets.String{
-				"metric_name_one[": {},
+				"metric_name_one[": {
+					sets.NewString("30s", "1m", "5m", "15m", "1h"),
+				},
 				"metric_name_one[3": {
 					sets.StringKeySet(timeUnits),
 				},
 				"metric_name_one[3m]": {
-					sets.NewString("offset"),
+					sets.NewString("offset", "@"),
+				},
+			},
+		},
+		{
+			desc: "complete on metric expression - composed durations",
+			expectedMatchesQueryMap: map[string][]sets.String{
+				"metric_name_one[5m ": {
+					sets.StringKeySet(durationOperators),
+				},
+				"metric_name_one[5m+3": {
+					sets.StringKeySet(timeUnits),
+				},
+				"metric_name_one[(1h-5m)/2": {
+					sets.StringKeySet(timeUnits),
+				},
+				"metric_name_one[5m+30s]": {
+					sets.NewString("offset", "@"),
+				},
+				"metric_name_one offset (1h+3": {
+					sets.StringKeySet(timeUnits),
+				},
+				// we don't know how long the range is, so every resolution is fair game
+				"metric_name_one[5m+30s:": {
+					sets.NewString("30s:15s", "30s:30s", "30s:1m15s", "30s:2m30s", "30s:7m30s", "30s:15m"),
 				},
 			},
 		},
@@ -327,7 +394,7 @@ func TestEndToEndAutoCompletion(t *testing.T) {
 					sets.NewString("\"1\"", "\"3\""),
 				},
 				"sum(metric_name_one{dima='1'} ": {
-					sets.NewString("offset"),
+					sets.NewString("offset", "@"),
 					sets.StringKeySet(comparisionOperators),
 					sets.StringKeySet(setOperators),
 					sets.StringKeySet(arithmeticOperators),
@@ -354,6 +421,26 @@ func TestEndToEndAutoCompletion(t *testing.T) {
 					sets.StringKeySet(setOperators),
 					sets.StringKeySet(arithmeticOperators),
 				},
+				"sum(rate(metric_name_two[5m])) without (": {
+					sets.NewString("dima", "dim2"),
+				},
+				"sum(metric_name_one) + sum(metric_name_two) by (": {
+					sets.NewString("dima", "dim2"),
+				},
+				"sum(metric_name_one) by (dima) / sum(metric_name_two) by (": {
+					sets.NewString("dima", "dim2"),
+				},
+			},
+		},
+		{
+			desc: "complete on aggregation expression - labels don't leak in from outside the aggregation",
+			expectedMatchesQueryMap: map[string][]sets.String{
+				"metric_name_one + sum by (": {
+					sets.NewString(),
+				},
+				"sum(metric_name_one) + sum without (": {
+					sets.NewString(),
+				},
 			},
 		},
 		{
@@ -388,7 +475,7 @@ func TestEndToEndAutoCompletion(t *testing.T) {
 					sets.NewString("\"1\"", "\"3\""),
 				},
 				"floor(metric_name_one{dima='1'}": {
-					sets.NewString("offset"),
+					sets.NewString("offset", "@"),
 					sets.StringKeySet(comparisionOperators),
 					sets.StringKeySet(arithmeticOperators),
 					sets.StringKeySet(setOperators),
@@ -403,19 +490,19 @@ func TestEndToEndAutoCompletion(t *testing.T) {
 		{
 			desc: "complete on function expression - have aggregation expression as arg",
 			expectedMatchesQueryMap: map[string][]sets.String{
-				"vector(su": {
+				"abs(su": {
 					sets.NewString("sum", "sum_over_time"),
 				},
-				"vector(sum(me": {
+				"abs(sum(me": {
 					sets.NewString("metric_name_one", "metric_name_two"),
 				},
-				"vector(sum(metric_name_one)": {
+				"abs(sum(metric_name_one)": {
 					sets.StringKeySet(comparisionOperators),
 					sets.StringKeySet(arithmeticOperators),
 					sets.StringKeySet(setOperators),
 					sets.StringKeySet(aggregateKeywords),
 				},
-				"vector(sum(metric_name_one))": {
+				"abs(sum(metric_name_one))": {
 					sets.StringKeySet(comparisionOperators),
 					sets.StringKeySet(arithmeticOperators),
 					sets.StringKeySet(setOperators),
@@ -425,18 +512,13 @@ func TestEndToEndAutoCompletion(t *testing.T) {
 		{
 			desc: "complete on function expression - have multiple args",
 			expectedMatchesQueryMap: map[string][]sets.String{
+				// the second arg of round is a scalar
 				"round(metric_name_one, ": {
-					sets.NewString("metric_name_one", "metric_name_two"),
-					sets.StringKeySet(aggregators),
 					sets.StringKeySet(scalarFunctions),
-					sets.StringKeySet(vectorFunctions),
 					sets.StringKeySet(unaryOperators),
 				},
 				"round(metric_name_one, -": {
-					sets.NewString("metric_name_one", "metric_name_two"),
-					sets.StringKeySet(aggregators),
 					sets.StringKeySet(scalarFunctions),
-					sets.StringKeySet(vectorFunctions),
 				},
 				"round(metric_name_one, -5 ": {
 					sets.StringKeySet(arithmeticOperators),
@@ -444,6 +526,127 @@ func TestEndToEndAutoCompletion(t *testing.T) {
 				},
 			},
 		},
+		{
+			desc: "complete on function expression - args follow the function signature",
+			expectedMatchesQueryMap: map[string][]sets.String{
+				"histogram_quantile(": {
+					sets.NewString("0.5", "0.9", "0.95", "0.99"),
+					sets.StringKeySet(scalarFunctions),
+					sets.StringKeySet(unaryOperators),
+				},
+				"histogram_quantile(0.9, ": {
+					sets.NewString("metric_name_one", "metric_name_two"),
+					sets.StringKeySet(aggregators),
+					sets.StringKeySet(scalarFunctions),
+					sets.StringKeySet(vectorFunctions),
+					sets.StringKeySet(unaryOperators),
+				},
+				// a metric isn't a valid first arg, so there's nothing to suggest after it
+				"histogram_quantile(metric_name_one, ": {},
+				"time(":                                {},
+				"pi(":                                  {},
+				"clamp(metric_name_one, 0, ": {
+					sets.StringKeySet(scalarFunctions),
+					sets.StringKeySet(unaryOperators),
+				},
+				"last_over_time(metric_name_one[5m]": {
+					sets.NewString("offset", "@"),
+				},
+			},
+		},
+		{
+			desc: "complete on aggregation expression - aggregators with a parameter",
+			expectedMatchesQueryMap: map[string][]sets.String{
+				"topk(": {
+					sets.NewString("5", "10"),
+					sets.StringKeySet(scalarFunctions),
+					sets.StringKeySet(unaryOperators),
+				},
+				"bottomk by (dima) (1": {
+					sets.NewString("10"),
+				},
+				"quantile(0.9": {
+					sets.NewString("0.9", "0.95"),
+				},
+				"count_values(": {
+					sets.NewString(`"value"`),
+				},
+				// the parameter is only ever the first argument
+				"topk(5, metric_name_one > 1": {},
+				"topk(5, metric_name_o": {
+					sets.NewString("metric_name_one"),
+				},
+				"quantile by (dima) (0.9, metric_name_one{": {
+					sets.NewString("dima", "dimb"),
+				},
+				"count_values('value', metric_name_one) by (d": {
+					sets.NewString("dima", "dimb"),
+				},
+				"group(metric_name_one) by (d": {
+					sets.NewString("dima", "dimb"),
+				},
+				// a metric isn't a valid parameter
+				"bottomk(metric_name_one, ": {},
+			},
+		},
+		{
+			desc: "complete on metric expression - selector without a metric name",
+			expectedMatchesQueryMap: map[string][]sets.String{
+				"{": {
+					sets.NewString("__name__"),
+				},
+				"metric_name_one + {__": {
+					sets.NewString("__name__"),
+				},
+				"{__name__=~": {
+					sets.NewString("\"metric_name_one\"", "\"metric_name_two\""),
+				},
+				"{__name__=\"metric_name_t": {
+					sets.NewString("\"metric_name_two\""),
+				},
+				// once we know the metric, we know its labels
+				"{__name__=\"metric_name_two\", d": {
+					sets.NewString("dima", "dim2"),
+				},
+				"rate({__name__=\"metric_name_one\"}[": {
+					sets.NewString("30s", "1m", "5m", "15m", "1h"),
+				},
+			},
+		},
+		{
+			desc: "complete on multi-line expression",
+			expectedMatchesQueryMap: map[string][]sets.String{
+				"sum(\nmetric_name_o": {
+					sets.NewString("metric_name_one"),
+				},
+				"sum(\n\tmetric_name_one{\r\n\td": {
+					sets.NewString("dima", "dimb"),
+				},
+				"sum(metric_name_one)\nby (d": {
+					sets.NewString("dima", "dimb"),
+				},
+			},
+		},
+		{
+			desc: "complete on compound expression - each selector has its own labels",
+			expectedMatchesQueryMap: map[string][]sets.String{
+				"( metric_name_one{dima='1'} + metric_name_two{": {
+					sets.NewString("dima", "dim2"),
+				},
+				"(metric_name_one{dima='1'}) + metric_name_two{": {
+					sets.NewString("dima", "dim2"),
+				},
+				"(metric_name_two) / (metric_name_one{d": {
+					sets.NewString("dima", "dimb"),
+				},
+				"metric_name_one{dimb='1'} + metric_name_two{dima=": {
+					sets.NewString("\"a\"", "\"ba\""),
+				},
+				"sum(metric_name_two{dima='a'}) by (dima) / metric_name_one{": {
+					sets.NewString("dima", "dimb"),
+				},
+			},
+		},
 		{
 			desc: "complete on function expression - nested function call",
 			expectedMatchesQueryMap: map[string][]sets.String{
@@ -455,16 +658,27 @@ func TestEndToEndAutoCompletion(t *testing.T) {
 		{
 			desc: "complete on subquery expression - expr is vectorSelector",
 			expectedMatchesQueryMap: map[string][]sets.String{
-				"metric_name_one{dima='1'}[": {},
+				"metric_name_one{dima='1'}[": {
+					sets.NewString("30s", "1m", "5m", "15m", "1h"),
+				},
 				"metric_name_one{dima='1'}[10": {
 					sets.StringKeySet(timeUnits),
 				},
-				"metric_name_one{dima='1'}[10m:": {},
+				"metric_name_one{dima='1'}[10m:": {
+					sets.NewString("10m:15s", "10m:30s", "10m:1m15s", "10m:2m30s", "10m:7m30s"),
+				},
+				"metric_name_one{dima='1'}[10m: ": {
+					sets.NewString("15s", "30s", "1m15s", "2m30s", "7m30s"),
+				},
+				"metric_name_one{dima='1'}[10m:1": {
+					sets.NewString("10m:15s", "10m:1m15s"),
+					sets.StringKeySet(timeUnits),
+				},
 				"metric_name_one{dima='1'}[10m:6": {
 					sets.StringKeySet(timeUnits),
 				},
 				"metric_name_one{dima='1'}[10m:6s]": {
-					sets.NewString("offset"),
+					sets.NewString("offset", "@"),
 				},
 			},
 		},
@@ -476,14 +690,21 @@ func TestEndToEndAutoCompletion(t *testing.T) {
 					sets.StringKeySet(comparisionOperators),
 					sets.StringKeySet(setOperators),
 				},
-				"rate(metric_name_one{dima='1'}[5m])[": {},
+				"rate(metric_name_one{dima='1'}[5m])[": {
+					sets.NewString("30s", "1m", "5m", "15m", "1h"),
+				},
 				"rate(metric_name_one{dima='1'}[5m])[10": {
 					sets.StringKeySet(timeUnits),
 				},
-				"rate(metric_name_one{dima='1'}[5m])[10m:": {},
-				"rate(metric_name_one{dima='1'}[5m])[10m:6s]": {
+				"rate(metric_name_one{dima='1'}[5m])[1m:": {
+					sets.NewString("1m:15s", "1m:30s"),
+				},
+				"rate(metric_name_one{dima='1'}[5m])[10m:6s] @ end() ": {
 					sets.NewString("offset"),
 				},
+				"rate(metric_name_one{dima='1'}[5m])[10m:6s]": {
+					sets.NewString("offset", "@"),
+				},
 			},
 		},
 		{
@@ -502,7 +723,7 @@ func TestEndToEndAutoCompletion(t *testing.T) {
 					sets.StringKeySet(arithmeticOperators),
 					sets.StringKeySet(comparisionOperators),
 					sets.StringKeySet(setOperators),
-					sets.NewString("offset"),
+					sets.NewString("offset", "@"),
 				},
 				"((metric_name_one{dima='1'} + metric_name_two{dima='a'})": {
 					sets.StringKeySet(arithmeticOperators),
@@ -540,7 +761,7 @@ func TestEndToEndAutoCompletion(t *testing.T) {
 					sets.NewString("metric_name_one", "metric_name_two", "max_over_time", "min_over_time", "minute", "month", "max", "min"),
 				},
 				"-s": {
-					sets.NewString("sum", "scalar", "sort", "sort_desc", "sqrt", "stddev", "stddev_over_time", "stdvar", "stdvar_over_time", "sum_over_time"),
+					sets.NewString("sum", "scalar", "sgn", "sin", "sinh", "sort", "sort_desc", "sqrt", "stddev", "stddev_over_time", "stdvar", "stdvar_over_time", "sum_over_time"),
 				},
 			},
 		},
@@ -562,6 +783,626 @@ func TestEndToEndAutoCompletion(t *testing.T) {
 	}
 }
 
+func TestEndToEndAutoCompletionWithMetricTypes(t *testing.T) {
+	index := NewTestIndex()
+	index.LoadMetrics(`
+# HELP han_requests_total [STABLE] counter help
+# TYPE han_requests_total counter
+han_requests_total{code="200"} 2
+# HELP han_temperature [STABLE] gauge help
+# TYPE han_temperature gauge
+han_temperature 21
+# HELP han_latency_seconds [STABLE] histogram help
+# TYPE han_latency_seconds histogram
+han_latency_seconds_bucket{le="+Inf"} 1
+han_latency_seconds_sum 0.5
+han_latency_seconds_count 1
+han_untyped 3
+`, time.Now())
+	testCases := []struct {
+		desc                    string
+		expectedMatchesQueryMap map[string][]sets.String
+	}{
+		{
+			desc: "complete on metric name - histogram buckets come with a histogram_quantile expression",
+			expectedMatchesQueryMap: map[string][]sets.String{
+				"han": {
+					sets.NewString("han_requests_total", "han_temperature", "han_latency_seconds_bucket", "han_latency_seconds_sum", "han_latency_seconds_count", "han_untyped"),
+					sets.NewString("histogram_quantile(0.95, rate(han_latency_seconds_bucket[5m]))"),
+				},
+				"abs(han": {
+					sets.NewString("han_requests_total", "han_temperature", "han_latency_seconds_bucket", "han_latency_seconds_sum", "han_latency_seconds_count", "han_untyped"),
+				},
+				// an aggregation is no function call
+				"sum(han": {
+					sets.NewString("han_requests_total", "han_temperature", "han_latency_seconds_bucket", "han_latency_seconds_sum", "han_latency_seconds_count", "han_untyped"),
+					sets.NewString("histogram_quantile(0.95, rate(han_latency_seconds_bucket[5m]))"),
+				},
+				// but one with a parameter is called much like one
+				"topk(5, han": {
+					sets.NewString("han_requests_total", "han_temperature", "han_latency_seconds_bucket", "han_latency_seconds_sum", "han_latency_seconds_count", "han_untyped"),
+				},
+			},
+		},
+		{
+			desc: "complete on function expression - counter functions don't suggest gauges",
+			expectedMatchesQueryMap: map[string][]sets.String{
+				"rate(han": {
+					sets.NewString("han_requests_total", "han_latency_seconds_bucket", "han_latency_seconds_sum", "han_latency_seconds_count", "han_untyped"),
+				},
+				"increase(han": {
+					sets.NewString("han_requests_total", "han_latency_seconds_bucket", "han_latency_seconds_sum", "han_latency_seconds_count", "han_untyped"),
+				},
+				// closing the nested call takes us back to the arguments of rate
+				"rate((abs(han_requests_total) + han": {
+					sets.NewString("han_requests_total", "han_latency_seconds_bucket", "han_latency_seconds_sum", "han_latency_seconds_count", "han_untyped"),
+				},
+				"rate(han_requests_total[5m]) / han": {
+					sets.NewString("han_requests_total", "han_temperature", "han_latency_seconds_bucket", "han_latency_seconds_sum", "han_latency_seconds_count", "han_untyped"),
+					sets.NewString("histogram_quantile(0.95, rate(han_latency_seconds_bucket[5m]))"),
+				},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			c := NewPromQLCompleter(index)
+			for query, expectedMatches := range tc.expectedMatchesQueryMap {
+				matches := c.GenerateSuggestions(query, len(query))
+				matchVals := toSet(matches)
+				expectedVals := union(expectedMatches...)
+				if !reflect.DeepEqual(matchVals, expectedVals) {
+					t.Errorf("Query %v: got %v matches [%v]\n expected %v\n", query, len(matchVals), matchVals, expectedVals)
+				}
+			}
+
+		})
+	}
+}
+
+func TestEndToEndAutoCompletionWithNativeHistograms(t *testing.T) {
+	index := NewTestIndex()
+	index.LoadMetrics(`
+# TYPE han_native_seconds histogram
+han_native_seconds 1
+# TYPE han_classic_seconds histogram
+han_classic_seconds_bucket{le="+Inf"} 1
+han_classic_seconds_sum 0.5
+han_classic_seconds_count 1
+# TYPE han_temperature gauge
+han_temperature 21
+`, time.Now())
+	testCases := map[string][]sets.String{
+		"han_n": {
+			sets.NewString("han_native_seconds"),
+			sets.NewString("histogram_quantile(0.95, rate(han_native_seconds[5m]))", "histogram_count(rate(han_native_seconds[5m]))"),
+		},
+		// native histograms only have the one series to rate
+		"rate(han": {
+			sets.NewString("han_native_seconds", "han_classic_seconds_bucket", "han_classic_seconds_sum", "han_classic_seconds_count"),
+		},
+		"histogram_count(han": {
+			sets.NewString("han_native_seconds"),
+		},
+		"histogram_fraction(0, 0.2, han": {
+			sets.NewString("han_native_seconds"),
+		},
+		"histogram_s": {
+			sets.NewString("histogram_stddev", "histogram_stdvar", "histogram_sum"),
+		},
+	}
+	c := NewPromQLCompleter(index)
+	for query, expectedMatches := range testCases {
+		matchVals := toSet(c.GenerateSuggestions(query, len(query)))
+		if expectedVals := union(expectedMatches...); !reflect.DeepEqual(matchVals, expectedVals) {
+			t.Errorf("Query %v: got %v matches [%v]\n expected %v\n", query, len(matchVals), matchVals, expectedVals)
+		}
+	}
+}
+
+func TestMetricIdMatchDetail(t *testing.T) {
+	index := NewTestIndex()
+	index.LoadMetrics(`
+# HELP han_requests_total [STABLE] counter help
+# TYPE han_requests_total counter
+han_requests_total{code="200"} 2
+han_untyped{dima="1",dimb="2"} 3
+`, time.Now())
+	want := map[string]string{
+		"han_requests_total": "[STABLE] counter help",
+		"han_untyped":        "dima,dimb",
+	}
+	c := NewPromQLCompleter(index)
+	matches := c.GenerateSuggestions("han", 3)
+	if len(matches) != len(want) {
+		t.Errorf("got %v matches, expected %v", len(matches), len(want))
+	}
+	for _, m := range matches {
+		if m.GetDetail() != want[m.GetValue()] {
+			t.Errorf("%v: got detail %q, expected %q", m.GetValue(), m.GetDetail(), want[m.GetValue()])
+		}
+	}
+}
+
+func TestSuggestionsFollowIndexUpdates(t *testing.T) {
+	index := NewTestIndex()
+	index.LoadMetrics(`
+metric_name_one{dima="1"} 1
+`, time.Now())
+	c := NewPromQLCompleter(index)
+	query := "sum(metric_"
+	if got, want := toSet(c.GenerateSuggestions(query, len(query))), sets.NewString("metric_name_one"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Query %v: got %v, expected %v", query, got, want)
+	}
+	// the same request again is served from cache
+	if got, want := toSet(c.GenerateSuggestions(query, len(query))), sets.NewString("metric_name_one"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Query %v: got %v, expected %v", query, got, want)
+	}
+
+	// a new scrape brings in a new metric, which we should see straight away
+	index.LoadMetrics(`
+metric_name_two{dimb="1"} 1
+`, time.Now())
+	if got, want := toSet(c.GenerateSuggestions(query, len(query))), sets.NewString("metric_name_one", "metric_name_two"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Query %v: got %v, expected %v", query, got, want)
+	}
+}
+
+func TestSubqueryResolutionFollowsScrapeInterval(t *testing.T) {
+	index := NewTestIndex()
+	index.LoadMetrics(`
+metric_name_one{dima="1"} 1
+`, time.Now())
+	c := NewPromQLCompleterWithOptions(index, CompleterOptions{ScrapeInterval: time.Minute})
+	query := "metric_name_one[1h:"
+	matches := c.GenerateSuggestions(query, len(query))
+	if got, want := toSet(matches), sets.NewString("1h:1m", "1h:2m", "1h:5m", "1h:10m", "1h:30m"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Query %v: got %v, expected %v", query, got, want)
+	}
+	for _, m := range matches {
+		if m.GetValue() == "1h:5m" && m.GetDetail() != "5 times the scrape interval" {
+			t.Errorf("%v: got detail %q", m.GetValue(), m.GetDetail())
+		}
+	}
+}
+
+func TestEndToEndAutoCompletionWithQuotedNames(t *testing.T) {
+	index := NewTestIndex()
+	// the text format can't express these, so skip parsing it
+	index.UpdateMetric(prom.ParsedSeries{Labels: labels.FromStrings("__name__", "my.metric", "label.name", "v", "job", "api")})
+	index.UpdateMetric(prom.ParsedSeries{Labels: labels.FromStrings("__name__", "my_metric", "job", "api")})
+	testCases := map[string][]sets.String{
+		"my": {
+			sets.NewString(`{"my.metric"}`, "my_metric"),
+		},
+		"{": {
+			sets.NewString("__name__", `"my.metric"`),
+		},
+		`{"my.`: {
+			sets.NewString(`"my.metric"`),
+		},
+		`{"my.metric", `: {
+			sets.NewString(`"label.name"`, "job"),
+		},
+		`{"my.metric", "label.name"=`: {
+			sets.NewString(`"v"`),
+		},
+		`sum by ("label.name", j`: {},
+		`sum({"my.metric"}) by (`: {
+			sets.NewString(`"label.name"`, "job"),
+		},
+	}
+	c := NewPromQLCompleter(index)
+	for query, expectedMatches := range testCases {
+		matches := c.GenerateSuggestions(query, len(query))
+		if got, want := toSet(matches), union(expectedMatches...); !reflect.DeepEqual(got, want) {
+			t.Errorf("Query %v: got %v, expected %v", query, got, want)
+		}
+	}
+}
+
+func TestCompletesMetricNamesWithLabelValues(t *testing.T) {
+	index := NewTestIndex()
+	index.UpdateMetric(prom.ParsedSeries{Labels: labels.FromStrings("__name__", "apiserver_requests_total", "namespace", "kube-system")})
+	index.UpdateMetric(prom.ParsedSeries{Labels: labels.FromStrings("__name__", "app_requests_total", "namespace", "default")})
+	index.UpdateMetric(prom.ParsedSeries{Labels: labels.FromStrings("__name__", "coredns_requests_total", "namespace", "kube-system")})
+	testCases := map[string]sets.String{
+		`{__name__="`: sets.NewString(`"apiserver_requests_total"`, `"app_requests_total"`, `"coredns_requests_total"`),
+		// only the metrics which have series in kube-system
+		`{namespace="kube-system", __name__="`:  sets.NewString(`"apiserver_requests_total"`, `"coredns_requests_total"`),
+		`{namespace="kube-system", __name__="a`: sets.NewString(`"apiserver_requests_total"`),
+		// only equality narrows the names down
+		`{namespace!="kube-system", __name__="`: sets.NewString(`"apiserver_requests_total"`, `"app_requests_total"`, `"coredns_requests_total"`),
+	}
+	c := NewPromQLCompleter(index)
+	for query, want := range testCases {
+		matches := c.GenerateSuggestions(query, len(query))
+		if got := toSet(matches); !reflect.DeepEqual(got, want) {
+			t.Errorf("Query %v: got %v, expected %v", query, got, want)
+		}
+	}
+}
+
+func TestMaxResults(t *testing.T) {
+	index := NewTestIndex()
+	index.LoadMetrics(initialMetricsString, time.Now())
+	c := NewPromQLCompleterWithOptions(index, CompleterOptions{MaxResults: 3})
+	query := "s"
+	matches := c.GenerateSuggestions(query, len(query))
+	if len(matches) != 4 {
+		t.Fatalf("Query %v: got %v matches, expected 3 and an overflow", query, len(matches))
+	}
+	// the cut is made after ranking, so it doesn't change from one call to the next
+	if got, want := toSet(matches[:3]), sets.NewString("sum", "sum_over_time", "stdvar_over_time"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Query %v: got %v, expected %v", query, got, want)
+	}
+	if got := matches[3]; got.GetKind() != "overflow" || got.GetValue() != "" || got.GetDetail() != "… 10 more, keep typing" {
+		t.Errorf("Query %v: got overflow match %+v", query, got)
+	}
+	// few enough matches to show them all
+	query = "metric_name_o"
+	if matches := c.GenerateSuggestions(query, len(query)); len(matches) != 1 {
+		t.Errorf("Query %v: got %v matches, expected 1", query, len(matches))
+	}
+}
+
+func TestHistorySuggestions(t *testing.T) {
+	index := NewTestIndex()
+	index.LoadMetrics(initialMetricsString, time.Now())
+	history, err := autocomplete.NewHistory("", autocomplete.DefaultHistorySize)
+	if err != nil {
+		t.Fatalf("unable to create history: %v", err)
+	}
+	c := NewPromQLCompleterWithOptions(index, CompleterOptions{Sources: []autocomplete.SuggestionSource{history}})
+	c.RecordQuery("sum by (dima) (rate(metric_name_one[5m]))")
+	if got := history.Queries(); len(got) != 1 {
+		t.Fatalf("got history %v, expected the recorded query", got)
+	}
+	testCases := []struct {
+		query string
+		want  map[string]string
+	}{
+		{
+			// the whole query, and the expressions in it, can start the query
+			query: "",
+			want: map[string]string{
+				"sum by (dima) (rate(metric_name_one[5m]))": "history",
+				"rate(metric_name_one[5m])":                 "history-expression",
+			},
+		},
+		{
+			query: "su",
+			want:  map[string]string{"sum by (dima) (rate(metric_name_one[5m]))": "history"},
+		},
+		{
+			query: "metric_name_two / ra",
+			want:  map[string]string{"rate(metric_name_one[5m])": "history-expression"},
+		},
+		{
+			// rate wants a range vector, not one of our expressions
+			query: "rate(ra",
+		},
+	}
+	for _, tc := range testCases {
+		got := map[string]string{}
+		for _, m := range c.GenerateSuggestions(tc.query, len(tc.query)) {
+			if strings.HasPrefix(m.GetKind(), "history") {
+				got[m.GetValue()] = m.GetKind()
+			}
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("Query %q: got %v, expected %v", tc.query, got, tc.want)
+			continue
+		}
+		for v, kind := range tc.want {
+			if got[v] != kind {
+				t.Errorf("Query %q: got %v, expected %v", tc.query, got, tc.want)
+			}
+		}
+	}
+}
+
+func TestProviders(t *testing.T) {
+	index := NewTestIndex()
+	index.LoadMetrics(initialMetricsString, time.Now())
+	namespaces := []string{"default", "kube-system"}
+	registry := autocomplete.NewRegistry()
+	err := registry.Register("namespaces", autocomplete.ProviderFunc(func(_ context.Context, tokenType string, completion autocomplete.CompletionContext) []autocomplete.Match {
+		if tokenType != string(STRING) || completion == nil || !completion.HasMetricLabel() || completion.GetMetricLabel() != "namespace" {
+			return nil
+		}
+		var matches []autocomplete.Match
+		for _, ns := range namespaces {
+			matches = append(matches, autocomplete.NewMatch(strconv.Quote(ns), "namespace", "a namespace in the cluster"))
+		}
+		return matches
+	}))
+	if err != nil {
+		t.Fatalf("unable to register provider: %v", err)
+	}
+	c := NewPromQLCompleterWithOptions(index, CompleterOptions{Providers: registry})
+
+	query := `metric_name_one{namespace="k`
+	if got, want := toSet(c.GenerateSuggestions(query, len(query))), sets.NewString(`"kube-system"`); !reflect.DeepEqual(got, want) {
+		t.Errorf("Query %v: got %v, expected %v", query, got, want)
+	}
+	// other labels are left to the index
+	query = `metric_name_one{dima="`
+	if got, want := toSet(c.GenerateSuggestions(query, len(query))), sets.NewString(`"1"`, `"3"`); !reflect.DeepEqual(got, want) {
+		t.Errorf("Query %v: got %v, expected %v", query, got, want)
+	}
+
+	// the suggestions were cached, so the completer has to be told they've changed
+	namespaces = append(namespaces, "kube-public")
+	registry.Invalidate()
+	query = `metric_name_one{namespace="k`
+	if got, want := toSet(c.GenerateSuggestions(query, len(query))), sets.NewString(`"kube-system"`, `"kube-public"`); !reflect.DeepEqual(got, want) {
+		t.Errorf("Query %v: got %v, expected %v", query, got, want)
+	}
+}
+
+func TestProvidersShareADeadline(t *testing.T) {
+	index := NewTestIndex()
+	index.LoadMetrics(initialMetricsString, time.Now())
+	registry := autocomplete.NewRegistry()
+	deadlines := map[time.Time]bool{}
+	asked := 0
+	err := registry.Register("deadlines", autocomplete.ProviderFunc(func(ctx context.Context, _ string, _ autocomplete.CompletionContext) []autocomplete.Match {
+		deadline, _ := ctx.Deadline()
+		deadlines[deadline] = true
+		asked++
+		return nil
+	}))
+	if err != nil {
+		t.Fatalf("unable to register provider: %v", err)
+	}
+	c := NewPromQLCompleterWithOptions(index, CompleterOptions{Providers: registry})
+	// a metric, a function, an aggregation, ... could all go here
+	c.GenerateSuggestions("", 0)
+	if asked < 2 || len(deadlines) != 1 {
+		t.Errorf("got %d deadlines over %d token types, want the one between them", len(deadlines), asked)
+	}
+}
+
+func TestUnstableMetrics(t *testing.T) {
+	index := NewTestIndex()
+	index.LoadMetrics(`
+# HELP han_alpha_total [ALPHA] counter help
+# TYPE han_alpha_total counter
+han_alpha_total 1
+# HELP han_old_total [STABLE] (Deprecated since 1.19.0) counter help
+# TYPE han_old_total counter
+han_old_total 1
+# HELP han_stable_total [STABLE] counter help
+# TYPE han_stable_total counter
+han_stable_total 1
+han_untyped 1
+`, time.Now())
+	query := "han"
+	testCases := []struct {
+		policy UnstableMetricsPolicy
+		want   []string
+	}{
+		{ShowUnstableMetrics, []string{"han_alpha_total", "han_untyped", "han_stable_total", "han_old_total"}},
+		// unstable metrics keep their order amongst themselves
+		{DemoteUnstableMetrics, []string{"han_untyped", "han_stable_total", "han_alpha_total", "han_old_total"}},
+		{HideUnstableMetrics, []string{"han_untyped", "han_stable_total"}},
+	}
+	for _, tc := range testCases {
+		c := NewPromQLCompleterWithOptions(index, CompleterOptions{UnstableMetrics: tc.policy})
+		// a recently used metric would normally come first
+		c.RecordQuery("han_alpha_total")
+		var got []string
+		for _, m := range c.GenerateSuggestions(query, len(query)) {
+			got = append(got, m.GetValue())
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("policy %v: got %v, expected %v", tc.policy, got, tc.want)
+		}
+	}
+}
+
+func TestLabelValuesFollowOtherMatchers(t *testing.T) {
+	index := NewTestIndex()
+	index.LoadMetrics(`
+han_metric_total{dima="1", dimb="a"} 1
+han_metric_total{dima="1", dimb="b"} 1
+han_metric_total{dima="2", dimb="c"} 1
+`, time.Now())
+	c := NewPromQLCompleter(index)
+	testCases := map[string][]string{
+		`han_metric_total{dimb="`:                      {`"c"`, `"b"`, `"a"`},
+		`han_metric_total{dima="1", dimb="`:            {`"b"`, `"a"`},
+		`han_metric_total{dima!="1", dimb="`:           {`"c"`},
+		`han_metric_total{dima=~"1|2", dimb="`:         {`"c"`, `"b"`, `"a"`},
+		`han_metric_total{dima="1", dimb!="a", dimb="`: {`"b"`, `"a"`},
+		// the matchers of the first selector don't apply to the second
+		`han_metric_total{dima="1"} / han_metric_total{dimb="`: {`"c"`, `"b"`, `"a"`},
+	}
+	for query, want := range testCases {
+		var got []string
+		for _, m := range c.GenerateSuggestions(query, len(query)) {
+			got = append(got, m.GetValue())
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, expected %v", query, got, want)
+		}
+	}
+}
+
+func TestMidWordCompletion(t *testing.T) {
+	index := NewTestIndex()
+	index.LoadMetrics(initialMetricsString, time.Now())
+	c := NewPromQLCompleter(index)
+	testCases := []struct {
+		query string
+		pos   int
+		want  autocomplete.Range
+	}{
+		// the cursor at the end of the word
+		{"sum(metric_na", 13, autocomplete.Range{Offset: 4, Length: 9}},
+		// 'sum(metric_|na)', the whole word is replaced
+		{"sum(metric_na)", 11, autocomplete.Range{Offset: 4, Length: 9}},
+		{"metric_name_one + metric_name_two", 22, autocomplete.Range{Offset: 18, Length: 15}},
+	}
+	for _, tc := range testCases {
+		matches := c.GenerateSuggestions(tc.query, tc.pos)
+		if !toSet(matches).Has("metric_name_one") {
+			t.Errorf("%q at %d: expected metric_name_one in %v", tc.query, tc.pos, toSet(matches))
+		}
+		for _, m := range matches {
+			if got := m.GetRange(); got != tc.want {
+				t.Errorf("%q at %d: %v replaces %+v, expected %+v", tc.query, tc.pos, m.GetValue(), got, tc.want)
+			}
+		}
+	}
+}
+
+func TestFormatCount(t *testing.T) {
+	for n, want := range map[int]string{0: "0", 999: "999", 4987: "4,987", 1234567: "1,234,567"} {
+		if got := formatCount(n); got != want {
+			t.Errorf("formatCount(%d) = %q, expected %q", n, got, want)
+		}
+	}
+}
+
+func TestRangesFollowScrapeIntervalAndWindow(t *testing.T) {
+	index := NewTestIndex()
+	index.LoadMetrics(`
+metric_name_one{dima="1"} 1
+`, time.Now())
+	c := NewPromQLCompleterWithOptions(index, CompleterOptions{ScrapeInterval: time.Minute, Window: 10 * time.Minute})
+	query := "rate(metric_name_one["
+	matches := c.GenerateSuggestions(query, len(query))
+	if got, want := toSet(matches), sets.NewString("2m", "5m"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Query %v: got %v, expected %v", query, got, want)
+	}
+	for _, m := range matches {
+		if m.GetValue() == "2m" && m.GetDetail() != "2 times the scrape interval" {
+			t.Errorf("%v: got detail %q", m.GetValue(), m.GetDetail())
+		}
+	}
+}
+
+func TestDiagnose(t *testing.T) {
+	testCases := []struct {
+		query string
+		want  []autocomplete.Diagnostic
+	}{
+		{
+			query: "sum(rate(metric_name_one{dima='1'}[5m]))",
+		},
+		{
+			query: "sum(rate(metric_name_one[5m))",
+			want: []autocomplete.Diagnostic{
+				{Offset: 27, Length: 1, Message: `unexpected ")"`, Expected: []string{":", "]", "duration operator"}},
+			},
+		},
+		{
+			query: "metric_name_one metric_name_two",
+			want: []autocomplete.Diagnostic{
+				{Offset: 16, Length: 15, Message: `unexpected "metric_name_two"`, Expected: []string{"@", "[", "arithmetic operator", "comparison operator", "end of query", "offset", "set operator", "{"}},
+			},
+		},
+		{
+			query: "abs(",
+			want: []autocomplete.Diagnostic{
+				{Offset: 4, Length: 0, Message: "unexpected end of query", Expected: []string{"(", "aggregation", "function", "metric name", "number", "unary operator", "{"}},
+			},
+		},
+	}
+	c := NewPromQLCompleter(NewTestIndex())
+	for _, tc := range testCases {
+		if got := c.Diagnose(tc.query); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Diagnose(%q) = %+v, expected %+v", tc.query, got, tc.want)
+		}
+	}
+
+	// the keywords of a vector match are expected by what they are
+	matchCases := []struct {
+		query    string
+		expected string
+		not      string
+	}{
+		{query: "metric_name_one + )", expected: "on or ignoring", not: "group_left or group_right"},
+		{query: "metric_name_one + on(dima) )", expected: "group_left or group_right", not: "on or ignoring"},
+	}
+	for _, tc := range matchCases {
+		got := c.Diagnose(tc.query)
+		if len(got) != 1 {
+			t.Fatalf("Diagnose(%q) = %+v, expected a diagnostic", tc.query, got)
+		}
+		expected := sets.NewString(got[0].Expected...)
+		if !expected.Has(tc.expected) || expected.Has(tc.not) {
+			t.Errorf("Diagnose(%q) expected %v, expected %q and not %q among them", tc.query, got[0].Expected, tc.expected, tc.not)
+		}
+	}
+}
+
+func TestEndToEndAutoCompletionWithFuzzyFilter(t *testing.T) {
+	index := NewTestIndex()
+	index.LoadMetrics(initialMetricsString, time.Now())
+	testCases := []struct {
+		desc                    string
+		expectedMatchesQueryMap map[string][]sets.String
+	}{
+		{
+			desc: "complete on metric name by subsequence",
+			expectedMatchesQueryMap: map[string][]sets.String{
+				"mnamet": {
+					sets.NewString("metric_name_two"),
+				},
+				"sum(mnameon": {
+					sets.NewString("metric_name_one"),
+				},
+			},
+		},
+		{
+			desc: "complete on label name by subsequence",
+			expectedMatchesQueryMap: map[string][]sets.String{
+				"metric_name_two{d2": {
+					sets.NewString("dim2"),
+				},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			c := NewPromQLCompleterWithFilter(index, autocomplete.FilterFuzzy)
+			for query, expectedMatches := range tc.expectedMatchesQueryMap {
+				matches := c.GenerateSuggestions(query, len(query))
+				matchVals := toSet(matches)
+				expectedVals := union(expectedMatches...)
+				if !reflect.DeepEqual(matchVals, expectedVals) {
+					t.Errorf("Query %v: got %v matches [%v]\n expected %v\n", query, len(matchVals), matchVals, expectedVals)
+				}
+			}
+
+		})
+	}
+}
+
+func TestEndToEndAutoCompletionIgnoringCaseAndSeparators(t *testing.T) {
+	index := NewTestIndex()
+	index.LoadMetrics(initialMetricsString, time.Now())
+	c := NewPromQLCompleterWithOptions(index, CompleterOptions{
+		Matching: autocomplete.MatchOptions{IgnoreCase: true, IgnoreSeparators: true},
+	})
+	for query, expected := range map[string]sets.String{
+		"Metric.Name.T":        sets.NewString("metric_name_two"),
+		"sum(METRIC_name_o":    sets.NewString("metric_name_one"),
+		"metric_name_two{DIM2": sets.NewString("dim2"),
+		// functions are still matched as they are
+		"RAT": sets.NewString(),
+	} {
+		if got := toSet(c.GenerateSuggestions(query, len(query))); !reflect.DeepEqual(got, expected) {
+			t.Errorf("Query %v: got %v, expected %v", query, got, expected)
+		}
+	}
+}
+
 func toSet(matches []autocomplete.Match) sets.String {
 	ret := sets.NewString()
 	for _, m := range matches {
@@ -17,9 +17,13 @@ limitations under the License.
 package earley
 
 import (
+	"strings"
+
 	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/prometheus/pkg/labels"
 
 	"sigs.k8s.io/instrumentation-tools/notstdlib/sets"
+	"sigs.k8s.io/instrumentation-tools/promq/autocomplete"
 )
 
 type ContextualToken struct {
@@ -27,18 +31,21 @@ type ContextualToken struct {
 	ctx *completionContext
 }
 
-type CompletionContext interface {
-	HasMetric() bool
-	GetMetric() string
-	HasMetricLabel() bool
-	GetMetricLabel() string
-	GetUsedMetricLabelValues() sets.String
-}
+// CompletionContext is defined alongside the providers which are handed it.
+type CompletionContext = autocomplete.CompletionContext
+
+var _ CompletionContext = &completionContext{}
 
 type completionContext struct {
-	metric            *string
-	metricLabel       *string
-	metricLabelValues sets.String
+	metric      *string
+	metricLabel *string
+	// the operator of the label matcher we're in, i.e. = or =~
+	metricLabelOperator *string
+	metricLabelValues   sets.String
+	// the label matchers we've seen so far in the selector we're in
+	metricLabelMatchers []*labels.Matcher
+	// the function call we're currently in the arguments of, if any
+	function *string
 }
 
 // Deep copy completionContext and return a pointer
@@ -53,6 +60,12 @@ func Copy(c *completionContext) *completionContext {
 	if c.metricLabel != nil {
 		cc.metricLabel = proto.String(*c.metricLabel)
 	}
+	if c.metricLabelOperator != nil {
+		cc.metricLabelOperator = proto.String(*c.metricLabelOperator)
+	}
+	if c.function != nil {
+		cc.function = proto.String(*c.function)
+	}
 	if c.metricLabelValues != nil {
 		ss := sets.String{}
 		for v := range c.metricLabelValues {
@@ -60,6 +73,10 @@ func Copy(c *completionContext) *completionContext {
 		}
 		cc.metricLabelValues = ss
 	}
+	if c.metricLabelMatchers != nil {
+		// matchers are never modified once made, so they can be shared
+		cc.metricLabelMatchers = append([]*labels.Matcher(nil), c.metricLabelMatchers...)
+	}
 	return &cc
 }
 
@@ -67,15 +84,76 @@ func Copy(c *completionContext) *completionContext {
 func (c *completionContext) BuildContext(tokenType *TokenType, token *Tokhan) {
 	switch *tokenType {
 	case METRIC_ID:
+		// a new selector, so whatever we saw of the previous one doesn't apply to it
 		c.metric = proto.String(token.Val)
+		c.metricLabel = nil
+		c.metricLabelValues = nil
+		c.metricLabelMatchers = nil
+	case SELECTOR_LEFT_BRACE:
+		// likewise, but we only find out which metric it is from a quoted name or a __name__ matcher
+		c.metric = nil
+		c.metricLabel = nil
+		c.metricLabelValues = nil
+		c.metricLabelMatchers = nil
+	case QUOTED_METRIC_ID:
+		c.metric = proto.String(unquote(token.Val))
 	case METRIC_LABEL_SUBTYPE:
 		c.metricLabel = proto.String(token.Val)
+	case QUOTED_LABEL_ID:
+		c.metricLabel = proto.String(unquote(token.Val))
+	case LABELMATCH:
+		c.metricLabelOperator = proto.String(token.Val)
 	case STRING:
 		c.AddObservedMetricLabelValue(token.Val)
+		c.addMetricLabelMatcher(unquote(token.Val))
+		// {__name__="foo"} is just another way of writing foo{}
+		if c.HasMetricLabel() && c.GetMetricLabel() == labels.MetricName &&
+			c.metricLabelOperator != nil && *c.metricLabelOperator == "=" {
+			c.metric = proto.String(unquote(token.Val))
+		}
+	case AGGR_OP:
+		// the labels of a by/without clause come from the aggregated expression,
+		// not from whatever came before the aggregation
+		c.metric = nil
+		c.metricLabel = nil
+		c.metricLabelValues = nil
+		c.metricLabelMatchers = nil
+		// one which takes a parameter, we're in the arguments of much like a function's,
+		// i.e. for the k of topk, but sum( is no function call, whatever's suggested
+		// anywhere else is suggested inside it too
+		if token.Type == AGGR_OP_SCALAR_PARAM || token.Type == AGGR_OP_STRING_PARAM {
+			c.function = proto.String(token.Val)
+		}
+	case FUNCTION_VECTOR_ID, FUNCTION_SCALAR_ID:
+		c.function = proto.String(token.Val)
 	default:
 	}
 }
 
+// completeContext gives the context to carry on parsing with once a sub-expression is
+// complete. We keep what we learned about the selectors in the sub-expression, i.e. so
+// that 'sum(metric) by (' suggests the labels of metric, but we're back to the function
+// call we were in before it, if any.
+func completeContext(parent, child *completionContext) *completionContext {
+	ctx := Copy(child)
+	if ctx == nil {
+		return Copy(parent)
+	}
+	ctx.function = nil
+	if parent != nil && parent.function != nil {
+		ctx.function = proto.String(*parent.function)
+	}
+	return ctx
+}
+
+// unquote strips the quotes from a string literal, any escapes are left as they are
+func unquote(s string) string {
+	if len(s) >= 2 && strings.ContainsRune(`"'`+"`", rune(s[0])) && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
 func (c *completionContext) HasMetric() bool {
 	return c.metric != nil
 }
@@ -85,6 +163,30 @@ func (c *completionContext) AddObservedMetricLabelValue(labelVal string) {
 	c.metricLabelValues = lv.Union(c.metricLabelValues)
 }
 
+// addMetricLabelMatcher records the matcher which the label value completes, i.e. dima="1"
+func (c *completionContext) addMetricLabelMatcher(labelVal string) {
+	if c.metricLabel == nil || c.metricLabelOperator == nil {
+		return
+	}
+	mt, ok := matchTypes[*c.metricLabelOperator]
+	if !ok {
+		return
+	}
+	// an invalid regex doesn't narrow anything down
+	m, err := labels.NewMatcher(mt, *c.metricLabel, labelVal)
+	if err != nil {
+		return
+	}
+	c.metricLabelMatchers = append(c.metricLabelMatchers, m)
+}
+
+var matchTypes = map[string]labels.MatchType{
+	"=":  labels.MatchEqual,
+	"!=": labels.MatchNotEqual,
+	"=~": labels.MatchRegexp,
+	"!~": labels.MatchNotRegexp,
+}
+
 func (c *completionContext) GetMetric() string {
 	return *c.metric
 }
@@ -103,3 +205,15 @@ func (c *completionContext) GetUsedMetricLabelValues() sets.String {
 	}
 	return c.metricLabelValues
 }
+
+func (c *completionContext) GetMetricLabelMatchers() []*labels.Matcher {
+	return c.metricLabelMatchers
+}
+
+func (c *completionContext) HasFunction() bool {
+	return c.function != nil
+}
+
+func (c *completionContext) GetFunction() string {
+	return *c.function
+}
@@ -0,0 +1,68 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package earley
+
+import (
+	"strings"
+
+	"sigs.k8s.io/instrumentation-tools/promq/autocomplete"
+)
+
+// Describe explains whatever is at pos in the query, i.e. what a function does or the
+// help text of a metric, for showing when someone hovers over it. It returns the span
+// it describes, or false if there's nothing to say about it.
+func Describe(query string, pos int, index autocomplete.QueryIndex) (string, Span, bool) {
+	for _, s := range Highlight(query) {
+		// the cursor can be at either end of a word
+		if pos < s.Start || pos > s.End {
+			continue
+		}
+		text := query[s.Start:s.End]
+		switch s.Class {
+		case SpanFunction, SpanKeyword, SpanOperator:
+			if desc, ok := describeKeyword(text); ok {
+				return desc, s, true
+			}
+		case SpanMetric:
+			name := unquote(text)
+			if index == nil || !index.GetMetricNames().Has(name) {
+				continue
+			}
+			desc := index.GetMetricHelp(name)
+			if desc == "" {
+				desc = "labels: " + strings.Join(index.GetStoredDimensionsForMetric(name).List(), ", ")
+			}
+			return name + ": " + desc, s, true
+		}
+	}
+	return "", Span{}, false
+}
+
+// describeKeyword looks up the description we suggest a keyword, function or operator with.
+func describeKeyword(text string) (string, bool) {
+	for _, t := range tokenTypes {
+		mapping := tokenTypeMatching[t]
+		if desc, ok := mapping[text]; ok {
+			return desc, true
+		}
+		// keywords are case insensitive, functions aren't
+		if desc, ok := mapping[strings.ToLower(text)]; ok && t != FUNCTION_VECTOR_ID && t != FUNCTION_SCALAR_ID {
+			return desc, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package earley
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDescribe(t *testing.T) {
+	index := NewTestIndex()
+	index.LoadMetrics(initialMetricsString+`
+metric_without_help{job="api"} 1
+`, time.Now())
+	query := "sum by (dima) (rate(metric_name_one[5m])) + metric_without_help + unknown_metric"
+	tests := []struct {
+		name     string
+		pos      int
+		want     string
+		wantText string
+		wantOk   bool
+	}{
+		{
+			name:     "aggregation",
+			pos:      1,
+			want:     aggregators["sum"],
+			wantText: "sum",
+			wantOk:   true,
+		},
+		{
+			name:     "keyword",
+			pos:      5,
+			want:     aggregateKeywords["by"],
+			wantText: "by",
+			wantOk:   true,
+		},
+		{
+			name:     "function, with the cursor at the end of it",
+			pos:      19,
+			want:     vectorFunctions["rate"],
+			wantText: "rate",
+			wantOk:   true,
+		},
+		{
+			name:     "metric with help text",
+			pos:      25,
+			want:     "metric_name_one: [STABLE] counter help",
+			wantText: "metric_name_one",
+			wantOk:   true,
+		},
+		{
+			name:     "metric without help text",
+			pos:      50,
+			want:     "metric_without_help: labels: job",
+			wantText: "metric_without_help",
+			wantOk:   true,
+		},
+		{
+			name:   "metric we don't know about",
+			pos:    75,
+			wantOk: false,
+		},
+		{
+			name:   "whitespace",
+			pos:    41,
+			wantOk: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, span, ok := Describe(query, tt.pos, index)
+			if ok != tt.wantOk {
+				t.Fatalf("Describe(%d) ok = %v, want %v", tt.pos, ok, tt.wantOk)
+			}
+			if got != tt.want {
+				t.Errorf("Describe(%d) = %q, want %q", tt.pos, got, tt.want)
+			}
+			if ok && query[span.Start:span.End] != tt.wantText {
+				t.Errorf("Describe(%d) described %q, want %q", tt.pos, query[span.Start:span.End], tt.wantText)
+			}
+		})
+	}
+}
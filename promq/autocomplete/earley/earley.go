@@ -63,18 +63,20 @@ func NewEarleyParser(g Grammar) *Earley {
 // For every state in S(k) of the form (X → α • Y β, j)
 // (where j is the origin position as above), add (Y → • γ, k) to S(k)
 // for every production in the grammar with Y on the left-hand side (Y → γ).
-func (p *Earley) predict(state *EarleyItem, chartIndex int, fromItems []ItemId) {
+func (p *Earley) predict(state *EarleyItem, chartIndex int) {
 	nextSymbol := state.GetRightSymbolByRulePos().(nonTerminal)
 	recognizedRules := p.g.recognizedRules(nextSymbol)
 	currStateSet := p.chart.GetState(chartIndex)
-	if len(recognizedRules) > 0 {
-		debug.Debugf("Predicting next state\n")
-	}
 	// Find all the rules for the Symbol put those rules to the current set
 	for _, r := range recognizedRules {
-		ctx := Copy(state.ctx)
-		nextItem := newPredictItem(r, chartIndex, fromItems, ctx)
-		if currStateSet.Add(nextItem) {
+		// most rules are predicted more than once, and where a prediction came from
+		// doesn't matter, so don't bother copying the context for the ones we have
+		if currStateSet.has(itemHash(r, 0, chartIndex)) {
+			continue
+		}
+		nextItem := newPredictItem(r, chartIndex, []ItemId{state.id}, Copy(state.ctx))
+		currStateSet.Add(nextItem)
+		if debug.Enabled() {
 			debug.Debugf("added %v\n", nextItem.String())
 		}
 	}
@@ -82,20 +84,21 @@ func (p *Earley) predict(state *EarleyItem, chartIndex int, fromItems []ItemId)
 
 // If a is the next symbol in the input stream, for every state in S(k) of the
 // form (X → α • a β, j), add (X → α a • β, j) to S(k+1).
-func (p *Earley) scan(state *EarleyItem, chartIndex int, fromItems []ItemId, token Tokhan) {
+func (p *Earley) scan(state *EarleyItem, chartIndex int, token Tokhan) {
 	// abort though if we can't scan further
 	if chartIndex+1 >= p.chart.Length() || !state.DoesTokenTypeMatch(token) {
 		return
 	}
-	debug.Debugf("Token (%v) matches, performing scan \n", token)
 	ctx := &completionContext{}
 	if state.ctx != nil {
 		ctx = Copy(state.ctx)
 	}
 	ctx.BuildContext(state.GetRightSymbolTypeByRulePos(), &token)
 
-	nextItem := newScanItem(state, state.originatingIndex, fromItems, ctx)
-	debug.Debugf("Scanning next item : %v\n", nextItem)
+	nextItem := newScanItem(state, state.originatingIndex, []ItemId{state.id}, ctx)
+	if debug.Enabled() {
+		debug.Debugf("Token (%v) matches, scanning next item : %v\n", token, nextItem.String())
+	}
 	// scanned item is added to next stateSet
 	nextSet := p.chart.GetState(chartIndex + 1)
 	nextSet.Add(nextItem)
@@ -110,9 +113,16 @@ func (p *Earley) complete(state *EarleyItem, chartIndex int) {
 
 	for _, item := range itemsToComplete {
 		fromItems := []ItemId{state.id, item.id}
-		ctx := Copy(state.ctx)
-		nextItem := newCompleteItem(&item, fromItems, ctx)
-		if currStateSet.Add(nextItem) {
+		// for an item we already have, we only need to know the other way to get to it,
+		// not to build its context all over again
+		if existing := currStateSet.get(itemHash(item.Rule, item.RulePos+1, item.originatingIndex)); existing != nil {
+			existing.addDerivedFrom(fromItems)
+			continue
+		}
+		ctx := completeContext(item.ctx, state.ctx)
+		nextItem := newCompleteItem(item, fromItems, ctx)
+		currStateSet.Add(nextItem)
+		if debug.Enabled() {
 			debug.Debugf("completed %v\n", nextItem.String())
 		}
 	}
@@ -123,10 +133,8 @@ func (p *Earley) resizeChartIfNecessary(words Tokens) {
 }
 
 func (p *Earley) resizeChart(size int) {
-	currentSize := p.chart.Length()
-	for currentSize < size {
-		p.chart.append(NewStateSet())
-		currentSize += 1
+	for p.chart.Length() < size {
+		p.chart.appendStateSet()
 	}
 }
 
@@ -141,8 +149,11 @@ func (p *Earley) Parse(input string) *earleyChart {
 // ParseTokens parses the full input tokens from beginning
 func (p *Earley) ParseTokens(tokens Tokens) *earleyChart {
 	p.chart.resetChartBeforeIndex(0)
+	p.words = p.words[:0]
 	p.PartialParse(tokens, 0)
-	debug.Debugf("------\n%v\n------\n", p.chart.String())
+	if debug.Enabled() {
+		debug.Debugf("------\n%v\n------\n", p.chart.String())
+	}
 	return p.chart
 }
 
@@ -158,18 +169,17 @@ func (p *Earley) PartialParse(tokens Tokens, chartIndex int) *earleyChart {
 	for _, token := range tokens {
 		setIndex := 0
 		for {
-			if setIndex >= len(currStateSet.GetStates()) {
+			if setIndex >= len(currStateSet.items) {
 				break
 			}
 			item := currStateSet.items[setIndex]
-			fromItems := []ItemId{item.id}
 			if !item.isCompleted() {
 				// predict if current state isn't terminal
 				if !item.GetRightSymbolByRulePos().isTerminal() {
-					p.predict(item, chartIndex, fromItems)
+					p.predict(item, chartIndex)
 				} else {
 					// Scan the next symbol which is terminal
-					p.scan(item, chartIndex, fromItems, token)
+					p.scan(item, chartIndex, token)
 				}
 			} else { // end of rule, let's complete
 				p.complete(item, chartIndex)
@@ -178,7 +188,9 @@ func (p *Earley) PartialParse(tokens Tokens, chartIndex int) *earleyChart {
 		}
 		chartIndex++
 		currStateSet = p.chart.GetState(chartIndex)
-		debug.Debugf("------\n%v\n------\n", p.chart.String())
+		if debug.Enabled() {
+			debug.Debugf("------\n%v\n------\n", p.chart.String())
+		}
 	}
 	return p.chart
 }
@@ -189,27 +201,23 @@ func (p *Earley) GetSuggestedTokenType(tokens Tokens) (types []ContextualToken)
 		lastTokenPos = 0
 	}
 
-	if p.words == nil || len(p.words) == 0 || len(tokens) == 0 || !p.words[0].equals(tokens[0]) {
+	// the chart is still valid up to the first token which changed since our last
+	// parse, so we only need to parse from there on.
+	unchanged := p.words.CommonPrefixLength(tokens)
+	switch {
+	case unchanged == 0:
 		p.ParseTokens(tokens)
-	} else {
-		result := p.words.Compare(tokens)
-
-		if result > 0 {
-			// prevWords and input words have partial overlap, truncate the current chart and partially
-			// parse the unparsed tokens
-			p.chart.resetChartBeforeIndex(result)
-			p.words = p.words[:result]
-			p.PartialParse(tokens[result:], result)
-		} else if result < 0 {
-			// input fully covers previous words, continue parsing from the unparsed word
-			result = 0 - result
-			p.PartialParse(tokens[result:], result)
-		} else {
-			// No further parsing needed if input tokens is exactly the previous input
-		}
+	case unchanged < len(p.words) || unchanged < len(tokens):
+		p.chart.resetChartBeforeIndex(unchanged)
+		p.words = p.words[:unchanged]
+		p.PartialParse(tokens[unchanged:], unchanged)
+	default:
+		// No further parsing needed if input tokens is exactly the previous input
 	}
 	suggestions := p.chart.GetValidTerminalTypesAtStateSet(lastTokenPos)
-	debug.Debugln(
-		"generating suggestions", tokens.Vals()[lastTokenPos], len(tokens), lastTokenPos, len(suggestions))
+	if debug.Enabled() {
+		debug.Debugln(
+			"generating suggestions", tokens.Vals()[lastTokenPos], len(tokens), lastTokenPos, len(suggestions))
+	}
 	return suggestions
 }
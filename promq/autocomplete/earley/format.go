@@ -0,0 +1,202 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package earley
+
+import (
+	"strings"
+)
+
+const (
+	// queries longer than this are split over multiple lines
+	formatLineWidth = 80
+	formatIndent    = "  "
+)
+
+// FormatQuery normalizes the whitespace in a query. Queries which don't fit on a
+// line are split up, with one label matcher per line and the outermost binary
+// operators lined up at the start of their lines, i.e.
+//
+//	sum by (job) (rate(http_requests_total{
+//	  job="api",
+//	  code="500"
+//	}[5m]))
+//	/ sum by (job) (rate(http_requests_total[5m]))
+//
+// Since we work off of the token stream, queries don't need to be valid to be
+// formatted, but comments are dropped.
+func FormatQuery(query string) string {
+	var tokens Tokens
+	for _, t := range newLuthor().lex(query) {
+		if !t.isEof() {
+			tokens = append(tokens, t)
+		}
+	}
+	if formatted := formatTokens(tokens, false); len(formatted) <= formatLineWidth {
+		return formatted
+	}
+	return formatTokens(tokens, true)
+}
+
+func formatTokens(tokens Tokens, multiline bool) string {
+	var sb strings.Builder
+	newline := func(indent int) {
+		sb.WriteString("\n")
+		sb.WriteString(strings.Repeat(formatIndent, indent))
+	}
+	// binary operators this deep in parens get lines of their own
+	breakDepth := minBinaryOperatorDepth(tokens)
+	parenDepth, lineIndent := 0, 0
+	inBrace, breakBrace := false, false
+	for i, t := range tokens {
+		var prev *Tokhan
+		if i > 0 {
+			prev = &tokens[i-1]
+		}
+		switch {
+		case multiline && breakBrace && (t.Type == RIGHT_BRACE || prev.Type == LEFT_BRACE || prev.Type == COMMA):
+			indent := lineIndent
+			if t.Type != RIGHT_BRACE {
+				indent++
+			}
+			newline(indent)
+		case multiline && isBinaryOperator(tokens, i, inBrace) && parenDepth == breakDepth:
+			lineIndent = parenDepth
+			newline(lineIndent)
+		case needsSpace(tokens, i, inBrace):
+			sb.WriteString(" ")
+		}
+		sb.WriteString(t.Val)
+
+		switch t.Type {
+		case LEFT_PAREN:
+			parenDepth++
+		case RIGHT_PAREN:
+			parenDepth--
+		case LEFT_BRACE:
+			inBrace = true
+			breakBrace = hasMultipleMatchers(tokens[i+1:])
+		case RIGHT_BRACE:
+			inBrace, breakBrace = false, false
+		}
+	}
+	return sb.String()
+}
+
+// needsSpace decides whether the ith token is separated from the one before it.
+func needsSpace(tokens Tokens, i int, inBrace bool) bool {
+	if i == 0 {
+		return false
+	}
+	prev, curr := tokens[i-1], tokens[i]
+	switch prev.Type {
+	case LEFT_PAREN, LEFT_BRACE, LEFT_BRACKET, COLON:
+		return false
+	case ARITHMETIC:
+		if isUnaryOperator(tokens, i-1) {
+			return false
+		}
+	case OPERATOR:
+		// label matchers are written out like job="api"
+		if inBrace {
+			return false
+		}
+	}
+	switch curr.Type {
+	case RIGHT_PAREN, RIGHT_BRACE, RIGHT_BRACKET, LEFT_BRACKET, COMMA, COLON:
+		return false
+	case LEFT_BRACE:
+		// i.e. metric{job="api"}, but a + {__name__="metric"}
+		return prev.Type != ID && prev.Type != METRIC_ID
+	case OPERATOR:
+		return !inBrace
+	case LEFT_PAREN:
+		// i.e. rate(, sum(, on(job), start(), but sum by (job)
+		switch prev.Type {
+		case AGGR_OP_NO_PARAM, AGGR_OP_SCALAR_PARAM, AGGR_OP_STRING_PARAM, GROUP_KW, GROUP_SIDE, AT_PREPROCESSOR, ID:
+			return false
+		}
+		return !isFunction(prev.Type)
+	}
+	return true
+}
+
+func isFunction(t TokenType) bool {
+	return vectorFunctionSignatures.Has(string(t)) || scalarFunctionSignatures.Has(string(t))
+}
+
+// isUnaryOperator checks whether the ith token is a sign, rather than a binary operator.
+func isUnaryOperator(tokens Tokens, i int) bool {
+	if tokens[i].Type != ARITHMETIC || (tokens[i].Val != "+" && tokens[i].Val != "-") {
+		return false
+	}
+	if i == 0 {
+		return true
+	}
+	switch tokens[i-1].Type {
+	case LEFT_PAREN, LEFT_BRACKET, COMMA, ARITHMETIC, OPERATOR, SET, BOOL_KW, OFFSET_KW, AT_MODIFIER:
+		return true
+	}
+	return false
+}
+
+func isBinaryOperator(tokens Tokens, i int, inBrace bool) bool {
+	switch tokens[i].Type {
+	case ARITHMETIC:
+		return !isUnaryOperator(tokens, i)
+	case OPERATOR:
+		return !inBrace
+	case SET:
+		return true
+	}
+	return false
+}
+
+// minBinaryOperatorDepth finds how deeply nested in parens the outermost binary operators are.
+func minBinaryOperatorDepth(tokens Tokens) int {
+	depth, inBrace := 0, false
+	min := -1
+	for i, t := range tokens {
+		switch t.Type {
+		case LEFT_PAREN:
+			depth++
+		case RIGHT_PAREN:
+			depth--
+		case LEFT_BRACE:
+			inBrace = true
+		case RIGHT_BRACE:
+			inBrace = false
+		}
+		if isBinaryOperator(tokens, i, inBrace) && (min == -1 || depth < min) {
+			min = depth
+		}
+	}
+	return min
+}
+
+// hasMultipleMatchers checks whether the label matchers up until the closing brace
+// are separated by commas.
+func hasMultipleMatchers(tokens Tokens) bool {
+	for _, t := range tokens {
+		switch t.Type {
+		case RIGHT_BRACE:
+			return false
+		case COMMA:
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package earley
+
+import (
+	"testing"
+)
+
+func TestFormatQuery(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "Should normalize whitespace",
+			input: "  sum   by(job)(rate( metric_name { job = 'api' , code!='500' } [ 5m ] ) )",
+			want:  "sum by (job) (rate(metric_name{job='api', code!='500'}[5m]))",
+		},
+		{
+			name:  "Should space out binary operators but not signs",
+			input: "-metric_name*2>bool -1 and on(job)other offset -5m",
+			want:  "-metric_name * 2 > bool -1 and on(job) other offset -5m",
+		},
+		{
+			name:  "Should format subqueries and modifiers",
+			input: "max_over_time( rate(metric_name[5m])[ 1h : 1m ] @ start( ) )",
+			want:  "max_over_time(rate(metric_name[5m])[1h:1m] @ start())",
+		},
+		{
+			name:  "Should format selectors without a metric name",
+			input: "rate( {__name__=~'api_.*'}[5m])+{__name__ = 'up'}",
+			want:  "rate({__name__=~'api_.*'}[5m]) + {__name__='up'}",
+		},
+		{
+			name:  "Should split long queries over lines",
+			input: "sum by (job) (rate(http_requests_total{job='api',code='500'}[5m])) / sum by (job) (rate(http_requests_total[5m]))",
+			want: "sum by (job) (rate(http_requests_total{\n" +
+				"  job='api',\n" +
+				"  code='500'\n" +
+				"}[5m]))\n" +
+				"/ sum by (job) (rate(http_requests_total[5m]))",
+		},
+		{
+			name:  "Should only split the outermost binary operators",
+			input: "(metric_name_one{job='api'} + metric_name_two{job='api'}) / metric_name_three{job='api'} > 0.5",
+			want: "(metric_name_one{job='api'} + metric_name_two{job='api'})\n" +
+				"/ metric_name_three{job='api'}\n" +
+				"> 0.5",
+		},
+		{
+			name:  "Should keep the text of incomplete queries",
+			input: "sum(rate(metric_name{job=",
+			want:  "sum(rate(metric_name{job=",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := FormatQuery(tt.input); got != tt.want {
+				t.Errorf("FormatQuery() =\n%v\nwant\n%v", got, tt.want)
+			}
+		})
+	}
+}
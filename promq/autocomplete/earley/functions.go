@@ -0,0 +1,81 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package earley
+
+import (
+	"fmt"
+	"strings"
+)
+
+var (
+	// the signatures our grammar has rules for, by the type of what the function returns
+	vectorFunctionSignatures = newStringSet(
+		FUNCTION_VECTOR_ARG, FUNCTION_OPTIONAL_VECTOR_ARG, FUNCTION_MATRIX_ARG, FUNCTION_SCALAR_ARG,
+		FUNCTION_VECTOR_SCALAR_ARGS, FUNCTION_VECTOR_OPT_SCALAR_ARGS, FUNCTION_VECTOR_SCALAR_2_ARGS,
+		FUNCTION_SCALAR_VECTOR_ARGS, FUNCTION_SCALAR_2_VECTOR_ARGS, FUNCTION_SCALAR_MATRIX_ARGS,
+		FUNCTION_MATRIX_SCALAR_ARGS, FUNCTION_MATRIX_SCALAR_2_ARGS, FUNCTION_LABEL_REPLACE_ARGS,
+		FUNCTION_LABEL_JOIN_ARGS,
+	)
+	scalarFunctionSignatures = newStringSet(FUNCTION_NO_ARGS, FUNCTION_VECTOR_TO_SCALAR_ARG)
+)
+
+// RegisterVectorFunction adds a function which returns an instant vector to the
+// functions we parse and suggest, i.e. one provided by a prometheus fork. The
+// signature is one of the FUNCTION_* token types which describe vector functions,
+// i.e. FUNCTION_MATRIX_ARG for a function like rate.
+//
+// Our grammar has rules per signature rather than per function, so there is no
+// need to rebuild the parser. Functions should be registered before any completer
+// is created (i.e. from an init function), this isn't safe to call concurrently
+// with completion.
+func RegisterVectorFunction(name, desc string, signature TokenType) error {
+	return registerFunction(vectorFunctions, vectorFunctionSignatures.Has(string(signature)), name, desc, signature)
+}
+
+// RegisterScalarFunction adds a function which returns a scalar, i.e. like time()
+// or scalar(v instant-vector). The signature is one of FUNCTION_NO_ARGS or
+// FUNCTION_VECTOR_TO_SCALAR_ARG. See RegisterVectorFunction for caveats.
+func RegisterScalarFunction(name, desc string, signature TokenType) error {
+	return registerFunction(scalarFunctions, scalarFunctionSignatures.Has(string(signature)), name, desc, signature)
+}
+
+func registerFunction(functions map[string]string, validSignature bool, name, desc string, signature TokenType) error {
+	if !validSignature {
+		return fmt.Errorf("function %q: unsupported signature %q", name, signature)
+	}
+	if !isIdentifier(name) {
+		return fmt.Errorf("function %q: not a valid identifier", name)
+	}
+	if _, ok := functionSignatures[name]; ok {
+		return fmt.Errorf("function %q is already registered", name)
+	}
+	if _, ok := keywords[strings.ToLower(name)]; ok {
+		return fmt.Errorf("function %q: clashes with a keyword", name)
+	}
+	functions[name] = desc
+	functionSignatures[name] = signature
+	return nil
+}
+
+func isIdentifier(name string) bool {
+	for i, r := range name {
+		if !isAlpha(r) && (i == 0 || !isAlphaNumeric(r)) {
+			return false
+		}
+	}
+	return name != ""
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package earley
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"sigs.k8s.io/instrumentation-tools/notstdlib/sets"
+)
+
+func TestRegisterFunction(t *testing.T) {
+	defer func() {
+		for _, f := range []string{"rate_limit_over_time", "cluster_time"} {
+			delete(vectorFunctions, f)
+			delete(scalarFunctions, f)
+			delete(functionSignatures, f)
+		}
+	}()
+	if err := RegisterVectorFunction("rate_limit_over_time", "rate_limit_over_time(v range-vector) custom", FUNCTION_MATRIX_ARG); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := RegisterScalarFunction("cluster_time", "cluster_time() custom", FUNCTION_NO_ARGS); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	invalid := []struct {
+		name      string
+		signature TokenType
+		register  func(string, string, TokenType) error
+	}{
+		{name: "rate", signature: FUNCTION_MATRIX_ARG, register: RegisterVectorFunction},
+		{name: "Sum", signature: FUNCTION_VECTOR_ARG, register: RegisterVectorFunction},
+		{name: "1st", signature: FUNCTION_VECTOR_ARG, register: RegisterVectorFunction},
+		{name: "my_scalar", signature: FUNCTION_VECTOR_ARG, register: RegisterScalarFunction},
+		{name: "my_vector", signature: FUNCTION_NO_ARGS, register: RegisterVectorFunction},
+	}
+	for _, tc := range invalid {
+		if err := tc.register(tc.name, "", tc.signature); err == nil {
+			t.Errorf("registering %q as %v: expected an error", tc.name, tc.signature)
+		}
+	}
+
+	index := NewTestIndex()
+	index.LoadMetrics(`
+metric_name_one{dima="1"} 1
+`, time.Now())
+	c := NewPromQLCompleter(index)
+	for query, want := range map[string]sets.String{
+		"rate_li": sets.NewString("rate_limit_over_time"),
+		"rate_limit_over_time(metric_name_one[5m]) ": sets.StringKeySet(arithmeticOperators).Union(sets.StringKeySet(comparisionOperators)).Union(sets.StringKeySet(setOperators)),
+		"cluster_time() > bool clu":                  sets.NewString("cluster_time"),
+	} {
+		if got := toSet(c.GenerateSuggestions(query, len(query))); !reflect.DeepEqual(got, want) {
+			t.Errorf("Query %v: got %v, expected %v", query, got, want)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package earley
+
+// SpanClass is what a span of a query is, for the purposes of colorizing it. These
+// are stable, unlike our token types which follow the needs of our grammar.
+type SpanClass string
+
+const (
+	SpanMetric   SpanClass = "metric"
+	SpanLabel    SpanClass = "label"
+	SpanString   SpanClass = "string"
+	SpanOperator SpanClass = "operator"
+	SpanFunction SpanClass = "function"
+	SpanDuration SpanClass = "duration"
+	SpanNumber   SpanClass = "number"
+	// i.e. by, offset, bool
+	SpanKeyword SpanClass = "keyword"
+)
+
+// Span is a highlighted part of a query, from Start up to (but not including) End
+// in bytes.
+type Span struct {
+	Start int
+	End   int
+	Class SpanClass
+}
+
+// Highlight splits a query up into spans to colorize. Anything without a class,
+// i.e. whitespace, brackets and text we can't make sense of, isn't covered by a span.
+func Highlight(query string) []Span {
+	tokens := newLuthor().lex(query)
+	var spans []Span
+	// whether we're in a label matcher, or the label list of i.e. by (job) or on(job)
+	inBrace, inLabelList := false, false
+	for i, t := range tokens {
+		var class SpanClass
+		switch t.Type {
+		case METRIC_ID:
+			class = SpanMetric
+		case ID:
+			switch {
+			case inBrace || inLabelList:
+				class = SpanLabel
+			case i+1 < len(tokens) && tokens[i+1].Type == LEFT_PAREN:
+				// a function we don't know about
+				class = SpanFunction
+			default:
+				class = SpanMetric
+			}
+		case STRING:
+			class = SpanString
+			// quoted names, i.e. {"my.metric", "label.name"="v"} or by ("label.name")
+			var next TokenType
+			if i+1 < len(tokens) {
+				next = tokens[i+1].Type
+			}
+			switch {
+			case inLabelList, inBrace && next == OPERATOR:
+				class = SpanLabel
+			case inBrace && tokens[i-1].Type == LEFT_BRACE && (next == COMMA || next == RIGHT_BRACE):
+				class = SpanMetric
+			}
+		case ARITHMETIC, OPERATOR, SET, AT_MODIFIER:
+			class = SpanOperator
+		case AGGR_OP_NO_PARAM, AGGR_OP_SCALAR_PARAM, AGGR_OP_STRING_PARAM, AT_PREPROCESSOR:
+			class = SpanFunction
+		case DURATION:
+			class = SpanDuration
+		case NUM:
+			class = SpanNumber
+		case AGGR_KW, GROUP_KW, GROUP_SIDE, BOOL_KW, OFFSET_KW:
+			class = SpanKeyword
+		case LEFT_BRACE:
+			inBrace = true
+		case RIGHT_BRACE:
+			inBrace = false
+		case LEFT_PAREN:
+			inLabelList = i > 0 && isLabelListKeyword(tokens[i-1].Type)
+		case RIGHT_PAREN:
+			inLabelList = false
+		default:
+			if isFunction(t.Type) {
+				class = SpanFunction
+			}
+		}
+		if class != "" {
+			spans = append(spans, Span{Start: t.StartPos, End: t.EndPos, Class: class})
+		}
+	}
+	return spans
+}
+
+func isLabelListKeyword(t TokenType) bool {
+	return t == AGGR_KW || t == GROUP_KW || t == GROUP_SIDE
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package earley
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHighlight(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		// the highlighted text, with its class
+		want [][2]string
+	}{
+		{
+			name:  "Should highlight selectors",
+			input: "metric_name{job='api'}[5m] offset 1h",
+			want: [][2]string{
+				{"metric_name", "metric"}, {"job", "label"}, {"=", "operator"}, {"'api'", "string"},
+				{"5m", "duration"}, {"offset", "keyword"}, {"1h", "duration"},
+			},
+		},
+		{
+			name:  "Should highlight functions and aggregations",
+			input: "sum by (job) (rate(foo:bar[5m])) > bool 0.5",
+			want: [][2]string{
+				{"sum", "function"}, {"by", "keyword"}, {"job", "label"}, {"rate", "function"}, {"foo:bar", "metric"},
+				{"5m", "duration"}, {">", "operator"}, {"bool", "keyword"}, {"0.5", "number"},
+			},
+		},
+		{
+			name:  "Should highlight vector matching",
+			input: "a / on(job) group_left(instance) b @ start()",
+			want: [][2]string{
+				{"a", "metric"}, {"/", "operator"}, {"on", "keyword"}, {"job", "label"}, {"group_left", "keyword"},
+				{"instance", "label"}, {"b", "metric"}, {"@", "operator"}, {"start", "function"},
+			},
+		},
+		{
+			name:  "Should highlight quoted names",
+			input: `sum by ("label.name") ({"my.metric", "label.name"="v"})`,
+			want: [][2]string{
+				{"sum", "function"}, {"by", "keyword"}, {`"label.name"`, "label"}, {`"my.metric"`, "metric"},
+				{`"label.name"`, "label"}, {"=", "operator"}, {`"v"`, "string"},
+			},
+		},
+		{
+			name:  "Should skip what we can't make sense of",
+			input: "foo ! my_func(",
+			want:  [][2]string{{"foo", "metric"}, {"my_func", "function"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got [][2]string
+			for _, s := range Highlight(tt.input) {
+				got = append(got, [2]string{tt.input[s.Start:s.End], string(s.Class)})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Highlight() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
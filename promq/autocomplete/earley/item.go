@@ -34,7 +34,10 @@ type EarleyItem struct {
 	originatingIndex int
 	cause            StateType // 'predict', 'scan' or 'complete'
 	// from is an array of the existing item that generate this item
-	from                    []ItemId
+	from []ItemId
+	// alternatives are the other items this item could have been generated from, which
+	// only happens when the input can be parsed more than one way
+	alternatives            [][]ItemId
 	terminalSymbolsConsumed int
 	ctx                     *completionContext
 }
@@ -79,6 +82,54 @@ func newCompleteItem(sourceState *EarleyItem, from []ItemId, ctx *completionCont
 	}
 }
 
+// Id locates the item in the chart.
+func (item *EarleyItem) Id() ItemId {
+	return item.id
+}
+
+// addDerivation records that other is the same item as this one, but generated from
+// different items, i.e. 'a + a + a' completes 'S -> S + S' from either of its halves.
+func (item *EarleyItem) addDerivation(other *EarleyItem) {
+	// where a prediction came from doesn't matter to the parse
+	if other.cause == PREDICT_STATE {
+		return
+	}
+	item.addDerivedFrom(other.from)
+}
+
+// addDerivedFrom records that this item could have been generated from the given items.
+func (item *EarleyItem) addDerivedFrom(from []ItemId) {
+	if from == nil || sameItemIds(item.from, from) {
+		return
+	}
+	for _, alt := range item.alternatives {
+		if sameItemIds(alt, from) {
+			return
+		}
+	}
+	item.alternatives = append(item.alternatives, from)
+}
+
+// derivations lists every set of items this item was generated from, the first one first
+func (item *EarleyItem) derivations() [][]ItemId {
+	if item.from == nil {
+		return nil
+	}
+	return append([][]ItemId{item.from}, item.alternatives...)
+}
+
+func sameItemIds(a, b []ItemId) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 // I like this bit from gearley, so I am leaving it the way it was
 func (item *EarleyItem) String() string {
 	rightStrings := make([]string, len(item.Rule.right))
@@ -111,7 +162,13 @@ func (item *EarleyItem) badhash() uint64 {
 	// let's just assume we don't have more than 1k rules,
 	// or rules which are over 500 chars long,
 	// or more than 500 symbols
-	return uint64(item.Rule.grammarRuleId)<<32 | uint64(item.RulePos)<<16 | uint64(item.originatingIndex)
+	return itemHash(item.Rule, item.RulePos, item.originatingIndex)
+}
+
+// itemHash is the badhash of the item we'd make, so that we can check whether we have
+// it before making it.
+func itemHash(rule *GrammarRule, rulePos, originatingIndex int) uint64 {
+	return uint64(rule.grammarRuleId)<<32 | uint64(rulePos)<<16 | uint64(originatingIndex)
 }
 
 // complete means that dot reaches the end
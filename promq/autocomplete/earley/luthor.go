@@ -19,11 +19,12 @@ package earley
 
 import (
 	"fmt"
-	"github.com/prometheus/prometheus/promql/parser"
-	"sigs.k8s.io/instrumentation-tools/notstdlib/sets"
 	"strings"
+	"sync"
+	"unicode/utf8"
 
 	"sigs.k8s.io/instrumentation-tools/debug"
+	"sigs.k8s.io/instrumentation-tools/notstdlib/sets"
 )
 
 type Tokens []Tokhan
@@ -44,6 +45,9 @@ func (ws Tokens) Types() []string {
 	return v
 }
 func (ws Tokens) Print() {
+	if !debug.Enabled() {
+		return
+	}
 	for _, w := range ws {
 		debug.Debugln(w.String())
 	}
@@ -62,20 +66,13 @@ func (ws Tokens) Last() Tokhan {
 	return ws[len(ws)-2]
 }
 
-func (ws Tokens) Compare(tks2 Tokens) int {
-	i := 0
-	for i, t := range ws {
-		// return positive i if ws and tks2 have partial overlap
-		if i >= len(tks2) || !t.equals(tks2[i]) {
-			return i
-		}
-	}
-	// return negative i if tks2 covers ws
-	if len(tks2) > len(ws) {
-		return 0 - i
+// CommonPrefixLength returns the number of leading tokens ws and tks2 have in common.
+func (ws Tokens) CommonPrefixLength(tks2 Tokens) int {
+	n := 0
+	for n < len(ws) && n < len(tks2) && ws[n].equals(tks2[n]) {
+		n++
 	}
-	// return 0 if they are equal
-	return 0
+	return n
 }
 
 type TypedToken interface {
@@ -98,6 +95,28 @@ const (
 	METRIC_LABEL_SUBTYPE TokenType = "metric-label-identifier"
 	FUNCTION_SCALAR_ID   TokenType = "function-scalar-identifier"
 	FUNCTION_VECTOR_ID   TokenType = "function-vector-identifier"
+	// names which aren't valid identifiers are quoted, i.e. {"my.metric", "label.name"="v"}
+	QUOTED_METRIC_ID TokenType = "quoted-metric-identifier"
+	QUOTED_LABEL_ID  TokenType = "quoted-metric-label-identifier"
+
+	// function identifiers are lexed by their signature (see functionSignatures),
+	// so that our grammar knows which arguments a function accepts
+	FUNCTION_NO_ARGS                TokenType = "function-no-args"                // time()
+	FUNCTION_VECTOR_ARG             TokenType = "function-vector-arg"             // abs(v instant-vector)
+	FUNCTION_OPTIONAL_VECTOR_ARG    TokenType = "function-optional-vector-arg"    // hour(v=vector(time()) instant-vector)
+	FUNCTION_MATRIX_ARG             TokenType = "function-matrix-arg"             // rate(v range-vector)
+	FUNCTION_SCALAR_ARG             TokenType = "function-scalar-arg"             // vector(s scalar)
+	FUNCTION_VECTOR_SCALAR_ARGS     TokenType = "function-vector-scalar-args"     // clamp_max(v instant-vector, max scalar)
+	FUNCTION_VECTOR_OPT_SCALAR_ARGS TokenType = "function-vector-opt-scalar-args" // round(v instant-vector, to_nearest=1 scalar)
+	FUNCTION_VECTOR_SCALAR_2_ARGS   TokenType = "function-vector-scalar-2-args"   // clamp(v instant-vector, min scalar, max scalar)
+	FUNCTION_SCALAR_VECTOR_ARGS     TokenType = "function-scalar-vector-args"     // histogram_quantile(φ scalar, b instant-vector)
+	FUNCTION_SCALAR_2_VECTOR_ARGS   TokenType = "function-scalar-2-vector-args"   // histogram_fraction(lower scalar, upper scalar, b instant-vector)
+	FUNCTION_SCALAR_MATRIX_ARGS     TokenType = "function-scalar-matrix-args"     // quantile_over_time(φ scalar, v range-vector)
+	FUNCTION_MATRIX_SCALAR_ARGS     TokenType = "function-matrix-scalar-args"     // predict_linear(v range-vector, t scalar)
+	FUNCTION_MATRIX_SCALAR_2_ARGS   TokenType = "function-matrix-scalar-2-args"   // holt_winters(v range-vector, sf scalar, tf scalar)
+	FUNCTION_LABEL_REPLACE_ARGS     TokenType = "function-label-replace-args"     // label_replace(v instant-vector, dst string, replacement string, src string, regex string)
+	FUNCTION_LABEL_JOIN_ARGS        TokenType = "function-label-join-args"        // label_join(v instant-vector, dst string, separator string, src string...)
+	FUNCTION_VECTOR_TO_SCALAR_ARG   TokenType = "function-vector-to-scalar-arg"   // scalar(v instant-vector)
 
 	OPERATOR TokenType = "operator"
 	//binary operators
@@ -110,6 +129,11 @@ const (
 	UNARY_OP TokenType = "unary-op"
 
 	AGGR_OP TokenType = "aggregator_operation"
+	// aggregators are lexed by whether they take a parameter ahead of the vector, like
+	// functions are, and suggested as AGGR_OP
+	AGGR_OP_NO_PARAM     TokenType = "aggregator-operation-no-param"     // sum(v instant-vector)
+	AGGR_OP_SCALAR_PARAM TokenType = "aggregator-operation-scalar-param" // topk(k scalar, v instant-vector)
+	AGGR_OP_STRING_PARAM TokenType = "aggregator-operation-string-param" // count_values(label string, v instant-vector)
 
 	//keywords
 	KEYWORD    TokenType = "keyword"
@@ -119,6 +143,18 @@ const (
 	GROUP_SIDE TokenType = "group-side"
 	GROUP_KW   TokenType = "group-keyword"
 
+	// negative offsets, i.e. offset -5m
+	OFFSET_SIGN TokenType = "offset-sign"
+	// operators between durations, i.e. [5m+30s]
+	DURATION_OP TokenType = "duration-op"
+
+	// @ modifier
+	AT_MODIFIER     TokenType = "at-modifier"
+	AT_PREPROCESSOR TokenType = "at-preprocessor"
+
+	// the brace which starts a selector without a metric name, i.e. {__name__=~"foo_.*"}
+	SELECTOR_LEFT_BRACE TokenType = "selector-leftbrace"
+
 	LEFT_BRACE    TokenType = "leftbrace"
 	RIGHT_BRACE   TokenType = "rightbrace"
 	LEFT_PAREN    TokenType = "leftparen"
@@ -140,13 +176,12 @@ type Tokhan struct {
 	StartPos int
 	EndPos   int
 	Type     TokenType
-	ItemType parser.ItemType
 	Val      string
 	_index   int
 }
 
 func (t Tokhan) isEof() bool {
-	return t.ItemType == parser.EOF
+	return t.Type == EOF
 }
 
 func (t Tokhan) String() string {
@@ -163,139 +198,316 @@ func (t Tokhan) equals(t2 Tokhan) bool {
 }
 
 func extractWords(query string) Tokens {
-	words := extractTokensWithOffset(query, 0)
+	words := newLuthor().lex(query)
 	words.Print()
 	return words
 }
 
-// todo(rant):  we should probably just hand-roll a parser for this. I am
-// todo(cont):  not fond of the way this lexer encodes random syntactical
-// todo(cont):  rules during lexing
-func extractTokensWithOffset(query string, offset int) (words Tokens) {
-	l := parser.Lex(query)
-	i := 0
+// keywords are matched case insensitively, like the prometheus lexer does.
+var keywords = map[string]TokenType{
+	"and":    SET,
+	"or":     SET,
+	"unless": SET,
+	"atan2":  ARITHMETIC,
+
+	"sum":          AGGR_OP_NO_PARAM,
+	"avg":          AGGR_OP_NO_PARAM,
+	"count":        AGGR_OP_NO_PARAM,
+	"min":          AGGR_OP_NO_PARAM,
+	"max":          AGGR_OP_NO_PARAM,
+	"group":        AGGR_OP_NO_PARAM,
+	"stddev":       AGGR_OP_NO_PARAM,
+	"stdvar":       AGGR_OP_NO_PARAM,
+	"topk":         AGGR_OP_SCALAR_PARAM,
+	"bottomk":      AGGR_OP_SCALAR_PARAM,
+	"count_values": AGGR_OP_STRING_PARAM,
+	"quantile":     AGGR_OP_SCALAR_PARAM,
+
+	"offset":      OFFSET_KW,
+	"by":          AGGR_KW,
+	"without":     AGGR_KW,
+	"on":          GROUP_KW,
+	"ignoring":    GROUP_KW,
+	"group_left":  GROUP_SIDE,
+	"group_right": GROUP_SIDE,
+	"bool":        BOOL_KW,
+
+	"start": AT_PREPROCESSOR,
+	"end":   AT_PREPROCESSOR,
+
+	"inf": NUM,
+	"nan": NUM,
+}
+
+// lexState is everything (besides the input) the lexer needs to carry on
+// lexing from a token boundary.
+type lexState struct {
+	braceOpen   bool
+	bracketOpen bool
+}
+
+// luthor is a lexer built for autocompletion. Unlike the prometheus lexer, it
+// never gives up on malformed or partial input: unclosed braces and strings are
+// fine, and anything it can't make sense of is lexed as UNKNOWN so the parser
+// can decide what to do with it.
+//
+// luthor also remembers the last input it lexed. Since queries are typically
+// edited at the end, lexing a new query only relexes the suffix which changed.
+type luthor struct {
+	mu     sync.Mutex
+	input  string
+	tokens Tokens
+	// states[i] is the lexer state just after tokens[i]
+	states []lexState
+
+	// scratch state for the current lex
+	src   string
+	pos   int
+	state lexState
+}
+
+func newLuthor() *luthor {
+	return &luthor{}
+}
+
+// lex returns the tokens of query, always terminated by an EOF token.
+func (l *luthor) lex(query string) Tokens {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// A token is only reusable if the character after it is unchanged too,
+	// since that's what decided where the token ended.
+	changedAt := commonPrefix(l.input, query)
+	keep := 0
+	for keep < len(l.tokens) && !l.tokens[keep].isEof() && l.tokens[keep].EndPos < changedAt {
+		keep++
+	}
+	l.tokens = l.tokens[:keep]
+	l.states = l.states[:keep]
+	l.src, l.pos, l.state = query, 0, lexState{}
+	if keep > 0 {
+		l.pos = l.tokens[keep-1].EndPos
+		l.state = l.states[keep-1]
+	}
+	debug.Debugf("relexing %q from position %v, reusing %v tokens\n", query, l.pos, keep)
+
 	for {
-		currItem := parser.Item{}
-		l.NextItem(&currItem)
-		if currItem.Typ == parser.EOF {
-			words = append(words, createTokenFromItem(currItem, offset))
+		t := l.next()
+		l.tokens = append(l.tokens, t)
+		l.states = append(l.states, l.state)
+		if t.isEof() {
 			break
 		}
+	}
+	l.input = query
 
-		// recurse our lexer on a sub-query string. We do this specifically to accommodate
-		// strings like `start(label='value)end` where we want as output:
-		// a linked list of tokens like this:
-		// "start" <-> "(" <-> "label" <-> "=" <-> "'value" <-> ")" <-> "end"
-		if currItem.Typ == parser.ERROR {
-			substring := query[currItem.Pos:]
-			// we're recursing and found an error already abort
-			if i == 0 {
-				break
-			}
-			subWords := extractTokensWithOffset(substring, int(currItem.Pos))
-			if len(subWords) > 0 {
-				words = append(words, subWords...)
-			}
-			return
-		}
-		words = append(words, createTokenFromItem(currItem, offset))
-		i++
+	words := make(Tokens, len(l.tokens))
+	copy(words, l.tokens)
+	return words
+}
+
+func commonPrefix(a, b string) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
 	}
-	return
+	return n
 }
 
-func createTokenFromItem(item parser.Item, offset int) Tokhan {
-	return Tokhan{
-		Val:      item.Val,
-		ItemType: item.Typ,
-		Type:     mapParserItemTypeToTokhanType(item),
-		StartPos: int(item.Pos) + offset,
-		EndPos:   int(item.PositionRange().End),
+func (l *luthor) peek(offset int) rune {
+	pos := l.pos
+	for ; offset > 0 && pos < len(l.src); offset-- {
+		_, w := utf8.DecodeRuneInString(l.src[pos:])
+		pos += w
 	}
+	if pos >= len(l.src) {
+		return utf8.RuneError
+	}
+	r, _ := utf8.DecodeRuneInString(l.src[pos:])
+	return r
+}
+
+func (l *luthor) advance() rune {
+	r, w := utf8.DecodeRuneInString(l.src[l.pos:])
+	l.pos += w
+	return r
 }
 
-func mapParserItemTypeToTokhanType(item parser.Item) TokenType {
-	t := item.Typ
-	switch {
-	case t == parser.BY, t == parser.WITHOUT:
-		return AGGR_KW
-	case t == parser.OFFSET:
-		return OFFSET_KW
-	case t == parser.BOOL:
-		return BOOL_KW
-	case t == parser.GROUP_LEFT, t == parser.GROUP_RIGHT:
-		return GROUP_SIDE
-	case t == parser.IGNORING, t == parser.ON:
-		return GROUP_KW
-	case t == parser.EOF:
-		return EOF
-	case t == parser.STRING:
-		return STRING
-	case isAggregator(t):
-		return AGGR_OP
-	case t == parser.METRIC_IDENTIFIER:
-		return METRIC_ID
-	case isScalarFunction(item):
-		return FUNCTION_SCALAR_ID
-	case isVectorFunction(item):
-		return FUNCTION_VECTOR_ID
-	case t == parser.IDENTIFIER:
-		return ID
-	case t == parser.LEFT_BRACE:
-		return LEFT_BRACE
-	case t == parser.RIGHT_BRACE:
-		return RIGHT_BRACE
-	case t == parser.LEFT_PAREN:
-		return LEFT_PAREN
-	case t == parser.RIGHT_PAREN:
-		return RIGHT_PAREN
-	case t == parser.LEFT_BRACKET:
-		return LEFT_BRACKET
-	case t == parser.RIGHT_BRACKET:
-		return RIGHT_BRACKET
-	case t == parser.DURATION:
-		return DURATION
-	case t == parser.ADD, t == parser.SUB, t == parser.MUL, t == parser.DIV, t == parser.MOD, t == parser.POW:
-		return ARITHMETIC
-	case t == parser.LAND, t == parser.LOR, t == parser.LUNLESS:
-		return SET
-	case isOperator(t):
-		return OPERATOR
-	case t == parser.COMMA:
-		return COMMA
-	case t == parser.COLON:
-		return COLON
-	case t == parser.NUMBER:
-		return NUM
-	default:
-		return UNKNOWN
+func (l *luthor) acceptRun(valid func(rune) bool) {
+	for l.pos < len(l.src) && valid(l.peek(0)) {
+		l.advance()
 	}
 }
 
-// need to explicitly extract this function since it's private
-// in prometheus 2.16
-func isAggregator(item parser.ItemType) bool {
-	return item > 57388 && item < 57401
+func (l *luthor) emit(tokenType TokenType, start int) Tokhan {
+	return Tokhan{
+		StartPos: start,
+		EndPos:   l.pos,
+		Type:     tokenType,
+		Val:      l.src[start:l.pos],
+	}
 }
 
-func isOperator(item parser.ItemType) bool {
-	return item == parser.EQL || (item > 57367 && item < 57387)
+// next lexes the token at the current position.
+func (l *luthor) next() Tokhan {
+	l.acceptRun(isSpace)
+	// comments run to the end of the line, and mean nothing to us
+	for l.peek(0) == '#' && l.pos < len(l.src) {
+		l.acceptRun(func(r rune) bool { return r != '\n' })
+		l.acceptRun(isSpace)
+	}
+	start := l.pos
+	if l.pos >= len(l.src) {
+		return l.emit(EOF, start)
+	}
+
+	switch r := l.advance(); {
+	case r == '"' || r == '\'' || r == '`':
+		return l.lexString(r, start)
+	case r == ',':
+		return l.emit(COMMA, start)
+	case r == '(':
+		return l.emit(LEFT_PAREN, start)
+	case r == ')':
+		return l.emit(RIGHT_PAREN, start)
+	case r == '{':
+		l.state.braceOpen = true
+		return l.emit(LEFT_BRACE, start)
+	case r == '}':
+		l.state.braceOpen = false
+		return l.emit(RIGHT_BRACE, start)
+	case r == '[':
+		l.state.bracketOpen = true
+		return l.emit(LEFT_BRACKET, start)
+	case r == ']':
+		l.state.bracketOpen = false
+		return l.emit(RIGHT_BRACKET, start)
+	case r == '@':
+		return l.emit(AT_MODIFIER, start)
+	case r == ':' && l.state.bracketOpen:
+		return l.emit(COLON, start)
+	case r == '+' || r == '-' || r == '*' || r == '/' || r == '%' || r == '^':
+		return l.emit(ARITHMETIC, start)
+	case r == '=':
+		if next := l.peek(0); next == '=' || next == '~' {
+			l.advance()
+		}
+		return l.emit(OPERATOR, start)
+	case r == '!':
+		if next := l.peek(0); next == '=' || next == '~' {
+			l.advance()
+			return l.emit(OPERATOR, start)
+		}
+		return l.emit(UNKNOWN, start)
+	case r == '<' || r == '>':
+		if l.peek(0) == '=' {
+			l.advance()
+		}
+		return l.emit(OPERATOR, start)
+	case isDigit(r) || (r == '.' && isDigit(l.peek(0))):
+		return l.lexNumberOrDuration(start)
+	case l.state.braceOpen && isAlpha(r):
+		// label names, keywords don't apply inside of braces
+		l.acceptRun(isAlphaNumeric)
+		return l.emit(ID, start)
+	case !l.state.braceOpen && (isAlpha(r) || r == ':'):
+		return l.lexKeywordOrIdentifier(start)
+	}
+	return l.emit(UNKNOWN, start)
 }
 
-func isScalarFunction(item parser.Item) bool {
-	for _, v := range sets.StringKeySet(scalarFunctions).List() {
-		if v == item.Val {
-			return true
+// lexString lexes a quoted string, the opening quote has already been consumed.
+// Unterminated strings run to the end of the input.
+func (l *luthor) lexString(quote rune, start int) Tokhan {
+	for l.pos < len(l.src) {
+		switch l.advance() {
+		case '\\':
+			if quote != '`' && l.pos < len(l.src) {
+				l.advance()
+			}
+		case quote:
+			return l.emit(STRING, start)
 		}
 	}
-	return false
+	return l.emit(STRING, start)
 }
 
-func isVectorFunction(item parser.Item) bool {
-	for _, v := range sets.StringKeySet(vectorFunctions).List() {
-		if v == item.Val {
-			return true
+func (l *luthor) lexNumberOrDuration(start int) Tokhan {
+	digits := isDigit
+	if l.src[start] == '0' && (l.peek(0) == 'x' || l.peek(0) == 'X') && isHexDigit(l.peek(1)) {
+		l.advance()
+		digits = isHexDigit
+	}
+	l.acceptRun(digits)
+	if l.peek(0) == '.' {
+		l.advance()
+		l.acceptRun(digits)
+	}
+	if next := l.peek(0); (next == 'e' || next == 'E') && (isDigit(l.peek(1)) || ((l.peek(1) == '+' || l.peek(1) == '-') && isDigit(l.peek(2)))) {
+		l.advance()
+		if !isDigit(l.peek(0)) {
+			l.advance()
+		}
+		l.acceptRun(isDigit)
+	}
+	if !isAlphaNumeric(l.peek(0)) {
+		return l.emit(NUM, start)
+	}
+	// durations are a sequence of number and unit pairs, i.e. 1h30m
+	l.pos = start
+	for l.pos < len(l.src) && isDigit(l.peek(0)) {
+		l.acceptRun(isDigit)
+		if !isDurationUnit(l.peek(0)) {
+			break
+		}
+		unit := l.advance()
+		// ms, the only unit which is two letters
+		if unit == 'm' && l.peek(0) == 's' {
+			l.advance()
 		}
 	}
-	return false
+	if l.pos > start && isDurationUnit(rune(l.src[l.pos-1])) && !isAlphaNumeric(l.peek(0)) {
+		return l.emit(DURATION, start)
+	}
+	l.acceptRun(isAlphaNumeric)
+	return l.emit(UNKNOWN, start)
+}
+
+func (l *luthor) lexKeywordOrIdentifier(start int) Tokhan {
+	l.acceptRun(func(r rune) bool { return isAlphaNumeric(r) || r == ':' })
+	word := l.src[start:l.pos]
+	if t, ok := keywords[strings.ToLower(word)]; ok {
+		return l.emit(t, start)
+	}
+	if strings.Contains(word, ":") {
+		return l.emit(METRIC_ID, start)
+	}
+	if t, ok := functionSignatures[word]; ok {
+		return l.emit(t, start)
+	}
+	return l.emit(ID, start)
+}
+
+func isSpace(r rune) bool {
+	return r == ' ' || r == '\t' || r == '\n' || r == '\r'
+}
+
+func isDigit(r rune) bool {
+	return '0' <= r && r <= '9'
+}
+
+func isHexDigit(r rune) bool {
+	return isDigit(r) || ('a' <= r && r <= 'f') || ('A' <= r && r <= 'F')
+}
+
+func isAlpha(r rune) bool {
+	return r == '_' || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z')
+}
+
+func isAlphaNumeric(r rune) bool {
+	return isAlpha(r) || isDigit(r)
+}
+
+func isDurationUnit(r rune) bool {
+	return strings.ContainsRune("smhdwy", r)
 }
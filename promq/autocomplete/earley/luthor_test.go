@@ -26,6 +26,7 @@ func TestExtractWords(t *testing.T) {
 		name      string
 		input     string
 		wantWords []string
+		wantTypes []TokenType
 	}{
 		{
 			name:      "Should only have EOF",
@@ -42,12 +43,117 @@ func TestExtractWords(t *testing.T) {
 			input:     "start{blah='aaa'}",
 			wantWords: []string{"start", "{", "blah", "=", "'aaa'", "}", ""},
 		},
+		{
+			name:      "Should tolerate unclosed parens and braces",
+			input:     "sum(rate(metric{job=~'api'",
+			wantWords: []string{"sum", "(", "rate", "(", "metric", "{", "job", "=~", "'api'", ""},
+			wantTypes: []TokenType{AGGR_OP_NO_PARAM, LEFT_PAREN, FUNCTION_MATRIX_ARG, LEFT_PAREN, ID, LEFT_BRACE, ID, OPERATOR, STRING, EOF},
+		},
+		{
+			name:      "Should lex unterminated strings to the end of the input",
+			input:     `metric{label="val`,
+			wantWords: []string{"metric", "{", "label", "=", `"val`, ""},
+		},
+		{
+			name:      "Should lex keywords and functions as labels inside braces",
+			input:     "foo{sum='1', rate!='2'} by",
+			wantWords: []string{"foo", "{", "sum", "=", "'1'", ",", "rate", "!=", "'2'", "}", "by", ""},
+			wantTypes: []TokenType{ID, LEFT_BRACE, ID, OPERATOR, STRING, COMMA, ID, OPERATOR, STRING, RIGHT_BRACE, AGGR_KW, EOF},
+		},
+		{
+			name:      "Should lex durations, numbers and modifiers",
+			input:     "rate(x:y[1h30m:5s]) offset -5m @ 1.5e3",
+			wantWords: []string{"rate", "(", "x:y", "[", "1h30m", ":", "5s", "]", ")", "offset", "-", "5m", "@", "1.5e3", ""},
+			wantTypes: []TokenType{FUNCTION_MATRIX_ARG, LEFT_PAREN, METRIC_ID, LEFT_BRACKET, DURATION, COLON, DURATION, RIGHT_BRACKET, RIGHT_PAREN, OFFSET_KW, ARITHMETIC, DURATION, AT_MODIFIER, NUM, EOF},
+		},
+		{
+			name:      "Should lex composed durations term by term",
+			input:     "x[5m+30s] offset (1h*2)",
+			wantWords: []string{"x", "[", "5m", "+", "30s", "]", "offset", "(", "1h", "*", "2", ")", ""},
+			wantTypes: []TokenType{ID, LEFT_BRACKET, DURATION, ARITHMETIC, DURATION, RIGHT_BRACKET, OFFSET_KW, LEFT_PAREN, DURATION, ARITHMETIC, NUM, RIGHT_PAREN, EOF},
+		},
+		{
+			name:      "Should lex aggregators by the parameter they take",
+			input:     "topk(5, count_values('v', group(x)))",
+			wantWords: []string{"topk", "(", "5", ",", "count_values", "(", "'v'", ",", "group", "(", "x", ")", ")", ")", ""},
+			wantTypes: []TokenType{AGGR_OP_SCALAR_PARAM, LEFT_PAREN, NUM, COMMA, AGGR_OP_STRING_PARAM, LEFT_PAREN, STRING, COMMA, AGGR_OP_NO_PARAM, LEFT_PAREN, ID, RIGHT_PAREN, RIGHT_PAREN, RIGHT_PAREN, EOF},
+		},
+		{
+			name:      "Should lex atan2 as an arithmetic operator",
+			input:     "foo ATAN2 atan(bar)",
+			wantWords: []string{"foo", "ATAN2", "atan", "(", "bar", ")", ""},
+			wantTypes: []TokenType{ID, ARITHMETIC, FUNCTION_VECTOR_ARG, LEFT_PAREN, ID, RIGHT_PAREN, EOF},
+		},
+		{
+			name:      "Should lex what we can't make sense of as unknown",
+			input:     "foo ! 5mx",
+			wantWords: []string{"foo", "!", "5mx", ""},
+			wantTypes: []TokenType{ID, UNKNOWN, UNKNOWN, EOF},
+		},
+		{
+			name:      "Should only lex an s after an m as part of the unit",
+			input:     "x[5ms] offset 5ss 5hs 5ds 1m30s",
+			wantWords: []string{"x", "[", "5ms", "]", "offset", "5ss", "5hs", "5ds", "1m30s", ""},
+			wantTypes: []TokenType{ID, LEFT_BRACKET, DURATION, RIGHT_BRACKET, OFFSET_KW, UNKNOWN, UNKNOWN, UNKNOWN, DURATION, EOF},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			if got := extractWords(tt.input); !reflect.DeepEqual(got.Vals(), tt.wantWords) {
 				t.Errorf("extractWords() = %v, want %v", got.Vals(), tt.wantWords)
 			}
+			if tt.wantTypes == nil {
+				return
+			}
+			var gotTypes []TokenType
+			for _, w := range extractWords(tt.input) {
+				gotTypes = append(gotTypes, w.Type)
+			}
+			if !reflect.DeepEqual(gotTypes, tt.wantTypes) {
+				t.Errorf("extractWords() types = %v, want %v", gotTypes, tt.wantTypes)
+			}
 		})
 	}
 }
+
+func TestFunctionSignatures(t *testing.T) {
+	for _, functions := range []map[string]string{scalarFunctions, vectorFunctions} {
+		for f := range functions {
+			if _, ok := functionSignatures[f]; !ok {
+				t.Errorf("function %q has no signature", f)
+			}
+			words := extractWords(f + "(")
+			if got := words[0].Type; got != functionSignatures[f] {
+				t.Errorf("extractWords(%q) lexed %v, want %v", f, got, functionSignatures[f])
+			}
+		}
+	}
+}
+
+func TestLuthorRelexesChangedSuffix(t *testing.T) {
+	query := "sum(rate(metric_name{job='api'}[5m])) by (job)"
+	var edits []string
+	// type the query out, then delete it again
+	for i := 0; i <= len(query); i++ {
+		edits = append(edits, query[:i])
+	}
+	for i := len(query); i >= 0; i-- {
+		edits = append(edits, query[:i])
+	}
+	// and edit it in the middle
+	edits = append(edits,
+		query,
+		"sum(rate(metric_name{job='apiserver'}[5m])) by (job)",
+		"sum(irate(metric_name{job='apiserver'}[5m])) by (job)",
+		"sum(irate(metric_name{job='apiserver'}[15m])) without (job)",
+	)
+
+	l := newLuthor()
+	for _, q := range edits {
+		got := l.lex(q)
+		want := newLuthor().lex(q)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("lex(%q) = %v, want %v", q, got, want)
+		}
+	}
+}
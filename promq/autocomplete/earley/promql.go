@@ -25,6 +25,7 @@ var (
 	Expression         = NewNonTerminal("expression", false)
 	AggrExpression     = NewNonTerminal("aggr-expression", false)
 	SubqueryExpression = NewNonTerminal("subquery-expression", false)
+	SubqueryRange      = NewNonTerminal("subquery-range", false)
 	UnaryExpression    = NewNonTerminal("unary-expression", false)
 	// bianry expressions
 	ScalarBinaryExpression = NewNonTerminal("scalar-binary-expression", false)
@@ -45,35 +46,79 @@ var (
 	LabelsMatchExpression = NewNonTerminal("labels-match-expression", false)
 	LabelValueExpression  = NewNonTerminal("label-value-expression", false)
 	AggrCallExpression    = NewNonTerminal("aggr-call-expression", false)
+	ScalarParamAggrCall   = NewNonTerminal("scalar-param-aggr-call-expression", false)
+	StringParamAggrCall   = NewNonTerminal("string-param-aggr-call-expression", false)
 	MetricLabelArgs       = NewNonTerminal("label-args", false)
 
+	// the label matchers of a selector without a metric name
+	SelectorLabelsMatchExpression = NewNonTerminal("selector-labels-match-expression", false)
+
 	OffsetModifier = NewNonTerminal("offset-modifier", false)
+	AtModifier     = NewNonTerminal("at-modifier", false)
+	// offset and @ modifiers can be combined, in either order
+	SelectorModifiers = NewNonTerminal("selector-modifiers", false)
+	// durations can be composed with arithmetic, i.e. [5m+30s] or offset (1h*2)
+	DurationExpression = NewNonTerminal("duration-expression", false)
 	//AggrFuncParam   = NewNonTerminal("func-param", false) // sometimes optional, but sometimes necessary
 
-	FunctionCallBody = NewNonTerminal("function-call-body", false)
-	FunctionCallArgs = NewNonTerminal("function-call-args", false)
+	// function arguments, by the type of expression a function accepts
+	ScalarFunctionArg  = NewNonTerminal("scalar-function-arg", false)
+	VectorFunctionArg  = NewNonTerminal("vector-function-arg", false)
+	MatrixFunctionArg  = NewNonTerminal("matrix-function-arg", false)
+	StringFunctionArgs = NewNonTerminal("string-function-args", false)
 
 	// Binary expressions related non-terminals:
 	BinaryOperator      = NewNonTerminal("scalar-binary-operator", false)
 	BinaryGroupModifier = NewNonTerminal("binary-group-modifier", false)
 
 	// terminals
-	Identifier               = NewTerminal(ID)                                  // this one is ambiguous
-	MetricIdentifier         = NewTerminalWithSubType(ID, METRIC_ID)            // this one is ambiguous
-	MetricLabelIdentifier    = NewTerminalWithSubType(ID, METRIC_LABEL_SUBTYPE) // this one is ambiguous
-	ScalarFunctionIdentifier = NewTerminal(FUNCTION_SCALAR_ID)
-	VectorFunctionIdentifier = NewTerminal(FUNCTION_VECTOR_ID)
-
-	AggregatorOp     = NewTerminal(AGGR_OP)
+	Identifier            = NewTerminal(ID)                                  // this one is ambiguous
+	MetricIdentifier      = NewTerminalWithSubType(ID, METRIC_ID)            // this one is ambiguous
+	MetricLabelIdentifier = NewTerminalWithSubType(ID, METRIC_LABEL_SUBTYPE) // this one is ambiguous
+
+	// function identifiers are matched by their signature, but suggested as scalar/vector functions
+	NoArgsFunctionIdentifier          = NewTerminalWithSubType(FUNCTION_NO_ARGS, FUNCTION_SCALAR_ID)
+	VectorToScalarFunctionIdentifier  = NewTerminalWithSubType(FUNCTION_VECTOR_TO_SCALAR_ARG, FUNCTION_SCALAR_ID)
+	VectorArgFunctionIdentifier       = NewTerminalWithSubType(FUNCTION_VECTOR_ARG, FUNCTION_VECTOR_ID)
+	OptionalVectorFunctionIdentifier  = NewTerminalWithSubType(FUNCTION_OPTIONAL_VECTOR_ARG, FUNCTION_VECTOR_ID)
+	MatrixArgFunctionIdentifier       = NewTerminalWithSubType(FUNCTION_MATRIX_ARG, FUNCTION_VECTOR_ID)
+	ScalarArgFunctionIdentifier       = NewTerminalWithSubType(FUNCTION_SCALAR_ARG, FUNCTION_VECTOR_ID)
+	VectorScalarFunctionIdentifier    = NewTerminalWithSubType(FUNCTION_VECTOR_SCALAR_ARGS, FUNCTION_VECTOR_ID)
+	VectorOptScalarFunctionIdentifier = NewTerminalWithSubType(FUNCTION_VECTOR_OPT_SCALAR_ARGS, FUNCTION_VECTOR_ID)
+	VectorScalar2FunctionIdentifier   = NewTerminalWithSubType(FUNCTION_VECTOR_SCALAR_2_ARGS, FUNCTION_VECTOR_ID)
+	ScalarVectorFunctionIdentifier    = NewTerminalWithSubType(FUNCTION_SCALAR_VECTOR_ARGS, FUNCTION_VECTOR_ID)
+	Scalar2VectorFunctionIdentifier   = NewTerminalWithSubType(FUNCTION_SCALAR_2_VECTOR_ARGS, FUNCTION_VECTOR_ID)
+	ScalarMatrixFunctionIdentifier    = NewTerminalWithSubType(FUNCTION_SCALAR_MATRIX_ARGS, FUNCTION_VECTOR_ID)
+	MatrixScalarFunctionIdentifier    = NewTerminalWithSubType(FUNCTION_MATRIX_SCALAR_ARGS, FUNCTION_VECTOR_ID)
+	MatrixScalar2FunctionIdentifier   = NewTerminalWithSubType(FUNCTION_MATRIX_SCALAR_2_ARGS, FUNCTION_VECTOR_ID)
+	LabelReplaceFunctionIdentifier    = NewTerminalWithSubType(FUNCTION_LABEL_REPLACE_ARGS, FUNCTION_VECTOR_ID)
+	LabelJoinFunctionIdentifier       = NewTerminalWithSubType(FUNCTION_LABEL_JOIN_ARGS, FUNCTION_VECTOR_ID)
+
+	AggregatorOp     = NewTerminalWithSubType(AGGR_OP_NO_PARAM, AGGR_OP)
 	AggregateKeyword = NewTerminal(AGGR_KW)
 	BoolKeyword      = NewTerminalWithSubType(KEYWORD, BOOL_KW)
 	OffsetKeyword    = NewTerminalWithSubType(KEYWORD, OFFSET_KW)
+	AtOperator       = NewTerminal(AT_MODIFIER)
+	AtPreprocessor   = NewTerminal(AT_PREPROCESSOR)
 	GroupKeyword     = NewTerminal(GROUP_KW)
 	GroupSide        = NewTerminal(GROUP_SIDE)
 
+	// parameterized aggregators are matched by their parameter, but suggested as aggregators
+	ScalarParamAggregatorOp = NewTerminalWithSubType(AGGR_OP_SCALAR_PARAM, AGGR_OP)
+	StringParamAggregatorOp = NewTerminalWithSubType(AGGR_OP_STRING_PARAM, AGGR_OP)
+
+	// starts a new selector, rather than adding matchers to the metric before it
+	SelectorLBrace = NewTerminalWithSubType(LEFT_BRACE, SELECTOR_LEFT_BRACE)
+
+	// quoted names, which can be any UTF-8
+	QuotedMetricIdentifier = NewTerminalWithSubType(STRING, QUOTED_METRIC_ID)
+	QuotedLabelIdentifier  = NewTerminalWithSubType(STRING, QUOTED_LABEL_ID)
+
 	Operator           = NewTerminal(OPERATOR)
 	Arithmetic         = NewTerminal(ARITHMETIC)
 	UnaryOperator      = NewTerminalWithSubType(ARITHMETIC, UNARY_OP)
+	OffsetSign         = NewTerminalWithSubType(ARITHMETIC, OFFSET_SIGN)
+	DurationOperator   = NewTerminalWithSubType(ARITHMETIC, DURATION_OP)
 	SetOperator        = NewTerminal(SET)
 	LabelMatchOperator = NewTerminalWithSubType(OPERATOR, LABELMATCH)
 	Comparision        = NewTerminalWithSubType(OPERATOR, COMPARISION)
@@ -122,20 +167,52 @@ var (
 		NewRule(VectorSelector, MetricIdentifier),
 		// 2) a vector selector can optionally have a label expression
 		NewRule(VectorSelector, MetricIdentifier, LabelsMatchExpression),
-		// 3) a metric expression can optionally have offset to get historical data
-		NewRule(VectorSelector, MetricIdentifier, OffsetModifier),
-		NewRule(VectorSelector, MetricIdentifier, LabelsMatchExpression, OffsetModifier),
+		// 3) a metric expression can optionally have offset and/or @ modifiers to get historical data
+		NewRule(VectorSelector, MetricIdentifier, SelectorModifiers),
+		NewRule(VectorSelector, MetricIdentifier, LabelsMatchExpression, SelectorModifiers),
+		// 4) or solely of label matchers, i.e. {__name__=~"apiserver_.*"}
+		NewRule(VectorSelector, SelectorLabelsMatchExpression),
+		NewRule(VectorSelector, SelectorLabelsMatchExpression, SelectorModifiers),
 
 		// matrix selector: range Vector selectors
 		// metric[5m]
-		NewRule(MatrixSelector, MetricIdentifier, LBracket, Duration, RBracket),
-		NewRule(MatrixSelector, MetricIdentifier, LabelsMatchExpression, LBracket, Duration, RBracket),
+		NewRule(MatrixSelector, MetricIdentifier, LBracket, DurationExpression, RBracket),
+		NewRule(MatrixSelector, MetricIdentifier, LabelsMatchExpression, LBracket, DurationExpression, RBracket),
 		// metric[5m] offset 3h
-		NewRule(MatrixSelector, MetricIdentifier, LBracket, Duration, RBracket, OffsetModifier),
-		NewRule(MatrixSelector, MetricIdentifier, LabelsMatchExpression, LBracket, Duration, RBracket, OffsetModifier),
+		NewRule(MatrixSelector, MetricIdentifier, LBracket, DurationExpression, RBracket, SelectorModifiers),
+		NewRule(MatrixSelector, MetricIdentifier, LabelsMatchExpression, LBracket, DurationExpression, RBracket, SelectorModifiers),
+		// {__name__=~"foo_.*"}[5m]
+		NewRule(MatrixSelector, SelectorLabelsMatchExpression, LBracket, DurationExpression, RBracket),
+		NewRule(MatrixSelector, SelectorLabelsMatchExpression, LBracket, DurationExpression, RBracket, SelectorModifiers),
+
+		// selector modifiers: each modifier may appear once, in any order
+		// metric offset 5m @ 1609746000
+		NewRule(SelectorModifiers, OffsetModifier),
+		NewRule(SelectorModifiers, AtModifier),
+		NewRule(SelectorModifiers, OffsetModifier, AtModifier),
+		NewRule(SelectorModifiers, AtModifier, OffsetModifier),
 
 		// offset modifier:
 		NewRule(OffsetModifier, OffsetKeyword, Duration),
+		// metric offset -5m
+		NewRule(OffsetModifier, OffsetKeyword, OffsetSign, Duration),
+		// composed offsets are parenthesized, otherwise metric offset 5m * 2 would be a binary expression
+		// metric offset (1h+30m)
+		NewRule(OffsetModifier, OffsetKeyword, LParen, DurationExpression, RParen),
+		NewRule(OffsetModifier, OffsetKeyword, OffsetSign, LParen, DurationExpression, RParen),
+
+		// duration expressions: durations and numbers combined with arithmetic, so long as
+		// there is a duration in there somewhere, i.e. 5m+30s, 2*1h or (1h-5m)/2
+		NewRule(DurationExpression, Duration),
+		NewRule(DurationExpression, DurationExpression, DurationOperator, Duration),
+		NewRule(DurationExpression, DurationExpression, DurationOperator, Num),
+		NewRule(DurationExpression, Num, DurationOperator, DurationExpression),
+		NewRule(DurationExpression, LParen, DurationExpression, RParen),
+
+		// @ modifier: a (possibly signed) unix timestamp, or start()/end()
+		NewRule(AtModifier, AtOperator, Num),
+		NewRule(AtModifier, AtOperator, UnaryOperator, Num),
+		NewRule(AtModifier, AtOperator, AtPreprocessor, LParen, RParen),
 
 		// AGGR EXPRESSIONS:
 		// 1) a aggregation operation expression can consist solely of a metric tokenType
@@ -149,6 +226,15 @@ var (
 		NewRule(AggrExpression, AggregatorOp, AggregateKeyword, LabelsExpression, AggrCallExpression),
 		// '(metric{label="blah"})'
 		NewRule(AggrCallExpression, LParen, VectorTypeExpression, RParen),
+		// the same, for aggregators which take a parameter, i.e. topk(5, metric) and count_values("value", metric)
+		NewRule(AggrExpression, ScalarParamAggregatorOp, ScalarParamAggrCall),
+		NewRule(AggrExpression, ScalarParamAggregatorOp, ScalarParamAggrCall, AggregateKeyword, LabelsExpression),
+		NewRule(AggrExpression, ScalarParamAggregatorOp, AggregateKeyword, LabelsExpression, ScalarParamAggrCall),
+		NewRule(ScalarParamAggrCall, LParen, ScalarFunctionArg, Comma, VectorTypeExpression, RParen),
+		NewRule(AggrExpression, StringParamAggregatorOp, StringParamAggrCall),
+		NewRule(AggrExpression, StringParamAggregatorOp, StringParamAggrCall, AggregateKeyword, LabelsExpression),
+		NewRule(AggrExpression, StringParamAggregatorOp, AggregateKeyword, LabelsExpression, StringParamAggrCall),
+		NewRule(StringParamAggrCall, LParen, Str, Comma, VectorTypeExpression, RParen),
 
 		// LABEL EXPRESSIONS:
 		NewRule(LabelsExpression, LParen, MetricLabelArgs, RParen),
@@ -161,11 +247,19 @@ var (
 		// todo(han) i.e. sum(metricname{label1="blah",label2="else"}) by (label3)
 		NewRule(MetricLabelArgs, MetricLabelArgs, Comma, MetricLabelIdentifier),
 		NewRule(MetricLabelArgs, MetricLabelIdentifier),
+		NewRule(MetricLabelArgs, MetricLabelArgs, Comma, QuotedLabelIdentifier),
+		NewRule(MetricLabelArgs, QuotedLabelIdentifier),
 
 		// {label1="blah",label2="else"}
 		NewRule(LabelsMatchExpression, LBrace, LabelValueExpression, RBrace),
+		NewRule(SelectorLabelsMatchExpression, SelectorLBrace, LabelValueExpression, RBrace),
 		NewRule(LabelValueExpression, MetricLabelIdentifier, LabelMatchOperator, Str),
 		NewRule(LabelValueExpression, LabelValueExpression, Comma, MetricLabelIdentifier, LabelMatchOperator, Str),
+		// {"my.metric", "label.name"="v"}, the quoted metric name is only allowed first
+		NewRule(SelectorLabelsMatchExpression, SelectorLBrace, QuotedMetricIdentifier, RBrace),
+		NewRule(SelectorLabelsMatchExpression, SelectorLBrace, QuotedMetricIdentifier, Comma, LabelValueExpression, RBrace),
+		NewRule(LabelValueExpression, QuotedLabelIdentifier, LabelMatchOperator, Str),
+		NewRule(LabelValueExpression, LabelValueExpression, Comma, QuotedLabelIdentifier, LabelMatchOperator, Str),
 
 		// BINARY EXPRESSIONS:
 		// Binary Operators:
@@ -190,31 +284,66 @@ var (
 		// Set operations match with all possible entries in the right vector by default.
 		NewRule(VectorBinaryExpression, VectorTypeExpression, SetOperator, GroupKeyword, LabelsExpression, VectorTypeExpression),
 
-		// binary expression can be embraced by parenthesis
-		NewRule(ScalarBinaryExpression, LParen, ScalarBinaryExpression, RParen),
-		NewRule(VectorBinaryExpression, LParen, VectorBinaryExpression, RParen),
+		// any expression can be embraced by parenthesis, i.e. '(metric) + other'
+		NewRule(ScalarTypeExpression, LParen, ScalarTypeExpression, RParen),
+		NewRule(VectorTypeExpression, LParen, VectorTypeExpression, RParen),
 		// unary exprssion inside binary expression should embraced with parenthesis
 		NewRule(ScalarBinaryExpression, LParen, UnaryOperator, ScalarTypeExpression, RParen),
 		NewRule(VectorBinaryExpression, LParen, UnaryOperator, VectorTypeExpression, RParen),
 
 		// FUNCTION EXPRESSIONS:
-		// Todo(yuchen) The input args can vary from different functions. Here I only separate the function with different return type.
-		// the functions that return vector type expression
-		NewRule(VectorFuncExpression, VectorFunctionIdentifier, FunctionCallBody),
-		NewRule(FunctionCallBody, LParen, RParen),
-		NewRule(FunctionCallBody, LParen, FunctionCallArgs, RParen),
-		NewRule(FunctionCallArgs, Expression),
-		NewRule(FunctionCallArgs, FunctionCallArgs, Comma, Expression),
-		// the functions that return scalar type expression: time() scalar(vector)
-		NewRule(ScalarFuncExpression, ScalarFunctionIdentifier, LParen, RParen),
-		NewRule(ScalarFuncExpression, ScalarFunctionIdentifier, LParen, VectorTypeExpression, RParen),
-		NewRule(ScalarFuncExpression, ScalarFunctionIdentifier, LParen, UnaryOperator, VectorTypeExpression, RParen),
+		// functions are lexed by their signature, so each function only accepts (and
+		// we only suggest) the number and types of args it actually takes.
+		// 1) function args
+		NewRule(ScalarFunctionArg, ScalarTypeExpression),
+		NewRule(ScalarFunctionArg, UnaryOperator, ScalarTypeExpression),
+		NewRule(VectorFunctionArg, VectorTypeExpression),
+		NewRule(VectorFunctionArg, UnaryOperator, VectorTypeExpression),
+		NewRule(MatrixFunctionArg, MatrixTypeExpression),
+		NewRule(StringFunctionArgs, Str),
+		NewRule(StringFunctionArgs, StringFunctionArgs, Comma, Str),
+		// 2) the functions that return vector type expression
+		// abs(v instant-vector)
+		NewRule(VectorFuncExpression, VectorArgFunctionIdentifier, LParen, VectorFunctionArg, RParen),
+		// hour(v=vector(time()) instant-vector)
+		NewRule(VectorFuncExpression, OptionalVectorFunctionIdentifier, LParen, RParen),
+		NewRule(VectorFuncExpression, OptionalVectorFunctionIdentifier, LParen, VectorFunctionArg, RParen),
+		// rate(v range-vector)
+		NewRule(VectorFuncExpression, MatrixArgFunctionIdentifier, LParen, MatrixFunctionArg, RParen),
+		// vector(s scalar)
+		NewRule(VectorFuncExpression, ScalarArgFunctionIdentifier, LParen, ScalarFunctionArg, RParen),
+		// clamp_max(v instant-vector, max scalar)
+		NewRule(VectorFuncExpression, VectorScalarFunctionIdentifier, LParen, VectorFunctionArg, Comma, ScalarFunctionArg, RParen),
+		// round(v instant-vector, to_nearest=1 scalar)
+		NewRule(VectorFuncExpression, VectorOptScalarFunctionIdentifier, LParen, VectorFunctionArg, RParen),
+		NewRule(VectorFuncExpression, VectorOptScalarFunctionIdentifier, LParen, VectorFunctionArg, Comma, ScalarFunctionArg, RParen),
+		// clamp(v instant-vector, min scalar, max scalar)
+		NewRule(VectorFuncExpression, VectorScalar2FunctionIdentifier, LParen, VectorFunctionArg, Comma, ScalarFunctionArg, Comma, ScalarFunctionArg, RParen),
+		// histogram_quantile(φ scalar, b instant-vector)
+		NewRule(VectorFuncExpression, ScalarVectorFunctionIdentifier, LParen, ScalarFunctionArg, Comma, VectorFunctionArg, RParen),
+		// histogram_fraction(lower scalar, upper scalar, b instant-vector)
+		NewRule(VectorFuncExpression, Scalar2VectorFunctionIdentifier, LParen, ScalarFunctionArg, Comma, ScalarFunctionArg, Comma, VectorFunctionArg, RParen),
+		// quantile_over_time(φ scalar, v range-vector)
+		NewRule(VectorFuncExpression, ScalarMatrixFunctionIdentifier, LParen, ScalarFunctionArg, Comma, MatrixFunctionArg, RParen),
+		// predict_linear(v range-vector, t scalar)
+		NewRule(VectorFuncExpression, MatrixScalarFunctionIdentifier, LParen, MatrixFunctionArg, Comma, ScalarFunctionArg, RParen),
+		// holt_winters(v range-vector, sf scalar, tf scalar)
+		NewRule(VectorFuncExpression, MatrixScalar2FunctionIdentifier, LParen, MatrixFunctionArg, Comma, ScalarFunctionArg, Comma, ScalarFunctionArg, RParen),
+		// label_replace(v instant-vector, dst_label string, replacement string, src_label string, regex string)
+		NewRule(VectorFuncExpression, LabelReplaceFunctionIdentifier, LParen, VectorFunctionArg, Comma, Str, Comma, Str, Comma, Str, Comma, Str, RParen),
+		// label_join(v instant-vector, dst_label string, separator string, src_label_1 string, ...)
+		NewRule(VectorFuncExpression, LabelJoinFunctionIdentifier, LParen, VectorFunctionArg, Comma, Str, Comma, Str, RParen),
+		NewRule(VectorFuncExpression, LabelJoinFunctionIdentifier, LParen, VectorFunctionArg, Comma, Str, Comma, Str, Comma, StringFunctionArgs, RParen),
+		// 3) the functions that return scalar type expression: time() scalar(vector)
+		NewRule(ScalarFuncExpression, NoArgsFunctionIdentifier, LParen, RParen),
+		NewRule(ScalarFuncExpression, VectorToScalarFunctionIdentifier, LParen, VectorFunctionArg, RParen),
 
 		// SUBQUERY EXPRESSIONS:
-		NewRule(SubqueryExpression, VectorTypeExpression, LBracket, Duration, Colon, RBracket),
-		NewRule(SubqueryExpression, VectorTypeExpression, LBracket, Duration, Colon, Duration, RBracket),
-		NewRule(SubqueryExpression, VectorTypeExpression, LBracket, Duration, Colon, RBracket, OffsetModifier),
-		NewRule(SubqueryExpression, VectorTypeExpression, LBracket, Duration, Colon, Duration, RBracket, OffsetModifier),
+		NewRule(SubqueryExpression, VectorTypeExpression, SubqueryRange),
+		NewRule(SubqueryExpression, VectorTypeExpression, SubqueryRange, SelectorModifiers),
+		// [range:] or [range:resolution]
+		NewRule(SubqueryRange, LBracket, DurationExpression, Colon, RBracket),
+		NewRule(SubqueryRange, LBracket, DurationExpression, Colon, DurationExpression, RBracket),
 
 		//UNARY EXPRESSIONS:
 		NewRule(UnaryExpression, UnaryOperator, ScalarTypeExpression),
@@ -231,6 +360,7 @@ var (
 		"stddev":       "calculate population standard deviation over dimensions",
 		"stdvar":       "calculate population standard variance over dimensions",
 		"count":        "count number of elements in the vector",
+		"group":        "all values in the resulting vector are 1",
 		"count_values": "count number of elements with the same value",
 		"bottomk":      "smallest k elements by sample value",
 		"topk":         "largest k elements by sample value",
@@ -245,6 +375,29 @@ var (
 		"offset": "allow changing the time offset for individual instant and range vectors in a query",
 	}
 
+	offsetSigns = map[string]string{
+		"-": "negative offset, moves the evaluation time forward in time",
+	}
+
+	// the arithmetic operators which can combine durations, atan2 can't
+	durationOperators = map[string]string{
+		"+": "addition",
+		"-": "subtraction",
+		"*": "multiplication",
+		"/": "division",
+		"%": "modulo",
+		"^": "power/exponentiation",
+	}
+
+	atModifier = map[string]string{
+		"@": "evaluate the selector at the given unix timestamp rather than the query evaluation time",
+	}
+
+	atPreprocessors = map[string]string{
+		"start": "start() resolves to the start of the range query, or the evaluation time of an instant query",
+		"end":   "end() resolves to the end of the range query, or the evaluation time of an instant query",
+	}
+
 	boolKeyword = map[string]string{
 		"bool": "if provided, return 0 or 1 for the value rather than filtering",
 	}
@@ -266,6 +419,8 @@ var (
 		"/": "division",
 		"%": "modulo",
 		"^": "power/exponentiation",
+		// atan2 is a keyword, but binds like the other arithmetic operators
+		"atan2": "arc tangent of the left and right operands, in radians",
 	}
 
 	unaryOperators = map[string]string{
@@ -306,27 +461,43 @@ var (
 
 	scalarFunctions = map[string]string{
 		"time":   "time() returns the time at which the expression is to be evaluated in seconds ",
+		"pi":     "pi() returns pi",
 		"scalar": "given a single-element input vector, scalar(v instant-vector) returns the sample value of that single element as a scalar.",
 	}
 
 	vectorFunctions = map[string]string{
 		"abs":                "abs(v instant-vector) returns the input vector with all sample values converted to their absolute value",
 		"absent":             "absent(v instant-vector) returns an empty vector if the vector passed to it has any elements and a 1-element vector with the value 1 if the vector passed to it has no elements",
+		"acos":               "acos(v instant-vector) calculates the arccosine of all elements in v",
+		"acosh":              "acosh(v instant-vector) calculates the inverse hyperbolic cosine of all elements in v",
+		"asin":               "asin(v instant-vector) calculates the arcsine of all elements in v",
+		"asinh":              "asinh(v instant-vector) calculates the inverse hyperbolic sine of all elements in v",
+		"atan":               "atan(v instant-vector) calculates the arctangent of all elements in v",
+		"atanh":              "atanh(v instant-vector) calculates the inverse hyperbolic tangent of all elements in v",
 		"absent_over_time":   "absent_over_time(v range-vector) returns an empty vector if the range vector passed to it has any elements and a 1-element vector with the value 1 if the range vector passed to it has no elements",
 		"avg_over_time":      "avg_over_time(v range-vector) returns the average value of all points in the specified interval",
 		"ceil":               "ceil(v instant-vector) rounds the sample values of all elements in input vector up to the nearest integer",
 		"changes":            "for each input time series, changes(v range-vector) returns the number of times its value has changed within the provided time range as an instant vector.",
+		"clamp":              "clamp(v instant-vector, min scalar, max scalar) clamps the sample values of all elements in v to have a lower limit of min and an upper limit of max",
 		"clamp_max":          "clamp_max(v instant-vector, max scalar) clamps the sample values of all elements in v to have an upper limit of max",
 		"clamp_min":          "clamp_min(v instant-vector, min scalar) clamps the sample values of all elements in v to have a lower limit of min",
+		"cos":                "cos(v instant-vector) calculates the cosine of all elements in v",
+		"cosh":               "cosh(v instant-vector) calculates the hyperbolic cosine of all elements in v",
 		"count_over_time":    "count_over_time(v range-vector) returns the count of all values in the specified interval",
 		"days_in_month":      "days_in_month(v=vector(time()) instant-vector) returns number of days in the month for each of the given times in UTC",
 		"day_of_month":       "day_of_month(v=vector(time()) instant-vector) returns the day of the month for each of the given times in UTC",
 		"day_of_week":        "day_of_week(v=vector(time()) instant-vector) returns the day of the week for each of the given times in UTC",
+		"deg":                "deg(v instant-vector) converts radians to degrees for all elements in v",
 		"delta":              "delta(v range-vector) calculates the difference between the first and last value of each time series element in a range vector v, returning an instant vector with the given deltas and equivalent labels",
 		"deriv":              "deriv(v range-vector) calculates the per-second derivative of the time series in a range vector v. deriv should only be used with gauges.",
 		"exp":                "exp(v instant-vector) calculates the exponential function for all elements in v",
 		"floor":              "floor(v instant-vector) rounds the sample values of all elements in v down to the nearest integer",
+		"histogram_count":    "histogram_count(v instant-vector) returns the count of observations stored in each native histogram in v",
+		"histogram_fraction": "histogram_fraction(lower scalar, upper scalar, b instant-vector) returns the estimated fraction of observations between lower and upper in each native histogram in b",
 		"histogram_quantile": "histogram_quantile(φ float, b instant-vector) calculates the φ-quantile (0 ≤ φ ≤ 1) from the buckets b of a histogram",
+		"histogram_stddev":   "histogram_stddev(v instant-vector) returns the estimated standard deviation of observations in each native histogram in v",
+		"histogram_stdvar":   "histogram_stdvar(v instant-vector) returns the estimated standard variance of observations in each native histogram in v",
+		"histogram_sum":      "histogram_sum(v instant-vector) returns the sum of observations stored in each native histogram in v",
 		"holt_winters":       "holt_winters(v range-vector, sf scalar, tf scalar) produces a smoothed value for time series based on the range in v",
 		"hour":               "hour(v=vector(time()) instant-vector) returns the hour of the day for each of the given times in UTC",
 		"idelta":             "idelta(v range-vector) calculates the difference between the last two samples in the range vector v, returning an instant vector with the given deltas and equivalent labels",
@@ -334,6 +505,7 @@ var (
 		"irate":              "irate(v range-vector) calculates the per-second instant rate of increase of the time series in the range vector",
 		"label_replace":      "for each timeseries in v, label_replace(v instant-vector, dst_label string, replacement string, src_label string, regex string) matches the regular expression regex against the label src_label. If it matches, then the timeseries is returned with the label dst_label replaced by the expansion of replacement.",
 		"label_join":         "for each timeseries in v, label_join(v instant-vector, dst_label string, separator string, src_label_1 string, src_label_2 string, ...) joins all the values of all the src_labels using separator and returns the timeseries with the label dst_label containing the joined value.",
+		"last_over_time":     "last_over_time(range-vector) returns the most recent point value in the specified interval",
 		"ln":                 "ln(v instant-vector) calculates the natural logarithm for all elements in v",
 		"log10":              "log10(v instant-vector) calculates the decimal logarithm for all elements in v",
 		"log2":               "log2(v instant-vector) calculates the binary logarithm for all elements in v",
@@ -342,21 +514,104 @@ var (
 		"minute":             "minute(v=vector(time()) instant-vector) returns the minute of the hour for each of the given times in UTC",
 		"month":              "month(v=vector(time()) instant-vector) returns the month of the year for each of the given times in UTC",
 		"predict_linear":     "predict_linear(v range-vector, t scalar) predicts the value of time series t seconds from now, based on the range vector v",
+		"present_over_time":  "present_over_time(range-vector) returns the value 1 for any series in the specified interval",
 		"quantile_over_time": "quantile_over_time(scalar, range-vector) returns the φ-quantile (0 ≤ φ ≤ 1) of the values in the specified interval",
+		"rad":                "rad(v instant-vector) converts degrees to radians for all elements in v",
 		"rate":               "rate(v range-vector) calculates the per-second average rate of increase of the time series in the range vector",
 		"resets":             "for each input time series, resets(v range-vector) returns the number of counter resets within the provided time range as an instant vector",
 		"round":              "round(v instant-vector, to_nearest=1 scalar) rounds the sample values of all elements in v to the nearest integer",
+		"sgn":                "sgn(v instant-vector) returns a vector with all sample values converted to their sign: 1 if v is positive, -1 if v is negative and 0 if v is equal to zero",
+		"sin":                "sin(v instant-vector) calculates the sine of all elements in v",
+		"sinh":               "sinh(v instant-vector) calculates the hyperbolic sine of all elements in v",
 		"sort":               "sort(v instant-vector) returns vector elements sorted by their sample values, in ascending order",
 		"sort_desc":          "sort(v instant-vector) returns vector elements sorted by their sample values, in descending order",
 		"sqrt":               "sqrt(v instant-vector) calculates the square root of all elements in v",
 		"stddev_over_time":   "stddev_over_time(range-vector) returns the population standard deviation of the values in the specified interval",
 		"stdvar_over_time":   "stdvar_over_time(range-vector) returns the population standard variance of the values in the specified interval",
 		"sum_over_time":      "sum_over_time(range-vector) returns the sum of all values in the specified interval",
+		"tan":                "tan(v instant-vector) calculates the tangent of all elements in v",
+		"tanh":               "tanh(v instant-vector) calculates the hyperbolic tangent of all elements in v",
 		"timestamp":          "timestamp(v instant-vector) returns the timestamp of each of the samples of the given vector as the number of seconds",
 		"vector":             "vector(s scalar) returns the scalar s as a vector with no labels",
 		"year":               "year(v=vector(time()) instant-vector) returns the year for each of the given times in UTC",
 	}
 
+	// functionSignatures classifies each of our scalarFunctions and vectorFunctions by
+	// the arguments it accepts.
+	functionSignatures = map[string]TokenType{
+		"time":               FUNCTION_NO_ARGS,
+		"pi":                 FUNCTION_NO_ARGS,
+		"scalar":             FUNCTION_VECTOR_TO_SCALAR_ARG,
+		"abs":                FUNCTION_VECTOR_ARG,
+		"absent":             FUNCTION_VECTOR_ARG,
+		"absent_over_time":   FUNCTION_MATRIX_ARG,
+		"acos":               FUNCTION_VECTOR_ARG,
+		"acosh":              FUNCTION_VECTOR_ARG,
+		"asin":               FUNCTION_VECTOR_ARG,
+		"asinh":              FUNCTION_VECTOR_ARG,
+		"atan":               FUNCTION_VECTOR_ARG,
+		"atanh":              FUNCTION_VECTOR_ARG,
+		"avg_over_time":      FUNCTION_MATRIX_ARG,
+		"ceil":               FUNCTION_VECTOR_ARG,
+		"changes":            FUNCTION_MATRIX_ARG,
+		"clamp":              FUNCTION_VECTOR_SCALAR_2_ARGS,
+		"clamp_max":          FUNCTION_VECTOR_SCALAR_ARGS,
+		"clamp_min":          FUNCTION_VECTOR_SCALAR_ARGS,
+		"cos":                FUNCTION_VECTOR_ARG,
+		"cosh":               FUNCTION_VECTOR_ARG,
+		"count_over_time":    FUNCTION_MATRIX_ARG,
+		"days_in_month":      FUNCTION_OPTIONAL_VECTOR_ARG,
+		"day_of_month":       FUNCTION_OPTIONAL_VECTOR_ARG,
+		"day_of_week":        FUNCTION_OPTIONAL_VECTOR_ARG,
+		"deg":                FUNCTION_VECTOR_ARG,
+		"delta":              FUNCTION_MATRIX_ARG,
+		"deriv":              FUNCTION_MATRIX_ARG,
+		"exp":                FUNCTION_VECTOR_ARG,
+		"floor":              FUNCTION_VECTOR_ARG,
+		"histogram_count":    FUNCTION_VECTOR_ARG,
+		"histogram_fraction": FUNCTION_SCALAR_2_VECTOR_ARGS,
+		"histogram_quantile": FUNCTION_SCALAR_VECTOR_ARGS,
+		"histogram_stddev":   FUNCTION_VECTOR_ARG,
+		"histogram_stdvar":   FUNCTION_VECTOR_ARG,
+		"histogram_sum":      FUNCTION_VECTOR_ARG,
+		"holt_winters":       FUNCTION_MATRIX_SCALAR_2_ARGS,
+		"hour":               FUNCTION_OPTIONAL_VECTOR_ARG,
+		"idelta":             FUNCTION_MATRIX_ARG,
+		"increase":           FUNCTION_MATRIX_ARG,
+		"irate":              FUNCTION_MATRIX_ARG,
+		"label_replace":      FUNCTION_LABEL_REPLACE_ARGS,
+		"label_join":         FUNCTION_LABEL_JOIN_ARGS,
+		"last_over_time":     FUNCTION_MATRIX_ARG,
+		"ln":                 FUNCTION_VECTOR_ARG,
+		"log10":              FUNCTION_VECTOR_ARG,
+		"log2":               FUNCTION_VECTOR_ARG,
+		"max_over_time":      FUNCTION_MATRIX_ARG,
+		"min_over_time":      FUNCTION_MATRIX_ARG,
+		"minute":             FUNCTION_OPTIONAL_VECTOR_ARG,
+		"month":              FUNCTION_OPTIONAL_VECTOR_ARG,
+		"predict_linear":     FUNCTION_MATRIX_SCALAR_ARGS,
+		"present_over_time":  FUNCTION_MATRIX_ARG,
+		"quantile_over_time": FUNCTION_SCALAR_MATRIX_ARGS,
+		"rad":                FUNCTION_VECTOR_ARG,
+		"rate":               FUNCTION_MATRIX_ARG,
+		"resets":             FUNCTION_MATRIX_ARG,
+		"round":              FUNCTION_VECTOR_OPT_SCALAR_ARGS,
+		"sgn":                FUNCTION_VECTOR_ARG,
+		"sin":                FUNCTION_VECTOR_ARG,
+		"sinh":               FUNCTION_VECTOR_ARG,
+		"sort":               FUNCTION_VECTOR_ARG,
+		"sort_desc":          FUNCTION_VECTOR_ARG,
+		"sqrt":               FUNCTION_VECTOR_ARG,
+		"stddev_over_time":   FUNCTION_MATRIX_ARG,
+		"stdvar_over_time":   FUNCTION_MATRIX_ARG,
+		"sum_over_time":      FUNCTION_MATRIX_ARG,
+		"tan":                FUNCTION_VECTOR_ARG,
+		"tanh":               FUNCTION_VECTOR_ARG,
+		"timestamp":          FUNCTION_VECTOR_ARG,
+		"vector":             FUNCTION_SCALAR_ARG,
+		"year":               FUNCTION_OPTIONAL_VECTOR_ARG,
+	}
+
 	tokenTypeMatching = map[TokenType]map[string]string{
 		AGGR_OP:            aggregators,
 		AGGR_KW:            aggregateKeywords,
@@ -366,6 +621,10 @@ var (
 		LABELMATCH:         labelMatchOperators,
 		UNARY_OP:           unaryOperators,
 		OFFSET_KW:          offsetKeyword,
+		OFFSET_SIGN:        offsetSigns,
+		DURATION_OP:        durationOperators,
+		AT_MODIFIER:        atModifier,
+		AT_PREPROCESSOR:    atPreprocessors,
 		BOOL_KW:            boolKeyword,
 		GROUP_SIDE:         groupSideKeywords,
 		GROUP_KW:           groupKeywords,
@@ -374,7 +633,7 @@ var (
 	}
 
 	tokenTypes = []TokenType{
-		AGGR_OP, AGGR_KW, ARITHMETIC, COMPARISION, SET, LABELMATCH, UNARY_OP, OFFSET_KW, BOOL_KW, GROUP_SIDE, GROUP_KW, FUNCTION_VECTOR_ID, FUNCTION_SCALAR_ID,
+		AGGR_OP, AGGR_KW, ARITHMETIC, COMPARISION, SET, LABELMATCH, UNARY_OP, OFFSET_KW, OFFSET_SIGN, DURATION_OP, AT_MODIFIER, AT_PREPROCESSOR, BOOL_KW, GROUP_SIDE, GROUP_KW, FUNCTION_VECTOR_ID, FUNCTION_SCALAR_ID,
 	}
 
 	tokenTypeStringSet = newStringSet(tokenTypes...)
@@ -27,12 +27,12 @@ const (
 type StateSet struct {
 	stateNo int
 	items   []*EarleyItem
-	itemSet map[uint64]bool
+	itemSet map[uint64]*EarleyItem
 }
 
 func NewStateSet() *StateSet {
 	return &StateSet{
-		itemSet: make(map[uint64]bool),
+		itemSet: make(map[uint64]*EarleyItem),
 	}
 }
 
@@ -53,19 +53,42 @@ func (s *StateSet) Length() int {
 	return len(s.itemSet)
 }
 
-// idempotent put operation
+func (s *StateSet) has(hash uint64) bool {
+	_, ok := s.itemSet[hash]
+	return ok
+}
+
+func (s *StateSet) get(hash uint64) *EarleyItem {
+	return s.itemSet[hash]
+}
+
+// reset empties the set while keeping the memory it had, so that it can be reused
+// for the next parse rather than allocated again.
+func (s *StateSet) reset() {
+	for i := range s.items {
+		s.items[i] = nil
+	}
+	s.items = s.items[:0]
+	for k := range s.itemSet {
+		delete(s.itemSet, k)
+	}
+}
+
+// idempotent put operation, though if the item was derived in a different way than the
+// one we already have, we keep track of that for reconstructing ambiguous parses
 func (s *StateSet) Add(item *EarleyItem) bool {
-	if _, ok := s.itemSet[item.badhash()]; ok {
+	if existing, ok := s.itemSet[item.badhash()]; ok {
+		existing.addDerivation(item)
 		return false
 	}
-	s.itemSet[item.badhash()] = true
+	s.itemSet[item.badhash()] = item
 	item.id.StateSetIndex = s.stateNo
 	item.id.ItemIndex = len(s.items)
 	s.items = append(s.items, item)
 	return true
 }
-func (s *StateSet) findItemsToComplete(symbol NonTerminalNode) (candidates []EarleyItem) {
-	for _, item := range s.GetStates() {
+func (s *StateSet) findItemsToComplete(symbol NonTerminalNode) (candidates []*EarleyItem) {
+	for _, item := range s.items {
 
 		if item.isCompleted() {
 			continue
@@ -17,7 +17,10 @@ limitations under the License.
 package earley
 
 import (
+	"reflect"
 	"testing"
+
+	"github.com/golang/protobuf/proto"
 )
 
 func TestEarleyItems(t *testing.T) {
@@ -55,7 +58,22 @@ func TestCompletionContext(t *testing.T) {
 		expectedMetric *string
 		expectedLabels *string
 	}{
-		//	Todo(yuchen): add test cases
+		//	Todo(yuchen): add more test cases
+		{
+			name:           "aggregation clause after expression has the aggregated metric",
+			inputString:    "sum(metric_name_one{dima='1'}) by (",
+			expectedMetric: proto.String("metric_name_one"),
+		},
+		{
+			name:           "aggregation clause has the metric of its own aggregation",
+			inputString:    "sum(metric_name_one) + sum(metric_name_two) without (",
+			expectedMetric: proto.String("metric_name_two"),
+		},
+		{
+			name:           "aggregation clause before expression has no metric",
+			inputString:    "metric_name_one + sum by (",
+			expectedMetric: nil,
+		},
 	}
 
 	for _, tc := range testCases {
@@ -71,12 +89,35 @@ func TestCompletionContext(t *testing.T) {
 				}
 			}
 		}
-		t.Errorf("Got %v, Expected metric in context :%v ",
-			safeRead(metricName),
-			safeRead(tc.expectedMetric))
+		if safeRead(metricName) != safeRead(tc.expectedMetric) {
+			t.Errorf("%v: Got %v, Expected metric in context :%v ",
+				tc.name,
+				safeRead(metricName),
+				safeRead(tc.expectedMetric))
+		}
 	}
 }
 
+func TestParseDiscardsPreviousInput(t *testing.T) {
+	query := "sum(metric_name_one) + sum(metric_name_two) by ("
+	p := NewEarleyParser(*promQLGrammar)
+	p.Parse(query)
+	// a full parse of an unrelated query should not leave stale words behind
+	p.Parse("metric_name_one + sum without (")
+	validTypes := p.GetSuggestedTokenType(extractWords(query))
+
+	for _, ct := range validTypes {
+		if ct.TokenType != METRIC_LABEL_SUBTYPE {
+			continue
+		}
+		if ct.ctx == nil || safeRead(ct.ctx.metric) != "metric_name_two" {
+			t.Errorf("Got %v, Expected metric in context :%v ", ct.ctx, "metric_name_two")
+		}
+		return
+	}
+	t.Errorf("Got %v, expected a %v suggestion", validTypes, METRIC_LABEL_SUBTYPE)
+}
+
 func TestSuggestedTypes(t *testing.T) {
 	testCases := []struct {
 		name                         string
@@ -87,14 +128,14 @@ func TestSuggestedTypes(t *testing.T) {
 			name:        "If we've consumed zero tokens, then we should suggest",
 			inputString: "blah",
 			expectedTypesFromParsePosMap: map[int][]TokenType{
-				0: {METRIC_ID, NUM, AGGR_OP, FUNCTION_SCALAR_ID, FUNCTION_VECTOR_ID, LEFT_PAREN, UNARY_OP},
+				0: {METRIC_ID, NUM, AGGR_OP, FUNCTION_SCALAR_ID, FUNCTION_VECTOR_ID, LEFT_PAREN, UNARY_OP, SELECTOR_LEFT_BRACE},
 			},
 		},
 		{
 			name:        "If we have an empty string, then we should suggest",
 			inputString: "",
 			expectedTypesFromParsePosMap: map[int][]TokenType{
-				0: {METRIC_ID, NUM, AGGR_OP, FUNCTION_SCALAR_ID, FUNCTION_VECTOR_ID, LEFT_PAREN, UNARY_OP},
+				0: {METRIC_ID, NUM, AGGR_OP, FUNCTION_SCALAR_ID, FUNCTION_VECTOR_ID, LEFT_PAREN, UNARY_OP, SELECTOR_LEFT_BRACE},
 			},
 		},
 		{
@@ -102,7 +143,7 @@ func TestSuggestedTypes(t *testing.T) {
 			inputString: "123 + 4",
 			expectedTypesFromParsePosMap: map[int][]TokenType{
 				1: {ARITHMETIC, COMPARISION, EOF},
-				2: {NUM, METRIC_ID, AGGR_OP, FUNCTION_SCALAR_ID, FUNCTION_VECTOR_ID, LEFT_PAREN},
+				2: {NUM, METRIC_ID, AGGR_OP, FUNCTION_SCALAR_ID, FUNCTION_VECTOR_ID, LEFT_PAREN, SELECTOR_LEFT_BRACE},
 				3: {EOF, ARITHMETIC, COMPARISION},
 			},
 		},
@@ -110,9 +151,9 @@ func TestSuggestedTypes(t *testing.T) {
 			name:        "Binary Expression - with unary expression",
 			inputString: "123 + (-4)",
 			expectedTypesFromParsePosMap: map[int][]TokenType{
-				2: {NUM, METRIC_ID, AGGR_OP, FUNCTION_SCALAR_ID, FUNCTION_VECTOR_ID, LEFT_PAREN},
-				3: {UNARY_OP, NUM, METRIC_ID, AGGR_OP, FUNCTION_SCALAR_ID, FUNCTION_VECTOR_ID, LEFT_PAREN},
-				4: {NUM, METRIC_ID, AGGR_OP, FUNCTION_SCALAR_ID, FUNCTION_VECTOR_ID, LEFT_PAREN},
+				2: {NUM, METRIC_ID, AGGR_OP, FUNCTION_SCALAR_ID, FUNCTION_VECTOR_ID, LEFT_PAREN, SELECTOR_LEFT_BRACE},
+				3: {UNARY_OP, NUM, METRIC_ID, AGGR_OP, FUNCTION_SCALAR_ID, FUNCTION_VECTOR_ID, LEFT_PAREN, SELECTOR_LEFT_BRACE},
+				4: {NUM, METRIC_ID, AGGR_OP, FUNCTION_SCALAR_ID, FUNCTION_VECTOR_ID, LEFT_PAREN, SELECTOR_LEFT_BRACE},
 				5: {RIGHT_PAREN, COMPARISION, ARITHMETIC},
 				6: {EOF, ARITHMETIC, COMPARISION},
 			},
@@ -122,10 +163,10 @@ func TestSuggestedTypes(t *testing.T) {
 			inputString: "123 + 4 <= bool 10",
 			expectedTypesFromParsePosMap: map[int][]TokenType{
 				1: {ARITHMETIC, COMPARISION, EOF},
-				2: {NUM, METRIC_ID, AGGR_OP, FUNCTION_SCALAR_ID, FUNCTION_VECTOR_ID, LEFT_PAREN},
+				2: {NUM, METRIC_ID, AGGR_OP, FUNCTION_SCALAR_ID, FUNCTION_VECTOR_ID, LEFT_PAREN, SELECTOR_LEFT_BRACE},
 				3: {EOF, ARITHMETIC, COMPARISION},
-				4: {BOOL_KW, NUM, FUNCTION_VECTOR_ID, FUNCTION_SCALAR_ID, AGGR_OP, METRIC_ID, LEFT_PAREN},
-				5: {NUM, METRIC_ID, AGGR_OP, FUNCTION_SCALAR_ID, FUNCTION_VECTOR_ID, LEFT_PAREN},
+				4: {BOOL_KW, NUM, FUNCTION_VECTOR_ID, FUNCTION_SCALAR_ID, AGGR_OP, METRIC_ID, LEFT_PAREN, SELECTOR_LEFT_BRACE},
+				5: {NUM, METRIC_ID, AGGR_OP, FUNCTION_SCALAR_ID, FUNCTION_VECTOR_ID, LEFT_PAREN, SELECTOR_LEFT_BRACE},
 			},
 		},
 		{
@@ -139,77 +180,86 @@ func TestSuggestedTypes(t *testing.T) {
 			name:        "Binary Expression - vector binary with set operation",
 			inputString: "foo and bar",
 			expectedTypesFromParsePosMap: map[int][]TokenType{
-				1: {ARITHMETIC, COMPARISION, SET, OFFSET_KW, LEFT_BRACKET, LEFT_BRACE, EOF},
-				2: {NUM, METRIC_ID, AGGR_OP, FUNCTION_SCALAR_ID, FUNCTION_VECTOR_ID, GROUP_KW, LEFT_PAREN},
-				3: {OFFSET_KW, LEFT_BRACE, LEFT_BRACKET, SET, COMPARISION, ARITHMETIC, EOF},
+				1: {ARITHMETIC, COMPARISION, SET, OFFSET_KW, AT_MODIFIER, LEFT_BRACKET, LEFT_BRACE, EOF},
+				2: {NUM, METRIC_ID, AGGR_OP, FUNCTION_SCALAR_ID, FUNCTION_VECTOR_ID, GROUP_KW, LEFT_PAREN, SELECTOR_LEFT_BRACE},
+				3: {OFFSET_KW, AT_MODIFIER, LEFT_BRACE, LEFT_BRACKET, SET, COMPARISION, ARITHMETIC, EOF},
 			},
 		},
 		{
 			name:        "Binary Expression - one_to_one vector match with arithmetic operator",
 			inputString: "foo * on(test,) bar",
 			expectedTypesFromParsePosMap: map[int][]TokenType{
-				2: {NUM, METRIC_ID, AGGR_OP, FUNCTION_SCALAR_ID, FUNCTION_VECTOR_ID, GROUP_KW, LEFT_PAREN},
+				2: {NUM, METRIC_ID, AGGR_OP, FUNCTION_SCALAR_ID, FUNCTION_VECTOR_ID, GROUP_KW, LEFT_PAREN, SELECTOR_LEFT_BRACE},
 				3: {LEFT_PAREN},
-				4: {RIGHT_PAREN, METRIC_LABEL_SUBTYPE},
+				4: {RIGHT_PAREN, METRIC_LABEL_SUBTYPE, QUOTED_LABEL_ID},
 				5: {COMMA, RIGHT_PAREN},
-				6: {RIGHT_PAREN, METRIC_LABEL_SUBTYPE},
-				7: {GROUP_SIDE, NUM, METRIC_ID, FUNCTION_VECTOR_ID, FUNCTION_SCALAR_ID, AGGR_OP, LEFT_PAREN},
-				8: {SET, OFFSET_KW, LEFT_BRACKET, LEFT_BRACE, COMPARISION, ARITHMETIC, EOF},
+				6: {RIGHT_PAREN, METRIC_LABEL_SUBTYPE, QUOTED_LABEL_ID},
+				7: {GROUP_SIDE, NUM, METRIC_ID, FUNCTION_VECTOR_ID, FUNCTION_SCALAR_ID, AGGR_OP, LEFT_PAREN, SELECTOR_LEFT_BRACE},
+				8: {SET, OFFSET_KW, AT_MODIFIER, LEFT_BRACKET, LEFT_BRACE, COMPARISION, ARITHMETIC, EOF},
 			},
 		},
 		{
 			name:        "Binary Expression - one_to_one vector match with set operator",
 			inputString: "foo and on(test,) bar",
 			expectedTypesFromParsePosMap: map[int][]TokenType{
-				7: {NUM, METRIC_ID, FUNCTION_VECTOR_ID, FUNCTION_SCALAR_ID, AGGR_OP, LEFT_PAREN},
-				8: {SET, OFFSET_KW, LEFT_BRACE, LEFT_BRACKET, COMPARISION, ARITHMETIC, EOF},
+				7: {NUM, METRIC_ID, FUNCTION_VECTOR_ID, FUNCTION_SCALAR_ID, AGGR_OP, LEFT_PAREN, SELECTOR_LEFT_BRACE},
+				8: {SET, OFFSET_KW, AT_MODIFIER, LEFT_BRACE, LEFT_BRACKET, COMPARISION, ARITHMETIC, EOF},
 			},
 		},
 		{
 			name:        "Binary Expression - one_to_many vector match",
 			inputString: "foo / on(test,blub) group_left (bar,) bar",
 			expectedTypesFromParsePosMap: map[int][]TokenType{
-				8:  {GROUP_SIDE, NUM, METRIC_ID, FUNCTION_VECTOR_ID, FUNCTION_SCALAR_ID, AGGR_OP, LEFT_PAREN},
-				9:  {LEFT_PAREN, NUM, METRIC_ID, FUNCTION_VECTOR_ID, FUNCTION_SCALAR_ID, AGGR_OP},
-				10: {METRIC_LABEL_SUBTYPE, RIGHT_PAREN, NUM, METRIC_ID, LEFT_PAREN, FUNCTION_VECTOR_ID, FUNCTION_SCALAR_ID, AGGR_OP, UNARY_OP},
-				11: {COMMA, RIGHT_PAREN, OFFSET_KW, COMPARISION, ARITHMETIC, LEFT_BRACE, SET},
-				12: {METRIC_LABEL_SUBTYPE, RIGHT_PAREN},
-				13: {NUM, METRIC_ID, FUNCTION_VECTOR_ID, FUNCTION_SCALAR_ID, AGGR_OP, LEFT_PAREN},
-				14: {SET, OFFSET_KW, LEFT_BRACKET, LEFT_BRACE, COMPARISION, ARITHMETIC, EOF},
+				8:  {GROUP_SIDE, NUM, METRIC_ID, FUNCTION_VECTOR_ID, FUNCTION_SCALAR_ID, AGGR_OP, LEFT_PAREN, SELECTOR_LEFT_BRACE},
+				9:  {LEFT_PAREN, NUM, METRIC_ID, FUNCTION_VECTOR_ID, FUNCTION_SCALAR_ID, AGGR_OP, SELECTOR_LEFT_BRACE},
+				10: {METRIC_LABEL_SUBTYPE, RIGHT_PAREN, NUM, METRIC_ID, LEFT_PAREN, FUNCTION_VECTOR_ID, FUNCTION_SCALAR_ID, AGGR_OP, UNARY_OP, SELECTOR_LEFT_BRACE, QUOTED_LABEL_ID},
+				11: {COMMA, RIGHT_PAREN, OFFSET_KW, AT_MODIFIER, COMPARISION, ARITHMETIC, LEFT_BRACE, SET},
+				12: {METRIC_LABEL_SUBTYPE, RIGHT_PAREN, QUOTED_LABEL_ID},
+				13: {NUM, METRIC_ID, FUNCTION_VECTOR_ID, FUNCTION_SCALAR_ID, AGGR_OP, LEFT_PAREN, SELECTOR_LEFT_BRACE},
+				14: {SET, OFFSET_KW, AT_MODIFIER, LEFT_BRACKET, LEFT_BRACE, COMPARISION, ARITHMETIC, EOF},
 			},
 		},
 		{
 			name:        "Metric Expression - with labels",
 			inputString: "metric_name{label1='foo', label2='bar'}",
 			expectedTypesFromParsePosMap: map[int][]TokenType{
-				1:  {EOF, LEFT_BRACE, OFFSET_KW, LEFT_BRACKET, COMPARISION, ARITHMETIC, SET},
-				2:  {METRIC_LABEL_SUBTYPE},
+				1:  {EOF, LEFT_BRACE, OFFSET_KW, AT_MODIFIER, LEFT_BRACKET, COMPARISION, ARITHMETIC, SET},
+				2:  {METRIC_LABEL_SUBTYPE, QUOTED_LABEL_ID},
 				3:  {LABELMATCH},
 				4:  {STRING},
 				5:  {RIGHT_BRACE, COMMA},
-				6:  {METRIC_LABEL_SUBTYPE},
-				10: {EOF, OFFSET_KW, LEFT_BRACKET, COMPARISION, ARITHMETIC, SET},
+				6:  {METRIC_LABEL_SUBTYPE, QUOTED_LABEL_ID},
+				10: {EOF, OFFSET_KW, AT_MODIFIER, LEFT_BRACKET, COMPARISION, ARITHMETIC, SET},
 			},
 		},
 		{
 			name:        "Metric Expression - metric name contains `:`",
 			inputString: "metric:name{label1='foo', label2='bar'}",
 			expectedTypesFromParsePosMap: map[int][]TokenType{
-				1:  {EOF, LEFT_BRACE, OFFSET_KW, LEFT_BRACKET, COMPARISION, ARITHMETIC, SET},
-				2:  {METRIC_LABEL_SUBTYPE},
+				1:  {EOF, LEFT_BRACE, OFFSET_KW, AT_MODIFIER, LEFT_BRACKET, COMPARISION, ARITHMETIC, SET},
+				2:  {METRIC_LABEL_SUBTYPE, QUOTED_LABEL_ID},
 				3:  {LABELMATCH},
 				4:  {STRING},
 				5:  {RIGHT_BRACE, COMMA},
-				6:  {METRIC_LABEL_SUBTYPE},
-				10: {EOF, OFFSET_KW, LEFT_BRACKET, COMPARISION, ARITHMETIC, SET},
+				6:  {METRIC_LABEL_SUBTYPE, QUOTED_LABEL_ID},
+				10: {EOF, OFFSET_KW, AT_MODIFIER, LEFT_BRACKET, COMPARISION, ARITHMETIC, SET},
 			},
 		},
 		{
 			name:        "Metric Expression - with offset",
 			inputString: "metric_name offset 5m",
 			expectedTypesFromParsePosMap: map[int][]TokenType{
-				2: {DURATION},
-				3: {EOF, COMPARISION, ARITHMETIC, LEFT_BRACKET, SET},
+				2: {DURATION, OFFSET_SIGN},
+				3: {EOF, AT_MODIFIER, COMPARISION, ARITHMETIC, LEFT_BRACKET, SET},
+			},
+		},
+		{
+			name:        "Metric Expression - with negative offset",
+			inputString: "metric_name offset -5m",
+			expectedTypesFromParsePosMap: map[int][]TokenType{
+				2: {DURATION, OFFSET_SIGN},
+				3: {DURATION},
+				4: {EOF, AT_MODIFIER, COMPARISION, ARITHMETIC, LEFT_BRACKET, SET},
 			},
 		},
 		{
@@ -218,7 +268,7 @@ func TestSuggestedTypes(t *testing.T) {
 			expectedTypesFromParsePosMap: map[int][]TokenType{
 				2: {DURATION},
 				3: {RIGHT_BRACKET, COLON},
-				4: {EOF, OFFSET_KW},
+				4: {EOF, OFFSET_KW, AT_MODIFIER},
 			},
 		},
 		{
@@ -226,8 +276,8 @@ func TestSuggestedTypes(t *testing.T) {
 			inputString: "sum(metric_name)",
 			expectedTypesFromParsePosMap: map[int][]TokenType{
 				1: {AGGR_KW, LEFT_PAREN},
-				2: {METRIC_ID, NUM, FUNCTION_VECTOR_ID, FUNCTION_SCALAR_ID, AGGR_OP, LEFT_PAREN},
-				3: {RIGHT_PAREN, LEFT_BRACE, OFFSET_KW, COMPARISION, ARITHMETIC, SET},
+				2: {METRIC_ID, NUM, FUNCTION_VECTOR_ID, FUNCTION_SCALAR_ID, AGGR_OP, LEFT_PAREN, SELECTOR_LEFT_BRACE},
+				3: {RIGHT_PAREN, LEFT_BRACE, OFFSET_KW, AT_MODIFIER, COMPARISION, ARITHMETIC, SET},
 				4: {AGGR_KW, EOF, COMPARISION, ARITHMETIC, LEFT_BRACKET, SET},
 			},
 		},
@@ -237,23 +287,23 @@ func TestSuggestedTypes(t *testing.T) {
 			expectedTypesFromParsePosMap: map[int][]TokenType{
 				1: {AGGR_KW, LEFT_PAREN},
 				2: {LEFT_PAREN},
-				3: {RIGHT_PAREN, METRIC_LABEL_SUBTYPE},
+				3: {RIGHT_PAREN, METRIC_LABEL_SUBTYPE, QUOTED_LABEL_ID},
 				4: {RIGHT_PAREN, COMMA},
-				5: {METRIC_LABEL_SUBTYPE, RIGHT_PAREN},
+				5: {METRIC_LABEL_SUBTYPE, RIGHT_PAREN, QUOTED_LABEL_ID},
 				7: {LEFT_PAREN},
-				8: {METRIC_ID, NUM, FUNCTION_VECTOR_ID, FUNCTION_SCALAR_ID, AGGR_OP, LEFT_PAREN},
+				8: {METRIC_ID, NUM, FUNCTION_VECTOR_ID, FUNCTION_SCALAR_ID, AGGR_OP, LEFT_PAREN, SELECTOR_LEFT_BRACE},
 			},
 		},
 		{
 			name:        "Aggregation expression - multiple label matchers",
 			inputString: "sum(metricname{label1='foo', label2='bar'})",
 			expectedTypesFromParsePosMap: map[int][]TokenType{
-				4:  {METRIC_LABEL_SUBTYPE},
+				4:  {METRIC_LABEL_SUBTYPE, QUOTED_LABEL_ID},
 				5:  {LABELMATCH},
 				6:  {STRING},
 				7:  {RIGHT_BRACE, COMMA},
-				8:  {METRIC_LABEL_SUBTYPE},
-				12: {RIGHT_PAREN, OFFSET_KW, ARITHMETIC, COMPARISION, SET},
+				8:  {METRIC_LABEL_SUBTYPE, QUOTED_LABEL_ID},
+				12: {RIGHT_PAREN, OFFSET_KW, AT_MODIFIER, ARITHMETIC, COMPARISION, SET},
 				13: {AGGR_KW, EOF, COMPARISION, ARITHMETIC, LEFT_BRACKET, SET},
 			},
 		},
@@ -262,17 +312,17 @@ func TestSuggestedTypes(t *testing.T) {
 			inputString: "sum(metricname{label1='foo', label2='bar'}) by (label1, label2)",
 			expectedTypesFromParsePosMap: map[int][]TokenType{
 				14: {LEFT_PAREN},
-				15: {RIGHT_PAREN, METRIC_LABEL_SUBTYPE},
+				15: {RIGHT_PAREN, METRIC_LABEL_SUBTYPE, QUOTED_LABEL_ID},
 				16: {RIGHT_PAREN, COMMA},
-				17: {METRIC_LABEL_SUBTYPE, RIGHT_PAREN},
+				17: {METRIC_LABEL_SUBTYPE, RIGHT_PAREN, QUOTED_LABEL_ID},
 			},
 		},
 		{
 			name:        "Function expression - scalar function",
 			inputString: "scalar(metricname)",
 			expectedTypesFromParsePosMap: map[int][]TokenType{
-				2: {RIGHT_PAREN, NUM, METRIC_ID, FUNCTION_VECTOR_ID, FUNCTION_SCALAR_ID, AGGR_OP, LEFT_PAREN, UNARY_OP},
-				3: {OFFSET_KW, RIGHT_PAREN, LEFT_BRACE, COMPARISION, ARITHMETIC, SET},
+				2: {NUM, METRIC_ID, FUNCTION_VECTOR_ID, FUNCTION_SCALAR_ID, AGGR_OP, LEFT_PAREN, UNARY_OP, SELECTOR_LEFT_BRACE},
+				3: {OFFSET_KW, AT_MODIFIER, RIGHT_PAREN, LEFT_BRACE, COMPARISION, ARITHMETIC, SET},
 				4: {EOF, ARITHMETIC, COMPARISION},
 			},
 		},
@@ -281,26 +331,47 @@ func TestSuggestedTypes(t *testing.T) {
 			inputString: "floor(metricname{foo!='bar'})",
 			expectedTypesFromParsePosMap: map[int][]TokenType{
 				1: {LEFT_PAREN},
-				8: {RIGHT_PAREN, COMMA, OFFSET_KW, LEFT_BRACKET, COMPARISION, ARITHMETIC, SET},
+				8: {RIGHT_PAREN, OFFSET_KW, AT_MODIFIER, COMPARISION, ARITHMETIC, SET},
 				9: {EOF, LEFT_BRACKET, COMPARISION, ARITHMETIC, SET},
 			},
 		},
 		{
 			name:        "Function expression - have aggregation expression as arg",
-			inputString: "vector(sum(metricname{foo!='bar'}))",
+			inputString: "abs(sum(metricname{foo!='bar'}))",
 			expectedTypesFromParsePosMap: map[int][]TokenType{
-				10: {RIGHT_PAREN, OFFSET_KW, COMPARISION, ARITHMETIC, SET},
-				11: {RIGHT_PAREN, COMMA, AGGR_KW, COMPARISION, ARITHMETIC, LEFT_BRACKET, SET},
+				10: {RIGHT_PAREN, OFFSET_KW, AT_MODIFIER, COMPARISION, ARITHMETIC, SET},
+				11: {RIGHT_PAREN, AGGR_KW, COMPARISION, ARITHMETIC, SET},
 			},
 		},
 		{
 			name:        "Function expression - have multiple args",
 			inputString: "round(metricname, -5)",
 			expectedTypesFromParsePosMap: map[int][]TokenType{
-				3: {RIGHT_PAREN, COMMA, OFFSET_KW, LEFT_BRACKET, LEFT_BRACE, COMPARISION, ARITHMETIC, SET},
-				4: {METRIC_ID, NUM, AGGR_OP, FUNCTION_VECTOR_ID, FUNCTION_SCALAR_ID, LEFT_PAREN, UNARY_OP},
-				5: {METRIC_ID, NUM, AGGR_OP, FUNCTION_VECTOR_ID, FUNCTION_SCALAR_ID, LEFT_PAREN},
-				6: {RIGHT_PAREN, COMMA, COMPARISION, ARITHMETIC},
+				3: {RIGHT_PAREN, COMMA, OFFSET_KW, AT_MODIFIER, LEFT_BRACE, COMPARISION, ARITHMETIC, SET},
+				// the second arg of round is a scalar
+				4: {NUM, FUNCTION_SCALAR_ID, LEFT_PAREN, UNARY_OP},
+				5: {NUM, FUNCTION_SCALAR_ID, LEFT_PAREN},
+				6: {RIGHT_PAREN, COMPARISION, ARITHMETIC},
+			},
+		},
+		{
+			name:        "Function expression - scalar arg before vector arg",
+			inputString: "histogram_quantile(0.9, rate(metricname[5m]))",
+			expectedTypesFromParsePosMap: map[int][]TokenType{
+				2:  {NUM, FUNCTION_SCALAR_ID, LEFT_PAREN, UNARY_OP},
+				3:  {COMMA, COMPARISION, ARITHMETIC},
+				4:  {METRIC_ID, NUM, AGGR_OP, FUNCTION_VECTOR_ID, FUNCTION_SCALAR_ID, LEFT_PAREN, UNARY_OP, SELECTOR_LEFT_BRACE},
+				7:  {LEFT_BRACKET, LEFT_BRACE, OFFSET_KW, AT_MODIFIER, COMPARISION, ARITHMETIC, SET},
+				11: {RIGHT_PAREN, COMPARISION, ARITHMETIC, SET},
+				12: {EOF, LEFT_BRACKET, COMPARISION, ARITHMETIC, SET},
+			},
+		},
+		{
+			name:        "Function expression - function without args",
+			inputString: "time()",
+			expectedTypesFromParsePosMap: map[int][]TokenType{
+				2: {RIGHT_PAREN},
+				3: {EOF, ARITHMETIC, COMPARISION},
 			},
 		},
 		{
@@ -308,21 +379,21 @@ func TestSuggestedTypes(t *testing.T) {
 			inputString: "ceil(abs(metricname{foo!='bar'}))",
 			expectedTypesFromParsePosMap: map[int][]TokenType{
 				3:  {LEFT_PAREN},
-				4:  {RIGHT_PAREN, METRIC_ID, NUM, AGGR_OP, FUNCTION_SCALAR_ID, FUNCTION_VECTOR_ID, LEFT_PAREN, UNARY_OP},
-				10: {RIGHT_PAREN, COMMA, OFFSET_KW, LEFT_BRACKET, COMPARISION, ARITHMETIC, SET},
-				11: {RIGHT_PAREN, COMMA, LEFT_BRACKET, COMPARISION, ARITHMETIC, SET},
+				4:  {METRIC_ID, NUM, AGGR_OP, FUNCTION_SCALAR_ID, FUNCTION_VECTOR_ID, LEFT_PAREN, UNARY_OP, SELECTOR_LEFT_BRACE},
+				10: {RIGHT_PAREN, OFFSET_KW, AT_MODIFIER, COMPARISION, ARITHMETIC, SET},
+				11: {RIGHT_PAREN, COMPARISION, ARITHMETIC, SET},
 			},
 		},
 		{
 			name:        "Subquery expression - expr is vectorSelector",
 			inputString: "metricname{foo='bar'}[10m:6s]",
 			expectedTypesFromParsePosMap: map[int][]TokenType{
-				6:  {EOF, OFFSET_KW, LEFT_BRACKET, COMPARISION, ARITHMETIC, SET},
+				6:  {EOF, OFFSET_KW, AT_MODIFIER, LEFT_BRACKET, COMPARISION, ARITHMETIC, SET},
 				7:  {DURATION},
 				8:  {COLON, RIGHT_BRACKET},
 				9:  {DURATION, RIGHT_BRACKET},
 				10: {RIGHT_BRACKET},
-				11: {EOF, OFFSET_KW},
+				11: {EOF, OFFSET_KW, AT_MODIFIER},
 			},
 		},
 		{
@@ -334,17 +405,27 @@ func TestSuggestedTypes(t *testing.T) {
 				14: {COLON},
 				15: {DURATION, RIGHT_BRACKET},
 				16: {RIGHT_BRACKET},
-				17: {EOF, OFFSET_KW},
+				17: {EOF, OFFSET_KW, AT_MODIFIER},
+			},
+		},
+		{
+			name:        "Subquery expression - with modifiers",
+			inputString: "metricname[5m:30s] @ end() offset 1m",
+			expectedTypesFromParsePosMap: map[int][]TokenType{
+				5:  {RIGHT_BRACKET},
+				6:  {EOF, OFFSET_KW, AT_MODIFIER},
+				10: {EOF, OFFSET_KW},
+				12: {EOF},
 			},
 		},
 		{
 			name:        "Parentheses expression - number arithmetic",
 			inputString: "1 + 2/(3*1)",
 			expectedTypesFromParsePosMap: map[int][]TokenType{
-				4: {NUM, METRIC_ID, AGGR_OP, FUNCTION_SCALAR_ID, FUNCTION_VECTOR_ID, LEFT_PAREN},
-				5: {NUM, METRIC_ID, AGGR_OP, FUNCTION_SCALAR_ID, FUNCTION_VECTOR_ID, LEFT_PAREN, UNARY_OP},
-				6: {COMPARISION, ARITHMETIC},
-				7: {NUM, METRIC_ID, AGGR_OP, FUNCTION_SCALAR_ID, FUNCTION_VECTOR_ID, LEFT_PAREN},
+				4: {NUM, METRIC_ID, AGGR_OP, FUNCTION_SCALAR_ID, FUNCTION_VECTOR_ID, LEFT_PAREN, SELECTOR_LEFT_BRACE},
+				5: {NUM, METRIC_ID, AGGR_OP, FUNCTION_SCALAR_ID, FUNCTION_VECTOR_ID, LEFT_PAREN, UNARY_OP, SELECTOR_LEFT_BRACE},
+				6: {RIGHT_PAREN, COMPARISION, ARITHMETIC},
+				7: {NUM, METRIC_ID, AGGR_OP, FUNCTION_SCALAR_ID, FUNCTION_VECTOR_ID, LEFT_PAREN, SELECTOR_LEFT_BRACE},
 				8: {RIGHT_PAREN, ARITHMETIC, COMPARISION},
 				9: {COMPARISION, ARITHMETIC, EOF},
 			},
@@ -353,27 +434,27 @@ func TestSuggestedTypes(t *testing.T) {
 			name:        "Parentheses expression - matrix type",
 			inputString: "(foo + bar{nm='val'})[5m:] offset 10m",
 			expectedTypesFromParsePosMap: map[int][]TokenType{
-				9:  {RIGHT_PAREN, OFFSET_KW, ARITHMETIC, COMPARISION, SET},
+				9:  {RIGHT_PAREN, OFFSET_KW, AT_MODIFIER, ARITHMETIC, COMPARISION, SET},
 				10: {LEFT_BRACKET, ARITHMETIC, COMPARISION, SET, EOF},
 				11: {DURATION},
 				12: {COLON},
 				13: {RIGHT_BRACKET, DURATION},
-				14: {EOF, OFFSET_KW},
-				15: {DURATION},
-				16: {EOF},
+				14: {EOF, OFFSET_KW, AT_MODIFIER},
+				15: {DURATION, OFFSET_SIGN},
+				16: {EOF, AT_MODIFIER},
 			},
 		},
 		{
 			name:        "Parentheses expression - nested parentheses",
 			inputString: "((foo + bar{nm='val'}) + metric_name) + 1",
 			expectedTypesFromParsePosMap: map[int][]TokenType{
-				0:  {METRIC_ID, NUM, AGGR_OP, FUNCTION_SCALAR_ID, FUNCTION_VECTOR_ID, LEFT_PAREN, UNARY_OP},
-				1:  {METRIC_ID, NUM, AGGR_OP, FUNCTION_SCALAR_ID, FUNCTION_VECTOR_ID, LEFT_PAREN, UNARY_OP},
+				0:  {METRIC_ID, NUM, AGGR_OP, FUNCTION_SCALAR_ID, FUNCTION_VECTOR_ID, LEFT_PAREN, UNARY_OP, SELECTOR_LEFT_BRACE},
+				1:  {METRIC_ID, NUM, AGGR_OP, FUNCTION_SCALAR_ID, FUNCTION_VECTOR_ID, LEFT_PAREN, UNARY_OP, SELECTOR_LEFT_BRACE},
 				11: {RIGHT_PAREN, SET, ARITHMETIC, COMPARISION},
-				12: {METRIC_ID, NUM, AGGR_OP, FUNCTION_SCALAR_ID, FUNCTION_VECTOR_ID, LEFT_PAREN, GROUP_KW},
-				13: {OFFSET_KW, LEFT_BRACE, COMPARISION, SET, ARITHMETIC, RIGHT_PAREN},
+				12: {METRIC_ID, NUM, AGGR_OP, FUNCTION_SCALAR_ID, FUNCTION_VECTOR_ID, LEFT_PAREN, GROUP_KW, SELECTOR_LEFT_BRACE},
+				13: {OFFSET_KW, AT_MODIFIER, LEFT_BRACE, COMPARISION, SET, ARITHMETIC, RIGHT_PAREN},
 				14: {EOF, LEFT_BRACKET, COMPARISION, SET, ARITHMETIC},
-				15: {METRIC_ID, NUM, AGGR_OP, FUNCTION_SCALAR_ID, FUNCTION_VECTOR_ID, LEFT_PAREN, GROUP_KW},
+				15: {METRIC_ID, NUM, AGGR_OP, FUNCTION_SCALAR_ID, FUNCTION_VECTOR_ID, LEFT_PAREN, GROUP_KW, SELECTOR_LEFT_BRACE},
 				16: {EOF, COMPARISION, SET, ARITHMETIC, LEFT_BRACKET},
 			},
 		},
@@ -381,12 +462,12 @@ func TestSuggestedTypes(t *testing.T) {
 			name:        "Unary expression - number",
 			inputString: "-1 + 2 * 5",
 			expectedTypesFromParsePosMap: map[int][]TokenType{
-				0: {METRIC_ID, NUM, AGGR_OP, FUNCTION_SCALAR_ID, FUNCTION_VECTOR_ID, LEFT_PAREN, UNARY_OP},
-				1: {METRIC_ID, NUM, AGGR_OP, FUNCTION_SCALAR_ID, FUNCTION_VECTOR_ID, LEFT_PAREN},
+				0: {METRIC_ID, NUM, AGGR_OP, FUNCTION_SCALAR_ID, FUNCTION_VECTOR_ID, LEFT_PAREN, UNARY_OP, SELECTOR_LEFT_BRACE},
+				1: {METRIC_ID, NUM, AGGR_OP, FUNCTION_SCALAR_ID, FUNCTION_VECTOR_ID, LEFT_PAREN, SELECTOR_LEFT_BRACE},
 				2: {EOF, ARITHMETIC, COMPARISION},
-				3: {METRIC_ID, NUM, AGGR_OP, FUNCTION_SCALAR_ID, FUNCTION_VECTOR_ID, LEFT_PAREN},
+				3: {METRIC_ID, NUM, AGGR_OP, FUNCTION_SCALAR_ID, FUNCTION_VECTOR_ID, LEFT_PAREN, SELECTOR_LEFT_BRACE},
 				4: {ARITHMETIC, COMPARISION, EOF},
-				5: {METRIC_ID, NUM, AGGR_OP, FUNCTION_SCALAR_ID, FUNCTION_VECTOR_ID, LEFT_PAREN},
+				5: {METRIC_ID, NUM, AGGR_OP, FUNCTION_SCALAR_ID, FUNCTION_VECTOR_ID, LEFT_PAREN, SELECTOR_LEFT_BRACE},
 				6: {ARITHMETIC, COMPARISION, EOF},
 			},
 		},
@@ -394,9 +475,9 @@ func TestSuggestedTypes(t *testing.T) {
 			name:        "Unary expression - metrics",
 			inputString: "-foo",
 			expectedTypesFromParsePosMap: map[int][]TokenType{
-				0: {METRIC_ID, NUM, AGGR_OP, FUNCTION_SCALAR_ID, FUNCTION_VECTOR_ID, LEFT_PAREN, UNARY_OP},
-				1: {METRIC_ID, NUM, AGGR_OP, FUNCTION_SCALAR_ID, FUNCTION_VECTOR_ID, LEFT_PAREN},
-				2: {EOF, ARITHMETIC, COMPARISION, SET, LEFT_BRACE, OFFSET_KW},
+				0: {METRIC_ID, NUM, AGGR_OP, FUNCTION_SCALAR_ID, FUNCTION_VECTOR_ID, LEFT_PAREN, UNARY_OP, SELECTOR_LEFT_BRACE},
+				1: {METRIC_ID, NUM, AGGR_OP, FUNCTION_SCALAR_ID, FUNCTION_VECTOR_ID, LEFT_PAREN, SELECTOR_LEFT_BRACE},
+				2: {EOF, ARITHMETIC, COMPARISION, SET, LEFT_BRACE, OFFSET_KW, AT_MODIFIER},
 			},
 		},
 	}
@@ -430,25 +511,25 @@ func TestPartialParse(t *testing.T) {
 			"new input is same as previous input",
 			"sum(metric_name_one",
 			"sum(metric_name_one",
-			[]TokenType{RIGHT_PAREN, LEFT_BRACE, OFFSET_KW, COMPARISION, ARITHMETIC, SET},
+			[]TokenType{RIGHT_PAREN, LEFT_BRACE, OFFSET_KW, AT_MODIFIER, COMPARISION, ARITHMETIC, SET},
 		},
 		{
 			"new input is empty",
 			"sum(metric_name_one",
 			"",
-			[]TokenType{METRIC_ID, NUM, AGGR_OP, FUNCTION_VECTOR_ID, FUNCTION_SCALAR_ID, LEFT_PAREN, UNARY_OP},
+			[]TokenType{METRIC_ID, NUM, AGGR_OP, FUNCTION_VECTOR_ID, FUNCTION_SCALAR_ID, LEFT_PAREN, UNARY_OP, SELECTOR_LEFT_BRACE},
 		},
 		{
 			"previous input is empty",
 			"",
 			"sum(metric_name_one",
-			[]TokenType{RIGHT_PAREN, LEFT_BRACE, OFFSET_KW, COMPARISION, ARITHMETIC, SET},
+			[]TokenType{RIGHT_PAREN, LEFT_BRACE, OFFSET_KW, AT_MODIFIER, COMPARISION, ARITHMETIC, SET},
 		},
 		{
 			"previous input and new input are different from beginning",
 			"metric_name{label=",
 			"sum(metric_name_one",
-			[]TokenType{RIGHT_PAREN, LEFT_BRACE, OFFSET_KW, COMPARISION, ARITHMETIC, SET},
+			[]TokenType{RIGHT_PAREN, LEFT_BRACE, OFFSET_KW, AT_MODIFIER, COMPARISION, ARITHMETIC, SET},
 		},
 		{
 			"previous input and new input are partially same",
@@ -466,7 +547,7 @@ func TestPartialParse(t *testing.T) {
 			"previous input covers new input",
 			"sum(metric_name_one{",
 			"sum(metric_name_one",
-			[]TokenType{RIGHT_PAREN, LEFT_BRACE, OFFSET_KW, COMPARISION, ARITHMETIC, SET},
+			[]TokenType{RIGHT_PAREN, LEFT_BRACE, OFFSET_KW, AT_MODIFIER, COMPARISION, ARITHMETIC, SET},
 		},
 	}
 
@@ -488,6 +569,90 @@ func TestPartialParse(t *testing.T) {
 	}
 }
 
+func TestPartialParseReusesChart(t *testing.T) {
+	prevInput := "sum(rate(metric_name_one[5m]))"
+	newInput := "sum(rate(metric_name_one[5m])) by ("
+	p := NewEarleyParser(*promQLGrammar)
+	p.Parse(prevInput)
+	prevStates := append([]*StateSet{}, p.chart.States()...)
+	validTypes := p.GetSuggestedTokenType(extractWords(newInput))
+
+	// everything up to the EOF of the previous input is still valid
+	unchanged := len(extractWords(prevInput)) - 1
+	for i := 0; i <= unchanged; i++ {
+		if p.chart.GetState(i) != prevStates[i] {
+			t.Errorf("state set %v was reparsed", i)
+		}
+	}
+	want := NewEarleyParser(*promQLGrammar).GetSuggestedTokenType(extractWords(newInput))
+	if len(validTypes) != len(want) {
+		t.Errorf("Got %v, expected %v", validTypes, want)
+	}
+	for i := range want {
+		if validTypes[i].TokenType != want[i].TokenType {
+			t.Errorf("Got %v, expected %v", validTypes, want)
+		}
+	}
+}
+
+func TestPartialParseReusesStateSets(t *testing.T) {
+	query := "sum(rate(metric_name_one{dima=\"1\"}[5m])) by (dima) / 2"
+	p := NewEarleyParser(*promQLGrammar)
+	// type the query, then delete it again, as someone changing their mind would
+	var prefixes []string
+	for i := 1; i <= len(query); i++ {
+		prefixes = append(prefixes, query[:i])
+	}
+	for i := len(query) - 1; i > 0; i-- {
+		prefixes = append(prefixes, query[:i])
+	}
+	for _, prefix := range prefixes {
+		validTypes := p.GetSuggestedTokenType(extractWords(prefix))
+		want := NewEarleyParser(*promQLGrammar).GetSuggestedTokenType(extractWords(prefix))
+		if !reflect.DeepEqual(suggestedTypes(validTypes), suggestedTypes(want)) {
+			t.Fatalf("%q: got %v, expected %v", prefix, validTypes, want)
+		}
+	}
+
+	// going back to where we were shouldn't need any new state sets
+	p.GetSuggestedTokenType(extractWords(query))
+	sets := map[*StateSet]bool{}
+	for _, s := range append(p.chart.States(), p.chart.spare...) {
+		sets[s] = true
+	}
+	p.GetSuggestedTokenType(extractWords("sum("))
+	p.GetSuggestedTokenType(extractWords(query))
+	for i, s := range p.chart.States() {
+		if !sets[s] {
+			t.Errorf("state set %v was allocated again", i)
+		}
+	}
+}
+
+func suggestedTypes(cts []ContextualToken) []TokenType {
+	types := make([]TokenType, len(cts))
+	for i, ct := range cts {
+		types[i] = ct.TokenType
+	}
+	return types
+}
+
+func BenchmarkTyping(b *testing.B) {
+	query := "sum(rate(metric_name_one{dima=\"1\"}[5m])) by (dima) / on (dima) group_left sum(metric_name_two)"
+	var prefixes []Tokens
+	for i := 1; i <= len(query); i++ {
+		prefixes = append(prefixes, extractWords(query[:i]))
+	}
+	p := NewEarleyParser(*promQLGrammar)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for _, tokens := range prefixes {
+			p.GetSuggestedTokenType(tokens)
+		}
+	}
+}
+
 func safeRead(sp *string) string {
 	if sp == nil {
 		return ""
@@ -0,0 +1,188 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package earley
+
+import (
+	"strings"
+)
+
+// an ambiguous grammar can parse some inputs an exponential number of ways, past a
+// point the extra parses aren't telling anyone anything
+const maxAlternatives = 16
+
+// ParseNode is a node of a parse tree, which is either a grammar rule that matched part
+// of the input, or a token which one of the rules matched.
+type ParseNode struct {
+	// Symbol is the non-terminal the rule produces, or the terminal the token matched.
+	Symbol Symbol
+	// Rule is nil for tokens.
+	Rule *GrammarRule
+	// Token is nil for rules.
+	Token *Tokhan
+	// Start and End are the indexes of the first token the node spans and of the one
+	// after its last.
+	Start int
+	End   int
+	// Children are what the right hand side of the rule has matched so far.
+	Children []*ParseNode
+	// Alternatives are the other ways the rule matched the same tokens, if the input
+	// is ambiguous.
+	Alternatives [][]*ParseNode
+}
+
+// String writes out the node as an s-expression, i.e. (E (E a) + (E a)), with only the
+// first of any alternatives.
+func (n *ParseNode) String() string {
+	sb := strings.Builder{}
+	n.write(&sb)
+	return sb.String()
+}
+
+func (n *ParseNode) write(sb *strings.Builder) {
+	if n.Token != nil {
+		sb.WriteString(n.Token.Val)
+		return
+	}
+	sb.WriteString("(")
+	sb.WriteString(n.Symbol.String())
+	for _, c := range n.Children {
+		sb.WriteString(" ")
+		c.write(sb)
+	}
+	sb.WriteString(")")
+}
+
+// Tokens lists the tokens the node spans, in order.
+func (n *ParseNode) Tokens() (tokens Tokens) {
+	if n.Token != nil {
+		return Tokens{*n.Token}
+	}
+	for _, c := range n.Children {
+		tokens = append(tokens, c.Tokens()...)
+	}
+	return tokens
+}
+
+// ParseTrees reconstructs how the input was parsed from the items which accepted all
+// of it, so that there's nothing if the input isn't valid. Ambiguities are kept as the
+// alternatives of the nodes concerned, unless it's the root rule that's ambiguous, in
+// which case there's a tree for each of them.
+func (c *earleyChart) ParseTrees() []*ParseNode {
+	// the final state set is never completed from, so only a root rule ending in a
+	// terminal (i.e. EOF) can be accepted there
+	last := c.GetState(len(c.inputWords))
+	if last == nil {
+		return nil
+	}
+	var trees []*ParseNode
+	memo := map[ItemId][][]*ParseNode{}
+	for _, item := range last.items {
+		if item.isCompleted() && item.originatingIndex == 0 && item.Rule.left.isRoot() {
+			trees = append(trees, c.node(item, memo))
+		}
+	}
+	return trees
+}
+
+// Derivation reconstructs what the rule of an item has matched so far, whether it's
+// complete or not. i.e. for the item that expected the token at the cursor, it tells
+// us why that token was suggested.
+func (c *earleyChart) Derivation(id ItemId) *ParseNode {
+	item := c.item(id)
+	if item == nil {
+		return nil
+	}
+	return c.node(item, map[ItemId][][]*ParseNode{})
+}
+
+func (c *earleyChart) item(id ItemId) *EarleyItem {
+	state := c.GetState(id.StateSetIndex)
+	if state == nil || id.ItemIndex < 0 || id.ItemIndex >= len(state.items) {
+		return nil
+	}
+	return state.items[id.ItemIndex]
+}
+
+func (c *earleyChart) node(item *EarleyItem, memo map[ItemId][][]*ParseNode) *ParseNode {
+	n := &ParseNode{
+		Symbol: item.Rule.left,
+		Rule:   item.Rule,
+		Start:  item.originatingIndex,
+		End:    item.id.StateSetIndex,
+	}
+	if ds := c.derive(item, memo); len(ds) > 0 {
+		n.Children = ds[0]
+		if len(ds) > 1 {
+			n.Alternatives = ds[1:]
+		}
+	}
+	return n
+}
+
+// derive works back from an item to the prediction of its rule, giving each of the ways
+// the symbols before the dot were matched.
+func (c *earleyChart) derive(item *EarleyItem, memo map[ItemId][][]*ParseNode) [][]*ParseNode {
+	// nothing's been matched by a prediction
+	if item.RulePos == 0 {
+		return [][]*ParseNode{nil}
+	}
+	if ds, ok := memo[item.id]; ok {
+		return ds
+	}
+	// in case the item somehow leads back to itself
+	memo[item.id] = nil
+
+	var ds [][]*ParseNode
+	for _, from := range item.derivations() {
+		var prev *EarleyItem
+		var matched *ParseNode
+		switch {
+		case item.cause == SCAN_STATE && len(from) == 1:
+			// the token was scanned at the state set the previous item is in
+			prev = c.item(from[0])
+			if prev == nil || prev.id.StateSetIndex >= len(c.inputWords) {
+				continue
+			}
+			i := prev.id.StateSetIndex
+			token := c.inputWords[i]
+			matched = &ParseNode{Symbol: prev.GetRightSymbolByRulePos(), Token: &token, Start: i, End: i + 1}
+		case item.cause == COMPLETE_STATE && len(from) == 2:
+			// the completed item, then the one which was waiting on it
+			child := c.item(from[0])
+			prev = c.item(from[1])
+			if child == nil || prev == nil {
+				continue
+			}
+			matched = c.node(child, memo)
+		default:
+			continue
+		}
+		for _, d := range c.derive(prev, memo) {
+			children := make([]*ParseNode, 0, len(d)+1)
+			children = append(append(children, d...), matched)
+			ds = append(ds, children)
+			if len(ds) == maxAlternatives {
+				break
+			}
+		}
+		if len(ds) == maxAlternatives {
+			break
+		}
+	}
+	memo[item.id] = ds
+	return ds
+}
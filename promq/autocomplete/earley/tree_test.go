@@ -0,0 +1,122 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package earley
+
+import (
+	"reflect"
+	"testing"
+
+	"sigs.k8s.io/instrumentation-tools/notstdlib/sets"
+)
+
+func TestParseTrees(t *testing.T) {
+	testCases := []struct {
+		name      string
+		query     string
+		wantTrees bool
+	}{
+		{
+			name:      "simple selector",
+			query:     "metric_name_one",
+			wantTrees: true,
+		},
+		{
+			name:      "nested functions and matchers",
+			query:     "sum(rate(metric_name_one{dima='1'}[5m])) by (dima)",
+			wantTrees: true,
+		},
+		{
+			name:      "incomplete query",
+			query:     "sum(rate(",
+			wantTrees: false,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tokens := extractWords(tc.query)
+			chart := NewEarleyParser(*promQLGrammar).ParseTokens(tokens)
+			trees := chart.ParseTrees()
+			if !tc.wantTrees {
+				if len(trees) != 0 {
+					t.Errorf("expected no parse trees, got %v", trees)
+				}
+				return
+			}
+			if len(trees) == 0 {
+				t.Fatalf("expected a parse tree for %q", tc.query)
+			}
+			for _, tree := range trees {
+				if tree.Symbol != Root || tree.Start != 0 || tree.End != len(tokens) {
+					t.Errorf("expected the tree to be rooted at %v over %d tokens, got %v over [%d, %d)", Root, len(tokens), tree.Symbol, tree.Start, tree.End)
+				}
+				// the leaves of the tree are the input
+				if got := tree.Tokens().Vals(); !reflect.DeepEqual(got, tokens.Vals()) {
+					t.Errorf("got leaves %v, expected %v", got, tokens.Vals())
+				}
+			}
+		})
+	}
+}
+
+func TestParseTreesOfAmbiguousInput(t *testing.T) {
+	E := NewNonTerminal("E", false)
+	g := NewGrammar(
+		// P -> E EOF
+		NewRule(P, E, Eof),
+		// E -> E + E
+		NewRule(E, E, plus, E),
+		// E -> a
+		NewRule(E, a),
+	)
+	tokens := Tokens{
+		{Type: "a", Val: "a"},
+		{Type: "+", Val: "+"},
+		{Type: "a", Val: "a"},
+		{Type: "+", Val: "+"},
+		{Type: "a", Val: "a"},
+		{Type: EOF},
+	}
+	chart := NewEarleyParser(*g).ParseTokens(tokens)
+	trees := chart.ParseTrees()
+	if len(trees) != 1 {
+		t.Fatalf("expected a single tree, since P itself isn't ambiguous, got %v", trees)
+	}
+	sum := trees[0].Children[0]
+	if len(sum.Alternatives) != 1 {
+		t.Fatalf("expected 'a + a + a' to parse two ways, got alternatives %v", sum.Alternatives)
+	}
+	got := sets.NewString(sum.String(), (&ParseNode{Symbol: E, Children: sum.Alternatives[0]}).String())
+	want := sets.NewString(
+		"(E (E (E a) + (E a)) + (E a))",
+		"(E (E a) + (E (E a) + (E a)))",
+	)
+	if !got.Equal(want) {
+		t.Errorf("got parses %v, expected %v", got.List(), want.List())
+	}
+
+	// an item's derivation is the same as its node in the tree
+	for _, item := range chart.GetState(len(tokens)).items {
+		if item.isCompleted() && item.Rule.left.isRoot() {
+			if got := chart.Derivation(item.Id()).String(); got != trees[0].String() {
+				t.Errorf("got derivation %v, expected %v", got, trees[0])
+			}
+		}
+	}
+	if got := chart.Derivation(ItemId{StateSetIndex: len(tokens) + 1}); got != nil {
+		t.Errorf("expected no derivation for an item outside of the chart, got %v", got)
+	}
+}
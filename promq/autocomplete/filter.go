@@ -23,6 +23,11 @@ import (
 	"sigs.k8s.io/instrumentation-tools/notstdlib/sets"
 )
 
+// FilterFunc is a matching strategy for pruning a set of suggestions down to the ones
+// which match the incomplete text at the cursor. FilterPrefix and FilterFuzzy are both
+// valid FilterFuncs.
+type FilterFunc func(stringSet sets.String, prefix string, ignoreCase bool) sets.String
+
 // a lot of this is lifted from "github.com/c-bata/go-prompt" but typed against sets.String
 // since they are helpful in pruning a list of suggestions, given the filtering constraints.
 // FilterPrefix takes a set of strings and compares each string against the prefix and includes
@@ -56,16 +61,63 @@ func filterSet(autocompletions sets.String, sub string, ignoreCase bool, inclusi
 	}
 	ret := sets.NewString()
 	for _, item := range autocompletions.List() {
+		compared := item
 		if ignoreCase {
-			item = strings.ToLower(item)
+			compared = strings.ToLower(item)
 		}
-		if inclusionFunc(item, sub) {
+		if inclusionFunc(compared, sub) {
 			ret.Insert(item)
 		}
 	}
 	return ret
 }
 
+// MatchOptions loosen how names are matched against what's been typed, for people
+// who don't remember exactly how a metric is spelled.
+type MatchOptions struct {
+	// IgnoreCase matches regardless of case, i.e. 'ApiServer' matches 'apiserver_request_total'
+	IgnoreCase bool
+	// IgnoreSeparators treats '.', '-' and '_' alike, i.e. 'apiserver.request' matches
+	// 'apiserver_request_total'
+	IgnoreSeparators bool
+}
+
+var separatorReplacer = strings.NewReplacer(".", "_", "-", "_")
+
+func (o MatchOptions) normalize(s string) string {
+	if o.IgnoreCase {
+		s = strings.ToLower(s)
+	}
+	if o.IgnoreSeparators {
+		s = separatorReplacer.Replace(s)
+	}
+	return s
+}
+
+// Loosely wraps a FilterFunc, so that it matches as loosely as the options say,
+// returning the strings from the set as they were rather than as they were compared.
+func Loosely(filter FilterFunc, opts MatchOptions) FilterFunc {
+	if opts == (MatchOptions{}) {
+		return filter
+	}
+	return func(stringSet sets.String, prefix string, ignoreCase bool) sets.String {
+		if prefix == "" {
+			return stringSet
+		}
+		// different strings can look the same once normalized, i.e. 'a.b' and 'a_b'
+		originals := map[string][]string{}
+		for _, item := range stringSet.List() {
+			n := opts.normalize(item)
+			originals[n] = append(originals[n], item)
+		}
+		ret := sets.NewString()
+		for _, n := range filter(sets.StringKeySet(originals), opts.normalize(prefix), ignoreCase).List() {
+			ret.Insert(originals[n]...)
+		}
+		return ret
+	}
+}
+
 func Enquote(stringSet sets.String) sets.String {
 	newStrings := sets.NewString()
 	for _, item := range stringSet.List() {
@@ -0,0 +1,156 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package autocomplete
+
+import (
+	"reflect"
+	"testing"
+
+	"sigs.k8s.io/instrumentation-tools/notstdlib/sets"
+)
+
+func TestFilterPrefix(t *testing.T) {
+
+	testCases := []struct {
+		name       string
+		stringSet  sets.String
+		prefix     string
+		ignoreCase bool
+		want       sets.String
+	}{
+		{
+			name:       "test filter prefix",
+			stringSet:  sets.NewString("metricnameone", "metricnametwo"),
+			prefix:     "metricnameo",
+			ignoreCase: true,
+			want:       sets.NewString("metricnameone"),
+		},
+		{
+			name:       "test filter prefix ignoring case keeps the original case",
+			stringSet:  sets.NewString("MetricNameOne", "metricnametwo"),
+			prefix:     "metricnameo",
+			ignoreCase: true,
+			want:       sets.NewString("MetricNameOne"),
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := FilterPrefix(tc.stringSet, tc.prefix, tc.ignoreCase); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("FilterPrefix() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestFilterFuzzy(t *testing.T) {
+
+	testCases := []struct {
+		name       string
+		stringSet  sets.String
+		prefix     string
+		ignoreCase bool
+		want       sets.String
+	}{
+		{
+			name:       "test filter fuzzy matches subsequence",
+			stringSet:  sets.NewString("apiserver_request_total", "apiserver_response_sizes", "etcd_request_duration_seconds"),
+			prefix:     "apireqtot",
+			ignoreCase: false,
+			want:       sets.NewString("apiserver_request_total"),
+		},
+		{
+			name:       "test filter fuzzy requires characters in order",
+			stringSet:  sets.NewString("metricnameone", "metricnametwo"),
+			prefix:     "tmto",
+			ignoreCase: false,
+			want:       sets.NewString("metricnametwo"),
+		},
+		{
+			name:       "test filter fuzzy with empty prefix",
+			stringSet:  sets.NewString("metricnameone", "metricnametwo"),
+			prefix:     "",
+			ignoreCase: false,
+			want:       sets.NewString("metricnameone", "metricnametwo"),
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := FilterFuzzy(tc.stringSet, tc.prefix, tc.ignoreCase); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("FilterFuzzy() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestLoosely(t *testing.T) {
+
+	testCases := []struct {
+		name      string
+		filter    FilterFunc
+		opts      MatchOptions
+		stringSet sets.String
+		prefix    string
+		want      sets.String
+	}{
+		{
+			name:      "test loosely without options is the filter",
+			filter:    FilterPrefix,
+			stringSet: sets.NewString("apiserver_request_total", "etcd_request_duration_seconds"),
+			prefix:    "ApiServer",
+			want:      sets.NewString(),
+		},
+		{
+			name:      "test loosely ignoring case",
+			filter:    FilterPrefix,
+			opts:      MatchOptions{IgnoreCase: true},
+			stringSet: sets.NewString("apiserver_request_total", "etcd_request_duration_seconds"),
+			prefix:    "ApiServer",
+			want:      sets.NewString("apiserver_request_total"),
+		},
+		{
+			name:      "test loosely ignoring separators",
+			filter:    FilterPrefix,
+			opts:      MatchOptions{IgnoreSeparators: true},
+			stringSet: sets.NewString("apiserver_request_total", "apiserver.request-count", "apiserver_response_sizes"),
+			prefix:    "apiserver-request.",
+			want:      sets.NewString("apiserver_request_total", "apiserver.request-count"),
+		},
+		{
+			name:      "test loosely ignoring case but not separators",
+			filter:    FilterPrefix,
+			opts:      MatchOptions{IgnoreCase: true},
+			stringSet: sets.NewString("apiserver_request_total"),
+			prefix:    "ApiServer.",
+			want:      sets.NewString(),
+		},
+		{
+			name:      "test loosely fuzzy",
+			filter:    FilterFuzzy,
+			opts:      MatchOptions{IgnoreCase: true, IgnoreSeparators: true},
+			stringSet: sets.NewString("apiserver_request_total", "etcd_request_duration_seconds"),
+			prefix:    "Api.Req.Tot",
+			want:      sets.NewString("apiserver_request_total"),
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := Loosely(tc.filter, tc.opts)(tc.stringSet, tc.prefix, false); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Loosely() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -1,50 +0,0 @@
-/*
-Copyright 2020 The Kubernetes Authors.
-
-Licensed under the Apache License, Version 2.0 (the "License");
-you may not use this file except in compliance with the License.
-You may obtain a copy of the License at
-
-    http://www.apache.org/licenses/LICENSE-2.0
-
-Unless required by applicable law or agreed to in writing, software
-distributed under the License is distributed on an "AS IS" BASIS,
-WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
-See the License for the specific language governing permissions and
-limitations under the License.
-*/
-
-package autocomplete
-
-import (
-	"reflect"
-	"testing"
-
-	"sigs.k8s.io/instrumentation-tools/notstdlib/sets"
-)
-
-func TestFilterPrefix(t *testing.T) {
-
-	testCases := []struct {
-		name       string
-		stringSet  sets.String
-		prefix     string
-		ignoreCase bool
-		want       sets.String
-	}{
-		{
-			name:       "test filter prefix",
-			stringSet:  sets.NewString("metricnameone", "metricnametwo"),
-			prefix:     "metricnameo",
-			ignoreCase: true,
-			want:       sets.NewString("metricnameone"),
-		},
-	}
-	for _, tc := range testCases {
-		t.Run(tc.name, func(t *testing.T) {
-			if got := FilterPrefix(tc.stringSet, tc.prefix, tc.ignoreCase); !reflect.DeepEqual(got, tc.want) {
-				t.Errorf("FilterPrefix() = %v, want %v", got, tc.want)
-			}
-		})
-	}
-}
@@ -0,0 +1,242 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package autocomplete
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"sigs.k8s.io/instrumentation-tools/debug"
+)
+
+const (
+	// DefaultHistorySize is how many queries a history remembers by default.
+	DefaultHistorySize = 500
+	// queries are short, anything longer than this in a history file is junk
+	maxHistoryLineSize = 1 << 20
+)
+
+type historyEntry struct {
+	query string
+	// the function calls and aggregations in the query, as they were written
+	expressions []string
+}
+
+// History remembers the queries which were run, most recent last, and offers them
+// (and the function calls and aggregations in them) as completions. It's persisted
+// to a file, one JSON string per line, so that it survives restarts.
+type History struct {
+	mu      sync.Mutex
+	path    string
+	size    int
+	entries []historyEntry
+}
+
+// NewHistory loads the history persisted at path, which doesn't have to exist yet.
+// An empty path keeps the history in memory only. At most size queries are kept.
+func NewHistory(path string, size int) (*History, error) {
+	h := &History{path: path, size: size}
+	if path == "" {
+		return h, nil
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read history: %w", err)
+	}
+	defer f.Close()
+
+	lines := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, maxHistoryLineSize)
+	for scanner.Scan() {
+		lines++
+		var query string
+		// a line we can't make sense of just isn't worth suggesting
+		if err := json.Unmarshal(scanner.Bytes(), &query); err != nil {
+			continue
+		}
+		h.add(query)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read history: %w", err)
+	}
+	// we only ever append to the file, so drop the repeats and the queries we've
+	// forgotten about before they pile up
+	if lines > len(h.entries) {
+		if err := h.rewrite(); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// Queries returns the queries in the history, most recent first.
+func (h *History) Queries() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	queries := make([]string, 0, len(h.entries))
+	for i := len(h.entries) - 1; i >= 0; i-- {
+		queries = append(queries, h.entries[i].query)
+	}
+	return queries
+}
+
+// Add adds a query to the history, or makes it the most recent one if it's already
+// there, and persists it.
+func (h *History) Add(query string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.add(query) || h.path == "" {
+		return nil
+	}
+	line, err := json.Marshal(strings.TrimSpace(query))
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(h.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to save history: %w", err)
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("unable to save history: %w", err)
+	}
+	return f.Close()
+}
+
+// Record adds the query to the history, for the completer. Failing to save it isn't
+// worth interrupting anyone over.
+func (h *History) Record(query string) {
+	if err := h.Add(query); err != nil {
+		debug.Debugf("%v\n", err)
+	}
+}
+
+// Suggest offers the function calls and aggregations of the queries in the history,
+// and the queries themselves if wholeQuery is set.
+func (h *History) Suggest(wholeQuery bool) []Match {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	seen := map[string]bool{}
+	var matches []Match
+	for i := len(h.entries) - 1; i >= 0; i-- {
+		e := h.entries[i]
+		if wholeQuery && !seen[e.query] {
+			seen[e.query] = true
+			matches = append(matches, &sourceMatch{value: e.query, kind: "history", detail: "a query you ran before"})
+		}
+		for _, expr := range e.expressions {
+			if seen[expr] {
+				continue
+			}
+			seen[expr] = true
+			matches = append(matches, &sourceMatch{value: expr, kind: "history-expression", detail: "from " + e.query})
+		}
+	}
+	return matches
+}
+
+// add adds the query to the history in memory, returning whether it was worth adding.
+func (h *History) add(query string) bool {
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return false
+	}
+	for i, e := range h.entries {
+		if e.query == query {
+			h.entries = append(h.entries[:i], h.entries[i+1:]...)
+			break
+		}
+	}
+	h.entries = append(h.entries, historyEntry{query: query, expressions: subExpressions(query)})
+	if h.size > 0 && len(h.entries) > h.size {
+		h.entries = h.entries[len(h.entries)-h.size:]
+	}
+	return true
+}
+
+func (h *History) rewrite() error {
+	var sb strings.Builder
+	for _, e := range h.entries {
+		line, err := json.Marshal(e.query)
+		if err != nil {
+			return err
+		}
+		sb.Write(line)
+		sb.WriteByte('\n')
+	}
+	if err := ioutil.WriteFile(h.path, []byte(sb.String()), 0600); err != nil {
+		return fmt.Errorf("unable to save history: %w", err)
+	}
+	return nil
+}
+
+// subExpressions finds the function calls and aggregations in a query, other than the
+// query itself, i.e. 'rate(foo[5m])' in 'sum(rate(foo[5m]))'.
+func subExpressions(query string) []string {
+	expr, err := parser.ParseExpr(query)
+	if err != nil {
+		return nil
+	}
+	var exprs []string
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		switch node.(type) {
+		case *parser.Call, *parser.AggregateExpr:
+		default:
+			return nil
+		}
+		pos := node.PositionRange()
+		if text := query[pos.Start:pos.End]; text != query {
+			exprs = append(exprs, text)
+		}
+		return nil
+	})
+	return exprs
+}
+
+type sourceMatch struct {
+	value  string
+	kind   string
+	detail string
+}
+
+func (m *sourceMatch) GetValue() string {
+	return m.value
+}
+
+func (m *sourceMatch) GetKind() string {
+	return m.kind
+}
+
+func (m *sourceMatch) GetDetail() string {
+	return m.detail
+}
+
+// GetRange is filled in by the completer, which knows what the match replaces.
+func (m *sourceMatch) GetRange() Range {
+	return Range{}
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package autocomplete
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHistoryPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history")
+	h, err := NewHistory(path, 2)
+	if err != nil {
+		t.Fatalf("unable to create history: %v", err)
+	}
+	for _, q := range []string{"up", "sum(up)\n", "", "up", "rate(foo[5m])"} {
+		if err := h.Add(q); err != nil {
+			t.Fatalf("unable to add %q: %v", q, err)
+		}
+	}
+	want := []string{"rate(foo[5m])", "up"}
+	if got := h.Queries(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got queries %v, want %v", got, want)
+	}
+
+	reloaded, err := NewHistory(path, 2)
+	if err != nil {
+		t.Fatalf("unable to reload history: %v", err)
+	}
+	if got := reloaded.Queries(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got reloaded queries %v, want %v", got, want)
+	}
+	// the repeats and forgotten queries are gone from the file
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unable to read history file: %v", err)
+	}
+	if got := strings.Count(string(data), "\n"); got != 2 {
+		t.Errorf("got %d lines in the history file, want 2:\n%s", got, data)
+	}
+}
+
+func TestHistoryIgnoresMangledLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history")
+	if err := ioutil.WriteFile(path, []byte("\"up\"\nnot json\n\"sum(up)\"\n"), 0600); err != nil {
+		t.Fatalf("unable to write history file: %v", err)
+	}
+	h, err := NewHistory(path, DefaultHistorySize)
+	if err != nil {
+		t.Fatalf("unable to load history: %v", err)
+	}
+	if got, want := h.Queries(), []string{"sum(up)", "up"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got queries %v, want %v", got, want)
+	}
+}
+
+func TestHistorySuggest(t *testing.T) {
+	h, err := NewHistory("", DefaultHistorySize)
+	if err != nil {
+		t.Fatalf("unable to create history: %v", err)
+	}
+	h.Record("sum by (code) (rate(requests_total[5m])) / sum(rate(requests_total[5m]))")
+	h.Record("not a query (")
+
+	suggested := func(wholeQuery bool) map[string]string {
+		kinds := map[string]string{}
+		for _, m := range h.Suggest(wholeQuery) {
+			kinds[m.GetValue()] = m.GetKind()
+		}
+		return kinds
+	}
+	want := map[string]string{
+		"sum by (code) (rate(requests_total[5m]))": "history-expression",
+		"sum(rate(requests_total[5m]))":            "history-expression",
+		"rate(requests_total[5m])":                 "history-expression",
+	}
+	if got := suggested(false); !reflect.DeepEqual(got, want) {
+		t.Errorf("Suggest(false) = %v, want %v", got, want)
+	}
+	want["sum by (code) (rate(requests_total[5m])) / sum(rate(requests_total[5m]))"] = "history"
+	want["not a query ("] = "history"
+	if got := suggested(true); !reflect.DeepEqual(got, want) {
+		t.Errorf("Suggest(true) = %v, want %v", got, want)
+	}
+}
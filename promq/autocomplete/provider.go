@@ -0,0 +1,153 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package autocomplete
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+
+	"sigs.k8s.io/instrumentation-tools/notstdlib/sets"
+)
+
+// CompletionContext is what we know about where a token goes, i.e. the metric and
+// label of the matcher a label value is for, or the function it's an argument of.
+type CompletionContext interface {
+	HasMetric() bool
+	GetMetric() string
+	HasMetricLabel() bool
+	GetMetricLabel() string
+	GetUsedMetricLabelValues() sets.String
+	GetMetricLabelMatchers() []*labels.Matcher
+	HasFunction() bool
+	GetFunction() string
+}
+
+// Provider suggests things the index doesn't know about, i.e. the namespaces of a
+// Kubernetes cluster for a namespace label, or a team's own label values.
+type Provider interface {
+	// Provide returns the matches for a token of the given type, i.e. "metric-identifier",
+	// "metric-label-identifier" or "string" (for label values, the completion context has
+	// the label). They're filtered against what's been typed so far by the completer.
+	// The completion context is nil when we know nothing about where the token goes.
+	// Providers are consulted as the query is typed, so should give up quickly when
+	// the context is done.
+	Provide(ctx context.Context, tokenType string, completion CompletionContext) []Match
+}
+
+// ProviderFunc lets a plain function be a Provider.
+type ProviderFunc func(ctx context.Context, tokenType string, completion CompletionContext) []Match
+
+func (f ProviderFunc) Provide(ctx context.Context, tokenType string, completion CompletionContext) []Match {
+	return f(ctx, tokenType, completion)
+}
+
+type namedProvider struct {
+	name     string
+	provider Provider
+}
+
+// Registry has the providers a completer consults alongside its index, by name.
+type Registry struct {
+	mu sync.RWMutex
+	// in the order they were registered, so that suggestions come out the same way
+	// every time
+	providers []namedProvider
+	// bumped whenever what the providers suggest may have changed
+	generation uint64
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Register adds a provider, names have to be unique.
+func (r *Registry) Register(name string, p Provider) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, np := range r.providers {
+		if np.name == name {
+			return fmt.Errorf("a provider named %q is already registered", name)
+		}
+	}
+	r.providers = append(r.providers, namedProvider{name: name, provider: p})
+	r.generation++
+	return nil
+}
+
+// Unregister removes the provider with the given name, if there is one.
+func (r *Registry) Unregister(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, np := range r.providers {
+		if np.name == name {
+			r.providers = append(r.providers[:i], r.providers[i+1:]...)
+			r.generation++
+			return
+		}
+	}
+}
+
+// Names returns the names of the registered providers, in the order they were
+// registered.
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, len(r.providers))
+	for i, np := range r.providers {
+		names[i] = np.name
+	}
+	return names
+}
+
+// Invalidate lets completers know that the providers' suggestions have changed, so
+// that they don't keep on suggesting what they cached before, i.e. once a provider
+// has listed the namespaces of a cluster again.
+func (r *Registry) Invalidate() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.generation++
+}
+
+// Generation changes whenever the providers, or what they suggest, may have.
+func (r *Registry) Generation() uint64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.generation
+}
+
+// Provide asks every registered provider for matches, in the order they were
+// registered.
+func (r *Registry) Provide(ctx context.Context, tokenType string, completion CompletionContext) []Match {
+	r.mu.RLock()
+	providers := append([]namedProvider(nil), r.providers...)
+	r.mu.RUnlock()
+	// a provider may well register another one, so don't hold the lock while they run
+	var matches []Match
+	for _, np := range providers {
+		matches = append(matches, np.provider.Provide(ctx, tokenType, completion)...)
+	}
+	return matches
+}
+
+// NewMatch is a match for providers to return, the completer works out what it
+// replaces.
+func NewMatch(value, kind, detail string) Match {
+	return &sourceMatch{value: value, kind: kind, detail: detail}
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package autocomplete
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func constantProvider(values ...string) Provider {
+	return ProviderFunc(func(_ context.Context, tokenType string, _ CompletionContext) []Match {
+		if tokenType != "metric-identifier" {
+			return nil
+		}
+		var matches []Match
+		for _, v := range values {
+			matches = append(matches, NewMatch(v, "metric-id", ""))
+		}
+		return matches
+	})
+}
+
+func provided(r *Registry, tokenType string) []string {
+	var values []string
+	for _, m := range r.Provide(context.Background(), tokenType, nil) {
+		values = append(values, m.GetValue())
+	}
+	return values
+}
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	if got := provided(r, "metric-identifier"); len(got) != 0 {
+		t.Errorf("empty registry provided %v", got)
+	}
+
+	generation := r.Generation()
+	if err := r.Register("b", constantProvider("b1", "b2")); err != nil {
+		t.Fatalf("Register(b) = %v", err)
+	}
+	if err := r.Register("a", constantProvider("a1")); err != nil {
+		t.Fatalf("Register(a) = %v", err)
+	}
+	if err := r.Register("a", constantProvider("a2")); err == nil {
+		t.Errorf("registering a second provider named a succeeded")
+	}
+	if r.Generation() == generation {
+		t.Errorf("registering providers didn't change the generation")
+	}
+	if got, want := r.Names(), []string{"b", "a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Names() = %v, want %v", got, want)
+	}
+	if got, want := provided(r, "metric-identifier"), []string{"b1", "b2", "a1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Provide() = %v, want %v", got, want)
+	}
+	if got := provided(r, "string"); len(got) != 0 {
+		t.Errorf("Provide() for a token type nobody provides = %v", got)
+	}
+
+	generation = r.Generation()
+	r.Unregister("b")
+	r.Unregister("nonexistent")
+	if got, want := provided(r, "metric-identifier"), []string{"a1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Provide() after unregistering = %v, want %v", got, want)
+	}
+	r.Invalidate()
+	if r.Generation() == generation {
+		t.Errorf("unregistering and invalidating didn't change the generation")
+	}
+}
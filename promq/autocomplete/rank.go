@@ -0,0 +1,175 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package autocomplete
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// scores are tiered so that a better kind of match always outranks a worse
+	// one, regardless of how recently the worse match was used.
+	scoreExactPrefix = 300
+	scoreHumpMatch   = 200
+	scoreSubstring   = 100
+	// recently used suggestions float to the top of their tier.
+	maxRecencyBoost = 50
+	maxRecentlyUsed = maxRecencyBoost
+)
+
+// Ranker scores suggestions against the autocomplete prefix, so that the most
+// relevant completions can be listed first. Exact prefix matches beat
+// underscore/camel hump matches (e.g. 'art' for 'apiserver_request_total'),
+// which beat plain substring matches. Anything else which made it through the
+// filter (i.e. fuzzy matches) scores lowest.
+type Ranker struct {
+	mu     sync.Mutex
+	recent []string
+}
+
+func NewRanker() *Ranker {
+	return &Ranker{}
+}
+
+// MarkUsed records that the given values have been used, most recent last.
+func (r *Ranker) MarkUsed(values ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, v := range values {
+		for i, old := range r.recent {
+			if old == v {
+				r.recent = append(r.recent[:i], r.recent[i+1:]...)
+				break
+			}
+		}
+		r.recent = append(r.recent, v)
+	}
+	if len(r.recent) > maxRecentlyUsed {
+		r.recent = r.recent[len(r.recent)-maxRecentlyUsed:]
+	}
+}
+
+// Score returns how relevant value is as a completion of prefix, higher is better.
+func (r *Ranker) Score(value, prefix string) int {
+	return matchScore(value, prefix) + r.recencyBoost(value)
+}
+
+// Sort orders matches by score, highest first. Equal scores keep the reverse
+// alphabetical ordering we've always used.
+func (r *Ranker) Sort(matches []Match, prefix string) {
+	scores := make(map[string]int, len(matches))
+	for _, m := range matches {
+		scores[m.GetValue()] = r.Score(m.GetValue(), prefix)
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		si, sj := scores[matches[i].GetValue()], scores[matches[j].GetValue()]
+		if si != sj {
+			return si > sj
+		}
+		return matches[i].GetValue() > matches[j].GetValue()
+	})
+}
+
+func (r *Ranker) recencyBoost(value string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := len(r.recent) - 1; i >= 0; i-- {
+		if r.recent[i] == value {
+			// the most recently used value gets the full boost
+			return maxRecencyBoost - (len(r.recent) - 1 - i)
+		}
+	}
+	return 0
+}
+
+func matchScore(value, prefix string) int {
+	switch {
+	case prefix == "" || strings.HasPrefix(value, prefix):
+		return scoreExactPrefix
+	case humpMatch(splitHumps(value), prefix):
+		return scoreHumpMatch
+	case strings.Contains(value, prefix):
+		return scoreSubstring
+	}
+	return 0
+}
+
+// splitHumps splits an identifier into its underscore and camel case separated
+// words, i.e. "apiserver_requestTotal" becomes ["apiserver", "request", "Total"].
+func splitHumps(s string) []string {
+	var humps []string
+	start := -1
+	runes := []rune(s)
+	for i, c := range runes {
+		switch {
+		case c == '_' || c == ':':
+			if start >= 0 {
+				humps = append(humps, string(runes[start:i]))
+			}
+			start = -1
+		case start < 0:
+			start = i
+		case unicode.IsUpper(c) && !unicode.IsUpper(runes[i-1]):
+			humps = append(humps, string(runes[start:i]))
+			start = i
+		}
+	}
+	if start >= 0 {
+		humps = append(humps, string(runes[start:]))
+	}
+	return humps
+}
+
+// humpMatch reports whether sub can be built by concatenating non-empty
+// prefixes of humps, in order and ignoring case, e.g. "apireqtot" or "art"
+// against ["apiserver", "request", "total"]. Humps may be skipped.
+func humpMatch(humps []string, sub string) bool {
+	if sub == "" {
+		return true
+	}
+	for i, h := range humps {
+		for n := commonPrefixLen(h, sub); n > 0; {
+			if humpMatch(humps[i+1:], sub[n:]) {
+				return true
+			}
+			_, size := utf8.DecodeLastRuneInString(sub[:n])
+			n -= size
+		}
+	}
+	return false
+}
+
+// commonPrefixLen is how many bytes of b start the same way as a, comparing runes
+// and ignoring case.
+func commonPrefixLen(a, b string) int {
+	n := 0
+	for _, r := range a {
+		if n == len(b) {
+			break
+		}
+		s, size := utf8.DecodeRuneInString(b[n:])
+		if unicode.ToLower(r) != unicode.ToLower(s) {
+			break
+		}
+		n += size
+	}
+	return n
+}
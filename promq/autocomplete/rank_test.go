@@ -0,0 +1,112 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package autocomplete
+
+import (
+	"reflect"
+	"testing"
+)
+
+type testMatch string
+
+func (m testMatch) GetValue() string  { return string(m) }
+func (m testMatch) GetKind() string   { return "" }
+func (m testMatch) GetDetail() string { return "" }
+func (m testMatch) GetRange() Range   { return Range{} }
+
+func TestRankerSort(t *testing.T) {
+
+	testCases := []struct {
+		name   string
+		values []string
+		prefix string
+		used   []string
+		want   []string
+	}{
+		{
+			name:   "without a prefix, keep reverse alphabetical order",
+			values: []string{"a", "c", "b"},
+			prefix: "",
+			want:   []string{"c", "b", "a"},
+		},
+		{
+			name:   "exact prefix beats hump match beats substring beats fuzzy",
+			values: []string{"etcd_request_total", "restart_total", "apiserver_request_total", "art_total"},
+			prefix: "art",
+			want:   []string{"art_total", "apiserver_request_total", "restart_total", "etcd_request_total"},
+		},
+		{
+			name:   "camel case starts a hump",
+			values: []string{"requesttotal", "requestTotal"},
+			prefix: "rtot",
+			want:   []string{"requestTotal", "requesttotal"},
+		},
+		{
+			name:   "recently used values are boosted within their tier",
+			values: []string{"metric_name_one", "metric_name_two", "min_over_time"},
+			prefix: "m",
+			used:   []string{"metric_name_one", "min_over_time"},
+			want:   []string{"min_over_time", "metric_name_one", "metric_name_two"},
+		},
+		{
+			name:   "recently used values don't outrank a better kind of match",
+			values: []string{"apiserver_request_total", "request_total"},
+			prefix: "req",
+			used:   []string{"apiserver_request_total"},
+			want:   []string{"request_total", "apiserver_request_total"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := NewRanker()
+			r.MarkUsed(tc.used...)
+			matches := make([]Match, len(tc.values))
+			for i, v := range tc.values {
+				matches[i] = testMatch(v)
+			}
+			r.Sort(matches, tc.prefix)
+			got := make([]string, len(matches))
+			for i, m := range matches {
+				got[i] = m.GetValue()
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Sort() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestHumpMatch(t *testing.T) {
+	testCases := []struct {
+		humps []string
+		sub   string
+		want  bool
+	}{
+		{humps: []string{"apiserver", "request", "total"}, sub: "apireqtot", want: true},
+		{humps: []string{"apiserver", "request", "total"}, sub: "ART", want: true},
+		{humps: []string{"apiserver", "request", "total"}, sub: "tr", want: false},
+		// runes rather than bytes are compared, ö and Ö share their first byte
+		{humps: []string{"größe", "total"}, sub: "GRÖtot", want: true},
+		{humps: []string{"größe", "total"}, sub: "grötal", want: false},
+		{humps: []string{"größe", "total"}, sub: "gr\xc3", want: false},
+	}
+	for _, tc := range testCases {
+		if got := humpMatch(tc.humps, tc.sub); got != tc.want {
+			t.Errorf("humpMatch(%q, %q) = %v, want %v", tc.humps, tc.sub, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package service serves autocompletion over HTTP, so that i.e. web UIs and chat bots
+// can suggest the same things as our prompt does without linking against us.
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"unicode/utf8"
+
+	"sigs.k8s.io/instrumentation-tools/debug"
+	"sigs.k8s.io/instrumentation-tools/promq/autocomplete"
+)
+
+// queries are short, anything bigger than this isn't one
+const maxRequestSize = 1 << 20
+
+// CompletionRequest asks for suggestions at a cursor in a query.
+type CompletionRequest struct {
+	Query string `json:"query"`
+	// Cursor is a byte offset into the query, it defaults to the end of it.
+	Cursor *int `json:"cursor,omitempty"`
+}
+
+// Replacement is the part of the query a suggestion replaces, in bytes.
+type Replacement struct {
+	Offset int `json:"offset"`
+	Length int `json:"length"`
+}
+
+type Suggestion struct {
+	Value   string      `json:"value"`
+	Kind    string      `json:"kind"`
+	Detail  string      `json:"detail,omitempty"`
+	Replace Replacement `json:"replace"`
+}
+
+type CompletionResponse struct {
+	// Suggestions are ranked, best first.
+	Suggestions []Suggestion `json:"suggestions"`
+	// Truncated is set when there were too many suggestions to send all of them.
+	Truncated bool `json:"truncated"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// NewHandler serves suggestions from the completer at /complete, either for a JSON
+// CompletionRequest POSTed to it, or for the query and cursor parameters of a GET.
+// The completer's parser keeps its state between suggestions, so requests get their
+// suggestions one at a time.
+func NewHandler(completer autocomplete.PromQLCompleter) http.Handler {
+	var completerMu sync.Mutex
+	mux := http.NewServeMux()
+	mux.HandleFunc("/complete", func(w http.ResponseWriter, r *http.Request) {
+		req, err := parseRequest(w, r)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+			return
+		}
+		completerMu.Lock()
+		resp := complete(completer, req)
+		completerMu.Unlock()
+		writeJSON(w, http.StatusOK, resp)
+	})
+	return mux
+}
+
+func parseRequest(w http.ResponseWriter, r *http.Request) (CompletionRequest, error) {
+	var req CompletionRequest
+	switch r.Method {
+	case http.MethodGet:
+		params := r.URL.Query()
+		req.Query = params.Get("query")
+		if c := params.Get("cursor"); c != "" {
+			cursor, err := strconv.Atoi(c)
+			if err != nil {
+				return req, fmt.Errorf("invalid cursor %q: %w", c, err)
+			}
+			req.Cursor = &cursor
+		}
+	case http.MethodPost:
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize)).Decode(&req); err != nil {
+			return req, fmt.Errorf("unable to decode request: %w", err)
+		}
+	default:
+		return req, fmt.Errorf("unsupported method %s, use GET or POST", r.Method)
+	}
+	if req.Cursor == nil {
+		end := len(req.Query)
+		req.Cursor = &end
+	}
+	if c := *req.Cursor; c < 0 || c > len(req.Query) || (c < len(req.Query) && !utf8.RuneStart(req.Query[c])) {
+		return req, fmt.Errorf("cursor %d isn't at a character of the query", c)
+	}
+	return req, nil
+}
+
+func complete(completer autocomplete.PromQLCompleter, req CompletionRequest) CompletionResponse {
+	resp := CompletionResponse{Suggestions: []Suggestion{}}
+	for _, m := range completer.GenerateSuggestions(req.Query, *req.Cursor) {
+		if m.GetKind() == "overflow" {
+			resp.Truncated = true
+			continue
+		}
+		r := m.GetRange()
+		resp.Suggestions = append(resp.Suggestions, Suggestion{
+			Value:   m.GetValue(),
+			Kind:    m.GetKind(),
+			Detail:  m.GetDetail(),
+			Replace: Replacement{Offset: r.Offset, Length: r.Length},
+		})
+	}
+	return resp
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		debug.Debugf("unable to write response: %v\n", err)
+	}
+}
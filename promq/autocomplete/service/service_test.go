@@ -0,0 +1,201 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"sigs.k8s.io/instrumentation-tools/promq/autocomplete/earley"
+	"sigs.k8s.io/instrumentation-tools/promq/prom"
+)
+
+const testMetrics = `
+# HELP http_requests_total Total HTTP requests.
+# TYPE http_requests_total counter
+http_requests_total{code="200"} 2
+http_requests_total{code="500"} 1
+`
+
+func newTestServer(t *testing.T, opts earley.CompleterOptions) *httptest.Server {
+	index := prom.NewIndex()
+	series, err := prom.ParseTextData([]byte(testMetrics), time.Now())
+	if err != nil {
+		t.Fatalf("unable to parse test metrics: %v", err)
+	}
+	for _, s := range series {
+		index.UpdateMetric(s)
+	}
+	srv := httptest.NewServer(NewHandler(earley.NewPromQLCompleterWithOptions(index, opts)))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func decode(t *testing.T, resp *http.Response, v interface{}) {
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("unable to decode response: %v", err)
+	}
+}
+
+func TestComplete(t *testing.T) {
+	srv := newTestServer(t, earley.CompleterOptions{})
+	testCases := []struct {
+		desc string
+		do   func() (*http.Response, error)
+		want Suggestion
+	}{
+		{
+			desc: "GET, with the cursor mid-word",
+			do: func() (*http.Response, error) {
+				return http.Get(srv.URL + "/complete?" + url.Values{"query": {"sum(http_reqx)"}, "cursor": {"12"}}.Encode())
+			},
+			want: Suggestion{Value: "http_requests_total", Kind: "metric-id", Detail: "Total HTTP requests.", Replace: Replacement{Offset: 4, Length: 9}},
+		},
+		{
+			desc: "POST, with the cursor at the end by default",
+			do: func() (*http.Response, error) {
+				return http.Post(srv.URL+"/complete", "application/json", strings.NewReader(`{"query": "http_requests_total{code=\"5"}`))
+			},
+			want: Suggestion{Value: `"500"`, Kind: "metric-id", Replace: Replacement{Offset: 25, Length: 2}},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			resp, err := tc.do()
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusOK)
+			}
+			var got CompletionResponse
+			decode(t, resp, &got)
+			for _, s := range got.Suggestions {
+				if s.Value == tc.want.Value {
+					if s.Replace != tc.want.Replace || s.Kind != tc.want.Kind {
+						t.Errorf("got %+v, want %+v", s, tc.want)
+					}
+					return
+				}
+			}
+			t.Errorf("got %+v, want %q among them", got.Suggestions, tc.want.Value)
+		})
+	}
+}
+
+// run with -race, this checks that concurrent requests don't share the parser's
+// state unguarded
+func TestCompleteConcurrently(t *testing.T) {
+	srv := newTestServer(t, earley.CompleterOptions{})
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func(query string) {
+			defer wg.Done()
+			resp, err := http.Get(srv.URL + "/complete?" + url.Values{"query": {query}}.Encode())
+			if err != nil {
+				errs <- err
+				return
+			}
+			var got CompletionResponse
+			defer resp.Body.Close()
+			if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+				errs <- err
+				return
+			}
+			if len(got.Suggestions) == 0 {
+				errs <- fmt.Errorf("got no suggestions for %q", query)
+			}
+		}([]string{"sum(http_req", `http_requests_total{code="`}[i%2])
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestCompleteTruncated(t *testing.T) {
+	srv := newTestServer(t, earley.CompleterOptions{MaxResults: 1})
+	resp, err := http.Get(srv.URL + "/complete?query=")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	var got CompletionResponse
+	decode(t, resp, &got)
+	if len(got.Suggestions) != 1 || !got.Truncated {
+		t.Errorf("got %+v, want one suggestion and to be told there were more", got)
+	}
+}
+
+func TestBadRequests(t *testing.T) {
+	srv := newTestServer(t, earley.CompleterOptions{})
+	testCases := []struct {
+		desc string
+		do   func() (*http.Response, error)
+	}{
+		{
+			desc: "cursor past the end",
+			do: func() (*http.Response, error) {
+				return http.Get(srv.URL + "/complete?query=up&cursor=3")
+			},
+		},
+		{
+			desc: "cursor isn't a number",
+			do: func() (*http.Response, error) {
+				return http.Get(srv.URL + "/complete?query=up&cursor=end")
+			},
+		},
+		{
+			desc: "cursor in the middle of a character",
+			do: func() (*http.Response, error) {
+				return http.Post(srv.URL+"/complete", "application/json", strings.NewReader(`{"query": "up{a=\"é\"}", "cursor": 7}`))
+			},
+		},
+		{
+			desc: "invalid JSON",
+			do: func() (*http.Response, error) {
+				return http.Post(srv.URL+"/complete", "application/json", strings.NewReader(`{"query": `))
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			resp, err := tc.do()
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("got status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+			}
+			var got errorResponse
+			decode(t, resp, &got)
+			if got.Error == "" {
+				t.Errorf("got no error message")
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package lint flags PromQL which is perfectly valid, but probably doesn't
+// do what whoever wrote it meant it to, i.e. taking the rate of a gauge.
+package lint
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"sigs.k8s.io/instrumentation-tools/notstdlib/sets"
+	"sigs.k8s.io/instrumentation-tools/promq/autocomplete"
+	"sigs.k8s.io/instrumentation-tools/promq/prom"
+)
+
+// Finding is a likely mistake in a query.
+type Finding struct {
+	// Offset and Length locate the offending expression in the query, in bytes.
+	Offset int
+	Length int
+	// Rule names the check which raised the finding.
+	Rule    string
+	Message string
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%s: %s", f.Rule, f.Message)
+}
+
+// a check looks at a single node of the query, given the path of nodes enclosing it
+type check func(index autocomplete.QueryIndex, node parser.Node, path []parser.Node) (string, bool)
+
+var (
+	checks = []struct {
+		rule  string
+		check check
+	}{
+		{"rate-on-non-counter", checkRateOnNonCounter},
+		{"histogram-quantile-without-rate", checkHistogramQuantileWithoutRate},
+		{"comparison-without-bool", checkComparisonWithoutBool},
+		{"no-matching-series", checkNoMatchingSeries},
+	}
+
+	counterFunctions = sets.NewString("rate", "irate", "increase", "resets")
+	// the functions that turn cumulative buckets into something histogram_quantile can use
+	bucketRateFunctions = sets.NewString("rate", "irate", "increase", "delta", "idelta")
+)
+
+// Lint parses the query and reports anything in it which looks like a mistake,
+// using the index to find out about the metrics the query selects. It returns
+// an error if the query can't be parsed.
+func Lint(query string, index autocomplete.QueryIndex) ([]Finding, error) {
+	expr, err := parser.ParseExpr(query)
+	if err != nil {
+		return nil, err
+	}
+	var findings []Finding
+	parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
+		if node == nil {
+			return nil
+		}
+		for _, c := range checks {
+			msg, found := c.check(index, node, path)
+			if !found {
+				continue
+			}
+			pos := node.PositionRange()
+			findings = append(findings, Finding{
+				Offset:  int(pos.Start),
+				Length:  int(pos.End - pos.Start),
+				Rule:    c.rule,
+				Message: msg,
+			})
+		}
+		return nil
+	})
+	sort.SliceStable(findings, func(i, j int) bool {
+		return findings[i].Offset < findings[j].Offset
+	})
+	return findings, nil
+}
+
+// i.e. rate(some_gauge[5m]), which gives nonsense whenever the gauge goes down
+func checkRateOnNonCounter(index autocomplete.QueryIndex, node parser.Node, _ []parser.Node) (string, bool) {
+	call, ok := node.(*parser.Call)
+	if !ok || !counterFunctions.Has(call.Func.Name) || len(call.Args) == 0 {
+		return "", false
+	}
+	ms, ok := call.Args[0].(*parser.MatrixSelector)
+	if !ok {
+		return "", false
+	}
+	vs, ok := ms.VectorSelector.(*parser.VectorSelector)
+	if !ok || vs.Name == "" {
+		return "", false
+	}
+	metricType := index.GetMetricType(vs.Name)
+	if prom.IsCounter(vs.Name, metricType) {
+		return "", false
+	}
+	return fmt.Sprintf("%s() should only be used with counters, but %s is a %s", call.Func.Name, vs.Name, metricType), true
+}
+
+// i.e. histogram_quantile(0.9, foo_bucket), which gives the quantile since the process started
+func checkHistogramQuantileWithoutRate(_ autocomplete.QueryIndex, node parser.Node, _ []parser.Node) (string, bool) {
+	call, ok := node.(*parser.Call)
+	if !ok || call.Func.Name != "histogram_quantile" || len(call.Args) < 2 {
+		return "", false
+	}
+	rated := false
+	parser.Inspect(call.Args[1], func(n parser.Node, _ []parser.Node) error {
+		if c, ok := n.(*parser.Call); ok && bucketRateFunctions.Has(c.Func.Name) {
+			rated = true
+		}
+		return nil
+	})
+	if rated {
+		return "", false
+	}
+	return "histogram_quantile() over raw buckets gives the quantile over the whole lifetime of each series, you probably want to rate() them first", true
+}
+
+// i.e. sum(foo > 5), which sums the series over 5 rather than counting them
+func checkComparisonWithoutBool(_ autocomplete.QueryIndex, node parser.Node, path []parser.Node) (string, bool) {
+	expr, ok := node.(*parser.BinaryExpr)
+	if !ok || !expr.Op.IsComparisonOperator() || expr.ReturnBool {
+		return "", false
+	}
+	// a comparison is a perfectly good filter, on its own, or to count or pick from
+	// what's left of it, it's only suspect when what's left is summed or averaged
+	for i := len(path) - 1; i >= 0; i-- {
+		switch p := path[i].(type) {
+		case *parser.ParenExpr:
+			continue
+		case *parser.AggregateExpr:
+			if p.Op == parser.SUM || p.Op == parser.AVG {
+				return fmt.Sprintf("%s filters out series rather than returning 0 or 1, use '%s bool' to keep them", expr.Op, expr.Op), true
+			}
+		}
+		break
+	}
+	return "", false
+}
+
+// i.e. typos in metric names and label values
+func checkNoMatchingSeries(index autocomplete.QueryIndex, node parser.Node, _ []parser.Node) (string, bool) {
+	vs, ok := node.(*parser.VectorSelector)
+	if !ok || vs.Name == "" {
+		return "", false
+	}
+	names := index.GetMetricNames()
+	// we haven't scraped anything yet, so we don't know any better
+	if names.Len() == 0 {
+		return "", false
+	}
+	if !names.Has(vs.Name) {
+		msg := fmt.Sprintf("no series of %s have been scraped", vs.Name)
+		if hint := autocomplete.DidYouMeanHint(vs.Name, names); hint != "" {
+			msg += ", " + hint
+		}
+		return msg, true
+	}
+	for _, m := range vs.LabelMatchers {
+		if m.Type != labels.MatchEqual || m.Name == labels.MetricName || m.Value == "" {
+			continue
+		}
+		if !index.GetStoredValuesForMetricAndDimension(vs.Name, m.Name).Has(m.Value) {
+			return fmt.Sprintf("no series of %s have been scraped with %s", vs.Name, m), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lint
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"sigs.k8s.io/instrumentation-tools/promq/prom"
+)
+
+const testMetrics = `
+# TYPE requests_total counter
+requests_total{code="200"} 2
+# TYPE temperature gauge
+temperature{room="kitchen"} 21
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="+Inf"} 1
+latency_seconds_sum 0.5
+latency_seconds_count 1
+`
+
+func newTestIndex(t *testing.T, metrics string) prom.Indexer {
+	index := prom.NewIndex()
+	series, err := prom.ParseTextData([]byte(metrics), time.Now())
+	if err != nil {
+		t.Fatalf("unable to parse test metrics: %v", err)
+	}
+	for _, s := range series {
+		index.UpdateMetric(s)
+	}
+	return index
+}
+
+func TestLint(t *testing.T) {
+	index := newTestIndex(t, testMetrics)
+	testCases := []struct {
+		desc  string
+		query string
+		want  []Finding
+	}{
+		{
+			desc:  "valid query",
+			query: `sum(rate(requests_total{code="200"}[5m]))`,
+		},
+		{
+			desc:  "rate on a gauge",
+			query: `rate(temperature[5m])`,
+			want: []Finding{
+				{Offset: 0, Length: 21, Rule: "rate-on-non-counter", Message: "rate() should only be used with counters, but temperature is a gauge"},
+			},
+		},
+		{
+			desc:  "rate on histogram series",
+			query: `rate(latency_seconds_sum[5m]) / rate(latency_seconds_count[5m])`,
+		},
+		{
+			desc:  "histogram_quantile without rate",
+			query: `histogram_quantile(0.9, latency_seconds_bucket)`,
+			want: []Finding{
+				{Offset: 0, Length: 47, Rule: "histogram-quantile-without-rate", Message: "histogram_quantile() over raw buckets gives the quantile over the whole lifetime of each series, you probably want to rate() them first"},
+			},
+		},
+		{
+			desc:  "histogram_quantile with rate",
+			query: `histogram_quantile(0.9, sum by (le) (rate(latency_seconds_bucket[5m])))`,
+		},
+		{
+			desc:  "comparison inside a sum",
+			query: `sum((temperature > 20))`,
+			want: []Finding{
+				{Offset: 5, Length: 16, Rule: "comparison-without-bool", Message: "> filters out series rather than returning 0 or 1, use '> bool' to keep them"},
+			},
+		},
+		{
+			desc:  "counting what a comparison filters",
+			query: `count(temperature > 20)`,
+		},
+		{
+			desc:  "picking from what a comparison filters",
+			query: `topk(3, temperature > 20)`,
+		},
+		{
+			desc:  "a comparison further inside a sum",
+			query: `sum(abs(temperature > 20))`,
+		},
+		{
+			desc:  "comparisons on their own are filters",
+			query: `temperature > 20`,
+		},
+		{
+			desc:  "comparisons with bool",
+			query: `sum(temperature > bool 20)`,
+		},
+		{
+			desc:  "unknown metric",
+			query: `temprature`,
+			want: []Finding{
+				{Offset: 0, Length: 10, Rule: "no-matching-series", Message: "no series of temprature have been scraped, did you mean temperature?"},
+			},
+		},
+		{
+			desc:  "unknown metric with nothing like it",
+			query: `humidity`,
+			want: []Finding{
+				{Offset: 0, Length: 8, Rule: "no-matching-series", Message: "no series of humidity have been scraped"},
+			},
+		},
+		{
+			desc:  "unknown label value",
+			query: `temperature{room="garage"}`,
+			want: []Finding{
+				{Offset: 0, Length: 26, Rule: "no-matching-series", Message: `no series of temperature have been scraped with room="garage"`},
+			},
+		},
+		{
+			desc:  "regex matchers aren't checked",
+			query: `temperature{room=~"gar.*"}`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			got, err := Lint(tc.query, index)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Lint(%q) = %+v, expected %+v", tc.query, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestLintWithEmptyIndex(t *testing.T) {
+	// nothing has been scraped yet, so we can't tell if a selector matches anything
+	got, err := Lint(`temperature`, prom.NewIndex())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got) != 0 {
+		t.Errorf("expected no findings, got %+v", got)
+	}
+}
+
+func TestLintInvalidQuery(t *testing.T) {
+	if _, err := Lint(`sum(`, prom.NewIndex()); err == nil {
+		t.Errorf("expected an error for an invalid query")
+	}
+}
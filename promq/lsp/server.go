@@ -0,0 +1,397 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package lsp serves completion, diagnostics, hover docs and formatting for PromQL
+// over the language server protocol, so that editors get the same index-aware
+// completion as our interactive prompt. Each document is taken to be one query.
+package lsp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"sigs.k8s.io/instrumentation-tools/debug"
+	"sigs.k8s.io/instrumentation-tools/promq/autocomplete"
+	"sigs.k8s.io/instrumentation-tools/promq/autocomplete/earley"
+	"sigs.k8s.io/instrumentation-tools/promq/lint"
+)
+
+const source = "promq"
+
+var (
+	// the characters after which editors should ask us for suggestions, on top of
+	// the ones they ask for as words are typed
+	triggerCharacters = []string{"(", "{", ",", "=", "\"", "[", " "}
+
+	// the kinds of match our completer gives, as far as editors are concerned
+	completionKinds = map[string]CompletionItemKind{
+		"metric-id":                       KindVariable,
+		"metric-label":                    KindField,
+		"range":                           KindUnit,
+		"time-unit":                       KindUnit,
+		"subquery-resolution":             KindUnit,
+		"histogram-quantile":              KindSnippet,
+		"histogram-count":                 KindSnippet,
+		string(earley.FUNCTION_VECTOR_ID): KindFunction,
+		string(earley.FUNCTION_SCALAR_ID): KindFunction,
+		string(earley.AGGR_OP):            KindFunction,
+		string(earley.ARITHMETIC):         KindOperator,
+		string(earley.COMPARISION):        KindOperator,
+		string(earley.SET):                KindOperator,
+		string(earley.LABELMATCH):         KindOperator,
+		string(earley.UNARY_OP):           KindOperator,
+	}
+
+	errExit = errors.New("exit")
+)
+
+// Server answers the requests of a single editor.
+type Server struct {
+	completer autocomplete.PromQLCompleter
+
+	docsMu sync.Mutex
+	// the text of each open document by its URI
+	docs map[string]string
+
+	writeMu sync.Mutex
+	out     io.Writer
+
+	shutdown bool
+}
+
+func NewServer(completer autocomplete.PromQLCompleter) *Server {
+	return &Server{
+		completer: completer,
+		docs:      map[string]string{},
+	}
+}
+
+// Serve reads requests from in and writes responses to out until the editor asks us
+// to exit, in runs out or the context is done.
+func (s *Server) Serve(ctx context.Context, in io.Reader, out io.Writer) error {
+	s.out = out
+	r := bufio.NewReader(in)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+		body, err := readMessage(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("unable to read message: %w", err)
+		}
+		var msg message
+		if err := json.Unmarshal(body, &msg); err != nil {
+			if err := s.reply(nil, nil, &responseError{Code: codeParseError, Message: err.Error()}); err != nil {
+				return err
+			}
+			continue
+		}
+		result, rerr := s.handle(&msg)
+		if rerr == errExit {
+			if !s.shutdown {
+				return errors.New("asked to exit without shutting down first")
+			}
+			return nil
+		}
+		// notifications don't get a response, even if they fail
+		if msg.ID == nil {
+			if rerr != nil {
+				debug.Debugf("lsp: %s: %v\n", msg.Method, rerr)
+			}
+			continue
+		}
+		var respErr *responseError
+		if rerr != nil && !errors.As(rerr, &respErr) {
+			respErr = &responseError{Code: codeInvalidParams, Message: rerr.Error()}
+		}
+		if err := s.reply(msg.ID, result, respErr); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Server) handle(msg *message) (interface{}, error) {
+	debug.Debugf("lsp: handling %s\n", msg.Method)
+	switch msg.Method {
+	case "initialize":
+		return InitializeResult{
+			Capabilities: ServerCapabilities{
+				TextDocumentSync:           1,
+				CompletionProvider:         &CompletionOptions{TriggerCharacters: triggerCharacters},
+				HoverProvider:              true,
+				DocumentFormattingProvider: true,
+			},
+			ServerInfo: ServerInfo{Name: source},
+		}, nil
+	case "initialized":
+		return nil, nil
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+	case "exit":
+		return nil, errExit
+	case "textDocument/didOpen":
+		var params DidOpenTextDocumentParams
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, err
+		}
+		s.setDocument(params.TextDocument.URI, params.TextDocument.Text)
+		return nil, s.publishDiagnostics(params.TextDocument.URI)
+	case "textDocument/didChange":
+		var params DidChangeTextDocumentParams
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, err
+		}
+		if len(params.ContentChanges) == 0 {
+			return nil, nil
+		}
+		// we only ask for full syncs, so the last change has all of the text
+		s.setDocument(params.TextDocument.URI, params.ContentChanges[len(params.ContentChanges)-1].Text)
+		return nil, s.publishDiagnostics(params.TextDocument.URI)
+	case "textDocument/didClose":
+		var params DidCloseTextDocumentParams
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, err
+		}
+		s.docsMu.Lock()
+		delete(s.docs, params.TextDocument.URI)
+		s.docsMu.Unlock()
+		// clear out whatever we said about it
+		return nil, s.notify("textDocument/publishDiagnostics", PublishDiagnosticsParams{URI: params.TextDocument.URI, Diagnostics: []Diagnostic{}})
+	case "textDocument/completion":
+		var params TextDocumentPositionParams
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, err
+		}
+		return s.complete(params)
+	case "textDocument/hover":
+		var params TextDocumentPositionParams
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, err
+		}
+		return s.hover(params)
+	case "textDocument/formatting":
+		var params DocumentFormattingParams
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, err
+		}
+		return s.format(params)
+	}
+	return nil, &responseError{Code: codeMethodNotFound, Message: fmt.Sprintf("method %q not supported", msg.Method)}
+}
+
+func (s *Server) setDocument(uri, text string) {
+	s.docsMu.Lock()
+	defer s.docsMu.Unlock()
+	s.docs[uri] = text
+}
+
+func (s *Server) document(uri string) (string, error) {
+	s.docsMu.Lock()
+	defer s.docsMu.Unlock()
+	text, ok := s.docs[uri]
+	if !ok {
+		return "", &responseError{Code: codeInvalidParams, Message: fmt.Sprintf("document %q isn't open", uri)}
+	}
+	return text, nil
+}
+
+func (s *Server) complete(params TextDocumentPositionParams) (interface{}, error) {
+	text, err := s.document(params.TextDocument.URI)
+	if err != nil {
+		return nil, err
+	}
+	pos := offsetOf(text, params.Position)
+	list := CompletionList{Items: []CompletionItem{}}
+	for i, m := range s.completer.GenerateSuggestions(text, pos) {
+		// the editor shows that there's more by itself
+		if m.GetKind() == "overflow" {
+			list.IsIncomplete = true
+			continue
+		}
+		kind, ok := completionKinds[m.GetKind()]
+		if !ok {
+			kind = KindKeyword
+		}
+		r := m.GetRange()
+		list.Items = append(list.Items, CompletionItem{
+			Label:    m.GetValue(),
+			Kind:     kind,
+			Detail:   m.GetDetail(),
+			SortText: fmt.Sprintf("%05d", i),
+			TextEdit: &TextEdit{
+				Range:   rangeOf(text, r.Offset, r.Offset+r.Length),
+				NewText: m.GetValue(),
+			},
+		})
+	}
+	return list, nil
+}
+
+func (s *Server) hover(params TextDocumentPositionParams) (interface{}, error) {
+	text, err := s.document(params.TextDocument.URI)
+	if err != nil {
+		return nil, err
+	}
+	desc, span, ok := earley.Describe(text, offsetOf(text, params.Position), s.completer)
+	if !ok {
+		// null, rather than an empty hover
+		return nil, nil
+	}
+	r := rangeOf(text, span.Start, span.End)
+	return Hover{Contents: MarkupContent{Kind: "plaintext", Value: desc}, Range: &r}, nil
+}
+
+func (s *Server) format(params DocumentFormattingParams) (interface{}, error) {
+	text, err := s.document(params.TextDocument.URI)
+	if err != nil {
+		return nil, err
+	}
+	edits := []TextEdit{}
+	// don't make a mess of queries we can't parse
+	if len(s.completer.Diagnose(text)) > 0 {
+		return edits, nil
+	}
+	if formatted := earley.FormatQuery(text); formatted != strings.TrimSpace(text) {
+		edits = append(edits, TextEdit{Range: rangeOf(text, 0, len(text)), NewText: formatted})
+	}
+	return edits, nil
+}
+
+// publishDiagnostics sends the syntax errors in a document, or if there aren't any,
+// the likely mistakes in it.
+func (s *Server) publishDiagnostics(uri string) error {
+	text, err := s.document(uri)
+	if err != nil {
+		return err
+	}
+	diagnostics := []Diagnostic{}
+	for _, d := range s.completer.Diagnose(text) {
+		msg := d.Message
+		if len(d.Expected) > 0 {
+			msg = fmt.Sprintf("%s, expected one of: %s", msg, strings.Join(d.Expected, ", "))
+		}
+		diagnostics = append(diagnostics, Diagnostic{
+			Range:    rangeOf(text, d.Offset, d.Offset+d.Length),
+			Severity: SeverityError,
+			Source:   source,
+			Message:  msg,
+		})
+	}
+	if len(diagnostics) == 0 && strings.TrimSpace(text) != "" {
+		// prometheus' parser has the last word on what's valid, so it may still fail
+		findings, err := lint.Lint(text, s.completer)
+		if err != nil {
+			debug.Debugf("lsp: unable to lint %s: %v\n", uri, err)
+		}
+		for _, f := range findings {
+			diagnostics = append(diagnostics, Diagnostic{
+				Range:    rangeOf(text, f.Offset, f.Offset+f.Length),
+				Severity: SeverityWarning,
+				Code:     f.Rule,
+				Source:   source,
+				Message:  f.Message,
+			})
+		}
+	}
+	return s.notify("textDocument/publishDiagnostics", PublishDiagnosticsParams{URI: uri, Diagnostics: diagnostics})
+}
+
+func (s *Server) notify(method string, params interface{}) error {
+	raw, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	return s.write(&message{JSONRPC: "2.0", Method: method, Params: raw})
+}
+
+func (s *Server) reply(id *json.RawMessage, result interface{}, respErr *responseError) error {
+	resp := &response{JSONRPC: "2.0", ID: id, Error: respErr}
+	if respErr == nil {
+		raw, err := json.Marshal(result)
+		if err != nil {
+			return err
+		}
+		rawResult := json.RawMessage(raw)
+		resp.Result = &rawResult
+	}
+	return s.write(resp)
+}
+
+func (s *Server) write(msg interface{}) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return writeMessage(s.out, msg)
+}
+
+// offsetOf turns a position in the document into a byte offset, positions past the
+// end of a line are taken to be at the end of it.
+func offsetOf(text string, p Position) int {
+	offset := 0
+	for line := 0; line < p.Line; line++ {
+		i := strings.IndexByte(text[offset:], '\n')
+		if i < 0 {
+			return len(text)
+		}
+		offset += i + 1
+	}
+	units := 0
+	for i, r := range text[offset:] {
+		if units >= p.Character || r == '\n' {
+			return offset + i
+		}
+		units += utf16Len(r)
+	}
+	return len(text)
+}
+
+// positionOf turns a byte offset in the document into a position.
+func positionOf(text string, offset int) Position {
+	if offset > len(text) {
+		offset = len(text)
+	}
+	before := text[:offset]
+	start := strings.LastIndexByte(before, '\n') + 1
+	p := Position{Line: strings.Count(before, "\n")}
+	for _, r := range before[start:] {
+		p.Character += utf16Len(r)
+	}
+	return p
+}
+
+func rangeOf(text string, start, end int) Range {
+	return Range{Start: positionOf(text, start), End: positionOf(text, end)}
+}
+
+// utf16Len is how many UTF-16 code units a rune takes up, which is what positions
+// count characters in.
+func utf16Len(r rune) int {
+	if r >= 0x10000 {
+		return 2
+	}
+	return 1
+}
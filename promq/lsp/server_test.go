@@ -0,0 +1,249 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lsp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"sigs.k8s.io/instrumentation-tools/promq/autocomplete/earley"
+	"sigs.k8s.io/instrumentation-tools/promq/prom"
+)
+
+const testMetrics = `
+# HELP http_requests_total Total HTTP requests.
+# TYPE http_requests_total counter
+http_requests_total{code="200"} 2
+`
+
+// session runs the server over the given requests, and returns what it said back.
+type session struct {
+	t        *testing.T
+	in       bytes.Buffer
+	nextID   int
+	results  map[int]json.RawMessage
+	errors   map[int]*responseError
+	notified map[string][]json.RawMessage
+}
+
+func newSession(t *testing.T) *session {
+	return &session{
+		t:        t,
+		results:  map[int]json.RawMessage{},
+		errors:   map[int]*responseError{},
+		notified: map[string][]json.RawMessage{},
+	}
+}
+
+func (s *session) request(method string, params interface{}) int {
+	s.nextID++
+	s.send(s.nextID, method, params)
+	return s.nextID
+}
+
+func (s *session) notify(method string, params interface{}) {
+	s.send(0, method, params)
+}
+
+func (s *session) send(id int, method string, params interface{}) {
+	raw, err := json.Marshal(params)
+	if err != nil {
+		s.t.Fatalf("unable to marshal %s params: %v", method, err)
+	}
+	msg := &message{JSONRPC: "2.0", Method: method, Params: raw}
+	if id != 0 {
+		rawID := json.RawMessage(fmt.Sprint(id))
+		msg.ID = &rawID
+	}
+	if err := writeMessage(&s.in, msg); err != nil {
+		s.t.Fatalf("unable to write %s: %v", method, err)
+	}
+}
+
+func (s *session) run() {
+	index := prom.NewIndex()
+	series, err := prom.ParseTextData([]byte(testMetrics), time.Now())
+	if err != nil {
+		s.t.Fatalf("unable to parse test metrics: %v", err)
+	}
+	for _, ps := range series {
+		index.UpdateMetric(ps)
+	}
+	out := bytes.Buffer{}
+	if err := NewServer(earley.NewPromQLCompleter(index)).Serve(context.Background(), &s.in, &out); err != nil {
+		s.t.Fatalf("Serve() = %v", err)
+	}
+
+	r := bufio.NewReader(&out)
+	for {
+		body, err := readMessage(r)
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			s.t.Fatalf("unable to read what the server wrote: %v", err)
+		}
+		var msg struct {
+			ID     *int            `json:"id"`
+			Method string          `json:"method"`
+			Params json.RawMessage `json:"params"`
+			Result json.RawMessage `json:"result"`
+			Error  *responseError  `json:"error"`
+		}
+		if err := json.Unmarshal(body, &msg); err != nil {
+			s.t.Fatalf("server wrote invalid JSON %q: %v", body, err)
+		}
+		switch {
+		case msg.ID == nil:
+			s.notified[msg.Method] = append(s.notified[msg.Method], msg.Params)
+		case msg.Error != nil:
+			s.errors[*msg.ID] = msg.Error
+		default:
+			s.results[*msg.ID] = msg.Result
+		}
+	}
+}
+
+func (s *session) result(id int, v interface{}) {
+	raw, ok := s.results[id]
+	if !ok {
+		s.t.Fatalf("no result for request %d, error: %v", id, s.errors[id])
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		s.t.Fatalf("unable to unmarshal result %s: %v", raw, err)
+	}
+}
+
+func open(uri, text string) DidOpenTextDocumentParams {
+	return DidOpenTextDocumentParams{TextDocument: TextDocumentItem{URI: uri, LanguageID: "promql", Version: 1, Text: text}}
+}
+
+func at(uri string, line, character int) TextDocumentPositionParams {
+	return TextDocumentPositionParams{TextDocument: TextDocumentIdentifier{URI: uri}, Position: Position{Line: line, Character: character}}
+}
+
+func TestServer(t *testing.T) {
+	s := newSession(t)
+	initialize := s.request("initialize", map[string]interface{}{"capabilities": map[string]interface{}{}})
+	s.notify("initialized", map[string]interface{}{})
+
+	s.notify("textDocument/didOpen", open("file:///valid.promql", "sum(rate(http_requests_total[5m]))"))
+	s.notify("textDocument/didOpen", open("file:///invalid.promql", "sum(rate(http_requests_total[5m])"))
+	s.notify("textDocument/didOpen", open("file:///complete.promql", "sum(http_req)"))
+	completion := s.request("textDocument/completion", at("file:///complete.promql", 0, 12))
+	hover := s.request("textDocument/hover", at("file:///valid.promql", 0, 5))
+	s.notify("textDocument/didOpen", open("file:///format.promql", "sum( http_requests_total )"))
+	formatting := s.request("textDocument/formatting", DocumentFormattingParams{TextDocument: TextDocumentIdentifier{URI: "file:///format.promql"}})
+	unknown := s.request("textDocument/rename", at("file:///valid.promql", 0, 0))
+	shutdown := s.request("shutdown", nil)
+	s.notify("exit", nil)
+	s.run()
+
+	var init InitializeResult
+	s.result(initialize, &init)
+	if init.Capabilities.TextDocumentSync != 1 || init.Capabilities.CompletionProvider == nil || !init.Capabilities.HoverProvider {
+		t.Errorf("initialize = %+v, want full sync, completion and hover", init)
+	}
+
+	diagnostics := map[string][]Diagnostic{}
+	for _, raw := range s.notified["textDocument/publishDiagnostics"] {
+		var p PublishDiagnosticsParams
+		if err := json.Unmarshal(raw, &p); err != nil {
+			t.Fatalf("unable to unmarshal diagnostics %s: %v", raw, err)
+		}
+		diagnostics[p.URI] = p.Diagnostics
+	}
+	if got := diagnostics["file:///valid.promql"]; len(got) != 0 {
+		t.Errorf("diagnostics for a valid query = %+v, want none", got)
+	}
+	if got := diagnostics["file:///invalid.promql"]; len(got) == 0 || got[0].Severity != SeverityError {
+		t.Errorf("diagnostics for an invalid query = %+v, want an error", got)
+	}
+
+	var list CompletionList
+	s.result(completion, &list)
+	found := false
+	for _, item := range list.Items {
+		if item.Label != "http_requests_total" {
+			continue
+		}
+		found = true
+		want := Range{Start: Position{Character: 4}, End: Position{Character: 12}}
+		if item.Kind != KindVariable || item.TextEdit == nil || item.TextEdit.Range != want {
+			t.Errorf("completion = %+v, want a variable replacing %+v", item, want)
+		}
+	}
+	if !found {
+		t.Errorf("completion = %+v, want http_requests_total", list.Items)
+	}
+
+	var h Hover
+	s.result(hover, &h)
+	if h.Contents.Value == "" {
+		t.Errorf("hover = %+v, want a description of rate", h)
+	}
+	if h.Range == nil || h.Range.Start.Character != 4 || h.Range.End.Character != 8 {
+		t.Errorf("hover range = %+v, want rate", h.Range)
+	}
+
+	var edits []TextEdit
+	s.result(formatting, &edits)
+	if want := earley.FormatQuery("sum( http_requests_total )"); len(edits) != 1 || edits[0].NewText != want {
+		t.Errorf("formatting = %+v, want %q", edits, want)
+	}
+
+	if err, ok := s.errors[unknown]; !ok || err.Code != codeMethodNotFound {
+		t.Errorf("unsupported request got %v, want method not found", err)
+	}
+	if raw, ok := s.results[shutdown]; !ok || string(raw) != "null" {
+		t.Errorf("shutdown = %s, want null", raw)
+	}
+}
+
+func TestPositions(t *testing.T) {
+	// the emoji takes up two UTF-16 code units, and four bytes
+	text := "up\n{a=\"😀\"} +\nb"
+	testCases := []struct {
+		offset int
+		pos    Position
+	}{
+		{offset: 0, pos: Position{Line: 0, Character: 0}},
+		{offset: 2, pos: Position{Line: 0, Character: 2}},
+		{offset: 3, pos: Position{Line: 1, Character: 0}},
+		{offset: 7, pos: Position{Line: 1, Character: 4}},
+		{offset: 11, pos: Position{Line: 1, Character: 6}},
+		{offset: 12, pos: Position{Line: 1, Character: 7}},
+		{offset: 16, pos: Position{Line: 2, Character: 0}},
+		{offset: 17, pos: Position{Line: 2, Character: 1}},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprint(tc.offset), func(t *testing.T) {
+			if got := positionOf(text, tc.offset); got != tc.pos {
+				t.Errorf("positionOf(%d) = %+v, want %+v", tc.offset, got, tc.pos)
+			}
+			if got := offsetOf(text, tc.pos); got != tc.offset {
+				t.Errorf("offsetOf(%+v) = %d, want %d", tc.pos, got, tc.offset)
+			}
+		})
+	}
+}
@@ -0,0 +1,229 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/textparse"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/storage"
+)
+
+const (
+	// AlertMetricName is the series of the alerts which are pending or firing, like
+	// prometheus'.
+	AlertMetricName = "ALERTS"
+	// AlertNameLabel and AlertStateLabel are which alert an ALERTS series is, and
+	// whether it's pending or firing.
+	AlertNameLabel  = "alertname"
+	AlertStateLabel = "alertstate"
+)
+
+// AlertState is whether an alert has been active for as long as its rule needs it to
+// be before it fires.
+type AlertState string
+
+const (
+	AlertPending AlertState = "pending"
+	AlertFiring  AlertState = "firing"
+)
+
+// AlertingRule is an alert, which is active for each series its expression returns,
+// and fires once it's been active for the rule's For.
+type AlertingRule struct {
+	Name        string
+	Expr        string
+	For         time.Duration
+	Labels      map[string]string
+	Annotations map[string]string
+}
+
+// Alert is an active alert of a rule.
+type Alert struct {
+	// Labels are those of its ALERTS series, but for the alertstate
+	Labels labels.Labels
+	State  AlertState
+	// ActiveAt is when the rule's expression first returned the alert's series
+	ActiveAt time.Time
+	// Value is what the expression returned the last time it was evaluated
+	Value       float64
+	Annotations map[string]string
+}
+
+// ParseAlertingRules parses a prometheus rules file, and returns its alerting rules.
+// Recording rules are skipped, see ParseRecordingRules.
+func ParseAlertingRules(data []byte) ([]AlertingRule, error) {
+	groups, err := parseRuleGroups(data)
+	if err != nil {
+		return nil, err
+	}
+	var rules []AlertingRule
+	for _, g := range groups {
+		for _, r := range g.Rules {
+			if r.Alert.Value == "" {
+				continue
+			}
+			rules = append(rules, AlertingRule{
+				Name:        r.Alert.Value,
+				Expr:        r.Expr.Value,
+				For:         time.Duration(r.For),
+				Labels:      r.Labels,
+				Annotations: r.Annotations,
+			})
+		}
+	}
+	return rules, nil
+}
+
+// ParseAlert parses an ad-hoc alert, an expression optionally followed by how long
+// it has to be active to fire, i.e. 'rate(errors_total[5m]) > 1 for 1m'. The alert
+// is named after its expression.
+func ParseAlert(spec string) (AlertingRule, error) {
+	rule := AlertingRule{Expr: strings.TrimSpace(spec)}
+	if i := strings.LastIndex(rule.Expr, " for "); i >= 0 {
+		if d, err := model.ParseDuration(strings.TrimSpace(rule.Expr[i+len(" for "):])); err == nil {
+			rule.Expr, rule.For = strings.TrimSpace(rule.Expr[:i]), time.Duration(d)
+		}
+	}
+	if _, err := parser.ParseExpr(rule.Expr); err != nil {
+		return AlertingRule{}, fmt.Errorf("invalid alert %q: %w", spec, err)
+	}
+	rule.Name = rule.Expr
+	return rule, nil
+}
+
+// Alerter evaluates alerting rules, keeping track of which of their alerts are active
+// and since when.
+type Alerter struct {
+	rules []AlertingRule
+
+	mu sync.Mutex
+	// active has the active alerts of each rule, by the hash of their labels
+	active []map[uint64]*Alert
+}
+
+func NewAlerter(rules []AlertingRule) (*Alerter, error) {
+	for _, r := range rules {
+		if _, err := parser.ParseExpr(r.Expr); err != nil {
+			return nil, fmt.Errorf("invalid expression for alert %s: %w", r.Name, err)
+		}
+	}
+	active := make([]map[uint64]*Alert, len(rules))
+	for i := range active {
+		active[i] = map[uint64]*Alert{}
+	}
+	return &Alerter{rules: rules, active: active}, nil
+}
+
+// Eval evaluates every rule at the given time, and returns the ALERTS series of the
+// alerts which are active, and why any of the rules couldn't be evaluated. A rule
+// which can't be evaluated keeps its alerts as they were.
+func (a *Alerter) Eval(ctx context.Context, engine *promql.Engine, queryable storage.Queryable, ts time.Time) ([]ParsedSeries, []error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var errs []error
+	for i, rule := range a.rules {
+		if err := a.eval(ctx, i, engine, queryable, ts); err != nil {
+			errs = append(errs, fmt.Errorf("unable to evaluate alert %s: %w", rule.Name, err))
+		}
+	}
+	var series []ParsedSeries
+	for _, active := range a.active {
+		for _, alert := range active {
+			lb := labels.NewBuilder(alert.Labels)
+			lb.Set(labels.MetricName, AlertMetricName)
+			lb.Set(AlertStateLabel, string(alert.State))
+			series = append(series, ParsedSeries{
+				Labels:    lb.Labels(),
+				Value:     1,
+				Timestamp: PromTimestamp(ts),
+				Type:      textparse.MetricTypeGauge,
+				Help:      "the alerts which are pending or firing",
+			})
+		}
+	}
+	return series, errs
+}
+
+func (a *Alerter) eval(ctx context.Context, i int, engine *promql.Engine, queryable storage.Queryable, ts time.Time) error {
+	rule := a.rules[i]
+	query, err := engine.NewInstantQuery(queryable, rule.Expr, ts)
+	if err != nil {
+		return err
+	}
+	defer query.Close()
+	res := query.Exec(ctx)
+	if res.Err != nil {
+		return res.Err
+	}
+	vector, err := res.Vector()
+	if err != nil {
+		return err
+	}
+
+	active := make(map[uint64]*Alert, len(vector))
+	for _, sample := range vector {
+		lb := labels.NewBuilder(sample.Metric)
+		lb.Del(labels.MetricName)
+		for k, v := range rule.Labels {
+			lb.Set(k, v)
+		}
+		lb.Set(AlertNameLabel, rule.Name)
+		ls := lb.Labels()
+		h := ls.Hash()
+		alert, ok := a.active[i][h]
+		if !ok {
+			alert = &Alert{Labels: ls, State: AlertPending, ActiveAt: ts, Annotations: rule.Annotations}
+		}
+		alert.Value = sample.V
+		if ts.Sub(alert.ActiveAt) >= rule.For {
+			alert.State = AlertFiring
+		}
+		active[h] = alert
+	}
+	// the rest are resolved, and their ALERTS series go stale
+	a.active[i] = active
+	return nil
+}
+
+// Alerts returns the active alerts, by name and then labels.
+func (a *Alerter) Alerts() []Alert {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var alerts []Alert
+	for _, active := range a.active {
+		for _, alert := range active {
+			alerts = append(alerts, *alert)
+		}
+	}
+	sort.Slice(alerts, func(i, j int) bool {
+		if ni, nj := alerts[i].Labels.Get(AlertNameLabel), alerts[j].Labels.Get(AlertNameLabel); ni != nj {
+			return ni < nj
+		}
+		return labels.Compare(alerts[i].Labels, alerts[j].Labels) < 0
+	})
+	return alerts
+}
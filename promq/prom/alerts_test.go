@@ -0,0 +1,169 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/promql"
+)
+
+func TestParseAlert(t *testing.T) {
+	rule, err := ParseAlert("sum(rate(errors_total[5m])) > 1 for 1m")
+	if err != nil {
+		t.Fatalf("unable to parse alert: %v", err)
+	}
+	if rule.Expr != "sum(rate(errors_total[5m])) > 1" || rule.For != time.Minute || rule.Name != rule.Expr {
+		t.Errorf("got %+v, want the expression, for a minute, named after itself", rule)
+	}
+	if rule, err := ParseAlert("up == 0"); err != nil || rule.For != 0 {
+		t.Errorf("got %+v, %v, want an alert which fires straight away", rule, err)
+	}
+	if _, err := ParseAlert("up == for 1m"); err == nil {
+		t.Errorf("expected an alert with an invalid expression to be invalid")
+	}
+}
+
+func TestParseAlertingRules(t *testing.T) {
+	rules, err := ParseAlertingRules([]byte(`
+groups:
+- name: cheese
+  rules:
+  - record: cheese:sum
+    expr: sum(cheese)
+  - alert: TooMuchCheese
+    expr: cheese > 0.4
+    for: 5m
+    labels:
+      severity: page
+    annotations:
+      summary: that's a lot of cheese
+`))
+	if err != nil {
+		t.Fatalf("unable to parse rules: %v", err)
+	}
+	want := []AlertingRule{{
+		Name:        "TooMuchCheese",
+		Expr:        "cheese > 0.4",
+		For:         5 * time.Minute,
+		Labels:      map[string]string{"severity": "page"},
+		Annotations: map[string]string{"summary": "that's a lot of cheese"},
+	}}
+	if !reflect.DeepEqual(rules, want) {
+		t.Errorf("got rules %+v, want %+v", rules, want)
+	}
+}
+
+func TestAlerter(t *testing.T) {
+	engine := promql.NewEngine(DefaultEngineOptions(time.Minute, 1000))
+	storage := NewRangeStorage()
+	start := time.Unix(1000, 0)
+	load := func(data string, ts time.Time) {
+		points, err := ParseTextData([]byte(data), ts)
+		if err != nil {
+			t.Fatalf("invalid raw data: %v", err)
+		}
+		if err := storage.LoadData(points); err != nil {
+			t.Fatalf("unable to load data: %v", err)
+		}
+	}
+	rule, err := ParseAlert("cheese > 0.4 for 1m")
+	if err != nil {
+		t.Fatalf("unable to parse alert: %v", err)
+	}
+	rule.Labels = map[string]string{"severity": "page"}
+	alerter, err := NewAlerter([]AlertingRule{rule})
+	if err != nil {
+		t.Fatalf("unable to create alerter: %v", err)
+	}
+	eval := func(ts time.Time) []string {
+		series, errs := alerter.Eval(context.TODO(), engine, storage, ts)
+		if len(errs) > 0 {
+			t.Fatalf("unable to evaluate alerts: %v", errs)
+		}
+		var got []string
+		for _, s := range series {
+			got = append(got, s.Labels.String())
+		}
+		return got
+	}
+
+	load("cheese{sharpness=\"vermont\"} 0.42\ncheese{sharpness=\"sunnyvale\"} 0.22\n", start)
+	want := []string{`{__name__="ALERTS", alertname="cheese > 0.4", alertstate="pending", severity="page", sharpness="vermont"}`}
+	if got := eval(start); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want the vermont cheese alert pending", got)
+	}
+
+	load("cheese{sharpness=\"vermont\"} 0.43\ncheese{sharpness=\"sunnyvale\"} 0.22\n", start.Add(30*time.Second))
+	want = []string{`{__name__="ALERTS", alertname="cheese > 0.4", alertstate="firing", severity="page", sharpness="vermont"}`}
+	if got := eval(start.Add(time.Minute)); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want the vermont cheese alert firing a minute later", got)
+	}
+	alerts := alerter.Alerts()
+	if len(alerts) != 1 || alerts[0].Value != 0.43 || !alerts[0].ActiveAt.Equal(start) {
+		t.Errorf("got %+v, want the alert active since the start, with the latest value", alerts)
+	}
+
+	load("cheese{sharpness=\"vermont\"} 0.1\ncheese{sharpness=\"sunnyvale\"} 0.22\n", start.Add(90*time.Second))
+	if got := eval(start.Add(2 * time.Minute)); len(got) != 0 {
+		t.Errorf("got %v, want the alert resolved", got)
+	}
+}
+
+func TestScrapeStoresAlerts(t *testing.T) {
+	data := NewPeriodicData(&scrapesSource{scrapes: [][]byte{testData[0], testData[1]}}, DefaultEngineOptions(time.Minute, 1000))
+	rule, err := ParseAlert("crackers > 10")
+	if err != nil {
+		t.Fatalf("unable to parse alert: %v", err)
+	}
+	if data.Alerter, err = NewAlerter([]AlertingRule{rule}); err != nil {
+		t.Fatalf("unable to create alerter: %v", err)
+	}
+	var alerts []Alert
+	data.AlertsCallback = func(a []Alert) {
+		alerts = a
+	}
+	data.Times = Range{Instant: true}
+	if err := data.SetQuery(context.TODO(), "ALERTS"); err != nil {
+		t.Fatalf("unable to set query: %v", err)
+	}
+	var res promql.Vector
+	data.Callback = func(r *promql.Result) error {
+		var err error
+		res, err = r.Vector()
+		return err
+	}
+	// the alerts are evaluated over what was there before each scrape
+	if err := data.Scrape(context.TODO()); err != nil {
+		t.Fatalf("unable to scrape: %v", err)
+	}
+	if len(res) != 0 || len(alerts) != 0 {
+		t.Errorf("got %v and %v, want no alerts before we've scraped anything", res, alerts)
+	}
+	if err := data.Scrape(context.TODO()); err != nil {
+		t.Fatalf("unable to scrape: %v", err)
+	}
+	if len(res) != 1 || res[0].Metric.Get(AlertStateLabel) != string(AlertFiring) {
+		t.Errorf("got %v, want the triscuit alert firing", res)
+	}
+	if len(alerts) != 1 || alerts[0].Labels.Get("name") != "triscuit" {
+		t.Errorf("got %+v, want the triscuit alert", alerts)
+	}
+}
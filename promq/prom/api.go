@@ -0,0 +1,288 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/textparse"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// Backend runs queries somewhere other than over the data we've scraped ourselves.
+type Backend interface {
+	ExecuteInstantQuery(ctx context.Context, query string, ts time.Time, cb ResultsCallback) error
+	ExecuteRangeQuery(ctx context.Context, query string, start, end time.Time, step time.Duration, cb ResultsCallback) error
+}
+
+// APIBackend forwards queries to a prometheus server's HTTP API, making its results
+// look like our engine's, so that we can chart anything the server has. As a
+// DataSource, it gives the server's metrics, for autocompletion, but no samples.
+type APIBackend struct {
+	url    string
+	client *http.Client
+	// Headers are sent with every call, i.e. the X-Scope-OrgID of a Cortex or Mimir
+	// tenant
+	Headers map[string]string
+}
+
+var (
+	_ Backend    = &APIBackend{}
+	_ DataSource = &APIBackend{}
+)
+
+// NewAPIBackend queries the prometheus server at url, i.e. http://prometheus:9090.
+func NewAPIBackend(url string, client *http.Client) *APIBackend {
+	return &APIBackend{url: strings.TrimSuffix(url, "/"), client: client}
+}
+
+func (b *APIBackend) ExecuteInstantQuery(ctx context.Context, query string, ts time.Time, cb ResultsCallback) error {
+	return cb(b.query(ctx, "/api/v1/query", url.Values{
+		"query": {query},
+		"time":  {formatAPITime(ts)},
+	}))
+}
+
+func (b *APIBackend) ExecuteRangeQuery(ctx context.Context, query string, start, end time.Time, step time.Duration, cb ResultsCallback) error {
+	return cb(b.query(ctx, "/api/v1/query_range", url.Values{
+		"query": {query},
+		"start": {formatAPITime(start)},
+		"end":   {formatAPITime(end)},
+		"step":  {strconv.FormatFloat(step.Seconds(), 'f', -1, 64)},
+	}))
+}
+
+// ScrapePrometheusEndpoint gives a series for each metric the server knows about, with
+// its type and help, so that we can autocomplete them. They have no samples to speak of.
+func (b *APIBackend) ScrapePrometheusEndpoint(ctx context.Context, nowish time.Time) ([]ParsedSeries, error) {
+	var names []string
+	if err := b.get(ctx, "/api/v1/label/__name__/values", nil, &names); err != nil {
+		return nil, err
+	}
+	var metadata map[string][]struct {
+		Type string `json:"type"`
+		Help string `json:"help"`
+		Unit string `json:"unit"`
+	}
+	// older servers don't have metadata, it's nice to have rather than essential
+	if err := b.get(ctx, "/api/v1/metadata", nil, &metadata); err != nil {
+		metadata = nil
+	}
+	series := make([]ParsedSeries, 0, len(names))
+	for _, name := range names {
+		s := ParsedSeries{
+			Labels:    labels.FromStrings(labels.MetricName, name),
+			Value:     math.NaN(),
+			Timestamp: PromTimestamp(nowish),
+			Type:      textparse.MetricTypeUnknown,
+		}
+		family := name
+		if _, ok := metadata[family]; !ok {
+			for _, suffix := range []string{"_bucket", "_sum", "_count", "_total", "_created"} {
+				if trimmed := strings.TrimSuffix(name, suffix); trimmed != name {
+					if _, ok := metadata[trimmed]; ok {
+						family = trimmed
+						break
+					}
+				}
+			}
+		}
+		if md := metadata[family]; len(md) > 0 {
+			s.Type, s.Help, s.Unit = textparse.MetricType(md[0].Type), md[0].Help, md[0].Unit
+			s.Stability = ParseStabilityLevel(s.Help)
+		}
+		series = append(series, s)
+	}
+	return series, nil
+}
+
+type apiResponse struct {
+	Status    string          `json:"status"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	ErrorType string          `json:"errorType,omitempty"`
+	Error     string          `json:"error,omitempty"`
+	Warnings  []string        `json:"warnings,omitempty"`
+}
+
+// apiQueryData is the data of the response to a query
+type apiQueryData struct {
+	ResultType string          `json:"resultType"`
+	Result     json.RawMessage `json:"result"`
+}
+
+// get calls an endpoint of the API, decoding the data of its response into v.
+func (b *APIBackend) get(ctx context.Context, path string, params url.Values, v interface{}) error {
+	_, err := b.call(ctx, path, params, v)
+	return err
+}
+
+func (b *APIBackend) call(ctx context.Context, path string, params url.Values, v interface{}) ([]string, error) {
+	u := b.url + path
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to construct prometheus API request: %w", err)
+	}
+	for name, value := range b.Headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to call prometheus API: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read prometheus API response: %w", err)
+	}
+	var apiResp apiResponse
+	if err := json.Unmarshal(body, &apiResp); err != nil {
+		return nil, fmt.Errorf("unable to decode prometheus API response (%s): %w", resp.Status, err)
+	}
+	if apiResp.Status != "success" {
+		return apiResp.Warnings, fmt.Errorf("prometheus API returned %s: %s", apiResp.ErrorType, apiResp.Error)
+	}
+	if err := json.Unmarshal(apiResp.Data, v); err != nil {
+		return apiResp.Warnings, fmt.Errorf("unable to decode prometheus API response: %w", err)
+	}
+	return apiResp.Warnings, nil
+}
+
+// query runs a query and makes its result look like our engine's
+func (b *APIBackend) query(ctx context.Context, path string, params url.Values) *promql.Result {
+	var data apiQueryData
+	warnings, err := b.call(ctx, path, params, &data)
+	res := &promql.Result{}
+	for _, w := range warnings {
+		res.Warnings = append(res.Warnings, errors.New(w))
+	}
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	res.Value, res.Err = decodeAPIValue(data.ResultType, data.Result)
+	return res
+}
+
+type apiSeries struct {
+	Metric map[string]string `json:"metric"`
+	Value  apiPoint          `json:"value"`
+	Values []apiPoint        `json:"values"`
+}
+
+// apiPoint is a [timestamp, "value"] pair, timestamps are in seconds
+type apiPoint struct {
+	T int64
+	V string
+}
+
+func (p *apiPoint) UnmarshalJSON(data []byte) error {
+	var pair []interface{}
+	if err := json.Unmarshal(data, &pair); err != nil {
+		return err
+	}
+	if len(pair) != 2 {
+		return fmt.Errorf("expected a timestamp and a value, not %s", data)
+	}
+	ts, ok := pair[0].(float64)
+	v, isString := pair[1].(string)
+	if !ok || !isString {
+		return fmt.Errorf("expected a timestamp and a value, not %s", data)
+	}
+	p.T, p.V = int64(math.Round(ts*1000)), v
+	return nil
+}
+
+func (p apiPoint) point() (promql.Point, error) {
+	v, err := strconv.ParseFloat(p.V, 64)
+	if err != nil {
+		return promql.Point{}, fmt.Errorf("invalid sample value %q: %w", p.V, err)
+	}
+	return promql.Point{T: p.T, V: v}, nil
+}
+
+func decodeAPIValue(resultType string, result json.RawMessage) (parser.Value, error) {
+	switch resultType {
+	case "matrix":
+		var series []apiSeries
+		if err := json.Unmarshal(result, &series); err != nil {
+			return nil, err
+		}
+		matrix := make(promql.Matrix, 0, len(series))
+		for _, s := range series {
+			out := promql.Series{Metric: labels.FromMap(s.Metric)}
+			for _, v := range s.Values {
+				pt, err := v.point()
+				if err != nil {
+					return nil, err
+				}
+				out.Points = append(out.Points, pt)
+			}
+			matrix = append(matrix, out)
+		}
+		return matrix, nil
+	case "vector":
+		var series []apiSeries
+		if err := json.Unmarshal(result, &series); err != nil {
+			return nil, err
+		}
+		vector := make(promql.Vector, 0, len(series))
+		for _, s := range series {
+			pt, err := s.Value.point()
+			if err != nil {
+				return nil, err
+			}
+			vector = append(vector, promql.Sample{Point: pt, Metric: labels.FromMap(s.Metric)})
+		}
+		return vector, nil
+	case "scalar":
+		var p apiPoint
+		if err := json.Unmarshal(result, &p); err != nil {
+			return nil, err
+		}
+		pt, err := p.point()
+		if err != nil {
+			return nil, err
+		}
+		return promql.Scalar{T: pt.T, V: pt.V}, nil
+	case "string":
+		var p apiPoint
+		if err := json.Unmarshal(result, &p); err != nil {
+			return nil, err
+		}
+		return promql.String{T: p.T, V: p.V}, nil
+	}
+	return nil, fmt.Errorf("unknown result type %q", resultType)
+}
+
+func formatAPITime(t time.Time) string {
+	return strconv.FormatFloat(float64(t.UnixNano())/float64(time.Second), 'f', -1, 64)
+}
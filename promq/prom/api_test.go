@@ -0,0 +1,126 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/textparse"
+	"github.com/prometheus/prometheus/promql"
+)
+
+func newTestAPI(t *testing.T) *httptest.Server {
+	responses := map[string]string{
+		"/api/v1/query":                 `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up","job":"apiserver"},"value":[1000.5,"1"]}]}}`,
+		"/api/v1/query_range":           `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"job":"apiserver"},"values":[[1000,"1"],[1015,"NaN"]]}]},"warnings":["it's a bit slow"]}`,
+		"/api/v1/label/__name__/values": `{"status":"success","data":["requests_total","up"]}`,
+		"/api/v1/metadata":              `{"status":"success","data":{"requests":[{"type":"counter","help":"[STABLE] requests","unit":""}]}}`,
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("query") == "invalid(" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"status":"error","errorType":"bad_data","error":"unexpected end of input"}`)
+			return
+		}
+		resp, ok := responses[r.URL.Path]
+		if !ok {
+			t.Errorf("unexpected request for %s", r.URL)
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, resp)
+	}))
+}
+
+func TestAPIBackendQueries(t *testing.T) {
+	server := newTestAPI(t)
+	defer server.Close()
+	backend := NewAPIBackend(server.URL+"/", server.Client())
+
+	var res *promql.Result
+	keep := func(r *promql.Result) error {
+		res = r
+		return nil
+	}
+	if err := backend.ExecuteInstantQuery(context.TODO(), "up", time.Unix(1000, 0), keep); err != nil {
+		t.Fatalf("unable to run instant query: %v", err)
+	}
+	wantVector := promql.Vector{{Point: promql.Point{T: 1000500, V: 1}, Metric: labels.FromStrings("__name__", "up", "job", "apiserver")}}
+	if res.Err != nil || !reflect.DeepEqual(res.Value, wantVector) {
+		t.Errorf("got %v, %v, want %v", res.Value, res.Err, wantVector)
+	}
+
+	if err := backend.ExecuteRangeQuery(context.TODO(), "sum by (job) (up)", time.Unix(1000, 0), time.Unix(1015, 0), 15*time.Second, keep); err != nil {
+		t.Fatalf("unable to run range query: %v", err)
+	}
+	matrix, err := res.Matrix()
+	if err != nil || len(matrix) != 1 || len(matrix[0].Points) != 2 || matrix[0].Points[1].T != 1015000 || len(res.Warnings) != 1 {
+		t.Errorf("got %v, %v with warnings %v, want a series of two points and a warning", res.Value, err, res.Warnings)
+	}
+
+	if err := backend.ExecuteInstantQuery(context.TODO(), "invalid(", time.Unix(1000, 0), keep); err != nil {
+		t.Fatalf("unable to run instant query: %v", err)
+	}
+	if res.Err == nil {
+		t.Errorf("expected the error from the API in the result")
+	}
+}
+
+func TestAPIBackendHeaders(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tenant := r.Header.Get("X-Scope-OrgID"); tenant != "tenant-1" {
+			t.Errorf("got tenant %q, want the tenant-1 of the backend's headers", tenant)
+		}
+		fmt.Fprint(w, `{"status":"success","data":{"resultType":"vector","result":[]}}`)
+	}))
+	defer server.Close()
+	backend := NewAPIBackend(server.URL, server.Client())
+	backend.Headers = map[string]string{"X-Scope-Orgid": "tenant-1"}
+
+	err := backend.ExecuteInstantQuery(context.TODO(), "up", time.Unix(1000, 0), func(res *promql.Result) error {
+		return res.Err
+	})
+	if err != nil {
+		t.Errorf("unable to run instant query: %v", err)
+	}
+}
+
+func TestAPIBackendMetrics(t *testing.T) {
+	server := newTestAPI(t)
+	defer server.Close()
+	backend := NewAPIBackend(server.URL, server.Client())
+	series, err := backend.ScrapePrometheusEndpoint(context.TODO(), time.Now())
+	if err != nil {
+		t.Fatalf("unable to list metrics: %v", err)
+	}
+	if len(series) != 2 {
+		t.Fatalf("got %v, want a series for each metric", series)
+	}
+	if name, typ, level := series[0].Labels.Get(labels.MetricName), series[0].Type, series[0].Stability; name != "requests_total" || typ != textparse.MetricTypeCounter || level != StabilityStable {
+		t.Errorf("got %s, a %s of %q stability, want the metadata of its family", name, typ, level)
+	}
+	if typ := series[1].Type; typ != textparse.MetricTypeUnknown {
+		t.Errorf("got %s for up, which has no metadata", typ)
+	}
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Budget is how much we're willing to keep in memory, so that pointing us at an
+// endpoint with a lot of series doesn't run us out of it. Zero is no limit.
+type Budget struct {
+	MaxSeries int
+	MaxBytes  int64
+}
+
+func (b Budget) String() string {
+	var limits []string
+	if b.MaxSeries > 0 {
+		limits = append(limits, fmt.Sprintf("%d series", b.MaxSeries))
+	}
+	if b.MaxBytes > 0 {
+		limits = append(limits, fmt.Sprintf("%d bytes", b.MaxBytes))
+	}
+	if len(limits) == 0 {
+		return "unlimited"
+	}
+	return strings.Join(limits, ", ")
+}
+
+// NewRangeStorageWithBudget keeps what's loaded in memory, like NewRangeStorage, but
+// evicts the series which were queried least recently when there's more than the
+// budget allows. Queries warn when the last load evicted anything.
+func NewRangeStorageWithBudget(budget Budget) *rangeStorage {
+	s := NewRangeStorage()
+	s.budget = budget
+	return s
+}
+
+// size is roughly how many bytes the series takes up.
+func (b *seriesData) size() int64 {
+	// the slice headers, the map entries and the postings, give or take
+	size := int64(200 + 16*cap(b.data) + 56*cap(b.buckets) + 8*cap(b.resets))
+	for _, l := range b.series {
+		size += int64(32 + len(l.Name) + len(l.Value))
+	}
+	return size
+}
+
+// enforceBudget evicts series until we're within the budget, returning how many.
+func (s *rangeStorage) enforceBudget() int {
+	if s.budget.MaxSeries <= 0 && s.budget.MaxBytes <= 0 {
+		return 0
+	}
+	var size int64
+	refs := make([]uint64, 0, len(s.data))
+	for ref, block := range s.data {
+		refs = append(refs, ref)
+		if s.budget.MaxBytes > 0 {
+			size += block.size()
+		}
+	}
+	over := func() bool {
+		return (s.budget.MaxSeries > 0 && len(s.data) > s.budget.MaxSeries) || (s.budget.MaxBytes > 0 && size > s.budget.MaxBytes)
+	}
+	if !over() {
+		return 0
+	}
+	// the least recently queried first, and of those, the newest, since they're the
+	// least likely to be part of what's on screen
+	sort.Slice(refs, func(i, j int) bool {
+		a, b := s.data[refs[i]], s.data[refs[j]]
+		if a.lastQueried != b.lastQueried {
+			return a.lastQueried < b.lastQueried
+		}
+		return refs[i] > refs[j]
+	})
+	evicted := make(map[uint64]struct{})
+	for _, ref := range refs {
+		if !over() {
+			break
+		}
+		size -= s.data[ref].size()
+		s.forget(ref)
+		evicted[ref] = struct{}{}
+	}
+	s.postings.Delete(evicted)
+	return len(evicted)
+}
+
+// forget drops a series entirely, bar its postings, which are best deleted in bulk,
+// so that if it comes back, it's added again as if it were new.
+func (s *rangeStorage) forget(ref uint64) {
+	block := s.data[ref]
+	delete(s.data, ref)
+	s.series.del(block.series.Hash(), block.series)
+	delete(s.lastBatch, ref)
+}
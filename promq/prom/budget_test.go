@@ -0,0 +1,101 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+func TestBudgetEvictsLeastRecentlyQueried(t *testing.T) {
+	start := time.Unix(0, 0)
+	s := NewRangeStorageWithBudget(Budget{MaxSeries: 3})
+	load := func(raw string, at time.Duration) {
+		points, err := ParseTextData([]byte(raw), start.Add(at))
+		if err != nil {
+			t.Fatalf("unable to parse data: %v", err)
+		}
+		if err := s.LoadData(points); err != nil {
+			t.Fatalf("unable to load data: %v", err)
+		}
+	}
+	query := func(name string) (int, []string) {
+		q, err := s.Querier(context.TODO(), 0, 0)
+		if err != nil {
+			t.Fatalf("unable to query: %v", err)
+		}
+		set := q.Select(false, nil, labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, name))
+		found := 0
+		for set.Next() {
+			found++
+		}
+		var warnings []string
+		for _, w := range set.Warnings() {
+			warnings = append(warnings, w.Error())
+		}
+		return found, warnings
+	}
+
+	load("cheese 1\ncrackers 1\ntea 1\n", time.Second)
+	if found, warnings := query("cheese"); found != 1 || len(warnings) != 0 {
+		t.Errorf("got %d series and warnings %v within the budget, want cheese and no warnings", found, warnings)
+	}
+	query("tea")
+
+	load("cheese 2\ncrackers 2\ntea 2\nwine 2\n", 2*time.Second)
+	if len(s.data) != 3 {
+		t.Errorf("got %d series, want the budget's 3", len(s.data))
+	}
+	for _, name := range []string{"cheese", "tea", "crackers"} {
+		found, warnings := query(name)
+		if found != 1 {
+			t.Errorf("got %d series for %s, want it kept", found, name)
+		}
+		if len(warnings) != 1 || !strings.Contains(warnings[0], "dropped the 1 series") {
+			t.Errorf("got warnings %v, want one about the evicted series", warnings)
+		}
+	}
+	// neither's been queried, so the newest is evicted
+	if wine, _ := query("wine"); wine != 0 {
+		t.Errorf("got %d series for wine, want it evicted", wine)
+	}
+}
+
+func TestBudgetBytes(t *testing.T) {
+	s := NewRangeStorageWithBudget(Budget{MaxBytes: 10000})
+	for i := 0; i < 100; i++ {
+		points, err := ParseTextData([]byte(fmt.Sprintf("cheese{id=\"%d\"} 1\n", i)), time.Unix(0, 0))
+		if err != nil {
+			t.Fatalf("unable to parse data: %v", err)
+		}
+		if err := s.LoadData(points); err != nil {
+			t.Fatalf("unable to load data: %v", err)
+		}
+	}
+	var size int64
+	for _, block := range s.data {
+		size += block.size()
+	}
+	if size > 10000 || len(s.data) == 0 {
+		t.Errorf("got %d series taking up %d bytes, want as many as fit in 10000", len(s.data), size)
+	}
+}
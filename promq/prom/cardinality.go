@@ -0,0 +1,96 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"sort"
+
+	"sigs.k8s.io/instrumentation-tools/notstdlib/sets"
+)
+
+// CardinalityCount is how many series, or distinct values, something has.
+type CardinalityCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// Cardinality is how many series we've indexed, and where they come from, like the
+// TSDB status of prometheus, so that label explosions can be spotted.
+type Cardinality struct {
+	// TotalSeries is how many series there are, and TotalLabelPairs how many distinct
+	// label name and value pairs they have between them
+	TotalSeries     int `json:"totalSeries"`
+	TotalLabelPairs int `json:"totalLabelPairs"`
+	// SeriesCountByMetricName is how many series each metric has, most first
+	SeriesCountByMetricName []CardinalityCount `json:"seriesCountByMetricName"`
+	// LabelValueCountByLabelName is how many distinct values each label has across
+	// every metric, most first
+	LabelValueCountByLabelName []CardinalityCount `json:"labelValueCountByLabelName"`
+}
+
+// GetCardinality returns how many series there are, by metric, and how many values
+// each label has, keeping only the top limit of each, or all of them if it's zero.
+func (i *indexer) GetCardinality(limit int) Cardinality {
+	i.metricNameMu.RLock()
+	defer i.metricNameMu.RUnlock()
+	var c Cardinality
+	values := map[string]sets.String{}
+	for name, series := range i.series {
+		c.TotalSeries += len(series)
+		c.SeriesCountByMetricName = append(c.SeriesCountByMetricName, CardinalityCount{Name: name, Count: len(series)})
+		for label, vs := range i.store[name] {
+			if _, ok := values[label]; !ok {
+				values[label] = sets.NewString()
+			}
+			values[label].Insert(vs.UnsortedList()...)
+		}
+	}
+	for label, vs := range values {
+		c.TotalLabelPairs += vs.Len()
+		c.LabelValueCountByLabelName = append(c.LabelValueCountByLabelName, CardinalityCount{Name: label, Count: vs.Len()})
+	}
+	c.SeriesCountByMetricName = topCounts(c.SeriesCountByMetricName, limit)
+	c.LabelValueCountByLabelName = topCounts(c.LabelValueCountByLabelName, limit)
+	return c
+}
+
+// GetLabelCardinalityForMetric returns how many distinct values each label of a metric
+// has, most first.
+func (i *indexer) GetLabelCardinalityForMetric(metricName string) []CardinalityCount {
+	i.metricNameMu.RLock()
+	defer i.metricNameMu.RUnlock()
+	var counts []CardinalityCount
+	for label, vs := range i.store[metricName] {
+		counts = append(counts, CardinalityCount{Name: label, Count: vs.Len()})
+	}
+	return topCounts(counts, 0)
+}
+
+// topCounts sorts counts, most first, and then by name, and keeps the top limit, or
+// all of them if it's zero.
+func topCounts(counts []CardinalityCount, limit int) []CardinalityCount {
+	sort.Slice(counts, func(a, b int) bool {
+		if counts[a].Count != counts[b].Count {
+			return counts[a].Count > counts[b].Count
+		}
+		return counts[a].Name < counts[b].Name
+	})
+	if limit > 0 && len(counts) > limit {
+		counts = counts[:limit]
+	}
+	return counts
+}
@@ -0,0 +1,65 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCardinality(t *testing.T) {
+	index := NewIndex()
+	points, err := ParseTextData(testData[0], time.Now())
+	if err != nil {
+		t.Fatalf("invalid raw data: %v", err)
+	}
+	for _, p := range points {
+		index.UpdateMetric(p)
+	}
+
+	got := index.GetCardinality(0)
+	want := Cardinality{
+		TotalSeries: 5,
+		// sharpness has 3 values, adj 2, and crunchy and name 1 each
+		TotalLabelPairs: 7,
+		SeriesCountByMetricName: []CardinalityCount{
+			{Name: "cheese", Count: 4},
+			{Name: "crackers", Count: 1},
+		},
+		LabelValueCountByLabelName: []CardinalityCount{
+			{Name: "sharpness", Count: 3},
+			{Name: "adj", Count: 2},
+			{Name: "crunchy", Count: 1},
+			{Name: "name", Count: 1},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got cardinality %+v, want %+v", got, want)
+	}
+	if got := index.GetCardinality(1); len(got.SeriesCountByMetricName) != 1 || len(got.LabelValueCountByLabelName) != 1 || got.TotalSeries != 5 {
+		t.Errorf("got %+v, want only the top metric and label, but the same totals", got)
+	}
+
+	wantLabels := []CardinalityCount{{Name: "sharpness", Count: 3}, {Name: "adj", Count: 2}}
+	if got := index.GetLabelCardinalityForMetric("cheese"); !reflect.DeepEqual(got, wantLabels) {
+		t.Errorf("got label cardinality %v for cheese, want %v", got, wantLabels)
+	}
+	if got := index.GetLabelCardinalityForMetric("biscuits"); len(got) != 0 {
+		t.Errorf("got label cardinality %v for a metric we've never seen", got)
+	}
+}
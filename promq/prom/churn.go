@@ -0,0 +1,76 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// Churn is how the series scraped changed from one scrape to the next, i.e. those of
+// the pods of a rollout coming and going, or a label exploding.
+type Churn struct {
+	// At and Since are the prometheus timestamps of the scrapes, both zero until there
+	// have been two of them
+	At, Since int64
+	// Appeared are the series which weren't in the scrape before, Disappeared those
+	// which aren't in the scrape any more, both sorted
+	Appeared    []labels.Labels
+	Disappeared []labels.Labels
+}
+
+// ForMetric is the churn of the series of the given metric only.
+func (c Churn) ForMetric(name string) Churn {
+	filter := func(series []labels.Labels) []labels.Labels {
+		var kept []labels.Labels
+		for _, ls := range series {
+			if ls.Get(labels.MetricName) == name {
+				kept = append(kept, ls)
+			}
+		}
+		return kept
+	}
+	return Churn{At: c.At, Since: c.Since, Appeared: filter(c.Appeared), Disappeared: filter(c.Disappeared)}
+}
+
+// FormatChurn lists the series which appeared, with a +, and disappeared, with a -,
+// like a diff, at most limit of each, or all of them if limit isn't positive.
+func FormatChurn(c Churn, limit int) string {
+	if c.At == 0 {
+		return "there haven't been two scrapes to compare yet\n"
+	}
+	at := func(ts int64) string {
+		return time.Unix(0, ts*int64(time.Millisecond)).Format("15:04:05")
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%d series appeared and %d disappeared between the scrapes at %s and %s\n", len(c.Appeared), len(c.Disappeared), at(c.Since), at(c.At))
+	list := func(prefix string, series []labels.Labels) {
+		for i, ls := range series {
+			if limit > 0 && i == limit {
+				fmt.Fprintf(&sb, "%s ...and %d more\n", prefix, len(series)-limit)
+				return
+			}
+			fmt.Fprintf(&sb, "%s %s\n", prefix, openMetricsSeries(ls.Get(labels.MetricName), ls))
+		}
+	}
+	list("+", c.Appeared)
+	list("-", c.Disappeared)
+	return sb.String()
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+const (
+	// ComparisonLabel tells the results of a query apart from those of it run the
+	// CompareOffset ago, when they're compared.
+	ComparisonLabel = "comparison"
+	// comparisonNow is the ComparisonLabel of the results of the query as it is now
+	comparisonNow = "now"
+)
+
+// ComparisonValue is the ComparisonLabel of the results of a query run the given
+// offset ago, i.e. "1d ago".
+func ComparisonValue(offset time.Duration) string {
+	return model.Duration(offset).String() + " ago"
+}
+
+// withComparison runs the query as it was the CompareOffset ago, and adds its results,
+// shifted forward onto now, to those of the query, so that they're charted over each
+// other.
+func (q *PeriodicData) withComparison(ctx context.Context, now time.Time, cb ResultsCallback) (ResultsCallback, error) {
+	var earlier parser.Value
+	err := q.execute(ctx, now, q.CompareOffset, func(res *promql.Result) error {
+		if res.Err != nil {
+			return res.Err
+		}
+		// the results are only valid until we return, so this copies them
+		earlier = shiftValue(res.Value, q.CompareOffset, ComparisonValue(q.CompareOffset))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to run the query %v ago: %w", model.Duration(q.CompareOffset), err)
+	}
+	return func(res *promql.Result) error {
+		if res.Err == nil {
+			res.Value = combineValues(shiftValue(res.Value, 0, comparisonNow), earlier)
+		}
+		return cb(res)
+	}, nil
+}
+
+// shiftValue copies the series of a result with their samples moved the given offset
+// later, and their ComparisonLabel set to the given value. Anything other than series
+// is left as it is.
+func shiftValue(value parser.Value, offset time.Duration, comparison string) parser.Value {
+	shift := int64(offset / time.Millisecond)
+	switch value := value.(type) {
+	case promql.Matrix:
+		shifted := make(promql.Matrix, len(value))
+		for i, series := range value {
+			points := make([]promql.Point, len(series.Points))
+			for j, pt := range series.Points {
+				points[j] = promql.Point{T: pt.T + shift, V: pt.V}
+			}
+			shifted[i] = promql.Series{Metric: withComparisonLabel(series.Metric, comparison), Points: points}
+		}
+		return shifted
+	case promql.Vector:
+		shifted := make(promql.Vector, len(value))
+		for i, sample := range value {
+			shifted[i] = promql.Sample{
+				Metric: withComparisonLabel(sample.Metric, comparison),
+				Point:  promql.Point{T: sample.T + shift, V: sample.V},
+			}
+		}
+		return shifted
+	}
+	return value
+}
+
+func withComparisonLabel(lset labels.Labels, comparison string) labels.Labels {
+	return labels.NewBuilder(lset).Set(ComparisonLabel, comparison).Labels()
+}
+
+// combineValues adds the series of the earlier results to the current ones, if they're
+// both series of the same type, i.e. a scalar can't be compared.
+func combineValues(current, earlier parser.Value) parser.Value {
+	switch current := current.(type) {
+	case promql.Matrix:
+		if earlier, ok := earlier.(promql.Matrix); ok {
+			return append(current, earlier...)
+		}
+	case promql.Vector:
+		if earlier, ok := earlier.(promql.Vector); ok {
+			return append(current, earlier...)
+		}
+	}
+	return current
+}
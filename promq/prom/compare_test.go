@@ -0,0 +1,69 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/promql"
+)
+
+func TestCompareOffset(t *testing.T) {
+	start := time.Unix(0, 0)
+	data := NewPeriodicData(nil, DefaultEngineOptions(time.Minute, 1000))
+	for i := 1; i <= 10; i++ {
+		points, err := ParseTextData([]byte(fmt.Sprintf("temperature %d\n", i)), start.Add(time.Duration(i)*time.Second))
+		if err != nil {
+			t.Fatalf("unable to parse data: %v", err)
+		}
+		if err := data.storage.LoadData(points); err != nil {
+			t.Fatalf("unable to load data: %v", err)
+		}
+	}
+	if err := data.SetQuery(context.TODO(), "temperature"); err != nil {
+		t.Fatalf("unable to set query: %v", err)
+	}
+	data.Times = Range{Start: start.Add(7 * time.Second), End: start.Add(8 * time.Second), Interval: time.Second}
+	data.CompareOffset = 5 * time.Second
+
+	got := map[string][]promql.Point{}
+	err := data.ManuallyExecuteQuery(context.TODO(), func(res *promql.Result) error {
+		matrix, err := res.Matrix()
+		if err != nil {
+			return err
+		}
+		for _, series := range matrix {
+			got[series.Metric.Get(ComparisonLabel)] = series.Points
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unable to execute query: %v", err)
+	}
+	want := map[string][]promql.Point{
+		"now": {{T: 7000, V: 7}, {T: 8000, V: 8}},
+		// what it was 5s before, charted over now
+		"5s ago": {{T: 7000, V: 2}, {T: 8000, V: 3}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got series %v, want %v", got, want)
+	}
+}
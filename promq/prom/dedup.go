@@ -0,0 +1,182 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// DedupingSource merges the series of the replicas of a component scraped at once, i.e.
+// of an HA pair, like Thanos does for those of prometheus. The replica labels are
+// dropped, and of the series which are then the same, only those of one replica are
+// kept, so that a sum doesn't count everything twice. Like Thanos' replica penalty,
+// a series sticks to the replica it was first taken from until that replica goes
+// missing, so that the counters of different replicas don't interleave into resets.
+// The up series and such of the replicas are left be, they're about the replicas
+// themselves.
+type DedupingSource struct {
+	source        DataSource
+	replicaLabels []string
+
+	// mu guards replicas, and is held for the whole of a scrape
+	mu sync.Mutex
+	// replicas are the replica (i.e. the values of its replica labels) each deduped
+	// series is taken from
+	replicas map[string]string
+}
+
+var _ QueryAwareSource = &DedupingSource{}
+var _ StreamingSource = &DedupingSource{}
+
+// NewDedupingSource dedups the series of the source by dropping the given replica
+// labels, the instance label if there aren't any.
+func NewDedupingSource(source DataSource, replicaLabels ...string) *DedupingSource {
+	if len(replicaLabels) == 0 {
+		replicaLabels = []string{labels.InstanceName}
+	}
+	return &DedupingSource{source: source, replicaLabels: replicaLabels, replicas: map[string]string{}}
+}
+
+// dedupScrape is what a scrape has had of each deduped series so far.
+type dedupScrape struct {
+	// kept are the series whose replica has been scraped
+	kept map[string]bool
+	// standby are the samples of the first other replica of each series, in case its
+	// replica doesn't turn up, in the order they did
+	standby        map[string][]ParsedSeries
+	standbyReplica map[string]string
+	standbyOrder   []string
+}
+
+func (s *DedupingSource) ScrapePrometheusEndpoint(ctx context.Context, nowish time.Time) ([]ParsedSeries, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	series, err := s.source.ScrapePrometheusEndpoint(ctx, nowish)
+	// one of the replicas being down is what they're there for
+	if _, ok := ScrapeWarnings(err); !ok {
+		return series, err
+	}
+	kept := make([]ParsedSeries, 0, len(series))
+	scrape := newDedupScrape()
+	for _, ps := range series {
+		if ps, ok := s.dedup(ps, scrape); ok {
+			kept = append(kept, ps)
+		}
+	}
+	return append(kept, s.endScrape(scrape)...), err
+}
+
+// StreamPrometheusEndpoint dedups the series of the source as they're streamed. The
+// series of the other replicas are held back until the end of the scrape, in case
+// they're needed.
+func (s *DedupingSource) StreamPrometheusEndpoint(ctx context.Context, nowish time.Time, add func(ParsedSeries) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	scrape := newDedupScrape()
+	err := StreamSource(ctx, s.source, nowish, func(ps ParsedSeries) error {
+		if ps, ok := s.dedup(ps, scrape); ok {
+			return add(ps)
+		}
+		return nil
+	})
+	if _, ok := ScrapeWarnings(err); !ok {
+		return err
+	}
+	for _, ps := range s.endScrape(scrape) {
+		if err := add(ps); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func newDedupScrape() *dedupScrape {
+	return &dedupScrape{
+		kept:           map[string]bool{},
+		standby:        map[string][]ParsedSeries{},
+		standbyReplica: map[string]string{},
+	}
+}
+
+// dedup drops the replica labels of a series, returning false if it isn't from the
+// replica the series is taken from, in which case it may be kept on standby.
+func (s *DedupingSource) dedup(ps ParsedSeries, scrape *dedupScrape) (ParsedSeries, bool) {
+	if isScrapeHealth(ps) {
+		return ps, true
+	}
+	replicaValues := make([]string, len(s.replicaLabels))
+	for i, name := range s.replicaLabels {
+		replicaValues[i] = ps.Labels.Get(name)
+	}
+	replica := strings.Join(replicaValues, "\xff")
+	lb := labels.NewBuilder(ps.Labels)
+	lb.Del(s.replicaLabels...)
+	ps.Labels = lb.Labels()
+	key := ps.Labels.String()
+
+	if _, known := s.replicas[key]; !known {
+		s.replicas[key] = replica
+	}
+	if s.replicas[key] == replica {
+		scrape.kept[key] = true
+		return ps, true
+	}
+	if scrape.kept[key] {
+		return ps, false
+	}
+	if standby, ok := scrape.standbyReplica[key]; !ok {
+		scrape.standbyReplica[key] = replica
+		scrape.standbyOrder = append(scrape.standbyOrder, key)
+	} else if standby != replica {
+		return ps, false
+	}
+	scrape.standby[key] = append(scrape.standby[key], ps)
+	return ps, false
+}
+
+// endScrape returns the series on standby whose replica went missing, taking them
+// from the standby's replica from now on, and forgets the series which weren't
+// scraped at all.
+func (s *DedupingSource) endScrape(scrape *dedupScrape) []ParsedSeries {
+	var switched []ParsedSeries
+	for _, key := range scrape.standbyOrder {
+		if scrape.kept[key] {
+			continue
+		}
+		s.replicas[key] = scrape.standbyReplica[key]
+		switched = append(switched, scrape.standby[key]...)
+	}
+	for key := range s.replicas {
+		if _, standby := scrape.standbyReplica[key]; !scrape.kept[key] && !standby {
+			delete(s.replicas, key)
+		}
+	}
+	return switched
+}
+
+// SetQuery passes the query on, if the source only fetches what it needs.
+func (s *DedupingSource) SetQuery(query string) error {
+	if qs, ok := s.source.(QueryAwareSource); ok {
+		return qs.SetQuery(query)
+	}
+	return nil
+}
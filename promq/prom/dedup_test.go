@@ -0,0 +1,129 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// seriesSource scrapes the same series every time.
+type seriesSource []ParsedSeries
+
+func (s seriesSource) ScrapePrometheusEndpoint(_ context.Context, _ time.Time) ([]ParsedSeries, error) {
+	return s, nil
+}
+
+func TestDedupingSource(t *testing.T) {
+	now := time.Unix(1591005600, 0)
+	var series []ParsedSeries
+	for _, replica := range []struct {
+		instance string
+		data     string
+	}{
+		{instance: "scheduler-1", data: "cheese 1\ncrackers 2 1591005500000\n"},
+		// only the replica has tea, so that's taken from it
+		{instance: "scheduler-2", data: "cheese 3\ncrackers 4 1591005501000\ntea 5\n"},
+	} {
+		parsed, err := ParseTextDataWithAdditionalLabels([]byte(replica.data), now, map[string]string{labels.InstanceName: replica.instance})
+		if err != nil {
+			t.Fatalf("invalid raw data: %v", err)
+		}
+		series = append(append(series, parsed...), ScrapeHealth(map[string]string{labels.InstanceName: replica.instance}, now, time.Second, len(parsed), nil)[0])
+	}
+
+	for _, streamed := range []bool{false, true} {
+		src := NewDedupingSource(seriesSource(series))
+		var deduped []ParsedSeries
+		if streamed {
+			err := src.StreamPrometheusEndpoint(context.TODO(), now, func(ps ParsedSeries) error {
+				deduped = append(deduped, ps)
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("unable to stream: %v", err)
+			}
+		} else {
+			var err error
+			if deduped, err = src.ScrapePrometheusEndpoint(context.TODO(), now); err != nil {
+				t.Fatalf("unable to scrape: %v", err)
+			}
+		}
+		var got []string
+		for _, ps := range deduped {
+			got = append(got, ps.Labels.String()+" "+formatFloat(ps.Value))
+		}
+		want := []string{
+			`{__name__="cheese"} 1`,
+			`{__name__="crackers"} 2`,
+			`{__name__="up", instance="scheduler-1"} 1`,
+			`{__name__="tea"} 5`,
+			`{__name__="up", instance="scheduler-2"} 1`,
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got series %v (streamed: %v), want %v", got, streamed, want)
+		}
+	}
+}
+
+// replicaScrapes scrapes each of its scrapes in turn.
+type replicaScrapes struct {
+	scrapes [][]ParsedSeries
+	next    int
+}
+
+func (s *replicaScrapes) ScrapePrometheusEndpoint(_ context.Context, _ time.Time) ([]ParsedSeries, error) {
+	scrape := s.scrapes[s.next]
+	s.next++
+	return scrape, nil
+}
+
+func TestDedupingSticksToAReplica(t *testing.T) {
+	now := time.Unix(1591005600, 0)
+	counter := func(instance string, value float64) ParsedSeries {
+		return ParsedSeries{
+			Labels:    labels.FromStrings(labels.MetricName, "requests_total", labels.InstanceName, instance),
+			Value:     value,
+			Timestamp: PromTimestamp(now),
+		}
+	}
+	// the replicas' counters differ, and they turn up in whichever order they're
+	// scraped in, until the first goes missing
+	src := NewDedupingSource(&replicaScrapes{scrapes: [][]ParsedSeries{
+		{counter("prometheus-0", 100), counter("prometheus-1", 40)},
+		{counter("prometheus-1", 45), counter("prometheus-0", 110)},
+		{counter("prometheus-1", 50)},
+		{counter("prometheus-0", 120), counter("prometheus-1", 55)},
+	}})
+	var got []float64
+	for i := 0; i < 4; i++ {
+		deduped, err := src.ScrapePrometheusEndpoint(context.TODO(), now)
+		if err != nil {
+			t.Fatalf("unable to scrape: %v", err)
+		}
+		for _, ps := range deduped {
+			got = append(got, ps.Value)
+		}
+	}
+	if want := []float64{100, 110, 50, 55}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want the first replica's until it went missing, and the other's from then on", got)
+	}
+}
@@ -0,0 +1,187 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/textparse"
+	"github.com/prometheus/prometheus/pkg/value"
+	"github.com/prometheus/prometheus/storage"
+)
+
+// openMetricsEscaper escapes label values and help text the way OpenMetrics wants,
+// which is less than strconv.Quote does.
+var openMetricsEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+type exportedSeries struct {
+	labels  labels.Labels
+	samples []datapoint
+}
+
+// Export writes everything we've stored, every sample of every series, to w in the
+// OpenMetrics format, so that it can be replayed, or backfilled into a prometheus with
+// 'promtool tsdb create-blocks-from openmetrics'. It returns how many series it wrote.
+func (q *PeriodicData) Export(ctx context.Context, w io.Writer) (int, error) {
+	if q.backend != nil {
+		return 0, errors.New("there's nothing stored to export when querying a prometheus server")
+	}
+	q.storageMu.RLock()
+	defer q.storageMu.RUnlock()
+	return ExportOpenMetrics(ctx, w, q.storage, q.index)
+}
+
+// ExportOpenMetrics writes every sample of every series in the queryable to w in the
+// OpenMetrics format, with the help text of the metrics in the index, if there is
+// one. Staleness markers are left out, since they can't be written down. It returns
+// how many series it wrote.
+func ExportOpenMetrics(ctx context.Context, w io.Writer, queryable storage.Queryable, index Indexer) (int, error) {
+	querier, err := queryable.Querier(ctx, math.MinInt64, math.MaxInt64)
+	if err != nil {
+		return 0, fmt.Errorf("unable to read what's stored: %w", err)
+	}
+	defer querier.Close()
+
+	// a metric's series have to be written together, and our storage doesn't keep
+	// them in any order
+	var all []exportedSeries
+	set := querier.Select(true, nil, labels.MustNewMatcher(labels.MatchRegexp, labels.MetricName, ".+"))
+	for set.Next() {
+		series := set.At()
+		exported := exportedSeries{labels: series.Labels()}
+		it := series.Iterator()
+		for it.Next() {
+			ts, val := it.At()
+			if value.IsStaleNaN(val) {
+				continue
+			}
+			exported.samples = append(exported.samples, datapoint{timestamp: ts, value: val})
+		}
+		if err := it.Err(); err != nil {
+			return 0, fmt.Errorf("unable to read %s: %w", exported.labels, err)
+		}
+		if len(exported.samples) > 0 {
+			all = append(all, exported)
+		}
+	}
+	if err := set.Err(); err != nil {
+		return 0, fmt.Errorf("unable to read what's stored: %w", err)
+	}
+	// a metric's series have to be together, under its metadata, and the metric name
+	// isn't always the first label, i.e. when a label name sorts before __name__
+	sort.Slice(all, func(i, j int) bool {
+		iName, jName := all[i].labels.Get(labels.MetricName), all[j].labels.Get(labels.MetricName)
+		if iName != jName {
+			return iName < jName
+		}
+		return labels.Compare(all[i].labels, all[j].labels) < 0
+	})
+
+	out := bufio.NewWriter(w)
+	lastName := ""
+	for _, series := range all {
+		name := series.labels.Get(labels.MetricName)
+		if name != lastName {
+			writeOpenMetricsMetadata(out, name, index)
+			lastName = name
+		}
+		prefix := openMetricsSeries(name, series.labels)
+		for _, pt := range series.samples {
+			out.WriteString(prefix)
+			out.WriteByte(' ')
+			out.WriteString(formatOpenMetricsValue(pt.value))
+			out.WriteByte(' ')
+			out.WriteString(formatOpenMetricsTimestamp(pt.timestamp))
+			out.WriteByte('\n')
+		}
+	}
+	out.WriteString("# EOF\n")
+	if err := out.Flush(); err != nil {
+		return 0, fmt.Errorf("unable to write the export: %w", err)
+	}
+	return len(all), nil
+}
+
+// writeOpenMetricsMetadata describes a metric, as much as can be without knowing which
+// family it's part of, i.e. a _bucket series is written as a metric of its own. Only a
+// gauge's type carries over like that, everything else is unknown.
+func writeOpenMetricsMetadata(out *bufio.Writer, name string, index Indexer) {
+	typ := textparse.MetricTypeUnknown
+	if index != nil {
+		md := index.GetMetricMetadata(name)
+		if md.Help != "" {
+			fmt.Fprintf(out, "# HELP %s %s\n", name, openMetricsEscaper.Replace(md.Help))
+		}
+		if md.Type == textparse.MetricTypeGauge {
+			typ = md.Type
+		}
+	}
+	fmt.Fprintf(out, "# TYPE %s %s\n", name, typ)
+}
+
+// openMetricsSeries is the name and labels of a series, i.e. 'foo{bar="baz"}'.
+func openMetricsSeries(name string, lset labels.Labels) string {
+	var sb strings.Builder
+	sb.WriteString(name)
+	first := true
+	for _, l := range lset {
+		if l.Name == labels.MetricName {
+			continue
+		}
+		if first {
+			sb.WriteByte('{')
+			first = false
+		} else {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(l.Name)
+		sb.WriteString(`="`)
+		sb.WriteString(openMetricsEscaper.Replace(l.Value))
+		sb.WriteByte('"')
+	}
+	if !first {
+		sb.WriteByte('}')
+	}
+	return sb.String()
+}
+
+func formatOpenMetricsValue(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// formatOpenMetricsTimestamp formats a prometheus timestamp in seconds, which is what
+// OpenMetrics has them in.
+func formatOpenMetricsTimestamp(ts int64) string {
+	return strconv.FormatFloat(float64(ts)/1000, 'f', -1, 64)
+}
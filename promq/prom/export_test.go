@@ -0,0 +1,96 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/textparse"
+)
+
+func TestExportOpenMetrics(t *testing.T) {
+	storage := NewRangeStorage()
+	index := NewIndex()
+	scrapes := []string{
+		"# HELP temperature how \"hot\" it is\n# TYPE temperature gauge\ntemperature{room=\"a\\nb\"} 20\ntemperature{Zone=\"x\"} 5\n# TYPE requests_total counter\nrequests_total{code=\"200\"} 1\nrequests_total{code=\"500\"} 1\n",
+		"# HELP temperature how \"hot\" it is\n# TYPE temperature gauge\ntemperature{room=\"a\\nb\"} 21.5\n# TYPE requests_total counter\nrequests_total{code=\"200\"} +Inf\n",
+	}
+	for i, scrape := range scrapes {
+		points, err := ParseTextData([]byte(scrape), time.Unix(1000+int64(i)*15, 0))
+		if err != nil {
+			t.Fatalf("invalid raw data: %v", err)
+		}
+		for _, p := range points {
+			index.UpdateMetric(p)
+		}
+		if err := storage.LoadData(points); err != nil {
+			t.Fatalf("unable to load data: %v", err)
+		}
+	}
+
+	var out bytes.Buffer
+	n, err := ExportOpenMetrics(context.TODO(), &out, storage, index)
+	if err != nil {
+		t.Fatalf("unable to export: %v", err)
+	}
+	// requests_total{code="500"} went stale, but what was scraped of it is still there,
+	// and Zone sorts before __name__, but it's still with the rest of temperature
+	if n != 4 {
+		t.Errorf("exported %d series, want 4", n)
+	}
+	want := `# TYPE requests_total unknown
+requests_total{code="200"} 1 1000
+requests_total{code="200"} +Inf 1015
+requests_total{code="500"} 1 1000
+# HELP temperature how \"hot\" it is
+# TYPE temperature gauge
+temperature{Zone="x"} 5 1000
+temperature{room="a\nb"} 20 1000
+temperature{room="a\nb"} 21.5 1015
+# EOF
+`
+	if got := out.String(); got != want {
+		t.Errorf("got export:\n%s\nwant:\n%s", got, want)
+	}
+
+	// it has to be something promtool can backfill
+	p := textparse.NewOpenMetricsParser(out.Bytes())
+	samples := 0
+	for {
+		entry, err := p.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("exported invalid OpenMetrics: %v", err)
+		}
+		if entry == textparse.EntrySeries {
+			samples++
+			if _, ts, _ := p.Series(); ts == nil {
+				t.Errorf("exported a sample without a timestamp")
+			}
+		}
+	}
+	if samples != strings.Count(want, "} ") {
+		t.Errorf("parsed %d samples back, want %d", samples, strings.Count(want, "} "))
+	}
+}
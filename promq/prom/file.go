@@ -0,0 +1,189 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileSource reads metrics from a dump on disk rather than scraping an endpoint, i.e.
+// the output of 'kubectl get --raw /metrics'. A file is read again on every scrape, as
+// if it were an endpoint. A directory is taken to have a dump in each file, from the
+// time in its name (an RFC 3339 or unix timestamp, i.e. '1591005600.txt') or when it
+// was last modified, and each dump is only read the once.
+type FileSource struct {
+	path string
+	// Lenient skips the lines of a dump which can't be parsed, rather than failing
+	// to read it, they're returned as a MalformedLinesError
+	Lenient bool
+	// ExternalLabels are added to every series of the dumps, i.e. the cluster they're of
+	ExternalLabels map[string]string
+	// Filter drops the series of the metric families which aren't wanted as the dumps
+	// are read
+	Filter *MetricFilter
+
+	mu sync.Mutex
+	// the dumps in a directory which we've already read
+	read map[string]bool
+}
+
+// NewFileSource reads metrics from the file or directory at the given path.
+func NewFileSource(path string) (*FileSource, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("unable to read metrics dump: %w", err)
+	}
+	return &FileSource{path: path, read: map[string]bool{}}, nil
+}
+
+// String is what the instance label of its series is.
+func (s *FileSource) String() string {
+	return "file://" + s.path
+}
+
+// TargetLabels are the labels every series of the dumps gets.
+func (s *FileSource) TargetLabels() map[string]string {
+	return TargetLabels(s.String(), s.ExternalLabels)
+}
+
+func (s *FileSource) ScrapePrometheusEndpoint(ctx context.Context, nowish time.Time) ([]ParsedSeries, error) {
+	series := make([]ParsedSeries, 0)
+	err := s.StreamPrometheusEndpoint(ctx, nowish, func(ps ParsedSeries) error {
+		series = append(series, ps)
+		return nil
+	})
+	if _, ok := ScrapeWarnings(err); !ok {
+		return nil, err
+	}
+	return series, err
+}
+
+// StreamPrometheusEndpoint parses the dumps as they're read, they can be dozens of
+// megabytes for the apiserver.
+func (s *FileSource) StreamPrometheusEndpoint(_ context.Context, nowish time.Time, add func(ParsedSeries) error) error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return fmt.Errorf("unable to read metrics dump: %w", err)
+	}
+	if !info.IsDir() {
+		return s.streamDump(s.path, nowish, add)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	files, err := ioutil.ReadDir(s.path)
+	if err != nil {
+		return fmt.Errorf("unable to read metrics dumps: %w", err)
+	}
+	type dump struct {
+		path string
+		at   time.Time
+	}
+	var dumps []dump
+	for _, f := range files {
+		path := filepath.Join(s.path, f.Name())
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") || s.read[path] {
+			continue
+		}
+		at, ok := dumpTime(f.Name())
+		if !ok {
+			at = f.ModTime()
+		}
+		dumps = append(dumps, dump{path: path, at: at})
+	}
+	// our storage copes with going back in time, but not for free
+	sort.SliceStable(dumps, func(i, j int) bool {
+		return dumps[i].at.Before(dumps[j].at)
+	})
+	var malformed MalformedLinesError
+	for _, d := range dumps {
+		err := s.streamDump(d.path, d.at, add)
+		var m *MalformedLinesError
+		if errors.As(err, &m) {
+			malformed.merge(d.path, m)
+		} else if err != nil {
+			return err
+		}
+		s.read[d.path] = true
+	}
+	if malformed.Skipped > 0 {
+		return &malformed
+	}
+	return nil
+}
+
+func (s *FileSource) streamDump(path string, at time.Time, add func(ParsedSeries) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("unable to read metrics dump: %w", err)
+	}
+	defer f.Close()
+	// files don't come with a content type, but OpenMetrics always ends with # EOF
+	contentType := ""
+	if isOpenMetricsDump(f) {
+		contentType = OpenMetricsContentType
+	}
+	// the dumps in a directory are all of the same instance, so that their series line up
+	stream := NewSeriesStream(f, contentType, at, s.TargetLabels())
+	stream.Lenient, stream.Filter = s.Lenient, s.Filter
+	for stream.Next() {
+		if err := add(stream.At()); err != nil {
+			return err
+		}
+	}
+	if err := stream.Err(); err != nil {
+		return fmt.Errorf("unable to parse metrics dump %s: %w", path, err)
+	}
+	return stream.Malformed()
+}
+
+// isOpenMetricsDump checks whether a dump ends with # EOF, without reading the rest.
+func isOpenMetricsDump(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	tail := make([]byte, 64)
+	offset := info.Size() - int64(len(tail))
+	if offset < 0 {
+		tail, offset = tail[:info.Size()], 0
+	}
+	n, _ := f.ReadAt(tail, offset)
+	return bytes.HasSuffix(bytes.TrimSpace(tail[:n]), []byte("# EOF"))
+}
+
+// dumpTime finds the time of a dump in its file name, sans extension.
+func dumpTime(name string) (time.Time, bool) {
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+	if secs, err := strconv.ParseInt(name, 10, 64); err == nil {
+		return time.Unix(secs, 0), true
+	}
+	if t, err := time.Parse(time.RFC3339, name); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
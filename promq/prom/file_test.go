@@ -0,0 +1,108 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFileSource(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.txt")
+	if err := ioutil.WriteFile(path, testData[0], 0644); err != nil {
+		t.Fatalf("unable to write dump: %v", err)
+	}
+	src, err := NewFileSource(path)
+	if err != nil {
+		t.Fatalf("unable to read dump: %v", err)
+	}
+	now := time.Now()
+	// a file is read on every scrape, like an endpoint
+	for i := 0; i < 2; i++ {
+		series, err := src.ScrapePrometheusEndpoint(context.TODO(), now)
+		if err != nil {
+			t.Fatalf("unable to scrape dump: %v", err)
+		}
+		if len(series) != 5 {
+			t.Errorf("got %d series, want 5", len(series))
+		}
+		for _, s := range series {
+			if s.Timestamp != PromTimestamp(now) || s.Labels.Get("instance") != "file://"+path {
+				t.Errorf("got %s at %v, want it from file://%s at %v", s.Labels, s.Timestamp, path, PromTimestamp(now))
+			}
+		}
+	}
+
+	if _, err := NewFileSource(filepath.Join(t.TempDir(), "nonexistent")); err == nil {
+		t.Errorf("expected an error reading a dump which doesn't exist")
+	}
+}
+
+func TestFileSourceDirectory(t *testing.T) {
+	dir := t.TempDir()
+	modified := time.Unix(3000, 0)
+	dumps := map[string][]byte{
+		"2000.txt":             testData[1],
+		"1970-01-01T00:16:40Z": testData[0],
+		"untimed.txt":          []byte("tea 1\n"),
+	}
+	for name, data := range dumps {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatalf("unable to write dump: %v", err)
+		}
+		if err := os.Chtimes(path, modified, modified); err != nil {
+			t.Fatalf("unable to set the time of the dump: %v", err)
+		}
+	}
+	src, err := NewFileSource(dir)
+	if err != nil {
+		t.Fatalf("unable to read dumps: %v", err)
+	}
+	series, err := src.ScrapePrometheusEndpoint(context.TODO(), time.Now())
+	if err != nil {
+		t.Fatalf("unable to scrape dumps: %v", err)
+	}
+	var times []int64
+	for _, s := range series {
+		if len(times) == 0 || times[len(times)-1] != s.Timestamp {
+			times = append(times, s.Timestamp)
+		}
+	}
+	// in order, by the time in their name, or when they were modified
+	want := []int64{1000 * 1000, 2000 * 1000, 3000 * 1000}
+	if len(series) != 12 || !reflect.DeepEqual(times, want) {
+		t.Errorf("got %d series at %v, want 12 at %v", len(series), times, want)
+	}
+
+	// each dump is only read the once
+	if err := ioutil.WriteFile(filepath.Join(dir, "4000.txt"), []byte("tea 2\n"), 0644); err != nil {
+		t.Fatalf("unable to write dump: %v", err)
+	}
+	series, err = src.ScrapePrometheusEndpoint(context.TODO(), time.Now())
+	if err != nil {
+		t.Fatalf("unable to scrape dumps: %v", err)
+	}
+	if len(series) != 1 || series[0].Timestamp != 4000*1000 {
+		t.Errorf("got %v, want just the new dump", series)
+	}
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// MetricFilter picks the metric families to keep as a scrape is parsed, so that those
+// of a huge endpoint which aren't wanted are never stored or indexed. A family is kept
+// if its name, or that of the series, matches Allow (if there is one) and doesn't
+// match Deny. A nil filter keeps everything.
+type MetricFilter struct {
+	allow, deny *regexp.Regexp
+}
+
+// NewMetricFilter filters by the given regular expressions, which are anchored at both
+// ends like prometheus', either of them can be empty. There's no filter if neither are
+// given.
+func NewMetricFilter(allow, deny string) (*MetricFilter, error) {
+	if allow == "" && deny == "" {
+		return nil, nil
+	}
+	f := &MetricFilter{}
+	var err error
+	if allow != "" {
+		if f.allow, err = regexp.Compile("^(?:" + allow + ")$"); err != nil {
+			return nil, fmt.Errorf("invalid metric allow regex %q: %w", allow, err)
+		}
+	}
+	if deny != "" {
+		if f.deny, err = regexp.Compile("^(?:" + deny + ")$"); err != nil {
+			return nil, fmt.Errorf("invalid metric deny regex %q: %w", deny, err)
+		}
+	}
+	return f, nil
+}
+
+// Keep is whether to keep a series with the given name, of the given family, which is
+// empty if we don't know it, i.e. there wasn't a # TYPE line.
+func (f *MetricFilter) Keep(name, family string) bool {
+	if f == nil {
+		return true
+	}
+	matches := func(re *regexp.Regexp) bool {
+		return re.MatchString(name) || (family != "" && re.MatchString(family))
+	}
+	if f.allow != nil && !matches(f.allow) {
+		return false
+	}
+	return f.deny == nil || !matches(f.deny)
+}
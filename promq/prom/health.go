@@ -0,0 +1,63 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/textparse"
+)
+
+// ScrapeHealth is the series prometheus adds for every scrape of a target, up,
+// scrape_duration_seconds and scrape_samples_scraped, so that its health can be
+// queried and charted like anything else. They have the target's labels, i.e. its
+// instance and external labels, like the series scraped from it.
+func ScrapeHealth(target map[string]string, nowish time.Time, duration time.Duration, samples int, err error) []ParsedSeries {
+	up := 1.0
+	if err != nil {
+		up = 0
+	}
+	health := func(name, help string, value float64) ParsedSeries {
+		ls := make(map[string]string, len(target)+1)
+		for k, v := range target {
+			ls[k] = v
+		}
+		ls[labels.MetricName] = name
+		return ParsedSeries{
+			Labels:    labels.FromMap(ls),
+			Value:     value,
+			Timestamp: PromTimestamp(nowish),
+			Type:      textparse.MetricTypeGauge,
+			Help:      help,
+		}
+	}
+	return []ParsedSeries{
+		health("up", "1 if the target could be scraped, 0 otherwise.", up),
+		health("scrape_duration_seconds", "How long scraping the target took.", duration.Seconds()),
+		health("scrape_samples_scraped", "How many samples scraping the target got.", float64(samples)),
+	}
+}
+
+// isScrapeHealth checks whether a series is one of those ScrapeHealth adds.
+func isScrapeHealth(ps ParsedSeries) bool {
+	switch ps.Labels.Get(labels.MetricName) {
+	case "up", "scrape_duration_seconds", "scrape_samples_scraped":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+func TestScrapeHealth(t *testing.T) {
+	now := time.Unix(1000, 0)
+	target := map[string]string{labels.InstanceName: "http://cheese:8080/metrics", "cluster": "prod"}
+	values := func(series []ParsedSeries) map[string]float64 {
+		got := map[string]float64{}
+		for _, s := range series {
+			if instance := s.Labels.Get(labels.InstanceName); instance != "http://cheese:8080/metrics" {
+				t.Errorf("got instance %q for %s, want the target's", instance, s.Labels)
+			}
+			if cluster := s.Labels.Get("cluster"); cluster != "prod" {
+				t.Errorf("got cluster %q for %s, want the target's external label", cluster, s.Labels)
+			}
+			if s.Timestamp != 1000000 {
+				t.Errorf("got timestamp %d for %s, want the scrape's", s.Timestamp, s.Labels)
+			}
+			got[s.Labels.Get(labels.MetricName)] = s.Value
+		}
+		return got
+	}
+
+	got := values(ScrapeHealth(target, now, 250*time.Millisecond, 42, nil))
+	want := map[string]float64{"up": 1, "scrape_duration_seconds": 0.25, "scrape_samples_scraped": 42}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v for a successful scrape, want %v", got, want)
+	}
+	got = values(ScrapeHealth(target, now, time.Second, 0, errors.New("connection refused")))
+	want = map[string]float64{"up": 0, "scrape_duration_seconds": 1, "scrape_samples_scraped": 0}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v for a failed scrape, want %v", got, want)
+	}
+}
@@ -17,34 +17,110 @@ limitations under the License.
 package prom
 
 import (
+	"sort"
 	"sync"
 
 	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/textparse"
 
 	debug "sigs.k8s.io/instrumentation-tools/debug/error"
 	"sigs.k8s.io/instrumentation-tools/notstdlib/sets"
 )
 
+// Indexer keeps track of the series we've scraped, their labels and metadata, for
+// autocompletion and the like. NewIndex keeps them in memory, other implementations,
+// i.e. one kept on disk for huge clusters, or one shared between several promqs, can
+// stand in for it, see IndexFactory. Implementations have to be safe to use from
+// several goroutines at once.
 type Indexer interface {
+	// UpdateMetric indexes a scraped series, or notes that it was scraped again.
 	UpdateMetric(m ParsedSeries)
 	GetMetricNames() sets.String
 	GetStoredDimensionsForMetric(string) sets.String
 	GetStoredValuesForMetricAndDimension(string, string) sets.String
+	GetStoredValuesForMetricAndDimensionMatching(string, string, ...*labels.Matcher) sets.String
+	GetMetricType(string) textparse.MetricType
+	GetMetricHelp(string) string
+	GetMetricStability(string) StabilityLevel
+	GetMetricUnit(string) string
+	GetMetricMetadata(string) Metadata
+	GetMetricsWithLabel(string) sets.String
+	GetMetricsWithLabelValue(string, string) sets.String
+	GetCardinality(limit int) Cardinality
+	GetLabelCardinalityForMetric(string) []CardinalityCount
+	// Generation changes whenever what's indexed does, so that anything derived from
+	// the index, i.e. cached completions, knows when it's stale.
+	Generation() uint64
+	// Expire forgets the series which haven't been scraped since the given prometheus
+	// timestamp, and returns how many there were.
+	Expire(olderThan int64) int
+	// EndScrape notes that the series of a scrape at the given prometheus timestamp
+	// have all been indexed, so that they can be told apart from the next scrape's.
+	EndScrape(at int64)
+	// ResetScrape forgets the series of the scrape being indexed, at the start of a
+	// scrape, and when one fails part way, so that they aren't counted in the next.
+	ResetScrape()
+	// Churn returns the series which appeared and disappeared between the last two
+	// scrapes.
+	Churn() Churn
 }
 
+// IndexFactory makes the index of what we scrape, so that another Indexer can stand
+// in for the in-memory one.
+type IndexFactory func() (Indexer, error)
+
+// DefaultIndexFactory makes the in-memory index, see NewIndex.
+func DefaultIndexFactory() (Indexer, error) {
+	return NewIndex(), nil
+}
+
+var _ Indexer = &indexer{}
+
 type indexer struct {
 	metricNameMu sync.RWMutex
 	// let's just be super inefficient
 	store map[string]map[string]sets.String
+	// metric name to the labels of each of its series, so that we can tell which
+	// values go together
+	series map[string][]labels.Labels
+	// label name to label value to the metrics with series which have it, so that we
+	// can tell which metrics have namespace="kube-system" without looking at them all
+	metricsByLabel map[string]map[string]sets.String
+	// metric name to the type of its metric family
+	types map[string]textparse.MetricType
+	// metric name to the help text of its metric family
+	help map[string]string
+	// metric name to the stability level of its metric family
+	stability map[string]StabilityLevel
+	// metric name to the unit of its metric family, only OpenMetrics has them
+	units map[string]string
 	// metric bloom filter
 	metricBloomFilter sets.Uint64
+	// the timestamp each series was last scraped at, by the hash of its labels, zero
+	// for series which never expire
+	lastSeen map[uint64]int64
+	// bumped every time we index a new series, or a metric's metadata changes
+	generation uint64
+	// the series of the scrape being indexed, and of the one before, by hash, for the
+	// churn between them
+	scraping, scraped map[uint64]labels.Labels
+	scrapedAt         int64
+	churn             Churn
 }
 
 func NewIndex() Indexer {
 	return &indexer{
 		metricNameMu:      sync.RWMutex{},
 		metricBloomFilter: sets.Uint64{},
+		lastSeen:          map[uint64]int64{},
 		store:             map[string]map[string]sets.String{},
+		series:            map[string][]labels.Labels{},
+		metricsByLabel:    map[string]map[string]sets.String{},
+		types:             map[string]textparse.MetricType{},
+		help:              map[string]string{},
+		stability:         map[string]StabilityLevel{},
+		units:             map[string]string{},
+		scraping:          map[uint64]labels.Labels{},
 	}
 }
 
@@ -61,6 +137,7 @@ func (i *indexer) UpdateMetric(m ParsedSeries) {
 	// note: we don't care about collisions, this is functionally
 	// a bloom filter.
 	if i.isMetricPresent(hash) {
+		i.seen(hash, m)
 		return
 	}
 	ls := m.Labels.Map()
@@ -73,18 +150,193 @@ func (i *indexer) UpdateMetric(m ParsedSeries) {
 	defer i.metricNameMu.Unlock()
 	// next time we will know that
 	i.metricBloomFilter.Insert(hash)
+	i.lastSeen[hash] = m.Timestamp
+	i.scrapedSeries(hash, m)
+	i.generation++
 	if _, ok := i.store[n]; !ok {
 		i.store[n] = map[string]sets.String{}
 	}
+	i.series[n] = append(i.series[n], m.Labels)
+	i.updateMetadata(n, m)
+
+	i.indexLabels(n, m.Labels)
+}
+
+// updateMetadata records the type, help, stability and unit a series came with, and
+// reports whether any of them changed.
+func (i *indexer) updateMetadata(n string, m ParsedSeries) bool {
+	changed := false
+	// don't let an untyped series clobber a type we already know about
+	if m.Type != "" && m.Type != textparse.MetricTypeUnknown && i.types[n] != m.Type {
+		i.types[n] = m.Type
+		changed = true
+	}
+	if m.Help != "" && i.help[n] != m.Help {
+		i.help[n] = m.Help
+		changed = true
+	}
+	if m.Stability != "" && i.stability[n] != m.Stability {
+		i.stability[n] = m.Stability
+		changed = true
+	}
+	if m.Unit != "" && i.units[n] != m.Unit {
+		i.units[n] = m.Unit
+		changed = true
+	}
+	return changed
+}
 
-	for l, v := range ls {
-		if l == labels.MetricName {
+// indexLabels adds the label values of a series of the given metric to the index.
+func (i *indexer) indexLabels(n string, ls labels.Labels) {
+	for _, l := range ls {
+		if l.Name == labels.MetricName {
 			continue
 		}
-		if _, ok := i.store[n][l]; !ok {
-			i.store[n][l] = sets.NewString()
+		if _, ok := i.store[n][l.Name]; !ok {
+			i.store[n][l.Name] = sets.NewString()
+		}
+		i.store[n][l.Name].Insert(l.Value)
+		if _, ok := i.metricsByLabel[l.Name]; !ok {
+			i.metricsByLabel[l.Name] = map[string]sets.String{}
+		}
+		if _, ok := i.metricsByLabel[l.Name][l.Value]; !ok {
+			i.metricsByLabel[l.Name][l.Value] = sets.NewString()
+		}
+		i.metricsByLabel[l.Name][l.Value].Insert(n)
+	}
+}
+
+// seen notes that a series we've already indexed was scraped again, possibly with new
+// metadata, i.e. after its target was upgraded.
+func (i *indexer) seen(hash uint64, m ParsedSeries) {
+	i.metricNameMu.Lock()
+	defer i.metricNameMu.Unlock()
+	if last, ok := i.lastSeen[hash]; ok && last != 0 && m.Timestamp > last {
+		i.lastSeen[hash] = m.Timestamp
+	}
+	i.scrapedSeries(hash, m)
+	if n := m.Labels.Get(labels.MetricName); n != "" && i.updateMetadata(n, m) {
+		i.generation++
+	}
+}
+
+// scrapedSeries adds a series to the scrape being indexed, unless it's one which is
+// never scraped, i.e. a recording rule of a rules file, or a historical point, i.e.
+// backfilled or read back.
+func (i *indexer) scrapedSeries(hash uint64, m ParsedSeries) {
+	if m.Timestamp != 0 && !m.Historical {
+		i.scraping[hash] = m.Labels
+	}
+}
+
+// EndScrape works out the churn between the scrape we've just indexed and the one
+// before it. A scrape without any series, i.e. one which failed, is skipped, rather
+// than everything disappearing and then appearing again.
+func (i *indexer) EndScrape(at int64) {
+	i.metricNameMu.Lock()
+	defer i.metricNameMu.Unlock()
+	if len(i.scraping) == 0 {
+		return
+	}
+	if i.scraped != nil {
+		churn := Churn{At: at, Since: i.scrapedAt}
+		for hash, ls := range i.scraping {
+			if _, ok := i.scraped[hash]; !ok {
+				churn.Appeared = append(churn.Appeared, ls)
+			}
+		}
+		for hash, ls := range i.scraped {
+			if _, ok := i.scraping[hash]; !ok {
+				churn.Disappeared = append(churn.Disappeared, ls)
+			}
+		}
+		sortLabels(churn.Appeared)
+		sortLabels(churn.Disappeared)
+		i.churn = churn
+	}
+	i.scraped, i.scrapedAt = i.scraping, at
+	i.scraping = make(map[uint64]labels.Labels, len(i.scraped))
+}
+
+func (i *indexer) ResetScrape() {
+	i.metricNameMu.Lock()
+	defer i.metricNameMu.Unlock()
+	if len(i.scraping) > 0 {
+		i.scraping = make(map[uint64]labels.Labels, len(i.scraped))
+	}
+}
+
+// Churn returns the series which appeared and disappeared between the last two scrapes.
+func (i *indexer) Churn() Churn {
+	i.metricNameMu.RLock()
+	defer i.metricNameMu.RUnlock()
+	return i.churn
+}
+
+func sortLabels(series []labels.Labels) {
+	sort.Slice(series, func(a, b int) bool {
+		return labels.Compare(series[a], series[b]) < 0
+	})
+}
+
+// Expire forgets the series which haven't been scraped since the given prometheus
+// timestamp, i.e. those of pods deleted long ago, so that we stop suggesting them, and
+// returns how many it forgot. Series indexed with a zero timestamp, i.e. the recording
+// rules of rules files, which are never scraped, are kept.
+func (i *indexer) Expire(olderThan int64) int {
+	i.metricNameMu.Lock()
+	defer i.metricNameMu.Unlock()
+	expired := 0
+	for n, series := range i.series {
+		kept := make([]labels.Labels, 0, len(series))
+		for _, ls := range series {
+			hash := ls.Hash()
+			if last := i.lastSeen[hash]; last != 0 && last < olderThan {
+				delete(i.lastSeen, hash)
+				i.metricBloomFilter.Delete(hash)
+				continue
+			}
+			kept = append(kept, ls)
+		}
+		if len(kept) == len(series) {
+			continue
+		}
+		expired += len(series) - len(kept)
+		i.reindexMetric(n, kept)
+	}
+	if expired > 0 {
+		i.generation++
+	}
+	return expired
+}
+
+// reindexMetric replaces the series of a metric, forgetting the label values only the
+// series which are gone had, and the metric altogether if none are left.
+func (i *indexer) reindexMetric(n string, series []labels.Labels) {
+	for l, values := range i.store[n] {
+		for v := range values {
+			i.metricsByLabel[l][v].Delete(n)
+			if i.metricsByLabel[l][v].Len() == 0 {
+				delete(i.metricsByLabel[l], v)
+			}
+		}
+		if len(i.metricsByLabel[l]) == 0 {
+			delete(i.metricsByLabel, l)
 		}
-		i.store[n][l].Insert(v)
+	}
+	if len(series) == 0 {
+		delete(i.store, n)
+		delete(i.series, n)
+		delete(i.types, n)
+		delete(i.help, n)
+		delete(i.stability, n)
+		delete(i.units, n)
+		return
+	}
+	i.series[n] = series
+	i.store[n] = map[string]sets.String{}
+	for _, ls := range series {
+		i.indexLabels(n, ls)
 	}
 }
 
@@ -110,3 +362,119 @@ func (i *indexer) GetStoredValuesForMetricAndDimension(metricName string, dimens
 	}
 	return dimensionForMetric[dimension]
 }
+
+// GetStoredValuesForMetricAndDimensionMatching is like GetStoredValuesForMetricAndDimension,
+// except it only returns the values of series which the matchers match, i.e. the values of
+// dimb for series with dima="1".
+func (i *indexer) GetStoredValuesForMetricAndDimensionMatching(metricName string, dimension string, matchers ...*labels.Matcher) sets.String {
+	if len(matchers) == 0 {
+		return i.GetStoredValuesForMetricAndDimension(metricName, dimension)
+	}
+	i.metricNameMu.RLock()
+	defer i.metricNameMu.RUnlock()
+	series, ok := i.series[metricName]
+	if !ok {
+		return nil
+	}
+	values := sets.NewString()
+	for _, ls := range series {
+		v := ls.Get(dimension)
+		if v == "" || !matchesAll(ls, matchers) {
+			continue
+		}
+		values.Insert(v)
+	}
+	return values
+}
+
+// GetMetricsWithLabel returns the metrics which have series with the given label.
+func (i *indexer) GetMetricsWithLabel(labelName string) sets.String {
+	i.metricNameMu.RLock()
+	defer i.metricNameMu.RUnlock()
+	metrics := sets.NewString()
+	for _, ms := range i.metricsByLabel[labelName] {
+		metrics.Insert(ms.UnsortedList()...)
+	}
+	return metrics
+}
+
+// GetMetricsWithLabelValue returns the metrics which have series with the given label
+// value, i.e. the metrics with namespace="kube-system".
+func (i *indexer) GetMetricsWithLabelValue(labelName, labelValue string) sets.String {
+	i.metricNameMu.RLock()
+	defer i.metricNameMu.RUnlock()
+	return sets.NewString(i.metricsByLabel[labelName][labelValue].UnsortedList()...)
+}
+
+// matchesAll checks whether the labels of a series satisfy every matcher, a label the
+// series doesn't have counts as an empty one, as it does in PromQL.
+func matchesAll(ls labels.Labels, matchers []*labels.Matcher) bool {
+	for _, m := range matchers {
+		if !m.Matches(ls.Get(m.Name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// GetMetricType returns the type of the metric family the metric belongs to,
+// or unknown if the metric was never declared with a # TYPE line.
+func (i *indexer) GetMetricType(metricName string) textparse.MetricType {
+	i.metricNameMu.RLock()
+	defer i.metricNameMu.RUnlock()
+	if t, ok := i.types[metricName]; ok {
+		return t
+	}
+	return textparse.MetricTypeUnknown
+}
+
+// GetMetricHelp returns the # HELP text of the metric family the metric belongs to,
+// if there was any.
+func (i *indexer) GetMetricHelp(metricName string) string {
+	i.metricNameMu.RLock()
+	defer i.metricNameMu.RUnlock()
+	return i.help[metricName]
+}
+
+// GetMetricStability returns the stability level of the metric family the metric
+// belongs to, if it has one.
+func (i *indexer) GetMetricStability(metricName string) StabilityLevel {
+	i.metricNameMu.RLock()
+	defer i.metricNameMu.RUnlock()
+	return i.stability[metricName]
+}
+
+// GetMetricUnit returns the # UNIT of the metric family the metric belongs to, if
+// there was one.
+func (i *indexer) GetMetricUnit(metricName string) string {
+	i.metricNameMu.RLock()
+	defer i.metricNameMu.RUnlock()
+	return i.units[metricName]
+}
+
+// Metadata is what the comment lines of a metric family say about it.
+type Metadata struct {
+	Type      textparse.MetricType
+	Help      string
+	Unit      string
+	Stability StabilityLevel
+}
+
+// GetMetricMetadata returns the metadata of the metric family the metric belongs to,
+// whatever of it we know.
+func (i *indexer) GetMetricMetadata(metricName string) Metadata {
+	return Metadata{
+		Type:      i.GetMetricType(metricName),
+		Help:      i.GetMetricHelp(metricName),
+		Unit:      i.GetMetricUnit(metricName),
+		Stability: i.GetMetricStability(metricName),
+	}
+}
+
+// Generation returns a number which changes every time a new series is indexed, or
+// the metadata of a metric changes.
+func (i *indexer) Generation() uint64 {
+	i.metricNameMu.RLock()
+	defer i.metricNameMu.RUnlock()
+	return i.generation
+}
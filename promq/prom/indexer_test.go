@@ -18,10 +18,13 @@ package prom
 
 import (
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/textparse"
 
 	"sigs.k8s.io/instrumentation-tools/notstdlib/sets"
 )
@@ -262,6 +265,396 @@ other_metric_name{keyone="a"} 2
 	}
 }
 
+func TestIndexUpdatesAgainstMetricTypes(t *testing.T) {
+	index := NewTestIndex()
+	now := time.Now()
+	testCases := []struct {
+		name                string
+		scrapeMetricsString *string
+		want                map[string]textparse.MetricType
+	}{
+		{
+			name:                "should be unknown initially",
+			scrapeMetricsString: nil,
+			want: map[string]textparse.MetricType{
+				"han_metric_total": textparse.MetricTypeUnknown,
+			},
+		},
+		{
+			name: "should be able to update",
+			scrapeMetricsString: proto.String(`
+# HELP han_metric_total [STABLE] counter help
+# TYPE han_metric_total counter
+han_metric_total 1
+# HELP han_gauge [STABLE] gauge help
+# TYPE han_gauge gauge
+han_gauge 1
+# HELP han_latency_seconds [STABLE] histogram help
+# TYPE han_latency_seconds histogram
+han_latency_seconds_bucket{le="+Inf"} 1
+han_latency_seconds_sum 0.5
+han_latency_seconds_count 1
+`),
+			want: map[string]textparse.MetricType{
+				"han_metric_total":           textparse.MetricTypeCounter,
+				"han_gauge":                  textparse.MetricTypeGauge,
+				"han_latency_seconds_bucket": textparse.MetricTypeHistogram,
+				"han_latency_seconds_sum":    textparse.MetricTypeHistogram,
+			},
+		},
+		{
+			name: "untyped series should not clobber the type we know about",
+			scrapeMetricsString: proto.String(`
+han_metric_total{d="1"} 1
+`),
+			want: map[string]textparse.MetricType{
+				"han_metric_total": textparse.MetricTypeCounter,
+			},
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			now = now.Add(time.Duration(i) * time.Second)
+			if tc.scrapeMetricsString != nil {
+				err := index.LoadMetrics(*tc.scrapeMetricsString, now)
+				if err != nil {
+					t.Errorf("didn't expect this to err %v", err)
+				}
+			}
+			for metricName, want := range tc.want {
+				if got := index.GetMetricType(metricName); got != want {
+					t.Errorf("GetMetricType(%v) = %v, want %v", metricName, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestIndexUpdatesAgainstMetricHelp(t *testing.T) {
+	index := NewTestIndex()
+	err := index.LoadMetrics(`
+# HELP han_metric_total [STABLE] counter help
+# TYPE han_metric_total counter
+han_metric_total 1
+# TYPE han_gauge gauge
+han_gauge 1
+`, time.Now())
+	if err != nil {
+		t.Errorf("didn't expect this to err %v", err)
+	}
+	want := map[string]string{
+		"han_metric_total": "[STABLE] counter help",
+		// a family without help text shouldn't inherit the previous family's
+		"han_gauge":    "",
+		"not_a_metric": "",
+	}
+	for metricName, want := range want {
+		if got := index.GetMetricHelp(metricName); got != want {
+			t.Errorf("GetMetricHelp(%v) = %q, want %q", metricName, got, want)
+		}
+	}
+}
+
+func TestGetStoredValuesForMetricAndDimensionMatching(t *testing.T) {
+	index, err := NewTestIndexFromData(`
+han_metric_total{dima="1", dimb="a"} 1
+han_metric_total{dima="1", dimb="b"} 1
+han_metric_total{dima="2", dimb="c"} 1
+han_metric_total{dimb="d"} 1
+`, time.Now())
+	if err != nil {
+		t.Fatalf("didn't expect this to err %v", err)
+	}
+	testCases := []struct {
+		name     string
+		matchers []*labels.Matcher
+		want     sets.String
+	}{
+		{
+			name: "no matchers",
+			want: sets.NewString("a", "b", "c", "d"),
+		},
+		{
+			name:     "equal",
+			matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "dima", "1")},
+			want:     sets.NewString("a", "b"),
+		},
+		{
+			name:     "not equal includes series without the label",
+			matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchNotEqual, "dima", "1")},
+			want:     sets.NewString("c", "d"),
+		},
+		{
+			name:     "regex",
+			matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, "dima", "1|2")},
+			want:     sets.NewString("a", "b", "c"),
+		},
+		{
+			name: "every matcher has to match",
+			matchers: []*labels.Matcher{
+				labels.MustNewMatcher(labels.MatchEqual, "dima", "1"),
+				labels.MustNewMatcher(labels.MatchNotEqual, "dimb", "a"),
+			},
+			want: sets.NewString("b"),
+		},
+		{
+			name:     "nothing matches",
+			matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "dima", "3")},
+			want:     sets.NewString(),
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := index.GetStoredValuesForMetricAndDimensionMatching("han_metric_total", "dimb", tc.matchers...)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestGetMetricsWithLabel(t *testing.T) {
+	index, err := NewTestIndexFromData(`
+apiserver_requests_total{namespace="kube-system", code="200"} 1
+app_requests_total{namespace="default", code="500"} 1
+coredns_requests_total{namespace="kube-system"} 1
+up 1
+`, time.Now())
+	if err != nil {
+		t.Fatalf("didn't expect this to err %v", err)
+	}
+	if got, want := index.GetMetricsWithLabel("namespace"), sets.NewString("apiserver_requests_total", "app_requests_total", "coredns_requests_total"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got metrics %v with a namespace, want %v", got, want)
+	}
+	if got, want := index.GetMetricsWithLabelValue("namespace", "kube-system"), sets.NewString("apiserver_requests_total", "coredns_requests_total"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got metrics %v in kube-system, want %v", got, want)
+	}
+	if got, want := index.GetMetricsWithLabelValue("code", "500"), sets.NewString("app_requests_total"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got metrics %v with code 500, want %v", got, want)
+	}
+	if got := index.GetMetricsWithLabelValue("namespace", "monitoring"); got.Len() != 0 {
+		t.Errorf("got metrics %v in a namespace we've never seen", got)
+	}
+	if got := index.GetMetricsWithLabel("pod"); got.Len() != 0 {
+		t.Errorf("got metrics %v with a label we've never seen", got)
+	}
+}
+
+func TestIndexExpire(t *testing.T) {
+	index := NewIndex()
+	update := func(ts int64, ls ...string) {
+		index.UpdateMetric(ParsedSeries{Labels: labels.FromStrings(ls...), Timestamp: ts, Help: "help"})
+	}
+	update(1000, "__name__", "container_cpu_seconds_total", "pod", "gone")
+	update(1000, "__name__", "container_cpu_seconds_total", "pod", "still-here")
+	update(1000, "__name__", "deleted_metric", "pod", "gone")
+	// a recording rule, which never expires
+	update(0, "__name__", "pod:cpu:sum", "pod", "gone")
+	update(5000, "__name__", "container_cpu_seconds_total", "pod", "still-here")
+
+	generation := index.Generation()
+	if got := index.Expire(2000); got != 2 {
+		t.Errorf("expired %d series, want 2", got)
+	}
+	if index.Generation() == generation {
+		t.Errorf("expected expiring series to change the generation")
+	}
+	if got, want := index.GetMetricNames(), sets.NewString("container_cpu_seconds_total", "pod:cpu:sum"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got metrics %v, want %v", got, want)
+	}
+	if got, want := index.GetStoredValuesForMetricAndDimension("container_cpu_seconds_total", "pod"), sets.NewString("still-here"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got pods %v, want %v", got, want)
+	}
+	if got, want := index.GetMetricsWithLabelValue("pod", "gone"), sets.NewString("pod:cpu:sum"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got metrics %v for the gone pod, want %v", got, want)
+	}
+	if got := index.GetMetricHelp("deleted_metric"); got != "" {
+		t.Errorf("got help %q for an expired metric", got)
+	}
+	if got := index.Expire(2000); got != 0 {
+		t.Errorf("expired %d series again, want none", got)
+	}
+
+	// a series which comes back is indexed again
+	update(6000, "__name__", "deleted_metric", "pod", "back")
+	if got, want := index.GetStoredValuesForMetricAndDimension("deleted_metric", "pod"), sets.NewString("back"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got pods %v, want %v", got, want)
+	}
+}
+
+func TestIndexChurn(t *testing.T) {
+	index := NewIndex()
+	update := func(ts int64, ls ...string) {
+		index.UpdateMetric(ParsedSeries{Labels: labels.FromStrings(ls...), Timestamp: ts})
+	}
+	// a recording rule, which isn't scraped, so never comes or goes
+	update(0, "__name__", "pod:cpu:sum", "pod", "a")
+	update(1000, "__name__", "kube_pod_info", "pod", "a")
+	update(1000, "__name__", "kube_pod_info", "pod", "b")
+	update(1000, "__name__", "up")
+	index.EndScrape(1000)
+	if churn := index.Churn(); churn.At != 0 {
+		t.Errorf("got churn %v after a single scrape, want none", churn)
+	}
+	// a scrape which failed doesn't count, even part way
+	index.EndScrape(2000)
+	update(2500, "__name__", "kube_pod_info", "pod", "partial")
+	index.ResetScrape()
+	// nor does what's backfilled
+	index.UpdateMetric(ParsedSeries{Labels: labels.FromStrings("__name__", "kube_pod_info", "pod", "backfilled"), Timestamp: 500, Historical: true})
+
+	index.ResetScrape()
+	update(3000, "__name__", "kube_pod_info", "pod", "b")
+	update(3000, "__name__", "kube_pod_info", "pod", "c")
+	update(3000, "__name__", "up")
+	update(3000, "__name__", "new_metric")
+	index.EndScrape(3000)
+	want := Churn{
+		At:    3000,
+		Since: 1000,
+		Appeared: []labels.Labels{
+			labels.FromStrings("__name__", "kube_pod_info", "pod", "c"),
+			labels.FromStrings("__name__", "new_metric"),
+		},
+		Disappeared: []labels.Labels{labels.FromStrings("__name__", "kube_pod_info", "pod", "a")},
+	}
+	if got := index.Churn(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got churn %v, want %v", got, want)
+	}
+
+	pods := want.ForMetric("kube_pod_info")
+	if len(pods.Appeared) != 1 || len(pods.Disappeared) != 1 {
+		t.Errorf("got churn %v for kube_pod_info, want a pod each way", pods)
+	}
+	formatted := FormatChurn(want, 1)
+	for _, line := range []string{"+ kube_pod_info{pod=\"c\"}\n", "+ ...and 1 more\n", "- kube_pod_info{pod=\"a\"}\n"} {
+		if !strings.Contains(formatted, line) {
+			t.Errorf("expected %q in the formatted churn:\n%s", line, formatted)
+		}
+	}
+}
+
+func TestIndexMetadata(t *testing.T) {
+	index := NewIndex()
+	points, err := ParseOpenMetricsData([]byte(`# TYPE request_duration_seconds histogram
+# HELP request_duration_seconds [STABLE] how long requests take
+# UNIT request_duration_seconds seconds
+request_duration_seconds_bucket{le="+Inf"} 1
+request_duration_seconds_sum 0.5
+request_duration_seconds_count 1
+# EOF
+`), time.Now())
+	if err != nil {
+		t.Fatalf("invalid raw data: %v", err)
+	}
+	for _, p := range points {
+		index.UpdateMetric(p)
+	}
+	want := Metadata{
+		Type:      textparse.MetricTypeHistogram,
+		Help:      "[STABLE] how long requests take",
+		Unit:      "seconds",
+		Stability: StabilityStable,
+	}
+	if got := index.GetMetricMetadata("request_duration_seconds_bucket"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got metadata %+v, want %+v", got, want)
+	}
+	if got := index.GetMetricUnit("request_duration_seconds_count"); got != "seconds" {
+		t.Errorf("got unit %q for the count, want seconds", got)
+	}
+	if got := index.GetMetricMetadata("unknown"); !reflect.DeepEqual(got, Metadata{Type: textparse.MetricTypeUnknown}) {
+		t.Errorf("got metadata %+v for a metric we've never seen", got)
+	}
+}
+
+func TestIndexUpdatesAgainstMetricStability(t *testing.T) {
+	index := NewTestIndex()
+	err := index.LoadMetrics(`
+# HELP han_metric_total [STABLE] counter help
+# TYPE han_metric_total counter
+han_metric_total 1
+# HELP han_alpha_total [ALPHA] counter help
+# TYPE han_alpha_total counter
+han_alpha_total 1
+# HELP han_old_total [ALPHA] (Deprecated since 1.19.0) counter help
+# TYPE han_old_total counter
+han_old_total 1
+# HELP han_other_total counter help
+# TYPE han_other_total counter
+han_other_total 1
+`, time.Now())
+	if err != nil {
+		t.Errorf("didn't expect this to err %v", err)
+	}
+	want := map[string]StabilityLevel{
+		"han_metric_total": StabilityStable,
+		"han_alpha_total":  StabilityAlpha,
+		"han_old_total":    StabilityDeprecated,
+		// not every metric comes from kubernetes
+		"han_other_total": "",
+		"not_a_metric":    "",
+	}
+	for metricName, want := range want {
+		if got := index.GetMetricStability(metricName); got != want {
+			t.Errorf("GetMetricStability(%v) = %q, want %q", metricName, got, want)
+		}
+	}
+}
+
+func TestIndexGeneration(t *testing.T) {
+	index := NewTestIndex()
+	metrics := `
+han_metric_total{code="200"} 1
+han_metric_total{code="500"} 1
+`
+	start := index.Generation()
+	if err := index.LoadMetrics(metrics, time.Now()); err != nil {
+		t.Errorf("didn't expect this to err %v", err)
+	}
+	loaded := index.Generation()
+	if loaded == start {
+		t.Errorf("Generation() = %v, expected it to change after indexing new series", loaded)
+	}
+	// a scrape without new series leaves the index as it was
+	if err := index.LoadMetrics(metrics, time.Now()); err != nil {
+		t.Errorf("didn't expect this to err %v", err)
+	}
+	if got := index.Generation(); got != loaded {
+		t.Errorf("Generation() = %v, want %v", got, loaded)
+	}
+	// while one which gives a known metric help changes it
+	metadata := `
+# HELP han_metric_total requests
+# TYPE han_metric_total counter
+han_metric_total{code="200"} 1
+`
+	if err := index.LoadMetrics(metadata, time.Now()); err != nil {
+		t.Errorf("didn't expect this to err %v", err)
+	}
+	described := index.Generation()
+	if described == loaded {
+		t.Errorf("Generation() = %v, expected it to change after a metric gained help", described)
+	}
+	// as long as the help stays the same, the index does too
+	if err := index.LoadMetrics(metadata, time.Now()); err != nil {
+		t.Errorf("didn't expect this to err %v", err)
+	}
+	if got := index.Generation(); got != described {
+		t.Errorf("Generation() = %v, want %v", got, described)
+	}
+	// until it changes
+	if err := index.LoadMetrics(strings.Replace(metadata, "requests", "requests served", 1), time.Now()); err != nil {
+		t.Errorf("didn't expect this to err %v", err)
+	}
+	if got := index.Generation(); got == described {
+		t.Errorf("Generation() = %v, expected it to change after a metric's help changed", got)
+	}
+	if got := index.GetMetricHelp("han_metric_total"); got != "requests served" {
+		t.Errorf("GetMetricHelp(han_metric_total) = %q, want %q", got, "requests served")
+	}
+}
+
 type TestIndex struct {
 	Indexer
 }
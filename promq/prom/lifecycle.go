@@ -0,0 +1,132 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ScheduleOptions are when Start scrapes.
+type ScheduleOptions struct {
+	// Period is how long there is between scrapes
+	Period time.Duration
+	// Align scrapes on wall clock boundaries of the period, i.e. on the second, with
+	// what's scraped stored as of the boundary, see NextScrape
+	Align bool
+	// Immediately scrapes once straight away, rather than only after the first period
+	Immediately bool
+	// BeforeScrape, if set, is called before each scrape, with the time it's for and
+	// nothing locked, for whatever is slow to fetch, e.g. jittered targets
+	BeforeScrape func(ctx context.Context, at time.Time)
+}
+
+// scrapeErrorsBuffer is how many scrape errors Start keeps for whoever's reading them,
+// after that they're dropped, rather than the scrapes waiting on them
+const scrapeErrorsBuffer = 16
+
+// Start scrapes, and runs the query, every period in the background, until Stop is
+// called or the context is done. A scrape which fails doesn't stop the rest, the
+// error is sent on the returned channel, which is closed once we've stopped. Nobody
+// has to read it, errors which aren't read in time are dropped. We can be started
+// again once stopped, either way.
+func (q *PeriodicData) Start(ctx context.Context, opts ScheduleOptions) (<-chan error, error) {
+	if opts.Period <= 0 {
+		return nil, fmt.Errorf("the scrape period has to be positive, not %v", opts.Period)
+	}
+	q.loopMu.Lock()
+	defer q.loopMu.Unlock()
+	if q.stopped != nil {
+		select {
+		case <-q.stopped:
+			// the context we were started with is done, so we stopped by ourselves
+		default:
+			return nil, errors.New("already started")
+		}
+	}
+	ctx, stop := context.WithCancel(ctx)
+	errs := make(chan error, scrapeErrorsBuffer)
+	stopped := make(chan struct{})
+	q.stop, q.stopped = stop, stopped
+	go func() {
+		defer close(stopped)
+		defer close(errs)
+		q.scrapeEvery(ctx, opts, func(err error) {
+			select {
+			case errs <- err:
+			default:
+			}
+		})
+	}()
+	return errs, nil
+}
+
+// Stop stops the scrapes Start started, waiting for the one in flight, if any, to
+// finish. It does nothing if we haven't been started. Since it waits for the scrape,
+// it mustn't be called from our callbacks, which the scrape calls, that'd never return;
+// they can cancel the context we were started with instead.
+func (q *PeriodicData) Stop() {
+	q.loopMu.Lock()
+	defer q.loopMu.Unlock()
+	if q.stopped == nil {
+		return
+	}
+	q.stop()
+	<-q.stopped
+	q.stop, q.stopped = nil, nil
+}
+
+// scrapeEvery scrapes every period until the context is done, handing what goes
+// wrong to report.
+func (q *PeriodicData) scrapeEvery(ctx context.Context, opts ScheduleOptions, report func(error)) {
+	scrape := func(at time.Time) {
+		if opts.BeforeScrape != nil {
+			opts.BeforeScrape(ctx, at)
+		}
+		if err := q.ScrapeAt(ctx, at); err != nil && ctx.Err() == nil {
+			report(err)
+		}
+	}
+	if opts.Immediately {
+		scrape(time.Now())
+	}
+	if !opts.Align {
+		ticker := time.NewTicker(opts.Period)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				scrape(time.Now())
+			}
+		}
+	}
+	for {
+		next := NextScrape(time.Now(), opts.Period)
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+			scrape(next)
+		}
+	}
+}
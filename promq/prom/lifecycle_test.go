@@ -0,0 +1,105 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/promql"
+)
+
+func TestStartAndStop(t *testing.T) {
+	// the first scrape fails, which doesn't stop the ones after it
+	source := &flakySource{failures: 1}
+	data := NewPeriodicData(source, DefaultEngineOptions(time.Minute, 1000))
+	data.Times = Range{Instant: true}
+	charted := make(chan struct{}, 1)
+	data.Callback = func(*promql.Result) error {
+		select {
+		case charted <- struct{}{}:
+		default:
+		}
+		return nil
+	}
+	if err := data.SetQuery(context.TODO(), "cheese"); err != nil {
+		t.Fatalf("unable to set query: %v", err)
+	}
+	if _, err := data.Start(context.TODO(), ScheduleOptions{}); err == nil {
+		t.Errorf("expected starting without a period to fail")
+	}
+	errs, err := data.Start(context.TODO(), ScheduleOptions{Period: time.Millisecond, Immediately: true})
+	if err != nil {
+		t.Fatalf("unable to start: %v", err)
+	}
+	if _, err := data.Start(context.TODO(), ScheduleOptions{Period: time.Millisecond}); err == nil {
+		t.Errorf("expected starting twice to fail")
+	}
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Errorf("got a nil error for the failed scrape")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("the failed scrape wasn't reported")
+	}
+	select {
+	case <-charted:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("nothing was charted")
+	}
+
+	data.Stop()
+	// the errors are closed once we've stopped
+	for range errs {
+	}
+	scrapes := source.scrapes
+	time.Sleep(10 * time.Millisecond)
+	if source.scrapes != scrapes {
+		t.Errorf("got %d more scrapes after stopping", source.scrapes-scrapes)
+	}
+	data.Stop()
+
+	// we can be started again, and closing stops us
+	errs, err = data.Start(context.TODO(), ScheduleOptions{Period: time.Hour})
+	if err != nil {
+		t.Fatalf("unable to start again: %v", err)
+	}
+	if err := data.Close(); err != nil {
+		t.Fatalf("unable to close: %v", err)
+	}
+	for range errs {
+	}
+
+	// and when the context we were started with is done, we can be started again too
+	ctx, cancel := context.WithCancel(context.TODO())
+	errs, err = data.Start(ctx, ScheduleOptions{Period: time.Hour})
+	if err != nil {
+		t.Fatalf("unable to start again: %v", err)
+	}
+	cancel()
+	for range errs {
+	}
+	errs, err = data.Start(context.TODO(), ScheduleOptions{Period: time.Hour})
+	if err != nil {
+		t.Fatalf("unable to start again once the context was done: %v", err)
+	}
+	data.Stop()
+	for range errs {
+	}
+}
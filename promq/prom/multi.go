@@ -14,16 +14,25 @@ See the License for the specific language governing permissions and
 limitations under the License.
 */
 
+// Package prom scrapes prometheus endpoints, and anything else a DataSource can stand
+// for, into a Storage and an Indexer, and runs PromQL over what it's scraped, or on a
+// Backend. PeriodicData ties them together into the scrape and evaluate loop which
+// the promq command charts, so that other tools can embed it.
 package prom
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/prometheus/prometheus/promql/parser"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage"
 )
 
 // ResultsCallback is a function that processes the results of a prometheus query
@@ -31,35 +40,286 @@ import (
 // if they are kept around.
 type ResultsCallback func(*promql.Result) error
 
+// ResetsCallback is given the counter resets of the series a query selects, over the
+// times it's run over, i.e. to annotate restarts on a graph of its results.
+type ResetsCallback func([]CounterReset)
+
+// AlertsCallback is given the alerts which are pending or firing, every time the alerting
+// rules are evaluated.
+type AlertsCallback func([]Alert)
+
+// resetTracker is storage which keeps track of counter resets.
+type resetTracker interface {
+	CounterResets(mint, maxt int64, matchers ...*labels.Matcher) []CounterReset
+}
+
 type DataSource interface {
 	ScrapePrometheusEndpoint(ctx context.Context, nowish time.Time) ([]ParsedSeries, error)
 }
 
+// StreamingSource is a source which can hand over the series it scrapes as they're
+// parsed, rather than all at once, so that a huge scrape, i.e. of the apiserver, is
+// indexed and stored without all of it being in memory twice over.
+type StreamingSource interface {
+	DataSource
+	// StreamPrometheusEndpoint calls add with each series it scrapes, giving up if add
+	// returns an error. It can fail part of the way through, having added some.
+	StreamPrometheusEndpoint(ctx context.Context, nowish time.Time, add func(ParsedSeries) error) error
+}
+
+// StreamSource hands what a source scrapes to add, as it's parsed if the source can
+// stream it, or all at once if it can't. What we do get of a partial scrape is added.
+func StreamSource(ctx context.Context, src DataSource, nowish time.Time, add func(ParsedSeries) error) error {
+	if s, ok := src.(StreamingSource); ok {
+		return s.StreamPrometheusEndpoint(ctx, nowish, add)
+	}
+	series, err := src.ScrapePrometheusEndpoint(ctx, nowish)
+	if _, ok := ScrapeWarnings(err); !ok {
+		return err
+	}
+	for _, ps := range series {
+		if err := add(ps); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// PartialScrapeError is returned by sources which scrape several targets when some of
+// them couldn't be scraped, alongside the series of the rest.
+type PartialScrapeError struct {
+	// Errors has an error per target which couldn't be scraped
+	Errors []error
+	// Targets is how many targets there were, if it's as many as there are errors,
+	// all we have is their up series
+	Targets int
+	// Malformed has an error per target which was scraped, but had lines which were
+	// skipped, since they couldn't be parsed
+	Malformed []error
+}
+
+func (e *PartialScrapeError) Error() string {
+	var msgs []string
+	if len(e.Errors) > 0 {
+		failed := make([]string, len(e.Errors))
+		for i, err := range e.Errors {
+			failed[i] = err.Error()
+		}
+		msgs = append(msgs, fmt.Sprintf("unable to scrape %d of %d target(s): %s", len(e.Errors), e.Targets, strings.Join(failed, "; ")))
+	}
+	for _, err := range e.Malformed {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// ScrapeWarnings are what's wrong with a scrape which still got us some series, the
+// targets it couldn't get to and the lines it couldn't parse, or false if the error
+// means we got nothing.
+func ScrapeWarnings(err error) ([]error, bool) {
+	var partial *PartialScrapeError
+	var malformed *MalformedLinesError
+	switch {
+	case err == nil:
+		return nil, true
+	case errors.As(err, &partial):
+		return append(append([]error(nil), partial.Errors...), partial.Malformed...), true
+	case errors.As(err, &malformed):
+		return []error{err}, true
+	}
+	return nil, false
+}
+
 type Range struct {
 	Window   time.Duration
 	Interval time.Duration
 	Instant  bool
+	// Start and End pin a range query to the given times, rather than to the window
+	// up to now, Interval is the step between them. An unset End is now.
+	Start time.Time
+	End   time.Time
+}
+
+// Bounds is when a range query starts and ends, given the time now.
+func (r Range) Bounds(now time.Time) (start, end time.Time) {
+	end = r.End
+	if end.IsZero() {
+		end = now
+	}
+	if r.Start.IsZero() {
+		return end.Add(-r.Window), end
+	}
+	return r.Start, end
+}
+
+// Validate checks that a range query over these times makes sense.
+func (r Range) Validate(now time.Time) error {
+	if r.Instant {
+		return nil
+	}
+	if r.Interval <= 0 {
+		return fmt.Errorf("the step of a range query has to be positive, not %v", r.Interval)
+	}
+	if start, end := r.Bounds(now); end.Before(start) {
+		return fmt.Errorf("a range query can't end (%v) before it starts (%v)", end.Format(time.RFC3339), start.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// View is which part of the data a continuous query is charted over, when that isn't
+// just its window up to now, i.e. to zoom into a spike, or pause at it, without
+// changing what's scraped and kept.
+type View struct {
+	// Window is how far back from End is charted, the query's window if unset.
+	Window time.Duration
+	// End is when the chart ends, now if unset. Setting it pauses the chart there.
+	End time.Time
+	// Instant charts the query as an instant query at End, i.e. to draw the latest
+	// value of each series as a bar, rather than its window as a line.
+	Instant bool
+}
+
+// Paused is whether the chart stays put rather than following new scrapes.
+func (v View) Paused() bool {
+	return !v.End.IsZero()
+}
+
+// Storage keeps the series we scrape, for the engine to query.
+type Storage interface {
+	storage.Queryable
+	LoadData(points []ParsedSeries) error
+	// Backfill loads historical points, i.e. from a dump or a remote read, all at once,
+	// without any of them, or what was loaded before, going stale over it.
+	Backfill(points []ParsedSeries) error
+	// Appender loads a batch a point at a time instead, as a scrape is parsed.
+	Appender() BatchAppender
+	// Clean drops the data older than the given prometheus timestamp.
+	Clean(olderThan int64)
+	Close() error
+}
+
+// BatchAppender loads a batch of points, i.e. a scrape, a point at a time, so that a
+// huge scrape can be stored as it's parsed. The batch is only done once it's committed,
+// it's then that the series which weren't in it go stale, or rolled back, if the scrape
+// failed part of the way through.
+type BatchAppender interface {
+	Append(point ParsedSeries) error
+	Commit() error
+	Rollback() error
 }
 
+// PeriodicData scrapes its source into its storage and index, evaluates its alerts,
+// and runs its query over what it's scraped, on every scrape, handing the results to
+// its Callback. It's what the promq command charts, and can be embedded by other tools
+// the same way: set the query, and the callbacks and options below, then either call
+// Scrape whenever suits, or Start it scraping every period until it's stopped, and
+// Close it once done with.
 type PeriodicData struct {
 	source DataSource
 
 	storageMu sync.RWMutex
-	storage   *rangeStorage
+	storage   Storage
 	engine    *promql.Engine
 	queryMu   sync.RWMutex
 	Callback  ResultsCallback
 	Query     string
 	Times     Range
 	index    Indexer
+	// backend runs our queries rather than our engine, if set
+	backend Backend
+	// ResetsCallback, if set, is called with the counter resets before Callback is
+	// called with the results, on every scrape
+	ResetsCallback ResetsCallback
+	// DiscardRawData drops the samples once they're downsampled, for long windows,
+	// rather than keeping them around for queries which need every sample
+	DiscardRawData bool
+	// lastCleaned is when we last dropped the data we don't need any more
+	lastCleaned time.Time
+	// scrapeErrors are the targets the last scrape couldn't get to, and the lines it
+	// couldn't parse
+	scrapeErrors []error
+	// Alerter, if set, evaluates its alerting rules on every scrape, and their ALERTS
+	// series are stored with what's scraped. AlertsCallback, if set, is then called
+	// with the active alerts.
+	Alerter        *Alerter
+	AlertsCallback AlertsCallback
+	// alertErrors are the alerting rules which couldn't be evaluated last time
+	alertErrors []error
+	// StatsCallback, if set, is given the stats of every query our engine runs
+	StatsCallback StatsCallback
+	// IndexTTL, if set, is how long a series can go without being scraped before it's
+	// dropped from the index, and no longer suggested
+	IndexTTL time.Duration
+	// lastExpired is when we last dropped the series which went unscraped from the index
+	lastExpired time.Time
+	// lookbackDelta is how far back our engine looks for the latest sample of a series,
+	// so we keep at least that much
+	lookbackDelta time.Duration
+	// CompareOffset, if set, has the query run as it was that long ago as well, i.e. a
+	// day, and those results shifted forward onto now, so that today can be charted
+	// over yesterday. The results are told apart by their ComparisonLabel.
+	CompareOffset time.Duration
+	// view is what's charted of the data we keep, if not the window up to now
+	view View
+
+	// loopMu guards the scrape loop of Start, which stop stops, and which closes
+	// stopped once it has
+	loopMu  sync.Mutex
+	stop    context.CancelFunc
+	stopped chan struct{}
+}
+
+const (
+	// cleanEvery is how often we drop the data we don't need any more, it's a
+	// walk over every series, so not worth doing on every scrape
+	cleanEvery = time.Minute
+	// retentionSlack is how much more data we keep than the query needs, so that
+	// changing it doesn't immediately leave an empty graph
+	retentionSlack = 10 * time.Minute
+	// downsampleAbove is how many samples of a series a window can have before we
+	// downsample them, and downsampleTo is how many we downsample them to, a graph
+	// in a terminal isn't going to show more anyway
+	downsampleAbove = 2000
+	downsampleTo    = 500
+	// rawBuckets is how many buckets worth of the latest samples we leave be, so that
+	// the end of the graph is up to date
+	rawBuckets = 10
+)
+
+// downsampler is storage which can downsample what it keeps.
+type downsampler interface {
+	Downsample(olderThan, resolution int64, discardRaw bool)
 }
 
 func NewPeriodicData(source DataSource, opts promql.EngineOpts) *PeriodicData {
+	return NewPeriodicDataWithStorage(source, opts, NewRangeStorage())
+}
+
+// NewPeriodicDataWithStorage keeps what it scrapes in the given storage rather than
+// in memory, i.e. a TSDBStorage, so that it survives restarts.
+func NewPeriodicDataWithStorage(source DataSource, opts promql.EngineOpts, s Storage) *PeriodicData {
+	lookbackDelta := opts.LookbackDelta
+	if lookbackDelta <= 0 {
+		lookbackDelta = DefaultLookbackDelta
+	}
 	return &PeriodicData{
-		source:  source,
-		storage: NewRangeStorage(),
-		engine:  promql.NewEngine(opts),
-		index:  NewIndex(),
+		source:        source,
+		storage:       s,
+		engine:        promql.NewEngine(opts),
+		index:         NewIndex(),
+		lookbackDelta: lookbackDelta,
+	}
+}
+
+// NewPeriodicDataWithBackend runs its queries on the given backend, i.e. an APIBackend,
+// rather than over what it scrapes, which is only indexed.
+func NewPeriodicDataWithBackend(source DataSource, backend Backend) *PeriodicData {
+	return &PeriodicData{
+		source:        source,
+		storage:       NewRangeStorage(),
+		backend:       backend,
+		index:         NewIndex(),
+		lookbackDelta: DefaultLookbackDelta,
 	}
 }
 
@@ -71,28 +331,122 @@ func (q *PeriodicData) SetQuery(ctx context.Context, query string) error {
 	if err != nil {
 		return err
 	}
+	// i.e. so that a remote read fetches the series the query needs
+	if src, ok := q.source.(QueryAwareSource); ok {
+		if err := src.SetQuery(query); err != nil {
+			return err
+		}
+	}
 	q.Query = query
 	return nil
 }
 
+// SetView zooms and pans what's charted, independently of the window we scrape and
+// keep. What it takes the chart back to is kept for as long as it's charted.
+func (q *PeriodicData) SetView(view View) {
+	q.storageMu.Lock()
+	defer q.storageMu.Unlock()
+	q.view = view
+}
+
+// charted is the times the query is charted over, its Times as zoomed and paused by
+// its view.
+func (q *PeriodicData) charted() Range {
+	times := q.Times
+	if q.view.Window > 0 {
+		times.Window = q.view.Window
+	}
+	if q.view.Paused() {
+		times.End = q.view.End
+	}
+	if q.view.Instant {
+		times.Instant = true
+	}
+	return times
+}
+
+// Requery runs the query again over what's been scraped, calling Callback with the
+// results, i.e. so that a change of view is charted without waiting for a scrape.
+func (q *PeriodicData) Requery(ctx context.Context) error {
+	q.storageMu.Lock()
+	defer q.storageMu.Unlock()
+	return q.ManuallyExecuteQuery(ctx, q.Callback)
+}
+
 func (q *PeriodicData) Scrape(ctx context.Context) error {
+	return q.ScrapeAt(ctx, time.Now())
+}
+
+// ScrapeAt scrapes like Scrape, with what's scraped stored as of nowish rather than
+// now, i.e. a wall clock boundary the scrape was scheduled for, so that the samples
+// of every scrape line up.
+func (q *PeriodicData) ScrapeAt(ctx context.Context, nowish time.Time) error {
 	q.storageMu.Lock()
 	defer q.storageMu.Unlock()
-	data, err := q.source.ScrapePrometheusEndpoint(ctx, time.Now())
-	if err != nil {
-		return fmt.Errorf("unable to get new data from source: %w", err)
+	// the alerts are evaluated over what we had before this scrape, their ALERTS
+	// series are stored with it
+	alerts := q.evalAlerts(ctx, nowish)
+	// our backend has its own data
+	var app BatchAppender
+	if q.backend == nil {
+		app = q.storage.Appender()
 	}
-	for _, d := range data {
+	// a huge scrape is indexed and stored as it's parsed, if the source can stream it
+	q.index.ResetScrape()
+	var loadErr error
+	add := func(d ParsedSeries) error {
 		q.index.UpdateMetric(d)
+		if app == nil {
+			return nil
+		}
+		if err := app.Append(d); err != nil {
+			// it's rolled back, so the storage is as it was before the scrape
+			loadErr = fmt.Errorf("unable to load new data: %w", err)
+			return loadErr
+		}
+		return nil
+	}
+	rollback := func() {
+		q.index.ResetScrape()
+		if app != nil {
+			_ = app.Rollback()
+		}
+	}
+	err := StreamSource(ctx, q.source, nowish, add)
+	// one flaky target, or line, is no reason not to chart the rest, we just say so
+	warnings, ok := ScrapeWarnings(err)
+	if loadErr != nil {
+		rollback()
+		return loadErr
+	} else if !ok {
+		rollback()
+		return fmt.Errorf("unable to get new data from source: %w", err)
+	}
+	q.scrapeErrors = warnings
+	for _, a := range alerts {
+		if err := add(a); err != nil {
+			rollback()
+			return err
+		}
+	}
+	// so that the series which came and went since the last scrape can be told apart
+	q.index.EndScrape(PromTimestamp(nowish))
+	if q.IndexTTL > 0 && nowish.Sub(q.lastExpired) >= cleanEvery {
+		q.index.Expire(PromTimestamp(nowish.Add(-q.IndexTTL)))
+		q.lastExpired = nowish
 	}
-	if err := func() error {
-		if err := q.storage.LoadData(data); err != nil {
+	if app != nil {
+		if err := app.Commit(); err != nil {
 			return fmt.Errorf("unable to load new data, may now be in inconsistent state: %w", err)
 		}
-		// release the defer before we send the notification
-		return nil
-	}(); err != nil {
-		return err
+		now := time.Now()
+		if now.Sub(q.lastCleaned) >= cleanEvery {
+			q.clean(now)
+			q.lastCleaned = now
+		}
+		if q.ResetsCallback != nil {
+			q.ResetsCallback(q.counterResets(now))
+		}
 	}
 
 	if err := q.ManuallyExecuteQuery(ctx, q.Callback); err != nil {
@@ -102,37 +456,275 @@ func (q *PeriodicData) Scrape(ctx context.Context) error {
 }
 
 func (q *PeriodicData) ManuallyExecuteQuery(ctx context.Context, cb ResultsCallback) error {
+	cb = q.withScrapeErrors(cb)
+	now := time.Now()
+	if q.CompareOffset > 0 {
+		var err error
+		if cb, err = q.withComparison(ctx, now, cb); err != nil {
+			return err
+		}
+	}
+	return q.execute(ctx, now, 0, cb)
+}
+
+// execute runs the query over the times we chart it over, or at the end of them (i.e.
+// now) if it's an instant query, as they were the given offset ago.
+func (q *PeriodicData) execute(ctx context.Context, now time.Time, offset time.Duration, cb ResultsCallback) error {
 	var query promql.Query
-	if q.Times.Instant {
+	counted := &statsQueryable{Queryable: q.storage}
+	if times := q.charted(); times.Instant {
+		_, at := times.Bounds(now)
+		if q.backend != nil {
+			return q.backend.ExecuteInstantQuery(ctx, q.Query, at.Add(-offset), cb)
+		}
 		var err error
-		query, err = q.engine.NewInstantQuery(q.storage, q.Query, time.Now())
+		query, err = q.engine.NewInstantQuery(counted, q.Query, at.Add(-offset))
 		if err != nil {
 			return fmt.Errorf("unable to construct instant query: %w", err)
 		}
 	} else {
-		var err error
-		end := time.Now()
-		start := time.Now().Add(time.Duration(-1) * q.Times.Window)
-		query, err = q.engine.NewRangeQuery(q.storage, q.Query, start, end, q.Times.Interval)
-		if err != nil {
-			return fmt.Errorf("unable to construct range query: %w", err)
-		}
+		start, end := q.charted().Bounds(now)
+		return q.ExecuteRangeQuery(ctx, start.Add(-offset), end.Add(-offset), q.step(), cb)
+	}
+	defer query.Close()
+	// NB(directxman12): THE QUERY DATA IS ONLY VALID INSIDE THIS FUNCTION
+	return q.exec(ctx, query, counted, cb)
+}
+
+// ExecuteRangeQuery evaluates the query at every step from start to end, over whatever
+// data we've stored for those times, regardless of Times. The results are a matrix.
+func (q *PeriodicData) ExecuteRangeQuery(ctx context.Context, start, end time.Time, step time.Duration, cb ResultsCallback) error {
+	if q.backend != nil {
+		return q.backend.ExecuteRangeQuery(ctx, q.Query, start, end, step, cb)
+	}
+	counted := &statsQueryable{Queryable: q.storage}
+	query, err := q.engine.NewRangeQuery(counted, q.Query, start, end, step)
+	if err != nil {
+		return fmt.Errorf("unable to construct range query: %w", err)
 	}
 	defer query.Close()
 	// NB(directxman12): THE QUERY DATA IS ONLY VALID INSIDE THIS FUNCTION
-	return cb(query.Exec(ctx))
+	return q.exec(ctx, query, counted, cb)
+}
+
+// exec runs a query over the queryable it was made with, which counted what it read,
+// and passes on its stats and then its results.
+func (q *PeriodicData) exec(ctx context.Context, query promql.Query, counted *statsQueryable, cb ResultsCallback) error {
+	res := query.Exec(ctx)
+	if q.StatsCallback != nil {
+		q.StatsCallback(counted.queryStats(query))
+	}
+	return cb(res)
+}
+
+// withScrapeErrors adds the targets the last scrape couldn't get to to the warnings of
+// the results, since they're missing from them, as well as the alerting rules which
+// couldn't be evaluated.
+func (q *PeriodicData) withScrapeErrors(cb ResultsCallback) ResultsCallback {
+	warnings := append(append([]error(nil), q.scrapeErrors...), q.alertErrors...)
+	if len(warnings) == 0 {
+		return cb
+	}
+	return func(res *promql.Result) error {
+		res.Warnings = append(res.Warnings, warnings...)
+		return cb(res)
+	}
+}
+
+// evalAlerts evaluates the alerting rules over what we've stored so far, before what
+// was just scraped is stored, so that their ALERTS series are stored with it, and go
+// stale like any other series once the alerts are resolved.
+func (q *PeriodicData) evalAlerts(ctx context.Context, ts time.Time) []ParsedSeries {
+	// our backend has its own alerts
+	if q.Alerter == nil || q.backend != nil {
+		return nil
+	}
+	series, errs := q.Alerter.Eval(ctx, q.engine, q.storage, ts)
+	q.alertErrors = errs
+	if q.AlertsCallback != nil {
+		q.AlertsCallback(q.Alerter.Alerts())
+	}
+	return series
+}
+
+// clean drops the data older than the query is charted over, and then what it needs
+// to be evaluated at the start of its window, i.e. the 5m of 'rate(foo[5m])'. For
+// long windows, it downsamples the rest.
+func (q *PeriodicData) clean(now time.Time) {
+	// a pinned range may need anything, and instant queries aren't run continuously
+	if q.Times.Instant || !q.Times.Start.IsZero() || q.Times.Window <= 0 {
+		return
+	}
+	// what's charted may go back further than the window, once zoomed out or paused
+	oldest := now.Add(-q.Times.Window)
+	start, end := q.charted().Bounds(now)
+	if start.Before(oldest) {
+		oldest = start
+	}
+	retention := now.Sub(oldest) + lookbehind(q.Query, q.lookbackDelta) + q.CompareOffset + retentionSlack
+	q.storage.Clean(PromTimestamp(now.Add(-retention)))
+	if res := q.resolution(); res > 0 {
+		// the end of the chart is left be, even when it's paused
+		if ds, ok := q.storage.(downsampler); ok {
+			ds.Downsample(PromTimestamp(end.Add(-rawBuckets*res)), int64(res/time.Millisecond), q.DiscardRawData)
+		}
+	}
+}
+
+// resolution is how far apart the samples we keep are downsampled to, if the window
+// we scrape has too many of them to chart them all, and zero otherwise. It doesn't
+// change with the view, so that the buckets of a series are all the same size, and
+// zooming out for a moment doesn't throw away the samples of --discard-raw-data.
+func (q *PeriodicData) resolution() time.Duration {
+	return rangeResolution(q.Times)
+}
+
+// step is how far apart the steps of the query are over what's charted, i.e. so that
+// the query isn't evaluated at every scrape of a zoomed out view.
+func (q *PeriodicData) step() time.Duration {
+	times := q.charted()
+	step := times.Interval
+	if res := rangeResolution(times); res > step {
+		step = res
+	}
+	return step
+}
+
+// rangeResolution is how far apart the samples charted over the given times are, if they
+// have too many to chart them all, and zero otherwise.
+func rangeResolution(times Range) time.Duration {
+	if times.Instant || times.Interval <= 0 || times.Window/times.Interval <= downsampleAbove {
+		return 0
+	}
+	return (times.Window / downsampleTo).Truncate(time.Millisecond)
+}
+
+// lookbehind is how far before the time it's evaluated at the query looks, i.e. the
+// longest range and offset of its selectors, plus the lookback delta.
+func lookbehind(query string, lookbackDelta time.Duration) time.Duration {
+	longest := lookbackDelta
+	expr, err := parser.ParseExpr(query)
+	if err != nil {
+		return longest
+	}
+	parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
+		sel, ok := node.(*parser.VectorSelector)
+		if !ok {
+			return nil
+		}
+		d := sel.OriginalOffset + lookbackDelta
+		for _, parent := range path {
+			switch parent := parent.(type) {
+			case *parser.MatrixSelector:
+				d += parent.Range
+			case *parser.SubqueryExpr:
+				d += parent.Range + parent.OriginalOffset
+			}
+		}
+		if d > longest {
+			longest = d
+		}
+		return nil
+	})
+	return longest
+}
+
+// counterResets finds the resets of the series the query selects, over the times it's
+// run over. Storage which doesn't keep track of them has none.
+func (q *PeriodicData) counterResets(now time.Time) []CounterReset {
+	tracker, ok := q.storage.(resetTracker)
+	if !ok {
+		return nil
+	}
+	expr, err := parser.ParseExpr(q.Query)
+	if err != nil {
+		return nil
+	}
+	start, end := q.charted().Bounds(now)
+	// a series may well be selected more than once, i.e. in 'foo / foo offset 1h'
+	type seenReset struct {
+		series    uint64
+		timestamp int64
+	}
+	seen := map[seenReset]bool{}
+	var resets []CounterReset
+	for _, matchers := range parser.ExtractSelectors(expr) {
+		for _, reset := range tracker.CounterResets(PromTimestamp(start), PromTimestamp(end), matchers...) {
+			key := seenReset{series: reset.Series.Hash(), timestamp: reset.Timestamp}
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			resets = append(resets, reset)
+		}
+	}
+	sort.Slice(resets, func(i, j int) bool {
+		return resets[i].Timestamp < resets[j].Timestamp
+	})
+	return resets
+}
+
+// Backfill indexes and stores historical points in one go, i.e. from a dump, a remote
+// read or a recording, so that the graph shows their history straight away rather
+// than starting out empty. They can be from before, or in between, what's been
+// scraped, and what's been downsampled.
+func (q *PeriodicData) Backfill(points []ParsedSeries) error {
+	// our backend has its own data
+	if q.backend != nil {
+		return fmt.Errorf("unable to backfill, our queries are run on a backend with its own data")
+	}
+	q.storageMu.Lock()
+	defer q.storageMu.Unlock()
+	// they weren't scraped, so they're no part of the churn between scrapes
+	for _, point := range points {
+		point.Historical = true
+		q.index.UpdateMetric(point)
+	}
+	if err := q.storage.Backfill(points); err != nil {
+		return fmt.Errorf("unable to backfill, may now be in inconsistent state: %w", err)
+	}
+	return nil
+}
+
+// SetIndex makes what's scraped go into the given index rather than the in-memory one
+// we started with, it has to be called before the first scrape.
+func (q *PeriodicData) SetIndex(index Indexer) {
+	q.index = index
 }
 
 func (q *PeriodicData) GetIndex() Indexer {
 	return q.index
 }
 
+// Close stops scraping, if we were started, and closes our storage, which for
+// persistent storage flushes what we've scraped.
+func (q *PeriodicData) Close() error {
+	q.Stop()
+	q.storageMu.Lock()
+	defer q.storageMu.Unlock()
+	return q.storage.Close()
+}
+
+const (
+	// DefaultMaxSamples is how many samples a query can have in memory at once, unless
+	// told otherwise, a query over more fails rather than running us out of memory
+	DefaultMaxSamples = 100000
+	// DefaultLookbackDelta is how far back the engine looks for the latest sample of
+	// a series, unless told otherwise, like prometheus
+	DefaultLookbackDelta = 5 * time.Minute
+)
+
 func DefaultEngineOptions(timeout time.Duration, maxSamples int) promql.EngineOpts {
+	return EngineOptions(timeout, maxSamples, DefaultLookbackDelta)
+}
+
+// EngineOptions are the options of our engine, for those who need to raise its limits
+// for lots of series, or tighten them for a slow machine.
+func EngineOptions(timeout time.Duration, maxSamples int, lookbackDelta time.Duration) promql.EngineOpts {
 	// TODO(sollyross): add logging
-	// TODO(sollyross): figure out good options
 	return promql.EngineOpts{
-		Timeout:    timeout, // why? why is this here? THIS IS WHAT CONTEXT IS FOR!
-		MaxSamples: maxSamples,
-		// TODO(sollyross): anything else
+		Timeout:       timeout, // why? why is this here? THIS IS WHAT CONTEXT IS FOR!
+		MaxSamples:    maxSamples,
+		LookbackDelta: lookbackDelta,
 	}
 }
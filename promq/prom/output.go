@@ -17,15 +17,25 @@ limitations under the License.
 package prom
 
 import (
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
+	"strconv"
 	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/fatih/color"
 	"github.com/golang/protobuf/proto"
 	"github.com/hokaccha/go-prettyjson"
+	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
 	"gopkg.in/yaml.v2"
+
+	"sigs.k8s.io/instrumentation-tools/notstdlib/sets"
 )
 
 func ToPrettyJson(result *promql.Result) (*string, error) {
@@ -111,6 +121,24 @@ func ToPrettyFormat(res *promql.Result, outputType string, colorized bool) (*str
 			return nil, err
 		}
 		return o, nil
+	case "prometheus-api":
+		o, err := ToAPIFormat(res)
+		if err != nil {
+			return nil, err
+		}
+		return o, nil
+	case "table":
+		o, err := ToTable(res, nil)
+		if err != nil {
+			return nil, err
+		}
+		return o, nil
+	case "csv":
+		o, err := ToCSV(res)
+		if err != nil {
+			return nil, err
+		}
+		return o, nil
 	}
 
 	return nil, fmt.Errorf("unsupported formatting option (%s)", outputType)
@@ -150,3 +178,271 @@ func ToPrometheusFormat(result *promql.Result) (*string, error) {
 	output := strings.Join(lines, "\n")
 	return proto.String(output), nil
 }
+
+// ToAPIFormat writes the results the way prometheus' HTTP API responds to a query,
+// envelope and all, so that scripts written against it can be pointed at us instead.
+// A query which failed is written as the API's error, rather than returned.
+func ToAPIFormat(result *promql.Result) (*string, error) {
+	if result.Err != nil {
+		out, err := json.Marshal(apiResponse{Status: "error", ErrorType: apiErrorType(result.Err), Error: result.Err.Error()})
+		if err != nil {
+			return nil, err
+		}
+		return proto.String(string(out)), nil
+	}
+	value := result.Value
+	// the API has no results as an empty list, rather than null
+	switch v := value.(type) {
+	case promql.Matrix:
+		if v == nil {
+			value = promql.Matrix{}
+		}
+	case promql.Vector:
+		if v == nil {
+			value = promql.Vector{}
+		}
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(apiQueryData{ResultType: string(value.Type()), Result: encoded})
+	if err != nil {
+		return nil, err
+	}
+	resp := apiResponse{Status: "success", Data: data}
+	for _, w := range result.Warnings {
+		resp.Warnings = append(resp.Warnings, w.Error())
+	}
+	out, err := json.Marshal(resp)
+	if err != nil {
+		return nil, err
+	}
+	return proto.String(string(out)), nil
+}
+
+// apiErrorType is the errorType prometheus' HTTP API gives the error of a query.
+func apiErrorType(err error) string {
+	var canceled promql.ErrQueryCanceled
+	var timeout promql.ErrQueryTimeout
+	var storageErr promql.ErrStorage
+	var parseErrs parser.ParseErrors
+	var parseErr *parser.ParseErr
+	switch {
+	case errors.As(err, &canceled):
+		return "canceled"
+	case errors.As(err, &timeout):
+		return "timeout"
+	case errors.As(err, &storageErr):
+		return "internal"
+	case errors.As(err, &parseErrs), errors.As(err, &parseErr):
+		return "bad_data"
+	}
+	return "execution"
+}
+
+// ToTable writes the results as a table a row per sample, aligned for people to read,
+// with the metric name, the given labels (every label any of the series has, if
+// there aren't any), the value and the timestamp (RFC 3339) as columns.
+func ToTable(result *promql.Result, columns []string) (*string, error) {
+	if result.Err != nil {
+		return nil, result.Err
+	}
+	if result.Warnings != nil {
+		for _, e := range result.Warnings {
+			fmt.Println(e)
+		}
+	}
+	series, err := resultSeries(result.Value)
+	if err != nil {
+		return nil, err
+	}
+	columns = tableColumns(series, columns)
+
+	var sb strings.Builder
+	w := tabwriter.NewWriter(&sb, 0, 8, 2, ' ', 0)
+	header := []string{"METRIC"}
+	for _, name := range columns {
+		header = append(header, strings.ToUpper(name))
+	}
+	fmt.Fprintln(w, strings.Join(append(header, "VALUE", "TIMESTAMP"), "\t"))
+	for _, s := range series {
+		row := []string{s.Metric.Get(labels.MetricName)}
+		for _, name := range columns {
+			row = append(row, s.Metric.Get(name))
+		}
+		for _, pt := range s.Points {
+			cells := append(row, strconv.FormatFloat(pt.V, 'g', -1, 64), formatCSVTimestamp(pt.T))
+			fmt.Fprintln(w, strings.Join(cells, "\t"))
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	return proto.String(strings.TrimSuffix(sb.String(), "\n")), nil
+}
+
+// LatestTable is the results as the rows of a table, a row per series, of its latest
+// sample: the metric name, the given labels (every label any of the series has, if
+// there aren't any), the value, and how long before now it was sampled, so that the
+// series which went away stand out.
+func LatestTable(result *promql.Result, columns []string, now time.Time) (header []string, rows [][]string, err error) {
+	if result.Err != nil {
+		return nil, nil, result.Err
+	}
+	series, err := resultSeries(result.Value)
+	if err != nil {
+		return nil, nil, err
+	}
+	columns = tableColumns(series, columns)
+
+	header = []string{"METRIC"}
+	for _, name := range columns {
+		header = append(header, strings.ToUpper(name))
+	}
+	header = append(header, "VALUE", "AGE")
+	for _, s := range series {
+		if len(s.Points) == 0 {
+			continue
+		}
+		row := []string{s.Metric.Get(labels.MetricName)}
+		for _, name := range columns {
+			row = append(row, s.Metric.Get(name))
+		}
+		latest := s.Points[len(s.Points)-1]
+		age := now.Sub(time.Unix(0, latest.T*int64(time.Millisecond))).Truncate(time.Second)
+		rows = append(rows, append(row, strconv.FormatFloat(latest.V, 'g', -1, 64), age.String()))
+	}
+	return header, rows, nil
+}
+
+// tableColumns is the labels a table of the series has as columns, the given ones,
+// or every label any of the series has but the metric name (its own column).
+func tableColumns(series []promql.Series, columns []string) []string {
+	if len(columns) > 0 {
+		return columns
+	}
+	names := sets.NewString()
+	for _, s := range series {
+		for _, l := range s.Metric {
+			names.Insert(l.Name)
+		}
+	}
+	return names.Delete(labels.MetricName).List()
+}
+
+// resultSeries is the series of results, a vector's samples as series of a single
+// point, and a scalar as a series without labels.
+func resultSeries(value parser.Value) ([]promql.Series, error) {
+	switch value := value.(type) {
+	case promql.Matrix:
+		return value, nil
+	case promql.Vector:
+		series := make([]promql.Series, 0, len(value))
+		for _, sample := range value {
+			series = append(series, promql.Series{Metric: sample.Metric, Points: []promql.Point{sample.Point}})
+		}
+		return series, nil
+	case promql.Scalar:
+		return []promql.Series{{Points: []promql.Point{{T: value.T, V: value.V}}}}, nil
+	}
+	return nil, fmt.Errorf("%s results aren't series", value.Type())
+}
+
+// ToCSV writes the results a row per sample, i.e. for spreadsheets and pandas. The
+// columns are the timestamp (RFC 3339), the value, and then every label any of the
+// series has, the metric name first, empty for the series which don't have it. A
+// label named timestamp or value is prefixed with label_ in the header, so that the
+// columns can be told apart. The warnings go to stderr, so as not to break the CSV.
+func ToCSV(result *promql.Result) (*string, error) {
+	if result.Err != nil {
+		return nil, result.Err
+	}
+	for _, e := range result.Warnings {
+		fmt.Fprintln(os.Stderr, e)
+	}
+
+	if str, ok := result.Value.(promql.String); ok {
+		return csvRows([]string{"timestamp", "value"}, [][]string{{formatCSVTimestamp(str.T), str.V}})
+	}
+	series, err := resultSeries(result.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	names := sets.NewString()
+	for _, s := range series {
+		for _, l := range s.Metric {
+			names.Insert(l.Name)
+		}
+	}
+	var columns []string
+	if names.Has(labels.MetricName) {
+		columns = append(columns, labels.MetricName)
+		names.Delete(labels.MetricName)
+	}
+	columns = append(columns, names.List()...)
+
+	var rows [][]string
+	for _, s := range series {
+		for _, pt := range s.Points {
+			row := []string{formatCSVTimestamp(pt.T), strconv.FormatFloat(pt.V, 'g', -1, 64)}
+			for _, name := range columns {
+				row = append(row, s.Metric.Get(name))
+			}
+			rows = append(rows, row)
+		}
+	}
+	header := []string{"timestamp", "value"}
+	taken := sets.NewString(append(header, columns...)...)
+	for _, name := range columns {
+		if name == "timestamp" || name == "value" {
+			for taken.Has(name) {
+				name = "label_" + name
+			}
+			taken.Insert(name)
+		}
+		header = append(header, name)
+	}
+	return csvRows(header, rows)
+}
+
+func csvRows(header []string, rows [][]string) (*string, error) {
+	var sb strings.Builder
+	w := csv.NewWriter(&sb)
+	if err := w.Write(header); err != nil {
+		return nil, err
+	}
+	if err := w.WriteAll(rows); err != nil {
+		return nil, err
+	}
+	// the output is printed with a newline of its own
+	return proto.String(strings.TrimSuffix(sb.String(), "\n")), nil
+}
+
+func formatCSVTimestamp(ts int64) string {
+	return time.Unix(0, ts*int64(time.Millisecond)).UTC().Format(time.RFC3339Nano)
+}
+
+// ToPrometheusSeriesFormat formats a series given by a ResultStream the way
+// ToPrometheusFormat formats the results it's part of, of the given type.
+func ToPrometheusSeriesFormat(typ parser.ValueType, series promql.Series) string {
+	switch typ {
+	case parser.ValueTypeVector:
+		if len(series.Points) != 1 {
+			break
+		}
+		var line string
+		if name := series.Metric.Get(labels.MetricName); name != "" {
+			line = name
+		}
+		sample := promql.Sample{Point: series.Points[0], Metric: series.Metric.WithoutLabels(labels.MetricName)}
+		return line + sample.String()
+	case parser.ValueTypeScalar:
+		if len(series.Points) != 1 {
+			break
+		}
+		return promql.Scalar{T: series.Points[0].T, V: series.Points[0].V}.String()
+	}
+	return series.String()
+}
@@ -0,0 +1,193 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage"
+)
+
+func TestToCSV(t *testing.T) {
+	testCases := []struct {
+		name  string
+		value promql.Value
+		want  string
+	}{
+		{
+			name: "matrix",
+			value: promql.Matrix{
+				{Metric: labels.FromStrings(labels.MetricName, "up", "job", "a"), Points: []promql.Point{{T: 1000, V: 1}, {T: 2500, V: 0}}},
+				{Metric: labels.FromStrings(labels.MetricName, "up", "instance", "b,c"), Points: []promql.Point{{T: 1000, V: 1}}},
+			},
+			want: `timestamp,value,__name__,instance,job
+1970-01-01T00:00:01Z,1,up,,a
+1970-01-01T00:00:02.5Z,0,up,,a
+1970-01-01T00:00:01Z,1,up,"b,c",`,
+		},
+		{
+			name:  "vector",
+			value: promql.Vector{{Metric: labels.FromStrings("job", "a"), Point: promql.Point{T: 1000, V: 0.5}}},
+			want: `timestamp,value,job
+1970-01-01T00:00:01Z,0.5,a`,
+		},
+		{
+			name:  "labels named like the columns",
+			value: promql.Vector{{Metric: labels.FromStrings("value", "a", "label_value", "b", "timestamp", "c"), Point: promql.Point{T: 1000, V: 0.5}}},
+			want: `timestamp,value,label_value,label_timestamp,label_label_value
+1970-01-01T00:00:01Z,0.5,b,c,a`,
+		},
+		{
+			name:  "scalar",
+			value: promql.Scalar{T: 1000, V: 2},
+			want: `timestamp,value
+1970-01-01T00:00:01Z,2`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ToPrettyFormat(&promql.Result{Value: tc.value}, "csv", false)
+			if err != nil {
+				t.Fatalf("unable to write CSV: %v", err)
+			}
+			if *got != tc.want {
+				t.Errorf("got:\n%s\nwant:\n%s", *got, tc.want)
+			}
+		})
+	}
+}
+
+func TestToAPIFormat(t *testing.T) {
+	res := &promql.Result{
+		Value:    promql.Vector{{Metric: labels.FromStrings(labels.MetricName, "up", "job", "a"), Point: promql.Point{T: 1500, V: 1}}},
+		Warnings: storage.Warnings{errors.New("over budget")},
+	}
+	got, err := ToPrettyFormat(res, "prometheus-api", false)
+	if err != nil {
+		t.Fatalf("unable to write the API's format: %v", err)
+	}
+	want := `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up","job":"a"},"value":[1.5,"1"]}]},"warnings":["over budget"]}`
+	if *got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", *got, want)
+	}
+
+	// we can read it back like any response of the API
+	var resp apiResponse
+	if err := json.Unmarshal([]byte(*got), &resp); err != nil {
+		t.Fatalf("unable to decode response: %v", err)
+	}
+	var data apiQueryData
+	if err := json.Unmarshal(resp.Data, &data); err != nil {
+		t.Fatalf("unable to decode response data: %v", err)
+	}
+	value, err := decodeAPIValue(data.ResultType, data.Result)
+	if err != nil {
+		t.Fatalf("unable to decode result: %v", err)
+	}
+	if !reflect.DeepEqual(value, res.Value) {
+		t.Errorf("decoded %v, want %v", value, res.Value)
+	}
+
+	// no results are an empty list, not null
+	got, err = ToAPIFormat(&promql.Result{Value: promql.Matrix(nil)})
+	if err != nil {
+		t.Fatalf("unable to write the API's format: %v", err)
+	}
+	if want := `{"status":"success","data":{"resultType":"matrix","result":[]}}`; *got != want {
+		t.Errorf("got %s, want %s", *got, want)
+	}
+
+	// and a query which failed is the API's error
+	got, err = ToAPIFormat(&promql.Result{Err: promql.ErrQueryTimeout("query evaluation")})
+	if err != nil {
+		t.Fatalf("unable to write the API's format: %v", err)
+	}
+	if want := `{"status":"error","errorType":"timeout","error":"query timed out in query evaluation"}`; *got != want {
+		t.Errorf("got %s, want %s", *got, want)
+	}
+	got, err = ToAPIFormat(&promql.Result{Err: errors.New("vector cannot contain metrics with the same labelset")})
+	if err != nil {
+		t.Fatalf("unable to write the API's format: %v", err)
+	}
+	if want := `{"status":"error","errorType":"execution","error":"vector cannot contain metrics with the same labelset"}`; *got != want {
+		t.Errorf("got %s, want %s", *got, want)
+	}
+}
+
+func TestToTable(t *testing.T) {
+	res := &promql.Result{Value: promql.Vector{
+		{Metric: labels.FromStrings(labels.MetricName, "up", "job", "a", "instance", "x"), Point: promql.Point{T: 1000, V: 1}},
+		{Metric: labels.FromStrings(labels.MetricName, "up", "job", "bb"), Point: promql.Point{T: 1000, V: 0}},
+	}}
+	testCases := []struct {
+		name    string
+		columns []string
+		want    string
+	}{
+		{
+			name: "every label",
+			want: `METRIC  INSTANCE  JOB  VALUE  TIMESTAMP
+up      x         a    1      1970-01-01T00:00:01Z
+up                bb   0      1970-01-01T00:00:01Z`,
+		},
+		{
+			name:    "given labels",
+			columns: []string{"job"},
+			want: `METRIC  JOB  VALUE  TIMESTAMP
+up      a    1      1970-01-01T00:00:01Z
+up      bb   0      1970-01-01T00:00:01Z`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ToTable(res, tc.columns)
+			if err != nil {
+				t.Fatalf("unable to write table: %v", err)
+			}
+			if *got != tc.want {
+				t.Errorf("got:\n%s\nwant:\n%s", *got, tc.want)
+			}
+		})
+	}
+}
+
+func TestLatestTable(t *testing.T) {
+	res := &promql.Result{Value: promql.Matrix{
+		{Metric: labels.FromStrings(labels.MetricName, "up", "job", "a"), Points: []promql.Point{{T: 1000, V: 0}, {T: 61000, V: 1}}},
+		{Metric: labels.FromStrings(labels.MetricName, "up", "job", "b"), Points: []promql.Point{{T: 1000, V: 1}}},
+	}}
+	header, rows, err := LatestTable(res, nil, time.Unix(61, 500*int64(time.Millisecond)))
+	if err != nil {
+		t.Fatalf("unable to make table: %v", err)
+	}
+	if want := []string{"METRIC", "JOB", "VALUE", "AGE"}; !reflect.DeepEqual(header, want) {
+		t.Errorf("got header %v, want %v", header, want)
+	}
+	want := [][]string{
+		{"up", "a", "1", "0s"},
+		{"up", "b", "1", "1m0s"},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("got rows %v, want the latest sample of each series, %v", rows, want)
+	}
+}
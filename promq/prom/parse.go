@@ -18,12 +18,22 @@ package prom
 
 import (
 	"io"
+	"strings"
 	"time"
 
+	"github.com/prometheus/prometheus/pkg/exemplar"
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/pkg/textparse"
 )
 
+const (
+	// OpenMetricsContentType is what endpoints serving OpenMetrics say they do.
+	OpenMetricsContentType = "application/openmetrics-text"
+	// AcceptHeader asks for OpenMetrics, falling back to the classic text format, like
+	// prometheus does when it scrapes.
+	AcceptHeader = "application/openmetrics-text;version=1.0.0,application/openmetrics-text;version=0.0.1;q=0.75,text/plain;version=0.0.4;q=0.5,*/*;q=0.1"
+)
+
 func PromTimestamp(normalTime time.Time) int64 {
 	return normalTime.UnixNano() / int64(time.Millisecond/time.Nanosecond)
 }
@@ -32,6 +42,59 @@ type ParsedSeries struct {
 	Labels    labels.Labels
 	Value     float64
 	Timestamp int64
+	// Type is the type of the metric family this series belongs to, as
+	// declared by the # TYPE line, i.e. a histogram's _bucket series are
+	// of type histogram.
+	Type textparse.MetricType
+	// Help is the # HELP text of the metric family this series belongs to.
+	Help string
+	// Stability is how stable the metric is, going by its help text.
+	Stability StabilityLevel
+	// Unit is the # UNIT of the metric family this series belongs to, only OpenMetrics
+	// has them.
+	Unit string
+	// Exemplar is the example of what went into the value, i.e. the trace of a
+	// request that landed in a histogram bucket, if the OpenMetrics had one.
+	Exemplar *exemplar.Exemplar
+	// Historical is set for the samples read back from a prometheus server's storage,
+	// rather than scraped, which never go stale: a series not being read back only
+	// means it has nothing new.
+	Historical bool
+}
+
+// StabilityLevel is how stable a Kubernetes metric is, which is marked at the
+// start of its help text, i.e. "[STABLE] the number of requests".
+type StabilityLevel string
+
+const (
+	StabilityInternal StabilityLevel = "INTERNAL"
+	StabilityAlpha    StabilityLevel = "ALPHA"
+	StabilityBeta     StabilityLevel = "BETA"
+	StabilityStable   StabilityLevel = "STABLE"
+	// deprecated metrics keep their level, i.e. "[ALPHA] (Deprecated since 1.19.0) ..."
+	StabilityDeprecated StabilityLevel = "DEPRECATED"
+)
+
+// ParseStabilityLevel finds the stability level in a metric's help text, or returns
+// an empty string if there isn't one, i.e. for metrics from outside of Kubernetes.
+func ParseStabilityLevel(help string) StabilityLevel {
+	if !strings.HasPrefix(help, "[") {
+		return ""
+	}
+	end := strings.Index(help, "]")
+	if end < 0 {
+		return ""
+	}
+	level := StabilityLevel(help[1:end])
+	switch level {
+	case StabilityInternal, StabilityAlpha, StabilityBeta, StabilityStable:
+	default:
+		return ""
+	}
+	if strings.HasPrefix(strings.TrimSpace(help[end+1:]), "(Deprecated") {
+		return StabilityDeprecated
+	}
+	return level
 }
 
 func ParseTextData(data []byte, nowish time.Time) ([]ParsedSeries, error) {
@@ -39,10 +102,40 @@ func ParseTextData(data []byte, nowish time.Time) ([]ParsedSeries, error) {
 }
 
 func ParseTextDataWithAdditionalLabels(data []byte, nowish time.Time, ls map[string]string) ([]ParsedSeries, error) {
+	return ParseDataWithAdditionalLabels(data, "", nowish, ls)
+}
+
+// ParseOpenMetricsData parses metrics in the OpenMetrics exposition format, which has to
+// end with '# EOF'.
+func ParseOpenMetricsData(data []byte, nowish time.Time) ([]ParsedSeries, error) {
+	return ParseDataWithAdditionalLabels(data, OpenMetricsContentType, nowish, map[string]string{})
+}
+
+// ParseDataWithAdditionalLabels parses metrics in whichever exposition format the content
+// type of the response they came in says, protobuf, OpenMetrics or otherwise the classic
+// text format.
+func ParseDataWithAdditionalLabels(data []byte, contentType string, nowish time.Time, ls map[string]string) ([]ParsedSeries, error) {
+	if isProtobuf(contentType) {
+		return ParseProtobufData(data, nowish, ls)
+	}
 	// prometheus time is milliseconds, cause
-	nowAbouts := PromTimestamp(nowish)
-	p := textparse.NewPromParser(data)
-	metrics := make([]ParsedSeries, 0)
+	var family textFamily
+	return family.parse(make([]ParsedSeries, 0), data, contentType, PromTimestamp(nowish), ls)
+}
+
+// textFamily is the metric family the text formats are in the middle of, and its
+// type, help text and unit, as set by the last # TYPE, # HELP and # UNIT lines.
+type textFamily struct {
+	name, help, unit string
+	typ              textparse.MetricType
+	// filter drops the series of the families which aren't wanted before they're built
+	filter *MetricFilter
+}
+
+// parse appends the series in data to metrics, picking up the metric family where the
+// last data it parsed left off, so that a scrape can be parsed a few lines at a time.
+func (f *textFamily) parse(metrics []ParsedSeries, data []byte, contentType string, nowAbouts int64, ls map[string]string) ([]ParsedSeries, error) {
+	p := textparse.New(data, contentType)
 	for {
 		et, err := p.Next()
 
@@ -52,11 +145,36 @@ func ParseTextDataWithAdditionalLabels(data []byte, nowish time.Time, ls map[str
 			return nil, err
 		}
 		switch et {
+		case textparse.EntryType:
+			name, mt := p.Type()
+			if string(name) != f.name {
+				f.name, f.help, f.unit = string(name), "", ""
+			}
+			f.typ = mt
+		case textparse.EntryHelp:
+			name, help := p.Help()
+			if string(name) != f.name {
+				f.name, f.typ, f.unit = string(name), textparse.MetricTypeUnknown, ""
+			}
+			f.help = string(help)
+		case textparse.EntryUnit:
+			name, unit := p.Unit()
+			if string(name) != f.name {
+				f.name, f.typ, f.help = string(name), textparse.MetricTypeUnknown, ""
+			}
+			f.unit = string(unit)
 		case textparse.EntrySeries:
 			_, optTimestamp, v := p.Series()
 			var res labels.Labels
 
 			p.Metric(&res)
+			name, family := res.Get(labels.MetricName), ""
+			if isSeriesOfFamily(name, f.name) {
+				family = f.name
+			}
+			if !f.filter.Keep(name, family) {
+				continue
+			}
 			var timestamp int64
 			if optTimestamp != nil {
 				timestamp = *optTimestamp
@@ -72,12 +190,40 @@ func ParseTextDataWithAdditionalLabels(data []byte, nowish time.Time, ls map[str
 				lb.Set(k, v)
 			}
 
+			seriesType, seriesHelp, seriesUnit := textparse.MetricTypeUnknown, "", ""
+			if family != "" {
+				seriesType, seriesHelp, seriesUnit = f.typ, f.help, f.unit
+			}
+
+			var ex *exemplar.Exemplar
+			if e := (exemplar.Exemplar{}); p.Exemplar(&e) {
+				ex = &e
+			}
+
 			metrics = append(metrics, ParsedSeries{
 				Labels:    lb.Labels(),
 				Value:     v,
 				Timestamp: timestamp,
+				Type:      seriesType,
+				Help:      seriesHelp,
+				Stability: ParseStabilityLevel(seriesHelp),
+				Unit:      seriesUnit,
+				Exemplar:  ex,
 			})
 		}
 	}
 	return metrics, nil
 }
+
+// isSeriesOfFamily checks whether a series belongs to the given metric family, accounting
+// for the suffixes that histograms, summaries and counters append to the family name.
+func isSeriesOfFamily(seriesName, family string) bool {
+	if family == "" || !strings.HasPrefix(seriesName, family) {
+		return false
+	}
+	switch seriesName[len(family):] {
+	case "", "_bucket", "_sum", "_count", "_total", "_created":
+		return true
+	}
+	return false
+}
@@ -21,7 +21,9 @@ import (
 	"testing"
 	"time"
 
+	"github.com/prometheus/prometheus/pkg/exemplar"
 	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/textparse"
 )
 
 func TestParseTextDataWithAdditionalLabels(t *testing.T) {
@@ -47,6 +49,54 @@ han_metric_total 1
 					Labels:    labels.FromMap(map[string]string{labels.InstanceName: "hostname1", labels.MetricName: "han_metric_total"}),
 					Value:     1,
 					Timestamp: PromTimestamp(now),
+					Type:      textparse.MetricTypeCounter,
+					Help:      "[STABLE] counter help",
+					Stability: StabilityStable,
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "histogram series are typed by their family",
+			data: []byte(`
+# HELP han_latency_seconds [STABLE] histogram help
+# TYPE han_latency_seconds histogram
+han_latency_seconds_bucket{le="+Inf"} 1
+han_latency_seconds_sum 0.5
+han_latency_seconds_count 1
+untyped_metric 2
+`),
+			ls: map[string]string{},
+			want: []ParsedSeries{
+				{
+					Labels:    labels.FromMap(map[string]string{labels.MetricName: "han_latency_seconds_bucket", labels.BucketLabel: "+Inf"}),
+					Value:     1,
+					Timestamp: PromTimestamp(now),
+					Type:      textparse.MetricTypeHistogram,
+					Help:      "[STABLE] histogram help",
+					Stability: StabilityStable,
+				},
+				{
+					Labels:    labels.FromMap(map[string]string{labels.MetricName: "han_latency_seconds_sum"}),
+					Value:     0.5,
+					Timestamp: PromTimestamp(now),
+					Type:      textparse.MetricTypeHistogram,
+					Help:      "[STABLE] histogram help",
+					Stability: StabilityStable,
+				},
+				{
+					Labels:    labels.FromMap(map[string]string{labels.MetricName: "han_latency_seconds_count"}),
+					Value:     1,
+					Timestamp: PromTimestamp(now),
+					Type:      textparse.MetricTypeHistogram,
+					Help:      "[STABLE] histogram help",
+					Stability: StabilityStable,
+				},
+				{
+					Labels:    labels.FromMap(map[string]string{labels.MetricName: "untyped_metric"}),
+					Value:     2,
+					Timestamp: PromTimestamp(now),
+					Type:      textparse.MetricTypeUnknown,
 				},
 			},
 			wantErr: false,
@@ -66,3 +116,81 @@ han_metric_total 1
 		})
 	}
 }
+
+func TestParseOpenMetricsData(t *testing.T) {
+	now := time.Now()
+	data := []byte(`# HELP requests A counter of requests.
+# TYPE requests counter
+requests_total{code="200"} 3 # {trace_id="abc123"} 1 1591005600.5
+requests_created{code="200"} 1591005000
+# HELP latency_seconds How long requests took.
+# TYPE latency_seconds gauge
+# UNIT latency_seconds seconds
+latency_seconds 0.25 1591005600
+# EOF
+`)
+	got, err := ParseOpenMetricsData(data, now)
+	if err != nil {
+		t.Fatalf("unable to parse OpenMetrics: %v", err)
+	}
+	want := []ParsedSeries{
+		{
+			Labels:    labels.FromStrings(labels.MetricName, "requests_total", "code", "200"),
+			Value:     3,
+			Timestamp: PromTimestamp(now),
+			Type:      textparse.MetricTypeCounter,
+			Help:      "A counter of requests.",
+			Exemplar: &exemplar.Exemplar{
+				Labels: labels.FromStrings("trace_id", "abc123"),
+				Value:  1,
+				Ts:     1591005600500,
+				HasTs:  true,
+			},
+		},
+		{
+			Labels:    labels.FromStrings(labels.MetricName, "requests_created", "code", "200"),
+			Value:     1591005000,
+			Timestamp: PromTimestamp(now),
+			Type:      textparse.MetricTypeCounter,
+			Help:      "A counter of requests.",
+		},
+		{
+			Labels:    labels.FromStrings(labels.MetricName, "latency_seconds"),
+			Value:     0.25,
+			Timestamp: 1591005600000,
+			Type:      textparse.MetricTypeGauge,
+			Help:      "How long requests took.",
+			Unit:      "seconds",
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseOpenMetricsData() got = %v, want %v", got, want)
+	}
+
+	// OpenMetrics has to end with # EOF, the classic text format doesn't
+	if _, err := ParseOpenMetricsData([]byte("requests_total 3\n"), now); err == nil {
+		t.Errorf("expected an error parsing OpenMetrics without # EOF")
+	}
+	if _, err := ParseDataWithAdditionalLabels([]byte("requests_total 3\n"), "text/plain; version=0.0.4", now, map[string]string{}); err != nil {
+		t.Errorf("unable to parse the classic text format: %v", err)
+	}
+}
+
+func TestParseStabilityLevel(t *testing.T) {
+	testCases := map[string]StabilityLevel{
+		"[STABLE] counter help":                          StabilityStable,
+		"[BETA] counter help":                            StabilityBeta,
+		"[ALPHA] counter help":                           StabilityAlpha,
+		"[INTERNAL] counter help":                        StabilityInternal,
+		"[ALPHA] (Deprecated since 1.19.0) counter help": StabilityDeprecated,
+		"counter help":                                   "",
+		"[something] else":                               "",
+		"[STABLE counter help":                           "",
+		"":                                               "",
+	}
+	for help, want := range testCases {
+		if got := ParseStabilityLevel(help); got != want {
+			t.Errorf("ParseStabilityLevel(%q) = %q, want %q", help, got, want)
+		}
+	}
+}
@@ -18,10 +18,16 @@ package prom
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"reflect"
 	"testing"
 	"time"
 
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/textparse"
 	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage"
 )
 
 var testData = [][]byte{
@@ -82,7 +88,8 @@ func TestRangeQuery(t *testing.T) {
 		{
 			qs: `cheese{sharpness=~"s.*"}`,
 			expectedValuesForLabels: map[string][]float64{
-				`{__name__="cheese", sharpness="sunnyvale"}`:             {0.22, 0.22},
+				// it's gone by the second scrape, so it's stale rather than flat
+				`{__name__="cheese", sharpness="sunnyvale"}`:             {0.22},
 				`{__name__="cheese", sharpness="secret cheese enclave"}`: {0.01, 0.79},
 			},
 		},
@@ -139,6 +146,581 @@ func TestRangeQuery(t *testing.T) {
 	}
 }
 
+func TestExecuteRangeQuery(t *testing.T) {
+	start := time.Unix(0, 0)
+	data := NewPeriodicData(nil, DefaultEngineOptions(time.Minute, 1000))
+	for i, raw := range testData {
+		points, err := ParseTextData(raw, start.Add(time.Duration(i+1)*time.Second))
+		if err != nil {
+			t.Fatalf("unable to parse data: %v", err)
+		}
+		if err := data.storage.LoadData(points); err != nil {
+			t.Fatalf("unable to load data: %v", err)
+		}
+	}
+	if err := data.SetQuery(context.TODO(), `crackers`); err != nil {
+		t.Fatalf("unable to set query: %v", err)
+	}
+
+	var got []float64
+	err := data.ExecuteRangeQuery(context.TODO(), start.Add(time.Second), start.Add(2*time.Second), time.Second, func(res *promql.Result) error {
+		matrix, err := res.Matrix()
+		if err != nil {
+			return err
+		}
+		for _, series := range matrix {
+			for _, pt := range series.Points {
+				got = append(got, pt.V)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unable to execute range query: %v", err)
+	}
+	if want := []float64{37.5, 9000.1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got points %v, want %v", got, want)
+	}
+}
+
+func TestStalenessMarkers(t *testing.T) {
+	start := time.Unix(0, 0)
+	storage := NewRangeStorage()
+	scrapes := [][]byte{
+		[]byte("cheese{sharpness=\"vermont\"} 0.33\ncheese{sharpness=\"sunnyvale\"} 0.22\ncrackers 1 500\n"),
+		[]byte("cheese{sharpness=\"vermont\"} 0.43\n"),
+		[]byte("cheese{sharpness=\"vermont\"} 0.53\ncheese{sharpness=\"sunnyvale\"} 0.24\n"),
+	}
+	for i, raw := range scrapes {
+		points, err := ParseTextData(raw, start.Add(time.Duration(i+1)*time.Second))
+		if err != nil {
+			t.Fatalf("unable to parse data: %v", err)
+		}
+		if i == 0 {
+			// read back from a prometheus server, at the same time as the scrape
+			points = append(points, ParsedSeries{Labels: labels.FromStrings(labels.MetricName, "up"), Value: 1, Timestamp: PromTimestamp(start.Add(time.Second)), Historical: true})
+		}
+		if err := storage.LoadData(points); err != nil {
+			t.Fatalf("unable to load data: %v", err)
+		}
+	}
+
+	engine := promql.NewEngine(DefaultEngineOptions(time.Minute, 1000))
+	valuesAt := func(qs string, ts time.Time) map[string]float64 {
+		query, err := engine.NewInstantQuery(storage, qs, ts)
+		if err != nil {
+			t.Fatalf("unable to construct query: %v", err)
+		}
+		defer query.Close()
+		vec, err := query.Exec(context.TODO()).Vector()
+		if err != nil {
+			t.Fatalf("unable to run query: %v", err)
+		}
+		values := map[string]float64{}
+		for _, sample := range vec {
+			values[sample.Metric.String()] = sample.V
+		}
+		return values
+	}
+
+	if got, want := valuesAt("cheese", start.Add(2*time.Second)), map[string]float64{`{__name__="cheese", sharpness="vermont"}`: 0.43}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v once sunnyvale was gone, want %v", got, want)
+	}
+	want := map[string]float64{
+		`{__name__="cheese", sharpness="vermont"}`:   0.53,
+		`{__name__="cheese", sharpness="sunnyvale"}`: 0.24,
+	}
+	if got := valuesAt("cheese", start.Add(3*time.Second)); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v once sunnyvale was back, want %v", got, want)
+	}
+	// crackers has its own timestamp, so it's only gone once it's older than the lookback
+	if got, want := valuesAt("crackers", start.Add(3*time.Second)), map[string]float64{`{__name__="crackers"}`: 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v for a series with its own timestamp, want %v", got, want)
+	}
+	// and what's read back never goes stale
+	if got, want := valuesAt("up", start.Add(3*time.Second)), map[string]float64{`{__name__="up"}`: 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v for a series read back, want %v", got, want)
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	start := time.Unix(0, 0)
+	storage := NewRangeStorage()
+	scraped, err := ParseTextData([]byte("cheese{sharpness=\"vermont\"} 0.5\n"), start.Add(10*time.Second))
+	if err != nil {
+		t.Fatalf("unable to parse data: %v", err)
+	}
+	if err := storage.LoadData(scraped); err != nil {
+		t.Fatalf("unable to load data: %v", err)
+	}
+	var history []ParsedSeries
+	// newest first, to check that they're slotted in the right way around
+	for i := 3; i > 0; i-- {
+		points, err := ParseTextData([]byte(fmt.Sprintf("cheese{sharpness=\"vermont\"} %d\ncheese{sharpness=\"sunnyvale\"} %d\n", i, 10*i)), start.Add(time.Duration(i)*time.Second))
+		if err != nil {
+			t.Fatalf("unable to parse data: %v", err)
+		}
+		history = append(history, points...)
+	}
+	if err := storage.Backfill(history); err != nil {
+		t.Fatalf("unable to backfill: %v", err)
+	}
+
+	engine := promql.NewEngine(DefaultEngineOptions(time.Minute, 1000))
+	valuesAt := func(qs string, ts time.Time) map[string]float64 {
+		query, err := engine.NewInstantQuery(storage, qs, ts)
+		if err != nil {
+			t.Fatalf("unable to construct query: %v", err)
+		}
+		defer query.Close()
+		vec, err := query.Exec(context.TODO()).Vector()
+		if err != nil {
+			t.Fatalf("unable to run query: %v", err)
+		}
+		values := map[string]float64{}
+		for _, sample := range vec {
+			values[sample.Metric.String()] = sample.V
+		}
+		return values
+	}
+
+	want := map[string]float64{
+		`{__name__="cheese", sharpness="vermont"}`:   2,
+		`{__name__="cheese", sharpness="sunnyvale"}`: 20,
+	}
+	if got := valuesAt("cheese", start.Add(2*time.Second)); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v from the backfilled history, want %v", got, want)
+	}
+	// what was scraped is still the latest, and nothing went stale over the backfill
+	want = map[string]float64{
+		`{__name__="cheese", sharpness="vermont"}`:   0.5,
+		`{__name__="cheese", sharpness="sunnyvale"}`: 30,
+	}
+	if got := valuesAt("cheese", start.Add(10*time.Second)); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v after the backfill, want %v", got, want)
+	}
+}
+
+func TestCounterResets(t *testing.T) {
+	start := time.Unix(0, 0)
+	scrapes := []string{
+		"requests_total{job=\"a\"} 10\nrequests_total{job=\"b\"} 10\ntemperature 30\n",
+		"requests_total{job=\"a\"} 2\nrequests_total{job=\"b\"} 12\ntemperature 20\n",
+		"requests_total{job=\"b\"} 14\ntemperature 25\n",
+		// a's gone stale in between, but came back restarted
+		"requests_total{job=\"a\"} 1\nrequests_total{job=\"b\"} 16\ntemperature 25\n",
+	}
+	data := NewPeriodicData(nil, DefaultEngineOptions(time.Minute, 1000))
+	data.Times = Range{Window: time.Minute, Interval: time.Second}
+	for i, raw := range scrapes {
+		points, err := ParseTextData([]byte("# TYPE requests_total counter\n# TYPE temperature gauge\n"+raw), start.Add(time.Duration(i+1)*time.Second))
+		if err != nil {
+			t.Fatalf("unable to parse data: %v", err)
+		}
+		if err := data.storage.LoadData(points); err != nil {
+			t.Fatalf("unable to load data: %v", err)
+		}
+	}
+
+	for _, query := range []string{"rate(requests_total[5m]) / rate(requests_total[5m] offset 1m)", "temperature"} {
+		if err := data.SetQuery(context.TODO(), query); err != nil {
+			t.Fatalf("unable to set query: %v", err)
+		}
+		var got []int64
+		for _, reset := range data.counterResets(start.Add(5 * time.Second)) {
+			if job := reset.Series.Get("job"); job != "a" {
+				t.Errorf("got a reset of %s, only a was reset", reset.Series)
+			}
+			got = append(got, reset.Timestamp)
+		}
+		want := []int64{2000, 4000}
+		if query == "temperature" {
+			// gauges go down all the time
+			want = nil
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got resets at %v for %q, want %v", got, query, want)
+		}
+	}
+}
+
+func TestIsCounter(t *testing.T) {
+	tests := []struct {
+		name       string
+		metricType textparse.MetricType
+		want       bool
+	}{
+		{name: "requests_total", metricType: textparse.MetricTypeCounter, want: true},
+		{name: "temperature", metricType: textparse.MetricTypeGauge, want: false},
+		{name: "requests_total", metricType: textparse.MetricTypeUnknown, want: true},
+		{name: "latency_seconds_bucket", metricType: textparse.MetricTypeHistogram, want: true},
+		{name: "latency_seconds_sum", metricType: textparse.MetricTypeHistogram, want: true},
+		{name: "latency_seconds_count", metricType: textparse.MetricTypeHistogram, want: true},
+		{name: "latency_seconds", metricType: textparse.MetricTypeHistogram, want: true},
+		{name: "latency_seconds_created", metricType: textparse.MetricTypeHistogram, want: false},
+		{name: "latency_seconds_sum", metricType: textparse.MetricTypeSummary, want: true},
+		{name: "latency_seconds_count", metricType: textparse.MetricTypeSummary, want: true},
+		{name: "latency_seconds", metricType: textparse.MetricTypeSummary, want: false},
+		{name: "queue_depth_bucket", metricType: textparse.MetricTypeGaugeHistogram, want: false},
+	}
+	for _, test := range tests {
+		if got := IsCounter(test.name, test.metricType); got != test.want {
+			t.Errorf("got %v for the %s %s, want %v", got, test.metricType, test.name, test.want)
+		}
+	}
+}
+
+func TestRollback(t *testing.T) {
+	storage := NewRangeStorage()
+	parse := func(raw string, ts time.Time) []ParsedSeries {
+		points, err := ParseTextData([]byte("# TYPE requests_total counter\n"+raw), ts)
+		if err != nil {
+			t.Fatalf("unable to parse data: %v", err)
+		}
+		return points
+	}
+	if err := storage.LoadData(parse("requests_total{job=\"a\"} 10\nrequests_total{job=\"b\"} 10\n", time.Unix(2, 0))); err != nil {
+		t.Fatalf("unable to load data: %v", err)
+	}
+	snapshot := func() map[string][]datapoint {
+		series := map[string][]datapoint{}
+		for _, block := range storage.data {
+			series[block.series.String()] = append([]datapoint(nil), block.data...)
+		}
+		return series
+	}
+	before := snapshot()
+
+	// a reset of a, a point of b from before the last scrape, and a new series, which
+	// then fails to scrape
+	app := storage.Appender()
+	points := parse("requests_total{job=\"a\"} 1\nrequests_total{job=\"c\"} 1\n", time.Unix(3, 0))
+	points = append(points, parse("requests_total{job=\"b\"} 5\n", time.Unix(1, 0))...)
+	for _, point := range points {
+		if err := app.Append(point); err != nil {
+			t.Fatalf("unable to append: %v", err)
+		}
+	}
+	if err := app.Rollback(); err != nil {
+		t.Fatalf("unable to roll back: %v", err)
+	}
+	if got := snapshot(); !reflect.DeepEqual(got, before) {
+		t.Errorf("got %v after rolling back, want what was there before, %v", got, before)
+	}
+	for _, block := range storage.data {
+		if len(block.resets) != 0 {
+			t.Errorf("got resets %v of %s after rolling back, want none", block.resets, block.series)
+		}
+	}
+	if _, ok := storage.lastBatch[0]; !ok || storage.lastBatchTime != 2000 {
+		t.Errorf("got the last batch %v at %d, want the first scrape's", storage.lastBatch, storage.lastBatchTime)
+	}
+
+	// and the series it added can be added again
+	if err := storage.LoadData(parse("requests_total{job=\"c\"} 2\n", time.Unix(4, 0))); err != nil {
+		t.Fatalf("unable to load data: %v", err)
+	}
+	if got := snapshot()[`{__name__="requests_total", job="c"}`]; len(got) != 1 || got[0].value != 2 {
+		t.Errorf("got %v for the series added again, want its one point", got)
+	}
+}
+
+func TestRangeStorageClean(t *testing.T) {
+	start := time.Unix(0, 0)
+	storage := NewRangeStorage()
+	load := func(raw string, at time.Duration) {
+		points, err := ParseTextData([]byte(raw), start.Add(at))
+		if err != nil {
+			t.Fatalf("unable to parse data: %v", err)
+		}
+		if err := storage.LoadData(points); err != nil {
+			t.Fatalf("unable to load data: %v", err)
+		}
+	}
+	load("cheese 1\ncrackers 1\n", time.Second)
+	load("cheese 2\n", 2*time.Second)
+	load("cheese 3\n", 3*time.Second)
+
+	storage.Clean(PromTimestamp(start.Add(2 * time.Second)))
+	if len(storage.data) != 1 {
+		t.Errorf("got %d series after cleaning, want just cheese", len(storage.data))
+	}
+	points := func(name string) []datapoint {
+		set := (&memQuerier{storage: storage}).Select(false, nil, labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, name))
+		var data []datapoint
+		for set.Next() {
+			data = append(data, set.At().(*blockSeries).block.data...)
+		}
+		return data
+	}
+	if got, want := points("cheese"), []datapoint{{timestamp: 2000, value: 2}, {timestamp: 3000, value: 3}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got cheese %v after cleaning, want %v", got, want)
+	}
+
+	// crackers is forgotten, so comes back as if it were new
+	load("cheese 4\ncrackers 4\n", 4*time.Second)
+	if got, want := points("crackers"), []datapoint{{timestamp: 4000, value: 4}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got crackers %v once it came back, want %v", got, want)
+	}
+}
+
+func TestLookbehind(t *testing.T) {
+	testcases := []struct {
+		query string
+		want  time.Duration
+	}{
+		{query: "up", want: 5 * time.Minute},
+		{query: "rate(requests_total[1h])", want: time.Hour + 5*time.Minute},
+		{query: "up offset 1d / up", want: 24*time.Hour + 5*time.Minute},
+		{query: "max_over_time(rate(requests_total[5m])[30m:1m] offset 10m)", want: 50 * time.Minute},
+		{query: "not a query (", want: 5 * time.Minute},
+	}
+	for _, tc := range testcases {
+		if got := lookbehind(tc.query, DefaultLookbackDelta); got != tc.want {
+			t.Errorf("got %v for %q, want %v", got, tc.query, tc.want)
+		}
+	}
+	if got := lookbehind("rate(requests_total[1h])", 15*time.Minute); got != time.Hour+15*time.Minute {
+		t.Errorf("got %v with a 15m lookback delta, want 1h15m", got)
+	}
+}
+
+func TestDownsample(t *testing.T) {
+	start := time.Unix(0, 0)
+	s := NewRangeStorage()
+	for i := 1; i <= 100; i++ {
+		points, err := ParseTextData([]byte(fmt.Sprintf("temperature %d\n", i)), start.Add(time.Duration(i)*time.Second))
+		if err != nil {
+			t.Fatalf("unable to parse data: %v", err)
+		}
+		if err := s.LoadData(points); err != nil {
+			t.Fatalf("unable to load data: %v", err)
+		}
+	}
+	view := func(hints *storage.SelectHints) []datapoint {
+		set := (&memQuerier{storage: s}).Select(false, hints, labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, "temperature"))
+		var data []datapoint
+		for set.Next() {
+			it := set.At().Iterator()
+			for it.Next() {
+				ts, v := it.At()
+				data = append(data, datapoint{timestamp: ts, value: v})
+			}
+		}
+		return data
+	}
+
+	s.Downsample(65000, 10000, false)
+	if got := view(&storage.SelectHints{Step: 1000}); len(got) != 100 {
+		t.Errorf("got %d points for a fine step, want every sample", len(got))
+	}
+	got := view(&storage.SelectHints{Step: 10000})
+	if len(got) != 6+41 {
+		t.Fatalf("got %d points for a coarse step, want 6 buckets and the 41 samples since", len(got))
+	}
+	if want := (datapoint{timestamp: 19000, value: 14.5}); got[1] != want {
+		t.Errorf("got %v for the second bucket, want its average, %v", got[1], want)
+	}
+	if want := (datapoint{timestamp: 60000, value: 60}); got[6] != want {
+		t.Errorf("got %v after the buckets, want the raw samples, starting with %v", got[6], want)
+	}
+	if got := view(&storage.SelectHints{Step: 10000, Func: "max_over_time"}); got[1].value != 19 {
+		t.Errorf("got %v for the second bucket of max_over_time, want its max, 19", got[1].value)
+	}
+	if got := view(&storage.SelectHints{Step: 10000, Range: 15000, Func: "rate"}); len(got) != 100 {
+		t.Errorf("got %d points for a range shorter than two buckets, want every sample", len(got))
+	}
+	if got := view(&storage.SelectHints{Step: 10000, Range: 20000, Func: "rate"}); len(got) != 6+41 {
+		t.Errorf("got %d points for a range of two buckets, want 6 buckets and the 41 samples since", len(got))
+	}
+
+	s.Downsample(80000, 10000, true)
+	if got := view(&storage.SelectHints{Step: 1000}); len(got) != 8+21 {
+		t.Errorf("got %d points once the samples were discarded, want 8 buckets and the 21 samples since", len(got))
+	}
+
+	// what's backfilled from before then is downsampled too, in with what's there, or
+	// in a bucket of its own
+	err := s.Backfill([]ParsedSeries{
+		{Labels: labels.FromStrings(labels.MetricName, "temperature"), Value: 1000, Timestamp: 500},
+		{Labels: labels.FromStrings(labels.MetricName, "temperature"), Value: -5, Timestamp: -10000},
+	})
+	if err != nil {
+		t.Fatalf("unable to backfill: %v", err)
+	}
+	got = view(&storage.SelectHints{Step: 1000, Func: "max_over_time"})
+	if len(got) != 9+21 {
+		t.Fatalf("got %d points once backfilled, want 9 buckets and the 21 samples since", len(got))
+	}
+	if got[0] != (datapoint{timestamp: -10000, value: -5}) || got[1].value != 1000 {
+		t.Errorf("got %v and %v for the first buckets, want the backfilled samples in them", got[0], got[1])
+	}
+}
+
+func TestResolution(t *testing.T) {
+	testcases := []struct {
+		times Range
+		want  time.Duration
+	}{
+		{times: Range{Window: 15 * time.Minute, Interval: time.Second}, want: 0},
+		{times: Range{Window: time.Hour, Interval: time.Second}, want: 7200 * time.Millisecond},
+		{times: Range{Window: 24 * time.Hour, Interval: time.Second}, want: 172800 * time.Millisecond},
+		{times: Range{Window: 24 * time.Hour, Interval: time.Second, Instant: true}, want: 0},
+	}
+	for _, tc := range testcases {
+		data := &PeriodicData{Times: tc.times}
+		if got := data.resolution(); got != tc.want {
+			t.Errorf("got resolution %v for a %v window, want %v", got, tc.times.Window, tc.want)
+		}
+	}
+}
+
+func TestZoomingOnlyChangesTheStep(t *testing.T) {
+	data := &PeriodicData{Times: Range{Window: time.Hour, Interval: time.Second}}
+	data.SetView(View{Window: 24 * time.Hour})
+	if got, want := data.resolution(), 7200*time.Millisecond; got != want {
+		t.Errorf("got resolution %v zoomed out, want the %v of the window we scrape", got, want)
+	}
+	if got, want := data.step(), 172800*time.Millisecond; got != want {
+		t.Errorf("got step %v zoomed out, want the %v of the day charted", got, want)
+	}
+}
+
+func TestViewKeepsWhatsCharted(t *testing.T) {
+	now := time.Unix(3*60*60, 0)
+	storage := NewRangeStorage()
+	data := &PeriodicData{storage: storage, Times: Range{Window: 15 * time.Minute}}
+	for _, at := range []time.Time{now.Add(-90 * time.Minute), now} {
+		points, err := ParseTextData([]byte("cheese 1\n"), at)
+		if err != nil {
+			t.Fatalf("unable to parse data: %v", err)
+		}
+		if err := storage.LoadData(points); err != nil {
+			t.Fatalf("unable to load data: %v", err)
+		}
+	}
+
+	data.SetView(View{Window: 2 * time.Hour})
+	if start, end := data.charted().Bounds(now); !start.Equal(now.Add(-2*time.Hour)) || !end.Equal(now) {
+		t.Errorf("got %v to %v zoomed out, want the 2h up to now", start, end)
+	}
+	data.clean(now)
+	cheese := func() []datapoint {
+		set := (&memQuerier{storage: storage}).Select(false, nil, labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, "cheese"))
+		var got []datapoint
+		for set.Next() {
+			got = append(got, set.At().(*blockSeries).block.data...)
+		}
+		return got
+	}
+	if got := cheese(); len(got) != 2 {
+		t.Errorf("got %v zoomed out, want the samples of the 2h charted, not just the 15m window", got)
+	}
+
+	paused := now.Add(-80 * time.Minute)
+	data.SetView(View{Window: 30 * time.Minute, End: paused})
+	if start, end := data.charted().Bounds(now); !start.Equal(paused.Add(-30*time.Minute)) || !end.Equal(paused) {
+		t.Errorf("got %v to %v paused, want the 30m up to when it was paused", start, end)
+	}
+
+	data.SetView(View{})
+	data.clean(now)
+	if got := cheese(); len(got) != 1 {
+		t.Errorf("got %v back to the window, want just the sample in it", got)
+	}
+}
+
+func TestInstantViewIsChartedAsAVector(t *testing.T) {
+	data := NewPeriodicData(&scrapesSource{scrapes: [][]byte{testData[0]}}, DefaultEngineOptions(time.Minute, 1000))
+	data.Times = Range{Window: 15 * time.Minute, Interval: time.Minute}
+	var got promql.Value
+	data.Callback = func(res *promql.Result) error {
+		got = res.Value
+		return res.Err
+	}
+	if err := data.SetQuery(context.TODO(), "cheese"); err != nil {
+		t.Fatalf("unable to set query: %v", err)
+	}
+	if err := data.Scrape(context.TODO()); err != nil {
+		t.Fatalf("unable to scrape: %v", err)
+	}
+	if _, isMatrix := got.(promql.Matrix); !isMatrix {
+		t.Errorf("got %T, want a matrix, the window charted as lines", got)
+	}
+
+	data.SetView(View{Instant: true})
+	if err := data.Requery(context.TODO()); err != nil {
+		t.Fatalf("unable to query: %v", err)
+	}
+	if vector, isVector := got.(promql.Vector); !isVector || len(vector) != 5 {
+		t.Errorf("got %v, want a vector of the latest sample of each of the 5 series", got)
+	}
+}
+
+type partialSource struct{}
+
+func (partialSource) ScrapePrometheusEndpoint(_ context.Context, nowish time.Time) ([]ParsedSeries, error) {
+	series, err := ParseTextData([]byte("cheese 1\n"), nowish)
+	if err != nil {
+		return nil, err
+	}
+	return series, &PartialScrapeError{Errors: []error{errors.New("http://crackers: connection refused")}}
+}
+
+func TestScrapeChartsPartialScrapes(t *testing.T) {
+	data := NewPeriodicData(partialSource{}, DefaultEngineOptions(time.Minute, 1000))
+	data.Times = Range{Instant: true}
+	if err := data.SetQuery(context.TODO(), "cheese"); err != nil {
+		t.Fatalf("unable to set query: %v", err)
+	}
+	var res *promql.Result
+	data.Callback = func(r *promql.Result) error {
+		res = r
+		return nil
+	}
+	if err := data.Scrape(context.TODO()); err != nil {
+		t.Fatalf("got error %v, want the partial scrape to be charted", err)
+	}
+	if vec, err := res.Vector(); err != nil || len(vec) != 1 {
+		t.Errorf("got %v, %v, want the series we did scrape", res.Value, err)
+	}
+	if len(res.Warnings) != 1 || res.Warnings[0].Error() != "http://crackers: connection refused" {
+		t.Errorf("got warnings %v, want the target we couldn't scrape", res.Warnings)
+	}
+}
+
+// countingIndex is an index which counts the series it's given, standing in for some
+// other implementation.
+type countingIndex struct {
+	Indexer
+	updates int
+}
+
+func (i *countingIndex) UpdateMetric(m ParsedSeries) {
+	i.updates++
+	i.Indexer.UpdateMetric(m)
+}
+
+func TestScrapeIndexesIntoGivenIndex(t *testing.T) {
+	data := NewPeriodicData(&scrapesSource{scrapes: [][]byte{testData[0]}}, DefaultEngineOptions(time.Minute, 1000))
+	index := &countingIndex{Indexer: NewIndex()}
+	data.SetIndex(index)
+	data.Times = Range{Instant: true}
+	data.Callback = func(*promql.Result) error { return nil }
+	if err := data.SetQuery(context.TODO(), "cheese"); err != nil {
+		t.Fatalf("unable to set query: %v", err)
+	}
+	if err := data.Scrape(context.TODO()); err != nil {
+		t.Fatalf("unable to scrape: %v", err)
+	}
+	if index.updates != 5 {
+		t.Errorf("got %d series indexed, want 5", index.updates)
+	}
+	if data.GetIndex() != index {
+		t.Errorf("expected the index we were given to be the one used")
+	}
+}
+
 func TestInstantQuery(t *testing.T) {
 	now := time.Now()
 	points, err := ParseTextData(testData[0], now)
@@ -0,0 +1,188 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/exemplar"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/textparse"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// ProtobufAcceptHeader asks for the protobuf exposition format, falling back to
+// OpenMetrics and then the classic text format. It has no units.
+const ProtobufAcceptHeader = expfmt.ProtoFmt + " encoding=delimited;q=1.0," + AcceptHeader
+
+// isProtobuf checks whether a content type is the delimited protobuf exposition format.
+func isProtobuf(contentType string) bool {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == expfmt.ProtoType &&
+		params["proto"] == expfmt.ProtoProtocol && params["encoding"] == "delimited"
+}
+
+// ParseProtobufData parses metrics in the delimited protobuf exposition format, each
+// histogram and summary becomes the same series the text formats would have.
+//
+// Native histograms aren't supported: our client_model and query engine predate them,
+// so only the classic buckets, sum and count of a histogram are read, and a histogram
+// without classic buckets is an error rather than one with nothing in it.
+func ParseProtobufData(data []byte, nowish time.Time, ls map[string]string) ([]ParsedSeries, error) {
+	nowAbouts := PromTimestamp(nowish)
+	decoder := expfmt.NewDecoder(bytes.NewReader(data), expfmt.FmtProtoDelim)
+	metrics := make([]ParsedSeries, 0)
+	for {
+		var family dto.MetricFamily
+		if err := decoder.Decode(&family); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		var err error
+		if metrics, err = appendProtobufSeries(metrics, &family, nowAbouts, ls, nil); err != nil {
+			return nil, err
+		}
+	}
+	return metrics, nil
+}
+
+// appendProtobufSeries appends the series of a metric family to metrics, the ones the
+// filter keeps, by their own names, i.e. a histogram's _bucket series can be dropped
+// without its _sum and _count. A family we can't read, i.e. a native histogram, adds
+// nothing, and is returned as an error.
+func appendProtobufSeries(metrics []ParsedSeries, family *dto.MetricFamily, nowAbouts int64, ls map[string]string, filter *MetricFilter) ([]ParsedSeries, error) {
+	start := len(metrics)
+	familyType := protobufMetricType(family.GetType())
+	help := family.GetHelp()
+	for _, m := range family.GetMetric() {
+		timestamp := nowAbouts
+		if m.TimestampMs != nil {
+			timestamp = m.GetTimestampMs()
+		}
+		add := func(name string, value float64, ex *dto.Exemplar, extra ...string) {
+			if !filter.Keep(name, family.GetName()) {
+				return
+			}
+			lb := labels.NewBuilder(nil)
+			for _, l := range m.GetLabel() {
+				lb.Set(l.GetName(), l.GetValue())
+			}
+			for k, v := range ls {
+				lb.Set(k, v)
+			}
+			for i := 0; i+1 < len(extra); i += 2 {
+				lb.Set(extra[i], extra[i+1])
+			}
+			lb.Set(labels.MetricName, name)
+			metrics = append(metrics, ParsedSeries{
+				Labels:    lb.Labels(),
+				Value:     value,
+				Timestamp: timestamp,
+				Type:      familyType,
+				Help:      help,
+				Stability: ParseStabilityLevel(help),
+				Exemplar:  protobufExemplar(ex),
+			})
+		}
+
+		name := family.GetName()
+		switch family.GetType() {
+		case dto.MetricType_COUNTER:
+			add(name, m.GetCounter().GetValue(), m.GetCounter().GetExemplar())
+		case dto.MetricType_GAUGE:
+			add(name, m.GetGauge().GetValue(), nil)
+		case dto.MetricType_SUMMARY:
+			s := m.GetSummary()
+			for _, q := range s.GetQuantile() {
+				add(name, q.GetValue(), nil, "quantile", formatFloat(q.GetQuantile()))
+			}
+			add(name+"_sum", s.GetSampleSum(), nil)
+			add(name+"_count", float64(s.GetSampleCount()), nil)
+		case dto.MetricType_HISTOGRAM:
+			h := m.GetHistogram()
+			if isNativeHistogram(h) && filter.Keep(name+"_bucket", name) {
+				return metrics[:start], fmt.Errorf("%s is a native histogram, only classic histograms are supported", name)
+			}
+			sawInf := false
+			for _, b := range h.GetBucket() {
+				sawInf = sawInf || math.IsInf(b.GetUpperBound(), 1)
+				add(name+"_bucket", float64(b.GetCumulativeCount()), b.GetExemplar(), labels.BucketLabel, formatFloat(b.GetUpperBound()))
+			}
+			// the +Inf bucket is implicit in protobuf, but not in the text formats
+			if !sawInf {
+				add(name+"_bucket", float64(h.GetSampleCount()), nil, labels.BucketLabel, "+Inf")
+			}
+			add(name+"_sum", h.GetSampleSum(), nil)
+			add(name+"_count", float64(h.GetSampleCount()), nil)
+		default:
+			add(name, m.GetUntyped().GetValue(), nil)
+		}
+	}
+	return metrics, nil
+}
+
+// isNativeHistogram checks whether a histogram is a native one, which our client_model
+// can only tell by it having no classic buckets, but observations, or fields it doesn't
+// know, i.e. the schema and spans of the native buckets.
+func isNativeHistogram(h *dto.Histogram) bool {
+	return len(h.GetBucket()) == 0 && (h.GetSampleCount() > 0 || len(h.XXX_unrecognized) > 0)
+}
+
+func protobufMetricType(t dto.MetricType) textparse.MetricType {
+	switch t {
+	case dto.MetricType_COUNTER:
+		return textparse.MetricTypeCounter
+	case dto.MetricType_GAUGE:
+		return textparse.MetricTypeGauge
+	case dto.MetricType_SUMMARY:
+		return textparse.MetricTypeSummary
+	case dto.MetricType_HISTOGRAM:
+		return textparse.MetricTypeHistogram
+	}
+	return textparse.MetricTypeUnknown
+}
+
+func protobufExemplar(e *dto.Exemplar) *exemplar.Exemplar {
+	if e == nil {
+		return nil
+	}
+	var ls []labels.Label
+	for _, l := range e.GetLabel() {
+		ls = append(ls, labels.Label{Name: l.GetName(), Value: l.GetValue()})
+	}
+	ex := &exemplar.Exemplar{Labels: labels.New(ls...), Value: e.GetValue()}
+	if e.Timestamp != nil {
+		ex.Ts = PromTimestamp(e.GetTimestamp().AsTime())
+		ex.HasTs = true
+	}
+	return ex
+}
+
+// formatFloat formats bucket bounds and quantiles like the text formats do, i.e. +Inf
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
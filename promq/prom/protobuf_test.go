@@ -0,0 +1,153 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/prometheus/pkg/exemplar"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/textparse"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+func TestParseProtobufData(t *testing.T) {
+	now := time.Now()
+	families := []*dto.MetricFamily{
+		{
+			Name: proto.String("requests_total"),
+			Help: proto.String("[STABLE] requests"),
+			Type: dto.MetricType_COUNTER.Enum(),
+			Metric: []*dto.Metric{{
+				Label: []*dto.LabelPair{{Name: proto.String("code"), Value: proto.String("200")}},
+				Counter: &dto.Counter{
+					Value:    proto.Float64(3),
+					Exemplar: &dto.Exemplar{Label: []*dto.LabelPair{{Name: proto.String("trace_id"), Value: proto.String("abc123")}}, Value: proto.Float64(1)},
+				},
+			}},
+		},
+		{
+			Name: proto.String("latency_seconds"),
+			Type: dto.MetricType_HISTOGRAM.Enum(),
+			Metric: []*dto.Metric{{
+				TimestampMs: proto.Int64(1591005600000),
+				Histogram: &dto.Histogram{
+					SampleCount: proto.Uint64(2),
+					SampleSum:   proto.Float64(0.75),
+					Bucket:      []*dto.Bucket{{UpperBound: proto.Float64(0.5), CumulativeCount: proto.Uint64(1)}},
+				},
+			}},
+		},
+	}
+	var buf bytes.Buffer
+	encoder := expfmt.NewEncoder(&buf, expfmt.FmtProtoDelim)
+	for _, f := range families {
+		if err := encoder.Encode(f); err != nil {
+			t.Fatalf("unable to encode test metrics: %v", err)
+		}
+	}
+
+	got, err := ParseDataWithAdditionalLabels(buf.Bytes(), string(expfmt.FmtProtoDelim), now, map[string]string{labels.InstanceName: "hostname1"})
+	if err != nil {
+		t.Fatalf("unable to parse protobuf: %v", err)
+	}
+	histogram := func(name string, value float64, extra ...string) ParsedSeries {
+		return ParsedSeries{
+			Labels:    labels.FromStrings(append([]string{labels.MetricName, name, labels.InstanceName, "hostname1"}, extra...)...),
+			Value:     value,
+			Timestamp: 1591005600000,
+			Type:      textparse.MetricTypeHistogram,
+		}
+	}
+	want := []ParsedSeries{
+		{
+			Labels:    labels.FromStrings(labels.MetricName, "requests_total", "code", "200", labels.InstanceName, "hostname1"),
+			Value:     3,
+			Timestamp: PromTimestamp(now),
+			Type:      textparse.MetricTypeCounter,
+			Help:      "[STABLE] requests",
+			Stability: StabilityStable,
+			Exemplar:  &exemplar.Exemplar{Labels: labels.FromStrings("trace_id", "abc123"), Value: 1},
+		},
+		histogram("latency_seconds_bucket", 1, labels.BucketLabel, "0.5"),
+		histogram("latency_seconds_bucket", 2, labels.BucketLabel, "+Inf"),
+		histogram("latency_seconds_sum", 0.75),
+		histogram("latency_seconds_count", 2),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseDataWithAdditionalLabels() got = %v, want %v", got, want)
+	}
+}
+
+func TestParseProtobufNativeHistograms(t *testing.T) {
+	families := []*dto.MetricFamily{
+		{
+			Name: proto.String("native_seconds"),
+			Type: dto.MetricType_HISTOGRAM.Enum(),
+			Metric: []*dto.Metric{{
+				Histogram: &dto.Histogram{
+					SampleCount: proto.Uint64(3),
+					SampleSum:   proto.Float64(1.5),
+					// its schema, 3, which our client_model doesn't know about
+					XXX_unrecognized: []byte{0x28, 0x06},
+				},
+			}},
+		},
+		{
+			Name:   proto.String("cheese"),
+			Type:   dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(1)}}},
+		},
+	}
+	var buf bytes.Buffer
+	encoder := expfmt.NewEncoder(&buf, expfmt.FmtProtoDelim)
+	for _, f := range families {
+		if err := encoder.Encode(f); err != nil {
+			t.Fatalf("unable to encode test metrics: %v", err)
+		}
+	}
+
+	if _, err := ParseProtobufData(buf.Bytes(), time.Now(), map[string]string{}); err == nil || !strings.Contains(err.Error(), "native_seconds") {
+		t.Errorf("got error %v, want the native histogram to fail the parse", err)
+	}
+
+	stream := NewSeriesStream(bytes.NewReader(buf.Bytes()), string(expfmt.FmtProtoDelim), time.Now(), map[string]string{})
+	stream.Lenient = true
+	series, err := CollectSeries(stream)
+	var got []string
+	for _, s := range series {
+		got = append(got, s.Labels.Get(labels.MetricName))
+	}
+	if !reflect.DeepEqual(got, []string{"cheese"}) {
+		t.Errorf("got %v, want the native histogram to be skipped", got)
+	}
+	var malformed *MalformedLinesError
+	if !errors.As(err, &malformed) || malformed.Skipped != 1 {
+		t.Fatalf("got error %v, want the native histogram to be warned about", err)
+	}
+	if msg := malformed.Lines[0].Error(); strings.Contains(msg, "line") {
+		t.Errorf("got %q, didn't expect a line for protobuf", msg)
+	}
+}
@@ -22,8 +22,11 @@ import (
 	"github.com/prometheus/prometheus/tsdb/chunkenc"
 	"math"
 	"sort"
+	"strings"
 
 	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/textparse"
+	"github.com/prometheus/prometheus/pkg/value"
 	"github.com/prometheus/prometheus/storage"
 	"github.com/prometheus/prometheus/tsdb/index"
 )
@@ -31,6 +34,43 @@ import (
 type seriesData struct {
 	series labels.Labels
 	data   []datapoint
+	// when the series, if it's a counter, went backwards, i.e. its target restarted
+	resets []int64
+	// the samples from before the storage's downsampledUntil, aggregated
+	buckets []bucket
+	// lastQueried is the storage's query count when it was last queried
+	lastQueried uint64
+}
+
+// bucket is the aggregate of the samples of a series over a stretch of time, so that
+// long windows can be charted without every sample.
+type bucket struct {
+	start int64
+	// timestamp is that of the last sample in the bucket, it's where it's charted
+	timestamp           int64
+	min, max, sum, last float64
+	count               int
+}
+
+// value is what the bucket stands for when given to the function with the given
+// name, i.e. its last value for rates, which only care about what a counter got to.
+func (b bucket) value(fn string) float64 {
+	switch fn {
+	case "min_over_time":
+		return b.min
+	case "max_over_time":
+		return b.max
+	case "rate", "irate", "increase", "resets":
+		return b.last
+	}
+	return b.sum / float64(b.count)
+}
+
+// CounterReset is when a counter went backwards, which usually means its target
+// restarted, and explains the odd spike or gap in a rate.
+type CounterReset struct {
+	Series    labels.Labels
+	Timestamp int64
 }
 
 type datapoint struct {
@@ -55,64 +95,425 @@ type rangeStorage struct {
 	nextPt uint64
 
 	postings *memPostings
+
+	// the series in the last batch we loaded, i.e. the last scrape, and its time, so
+	// that we can tell when a series disappears
+	lastBatch     map[uint64]struct{}
+	lastBatchTime int64
+
+	// the samples before downsampledUntil are also in buckets of the resolution, and
+	// only there if we've discarded the raw ones
+	downsampledUntil int64
+	resolution       int64
+	discardRaw       bool
+
+	budget Budget
+	// how many queries we've run, so that we know which series were queried last
+	queries uint64
+	// how many series the last batch had us evict to stay within the budget
+	evicted int
 }
 
+// LoadData loads a batch of points, i.e. a scrape. Series from the last batch which
+// aren't in this one get a staleness marker, so that queries stop returning their
+// last value straight away, rather than for the whole lookback delta.
 func (s *rangeStorage) LoadData(points []ParsedSeries) error {
-	for _, point := range points {
-		lblsHash := point.Labels.Hash()
-		blockRef := s.series.get(lblsHash, point.Labels)
-		var block *seriesData
-		if blockRef == nil {
-			block = &seriesData{
-				series: point.Labels,
-			}
-			s.data[s.nextPt] = block
-			s.series.set(lblsHash, &seriesRef{lset: point.Labels, index: s.nextPt})
-			s.postings.Add(s.nextPt, point.Labels)
+	return loadAll(s.Appender(), points)
+}
+
+// Backfill loads points from before, or in between, what's been loaded already. They
+// aren't a batch, so nothing goes stale over them, they're just slotted in. Those from
+// before what's been downsampled are added to the buckets, and, if the samples there
+// were discarded, only kept there.
+func (s *rangeStorage) Backfill(points []ParsedSeries) error {
+	app := &rangeAppender{s: s, batch: map[uint64]struct{}{}}
+	// the series backfilled, and what of each was from before downsampledUntil
+	backfilled := map[uint64][]datapoint{}
+	for _, point := range sortedByTime(points) {
+		if err := app.Append(point); err != nil {
+			return err
+		}
+		ref := s.series.get(point.Labels.Hash(), point.Labels)
+		downsampled := backfilled[ref.index]
+		if point.Timestamp < s.downsampledUntil && !value.IsStaleNaN(point.Value) {
+			downsampled = append(downsampled, datapoint{timestamp: point.Timestamp, value: point.Value})
+		}
+		backfilled[ref.index] = downsampled
+	}
+	for ref, downsampled := range backfilled {
+		block := s.data[ref]
+		// series appended to out of order were slotted in a point at a time, make
+		// sure they came out in order
+		sort.SliceStable(block.data, func(i, j int) bool {
+			return block.data[i].timestamp < block.data[j].timestamp
+		})
+		if len(downsampled) == 0 {
+			continue
+		}
+		for _, pt := range downsampled {
+			block.buckets = addToBucket(block.buckets, pt, s.resolution)
+		}
+		if s.discardRaw {
+			raw := sort.Search(len(block.data), func(ind int) bool {
+				return block.data[ind].timestamp >= s.downsampledUntil
+			})
+			block.data = append(block.data[:0], block.data[raw:]...)
+		}
+	}
+	s.evicted = s.enforceBudget()
+	return nil
+}
 
-			if s.nextPt == math.MaxUint64 {
-				// pretty unlikely to happen, but check just in case
-				return fmt.Errorf("so much data, so few bits...")
-			}
-			s.nextPt++
+// sortedByTime returns a copy of the points, oldest first.
+func sortedByTime(points []ParsedSeries) []ParsedSeries {
+	sorted := append([]ParsedSeries(nil), points...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Timestamp < sorted[j].Timestamp
+	})
+	return sorted
+}
+
+// Appender loads a batch of points a point at a time, like LoadData does all at once.
+func (s *rangeStorage) Appender() BatchAppender {
+	return &rangeAppender{s: s, batch: map[uint64]struct{}{}}
+}
+
+// rangeAppender keeps track of the series in the batch being loaded, and its time,
+// for the staleness markers once it's committed. Historical points are left out of
+// both, they never go stale. It also keeps track of what each series was like before
+// the batch, so that it can be rolled back.
+type rangeAppender struct {
+	s         *rangeStorage
+	batch     map[uint64]struct{}
+	batchTime int64
+	appended  bool
+	// before is what each series appended to was like before the batch, by its ref
+	before map[uint64]*seriesMark
+}
+
+// seriesMark is what a series was like before a batch was appended to it.
+type seriesMark struct {
+	// created is whether the batch added the series, there's nothing to go back to
+	created bool
+	length  int
+	resets  int
+	// data is a copy of the series' points, once a point of the batch was slotted in
+	// between them, rather than appended
+	data []datapoint
+}
+
+// mark remembers what the series was like before the batch, the first time the batch
+// appends to it.
+func (a *rangeAppender) mark(ref uint64, block *seriesData, created bool) *seriesMark {
+	if a.before == nil {
+		a.before = map[uint64]*seriesMark{}
+	}
+	m, ok := a.before[ref]
+	if !ok {
+		m = &seriesMark{created: created, length: len(block.data), resets: len(block.resets)}
+		a.before[ref] = m
+	}
+	return m
+}
+
+func (a *rangeAppender) Append(point ParsedSeries) error {
+	a.appended = true
+	if !point.Historical && (len(a.batch) == 0 || point.Timestamp > a.batchTime) {
+		a.batchTime = point.Timestamp
+	}
+	s := a.s
+	lblsHash := point.Labels.Hash()
+	blockRef := s.series.get(lblsHash, point.Labels)
+	var block *seriesData
+	var m *seriesMark
+	if blockRef == nil {
+		if !point.Historical {
+			a.batch[s.nextPt] = struct{}{}
+		}
+		block = &seriesData{
+			series: point.Labels,
+		}
+		s.data[s.nextPt] = block
+		s.series.set(lblsHash, &seriesRef{lset: point.Labels, index: s.nextPt})
+		s.postings.Add(s.nextPt, point.Labels)
+		m = a.mark(s.nextPt, block, true)
+
+		if s.nextPt == math.MaxUint64 {
+			// pretty unlikely to happen, but check just in case
+			return fmt.Errorf("so much data, so few bits...")
+		}
+		s.nextPt++
+	} else {
+		if !point.Historical {
+			a.batch[blockRef.index] = struct{}{}
+		}
+		block = s.data[blockRef.index]
+		m = a.mark(blockRef.index, block, false)
+	}
+
+	needSort := false
+	if len(block.data) > 0 {
+		// in the unlikely event that we go backwards in time or have two data points
+		// in a single batch that are out of order, check if we need to sort
+		lastTime := block.data[len(block.data)-1].timestamp
+		if point.Timestamp < lastTime {
+			needSort = true
+		}
+	}
+	// what we don't know the type of can't be told apart from a gauge, which goes down
+	// all the time
+	if !needSort && point.Type != textparse.MetricTypeUnknown && point.Type != "" && IsCounter(point.Labels.Get(labels.MetricName), point.Type) {
+		if last, ok := lastValue(block); ok && point.Value < last {
+			block.resets = append(block.resets, point.Timestamp)
+		}
+	}
+	if needSort && m.data == nil && !m.created {
+		m.data = append([]datapoint{}, block.data[:m.length]...)
+	}
+	datapt := datapoint{timestamp: point.Timestamp, value: point.Value}
+	block.data = append(block.data, datapt)
+
+	if needSort {
+		// find the insertion point, shift things forward, and slot in the data point
+		insertionPt := sort.Search(len(block.data)-1, func(ind int) bool {
+			return datapt.timestamp > block.data[ind].timestamp
+		})
+		copy(block.data[insertionPt+1:], block.data[insertionPt:len(block.data)-1])
+		block.data[insertionPt] = datapt
+	}
+	return nil
+}
+
+func (a *rangeAppender) Commit() error {
+	if !a.appended {
+		return nil
+	}
+	// with nothing scraped, we've no idea when this was, so when the series went stale
+	if len(a.batch) > 0 {
+		a.s.markStale(a.batch, a.batchTime)
+		a.s.lastBatch, a.s.lastBatchTime = a.batch, a.batchTime
+	}
+	a.s.evicted = a.s.enforceBudget()
+	return nil
+}
+
+// Rollback takes back the points already appended, the series the batch added are
+// forgotten, and nothing goes stale.
+func (a *rangeAppender) Rollback() error {
+	created := make(map[uint64]struct{})
+	for ref, m := range a.before {
+		block, ok := a.s.data[ref]
+		if !ok {
+			continue
+		}
+		if m.created {
+			a.s.forget(ref)
+			created[ref] = struct{}{}
+			continue
+		}
+		if m.data != nil {
+			block.data = m.data
 		} else {
-			block = s.data[blockRef.index]
+			block.data = block.data[:m.length]
 		}
+		block.resets = block.resets[:m.resets]
+	}
+	if len(created) > 0 {
+		a.s.postings.Delete(created)
+	}
+	a.before = nil
+	return nil
+}
 
-		needSort := false
-		if len(block.data) > 0 {
-			// in the unlikely event that we go backwards in time or have two data points
-			// in a single batch that are out of order, check if we need to sort
-			lastTime := block.data[len(block.data)-1].timestamp
-			if point.Timestamp < lastTime {
-				needSort = true
+// loadAll loads a whole batch at once.
+func loadAll(app BatchAppender, points []ParsedSeries) error {
+	for _, point := range points {
+		if err := app.Append(point); err != nil {
+			_ = app.Rollback()
+			return err
+		}
+	}
+	return app.Commit()
+}
+
+// IsCounter checks whether a metric is monotonically increasing, unless it's reset,
+// and so can be used with functions like rate. Histogram and summary families have
+// counter series too, their buckets, counts and sums (if nothing negative is
+// observed), and a native histogram's one series. Metrics without a # TYPE are given
+// the benefit of the doubt.
+func IsCounter(metricName string, metricType textparse.MetricType) bool {
+	switch metricType {
+	case textparse.MetricTypeCounter, textparse.MetricTypeUnknown, "":
+		return true
+	case textparse.MetricTypeHistogram:
+		// _created is when the histogram was, which is anything but a counter
+		return !strings.HasSuffix(metricName, "_created")
+	case textparse.MetricTypeSummary:
+		// quantiles do what they like
+		return strings.HasSuffix(metricName, "_sum") || strings.HasSuffix(metricName, "_count")
+	}
+	return false
+}
+
+// lastValue is the latest value of the series which isn't a staleness marker, i.e.
+// from before its target went away for a bit.
+func lastValue(block *seriesData) (float64, bool) {
+	for i := len(block.data) - 1; i >= 0; i-- {
+		if v := block.data[i].value; !value.IsStaleNaN(v) {
+			return v, true
+		}
+	}
+	return 0, false
+}
+
+// Downsample aggregates the samples older than the given timestamp into buckets of the
+// given resolution, which queries use rather than the samples when their steps are at
+// least as long, and always if the samples are discarded. Only whole buckets are
+// aggregated, so each is only ever aggregated once.
+func (s *rangeStorage) Downsample(olderThan, resolution int64, discardRaw bool) {
+	olderThan -= olderThan % resolution
+	if olderThan <= s.downsampledUntil {
+		return
+	}
+	for _, block := range s.data {
+		from := sort.Search(len(block.data), func(ind int) bool {
+			return block.data[ind].timestamp >= s.downsampledUntil
+		})
+		to := sort.Search(len(block.data), func(ind int) bool {
+			return block.data[ind].timestamp >= olderThan
+		})
+		for _, pt := range block.data[from:to] {
+			if value.IsStaleNaN(pt.value) {
+				continue
 			}
+			block.buckets = addToBucket(block.buckets, pt, resolution)
 		}
-		datapt := datapoint{timestamp: point.Timestamp, value: point.Value}
-		block.data = append(block.data, datapt)
+		if discardRaw {
+			keep := block.data[to:]
+			copy(block.data[:len(keep)], keep)
+			block.data = block.data[:len(keep)]
+		}
+	}
+	s.downsampledUntil = olderThan
+	s.resolution = resolution
+	s.discardRaw = discardRaw
+}
+
+// addToBucket aggregates a sample into the bucket of the given resolution it falls in,
+// adding the bucket if there isn't one yet, keeping them in order, since a backfilled
+// sample can fall before or in between them.
+func addToBucket(buckets []bucket, pt datapoint, resolution int64) []bucket {
+	start := pt.timestamp - pt.timestamp%resolution
+	i := sort.Search(len(buckets), func(ind int) bool {
+		return buckets[ind].start >= start
+	})
+	if i == len(buckets) || buckets[i].start != start {
+		buckets = append(buckets, bucket{})
+		copy(buckets[i+1:], buckets[i:])
+		buckets[i] = bucket{start: start, min: pt.value, max: pt.value}
+	}
+	b := &buckets[i]
+	if b.count == 0 || pt.timestamp >= b.timestamp {
+		b.timestamp, b.last = pt.timestamp, pt.value
+	}
+	b.min = math.Min(b.min, pt.value)
+	b.max = math.Max(b.max, pt.value)
+	b.sum += pt.value
+	b.count++
+	return buckets
+}
+
+// view is the data of a series for a query, from its buckets if the query's steps
+// are long enough not to need every sample, and its ranges long enough to have a
+// couple of buckets in them, or if we don't have the samples any more.
+func (s *rangeStorage) view(block *seriesData, hints *storage.SelectHints) []datapoint {
+	if len(block.buckets) == 0 {
+		return block.data
+	}
+	var step, rng int64
+	var fn string
+	if hints != nil {
+		step, rng, fn = hints.Step, hints.Range, hints.Func
+	}
+	// i.e. rate(x[1m]) over a day would have less than the two points it needs in
+	// each of its ranges if they were buckets
+	coarse := step >= s.resolution && (rng == 0 || rng >= 2*s.resolution)
+	if !s.discardRaw && !coarse {
+		return block.data
+	}
+	data := make([]datapoint, 0, len(block.buckets)+len(block.data))
+	for _, b := range block.buckets {
+		data = append(data, datapoint{timestamp: b.timestamp, value: b.value(fn)})
+	}
+	raw := sort.Search(len(block.data), func(ind int) bool {
+		return block.data[ind].timestamp >= s.downsampledUntil
+	})
+	return append(data, block.data[raw:]...)
+}
 
-		if needSort {
-			// find the insertion point, shift things forward, and slot in the data point
-			insertionPt := sort.Search(len(block.data)-1, func(ind int) bool {
-				return datapt.timestamp > block.data[ind].timestamp
-			})
-			copy(block.data[insertionPt+1:], block.data[insertionPt:len(block.data)-1])
-			block.data[insertionPt] = datapt
+// onlyStale is whether there's nothing but staleness markers in the data, i.e. it's
+// what's left of a series which went away.
+func onlyStale(data []datapoint) bool {
+	for _, pt := range data {
+		if !value.IsStaleNaN(pt.value) {
+			return false
 		}
 	}
+	return true
+}
 
-	return nil
+// CounterResets returns the resets between mint and maxt of the series which match
+// the matchers.
+func (s *rangeStorage) CounterResets(mint, maxt int64, matchers ...*labels.Matcher) []CounterReset {
+	var resets []CounterReset
+	set := (&memQuerier{storage: s}).Select(false, nil, matchers...)
+	for set.Next() {
+		block := set.At().(*blockSeries).block
+		for _, ts := range block.resets {
+			if ts >= mint && ts <= maxt {
+				resets = append(resets, CounterReset{Series: block.series, Timestamp: ts})
+			}
+		}
+	}
+	return resets
+}
+
+// markStale appends a staleness marker to the series which were in the last batch but
+// aren't in this one. Like prometheus, we leave series with their own timestamps be,
+// since they may well just not have a new sample yet.
+func (s *rangeStorage) markStale(batch map[uint64]struct{}, batchTime int64) {
+	if batchTime <= s.lastBatchTime {
+		return
+	}
+	for ref := range s.lastBatch {
+		if _, ok := batch[ref]; ok {
+			continue
+		}
+		block := s.data[ref]
+		if block == nil || len(block.data) == 0 {
+			continue
+		}
+		last := block.data[len(block.data)-1]
+		if last.timestamp != s.lastBatchTime || value.IsStaleNaN(last.value) {
+			continue
+		}
+		block.data = append(block.data, datapoint{timestamp: batchTime, value: math.Float64frombits(value.StaleNaN)})
+	}
 }
 
+// Clean drops the data older than the given timestamp, and the series which have no
+// data left, so that long sessions don't grow without bound.
 func (s *rangeStorage) Clean(olderThan int64) {
 	postingsToClean := make(map[uint64]struct{})
 
 	for ref, block := range s.data {
-		if len(block.data) == 0 {
-			// oops
-			postingsToClean[ref] = struct{}{}
+		for len(block.resets) > 0 && block.resets[0] < olderThan {
+			block.resets = block.resets[1:]
 		}
-		if block.data[0].timestamp >= olderThan {
+		for len(block.buckets) > 0 && block.buckets[0].timestamp < olderThan {
+			block.buckets = block.buckets[1:]
+		}
+		if len(block.data) > 0 && block.data[0].timestamp >= olderThan {
 			// skip new enough blocks
 			continue
 		}
@@ -120,13 +521,19 @@ func (s *rangeStorage) Clean(olderThan int64) {
 		keepInd := sort.Search(len(block.data), func(ind int) bool {
 			return block.data[ind].timestamp >= olderThan
 		})
-		if keepInd == len(block.data) {
+		if (keepInd == len(block.data) || onlyStale(block.data[keepInd:])) && len(block.buckets) == 0 {
 			postingsToClean[ref] = struct{}{}
-		} else {
-			keep := block.data[keepInd:]
-			copy(block.data[:len(keep)], keep)
-			block.data = block.data[:len(keep)]
+			s.forget(ref)
+			continue
 		}
+		keep := block.data[keepInd:]
+		if cap(block.data) > 2*len(keep) {
+			// don't hold on to space for samples we're never going to have again
+			block.data = append(make([]datapoint, 0, 2*len(keep)), keep...)
+			continue
+		}
+		copy(block.data[:len(keep)], keep)
+		block.data = block.data[:len(keep)]
 	}
 
 	s.postings.Delete(postingsToClean)
@@ -154,10 +561,15 @@ func (s *rangeStorage) Clean(olderThan int64) {
 	*/
 }
 
+func (s *rangeStorage) Close() error {
+	return nil
+}
+
 func (s *rangeStorage) Querier(ctx context.Context, minTime, maxTime int64) (storage.Querier, error) {
 	// TODO(sollyross): we can short-circut here if we know the range of timestamps
 	// stored in our storage (which we can store from calls to New)
 
+	s.queries++
 	return &memQuerier{
 		storage: s,
 	}, nil
@@ -207,7 +619,7 @@ func (q *memQuerier) Select(sortSeries bool, hints *storage.SelectHints, matcher
 	}
 
 	finalPostings := index.Intersect(sets...)
-	return q.newSeriesSet(finalPostings)
+	return q.newSeriesSet(finalPostings, hints)
 }
 
 func (q *memQuerier) LabelValues(name string, matchers ...*labels.Matcher) ([]string, storage.Warnings, error) {
@@ -242,19 +654,24 @@ func (q *memQuerier) Close() error {
 	return nil
 }
 
-func (q *memQuerier) newSeriesSet(postings index.Postings) *seriesSet {
+func (q *memQuerier) newSeriesSet(postings index.Postings, hints *storage.SelectHints) *seriesSet {
 	return &seriesSet{
 		postings: postings,
 		storage:  q.storage,
+		hints:    hints,
 	}
 }
 
 type seriesSet struct {
 	postings index.Postings
 	storage  *rangeStorage
+	hints    *storage.SelectHints
 }
 
 func (s *seriesSet) Warnings() storage.Warnings {
+	if s.storage.evicted > 0 {
+		return storage.Warnings{fmt.Errorf("over the memory budget (%s), dropped the %d series queried least recently", s.storage.budget, s.storage.evicted)}
+	}
 	return nil
 }
 
@@ -264,8 +681,10 @@ func (s *seriesSet) Next() bool {
 
 func (s *seriesSet) At() storage.Series {
 	block := s.storage.data[s.postings.At()]
+	block.lastQueried = s.storage.queries
 	return &blockSeries{
 		block: block,
+		data:  s.storage.view(block, s.hints),
 		ind:   -1,
 	}
 }
@@ -276,7 +695,9 @@ func (s *seriesSet) Err() error {
 
 type blockSeries struct {
 	block *seriesData
-	ind   int
+	// the block's data as the query sees it, see rangeStorage.view
+	data []datapoint
+	ind  int
 }
 
 func (s *blockSeries) Iterator() chunkenc.Iterator {
@@ -287,16 +708,16 @@ func (s *blockSeries) Labels() labels.Labels {
 }
 func (s *blockSeries) Next() bool {
 	s.ind++
-	return s.ind < len(s.block.data)
+	return s.ind < len(s.data)
 }
 func (s *blockSeries) Seek(targetTime int64) bool {
-	s.ind = sort.Search(len(s.block.data), func(ind int) bool {
-		return s.block.data[ind].timestamp >= targetTime
+	s.ind = sort.Search(len(s.data), func(ind int) bool {
+		return s.data[ind].timestamp >= targetTime
 	})
-	return s.ind < len(s.block.data)
+	return s.ind < len(s.data)
 }
 func (s *blockSeries) At() (int64, float64) {
-	pt := s.block.data[s.ind]
+	pt := s.data[s.ind]
 	return pt.timestamp, pt.value
 }
 func (s *blockSeries) Err() error {
@@ -0,0 +1,214 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/textparse"
+)
+
+// a recorded scrape is a line of JSON in a recording
+type recordedScrape struct {
+	// Time is when the scrape happened, as a prometheus timestamp
+	Time   int64            `json:"time"`
+	Series []recordedSeries `json:"series"`
+}
+
+type recordedSeries struct {
+	Labels labels.Labels `json:"labels"`
+	// JSON has no NaN or Inf, so values are formatted like they are in the text format
+	Value     string `json:"value"`
+	Timestamp int64  `json:"timestamp"`
+	Type      string `json:"type,omitempty"`
+	Help      string `json:"help,omitempty"`
+	Unit      string `json:"unit,omitempty"`
+	// Historical is set for what was read back rather than scraped
+	Historical bool `json:"historical,omitempty"`
+}
+
+// recordScrape is what we record of the series of a scrape at nowish.
+func recordScrape(nowish time.Time, series []ParsedSeries) recordedScrape {
+	scrape := recordedScrape{Time: PromTimestamp(nowish), Series: make([]recordedSeries, len(series))}
+	for i, s := range series {
+		scrape.Series[i] = recordedSeries{
+			Labels:     s.Labels,
+			Value:      formatFloat(s.Value),
+			Timestamp:  s.Timestamp,
+			Type:       string(s.Type),
+			Help:       s.Help,
+			Unit:       s.Unit,
+			Historical: s.Historical,
+		}
+	}
+	return scrape
+}
+
+// parsed is the recorded series as it was scraped, at the given timestamp.
+func (s recordedSeries) parsed(timestamp int64) (ParsedSeries, error) {
+	value, err := strconv.ParseFloat(s.Value, 64)
+	if err != nil {
+		return ParsedSeries{}, fmt.Errorf("invalid value for %s in the recording: %w", s.Labels, err)
+	}
+	return ParsedSeries{
+		Labels:     s.Labels,
+		Value:      value,
+		Timestamp:  timestamp,
+		Type:       textparse.MetricType(s.Type),
+		Help:       s.Help,
+		Stability:  ParseStabilityLevel(s.Help),
+		Unit:       s.Unit,
+		Historical: s.Historical,
+	}, nil
+}
+
+// RecordingSource appends every scrape of the source it wraps to a file, for a
+// ReplaySource to play back later, i.e. to reproduce the graphs of an incident.
+type RecordingSource struct {
+	source DataSource
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewRecordingSource records the scrapes of the source to the file at path, after
+// any scrapes already recorded there.
+func NewRecordingSource(source DataSource, path string) (*RecordingSource, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open recording: %w", err)
+	}
+	return &RecordingSource{source: source, file: f}, nil
+}
+
+func (r *RecordingSource) ScrapePrometheusEndpoint(ctx context.Context, nowish time.Time) ([]ParsedSeries, error) {
+	series, scrapeErr := r.source.ScrapePrometheusEndpoint(ctx, nowish)
+	// what we did get of a partial scrape is what we'd have charted, so it's recorded
+	if _, ok := ScrapeWarnings(scrapeErr); !ok {
+		return series, scrapeErr
+	}
+	line, err := json.Marshal(recordScrape(nowish, series))
+	if err != nil {
+		return nil, fmt.Errorf("unable to record scrape: %w", err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err := r.file.Write(append(line, '\n')); err != nil {
+		return nil, fmt.Errorf("unable to record scrape: %w", err)
+	}
+	return series, scrapeErr
+}
+
+// SetQuery passes the query on to the source we're recording, if it cares.
+func (r *RecordingSource) SetQuery(query string) error {
+	if src, ok := r.source.(QueryAwareSource); ok {
+		return src.SetQuery(query)
+	}
+	return nil
+}
+
+func (r *RecordingSource) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.file.Close()
+}
+
+// ReplaySource plays back the scrapes in a recording, as if they were happening now.
+// Each scrape gives the recorded scrapes which are due since the last one, going by
+// how long it's been since the first, so that the recording plays out at the speed
+// it was recorded at, or faster. Once it's over, scrapes don't give anything.
+type ReplaySource struct {
+	scrapes []recordedScrape
+	speed   float64
+
+	mu sync.Mutex
+	// when we gave the first recorded scrape
+	started time.Time
+	next    int
+}
+
+// NewReplaySource loads the recording at path, to be played back at the given speed,
+// i.e. 2 for twice as fast as it was recorded.
+func NewReplaySource(path string, speed float64) (*ReplaySource, error) {
+	if speed <= 0 {
+		return nil, fmt.Errorf("the speed of a replay has to be positive, not %v", speed)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open recording: %w", err)
+	}
+	defer f.Close()
+	r := &ReplaySource{speed: speed}
+	scanner := bufio.NewScanner(f)
+	// a scrape of a big endpoint is a long line
+	scanner.Buffer(nil, 256<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var scrape recordedScrape
+		if err := json.Unmarshal(scanner.Bytes(), &scrape); err != nil {
+			return nil, fmt.Errorf("unable to read scrape on line %d of the recording: %w", line, err)
+		}
+		r.scrapes = append(r.scrapes, scrape)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read recording: %w", err)
+	}
+	if len(r.scrapes) == 0 {
+		return nil, fmt.Errorf("there aren't any scrapes in the recording at %s", path)
+	}
+	return r, nil
+}
+
+// Done is whether every recorded scrape has been played back.
+func (r *ReplaySource) Done() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.next >= len(r.scrapes)
+}
+
+func (r *ReplaySource) ScrapePrometheusEndpoint(_ context.Context, nowish time.Time) ([]ParsedSeries, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.started.IsZero() {
+		r.started = nowish
+	}
+	first := r.scrapes[0].Time
+	// how far into the recording we are, in its own time
+	elapsed := int64(float64(PromTimestamp(nowish)-PromTimestamp(r.started)) * r.speed)
+	// the recording's timestamps are moved to when they're played back
+	replayed := func(ts int64) int64 {
+		return PromTimestamp(r.started) + int64(float64(ts-first)/r.speed)
+	}
+	series := make([]ParsedSeries, 0)
+	for ; r.next < len(r.scrapes) && r.scrapes[r.next].Time-first <= elapsed; r.next++ {
+		for _, s := range r.scrapes[r.next].Series {
+			parsed, err := s.parsed(replayed(s.Timestamp))
+			if err != nil {
+				return nil, err
+			}
+			series = append(series, parsed)
+		}
+	}
+	return series, nil
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"context"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type scrapesSource struct {
+	scrapes [][]byte
+	next    int
+}
+
+func (s *scrapesSource) ScrapePrometheusEndpoint(_ context.Context, nowish time.Time) ([]ParsedSeries, error) {
+	data := s.scrapes[s.next]
+	s.next++
+	return ParseTextData(data, nowish)
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recording")
+	rec, err := NewRecordingSource(&scrapesSource{scrapes: [][]byte{testData[0], testData[1], []byte("weird_values NaN\n")}}, path)
+	if err != nil {
+		t.Fatalf("unable to start recording: %v", err)
+	}
+	recorded := time.Unix(1000, 0)
+	for i := 0; i < 3; i++ {
+		if _, err := rec.ScrapePrometheusEndpoint(context.TODO(), recorded.Add(time.Duration(i)*10*time.Second)); err != nil {
+			t.Fatalf("unable to record scrape: %v", err)
+		}
+	}
+	if err := rec.Close(); err != nil {
+		t.Fatalf("unable to close recording: %v", err)
+	}
+
+	replay, err := NewReplaySource(path, 2)
+	if err != nil {
+		t.Fatalf("unable to load recording: %v", err)
+	}
+	started := time.Unix(5000, 0)
+	testCases := []struct {
+		after         time.Duration
+		wantSeries    int
+		wantTimestamp time.Time
+	}{
+		{after: 0, wantSeries: 5, wantTimestamp: started},
+		// twice as fast, so the second scrape is due five seconds in
+		{after: 4 * time.Second, wantSeries: 0},
+		{after: 5 * time.Second, wantSeries: 6, wantTimestamp: started.Add(5 * time.Second)},
+		{after: time.Minute, wantSeries: 1, wantTimestamp: started.Add(10 * time.Second)},
+		{after: 2 * time.Minute, wantSeries: 0},
+	}
+	for _, tc := range testCases {
+		series, err := replay.ScrapePrometheusEndpoint(context.TODO(), started.Add(tc.after))
+		if err != nil {
+			t.Fatalf("unable to replay scrape %v in: %v", tc.after, err)
+		}
+		if len(series) != tc.wantSeries {
+			t.Errorf("got %d series %v in, want %d", len(series), tc.after, tc.wantSeries)
+		}
+		for _, s := range series {
+			if s.Timestamp != PromTimestamp(tc.wantTimestamp) {
+				t.Errorf("got %s at %v %v in, want it at %v", s.Labels, s.Timestamp, tc.after, PromTimestamp(tc.wantTimestamp))
+			}
+		}
+		if len(series) == 1 && !math.IsNaN(series[0].Value) {
+			t.Errorf("got %v for %s, want NaN", series[0].Value, series[0].Labels)
+		}
+	}
+	if !replay.Done() {
+		t.Errorf("the whole recording should have been replayed")
+	}
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/relabel"
+	"gopkg.in/yaml.v2"
+)
+
+// RelabelingSource applies relabel configs, like prometheus' metric_relabel_configs,
+// to the series of a source as they're scraped, i.e. to drop labels which would bloat
+// the index and the key of a graph.
+type RelabelingSource struct {
+	source  DataSource
+	configs []*relabel.Config
+}
+
+var _ QueryAwareSource = &RelabelingSource{}
+var _ StreamingSource = &RelabelingSource{}
+
+func NewRelabelingSource(source DataSource, configs []*relabel.Config) *RelabelingSource {
+	return &RelabelingSource{source: source, configs: configs}
+}
+
+func (s *RelabelingSource) ScrapePrometheusEndpoint(ctx context.Context, nowish time.Time) ([]ParsedSeries, error) {
+	series, err := s.source.ScrapePrometheusEndpoint(ctx, nowish)
+	// what we did get of a partial scrape is charted, so it's relabeled too
+	if _, ok := ScrapeWarnings(err); !ok {
+		return series, err
+	}
+	kept := make([]ParsedSeries, 0, len(series))
+	seen := make(map[string]bool, len(series))
+	for _, ps := range series {
+		if ps, ok := s.relabel(ps, seen); ok {
+			kept = append(kept, ps)
+		}
+	}
+	return kept, err
+}
+
+// StreamPrometheusEndpoint relabels the series of the source as they're streamed.
+func (s *RelabelingSource) StreamPrometheusEndpoint(ctx context.Context, nowish time.Time, add func(ParsedSeries) error) error {
+	seen := map[string]bool{}
+	return StreamSource(ctx, s.source, nowish, func(ps ParsedSeries) error {
+		if ps, ok := s.relabel(ps, seen); ok {
+			return add(ps)
+		}
+		return nil
+	})
+}
+
+// relabel relabels a series, returning false if it's dropped, or is the same as one
+// we've seen already in this scrape.
+func (s *RelabelingSource) relabel(ps ParsedSeries, seen map[string]bool) (ParsedSeries, bool) {
+	ls := relabel.Process(ps.Labels, s.configs...)
+	if ls == nil {
+		return ps, false
+	}
+	// dropping a label may leave several series the same, like prometheus, we
+	// keep the first
+	key := ls.String()
+	if seen[key] {
+		return ps, false
+	}
+	seen[key] = true
+	ps.Labels = ls
+	return ps, true
+}
+
+// SetQuery passes the query on, if the source only fetches what it needs.
+func (s *RelabelingSource) SetQuery(query string) error {
+	if qs, ok := s.source.(QueryAwareSource); ok {
+		return qs.SetQuery(query)
+	}
+	return nil
+}
+
+// ParseRelabelConfigs parses a list of relabel configs, in the YAML of prometheus'
+// metric_relabel_configs.
+func ParseRelabelConfigs(data []byte) ([]*relabel.Config, error) {
+	var configs []*relabel.Config
+	if err := yaml.UnmarshalStrict(data, &configs); err != nil {
+		return nil, fmt.Errorf("invalid relabel configs: %w", err)
+	}
+	return configs, nil
+}
+
+// DropLabelsConfig is a relabel config which drops the labels with the given names.
+func DropLabelsConfig(names ...string) *relabel.Config {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = regexp.QuoteMeta(name)
+	}
+	cfg := relabel.DefaultRelabelConfig
+	cfg.Action = relabel.LabelDrop
+	cfg.Regex = relabel.MustNewRegexp(strings.Join(quoted, "|"))
+	return &cfg
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/relabel"
+)
+
+func TestRelabelingSource(t *testing.T) {
+	configs, err := ParseRelabelConfigs([]byte(`
+- source_labels: [__name__]
+  regex: crackers
+  action: drop
+- source_labels: [sharpness]
+  regex: (.*) cheese enclave
+  target_label: enclave
+  replacement: $1
+`))
+	if err != nil {
+		t.Fatalf("unable to parse relabel configs: %v", err)
+	}
+	configs = append(configs, DropLabelsConfig("adj"))
+
+	src := NewRelabelingSource(&scrapesSource{scrapes: [][]byte{testData[0]}}, configs)
+	series, err := src.ScrapePrometheusEndpoint(context.TODO(), time.Unix(0, 0))
+	if err != nil {
+		t.Fatalf("unable to scrape: %v", err)
+	}
+	var got []string
+	for _, s := range series {
+		got = append(got, s.Labels.String())
+	}
+	want := []string{
+		// the two vermont series are the same without adj, we keep the first
+		`{__name__="cheese", sharpness="vermont"}`,
+		`{__name__="cheese", sharpness="sunnyvale"}`,
+		`{__name__="cheese", enclave="secret", sharpness="secret cheese enclave"}`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got series %v, want %v", got, want)
+	}
+	if series[0].Value != 0.33 {
+		t.Errorf("got %v for vermont cheese, want the first's value", series[0].Value)
+	}
+}
+
+func TestParseRelabelConfigs(t *testing.T) {
+	if _, err := ParseRelabelConfigs([]byte("- action: explode\n")); err == nil {
+		t.Errorf("expected an unknown action to be invalid")
+	}
+	if _, err := ParseRelabelConfigs([]byte("- regexp: uid\n  action: labeldrop\n")); err == nil {
+		t.Errorf("expected an unknown field to be invalid")
+	}
+	configs, err := ParseRelabelConfigs([]byte("- regex: uid\n  action: labeldrop\n"))
+	if err != nil {
+		t.Fatalf("unable to parse relabel configs: %v", err)
+	}
+	if len(configs) != 1 || configs[0].Action != relabel.LabelDrop {
+		t.Errorf("got %v, want a single labeldrop", configs)
+	}
+}
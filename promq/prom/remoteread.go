@@ -0,0 +1,201 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// QueryAwareSource is a DataSource which only fetches the series that the query being
+// run needs, rather than everything there is, i.e. from a prometheus server with far
+// more than we could keep around. PeriodicData tells it whenever the query changes.
+type QueryAwareSource interface {
+	DataSource
+	SetQuery(query string) error
+}
+
+// RemoteReadSource fetches the series a query selects from a prometheus server, over
+// its remote read API, so that we can graph what it's kept for far longer than we've
+// been scraping anything. When the query changes, the new query's series are fetched
+// as far back as the lookback, and after that, what's new since the last scrape, and
+// remoteReadOverlap before it, for the samples which arrived late.
+type RemoteReadSource struct {
+	url      string
+	client   *http.Client
+	lookback time.Duration
+	// Headers are sent with every read, i.e. the X-Scope-OrgID of a Cortex or Mimir
+	// tenant
+	Headers map[string]string
+
+	mu        sync.Mutex
+	selectors [][]*labels.Matcher
+	// until when we've fetched the series of the selectors, zero until the first scrape
+	// after the query changes
+	fetched time.Time
+	// latest is the timestamp of the latest sample we've fetched of each series, by its
+	// labels, so that what's read again of the overlap isn't handed over twice
+	latest map[string]int64
+}
+
+var _ QueryAwareSource = &RemoteReadSource{}
+
+// remoteReadOverlap is how far back before the last scrape we read again, since the
+// server may well only have received samples from before then since, i.e. when they're
+// remote written to it.
+const remoteReadOverlap = time.Minute
+
+// NewRemoteReadSource reads from the remote read endpoint at url, i.e.
+// http://prometheus:9090/api/v1/read.
+func NewRemoteReadSource(url string, client *http.Client, lookback time.Duration) *RemoteReadSource {
+	return &RemoteReadSource{url: url, client: client, lookback: lookback}
+}
+
+func (s *RemoteReadSource) String() string {
+	return s.url
+}
+
+func (s *RemoteReadSource) SetQuery(query string) error {
+	expr, err := parser.ParseExpr(query)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.selectors = parser.ExtractSelectors(expr)
+	s.fetched, s.latest = time.Time{}, nil
+	return nil
+}
+
+func (s *RemoteReadSource) ScrapePrometheusEndpoint(ctx context.Context, nowish time.Time) ([]ParsedSeries, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	series := make([]ParsedSeries, 0)
+	// we don't know what to fetch until we've got a query
+	if len(s.selectors) == 0 {
+		return series, nil
+	}
+	from := nowish.Add(-s.lookback)
+	if !s.fetched.IsZero() && s.fetched.Add(-remoteReadOverlap).After(from) {
+		from = s.fetched.Add(-remoteReadOverlap)
+	}
+	req := &prompb.ReadRequest{
+		AcceptedResponseTypes: []prompb.ReadRequest_ResponseType{prompb.ReadRequest_SAMPLES},
+	}
+	for _, matchers := range s.selectors {
+		query := &prompb.Query{
+			StartTimestampMs: PromTimestamp(from),
+			EndTimestampMs:   PromTimestamp(nowish),
+		}
+		for _, m := range matchers {
+			query.Matchers = append(query.Matchers, &prompb.LabelMatcher{
+				Type:  remoteMatchTypes[m.Type],
+				Name:  m.Name,
+				Value: m.Value,
+			})
+		}
+		req.Queries = append(req.Queries, query)
+	}
+	resp, err := s.read(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	latest := make(map[string]int64, len(s.latest))
+	for _, result := range resp.Results {
+		for _, ts := range result.Timeseries {
+			lbls := make(labels.Labels, 0, len(ts.Labels))
+			for _, l := range ts.Labels {
+				lbls = append(lbls, labels.Label{Name: l.Name, Value: l.Value})
+			}
+			lbls = labels.New(lbls...)
+			key := lbls.String()
+			last, seen := s.latest[key]
+			if seen {
+				latest[key] = last
+			}
+			for _, sample := range ts.Samples {
+				// the overlap is read again, we've already got what was there before
+				if seen && sample.Timestamp <= last {
+					continue
+				}
+				series = append(series, ParsedSeries{Labels: lbls, Value: sample.Value, Timestamp: sample.Timestamp, Historical: true})
+				if sample.Timestamp > latest[key] {
+					latest[key] = sample.Timestamp
+				}
+			}
+		}
+	}
+	// the series which weren't read again are past the overlap, nothing late will turn
+	// up for them
+	s.fetched, s.latest = nowish, latest
+	return series, nil
+}
+
+var remoteMatchTypes = map[labels.MatchType]prompb.LabelMatcher_Type{
+	labels.MatchEqual:     prompb.LabelMatcher_EQ,
+	labels.MatchNotEqual:  prompb.LabelMatcher_NEQ,
+	labels.MatchRegexp:    prompb.LabelMatcher_RE,
+	labels.MatchNotRegexp: prompb.LabelMatcher_NRE,
+}
+
+func (s *RemoteReadSource) read(ctx context.Context, readReq *prompb.ReadRequest) (*prompb.ReadResponse, error) {
+	data, err := readReq.Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode remote read request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", s.url, bytes.NewReader(snappy.Encode(nil, data)))
+	if err != nil {
+		return nil, fmt.Errorf("unable to construct remote read request: %w", err)
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Read-Version", "0.1.0")
+	for name, value := range s.Headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to remote read: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read remote read response: %w", err)
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("remote read failed with %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	decoded, err := snappy.Decode(nil, body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decompress remote read response: %w", err)
+	}
+	var readResp prompb.ReadResponse
+	if err := readResp.Unmarshal(decoded); err != nil {
+		return nil, fmt.Errorf("unable to decode remote read response: %w", err)
+	}
+	return &readResp, nil
+}
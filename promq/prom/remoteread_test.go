@@ -0,0 +1,113 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestRemoteReadSource(t *testing.T) {
+	var queries []*prompb.Query
+	samples := []prompb.Sample{{Value: 1, Timestamp: 1000}, {Value: 0, Timestamp: 2000}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		compressed, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("unable to read request: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			t.Errorf("unable to decompress request: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var req prompb.ReadRequest
+		if err := req.Unmarshal(data); err != nil {
+			t.Errorf("unable to decode request: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if tenant := r.Header.Get("X-Scope-OrgID"); tenant != "tenant-1" {
+			t.Errorf("got tenant %q, want the tenant-1 of the source's headers", tenant)
+		}
+		queries = append(queries, req.Queries...)
+		resp := prompb.ReadResponse{}
+		for range req.Queries {
+			resp.Results = append(resp.Results, &prompb.QueryResult{Timeseries: []*prompb.TimeSeries{{
+				Labels:  []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "apiserver"}},
+				Samples: samples,
+			}}})
+		}
+		out, err := resp.Marshal()
+		if err != nil {
+			t.Errorf("unable to encode response: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Encoding", "snappy")
+		_, _ = w.Write(snappy.Encode(nil, out))
+	}))
+	defer server.Close()
+
+	src := NewRemoteReadSource(server.URL, server.Client(), time.Hour)
+	src.Headers = map[string]string{"X-Scope-Orgid": "tenant-1"}
+	now := time.Unix(10000, 0)
+	// nothing to fetch until there's a query
+	if series, err := src.ScrapePrometheusEndpoint(context.TODO(), now); err != nil || len(series) != 0 {
+		t.Fatalf("got %v, %v before setting a query, want nothing", series, err)
+	}
+
+	if err := src.SetQuery(`sum(rate(up{job=~"api.*"}[5m]))`); err != nil {
+		t.Fatalf("unable to set query: %v", err)
+	}
+	series, err := src.ScrapePrometheusEndpoint(context.TODO(), now)
+	if err != nil {
+		t.Fatalf("unable to remote read: %v", err)
+	}
+	if len(series) != 2 || series[0].Labels.String() != `{__name__="up", job="apiserver"}` || series[1].Value != 0 || series[1].Timestamp != 2000 || !series[1].Historical {
+		t.Errorf("got %v, want the two samples of up, read back", series)
+	}
+	if len(queries) != 1 || queries[0].StartTimestampMs != PromTimestamp(now.Add(-time.Hour)) || len(queries[0].Matchers) != 2 {
+		t.Fatalf("got queries %v, want one for the last hour of up{job=~\"api.*\"}", queries)
+	}
+
+	// after that, what's new, and what turned up late since, but not what we've got
+	samples = append(samples, prompb.Sample{Value: 1, Timestamp: PromTimestamp(now.Add(-10 * time.Second))}, prompb.Sample{Value: 1, Timestamp: PromTimestamp(now.Add(30 * time.Second))})
+	series, err = src.ScrapePrometheusEndpoint(context.TODO(), now.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("unable to remote read: %v", err)
+	}
+	if len(queries) != 2 || queries[1].StartTimestampMs != PromTimestamp(now.Add(-remoteReadOverlap)) {
+		t.Errorf("got queries %v, want the second to start the overlap before the first", queries)
+	}
+	if len(series) != 2 || series[0].Timestamp != PromTimestamp(now.Add(-10*time.Second)) || series[1].Timestamp != PromTimestamp(now.Add(30*time.Second)) {
+		t.Errorf("got %v, want the late sample and the new one", series)
+	}
+	// and what was late is only handed over the once
+	if series, err = src.ScrapePrometheusEndpoint(context.TODO(), now.Add(time.Minute+10*time.Second)); err != nil || len(series) != 0 {
+		t.Errorf("got %v, %v, want nothing new", series, err)
+	}
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"fmt"
+
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/storage"
+)
+
+// ResultStream is given the results of a query a series at a time, so that they can
+// be formatted and written out as they're gone through, i.e. a line per series, rather
+// than only once every one of thousands of series has been formatted. The query has
+// already been run by then, it's only the output that's streamed, so the chart, which
+// needs every series to lay out its axes, still takes its results whole. A vector's
+// samples are given as series of a single point, and a scalar as a series without
+// labels. Like with ResultsCallback, a series is only valid until the callback it's
+// given to returns.
+type ResultStream struct {
+	// Start, if set, is called before any series, with the type of the results and
+	// their warnings.
+	Start func(typ parser.ValueType, warnings storage.Warnings) error
+	// Series is called with every series of the results, in order.
+	Series func(series promql.Series) error
+	// Done, if set, is called once every series has been given.
+	Done func() error
+	// Other, if set, is given the results which aren't series, i.e. strings, whole.
+	// They're an error otherwise.
+	Other ResultsCallback
+}
+
+// StreamResults turns a stream into a ResultsCallback, for a PeriodicData or Backend.
+// It stops at the first error the stream returns.
+func StreamResults(stream ResultStream) ResultsCallback {
+	return func(res *promql.Result) error {
+		if res.Err != nil {
+			return res.Err
+		}
+		typ := res.Value.Type()
+		if typ != parser.ValueTypeMatrix && typ != parser.ValueTypeVector && typ != parser.ValueTypeScalar {
+			if stream.Other == nil {
+				return fmt.Errorf("%s results can't be given a series at a time", typ)
+			}
+			return stream.Other(res)
+		}
+		if stream.Start != nil {
+			if err := stream.Start(typ, res.Warnings); err != nil {
+				return err
+			}
+		}
+		if err := streamSeries(res.Value, stream.Series); err != nil {
+			return err
+		}
+		if stream.Done != nil {
+			return stream.Done()
+		}
+		return nil
+	}
+}
+
+func streamSeries(value parser.Value, cb func(promql.Series) error) error {
+	switch value := value.(type) {
+	case promql.Matrix:
+		for _, series := range value {
+			if err := cb(series); err != nil {
+				return err
+			}
+		}
+	case promql.Vector:
+		for _, sample := range value {
+			if err := cb(promql.Series{Metric: sample.Metric, Points: []promql.Point{sample.Point}}); err != nil {
+				return err
+			}
+		}
+	case promql.Scalar:
+		return cb(promql.Series{Points: []promql.Point{{T: value.T, V: value.V}}})
+	}
+	return nil
+}
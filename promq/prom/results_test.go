@@ -0,0 +1,113 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/storage"
+)
+
+func TestStreamResults(t *testing.T) {
+	foo := labels.FromStrings(labels.MetricName, "foo", "job", "a")
+	bar := labels.FromStrings(labels.MetricName, "bar", "job", "b")
+	cases := []struct {
+		name  string
+		value parser.Value
+		want  []string
+	}{
+		{
+			name:  "matrix",
+			value: promql.Matrix{{Metric: foo, Points: []promql.Point{{T: 1, V: 1}, {T: 2, V: 2}}}, {Metric: bar, Points: []promql.Point{{T: 1, V: 3}}}},
+			want:  []string{"start matrix", "foo{job=\"a\"} =>\n1 @[1]\n2 @[2]", "bar{job=\"b\"} =>\n3 @[1]", "done"},
+		},
+		{
+			name:  "vector",
+			value: promql.Vector{{Metric: foo, Point: promql.Point{T: 1, V: 1}}, {Metric: bar, Point: promql.Point{T: 1, V: 3}}},
+			want:  []string{"start vector", "foo{job=\"a\"} => 1 @[1]", "bar{job=\"b\"} => 3 @[1]", "done"},
+		},
+		{
+			name:  "scalar",
+			value: promql.Scalar{T: 1, V: 4},
+			want:  []string{"start scalar", "scalar: 4 @[1]", "done"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var got []string
+			var typ parser.ValueType
+			cb := StreamResults(ResultStream{
+				Start: func(t parser.ValueType, _ storage.Warnings) error {
+					typ = t
+					got = append(got, "start "+string(t))
+					return nil
+				},
+				Series: func(series promql.Series) error {
+					got = append(got, ToPrometheusSeriesFormat(typ, series))
+					return nil
+				},
+				Done: func() error {
+					got = append(got, "done")
+					return nil
+				},
+			})
+			if err := cb(&promql.Result{Value: c.value}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("got %q, want %q", got, c.want)
+			}
+			if whole, err := ToPrometheusFormat(&promql.Result{Value: c.value}); err != nil {
+				t.Errorf("unable to format the whole results: %v", err)
+			} else if streamed := strings.Join(got[1:len(got)-1], "\n"); *whole != streamed {
+				t.Errorf("streamed %q, but the whole results are %q", streamed, *whole)
+			}
+		})
+	}
+}
+
+func TestStreamResultsStops(t *testing.T) {
+	stop := errors.New("stop")
+	calls := 0
+	cb := StreamResults(ResultStream{
+		Series: func(promql.Series) error {
+			calls++
+			return stop
+		},
+	})
+	value := promql.Vector{{Point: promql.Point{T: 1, V: 1}}, {Point: promql.Point{T: 1, V: 2}}}
+	if err := cb(&promql.Result{Value: value}); !errors.Is(err, stop) {
+		t.Errorf("got error %v, want %v", err, stop)
+	}
+	if calls != 1 {
+		t.Errorf("got %d series after the stream stopped, want 1", calls)
+	}
+
+	if err := cb(&promql.Result{Value: promql.String{T: 1, V: "foo"}}); err == nil {
+		t.Errorf("expected a string result to be an error without Other")
+	}
+	queryErr := errors.New("query failed")
+	if err := cb(&promql.Result{Err: queryErr}); !errors.Is(err, queryErr) {
+		t.Errorf("got error %v, want %v", err, queryErr)
+	}
+}
@@ -0,0 +1,230 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// RetryPolicy is how hard we try to scrape a target before giving up on it.
+type RetryPolicy struct {
+	// Timeout is how long a scrape can take, zero for as long as the context allows
+	Timeout time.Duration
+	// Retries is how many more times a failed scrape is tried
+	Retries int
+	// Backoff is how long to wait before the first retry, it doubles for each retry
+	// after that, and is jittered so that targets aren't retried all at once
+	Backoff time.Duration
+	// BreakAfter is how many scrapes in a row can fail before we stop trying the target
+	// for a while, zero to keep trying forever
+	BreakAfter int
+	// BreakFor is how long we stop trying it for, which doubles, up to MaxBreak, every
+	// time it fails again once we do
+	BreakFor time.Duration
+	MaxBreak time.Duration
+}
+
+// DefaultRetryPolicy gives up on a scrape after ten seconds, retries it twice, and stops
+// trying a target which has failed five times in a row for ten seconds, then twenty,
+// up to five minutes.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		Timeout:    10 * time.Second,
+		Retries:    2,
+		Backoff:    100 * time.Millisecond,
+		BreakAfter: 5,
+		BreakFor:   10 * time.Second,
+		MaxBreak:   5 * time.Minute,
+	}
+}
+
+// BrokenCircuitError is what a target we've stopped trying returns instead of being
+// scraped.
+type BrokenCircuitError struct {
+	// Failures is how many scrapes in a row have failed
+	Failures int
+	// Until is when we'll try it again
+	Until time.Time
+	// Err is why the last scrape failed
+	Err error
+}
+
+func (e *BrokenCircuitError) Error() string {
+	return fmt.Sprintf("not scraped until %s after %d failed scrapes in a row, the last with: %v", e.Until.Format("15:04:05"), e.Failures, e.Err)
+}
+
+func (e *BrokenCircuitError) Unwrap() error {
+	return e.Err
+}
+
+// RetryingSource scrapes a single target with a timeout, retries it when it fails, and
+// stops trying it for a while when it keeps on failing, so that a hung or dead target
+// doesn't hold up the rest.
+type RetryingSource struct {
+	source DataSource
+	policy RetryPolicy
+
+	// now and sleep are the clock, for the tests
+	now   func() time.Time
+	sleep func(ctx context.Context, d time.Duration) error
+
+	mu       sync.Mutex
+	failures int
+	// breaks is how many times we've stopped trying the target since it last worked
+	breaks      int
+	brokenUntil time.Time
+	lastErr     error
+}
+
+var _ QueryAwareSource = &RetryingSource{}
+var _ StreamingSource = &RetryingSource{}
+
+func NewRetryingSource(source DataSource, policy RetryPolicy) *RetryingSource {
+	return &RetryingSource{source: source, policy: policy, now: time.Now, sleep: sleepContext}
+}
+
+func (s *RetryingSource) ScrapePrometheusEndpoint(ctx context.Context, nowish time.Time) ([]ParsedSeries, error) {
+	var series []ParsedSeries
+	err := s.try(ctx, func(ctx context.Context) error {
+		var err error
+		series, err = s.source.ScrapePrometheusEndpoint(ctx, nowish)
+		return err
+	}, nil)
+	return series, err
+}
+
+// StreamPrometheusEndpoint streams the target's series, if it can. A scrape which fails
+// having streamed some of them already isn't retried, they'd only be added again.
+func (s *RetryingSource) StreamPrometheusEndpoint(ctx context.Context, nowish time.Time, add func(ParsedSeries) error) error {
+	added := false
+	return s.try(ctx, func(ctx context.Context) error {
+		return StreamSource(ctx, s.source, nowish, func(ps ParsedSeries) error {
+			added = true
+			return add(ps)
+		})
+	}, func() bool { return !added })
+}
+
+// try scrapes the target, retrying it when it fails, if it can be retried.
+func (s *RetryingSource) try(ctx context.Context, scrape func(context.Context) error, retriable func() bool) error {
+	s.mu.Lock()
+	if s.now().Before(s.brokenUntil) {
+		err := &BrokenCircuitError{Failures: s.failures, Until: s.brokenUntil, Err: s.lastErr}
+		s.mu.Unlock()
+		return err
+	}
+	s.mu.Unlock()
+
+	err := s.scrape(ctx, scrape)
+	for retry := 0; scrapeFailed(err) && retry < s.policy.Retries && ctx.Err() == nil && (retriable == nil || retriable()); retry++ {
+		if s.sleep(ctx, s.backoff(retry)) != nil {
+			break
+		}
+		err = s.scrape(ctx, scrape)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !scrapeFailed(err) {
+		s.failures, s.breaks, s.lastErr = 0, 0, nil
+		return err
+	}
+	s.failures++
+	s.lastErr = err
+	// having stopped trying it, it gets a single scrape to show it's back before we
+	// stop trying it for longer
+	if s.policy.BreakAfter > 0 && s.failures >= s.policy.BreakAfter {
+		breakFor := s.policy.BreakFor << s.breaks
+		if s.policy.MaxBreak > 0 && (breakFor > s.policy.MaxBreak || breakFor <= 0) {
+			breakFor = s.policy.MaxBreak
+		}
+		s.brokenUntil = s.now().Add(breakFor)
+		s.breaks++
+	}
+	return err
+}
+
+// scrape scrapes the target once, giving up after the timeout.
+func (s *RetryingSource) scrape(ctx context.Context, scrape func(context.Context) error) error {
+	if s.policy.Timeout <= 0 {
+		return scrape(ctx)
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.policy.Timeout)
+	defer cancel()
+	err := scrape(ctx)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("scrape timed out after %v: %w", s.policy.Timeout, err)
+	}
+	return err
+}
+
+// scrapeFailed is whether a scrape got us nothing, a lenient one which skipped the odd
+// line it couldn't parse didn't fail, and wouldn't do any better if it were retried.
+func scrapeFailed(err error) bool {
+	var malformed *MalformedLinesError
+	return err != nil && !errors.As(err, &malformed)
+}
+
+// backoff is how long to wait before the given retry, counting from zero, somewhere
+// between half and all of the doubled backoff.
+func (s *RetryingSource) backoff(retry int) time.Duration {
+	d := s.policy.Backoff << retry
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// SetQuery passes the query on, if the source only fetches what it needs.
+func (s *RetryingSource) SetQuery(query string) error {
+	if qs, ok := s.source.(QueryAwareSource); ok {
+		return qs.SetQuery(query)
+	}
+	return nil
+}
+
+// String is what the target is called, i.e. in the errors of a partial scrape.
+func (s *RetryingSource) String() string {
+	if str, ok := s.source.(fmt.Stringer); ok {
+		return str.String()
+	}
+	return "target"
+}
+
+// TargetLabels are the labels the source adds to every series, if it knows them.
+func (s *RetryingSource) TargetLabels() map[string]string {
+	if ts, ok := s.source.(TargetSource); ok {
+		return ts.TargetLabels()
+	}
+	return nil
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// flakySource fails as many times as it's told to, and then hangs if it's told to.
+type flakySource struct {
+	failures int
+	hang     bool
+	scrapes  int
+}
+
+func (s *flakySource) ScrapePrometheusEndpoint(ctx context.Context, nowish time.Time) ([]ParsedSeries, error) {
+	s.scrapes++
+	if s.failures > 0 {
+		s.failures--
+		return nil, errors.New("connection refused")
+	}
+	if s.hang {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return ParseTextData([]byte("cheese 1\n"), nowish)
+}
+
+func newTestRetryingSource(source DataSource, policy RetryPolicy) (*RetryingSource, *time.Time, *[]time.Duration) {
+	now := time.Unix(1000, 0)
+	var slept []time.Duration
+	s := NewRetryingSource(source, policy)
+	s.now = func() time.Time { return now }
+	s.sleep = func(_ context.Context, d time.Duration) error {
+		slept = append(slept, d)
+		return nil
+	}
+	return s, &now, &slept
+}
+
+func TestRetryingSourceRetries(t *testing.T) {
+	flaky := &flakySource{failures: 2}
+	s, _, slept := newTestRetryingSource(flaky, RetryPolicy{Retries: 2, Backoff: time.Second})
+	series, err := s.ScrapePrometheusEndpoint(context.TODO(), time.Unix(0, 0))
+	if err != nil {
+		t.Fatalf("expected the third try to work, got %v", err)
+	}
+	if len(series) != 1 {
+		t.Errorf("got %d series, want 1", len(series))
+	}
+	if len(*slept) != 2 {
+		t.Fatalf("backed off %d times, want 2", len(*slept))
+	}
+	for i, d := range *slept {
+		if max := time.Second << i; d < max/2 || d > max {
+			t.Errorf("backed off %v before retry %d, want between %v and %v", d, i+1, max/2, max)
+		}
+	}
+
+	flaky.failures = 3
+	if _, err := s.ScrapePrometheusEndpoint(context.TODO(), time.Unix(0, 0)); err == nil {
+		t.Errorf("expected failing more times than we retry to fail")
+	}
+}
+
+func TestRetryingSourceTimesOut(t *testing.T) {
+	s, _, _ := newTestRetryingSource(&flakySource{hang: true}, RetryPolicy{Timeout: 10 * time.Millisecond})
+	_, err := s.ScrapePrometheusEndpoint(context.TODO(), time.Unix(0, 0))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want the scrape to time out", err)
+	}
+}
+
+func TestRetryingSourceBreaksCircuit(t *testing.T) {
+	flaky := &flakySource{failures: 3}
+	s, now, _ := newTestRetryingSource(flaky, RetryPolicy{BreakAfter: 2, BreakFor: time.Minute, MaxBreak: 90 * time.Second})
+	scrape := func() error {
+		_, err := s.ScrapePrometheusEndpoint(context.TODO(), *now)
+		return err
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := scrape(); err == nil {
+			t.Fatalf("expected scrape %d to fail", i+1)
+		}
+	}
+	// it's failed twice in a row, so we stop trying it for a minute
+	var broken *BrokenCircuitError
+	if err := scrape(); !errors.As(err, &broken) || broken.Failures != 2 {
+		t.Fatalf("got %v, want a broken circuit after 2 failures", err)
+	}
+	if flaky.scrapes != 2 {
+		t.Errorf("scraped %d times, want 2, not while the circuit's broken", flaky.scrapes)
+	}
+
+	// it gets one more try, and having failed that too, we stop trying it for longer,
+	// though no longer than the max
+	*now = now.Add(time.Minute)
+	if err := scrape(); errors.As(err, &broken) {
+		t.Fatalf("expected a scrape once the break was up, got %v", err)
+	}
+	*now = now.Add(time.Minute)
+	if err := scrape(); !errors.As(err, &broken) || !broken.Until.Equal(time.Unix(1000, 0).Add(150*time.Second)) {
+		t.Fatalf("got %v, want a broken circuit until 90s after the last try", err)
+	}
+
+	// and once it's back, it's back
+	*now = now.Add(time.Minute)
+	if err := scrape(); err != nil {
+		t.Fatalf("expected the target to be back, got %v", err)
+	}
+	if flaky.failures = 1; scrape() == nil {
+		t.Fatalf("expected the scrape to fail")
+	}
+	if err := scrape(); err != nil {
+		t.Errorf("expected the failures to have been forgotten once it was back, got %v", err)
+	}
+}
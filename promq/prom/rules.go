@@ -0,0 +1,69 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/rulefmt"
+)
+
+// ParseRecordingRules parses a prometheus rules file, and returns a series for each of
+// its recording rules, so that they can be indexed even though no endpoint exposes them.
+// The series has the rule's static labels, and its expression as help text. Alerting
+// rules are skipped, they don't record anything we could select, see ParseAlertingRules.
+func ParseRecordingRules(data []byte, nowish time.Time) ([]ParsedSeries, error) {
+	groups, err := parseRuleGroups(data)
+	if err != nil {
+		return nil, err
+	}
+	ts := PromTimestamp(nowish)
+	series := make([]ParsedSeries, 0)
+	for _, g := range groups {
+		for _, r := range g.Rules {
+			if r.Record.Value == "" {
+				continue
+			}
+			ls := map[string]string{}
+			for k, v := range r.Labels {
+				ls[k] = v
+			}
+			ls[labels.MetricName] = r.Record.Value
+			series = append(series, ParsedSeries{
+				Labels:    labels.FromMap(ls),
+				Timestamp: ts,
+				Help:      fmt.Sprintf("recorded by %s: %s", g.Name, r.Expr.Value),
+			})
+		}
+	}
+	return series, nil
+}
+
+func parseRuleGroups(data []byte) ([]rulefmt.RuleGroup, error) {
+	groups, errs := rulefmt.Parse(data)
+	if len(errs) > 0 {
+		msgs := make([]string, len(errs))
+		for i, err := range errs {
+			msgs[i] = err.Error()
+		}
+		return nil, fmt.Errorf("invalid rules: %s", strings.Join(msgs, "; "))
+	}
+	return groups.Groups, nil
+}
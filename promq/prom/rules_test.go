@@ -0,0 +1,107 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+func TestParseRecordingRules(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		data    string
+		want    []ParsedSeries
+		wantErr bool
+	}{
+		{
+			name: "recording rules are parsed, alerts are skipped",
+			data: `
+groups:
+- name: apiserver
+  rules:
+  - record: cluster:apiserver_request_total:rate5m
+    expr: sum(rate(apiserver_request_total[5m]))
+    labels:
+      team: api
+  - alert: APIServerDown
+    expr: absent(up{job="apiserver"})
+`,
+			want: []ParsedSeries{
+				{
+					Labels:    labels.FromMap(map[string]string{labels.MetricName: "cluster:apiserver_request_total:rate5m", "team": "api"}),
+					Timestamp: PromTimestamp(now),
+					Help:      "recorded by apiserver: sum(rate(apiserver_request_total[5m]))",
+				},
+			},
+		},
+		{
+			name: "no groups",
+			data: ``,
+			want: []ParsedSeries{},
+		},
+		{
+			name: "invalid expression",
+			data: `
+groups:
+- name: broken
+  rules:
+  - record: job:up:sum
+    expr: sum(up
+`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseRecordingRules([]byte(tt.data), now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseRecordingRules() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseRecordingRules() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecordingRulesAreIndexed(t *testing.T) {
+	series, err := ParseRecordingRules([]byte(`
+groups:
+- name: nodes
+  rules:
+  - record: instance:node_cpu:rate1m
+    expr: rate(node_cpu_seconds_total[1m])
+`), time.Now())
+	if err != nil {
+		t.Fatalf("unable to parse rules: %v", err)
+	}
+	index := NewIndex()
+	for _, s := range series {
+		index.UpdateMetric(s)
+	}
+	if !index.GetMetricNames().Has("instance:node_cpu:rate1m") {
+		t.Errorf("got metrics %v, want the recording rule amongst them", index.GetMetricNames().List())
+	}
+	if help := index.GetMetricHelp("instance:node_cpu:rate1m"); help == "" {
+		t.Errorf("got no help text for the recording rule")
+	}
+}
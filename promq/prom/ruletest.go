@@ -0,0 +1,349 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/rulefmt"
+	"github.com/prometheus/prometheus/pkg/value"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+	"gopkg.in/yaml.v2"
+)
+
+// RuleTestFile is a unit test file of 'promtool test rules', see
+// https://prometheus.io/docs/prometheus/latest/configuration/unit_testing_rules/.
+// Only the recording rules of its rule files are evaluated, and only its
+// promql_expr_test are run, a file with alert_rule_test fails to load.
+type RuleTestFile struct {
+	RuleFiles          []string       `yaml:"rule_files"`
+	EvaluationInterval model.Duration `yaml:"evaluation_interval"`
+	// GroupEvalOrder is the order the rule groups are evaluated in, by name, the
+	// groups it doesn't name are evaluated after, in the order they're in
+	GroupEvalOrder []string        `yaml:"group_eval_order"`
+	Tests          []RuleTestGroup `yaml:"tests"`
+}
+
+// RuleTestGroup is a set of input series, and the queries to test over them.
+type RuleTestGroup struct {
+	Name           string           `yaml:"name"`
+	Interval       model.Duration   `yaml:"interval"`
+	InputSeries    []InputSeries    `yaml:"input_series"`
+	PromQLExprTest []PromQLExprTest `yaml:"promql_expr_test"`
+	AlertRuleTest  []yaml.MapSlice  `yaml:"alert_rule_test"`
+	// ExternalLabels and ExternalURL are only used in the templates of alerts,
+	// which we don't evaluate, they're accepted so that promtool's files load
+	ExternalLabels map[string]string `yaml:"external_labels"`
+	ExternalURL    string            `yaml:"external_url"`
+}
+
+// InputSeries is a series and its values in promtool's expanding notation, i.e.
+// '0+10x5 _ stale' for 0, 10, ... 50, then nothing, then a staleness marker.
+type InputSeries struct {
+	Series string `yaml:"series"`
+	Values string `yaml:"values"`
+}
+
+// PromQLExprTest is a query evaluated at a time, and the samples it should return.
+type PromQLExprTest struct {
+	Expr       string         `yaml:"expr"`
+	EvalTime   model.Duration `yaml:"eval_time"`
+	ExpSamples []ExpSample    `yaml:"exp_samples"`
+}
+
+type ExpSample struct {
+	Labels string  `yaml:"labels"`
+	Value  float64 `yaml:"value"`
+}
+
+const (
+	defaultTestInterval = model.Duration(time.Minute)
+	// ruleTestMaxSamples is plenty for the handful of series in a test
+	ruleTestMaxSamples = 50000000
+)
+
+// LoadRuleTestFile loads a unit test file, with its rule files relative to it.
+func LoadRuleTestFile(path string) (*RuleTestFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read rule tests: %w", err)
+	}
+	var file RuleTestFile
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid rule tests in %s: %w", path, err)
+	}
+	if file.EvaluationInterval == 0 {
+		file.EvaluationInterval = defaultTestInterval
+	}
+	for i, g := range file.Tests {
+		if len(g.AlertRuleTest) > 0 {
+			return nil, fmt.Errorf("invalid rule tests in %s: alert_rule_test isn't supported, only promql_expr_test, use promtool for those", path)
+		}
+		if g.Interval == 0 {
+			file.Tests[i].Interval = file.EvaluationInterval
+		}
+	}
+	dir := filepath.Dir(path)
+	var ruleFiles []string
+	for _, pattern := range file.RuleFiles {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule file pattern %q: %w", pattern, err)
+		}
+		ruleFiles = append(ruleFiles, matches...)
+	}
+	file.RuleFiles = ruleFiles
+	return &file, nil
+}
+
+// recordingRule is a recording rule of a rule file, to evaluate in a test
+type recordingRule struct {
+	name   string
+	expr   string
+	labels map[string]string
+}
+
+// Run runs every test, and returns why the ones which failed did. The error is for
+// tests which couldn't be run at all, i.e. because of an invalid rule file.
+func (f *RuleTestFile) Run(ctx context.Context) ([]error, error) {
+	var groups []rulefmt.RuleGroup
+	for _, path := range f.RuleFiles {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read rules: %w", err)
+		}
+		fileGroups, err := parseRuleGroups(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		groups = append(groups, fileGroups...)
+	}
+	groups, err := orderRuleGroups(groups, f.GroupEvalOrder)
+	if err != nil {
+		return nil, err
+	}
+	var rules []recordingRule
+	for _, g := range groups {
+		for _, r := range g.Rules {
+			if r.Record.Value != "" {
+				rules = append(rules, recordingRule{name: r.Record.Value, expr: r.Expr.Value, labels: r.Labels})
+			}
+		}
+	}
+
+	var failures []error
+	for i, g := range f.Tests {
+		name := g.Name
+		if name == "" {
+			name = fmt.Sprintf("test %d", i+1)
+		}
+		groupFailures, err := g.run(ctx, rules, time.Duration(f.EvaluationInterval))
+		if err != nil {
+			return failures, fmt.Errorf("%s: %w", name, err)
+		}
+		for _, failure := range groupFailures {
+			failures = append(failures, fmt.Errorf("%s: %w", name, failure))
+		}
+	}
+	return failures, nil
+}
+
+// orderRuleGroups puts the groups named in order first, in that order, like promtool
+// evaluates them.
+func orderRuleGroups(groups []rulefmt.RuleGroup, order []string) ([]rulefmt.RuleGroup, error) {
+	if len(order) == 0 {
+		return groups, nil
+	}
+	rank := make(map[string]int, len(order))
+	for i, name := range order {
+		rank[name] = i
+	}
+	found := map[string]bool{}
+	for _, g := range groups {
+		found[g.Name] = true
+	}
+	for _, name := range order {
+		if !found[name] {
+			return nil, fmt.Errorf("group %q in group_eval_order isn't in the rule files", name)
+		}
+	}
+	ordered := make([]rulefmt.RuleGroup, len(groups))
+	copy(ordered, groups)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		ri, iOrdered := rank[ordered[i].Name]
+		rj, jOrdered := rank[ordered[j].Name]
+		if iOrdered != jOrdered {
+			return iOrdered
+		}
+		return ri < rj
+	})
+	return ordered, nil
+}
+
+func (g *RuleTestGroup) run(ctx context.Context, rules []recordingRule, evalInterval time.Duration) ([]error, error) {
+	storage := NewRangeStorage()
+	// the points are queryable as soon as they're appended, committing them would only
+	// mark the series which aren't in the batch stale, and the series of a test only
+	// go stale when their values say so
+	app := storage.Appender()
+	start := time.Unix(0, 0).UTC()
+	for _, input := range g.InputSeries {
+		lset, values, err := parser.ParseSeriesDesc(input.Series + " " + input.Values)
+		if err != nil {
+			return nil, fmt.Errorf("invalid input series %q: %w", input.Series, err)
+		}
+		// a 'stale' value is a staleness marker already
+		for i, v := range values {
+			if v.Omitted {
+				continue
+			}
+			ts := start.Add(time.Duration(i) * time.Duration(g.Interval))
+			if err := app.Append(ParsedSeries{Labels: lset, Value: v.Value, Timestamp: PromTimestamp(ts)}); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	engine := promql.NewEngine(EngineOptions(time.Minute, ruleTestMaxSamples, DefaultLookbackDelta))
+	var maxEval time.Duration
+	for _, test := range g.PromQLExprTest {
+		if d := time.Duration(test.EvalTime); d > maxEval {
+			maxEval = d
+		}
+	}
+	// like prometheus, the rules are evaluated in order every evaluation interval, so
+	// a rule sees what the rules before it recorded, and the series a rule recorded
+	// last time, but not this time, are marked stale
+	if len(rules) > 0 {
+		recorded := make([]map[string]labels.Labels, len(rules))
+		for ts := time.Duration(0); ts <= maxEval; ts += evalInterval {
+			for i, r := range rules {
+				at := start.Add(ts)
+				vector, err := instantVector(ctx, engine, storage, r.expr, at)
+				if err != nil {
+					return nil, fmt.Errorf("unable to evaluate rule %s: %w", r.name, err)
+				}
+				current := make(map[string]labels.Labels, len(vector))
+				for _, sample := range vector {
+					lb := labels.NewBuilder(sample.Metric).Set(labels.MetricName, r.name)
+					for k, v := range r.labels {
+						lb.Set(k, v)
+					}
+					lset := lb.Labels()
+					current[lset.String()] = lset
+					if err := app.Append(ParsedSeries{Labels: lset, Value: sample.V, Timestamp: sample.T}); err != nil {
+						return nil, err
+					}
+				}
+				for key, lset := range recorded[i] {
+					if _, ok := current[key]; ok {
+						continue
+					}
+					if err := app.Append(ParsedSeries{Labels: lset, Value: math.Float64frombits(value.StaleNaN), Timestamp: PromTimestamp(at)}); err != nil {
+						return nil, err
+					}
+				}
+				recorded[i] = current
+			}
+		}
+	}
+
+	var failures []error
+	for _, test := range g.PromQLExprTest {
+		if err := test.check(ctx, engine, storage, start); err != nil {
+			failures = append(failures, err)
+		}
+	}
+	return failures, nil
+}
+
+// check runs the query, and compares its results with the expected samples, in any
+// order.
+func (t *PromQLExprTest) check(ctx context.Context, engine *promql.Engine, storage Storage, start time.Time) error {
+	at := start.Add(time.Duration(t.EvalTime))
+	got, err := instantVector(ctx, engine, storage, t.Expr, at)
+	if err != nil {
+		return fmt.Errorf("expr %q at %v: %w", t.Expr, t.EvalTime, err)
+	}
+	gotSamples := make([]string, len(got))
+	for i, s := range got {
+		gotSamples[i] = testSample(s.Metric, s.V)
+	}
+	expSamples := make([]string, len(t.ExpSamples))
+	for i, s := range t.ExpSamples {
+		lset, err := parser.ParseMetric(s.Labels)
+		if err != nil {
+			return fmt.Errorf("expr %q at %v: invalid expected labels %q: %w", t.Expr, t.EvalTime, s.Labels, err)
+		}
+		expSamples[i] = testSample(lset, s.Value)
+	}
+	sort.Strings(gotSamples)
+	sort.Strings(expSamples)
+	if strings.Join(gotSamples, "\n") != strings.Join(expSamples, "\n") {
+		return fmt.Errorf("expr %q at %v:\n    expected: %s\n    got:      %s", t.Expr, t.EvalTime, strings.Join(expSamples, ", "), strings.Join(gotSamples, ", "))
+	}
+	return nil
+}
+
+// testSample is a sample the way a query's written, i.e. 'up{job="a"} 1'.
+func testSample(lset labels.Labels, v float64) string {
+	name := lset.Get(labels.MetricName)
+	rest := lset.WithoutLabels(labels.MetricName)
+	if len(rest) > 0 || name == "" {
+		name += rest.String()
+	}
+	return name + " " + formatFloat(v)
+}
+
+// instantVector evaluates a query at a time, with a scalar as a sample without labels.
+func instantVector(ctx context.Context, engine *promql.Engine, storage Storage, expr string, at time.Time) (promql.Vector, error) {
+	query, err := engine.NewInstantQuery(storage, expr, at)
+	if err != nil {
+		return nil, err
+	}
+	defer query.Close()
+	res := query.Exec(ctx)
+	if res.Err != nil {
+		return nil, res.Err
+	}
+	switch v := res.Value.(type) {
+	case promql.Vector:
+		// the results are only valid until the query's closed
+		vector := make(promql.Vector, len(v))
+		for i, s := range v {
+			vector[i] = promql.Sample{Metric: s.Metric.Copy(), Point: s.Point}
+		}
+		return vector, nil
+	case promql.Scalar:
+		return promql.Vector{{Point: promql.Point{T: v.T, V: v.V}}}, nil
+	}
+	return nil, errors.New("only vector and scalar results can be tested")
+}
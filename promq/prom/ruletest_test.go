@@ -0,0 +1,171 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testRules = `groups:
+- name: example
+  rules:
+  - record: job:requests:rate1m
+    expr: sum by (job) (rate(requests_total[1m]))
+  - record: job:requests:rate1m_doubled
+    expr: job:requests:rate1m * 2
+    labels:
+      doubled: "yes"
+`
+
+const testRuleTests = `rule_files:
+- rules.yaml
+evaluation_interval: 1m
+tests:
+- interval: 1m
+  input_series:
+  - series: 'requests_total{job="a", instance="1"}'
+    values: '0+60x10'
+  - series: 'requests_total{job="a", instance="2"}'
+    values: '0+120x5 _ stale'
+  promql_expr_test:
+  - expr: job:requests:rate1m
+    eval_time: 5m
+    exp_samples:
+    - labels: 'job:requests:rate1m{job="a"}'
+      value: 3
+  - expr: job:requests:rate1m_doubled
+    eval_time: 5m
+    exp_samples:
+    - labels: 'job:requests:rate1m_doubled{job="a", doubled="yes"}'
+      value: 6
+  - expr: count(requests_total)
+    eval_time: 7m
+    exp_samples:
+    - labels: '{}'
+      value: 1
+- name: wrong
+  input_series:
+  - series: 'up'
+    values: '1 0'
+  promql_expr_test:
+  - expr: up
+    eval_time: 1m
+    exp_samples:
+    - labels: 'up'
+      value: 1
+`
+
+func TestRuleTestFile(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "rules.yaml"), []byte(testRules), 0644); err != nil {
+		t.Fatalf("unable to write rules: %v", err)
+	}
+	path := filepath.Join(dir, "tests.yaml")
+	if err := ioutil.WriteFile(path, []byte(testRuleTests), 0644); err != nil {
+		t.Fatalf("unable to write tests: %v", err)
+	}
+	file, err := LoadRuleTestFile(path)
+	if err != nil {
+		t.Fatalf("unable to load tests: %v", err)
+	}
+	failures, err := file.Run(context.TODO())
+	if err != nil {
+		t.Fatalf("unable to run tests: %v", err)
+	}
+	if len(failures) != 1 {
+		t.Fatalf("got failures %v, want just the one of the wrong test", failures)
+	}
+	if msg := failures[0].Error(); !strings.HasPrefix(msg, "wrong: ") || !strings.Contains(msg, `got:      up 0`) {
+		t.Errorf("got failure %q, want it to say what up was", msg)
+	}
+}
+
+const orderedTestRules = `groups:
+- name: doubled
+  rules:
+  - record: copy:doubled
+    expr: copy * 2
+- name: copied
+  rules:
+  - record: copy
+    expr: up
+`
+
+const orderedRuleTests = `rule_files:
+- rules.yaml
+group_eval_order:
+- copied
+- doubled
+tests:
+- external_labels:
+    cluster: a
+  input_series:
+  - series: 'up'
+    values: '1 1 stale'
+  promql_expr_test:
+  - expr: copy:doubled
+    eval_time: 0m
+    exp_samples:
+    - labels: 'copy:doubled'
+      value: 2
+  - expr: copy
+    eval_time: 3m
+`
+
+func TestRuleTestFileEvalOrderAndStaleness(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "rules.yaml"), []byte(orderedTestRules), 0644); err != nil {
+		t.Fatalf("unable to write rules: %v", err)
+	}
+	path := filepath.Join(dir, "tests.yaml")
+	if err := ioutil.WriteFile(path, []byte(orderedRuleTests), 0644); err != nil {
+		t.Fatalf("unable to write tests: %v", err)
+	}
+	file, err := LoadRuleTestFile(path)
+	if err != nil {
+		t.Fatalf("unable to load tests: %v", err)
+	}
+	// copied is evaluated before doubled, so doubled sees copy straight away, and
+	// copy goes stale once up does, rather than lasting the lookback
+	failures, err := file.Run(context.TODO())
+	if err != nil {
+		t.Fatalf("unable to run tests: %v", err)
+	}
+	if len(failures) != 0 {
+		t.Errorf("got failures %v, want none", failures)
+	}
+
+	file.GroupEvalOrder = []string{"missing"}
+	if _, err := file.Run(context.TODO()); err == nil {
+		t.Errorf("expected a group_eval_order naming a group which isn't there not to run")
+	}
+}
+
+func TestRuleTestFileAlertTests(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tests.yaml")
+	data := "tests:\n- alert_rule_test:\n  - eval_time: 1m\n    alertname: Down\n"
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatalf("unable to write tests: %v", err)
+	}
+	if _, err := LoadRuleTestFile(path); err == nil {
+		t.Errorf("expected alert rule tests not to load, rather than to silently pass")
+	}
+}
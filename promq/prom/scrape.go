@@ -0,0 +1,97 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// AcceptEncodingHeader asks for scrapes to be gzipped, like prometheus does, the
+// apiserver's metrics can be well over 10MB otherwise. Setting it means the transport
+// leaves decompressing them to us, see ReadScrapeBody.
+const AcceptEncodingHeader = "gzip"
+
+// SetScrapeHeaders asks for the richest exposition format we can parse, OpenMetrics,
+// or protobuf if asked to, gzipped.
+func SetScrapeHeaders(req *http.Request, protobuf bool) {
+	// endpoints which can serve OpenMetrics have more to say, i.e. units and exemplars
+	req.Header.Set("Accept", AcceptHeader)
+	if protobuf {
+		req.Header.Set("Accept", ProtobufAcceptHeader)
+	}
+	req.Header.Set("Accept-Encoding", AcceptEncodingHeader)
+}
+
+// ReadScrapeBody reads what a scrape returned, decompressing it if it came gzipped.
+func ReadScrapeBody(resp *http.Response) ([]byte, error) {
+	body, err := OpenScrapeBody(resp)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read metrics response body: %w", err)
+	}
+	return data, nil
+}
+
+// OpenScrapeBody is what a scrape returned, decompressed as it's read if it came
+// gzipped, for a SeriesStream to parse without all of it being in memory at once.
+func OpenScrapeBody(resp *http.Response) (io.Reader, error) {
+	if resp.StatusCode/100 != 2 {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read metrics response body: %w", err)
+		}
+		return nil, fmt.Errorf("scrape failed with %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		return resp.Body, nil
+	}
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decompress metrics response body: %w", err)
+	}
+	// closing a gzip reader doesn't close what it reads, or do much else
+	return gz, nil
+}
+
+// ScrapeJitter is how long after the others a target is scraped, somewhere up to
+// maxJitter, so that a lot of targets aren't all scraped at once. Like prometheus'
+// scrape offsets, it only depends on the target, so each is scraped as often as the
+// rest.
+func ScrapeJitter(target string, maxJitter time.Duration) time.Duration {
+	if maxJitter <= 0 {
+		return 0
+	}
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(target))
+	return time.Duration(h.Sum64() % uint64(maxJitter))
+}
+
+// NextScrape is when a scrape every period is next due after now, on a wall clock
+// boundary, i.e. on the minute for a period of a minute.
+func NextScrape(now time.Time, period time.Duration) time.Time {
+	return now.Truncate(period).Add(period)
+}
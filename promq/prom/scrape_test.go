@@ -0,0 +1,121 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScrapeGzipped(t *testing.T) {
+	const metrics = "# TYPE cheese gauge\ncheese 1\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") != AcceptHeader {
+			t.Errorf("got Accept %q, want %q", r.Header.Get("Accept"), AcceptHeader)
+		}
+		if r.Header.Get("Accept-Encoding") != "gzip" {
+			w.Write([]byte(metrics))
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		gz.Write([]byte(metrics))
+		gz.Close()
+	}))
+	defer srv.Close()
+
+	for _, compressed := range []bool{true, false} {
+		req, err := http.NewRequest("GET", srv.URL, nil)
+		if err != nil {
+			t.Fatalf("unable to construct request: %v", err)
+		}
+		SetScrapeHeaders(req, false)
+		if !compressed {
+			req.Header.Del("Accept-Encoding")
+		}
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatalf("unable to scrape: %v", err)
+		}
+		body, err := ReadScrapeBody(resp)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("unable to read scrape (compressed: %v): %v", compressed, err)
+		}
+		if string(body) != metrics {
+			t.Errorf("got %q (compressed: %v), want %q", body, compressed, metrics)
+		}
+	}
+}
+
+func TestScrapeFailed(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no cheese here", http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	resp, err := srv.Client().Get(srv.URL)
+	if err != nil {
+		t.Fatalf("unable to scrape: %v", err)
+	}
+	defer resp.Body.Close()
+	if _, err := ReadScrapeBody(resp); err == nil || !strings.Contains(err.Error(), "no cheese here") {
+		t.Errorf("got error %v, want the 404 and what the target said", err)
+	}
+}
+
+func TestScrapeJitter(t *testing.T) {
+	maxJitter := 10 * time.Second
+	seen := map[time.Duration]bool{}
+	for _, target := range []string{"http://a:8080/metrics", "http://b:8080/metrics", "http://c:8080/metrics"} {
+		jitter := ScrapeJitter(target, maxJitter)
+		if jitter < 0 || jitter >= maxJitter {
+			t.Errorf("got jitter %v for %s, want it in [0, %v)", jitter, target, maxJitter)
+		}
+		if again := ScrapeJitter(target, maxJitter); again != jitter {
+			t.Errorf("got jitter %v and then %v for %s, want it to stay the same", jitter, again, target)
+		}
+		seen[jitter] = true
+	}
+	if len(seen) == 1 {
+		t.Errorf("got the same jitter for every target")
+	}
+	if jitter := ScrapeJitter("http://a:8080/metrics", 0); jitter != 0 {
+		t.Errorf("got jitter %v without any allowed", jitter)
+	}
+}
+
+func TestNextScrape(t *testing.T) {
+	now := time.Date(2020, 6, 1, 15, 4, 5, 300000000, time.UTC)
+	testCases := []struct {
+		period time.Duration
+		want   time.Time
+	}{
+		{period: time.Second, want: time.Date(2020, 6, 1, 15, 4, 6, 0, time.UTC)},
+		{period: 15 * time.Second, want: time.Date(2020, 6, 1, 15, 4, 15, 0, time.UTC)},
+		{period: time.Minute, want: time.Date(2020, 6, 1, 15, 5, 0, 0, time.UTC)},
+	}
+	for _, tc := range testCases {
+		if got := NextScrape(now, tc.period); !got.Equal(tc.want) {
+			t.Errorf("got next scrape %v every %v, want %v", got, tc.period, tc.want)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+)
+
+// a sample in a JSONL sink, a line each
+type sinkSample struct {
+	Labels labels.Labels `json:"labels"`
+	// JSON has no NaN or Inf, so values are formatted like they are in the text format
+	Value     string `json:"value"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// SinkOptions are how a ResultsSink writes results, and when it starts a new file.
+type SinkOptions struct {
+	// Format is jsonl (a JSON object per sample) or csv (a row per sample)
+	Format string
+	// MaxSize, if set, is how big a file can get before it's rotated, in bytes
+	MaxSize int64
+	// RotateEvery, if set, is how long a file is written to before it's rotated
+	RotateEvery time.Duration
+}
+
+// ResultsSink appends the samples of the results of a query to a file, each only the
+// first time it's in them, i.e. a range query run continuously writes each sample
+// once rather than every time it's charted, so that an investigation leaves behind a
+// record of what was charted. A file is rotated, i.e. moved aside to
+// 'results.jsonl.20200601-150405', once it's too big or old.
+type ResultsSink struct {
+	path string
+	opts SinkOptions
+	now  func() time.Time
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+	// written is the timestamp of the last sample of each series written, by the
+	// hash of its labels, for the series in the last results
+	written map[uint64]int64
+}
+
+// NewResultsSink appends to the file at path, after whatever's already there.
+func NewResultsSink(path string, opts SinkOptions) (*ResultsSink, error) {
+	switch opts.Format {
+	case "jsonl", "csv":
+	default:
+		return nil, fmt.Errorf("unknown sink format %q, it can be jsonl or csv", opts.Format)
+	}
+	s := &ResultsSink{path: path, opts: opts, now: time.Now, written: map[uint64]int64{}}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Wrap writes the results to the sink before passing them on. A failure to write them
+// is added to their warnings, rather than getting in the way of charting them.
+func (s *ResultsSink) Wrap(cb ResultsCallback) ResultsCallback {
+	return func(res *promql.Result) error {
+		if res.Err == nil {
+			if err := s.Write(res); err != nil {
+				res.Warnings = append(res.Warnings, err)
+			}
+		}
+		return cb(res)
+	}
+}
+
+// Write appends the samples of the results which haven't been written before.
+func (s *ResultsSink) Write(res *promql.Result) error {
+	series, err := resultSeries(res.Value)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return errors.New("the results sink is closed")
+	}
+	if err := s.maybeRotate(); err != nil {
+		return err
+	}
+
+	var samples []sinkSample
+	written := make(map[uint64]int64, len(series))
+	for _, ser := range series {
+		hash := ser.Metric.Hash()
+		last, seen := s.written[hash]
+		for _, pt := range ser.Points {
+			if seen && pt.T <= last {
+				continue
+			}
+			samples = append(samples, sinkSample{Labels: ser.Metric, Value: formatFloat(pt.V), Timestamp: pt.T})
+			last, seen = pt.T, true
+		}
+		if seen {
+			written[hash] = last
+		}
+	}
+	s.written = written
+	if len(samples) == 0 {
+		return nil
+	}
+
+	var out []byte
+	if s.opts.Format == "csv" {
+		out, err = sinkCSV(samples, s.size == 0)
+	} else {
+		out, err = sinkJSONL(samples)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to write results to %s: %w", s.path, err)
+	}
+	n, err := s.file.Write(out)
+	s.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("unable to write results to %s: %w", s.path, err)
+	}
+	return nil
+}
+
+func (s *ResultsSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+func (s *ResultsSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to open results sink: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("unable to open results sink: %w", err)
+	}
+	s.file, s.size, s.opened = f, info.Size(), s.now()
+	return nil
+}
+
+// maybeRotate moves the file aside and starts a new one, if it's too big or old. If
+// it can't be moved aside, we carry on writing to it.
+func (s *ResultsSink) maybeRotate() error {
+	now := s.now()
+	tooBig := s.opts.MaxSize > 0 && s.size >= s.opts.MaxSize
+	tooOld := s.opts.RotateEvery > 0 && now.Sub(s.opened) >= s.opts.RotateEvery
+	if (!tooBig && !tooOld) || s.size == 0 {
+		return nil
+	}
+	if err := s.file.Close(); err != nil {
+		return fmt.Errorf("unable to rotate results sink: %w", err)
+	}
+	s.file = nil
+	if err := os.Rename(s.path, s.rotatedPath(now)); err != nil {
+		if openErr := s.open(); openErr != nil {
+			return openErr
+		}
+		return fmt.Errorf("unable to rotate results sink: %w", err)
+	}
+	return s.open()
+}
+
+// rotatedPath is where the file is moved aside to, named for when it was, with a
+// number after if it's been rotated more than once that second.
+func (s *ResultsSink) rotatedPath(now time.Time) string {
+	base := s.path + "." + now.Format("20060102-150405")
+	rotated := base
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(rotated); os.IsNotExist(err) {
+			return rotated
+		}
+		rotated = fmt.Sprintf("%s.%d", base, i)
+	}
+}
+
+func sinkJSONL(samples []sinkSample) ([]byte, error) {
+	var out []byte
+	for _, sample := range samples {
+		line, err := json.Marshal(sample)
+		if err != nil {
+			return nil, err
+		}
+		out = append(append(out, line...), '\n')
+	}
+	return out, nil
+}
+
+// sinkCSV writes a row per sample, with the series as a single column, since the
+// series written to a file over time won't all have the same labels.
+func sinkCSV(samples []sinkSample, header bool) ([]byte, error) {
+	rows := make([][]string, 0, len(samples)+1)
+	if header {
+		rows = append(rows, []string{"timestamp", "value", "series"})
+	}
+	for _, sample := range samples {
+		rows = append(rows, []string{formatCSVTimestamp(sample.Timestamp), sample.Value, sample.Labels.String()})
+	}
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if err := w.WriteAll(rows); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
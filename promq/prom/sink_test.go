@@ -0,0 +1,150 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+)
+
+func sinkResults(from, to int64) *promql.Result {
+	series := promql.Series{Metric: labels.FromStrings(labels.MetricName, "up", "job", "a")}
+	for ts := from; ts <= to; ts += 1000 {
+		series.Points = append(series.Points, promql.Point{T: ts, V: float64(ts / 1000)})
+	}
+	return &promql.Result{Value: promql.Matrix{series}}
+}
+
+func readLines(t *testing.T, path string) []string {
+	t.Helper()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unable to read %s: %v", path, err)
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func TestResultsSinkWritesSamplesOnce(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.jsonl")
+	sink, err := NewResultsSink(path, SinkOptions{Format: "jsonl"})
+	if err != nil {
+		t.Fatalf("unable to open sink: %v", err)
+	}
+	defer sink.Close()
+	// a window charted continuously overlaps with what was charted before
+	for _, res := range []*promql.Result{sinkResults(1000, 3000), sinkResults(2000, 4000)} {
+		if err := sink.Write(res); err != nil {
+			t.Fatalf("unable to write results: %v", err)
+		}
+	}
+	want := []string{
+		`{"labels":{"__name__":"up","job":"a"},"value":"1","timestamp":1000}`,
+		`{"labels":{"__name__":"up","job":"a"},"value":"2","timestamp":2000}`,
+		`{"labels":{"__name__":"up","job":"a"},"value":"3","timestamp":3000}`,
+		`{"labels":{"__name__":"up","job":"a"},"value":"4","timestamp":4000}`,
+	}
+	if got := readLines(t, path); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got lines:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestResultsSinkRotates(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "results.csv")
+	sink, err := NewResultsSink(path, SinkOptions{Format: "csv", RotateEvery: time.Hour})
+	if err != nil {
+		t.Fatalf("unable to open sink: %v", err)
+	}
+	defer sink.Close()
+	now := time.Date(2020, 6, 1, 15, 0, 0, 0, time.UTC)
+	sink.now = func() time.Time { return now }
+	sink.opened = now
+
+	if err := sink.Write(sinkResults(1000, 1000)); err != nil {
+		t.Fatalf("unable to write results: %v", err)
+	}
+	now = now.Add(time.Hour)
+	if err := sink.Write(sinkResults(1000, 2000)); err != nil {
+		t.Fatalf("unable to write results: %v", err)
+	}
+
+	rotated := readLines(t, path+".20200601-160000")
+	if want := []string{"timestamp,value,series", `1970-01-01T00:00:01Z,1,"{__name__=""up"", job=""a""}"`}; strings.Join(rotated, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got rotated file:\n%s\nwant:\n%s", strings.Join(rotated, "\n"), strings.Join(want, "\n"))
+	}
+	// the new file has its own header
+	current := readLines(t, path)
+	if want := []string{"timestamp,value,series", `1970-01-01T00:00:02Z,2,"{__name__=""up"", job=""a""}"`}; strings.Join(current, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got current file:\n%s\nwant:\n%s", strings.Join(current, "\n"), strings.Join(want, "\n"))
+	}
+
+	// rotating again the same second doesn't overwrite what was rotated before
+	sink.opts.RotateEvery, sink.opts.MaxSize = 0, 1
+	if err := sink.Write(sinkResults(1000, 3000)); err != nil {
+		t.Fatalf("unable to write results: %v", err)
+	}
+	if err := sink.Write(sinkResults(1000, 4000)); err != nil {
+		t.Fatalf("unable to write results: %v", err)
+	}
+	if got := readLines(t, path+".20200601-160000"); strings.Join(got, "\n") != strings.Join(rotated, "\n") {
+		t.Errorf("got first rotated file:\n%s\nwant it untouched", strings.Join(got, "\n"))
+	}
+	if got := readLines(t, path+".20200601-160000.1"); len(got) != 2 || !strings.HasPrefix(got[1], "1970-01-01T00:00:02Z") {
+		t.Errorf("got second rotated file:\n%s\nwant the second sample", strings.Join(got, "\n"))
+	}
+	if got := readLines(t, path+".20200601-160000.2"); len(got) != 2 || !strings.HasPrefix(got[1], "1970-01-01T00:00:03Z") {
+		t.Errorf("got third rotated file:\n%s\nwant the third sample", strings.Join(got, "\n"))
+	}
+}
+
+func TestResultsSinkCarriesOnWhenRotationFails(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "results.csv")
+	sink, err := NewResultsSink(path, SinkOptions{Format: "csv", MaxSize: 1})
+	if err != nil {
+		t.Fatalf("unable to open sink: %v", err)
+	}
+	defer sink.Close()
+	now := time.Date(2020, 6, 1, 15, 0, 0, 0, time.UTC)
+	sink.now = func() time.Time { return now }
+
+	if err := sink.Write(sinkResults(1000, 1000)); err != nil {
+		t.Fatalf("unable to write results: %v", err)
+	}
+	// it can't be moved aside once it's gone
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("unable to remove results: %v", err)
+	}
+	if err := sink.Write(sinkResults(1000, 2000)); err == nil {
+		t.Errorf("expected rotating a file which isn't there to fail")
+	}
+	// but what comes after is still written
+	if err := sink.Write(sinkResults(1000, 3000)); err != nil {
+		t.Fatalf("unable to write results after failing to rotate: %v", err)
+	}
+	want := []string{"timestamp,value,series", `1970-01-01T00:00:02Z,2,"{__name__=""up"", job=""a""}"`, `1970-01-01T00:00:03Z,3,"{__name__=""up"", job=""a""}"`}
+	if got := readLines(t, path); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got file:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/prometheus/util/stats"
+	"gopkg.in/yaml.v2"
+)
+
+// QueryStats is what it took to run a query, so that slow queries can be spotted
+// before they're run against a real prometheus. Our engine doesn't keep track of how
+// much memory it uses, so the samples it read are the best measure of that we have.
+type QueryStats struct {
+	// Series is how many series the query selected, and Samples how many of their
+	// samples were read
+	Series  int64 `json:"series" yaml:"series"`
+	Samples int64 `json:"samples" yaml:"samples"`
+	// PrepareDuration is how long selecting the series took, and EvalDuration how long
+	// evaluating the whole query did, selecting them included
+	PrepareDuration time.Duration `json:"prepareDuration" yaml:"prepareDuration"`
+	EvalDuration    time.Duration `json:"evalDuration" yaml:"evalDuration"`
+}
+
+func (s QueryStats) String() string {
+	return fmt.Sprintf("%d series, %d samples, evaluated in %v (%v preparing)", s.Series, s.Samples, s.EvalDuration, s.PrepareDuration)
+}
+
+// FormatStats formats query stats in the given output format, json, yaml or otherwise
+// a line of text.
+func FormatStats(s QueryStats, outputType string) (string, error) {
+	switch outputType {
+	case "json":
+		out, err := json.MarshalIndent(s, "", "  ")
+		return string(out), err
+	case "yaml":
+		out, err := yaml.Marshal(s)
+		return string(out), err
+	}
+	return "# " + s.String(), nil
+}
+
+// StatsCallback is given the stats of a query, before its results are given to the
+// ResultsCallback.
+type StatsCallback func(QueryStats)
+
+// statsQueryable counts the series and samples the engine reads from a queryable.
+type statsQueryable struct {
+	storage.Queryable
+	series, samples int64
+}
+
+func (q *statsQueryable) Querier(ctx context.Context, mint, maxt int64) (storage.Querier, error) {
+	querier, err := q.Queryable.Querier(ctx, mint, maxt)
+	if err != nil {
+		return nil, err
+	}
+	return &statsQuerier{Querier: querier, counts: q}, nil
+}
+
+// queryStats are the counts, with the timings of the query which was run over them.
+func (q *statsQueryable) queryStats(query promql.Query) QueryStats {
+	timers := query.Stats()
+	return QueryStats{
+		Series:          atomic.LoadInt64(&q.series),
+		Samples:         atomic.LoadInt64(&q.samples),
+		PrepareDuration: timers.GetTimer(stats.QueryPreparationTime).ElapsedTime(),
+		EvalDuration:    timers.GetTimer(stats.EvalTotalTime).ElapsedTime(),
+	}
+}
+
+type statsQuerier struct {
+	storage.Querier
+	counts *statsQueryable
+}
+
+func (q *statsQuerier) Select(sortSeries bool, hints *storage.SelectHints, matchers ...*labels.Matcher) storage.SeriesSet {
+	return &statsSeriesSet{SeriesSet: q.Querier.Select(sortSeries, hints, matchers...), counts: q.counts}
+}
+
+type statsSeriesSet struct {
+	storage.SeriesSet
+	counts *statsQueryable
+}
+
+func (s *statsSeriesSet) Next() bool {
+	if !s.SeriesSet.Next() {
+		return false
+	}
+	atomic.AddInt64(&s.counts.series, 1)
+	return true
+}
+
+func (s *statsSeriesSet) At() storage.Series {
+	return &statsSeries{Series: s.SeriesSet.At(), counts: s.counts}
+}
+
+type statsSeries struct {
+	storage.Series
+	counts *statsQueryable
+}
+
+func (s *statsSeries) Iterator() chunkenc.Iterator {
+	return &statsIterator{Iterator: s.Series.Iterator(), counts: s.counts, counted: math.MinInt64}
+}
+
+type statsIterator struct {
+	chunkenc.Iterator
+	counts *statsQueryable
+	// counted is the timestamp of the sample last counted, seeking to where we are
+	// already doesn't read anything new
+	counted int64
+}
+
+func (it *statsIterator) Next() bool {
+	return it.count(it.Iterator.Next())
+}
+
+func (it *statsIterator) Seek(t int64) bool {
+	return it.count(it.Iterator.Seek(t))
+}
+
+func (it *statsIterator) count(ok bool) bool {
+	if !ok {
+		return false
+	}
+	if t, _ := it.Iterator.At(); t != it.counted {
+		it.counted = t
+		atomic.AddInt64(&it.counts.samples, 1)
+	}
+	return true
+}
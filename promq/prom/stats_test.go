@@ -0,0 +1,68 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/promql"
+)
+
+func TestQueryStats(t *testing.T) {
+	data := NewPeriodicData(&scrapesSource{scrapes: [][]byte{testData[0]}}, DefaultEngineOptions(time.Minute, 1000))
+	data.Times = Range{Instant: true}
+	if err := data.SetQuery(context.TODO(), "sum(cheese)"); err != nil {
+		t.Fatalf("unable to set query: %v", err)
+	}
+	data.Callback = func(*promql.Result) error { return nil }
+	var got []QueryStats
+	data.StatsCallback = func(s QueryStats) {
+		got = append(got, s)
+	}
+	if err := data.Scrape(context.TODO()); err != nil {
+		t.Fatalf("unable to scrape: %v", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("got stats for %d queries, want 1", len(got))
+	}
+	if got[0].Series != 4 || got[0].Samples != 4 {
+		t.Errorf("got %d series and %d samples, want the 4 cheeses, once each", got[0].Series, got[0].Samples)
+	}
+	if got[0].EvalDuration <= 0 {
+		t.Errorf("got no evaluation time")
+	}
+}
+
+func TestFormatStats(t *testing.T) {
+	s := QueryStats{Series: 2, Samples: 10, EvalDuration: time.Millisecond}
+	for format, want := range map[string]string{
+		"json":       `"samples": 10`,
+		"yaml":       "samples: 10",
+		"prometheus": "# 2 series, 10 samples, evaluated in 1ms",
+	} {
+		out, err := FormatStats(s, format)
+		if err != nil {
+			t.Fatalf("unable to format stats as %s: %v", format, err)
+		}
+		if !strings.Contains(out, want) {
+			t.Errorf("got %q as %s, want it to contain %q", out, format, want)
+		}
+	}
+}
@@ -0,0 +1,320 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// streamChunkSize is roughly how much of a scrape in the classic text format we parse
+// at once, the chunks end at the end of a line, so can be a bit bigger.
+const streamChunkSize = 256 << 10
+
+// SeriesStream parses the series of a scrape as it's read, rather than all at once, so
+// that a huge scrape, i.e. of the apiserver, never has to be in memory twice over, and
+// its first series can be stored before its last one has arrived.
+//
+// The classic text format is parsed a chunk of lines at a time, and protobuf a metric
+// family at a time. OpenMetrics is still read whole, its parser insists on # EOF being
+// at the end of what it parses.
+type SeriesStream struct {
+	// Lenient, if set, skips the lines of the text formats which can't be parsed rather
+	// than giving up on the rest, see Malformed, and the protobuf metric families, i.e.
+	// native histograms. A protobuf message which can't be parsed is still the end of
+	// the stream, it's the end of the framing too.
+	Lenient bool
+	// Filter, if set, drops the series of the metric families which aren't wanted as
+	// they're parsed.
+	Filter *MetricFilter
+
+	r           *bufio.Reader
+	contentType string
+	nowAbouts   int64
+	ls          map[string]string
+
+	// family is where the classic text format got to, for the next chunk
+	family  textFamily
+	decoder expfmt.Decoder
+	chunk   []byte
+	// chunkSize is streamChunkSize, but for the tests
+	chunkSize int
+	// line is how many lines we've parsed, and malformed has those we've skipped
+	line      int
+	malformed MalformedLinesError
+
+	// pending are the series parsed but not yet iterated over
+	pending []ParsedSeries
+	next    int
+	cur     ParsedSeries
+	err     error
+	eof     bool
+}
+
+// NewSeriesStream parses the series read from r, in whichever exposition format the
+// content type says, like ParseDataWithAdditionalLabels.
+func NewSeriesStream(r io.Reader, contentType string, nowish time.Time, ls map[string]string) *SeriesStream {
+	s := &SeriesStream{
+		r:           bufio.NewReader(r),
+		contentType: contentType,
+		// prometheus time is milliseconds, cause
+		nowAbouts: PromTimestamp(nowish),
+		ls:        ls,
+		chunkSize: streamChunkSize,
+	}
+	if isProtobuf(contentType) {
+		s.decoder = expfmt.NewDecoder(s.r, expfmt.FmtProtoDelim)
+	}
+	return s
+}
+
+// Next moves on to the next series, returning false once there are no more, or the
+// scrape couldn't be parsed, see Err.
+func (s *SeriesStream) Next() bool {
+	for s.next >= len(s.pending) {
+		if s.eof || s.err != nil {
+			return false
+		}
+		s.pending, s.next = s.pending[:0], 0
+		if err := s.fill(); errors.Is(err, io.EOF) {
+			s.eof = true
+		} else if err != nil {
+			s.err = err
+			return false
+		}
+	}
+	s.cur = s.pending[s.next]
+	s.next++
+	return true
+}
+
+// At returns the series Next moved on to.
+func (s *SeriesStream) At() ParsedSeries {
+	return s.cur
+}
+
+// Err returns why the stream stopped early, if it did.
+func (s *SeriesStream) Err() error {
+	return s.err
+}
+
+// Malformed returns a MalformedLinesError with the lines a lenient stream skipped so
+// far, or nil if it hasn't.
+func (s *SeriesStream) Malformed() error {
+	if s.malformed.Skipped == 0 {
+		return nil
+	}
+	malformed := s.malformed
+	return &malformed
+}
+
+// fill parses the next few series into pending, returning io.EOF when there are no
+// more to come, which may be alongside the last few.
+func (s *SeriesStream) fill() error {
+	if s.decoder != nil {
+		var family dto.MetricFamily
+		if err := s.decoder.Decode(&family); err != nil {
+			return err
+		}
+		pending, err := appendProtobufSeries(s.pending, &family, s.nowAbouts, s.ls, s.Filter)
+		if err != nil {
+			if !s.Lenient {
+				return err
+			}
+			// protobuf has no lines to point at
+			s.malformed.add(0, err)
+		}
+		s.pending = pending
+		return nil
+	}
+	if isOpenMetrics(s.contentType) {
+		data, err := ioutil.ReadAll(s.r)
+		if err != nil {
+			return err
+		}
+		if err := s.parse(data); err != nil {
+			return err
+		}
+		return io.EOF
+	}
+	readErr := s.readChunk()
+	if readErr != nil && !errors.Is(readErr, io.EOF) {
+		return readErr
+	}
+	if err := s.parse(s.chunk); err != nil {
+		return err
+	}
+	return readErr
+}
+
+// parse parses some lines of the text formats into pending. If they can't be parsed
+// and we're lenient, they're parsed again a line at a time, skipping the bad ones.
+func (s *SeriesStream) parse(data []byte) error {
+	s.family.filter = s.Filter
+	family := s.family
+	parsed, err := s.family.parse(s.pending, data, s.contentType, s.nowAbouts, s.ls)
+	if err == nil {
+		s.pending = parsed
+		s.line += bytes.Count(data, []byte("\n"))
+		return nil
+	}
+	if !s.Lenient {
+		return err
+	}
+	s.family = family
+	openMetrics := isOpenMetrics(s.contentType)
+	for len(data) > 0 {
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line, data = data[:i+1], data[i+1:]
+		} else {
+			line, data = append(data, '\n'), nil
+		}
+		s.line++
+		if openMetrics {
+			// each line is only OpenMetrics by itself if it ends with # EOF too
+			if bytes.Equal(bytes.TrimSpace(line), []byte("# EOF")) {
+				continue
+			}
+			line = append(append([]byte(nil), line...), "# EOF\n"...)
+		}
+		// a line which can't be parsed doesn't leave anything behind in pending
+		parsed, err := s.family.parse(s.pending, line, s.contentType, s.nowAbouts, s.ls)
+		if err != nil {
+			s.malformed.add(s.line, err)
+			continue
+		}
+		s.pending = parsed
+	}
+	return nil
+}
+
+// readChunk reads the next chunk of lines of the classic text format, none of which
+// spans lines, so that each can be parsed by itself. What's parsed is copied out of
+// the chunk, so it's reused.
+func (s *SeriesStream) readChunk() error {
+	if cap(s.chunk) < s.chunkSize {
+		s.chunk = make([]byte, s.chunkSize)
+	}
+	s.chunk = s.chunk[:s.chunkSize]
+	n, err := io.ReadFull(s.r, s.chunk)
+	s.chunk = s.chunk[:n]
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return io.EOF
+	} else if err != nil {
+		return err
+	}
+	// finish off the line we stopped in the middle of
+	rest, err := s.r.ReadBytes('\n')
+	s.chunk = append(s.chunk, rest...)
+	return err
+}
+
+// CollectSeries iterates over the whole stream, for those who want all of its series
+// at once after all. The lines a lenient stream skipped are returned alongside them,
+// as a MalformedLinesError.
+func CollectSeries(s *SeriesStream) ([]ParsedSeries, error) {
+	metrics := make([]ParsedSeries, 0)
+	for s.Next() {
+		metrics = append(metrics, s.At())
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return metrics, s.Malformed()
+}
+
+// maxMalformedLines is how many of the lines a lenient stream skips we say why for, a
+// target serving garbage would otherwise bury everything else.
+const maxMalformedLines = 10
+
+// LineError is why a line couldn't be parsed.
+type LineError struct {
+	// Path is the dump the line is in, if it's one of several
+	Path string
+	// Line counts from one, it's zero for protobuf, which has no lines
+	Line int
+	Err  error
+}
+
+func (e LineError) Error() string {
+	if e.Line == 0 {
+		if e.Path != "" {
+			return fmt.Sprintf("%s: %v", e.Path, e.Err)
+		}
+		return e.Err.Error()
+	}
+	if e.Path != "" {
+		return fmt.Sprintf("%s:%d: %v", e.Path, e.Line, e.Err)
+	}
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+// MalformedLinesError is returned by a lenient scrape alongside the series it could
+// parse, it's a warning rather than a failure.
+type MalformedLinesError struct {
+	// Lines are the first few of the lines which were skipped
+	Lines []LineError
+	// Skipped is how many lines were skipped altogether
+	Skipped int
+}
+
+func (e *MalformedLinesError) Error() string {
+	msgs := make([]string, len(e.Lines))
+	for i, l := range e.Lines {
+		msgs[i] = l.Error()
+	}
+	if more := e.Skipped - len(e.Lines); more > 0 {
+		msgs = append(msgs, fmt.Sprintf("and %d more", more))
+	}
+	return fmt.Sprintf("skipped %d malformed line(s): %s", e.Skipped, strings.Join(msgs, "; "))
+}
+
+func (e *MalformedLinesError) add(line int, err error) {
+	e.Skipped++
+	if len(e.Lines) < maxMalformedLines {
+		e.Lines = append(e.Lines, LineError{Line: line, Err: err})
+	}
+}
+
+// merge adds the lines skipped in the dump at path.
+func (e *MalformedLinesError) merge(path string, other *MalformedLinesError) {
+	e.Skipped += other.Skipped
+	for _, l := range other.Lines {
+		if len(e.Lines) == maxMalformedLines {
+			break
+		}
+		l.Path = path
+		e.Lines = append(e.Lines, l)
+	}
+}
+
+// isOpenMetrics checks whether a content type is OpenMetrics, like textparse does.
+func isOpenMetrics(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == OpenMetricsContentType
+}
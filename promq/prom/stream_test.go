@@ -0,0 +1,229 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+)
+
+const streamTestData = `# HELP requests_total [STABLE] requests
+# TYPE requests_total counter
+requests_total{code="200",path="/api/v1/pods"} 1027
+requests_total{code="404",path="/api/v1/pods"} 3
+# HELP latency_seconds how long requests took
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.5"} 1
+latency_seconds_bucket{le="+Inf"} 2
+latency_seconds_sum 0.75
+latency_seconds_count 2
+cheese 1
+`
+
+func TestSeriesStreamInChunks(t *testing.T) {
+	now := time.Now()
+	ls := map[string]string{labels.InstanceName: "hostname1"}
+	want, err := ParseTextDataWithAdditionalLabels([]byte(streamTestData), now, ls)
+	if err != nil {
+		t.Fatalf("invalid raw data: %v", err)
+	}
+	// the chunks end in the middle of the lines, and the metric families
+	for _, chunkSize := range []int{1, 16, 100, streamChunkSize} {
+		stream := NewSeriesStream(bytes.NewReader([]byte(streamTestData)), "", now, ls)
+		stream.chunkSize = chunkSize
+		got, err := CollectSeries(stream)
+		if err != nil {
+			t.Fatalf("unable to stream in chunks of %d: %v", chunkSize, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v streaming in chunks of %d, want %v", got, chunkSize, want)
+		}
+	}
+}
+
+func TestSeriesStreamFilter(t *testing.T) {
+	testCases := []struct {
+		allow, deny string
+		want        []string
+	}{
+		// the histogram's series are kept by its family's name
+		{allow: "latency_seconds|cheese", want: []string{"latency_seconds_bucket", "latency_seconds_bucket", "latency_seconds_sum", "latency_seconds_count", "cheese"}},
+		{allow: "latency_seconds", deny: ".*_bucket", want: []string{"latency_seconds_sum", "latency_seconds_count"}},
+		// anchored, so requests doesn't match requests_total
+		{deny: "requests|latency_.*", want: []string{"requests_total", "requests_total", "cheese"}},
+	}
+	// the same families in protobuf, in the same order
+	families, err := (&expfmt.TextParser{}).TextToMetricFamilies(bytes.NewReader([]byte(streamTestData)))
+	if err != nil {
+		t.Fatalf("invalid raw data: %v", err)
+	}
+	var protobuf bytes.Buffer
+	encoder := expfmt.NewEncoder(&protobuf, expfmt.FmtProtoDelim)
+	for _, name := range []string{"requests_total", "latency_seconds", "cheese"} {
+		if err := encoder.Encode(families[name]); err != nil {
+			t.Fatalf("unable to encode test metrics: %v", err)
+		}
+	}
+	formats := map[string][]byte{"": []byte(streamTestData), string(expfmt.FmtProtoDelim): protobuf.Bytes()}
+
+	for _, tc := range testCases {
+		filter, err := NewMetricFilter(tc.allow, tc.deny)
+		if err != nil {
+			t.Fatalf("unable to create filter: %v", err)
+		}
+		for contentType, data := range formats {
+			stream := NewSeriesStream(bytes.NewReader(data), contentType, time.Now(), nil)
+			stream.Filter = filter
+			// so that the families span chunks
+			stream.chunkSize = 16
+			series, err := CollectSeries(stream)
+			if err != nil {
+				t.Fatalf("unable to stream %q: %v", contentType, err)
+			}
+			var got []string
+			for _, s := range series {
+				got = append(got, s.Labels.Get(labels.MetricName))
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %v from %q allowing %q and denying %q, want %v", got, contentType, tc.allow, tc.deny, tc.want)
+			}
+		}
+	}
+
+	if filter, err := NewMetricFilter("", ""); filter != nil || err != nil {
+		t.Errorf("got filter %v and error %v without any regexes, want neither", filter, err)
+	}
+	if _, err := NewMetricFilter("(", ""); err == nil {
+		t.Errorf("expected an invalid regex to fail")
+	}
+}
+
+func TestSeriesStreamOpenMetrics(t *testing.T) {
+	now := time.Now()
+	data := []byte(streamTestData + "# EOF\n")
+	want, err := ParseOpenMetricsData(data, now)
+	if err != nil {
+		t.Fatalf("invalid raw data: %v", err)
+	}
+	got, err := CollectSeries(NewSeriesStream(bytes.NewReader(data), OpenMetricsContentType, now, map[string]string{}))
+	if err != nil {
+		t.Fatalf("unable to stream OpenMetrics: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestSeriesStreamError(t *testing.T) {
+	stream := NewSeriesStream(bytes.NewReader([]byte("cheese 1\ncrackers{ 2\n")), "", time.Now(), map[string]string{})
+	stream.chunkSize = 1
+	var got []string
+	for stream.Next() {
+		got = append(got, stream.At().Labels.Get(labels.MetricName))
+	}
+	if stream.Err() == nil {
+		t.Errorf("expected an error parsing a broken series")
+	}
+	if !reflect.DeepEqual(got, []string{"cheese"}) {
+		t.Errorf("got %v before the broken series, want [cheese]", got)
+	}
+}
+
+// streamingSource only streams what it scrapes.
+type streamingSource struct {
+	data []byte
+}
+
+func (s streamingSource) ScrapePrometheusEndpoint(_ context.Context, _ time.Time) ([]ParsedSeries, error) {
+	return nil, errors.New("expected to be streamed")
+}
+
+func (s streamingSource) StreamPrometheusEndpoint(_ context.Context, nowish time.Time, add func(ParsedSeries) error) error {
+	stream := NewSeriesStream(bytes.NewReader(s.data), "", nowish, map[string]string{})
+	for stream.Next() {
+		if err := add(stream.At()); err != nil {
+			return err
+		}
+	}
+	return stream.Err()
+}
+
+func TestScrapeStreams(t *testing.T) {
+	data := NewPeriodicData(NewRetryingSource(streamingSource{data: []byte(streamTestData)}, DefaultRetryPolicy()), DefaultEngineOptions(time.Minute, 1000))
+	data.Times = Range{Instant: true}
+	if err := data.SetQuery(context.TODO(), "requests_total"); err != nil {
+		t.Fatalf("unable to set query: %v", err)
+	}
+	var res *promql.Result
+	data.Callback = func(r *promql.Result) error {
+		res = r
+		return nil
+	}
+	if err := data.Scrape(context.TODO()); err != nil {
+		t.Fatalf("unable to scrape: %v", err)
+	}
+	if vec, err := res.Vector(); err != nil || len(vec) != 2 {
+		t.Errorf("got %v, %v, want both of the series we streamed", res.Value, err)
+	}
+	if got := data.GetIndex().GetMetricNames().List(); !reflect.DeepEqual(got, []string{"cheese", "latency_seconds_bucket", "latency_seconds_count", "latency_seconds_sum", "requests_total"}) {
+		t.Errorf("got metrics %v indexed", got)
+	}
+}
+
+func TestSeriesStreamLenient(t *testing.T) {
+	for _, tc := range []struct {
+		contentType string
+		data        string
+	}{
+		{contentType: "", data: "cheese 1\ncrackers{ 2\ntea 3\ncrackers}\n"},
+		{contentType: OpenMetricsContentType, data: "cheese 1\ncrackers{ 2\ntea 3\ncrackers}\n# EOF\n"},
+	} {
+		stream := NewSeriesStream(bytes.NewReader([]byte(tc.data)), tc.contentType, time.Now(), map[string]string{})
+		stream.Lenient = true
+		stream.chunkSize = 1
+		series, err := CollectSeries(stream)
+		var got []string
+		for _, s := range series {
+			got = append(got, s.Labels.Get(labels.MetricName))
+		}
+		if !reflect.DeepEqual(got, []string{"cheese", "tea"}) {
+			t.Errorf("got %v from %q, want the lines which could be parsed", got, tc.contentType)
+		}
+		var malformed *MalformedLinesError
+		if !errors.As(err, &malformed) {
+			t.Fatalf("got error %v from %q, want the lines which couldn't be parsed", err, tc.contentType)
+		}
+		var lines []int
+		for _, l := range malformed.Lines {
+			lines = append(lines, l.Line)
+		}
+		if malformed.Skipped != 2 || !reflect.DeepEqual(lines, []int{2, 4}) {
+			t.Errorf("got %d skipped lines %v from %q, want lines 2 and 4", malformed.Skipped, lines, tc.contentType)
+		}
+		if warnings, ok := ScrapeWarnings(err); !ok || len(warnings) != 1 {
+			t.Errorf("got warnings %v, %v, want the skipped lines to be a warning", warnings, ok)
+		}
+	}
+}
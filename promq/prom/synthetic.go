@@ -0,0 +1,229 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/textparse"
+)
+
+// the kinds of series a SyntheticSource can generate
+const (
+	SyntheticSine      = "sine"
+	SyntheticWalk      = "walk"
+	SyntheticCounter   = "counter"
+	SyntheticHistogram = "histogram"
+)
+
+var syntheticKinds = []string{SyntheticSine, SyntheticWalk, SyntheticCounter, SyntheticHistogram}
+
+// syntheticBuckets are the upper bounds of the buckets of the synthetic histograms,
+// in seconds, like those of a request latency
+var syntheticBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// SyntheticSource generates series rather than scraping them, for demos, screenshots
+// and trying things out without a cluster: sine waves, random walks, counters which
+// get reset now and then, and histograms of latencies with bursts of slow requests.
+// The series advance a step a second from the first scrape, and what they do at each
+// step only depends on the seed, so a seed always gives the same series.
+type SyntheticSource struct {
+	spec   string
+	seed   uint64
+	kinds  []string
+	series int
+	// ExternalLabels are added to every series, i.e. the cluster they're pretending
+	// to be of
+	ExternalLabels map[string]string
+
+	mu    sync.Mutex
+	start time.Time
+	// step is the last step the random walks, counters and histograms were advanced to
+	step      int64
+	walks     []float64
+	counters  []float64
+	histogram []syntheticHistogram
+}
+
+type syntheticHistogram struct {
+	buckets []float64
+	sum     float64
+	count   float64
+}
+
+// NewSyntheticSource generates the series given by a spec like
+// 'synthetic://sine,counter?seed=42&series=5', the kinds of series (every kind if
+// there aren't any), the seed (1 unless it's given) and how many series of each
+// kind (3 unless it's given).
+func NewSyntheticSource(spec string) (*SyntheticSource, error) {
+	u, err := url.Parse(spec)
+	if err != nil || u.Scheme != "synthetic" {
+		return nil, fmt.Errorf("invalid synthetic target %q, expected i.e. synthetic://sine,walk?seed=42&series=5", spec)
+	}
+	s := &SyntheticSource{spec: spec, seed: 1, kinds: syntheticKinds, series: 3}
+	if u.Host != "" {
+		s.kinds = nil
+		for _, kind := range strings.Split(u.Host, ",") {
+			if !isSyntheticKind(kind) {
+				return nil, fmt.Errorf("unknown kind of synthetic series %q in %q, they can be %s", kind, spec, strings.Join(syntheticKinds, ", "))
+			}
+			s.kinds = append(s.kinds, kind)
+		}
+	}
+	q := u.Query()
+	if seed := q.Get("seed"); seed != "" {
+		if s.seed, err = strconv.ParseUint(seed, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid seed %q in %q: %w", seed, spec, err)
+		}
+	}
+	if series := q.Get("series"); series != "" {
+		if s.series, err = strconv.Atoi(series); err != nil || s.series <= 0 {
+			return nil, fmt.Errorf("invalid number of series %q in %q, it has to be positive", series, spec)
+		}
+	}
+	s.walks = make([]float64, s.series)
+	s.counters = make([]float64, s.series)
+	s.histogram = make([]syntheticHistogram, s.series)
+	for i := range s.histogram {
+		s.histogram[i].buckets = make([]float64, len(syntheticBuckets))
+	}
+	return s, nil
+}
+
+func isSyntheticKind(kind string) bool {
+	for _, k := range syntheticKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// String is what the instance label of its series is.
+func (s *SyntheticSource) String() string {
+	return s.spec
+}
+
+// TargetLabels are the labels every series gets.
+func (s *SyntheticSource) TargetLabels() map[string]string {
+	return TargetLabels(s.String(), s.ExternalLabels)
+}
+
+func (s *SyntheticSource) ScrapePrometheusEndpoint(_ context.Context, nowish time.Time) ([]ParsedSeries, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.start.IsZero() {
+		s.start = nowish
+	}
+	step := int64(nowish.Sub(s.start) / time.Second)
+	for s.step < step {
+		s.step++
+		s.advance(s.step)
+	}
+
+	target := s.TargetLabels()
+	ts := PromTimestamp(nowish)
+	var series []ParsedSeries
+	add := func(name string, typ textparse.MetricType, help string, v float64, extra ...string) {
+		ls := make(map[string]string, len(target)+len(extra)/2+1)
+		for k, val := range target {
+			ls[k] = val
+		}
+		for i := 0; i+1 < len(extra); i += 2 {
+			ls[extra[i]] = extra[i+1]
+		}
+		ls[labels.MetricName] = name
+		series = append(series, ParsedSeries{Labels: labels.FromMap(ls), Value: v, Timestamp: ts, Type: typ, Help: help})
+	}
+	elapsed := nowish.Sub(s.start).Seconds()
+	for _, kind := range s.kinds {
+		for i := 0; i < s.series; i++ {
+			id := strconv.Itoa(i)
+			switch kind {
+			case SyntheticSine:
+				// each wave has a period a minute longer than the last
+				period := float64(60 * (i + 1))
+				v := 50 + 40*math.Sin(2*math.Pi*elapsed/period+float64(i)) + 5*(s.noise(1, i, s.step)-0.5)
+				add("synthetic_temperature_celsius", textparse.MetricTypeGauge, "Sine waves, with a bit of noise.", v, "wave", id)
+			case SyntheticWalk:
+				add("synthetic_queue_length", textparse.MetricTypeGauge, "Random walks, which never go below zero.", s.walks[i], "queue", id)
+			case SyntheticCounter:
+				add("synthetic_requests_total", textparse.MetricTypeCounter, "Counters, which get reset now and then as if their process restarted.", s.counters[i], "handler", id)
+			case SyntheticHistogram:
+				h := s.histogram[i]
+				name := "synthetic_request_duration_seconds"
+				help := "Histograms of request latencies, with bursts of slow requests."
+				for b, le := range syntheticBuckets {
+					add(name+"_bucket", textparse.MetricTypeHistogram, help, h.buckets[b], "handler", id, labels.BucketLabel, formatFloat(le))
+				}
+				add(name+"_bucket", textparse.MetricTypeHistogram, help, h.count, "handler", id, labels.BucketLabel, "+Inf")
+				add(name+"_sum", textparse.MetricTypeHistogram, help, h.sum, "handler", id)
+				add(name+"_count", textparse.MetricTypeHistogram, help, h.count, "handler", id)
+			}
+		}
+	}
+	return series, nil
+}
+
+// advance moves the random walks, counters and histograms on by a step.
+func (s *SyntheticSource) advance(step int64) {
+	for i := 0; i < s.series; i++ {
+		s.walks[i] = math.Max(0, s.walks[i]+math.Round(4*(s.noise(2, i, step)-0.5)))
+
+		if s.noise(3, i, step) < 0.002 {
+			s.counters[i] = 0
+		} else {
+			s.counters[i] += math.Round(float64(10*(i+1)) * (0.5 + s.noise(4, i, step)))
+		}
+
+		// a burst lasts a while, and makes for more requests, and slower ones
+		requests, mean := 20, 0.05
+		if s.noise(5, i, step/30) > 0.8 {
+			requests, mean = 100, 0.8
+		}
+		h := &s.histogram[i]
+		for r := 0; r < requests; r++ {
+			latency := -mean * math.Log(1-s.noise(6+uint64(r), i, step))
+			h.sum += latency
+			h.count++
+			for b, le := range syntheticBuckets {
+				if latency <= le {
+					h.buckets[b]++
+				}
+			}
+		}
+	}
+}
+
+// noise is a number in [0, 1) which only depends on the seed and its arguments, a
+// splitmix64 hash of them.
+func (s *SyntheticSource) noise(stream uint64, series int, step int64) float64 {
+	x := s.seed ^ stream*0x9e3779b97f4a7c15 ^ uint64(series)*0xbf58476d1ce4e5b9 ^ uint64(step)*0x94d049bb133111eb
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	x ^= x >> 31
+	return float64(x>>11) / (1 << 53)
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSyntheticSourceIsDeterministic(t *testing.T) {
+	scrape := func(spec string) [][]ParsedSeries {
+		src, err := NewSyntheticSource(spec)
+		if err != nil {
+			t.Fatalf("unable to create source: %v", err)
+		}
+		start := time.Unix(1000, 0)
+		var scrapes [][]ParsedSeries
+		for _, after := range []time.Duration{0, time.Second, 10 * time.Second, 2 * time.Minute} {
+			series, err := src.ScrapePrometheusEndpoint(context.TODO(), start.Add(after))
+			if err != nil {
+				t.Fatalf("unable to scrape: %v", err)
+			}
+			scrapes = append(scrapes, series)
+		}
+		return scrapes
+	}
+
+	first, again := scrape("synthetic://?seed=42"), scrape("synthetic://?seed=42")
+	if !reflect.DeepEqual(first, again) {
+		t.Errorf("got different series for the same seed")
+	}
+	if other := scrape("synthetic://?seed=43"); reflect.DeepEqual(first, other) {
+		t.Errorf("got the same series for different seeds")
+	}
+	// 3 of each kind, with 11 buckets, a sum and a count for each histogram
+	if got, want := len(first[0]), 3+3+3+3*13; got != want {
+		t.Errorf("got %d series, want %d", got, want)
+	}
+
+	for i, series := range first[len(first)-1] {
+		if series.Labels.Get("instance") != "synthetic://?seed=42" {
+			t.Errorf("got series %s without the target as its instance", series.Labels)
+		}
+		// counters only go down when they're reset, and histograms never do
+		if series.Labels.Get("__name__") == "synthetic_request_duration_seconds_count" && series.Value < first[1][i].Value {
+			t.Errorf("got %s going down from %v to %v", series.Labels, first[1][i].Value, series.Value)
+		}
+	}
+}
+
+func TestNewSyntheticSource(t *testing.T) {
+	src, err := NewSyntheticSource("synthetic://sine,counter?series=2")
+	if err != nil {
+		t.Fatalf("unable to create source: %v", err)
+	}
+	series, err := src.ScrapePrometheusEndpoint(context.TODO(), time.Now())
+	if err != nil {
+		t.Fatalf("unable to scrape: %v", err)
+	}
+	if len(series) != 4 {
+		t.Errorf("got %d series, want 2 sine waves and 2 counters", len(series))
+	}
+	for _, spec := range []string{"synthetic://nonsense", "synthetic://?seed=x", "synthetic://?series=0", "http://localhost"} {
+		if _, err := NewSyntheticSource(spec); err == nil {
+			t.Errorf("expected %q to be invalid", spec)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/prometheus/common/config"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"gopkg.in/yaml.v2"
+)
+
+// TargetConfig is an endpoint to scrape which the kubeconfig's credentials are no good
+// for, i.e. a node_exporter behind mTLS, with the TLS and auth to scrape it with, in
+// the YAML of prometheus' scrape configs.
+type TargetConfig struct {
+	URL              string                  `yaml:"url"`
+	HTTPClientConfig config.HTTPClientConfig `yaml:",inline"`
+	// Labels are added to every series of the target, like the labels of prometheus'
+	// static configs, i.e. cluster: prod
+	Labels map[string]string `yaml:"labels,omitempty"`
+	// Headers are sent with every scrape of the target, i.e. the X-Scope-OrgID of a
+	// Cortex or Mimir tenant, or what an auth proxy in front of it wants
+	Headers map[string]string `yaml:"headers,omitempty"`
+}
+
+func (t *TargetConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*t = TargetConfig{HTTPClientConfig: config.DefaultHTTPClientConfig}
+	type plain TargetConfig
+	if err := unmarshal((*plain)(t)); err != nil {
+		return err
+	}
+	if t.URL == "" {
+		return fmt.Errorf("a target needs a url")
+	}
+	if err := t.HTTPClientConfig.Validate(); err != nil {
+		return fmt.Errorf("invalid target %s: %w", t.URL, err)
+	}
+	for name := range t.Labels {
+		if !model.LabelName(name).IsValid() {
+			return fmt.Errorf("invalid target %s: %q isn't a valid label name", t.URL, name)
+		}
+	}
+	headers := make(map[string]string, len(t.Headers))
+	for name, value := range t.Headers {
+		if !validHeaderName(name) {
+			return fmt.Errorf("invalid target %s: %q isn't a valid header name", t.URL, name)
+		}
+		headers[http.CanonicalHeaderKey(name)] = value
+	}
+	// we'd only be sending one of them
+	if _, ok := headers["Authorization"]; ok && t.HasAuth() {
+		return fmt.Errorf("invalid target %s: at most one of an Authorization header, basic_auth, authorization, bearer_token and oauth2 may be configured", t.URL)
+	}
+	t.Headers = headers
+	return nil
+}
+
+// HasAuth is whether the target is scraped with credentials of its own, which an
+// Authorization header would silently take the place of.
+func (t *TargetConfig) HasAuth() bool {
+	c := t.HTTPClientConfig
+	return c.BasicAuth != nil || c.Authorization != nil || c.OAuth2 != nil || c.BearerToken != "" || c.BearerTokenFile != ""
+}
+
+// ParseTargetConfigs parses a list of target configs. Their files, i.e. CAs and
+// bearer token files, are relative to the given directory, that of the config file.
+func ParseTargetConfigs(data []byte, dir string) ([]TargetConfig, error) {
+	var targets []TargetConfig
+	if err := yaml.UnmarshalStrict(data, &targets); err != nil {
+		return nil, fmt.Errorf("invalid target configs: %w", err)
+	}
+	for i := range targets {
+		targets[i].HTTPClientConfig.SetDirectory(filepath.Clean(dir))
+	}
+	return targets, nil
+}
+
+// ParseExternalLabels parses labels to add to every series of every target, like
+// prometheus' external labels, each of them name=value, i.e. cluster=prod.
+func ParseExternalLabels(specs []string) (map[string]string, error) {
+	external := make(map[string]string, len(specs))
+	for _, spec := range specs {
+		eq := strings.Index(spec, "=")
+		if eq < 0 {
+			return nil, fmt.Errorf("invalid external label %q, expected name=value", spec)
+		}
+		name, value := spec[:eq], spec[eq+1:]
+		if !model.LabelName(name).IsValid() {
+			return nil, fmt.Errorf("invalid external label %q, %q isn't a valid label name", spec, name)
+		}
+		external[name] = value
+	}
+	return external, nil
+}
+
+// ParseHeaders parses headers to send with every scrape, each of them name: value, i.e.
+// X-Scope-OrgID: tenant-1, with their names made canonical.
+func ParseHeaders(specs []string) (map[string]string, error) {
+	headers := make(map[string]string, len(specs))
+	for _, spec := range specs {
+		colon := strings.Index(spec, ":")
+		if colon < 0 {
+			return nil, fmt.Errorf("invalid header %q, expected name: value", spec)
+		}
+		name, value := strings.TrimSpace(spec[:colon]), strings.TrimSpace(spec[colon+1:])
+		if !validHeaderName(name) {
+			return nil, fmt.Errorf("invalid header %q, %q isn't a valid header name", spec, name)
+		}
+		headers[http.CanonicalHeaderKey(name)] = value
+	}
+	return headers, nil
+}
+
+// validHeaderName is whether the name is an HTTP token, as header names have to be.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	return strings.IndexFunc(name, func(r rune) bool {
+		return r <= ' ' || r >= 0x7f || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, r)
+	}) < 0
+}
+
+// TargetSource is a DataSource which adds the labels of its target to every series, so
+// that the up series and such of its scrapes can have them too.
+type TargetSource interface {
+	DataSource
+	TargetLabels() map[string]string
+}
+
+// TargetLabels are the labels to add to every series of a target, its external labels
+// and its instance label, which takes precedence over them.
+func TargetLabels(instance string, external map[string]string) map[string]string {
+	ls := make(map[string]string, len(external)+1)
+	for name, value := range external {
+		ls[name] = value
+	}
+	ls[labels.InstanceName] = instance
+	return ls
+}
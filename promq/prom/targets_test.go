@@ -0,0 +1,110 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+func TestParseTargetConfigs(t *testing.T) {
+	targets, err := ParseTargetConfigs([]byte(`
+- url: https://node-1:9100/metrics
+  tls_config:
+    ca_file: ca.pem
+    cert_file: client.pem
+    key_file: client-key.pem
+- url: http://node-2:9100/metrics
+  basic_auth:
+    username: prometheus
+    password_file: /etc/promq/password
+  labels:
+    cluster: prod
+  headers:
+    x-scope-orgid: tenant-1
+`), "/etc/promq")
+	if err != nil {
+		t.Fatalf("unable to parse target configs: %v", err)
+	}
+	if len(targets) != 2 {
+		t.Fatalf("got %d targets, want 2", len(targets))
+	}
+	tls := targets[0].HTTPClientConfig.TLSConfig
+	if tls.CAFile != "/etc/promq/ca.pem" || tls.CertFile != "/etc/promq/client.pem" || tls.KeyFile != "/etc/promq/client-key.pem" {
+		t.Errorf("got TLS files %q, %q and %q, want them relative to the config", tls.CAFile, tls.CertFile, tls.KeyFile)
+	}
+	if !targets[0].HTTPClientConfig.FollowRedirects {
+		t.Errorf("expected targets to follow redirects by default, like prometheus")
+	}
+	auth := targets[1].HTTPClientConfig.BasicAuth
+	if auth == nil || auth.Username != "prometheus" || auth.PasswordFile != "/etc/promq/password" {
+		t.Errorf("got basic auth %+v, want prometheus with /etc/promq/password", auth)
+	}
+	if got := targets[1].Labels; !reflect.DeepEqual(got, map[string]string{"cluster": "prod"}) {
+		t.Errorf("got labels %v, want cluster=prod", got)
+	}
+	if got := targets[1].Headers; !reflect.DeepEqual(got, map[string]string{"X-Scope-Orgid": "tenant-1"}) {
+		t.Errorf("got headers %v, want X-Scope-Orgid: tenant-1", got)
+	}
+
+	for _, invalid := range []string{
+		"- tls_config:\n    ca_file: ca.pem\n",
+		"- url: http://node-1:9100/metrics\n  bearer_token_file: token\n  basic_auth:\n    username: prometheus\n",
+		"- url: http://node-1:9100/metrics\n  tls:\n    ca_file: ca.pem\n",
+		"- url: http://node-1:9100/metrics\n  labels:\n    not-a-label: prod\n",
+		"- url: http://node-1:9100/metrics\n  headers:\n    not a header: tenant-1\n",
+		"- url: http://node-1:9100/metrics\n  headers:\n    authorization: Basic abc\n  basic_auth:\n    username: prometheus\n",
+	} {
+		if _, err := ParseTargetConfigs([]byte(invalid), "."); err == nil {
+			t.Errorf("expected %q to be invalid", invalid)
+		}
+	}
+}
+
+func TestParseHeaders(t *testing.T) {
+	headers, err := ParseHeaders([]string{"x-scope-orgid: tenant-1", "Authorization:Basic abc:def"})
+	if err != nil {
+		t.Fatalf("unable to parse headers: %v", err)
+	}
+	want := map[string]string{"X-Scope-Orgid": "tenant-1", "Authorization": "Basic abc:def"}
+	if !reflect.DeepEqual(headers, want) {
+		t.Errorf("got headers %v, want %v", headers, want)
+	}
+	for _, invalid := range []string{"X-Scope-OrgID", ": tenant-1", "X Scope: tenant-1"} {
+		if _, err := ParseHeaders([]string{invalid}); err == nil {
+			t.Errorf("expected %q to be invalid", invalid)
+		}
+	}
+}
+
+func TestTargetLabels(t *testing.T) {
+	external, err := ParseExternalLabels([]string{"cluster=prod", "replica=a=b", "instance=ignored"})
+	if err != nil {
+		t.Fatalf("unable to parse external labels: %v", err)
+	}
+	want := map[string]string{"cluster": "prod", "replica": "a=b", labels.InstanceName: "http://node-1:9100/metrics"}
+	if got := TargetLabels("http://node-1:9100/metrics", external); !reflect.DeepEqual(got, want) {
+		t.Errorf("got target labels %v, want %v", got, want)
+	}
+	for _, invalid := range []string{"cluster", "not-a-label=prod"} {
+		if _, err := ParseExternalLabels([]string{invalid}); err == nil {
+			t.Errorf("expected %q to be an invalid external label", invalid)
+		}
+	}
+}
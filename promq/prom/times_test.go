@@ -0,0 +1,104 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTime(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		in      string
+		want    time.Time
+		wantErr bool
+	}{
+		{in: "now", want: now},
+		{in: "2020-06-01T10:30:00Z", want: time.Date(2020, 6, 1, 10, 30, 0, 0, time.UTC)},
+		{in: "1591005600", want: time.Unix(1591005600, 0)},
+		{in: "1591005600.5", want: time.Unix(1591005600, int64(500*time.Millisecond))},
+		{in: "-1h30m", want: now.Add(-90 * time.Minute)},
+		{in: "yesterday", wantErr: true},
+		{in: "Inf", wantErr: true},
+	}
+	for _, tc := range testCases {
+		got, err := ParseTime(tc.in, now)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("ParseTime(%q) returned error %v, want an error: %v", tc.in, err, tc.wantErr)
+			continue
+		}
+		if !got.Equal(tc.want) {
+			t.Errorf("ParseTime(%q) = %v, want %v", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestRangeBounds(t *testing.T) {
+	now := time.Unix(1000, 0)
+	testCases := []struct {
+		desc      string
+		times     Range
+		wantStart time.Time
+		wantEnd   time.Time
+		wantErr   bool
+	}{
+		{
+			desc:      "window up to now",
+			times:     Range{Window: time.Minute, Interval: time.Second},
+			wantStart: time.Unix(940, 0),
+			wantEnd:   now,
+		},
+		{
+			desc:      "fixed start and end",
+			times:     Range{Window: time.Minute, Interval: time.Second, Start: time.Unix(100, 0), End: time.Unix(200, 0)},
+			wantStart: time.Unix(100, 0),
+			wantEnd:   time.Unix(200, 0),
+		},
+		{
+			desc:      "fixed start up to now",
+			times:     Range{Interval: time.Second, Start: time.Unix(100, 0)},
+			wantStart: time.Unix(100, 0),
+			wantEnd:   now,
+		},
+		{
+			desc:      "end before start",
+			times:     Range{Interval: time.Second, Start: time.Unix(200, 0), End: time.Unix(100, 0)},
+			wantStart: time.Unix(200, 0),
+			wantEnd:   time.Unix(100, 0),
+			wantErr:   true,
+		},
+		{
+			desc:      "no step",
+			times:     Range{Start: time.Unix(100, 0), End: time.Unix(200, 0)},
+			wantStart: time.Unix(100, 0),
+			wantEnd:   time.Unix(200, 0),
+			wantErr:   true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			start, end := tc.times.Bounds(now)
+			if !start.Equal(tc.wantStart) || !end.Equal(tc.wantEnd) {
+				t.Errorf("Bounds() = %v, %v, want %v, %v", start, end, tc.wantStart, tc.wantEnd)
+			}
+			if err := tc.times.Validate(now); (err != nil) != tc.wantErr {
+				t.Errorf("Validate() = %v, want an error: %v", err, tc.wantErr)
+			}
+		})
+	}
+}
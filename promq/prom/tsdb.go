@@ -0,0 +1,100 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb"
+)
+
+// TSDBStorage keeps what we scrape in a prometheus TSDB on disk, rather than in memory,
+// so that long continuous sessions survive restarts, and long windows don't need all
+// of their data in memory.
+type TSDBStorage struct {
+	db *tsdb.DB
+}
+
+var _ Storage = &TSDBStorage{}
+
+// NewTSDBStorage opens (or creates) a TSDB in the given directory, which keeps data for
+// as long as the retention.
+func NewTSDBStorage(dir string, retention time.Duration) (*TSDBStorage, error) {
+	opts := tsdb.DefaultOptions()
+	opts.RetentionDuration = int64(retention / time.Millisecond)
+	db, err := tsdb.Open(dir, nil, nil, opts, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open TSDB in %s: %w", dir, err)
+	}
+	return &TSDBStorage{db: db}, nil
+}
+
+func (s *TSDBStorage) LoadData(points []ParsedSeries) error {
+	return loadAll(s.Appender(), points)
+}
+
+// Backfill loads historical points oldest first, but the TSDB can't go back in time
+// any more than for a scrape, so those older than what it already has are dropped,
+// i.e. backfilling only really works before the first scrape.
+func (s *TSDBStorage) Backfill(points []ParsedSeries) error {
+	return loadAll(s.Appender(), sortedByTime(points))
+}
+
+// Appender loads a batch of points a point at a time, like LoadData does all at once.
+func (s *TSDBStorage) Appender() BatchAppender {
+	return &tsdbAppender{app: s.db.Appender(context.Background())}
+}
+
+type tsdbAppender struct {
+	app storage.Appender
+}
+
+func (a *tsdbAppender) Append(point ParsedSeries) error {
+	if _, err := a.app.Append(0, point.Labels, point.Timestamp, point.Value); err != nil {
+		// unlike our in-memory storage, the TSDB can't go back in time, i.e. for
+		// endpoints which give their own timestamps, those samples are just dropped
+		if errors.Is(err, storage.ErrOutOfOrderSample) || errors.Is(err, storage.ErrOutOfBounds) || errors.Is(err, storage.ErrDuplicateSampleForTimestamp) {
+			return nil
+		}
+		return fmt.Errorf("unable to store %s: %w", point.Labels, err)
+	}
+	return nil
+}
+
+func (a *tsdbAppender) Commit() error {
+	return a.app.Commit()
+}
+
+func (a *tsdbAppender) Rollback() error {
+	return a.app.Rollback()
+}
+
+// Clean doesn't do anything, the TSDB drops data older than its retention by itself.
+func (s *TSDBStorage) Clean(_ int64) {}
+
+func (s *TSDBStorage) Querier(ctx context.Context, minTime, maxTime int64) (storage.Querier, error) {
+	return s.db.Querier(ctx, minTime, maxTime)
+}
+
+// Close flushes what's in memory to disk.
+func (s *TSDBStorage) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,77 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/promql"
+)
+
+func TestTSDBStorageSurvivesRestarts(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	s, err := NewTSDBStorage(dir, time.Hour)
+	if err != nil {
+		t.Fatalf("unable to open storage: %v", err)
+	}
+	for i, raw := range testData {
+		points, err := ParseTextData(raw, now.Add(time.Duration(i-1)*time.Second))
+		if err != nil {
+			t.Fatalf("unable to parse data: %v", err)
+		}
+		if err := s.LoadData(points); err != nil {
+			t.Fatalf("unable to load data: %v", err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("unable to close storage: %v", err)
+	}
+
+	s, err = NewTSDBStorage(dir, time.Hour)
+	if err != nil {
+		t.Fatalf("unable to reopen storage: %v", err)
+	}
+	defer s.Close()
+	data := NewPeriodicDataWithStorage(nil, DefaultEngineOptions(time.Minute, 1000), s)
+	if err := data.SetQuery(context.TODO(), `crackers`); err != nil {
+		t.Fatalf("unable to set query: %v", err)
+	}
+
+	var got []float64
+	err = data.ExecuteRangeQuery(context.TODO(), now.Add(-time.Second), now, time.Second, func(res *promql.Result) error {
+		matrix, err := res.Matrix()
+		if err != nil {
+			return err
+		}
+		for _, series := range matrix {
+			for _, pt := range series.Points {
+				got = append(got, pt.V)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unable to execute range query: %v", err)
+	}
+	if want := []float64{37.5, 9000.1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got points %v, want %v", got, want)
+	}
+}
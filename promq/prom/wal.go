@@ -0,0 +1,364 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/tsdb/fileutil"
+)
+
+// walStreamBatch is how many series of a streamed scrape are written to the WAL at a
+// time, each batch as a scrape of its own.
+const walStreamBatch = 1000
+
+// a line of a WAL is either a scrape or a new query
+type walRecord struct {
+	Query  string          `json:"query,omitempty"`
+	Scrape *recordedScrape `json:"scrape,omitempty"`
+}
+
+// WALState is what a WAL had in it, for a session to carry on where the last one
+// left off.
+type WALState struct {
+	// Points are the samples scraped since the time the WAL was read from
+	Points []ParsedSeries
+	// Query is the last query that was run, if any
+	Query string
+}
+
+// ReadWAL reads back what the WAL at path has in it from since on, which is nothing
+// if there isn't one yet. Lines which can't be made sense of, i.e. the last one, if
+// we died half way through writing it, are skipped.
+func ReadWAL(path string, since time.Time) (WALState, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return WALState{}, nil
+	}
+	if err != nil {
+		return WALState{}, fmt.Errorf("unable to read WAL: %w", err)
+	}
+	defer f.Close()
+	return readWAL(f, since)
+}
+
+// readWAL reads back what a WAL has in it from since on.
+func readWAL(r io.Reader, since time.Time) (WALState, error) {
+	var state WALState
+	scanner := bufio.NewScanner(r)
+	// a scrape of a big endpoint is a long line
+	scanner.Buffer(nil, 256<<20)
+	for scanner.Scan() {
+		var record walRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			continue
+		}
+		if record.Query != "" {
+			state.Query = record.Query
+		}
+		if record.Scrape == nil || record.Scrape.Time < PromTimestamp(since) {
+			continue
+		}
+		for _, s := range record.Scrape.Series {
+			parsed, err := s.parsed(s.Timestamp)
+			if err != nil {
+				continue
+			}
+			state.Points = append(state.Points, parsed)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return state, fmt.Errorf("unable to read WAL: %w", err)
+	}
+	return state, nil
+}
+
+// WALSource appends every scrape of the source it wraps, and every query that's run
+// on it, to a WAL, so that if we die, the next session can pick up the window of data
+// and the query we had with ReadWAL, rather than starting from an empty graph. Only
+// the last window is kept, the WAL is compacted in the background once it has twice
+// as much. The WAL is locked while it's written to, so that two sessions can't share
+// it.
+type WALSource struct {
+	source DataSource
+	path   string
+	window time.Duration
+	lock   fileutil.Releaser
+	// compactions is the compaction in the background, if any, for Close to wait for
+	compactions sync.WaitGroup
+
+	mu   sync.Mutex
+	file *os.File
+	// how much has been written to the file, the time of the oldest scrape in it,
+	// and the last query written to it
+	written int64
+	oldest  int64
+	query   string
+	// whether it's being compacted, and why it couldn't be, last time it was
+	compacting bool
+	compactErr error
+}
+
+var _ QueryAwareSource = &WALSource{}
+var _ StreamingSource = &WALSource{}
+
+// NewWALSource locks the WAL at path, and starts it over with what's in the given
+// state, i.e. what was read back from it, followed by the scrapes of the source.
+func NewWALSource(source DataSource, path string, window time.Duration, state WALState) (*WALSource, error) {
+	lock, _, err := fileutil.Flock(path + ".lock")
+	if err != nil {
+		return nil, fmt.Errorf("unable to lock WAL %s, is another session using it? %w", path, err)
+	}
+	w := &WALSource{source: source, path: path, window: window, lock: lock}
+	f, written, oldest, err := w.writeState(state)
+	if err == nil {
+		err = w.replace(f)
+	}
+	if err != nil {
+		lock.Release()
+		return nil, err
+	}
+	w.file, w.written, w.oldest, w.query = f, written, oldest, state.Query
+	return w, nil
+}
+
+func (w *WALSource) ScrapePrometheusEndpoint(ctx context.Context, nowish time.Time) ([]ParsedSeries, error) {
+	series, scrapeErr := w.source.ScrapePrometheusEndpoint(ctx, nowish)
+	// what we did get of a partial scrape is what we'll have charted, so it's kept
+	if _, ok := ScrapeWarnings(scrapeErr); !ok {
+		return series, scrapeErr
+	}
+	if err := w.appendScrape(nowish, series); err != nil {
+		return nil, err
+	}
+	return series, scrapeErr
+}
+
+// StreamPrometheusEndpoint writes the series of the source to the WAL as they're
+// streamed, a batch at a time. What's written of a scrape which then fails is kept,
+// as those samples were scraped all the same.
+func (w *WALSource) StreamPrometheusEndpoint(ctx context.Context, nowish time.Time, add func(ParsedSeries) error) error {
+	batch := make([]ParsedSeries, 0, walStreamBatch)
+	scrapeErr := StreamSource(ctx, w.source, nowish, func(ps ParsedSeries) error {
+		if err := add(ps); err != nil {
+			return err
+		}
+		if batch = append(batch, ps); len(batch) < walStreamBatch {
+			return nil
+		}
+		err := w.appendScrape(nowish, batch)
+		batch = batch[:0]
+		return err
+	})
+	if _, ok := ScrapeWarnings(scrapeErr); !ok {
+		return scrapeErr
+	}
+	if err := w.appendScrape(nowish, batch); err != nil {
+		return err
+	}
+	return scrapeErr
+}
+
+// appendScrape writes (some of) the series of a scrape to the WAL, and starts
+// compacting it if it's got more than twice the window in it.
+func (w *WALSource) appendScrape(nowish time.Time, series []ParsedSeries) error {
+	scrape := recordScrape(nowish, series)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.compactErr; err != nil {
+		w.compactErr = nil
+		return err
+	}
+	if err := w.append(walRecord{Scrape: &scrape}); err != nil {
+		return err
+	}
+	if w.oldest == 0 {
+		w.oldest = scrape.Time
+	}
+	if !w.compacting && scrape.Time-w.oldest > 2*w.window.Milliseconds() {
+		w.compacting = true
+		w.compactions.Add(1)
+		go func() {
+			defer w.compactions.Done()
+			w.compact(nowish.Add(-w.window))
+		}()
+	}
+	return nil
+}
+
+// SetQuery writes the query to the WAL, and passes it on to the source, if it cares.
+func (w *WALSource) SetQuery(query string) error {
+	if src, ok := w.source.(QueryAwareSource); ok {
+		if err := src.SetQuery(query); err != nil {
+			return err
+		}
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if query == w.query {
+		return nil
+	}
+	w.query = query
+	return w.append(walRecord{Query: query})
+}
+
+func (w *WALSource) append(record walRecord) error {
+	n, err := appendRecord(w.file, record)
+	w.written += n
+	return err
+}
+
+// appendRecord writes a record to the given WAL file, returning how much it wrote.
+func appendRecord(f *os.File, record walRecord) (int64, error) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return 0, fmt.Errorf("unable to write to WAL: %w", err)
+	}
+	n, err := f.Write(append(line, '\n'))
+	if err != nil {
+		return int64(n), fmt.Errorf("unable to write to WAL: %w", err)
+	}
+	return int64(n), nil
+}
+
+// compact rewrites the WAL with just what's in it from since on. It reads the whole
+// WAL, so it's done in the background, rather than in the scrape it's due after, and
+// only what was appended to the WAL while it was at it is copied over with the WAL
+// locked. If it fails, the next scrape does.
+func (w *WALSource) compact(since time.Time) {
+	w.mu.Lock()
+	compacted := w.written
+	w.mu.Unlock()
+
+	err := func() error {
+		old, err := os.Open(w.path)
+		if err != nil {
+			return fmt.Errorf("unable to compact WAL: %w", err)
+		}
+		defer old.Close()
+		state, err := readWAL(io.LimitReader(old, compacted), since)
+		if err != nil {
+			return err
+		}
+		f, written, oldest, err := w.writeState(state)
+		if err != nil {
+			return err
+		}
+
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		appended, err := io.Copy(f, old)
+		if err == nil {
+			err = w.replace(f)
+		}
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("unable to compact WAL: %w", err)
+		}
+		w.file.Close()
+		w.file, w.written = f, written+appended
+		if oldest != 0 {
+			w.oldest = oldest
+		}
+		return nil
+	}()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.compacting, w.compactErr = false, err
+}
+
+// writeState writes a new WAL next to the old one with the given state in it, a
+// scrape per timestamp, returning it open to append to, with how much was written
+// and the time of its oldest scrape. It's moved over the old one with replace, so
+// that dying half way through leaves one or the other.
+func (w *WALSource) writeState(state WALState) (f *os.File, written, oldest int64, err error) {
+	scrapes := map[int64][]ParsedSeries{}
+	var times []int64
+	for _, p := range state.Points {
+		if _, ok := scrapes[p.Timestamp]; !ok {
+			times = append(times, p.Timestamp)
+		}
+		scrapes[p.Timestamp] = append(scrapes[p.Timestamp], p)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+
+	f, err = os.OpenFile(w.path+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("unable to write WAL: %w", err)
+	}
+	if len(times) > 0 {
+		oldest = times[0]
+	}
+	records := make([]walRecord, 0, len(times)+1)
+	for _, ts := range times {
+		scrape := recordScrape(time.Unix(0, ts*int64(time.Millisecond)), scrapes[ts])
+		records = append(records, walRecord{Scrape: &scrape})
+	}
+	if state.Query != "" {
+		records = append(records, walRecord{Query: state.Query})
+	}
+	for _, record := range records {
+		n, err := appendRecord(f, record)
+		written += n
+		if err != nil {
+			f.Close()
+			return nil, 0, 0, err
+		}
+	}
+	return f, written, oldest, nil
+}
+
+// replace moves a new WAL written by writeState over the old one.
+func (w *WALSource) replace(f *os.File) error {
+	if err := os.Rename(f.Name(), w.path); err != nil {
+		return fmt.Errorf("unable to write WAL: %w", err)
+	}
+	return nil
+}
+
+// Close closes the WAL, leaving it for the next session to resume, and unlocks it.
+func (w *WALSource) Close() error {
+	w.compactions.Wait()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	err := w.file.Close()
+	if releaseErr := w.lock.Release(); err == nil {
+		err = releaseErr
+	}
+	return err
+}
+
+// Discard closes the WAL and removes it, i.e. when the session ends cleanly, so that
+// there's nothing to resume.
+func (w *WALSource) Discard() error {
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if err := os.Remove(w.path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("unable to remove WAL: %w", err)
+	}
+	return nil
+}
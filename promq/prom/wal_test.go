@@ -0,0 +1,155 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prom
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWALResume(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal")
+	wal, err := NewWALSource(&scrapesSource{scrapes: [][]byte{testData[0], testData[1], []byte("up 1\n")}}, path, 30*time.Second, WALState{})
+	if err != nil {
+		t.Fatalf("unable to start WAL: %v", err)
+	}
+	start := time.Unix(1000, 0)
+	for i := 0; i < 3; i++ {
+		if _, err := wal.ScrapePrometheusEndpoint(context.TODO(), start.Add(time.Duration(i)*10*time.Second)); err != nil {
+			t.Fatalf("unable to scrape: %v", err)
+		}
+	}
+	for _, query := range []string{"cheese", "up"} {
+		if err := wal.SetQuery(query); err != nil {
+			t.Fatalf("unable to set query %q: %v", query, err)
+		}
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatalf("unable to close WAL: %v", err)
+	}
+	// as if we died half way through a write
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatalf("unable to open WAL: %v", err)
+	}
+	if _, err := f.WriteString(`{"scrape":{"ti`); err != nil {
+		t.Fatalf("unable to write to WAL: %v", err)
+	}
+	f.Close()
+
+	state, err := ReadWAL(path, start.Add(5*time.Second))
+	if err != nil {
+		t.Fatalf("unable to read WAL: %v", err)
+	}
+	if len(state.Points) != 7 || state.Query != "up" {
+		t.Errorf("got %d points and query %q from the last two scrapes, want 7 and %q", len(state.Points), state.Query, "up")
+	}
+
+	// resuming starts the WAL over with only what was restored
+	resumed, err := NewWALSource(&scrapesSource{}, path, 30*time.Second, state)
+	if err != nil {
+		t.Fatalf("unable to resume WAL: %v", err)
+	}
+	defer resumed.Close()
+	state, err = ReadWAL(path, time.Unix(0, 0))
+	if err != nil {
+		t.Fatalf("unable to read resumed WAL: %v", err)
+	}
+	if len(state.Points) != 7 || state.Query != "up" {
+		t.Errorf("got %d points and query %q from the resumed WAL, want 7 and %q", len(state.Points), state.Query, "up")
+	}
+}
+
+func TestWALCompacts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal")
+	wal, err := NewWALSource(&scrapesSource{scrapes: [][]byte{testData[0], []byte("up 1\n")}}, path, 30*time.Second, WALState{})
+	if err != nil {
+		t.Fatalf("unable to start WAL: %v", err)
+	}
+	if err := wal.SetQuery("up"); err != nil {
+		t.Fatalf("unable to set query: %v", err)
+	}
+	start := time.Unix(1000, 0)
+	for _, ts := range []time.Time{start, start.Add(70 * time.Second)} {
+		if _, err := wal.ScrapePrometheusEndpoint(context.TODO(), ts); err != nil {
+			t.Fatalf("unable to scrape: %v", err)
+		}
+	}
+	// closing waits for it to be compacted in the background
+	if err := wal.Close(); err != nil {
+		t.Fatalf("unable to close WAL: %v", err)
+	}
+	// the first scrape is more than two windows old, so it's been compacted away
+	state, err := ReadWAL(path, time.Unix(0, 0))
+	if err != nil {
+		t.Fatalf("unable to read WAL: %v", err)
+	}
+	if len(state.Points) != 1 || state.Query != "up" {
+		t.Errorf("got %d points and query %q after compacting, want 1 and %q", len(state.Points), state.Query, "up")
+	}
+}
+
+func TestWALIsLocked(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal")
+	wal, err := NewWALSource(&scrapesSource{}, path, 30*time.Second, WALState{})
+	if err != nil {
+		t.Fatalf("unable to start WAL: %v", err)
+	}
+	if _, err := NewWALSource(&scrapesSource{}, path, 30*time.Second, WALState{}); err == nil {
+		t.Errorf("expected a second session to be unable to use the same WAL")
+	}
+	if err := wal.Discard(); err != nil {
+		t.Fatalf("unable to discard WAL: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected a discarded WAL to be gone, got %v", err)
+	}
+	again, err := NewWALSource(&scrapesSource{}, path, 30*time.Second, WALState{})
+	if err != nil {
+		t.Fatalf("unable to start WAL once the last session was done with it: %v", err)
+	}
+	again.Close()
+}
+
+func TestWALStreams(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal")
+	wal, err := NewWALSource(streamingSource{data: testData[0]}, path, 30*time.Second, WALState{})
+	if err != nil {
+		t.Fatalf("unable to start WAL: %v", err)
+	}
+	var streamed int
+	err = StreamSource(context.TODO(), wal, time.Unix(1000, 0), func(ParsedSeries) error {
+		streamed++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unable to scrape: %v", err)
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatalf("unable to close WAL: %v", err)
+	}
+	state, err := ReadWAL(path, time.Unix(0, 0))
+	if err != nil {
+		t.Fatalf("unable to read WAL: %v", err)
+	}
+	if streamed != 5 || len(state.Points) != 5 {
+		t.Errorf("got %d series streamed and %d written to the WAL, want 5 of each", streamed, len(state.Points))
+	}
+}
@@ -0,0 +1,125 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package term
+
+import (
+	"strconv"
+
+	"github.com/gdamore/tcell"
+	"github.com/mattn/go-runewidth"
+
+	"sigs.k8s.io/instrumentation-tools/promq/term/plot"
+)
+
+// BarsView is a widget that draws a bar chart, i.e. of an instant vector, a bar
+// per row, running across from its title, with its value at its end.  The titles
+// get at most a third of the width, and are cut off past that, as are the bars
+// that don't fit below.
+type BarsView struct {
+	// Bars are drawn from the top down, in order.
+	Bars []plot.Bar
+	// Palette colors the bars, the default palette if unset.
+	Palette Palette
+	// Highlighted, if set, is drawn in bold, with the other bars dimmed.
+	Highlighted plot.SeriesId
+	// ValueLabeler labels each bar with its value, as %g if unset.
+	ValueLabeler func(float64) string
+
+	pos PositionBox
+}
+
+func (b *BarsView) SetBox(box PositionBox) {
+	b.pos = box
+}
+
+func (b *BarsView) FlushTo(screen tcell.Screen) {
+	if b.pos.Rows == 0 || b.pos.Cols == 0 {
+		// bail, we've effectively been asked not to render
+		return
+	}
+	for row := b.pos.StartRow; row < b.pos.StartRow+b.pos.Rows; row++ {
+		for col := b.pos.StartCol; col < b.pos.StartCol+b.pos.Cols; col++ {
+			screen.SetContent(col, row, ' ', nil, tcell.StyleDefault)
+		}
+	}
+
+	titleWidth, valueWidth := 0, 0
+	values := make([]string, len(b.Bars))
+	for i, bar := range b.Bars {
+		if width := runewidth.StringWidth(bar.Title); width > titleWidth {
+			titleWidth = width
+		}
+		values[i] = b.label(bar.Value)
+		if width := runewidth.StringWidth(values[i]); width > valueWidth {
+			valueWidth = width
+		}
+	}
+	if titleWidth > b.pos.Cols/3 {
+		titleWidth = b.pos.Cols / 3
+	}
+	// a space either side of the bars
+	barCells := b.pos.Cols - titleWidth - valueWidth - 2
+	if barCells < 0 {
+		barCells = 0
+	}
+	eighths := plot.BarEighths(b.Bars, barCells)
+
+	barStart := b.pos.StartCol + titleWidth + 1
+	for i, bar := range b.Bars {
+		if i >= b.pos.Rows {
+			break
+		}
+		row := b.pos.StartRow + i
+		sty := tcell.StyleDefault.Foreground(b.Palette.Color(bar.Id))
+		switch {
+		case b.Highlighted == plot.NoSeries:
+		case bar.Id == b.Highlighted:
+			sty = sty.Bold(true)
+		default:
+			sty = sty.Dim(true)
+		}
+		b.flushText(screen, b.pos.StartCol, row, titleWidth, bar.Title, tcell.StyleDefault)
+		barEnd := barStart
+		plot.DrawBar(eighths[i], func(col plot.Column, cell rune) {
+			screen.SetContent(barStart+int(col), row, cell, nil, sty)
+			barEnd = barStart + int(col) + 1
+		})
+		b.flushText(screen, barEnd+1, row, b.pos.StartCol+b.pos.Cols-barEnd-1, values[i], tcell.StyleDefault)
+	}
+}
+
+// label labels a bar with the given value.
+func (b *BarsView) label(value float64) string {
+	if b.ValueLabeler != nil {
+		return b.ValueLabeler(value)
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// flushText writes the given text from the given cell of the screen, cutting it off
+// past the given width.
+func (b *BarsView) flushText(screen tcell.Screen, startCol, row, width int, text string, sty tcell.Style) {
+	col := startCol
+	for _, rn := range text {
+		rnWidth := runewidth.RuneWidth(rn)
+		if col+rnWidth > startCol+width {
+			return
+		}
+		screen.SetContent(col, row, rn, nil, sty)
+		col += rnWidth
+	}
+}
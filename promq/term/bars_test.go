@@ -0,0 +1,85 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package term_test
+
+import (
+	"fmt"
+
+	"github.com/gdamore/tcell"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"sigs.k8s.io/instrumentation-tools/promq/term"
+	"sigs.k8s.io/instrumentation-tools/promq/term/plot"
+)
+
+var _ = Describe("The Bars widget", func() {
+	var bars *term.BarsView
+	BeforeEach(func() {
+		bars = &term.BarsView{
+			Bars: []plot.Bar{
+				{Title: "200", Id: 1, Value: 10},
+				{Title: "500", Id: 2, Value: 5},
+				{Title: "404", Id: 3, Value: 0},
+			},
+			Palette: term.Palette{tcell.ColorRed, tcell.ColorGreen, tcell.ColorBlue},
+		}
+		bars.SetBox(term.PositionBox{Rows: 3, Cols: 20})
+	})
+
+	It("should skip rendering if given zero rows", func() {
+		bars.SetBox(term.PositionBox{Rows: 0, Cols: 20})
+		Expect(bars).To(DisplayLike(20, 1, ""))
+	})
+
+	It("should draw a bar per row, scaled to the longest, with eighths of a cell at their ends", func() {
+		Expect(bars).To(DisplayLike(20, 3,
+			"200 █████████████ 10"+
+				"500 ██████▌ 5       "+
+				"404  0              "))
+	})
+
+	It("should color each bar from the palette", func() {
+		Expect(bars).To(DisplayWithStyle(20, 1,
+			"200 ", tcell.StyleDefault,
+			"█████████████", tcell.StyleDefault.Foreground(tcell.ColorGreen),
+			" 10", tcell.StyleDefault))
+	})
+
+	It("should cut off long titles at a third of the width, and the bars that don't fit", func() {
+		bars.Bars = []plot.Bar{{Title: "cheddar", Id: 1, Value: 2}, {Title: "brie", Id: 2, Value: 1}}
+		bars.ValueLabeler = func(v float64) string { return fmt.Sprintf("%.0f", v) }
+		bars.SetBox(term.PositionBox{Rows: 1, Cols: 9})
+		Expect(bars).To(DisplayLike(9, 1, "che ███ 2"))
+	})
+
+	It("should dim all but the highlighted bar", func() {
+		bars.Highlighted = plot.SeriesId(1)
+		screen := tcell.NewSimulationScreen("")
+		screen.Init()
+		screen.SetSize(20, 3)
+		bars.FlushTo(screen)
+
+		_, _, sty, _ := screen.GetContent(4, 0)
+		_, _, attrs := sty.Decompose()
+		Expect(attrs & tcell.AttrBold).NotTo(BeZero())
+
+		_, _, sty, _ = screen.GetContent(4, 1)
+		_, _, attrs = sty.Decompose()
+		Expect(attrs & tcell.AttrDim).NotTo(BeZero())
+	})
+})
@@ -17,10 +17,19 @@ limitations under the License.
 package term
 
 import (
-    "sigs.k8s.io/instrumentation-tools/promq/term/plot"
+	"math"
+	"strings"
+
 	"github.com/gdamore/tcell"
+	"sigs.k8s.io/instrumentation-tools/promq/term/plot"
 )
 
+// GraphPoint is a point in the graph's data, as opposed to on the screen.
+type GraphPoint struct {
+	Timestamp int64
+	Value     float64
+}
+
 // GraphView is a widget that displays the given graph with on the screen.  You
 // *must* supply a domain and range labeler.  Default spacings will be chosen
 // for the tick spacing if not specified.
@@ -30,17 +39,60 @@ type GraphView struct {
 	Graph *plot.PlatonicGraph
 
 	DomainLabeler plot.DomainLabeler
-	RangeLabeler plot.RangeLabeler
+	RangeLabeler  plot.RangeLabeler
 
 	DomainTickSpacing int
-	RangeTickSpacing int
+	RangeTickSpacing  int
+
+	// Highlighted, if set, is drawn in bold, with the other series dimmed.
+	Highlighted plot.SeriesId
+
+	// Crosshair, if set, marks the given point, labeled with its time & value.
+	Crosshair *GraphPoint
+
+	// Palette colors the series, the default palette if unset.
+	Palette Palette
+
+	// inner & axes are where the plot itself was drawn, and with what axes,
+	// as of the last flush (so that we can map the screen back to data).
+	inner PositionBox
+	axes  plot.PlatonicAxes
 }
 
 func (g *GraphView) SetBox(box PositionBox) {
 	g.pos = box
 }
 
+// PointAt returns the point in the graph's data shown at the given cell of the
+// screen, as of the last flush.  It returns false if the cell isn't on the plot
+// itself (e.g. it's on an axis).
+func (g *GraphView) PointAt(col, row int) (GraphPoint, bool) {
+	if g.inner.Cols == 0 || g.inner.Rows == 0 {
+		return GraphPoint{}, false
+	}
+	col -= g.inner.StartCol
+	row -= g.inner.StartRow
+	if col < 0 || col >= g.inner.Cols || row < 0 || row >= g.inner.Rows {
+		return GraphPoint{}, false
+	}
+
+	// each cell is several braille dots, so aim for the middle of the cell
+	// (remembering that rows count up from the bottom in the plot)
+	dots := plot.BrailleCellScreenSize(plot.ScreenSize{Cols: plot.Column(g.inner.Cols), Rows: plot.Row(g.inner.Rows)})
+	dotsPerCol, dotsPerRow := int(dots.Cols)/g.inner.Cols, int(dots.Rows)/g.inner.Rows
+	dotCol := float64(col*dotsPerCol) + float64(dotsPerCol-1)/2
+	dotRow := float64((g.inner.Rows-1-row)*dotsPerRow) + float64(dotsPerRow-1)/2
+
+	domainDiff := float64(g.axes.DomainMax - g.axes.DomainMin)
+	rangeDiff := g.axes.RangeMax - g.axes.RangeMin
+	return GraphPoint{
+		Timestamp: g.axes.DomainMin + int64(math.Round(dotCol/float64(dots.Cols-1)*domainDiff)),
+		Value:     g.axes.RangeMin + dotRow/float64(dots.Rows-1)*rangeDiff,
+	}, true
+}
+
 func (g *GraphView) FlushTo(screen tcell.Screen) {
+	g.inner = PositionBox{}
 	if g.Graph == nil {
 		return
 	}
@@ -60,13 +112,13 @@ func (g *GraphView) FlushTo(screen tcell.Screen) {
 	screenSize := plot.ScreenSize{Cols: plot.Column(g.pos.Cols), Rows: plot.Row(g.pos.Rows)}
 	scale := func(p float64) float64 { return p }
 	axes := plot.EvenlySpacedTicks(g.Graph, screenSize, plot.TickScaling{
-		RangeScale: scale,
-		DomainDensity: domainSpacing, 
-		RangeDensity: rangeSpacing,
+		RangeScale:    scale,
+		DomainDensity: domainSpacing,
+		RangeDensity:  rangeSpacing,
 	}, plot.Labeling{
 		DomainLabeler: g.DomainLabeler,
-		RangeLabeler: g.RangeLabeler,
-		LineSize: 1,
+		RangeLabeler:  g.RangeLabeler,
+		LineSize:      1,
 	})
 
 	if axes.InnerGraphSize.Cols == 0 || axes.InnerGraphSize.Rows == 0 {
@@ -104,11 +156,89 @@ func (g *GraphView) FlushTo(screen tcell.Screen) {
 
 	startCol := g.pos.StartCol + int(axes.MarginCols)
 	startRow := g.pos.StartRow
+	g.inner = PositionBox{
+		StartCol: startCol, StartRow: startRow,
+		Cols: int(axes.InnerGraphSize.Cols), Rows: int(axes.InnerGraphSize.Rows),
+	}
+	g.axes = g.Graph.PlatonicAxes
+
+	// the crosshair goes through the empty cells around its point
+	crossCol, crossRow, hasCrosshair := g.crosshairCell(scale, axes.InnerGraphSize)
+	var crossSty tcell.Style
+	crossSty = crossSty.Dim(true)
+
 	plot.DrawBraille(renderedGraph, func(row plot.Row, col plot.Column, contents rune, id plot.SeriesId) {
 		var sty tcell.Style
 		if id != plot.NoSeries {
-			sty = sty.Foreground(tcell.Color(id % 256))
+			sty = sty.Foreground(g.Palette.Color(id))
+			switch {
+			case g.Highlighted == plot.NoSeries:
+			case id == g.Highlighted:
+				sty = sty.Bold(true)
+			default:
+				sty = sty.Dim(true)
+			}
+		} else if hasCrosshair {
+			switch {
+			case int(row) == crossRow && int(col) == crossCol:
+				contents, sty = '┼', crossSty
+			case int(row) == crossRow:
+				contents, sty = '─', crossSty
+			case int(col) == crossCol:
+				contents, sty = '│', crossSty
+			}
 		}
 		screen.SetContent(int(col)+startCol, int(row)+startRow, contents, nil, sty)
 	})
+
+	if hasCrosshair {
+		g.labelCrosshair(screen, crossCol, crossRow)
+	}
+}
+
+// crosshairCell figures out which cell of the plot the crosshair is in, if
+// there's a crosshair and it's on the plot at all.
+func (g *GraphView) crosshairCell(scale plot.RangeScale, size plot.ScreenSize) (col, row int, ok bool) {
+	if g.Crosshair == nil {
+		return 0, 0, false
+	}
+	pt := *g.Crosshair
+	if pt.Timestamp < g.axes.DomainMin || pt.Timestamp > g.axes.DomainMax || pt.Value < g.axes.RangeMin || pt.Value > g.axes.RangeMax {
+		return 0, 0, false
+	}
+
+	dots := plot.BrailleCellScreenSize(size)
+	domain, rng := g.Graph.ScalePlatonicToScreen(scale, dots)
+	dotsPerCol, dotsPerRow := int(dots.Cols)/int(size.Cols), int(dots.Rows)/int(size.Rows)
+	return int(domain(pt.Timestamp)) / dotsPerCol, int(size.Rows) - 1 - int(rng(pt.Value))/dotsPerRow, true
+}
+
+// labelCrosshair writes the crosshair's time & value just above it (or below,
+// if there's no room above), keeping it on the plot.
+func (g *GraphView) labelCrosshair(screen tcell.Screen, col, row int) {
+	pt := *g.Crosshair
+	label := []rune(strings.TrimSpace(g.DomainLabeler(pt.Timestamp)) + " " + strings.TrimSpace(g.RangeLabeler(pt.Value)))
+
+	if row > 0 {
+		row--
+	} else {
+		row++
+	}
+	if row >= g.inner.Rows {
+		return
+	}
+	col++
+	if col+len(label) > g.inner.Cols {
+		col = g.inner.Cols - len(label)
+	}
+	if col < 0 {
+		col = 0
+		label = label[:g.inner.Cols]
+	}
+
+	var sty tcell.Style
+	sty = sty.Reverse(true)
+	for i, rn := range label {
+		screen.SetContent(g.inner.StartCol+col+i, g.inner.StartRow+row, rn, nil, sty)
+	}
 }
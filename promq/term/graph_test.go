@@ -21,6 +21,7 @@ import (
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/gdamore/tcell"
 
 	"sigs.k8s.io/instrumentation-tools/promq/term"
 	"sigs.k8s.io/instrumentation-tools/promq/term/plot"
@@ -178,4 +179,81 @@ var _ = Describe("The Graph widget", func() {
 				" X X X  X "))
 		})
 	})
+
+	Context("when pointed at with the mouse", func() {
+		var (
+			gr *term.GraphView
+			screen tcell.SimulationScreen
+		)
+		BeforeEach(func() {
+			gr = &term.GraphView{
+				Graph: samplePlatonicGraph,
+				DomainLabeler: trivialDomLabeler,
+				RangeLabeler: trivialRngLabeler,
+				DomainTickSpacing: 4,
+				RangeTickSpacing: 3,
+			}
+			gr.SetBox(term.PositionBox{
+				StartRow: 1, StartCol: 2,
+				Rows: 10, Cols: 12,
+			})
+
+			screen = tcell.NewSimulationScreen("")
+			screen.Init()
+			screen.SetSize(15, 13)
+		})
+
+		It("should not know about any points before it's been drawn", func() {
+			_, ok := gr.PointAt(10, 4)
+			Expect(ok).To(BeFalse())
+		})
+
+		It("should map cells on the plot back to points in the data", func() {
+			gr.FlushTo(screen)
+
+			pt, ok := gr.PointAt(10, 4)
+			Expect(ok).To(BeTrue())
+			Expect(pt.Timestamp).To(BeNumerically("~", 10, 1))
+			Expect(pt.Value).To(BeNumerically("~", 4.35, 0.5))
+		})
+
+		It("should not map cells off of the plot, like the axes", func() {
+			gr.FlushTo(screen)
+
+			_, ok := gr.PointAt(5, 4)
+			Expect(ok).To(BeFalse())
+			_, ok = gr.PointAt(10, 8)
+			Expect(ok).To(BeFalse())
+		})
+
+		It("should draw a crosshair through the point it was given", func() {
+			gr.FlushTo(screen)
+			pt, ok := gr.PointAt(10, 4)
+			Expect(ok).To(BeTrue())
+
+			gr.Crosshair = &pt
+			gr.FlushTo(screen)
+
+			center, _, _, _ := screen.GetContent(10, 4)
+			Expect(center).To(Equal('┼'))
+			below, _, _, _ := screen.GetContent(10, 6)
+			Expect(below).To(Equal('│'))
+		})
+
+		It("should dim all but the highlighted series", func() {
+			gr.Highlighted = plot.SeriesId(1)
+			gr.FlushTo(screen)
+
+			_, _, sty, _ := screen.GetContent(7, 4)
+			_, _, attrs := sty.Decompose()
+			Expect(attrs & tcell.AttrBold).NotTo(BeZero())
+
+			gr.Highlighted = plot.SeriesId(2)
+			gr.FlushTo(screen)
+
+			_, _, sty, _ = screen.GetContent(7, 4)
+			_, _, attrs = sty.Decompose()
+			Expect(attrs & tcell.AttrDim).NotTo(BeZero())
+		})
+	})
 })
@@ -0,0 +1,116 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package term
+
+import (
+	"strconv"
+
+	"github.com/gdamore/tcell"
+	"github.com/mattn/go-runewidth"
+
+	"sigs.k8s.io/instrumentation-tools/promq/term/plot"
+)
+
+// HeatmapView is a widget that draws a heatmap, i.e. of the buckets of a
+// histogram over time, as shaded cells, with the upper bound (le) of each row's
+// buckets on the left, and, if it has a DomainLabeler, the first and last times
+// underneath.
+type HeatmapView struct {
+	Heatmap *plot.Heatmap
+	// Color is what the cells are shaded in, the terminal's default if unset.
+	Color tcell.Color
+	// BoundLabeler labels each row with the upper bound of its buckets, as %g
+	// (i.e. +Inf for the last bucket) if unset.
+	BoundLabeler func(float64) string
+	// DomainLabeler labels the times under the heatmap, if set.
+	DomainLabeler func(int64) string
+
+	pos PositionBox
+}
+
+func (h *HeatmapView) SetBox(box PositionBox) {
+	h.pos = box
+}
+
+func (h *HeatmapView) FlushTo(screen tcell.Screen) {
+	if h.pos.Rows == 0 || h.pos.Cols == 0 {
+		// bail, we've effectively been asked not to render
+		return
+	}
+	for row := h.pos.StartRow; row < h.pos.StartRow+h.pos.Rows; row++ {
+		for col := h.pos.StartCol; col < h.pos.StartCol+h.pos.Cols; col++ {
+			screen.SetContent(col, row, ' ', nil, tcell.StyleDefault)
+		}
+	}
+	if h.Heatmap == nil || len(h.Heatmap.Times) == 0 {
+		return
+	}
+
+	// the labels are as wide as the widest bound, whichever buckets share rows,
+	// so that they don't shift about
+	labelWidth := 0
+	for _, bound := range h.Heatmap.Bounds {
+		if width := runewidth.StringWidth(h.boundLabel(bound)); width > labelWidth {
+			labelWidth = width
+		}
+	}
+	gridRows, gridCols := h.pos.Rows, h.pos.Cols-labelWidth-1
+	if h.DomainLabeler != nil {
+		gridRows--
+	}
+	if gridRows <= 0 || gridCols <= 0 {
+		return
+	}
+
+	gridStart := h.pos.StartCol + labelWidth + 1
+	shaded := h.Heatmap.Shade(plot.ScreenSize{Rows: plot.Row(gridRows), Cols: plot.Column(gridCols)})
+	sty := tcell.StyleDefault.Foreground(h.Color)
+	for i, cells := range shaded.Cells {
+		row := h.pos.StartRow + i
+		label := h.boundLabel(shaded.Bounds[i])
+		flushString(screen, gridStart-1-runewidth.StringWidth(label), row, label, tcell.StyleDefault)
+		screen.SetContent(gridStart-1, row, '│', nil, tcell.StyleDefault)
+		for col, cell := range cells {
+			screen.SetContent(gridStart+col, row, cell, nil, sty)
+		}
+	}
+
+	if h.DomainLabeler != nil {
+		row := h.pos.StartRow + len(shaded.Cells)
+		first, last := h.DomainLabeler(h.Heatmap.Times[0]), h.DomainLabeler(h.Heatmap.Times[len(h.Heatmap.Times)-1])
+		flushString(screen, gridStart, row, first, tcell.StyleDefault)
+		if lastStart := h.pos.StartCol + h.pos.Cols - runewidth.StringWidth(last); lastStart > gridStart+runewidth.StringWidth(first) {
+			flushString(screen, lastStart, row, last, tcell.StyleDefault)
+		}
+	}
+}
+
+// boundLabel labels a row with the given upper bound of its buckets.
+func (h *HeatmapView) boundLabel(bound float64) string {
+	if h.BoundLabeler != nil {
+		return h.BoundLabeler(bound)
+	}
+	return strconv.FormatFloat(bound, 'g', -1, 64)
+}
+
+// flushString writes the given string from the given cell of the screen.
+func flushString(screen tcell.Screen, col, row int, str string, sty tcell.Style) {
+	for _, rn := range str {
+		screen.SetContent(col, row, rn, nil, sty)
+		col += runewidth.RuneWidth(rn)
+	}
+}
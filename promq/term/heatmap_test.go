@@ -0,0 +1,63 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package term_test
+
+import (
+	"fmt"
+	"math"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"sigs.k8s.io/instrumentation-tools/promq/term"
+	"sigs.k8s.io/instrumentation-tools/promq/term/plot"
+)
+
+var _ = Describe("The Heatmap widget", func() {
+	var heatmap *term.HeatmapView
+	BeforeEach(func() {
+		heatmap = &term.HeatmapView{
+			Heatmap: &plot.Heatmap{
+				Bounds: []float64{1, 2, math.Inf(1)},
+				Times:  []int64{0, 1},
+				Counts: [][]float64{{4, 0}, {2, 2}, {0, 1}},
+			},
+			DomainLabeler: func(v int64) string { return fmt.Sprintf("%d", v) },
+		}
+		heatmap.SetBox(term.PositionBox{Rows: 4, Cols: 8})
+	})
+
+	It("should skip rendering if given zero rows", func() {
+		heatmap.SetBox(term.PositionBox{Rows: 0, Cols: 8})
+		Expect(heatmap).To(DisplayLike(8, 1, ""))
+	})
+
+	It("should shade a row per bucket, the lowest at the bottom, with the times underneath", func() {
+		Expect(heatmap).To(DisplayLike(8, 4,
+			"+Inf│  ░"+
+				"   2│▒▒▒"+
+				"   1│██ "+
+				"     0 1"))
+	})
+
+	It("should add up the buckets which share a row, labelled with the highest's bound", func() {
+		heatmap.SetBox(term.PositionBox{Rows: 2, Cols: 8})
+		Expect(heatmap).To(DisplayLike(8, 2,
+			"+Inf│██▒"+
+				"     0 1"))
+	})
+})
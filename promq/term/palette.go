@@ -0,0 +1,130 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package term
+
+import (
+	"sort"
+
+	"github.com/gdamore/tcell"
+
+	"sigs.k8s.io/instrumentation-tools/promq/term/plot"
+)
+
+// Palette is the colors series are drawn in.  A series is always drawn in the
+// same color, picked by its id (which is a hash of its labels), so that it
+// keeps its color from one refresh to the next.  Ranked hands the colors out
+// to the series charted instead, so that they don't share them.
+type Palette []tcell.Color
+
+// Color returns the color of the given series.  An empty palette is the
+// default one.
+func (p Palette) Color(id plot.SeriesId) tcell.Color {
+	if len(p) == 0 {
+		p = DefaultPalette
+	}
+	return p[int(id)%len(p)]
+}
+
+// Ranked is the palette with its colors handed out to the given series in
+// order, i.e. sorted by their labels, so that no two of them share a color
+// until there are more of them than colors.  The ones after that get the
+// color of their id, as they would from the palette itself.
+func (p Palette) Ranked(ids []plot.SeriesId) Palette {
+	if len(p) == 0 {
+		p = DefaultPalette
+	}
+	// indexed by id, so that Color picks out the color each was handed
+	size := len(p)
+	for _, id := range ids {
+		if int(id) >= size {
+			size = int(id) + 1
+		}
+	}
+	ranked := make(Palette, size)
+	for i := range ranked {
+		ranked[i] = p[i%len(p)]
+	}
+	assigned := map[plot.SeriesId]bool{}
+	for rank, id := range ids {
+		if rank >= len(p) {
+			break
+		}
+		if !assigned[id] {
+			ranked[id], assigned[id] = p[rank], true
+		}
+	}
+	return ranked
+}
+
+var (
+	// DefaultPalette is colors which are easy to tell apart on a dark
+	// background.
+	DefaultPalette = Palette{
+		tcell.ColorDodgerBlue,
+		tcell.ColorOrange,
+		tcell.ColorLimeGreen,
+		tcell.ColorMediumOrchid,
+		tcell.ColorGold,
+		tcell.ColorDeepPink,
+		tcell.ColorTurquoise,
+		tcell.ColorTomato,
+		tcell.ColorYellowGreen,
+		tcell.ColorSlateBlue,
+	}
+
+	// HighContrastPalette is just the brightest colors, for washed out
+	// terminals and projectors.
+	HighContrastPalette = Palette{
+		tcell.ColorYellow,
+		tcell.ColorAqua,
+		tcell.ColorFuchsia,
+		tcell.ColorLime,
+		tcell.ColorRed,
+		tcell.ColorWhite,
+	}
+
+	// ColorblindPalette is the Okabe-Ito palette, which can be told apart with
+	// the common kinds of colorblindness (with grey rather than black, for dark
+	// backgrounds).
+	ColorblindPalette = Palette{
+		tcell.NewHexColor(0xE69F00), // orange
+		tcell.NewHexColor(0x56B4E9), // sky blue
+		tcell.NewHexColor(0x009E73), // bluish green
+		tcell.NewHexColor(0xF0E442), // yellow
+		tcell.NewHexColor(0x0072B2), // blue
+		tcell.NewHexColor(0xD55E00), // vermillion
+		tcell.NewHexColor(0xCC79A7), // reddish purple
+		tcell.NewHexColor(0x999999), // grey
+	}
+)
+
+// Palettes are the palettes there are, by name, i.e. for a flag.
+var Palettes = map[string]Palette{
+	"default":       DefaultPalette,
+	"high-contrast": HighContrastPalette,
+	"colorblind":    ColorblindPalette,
+}
+
+// PaletteNames lists the names of the palettes there are, sorted.
+func PaletteNames() []string {
+	names := make([]string, 0, len(Palettes))
+	for name := range Palettes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
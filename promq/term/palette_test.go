@@ -0,0 +1,62 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package term_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"sigs.k8s.io/instrumentation-tools/promq/term"
+	"sigs.k8s.io/instrumentation-tools/promq/term/plot"
+)
+
+var _ = Describe("Palettes", func() {
+	It("should always give a series the same color", func() {
+		for _, name := range term.PaletteNames() {
+			palette := term.Palettes[name]
+			Expect(palette.Color(plot.SeriesId(42))).To(Equal(palette.Color(plot.SeriesId(42))), name)
+			Expect(palette).To(ContainElement(palette.Color(plot.SeriesId(42))), name)
+		}
+	})
+
+	It("should give consecutive series different colors", func() {
+		palette := term.ColorblindPalette
+		Expect(palette.Color(plot.SeriesId(1))).NotTo(Equal(palette.Color(plot.SeriesId(2))))
+	})
+
+	It("should hand out its colors to the series charted, in order", func() {
+		palette := term.HighContrastPalette
+		// 1 and 7 would share a color by their ids
+		ranked := palette.Ranked([]plot.SeriesId{7, 1, 200})
+		Expect(ranked.Color(plot.SeriesId(7))).To(Equal(palette[0]))
+		Expect(ranked.Color(plot.SeriesId(1))).To(Equal(palette[1]))
+		Expect(ranked.Color(plot.SeriesId(200))).To(Equal(palette[2]))
+	})
+
+	It("should fall back to the colors of their ids past the size of the palette", func() {
+		palette := term.HighContrastPalette
+		ids := []plot.SeriesId{10, 11, 12, 13, 14, 15, 16, 17}
+		ranked := palette.Ranked(ids)
+		Expect(ranked.Color(plot.SeriesId(10))).To(Equal(palette[0]))
+		Expect(ranked.Color(plot.SeriesId(17))).To(Equal(palette.Color(plot.SeriesId(17))))
+	})
+
+	It("should fall back to the default palette when empty", func() {
+		var palette term.Palette
+		Expect(palette.Color(plot.SeriesId(3))).To(Equal(term.DefaultPalette.Color(plot.SeriesId(3))))
+	})
+})
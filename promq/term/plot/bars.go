@@ -0,0 +1,92 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plot
+
+import (
+	"math"
+)
+
+// barCellEighths is how finely a bar's end is drawn, in the eighths of a cell the
+// block elements can fill.
+const barCellEighths = 8
+
+// partialBlocks fill the left eighths of a cell, from none of them to all.
+var partialBlocks = [barCellEighths + 1]rune{' ', '▏', '▎', '▍', '▌', '▋', '▊', '▉', '█'}
+
+// Bar is a single value, i.e. a series of an instant vector, drawn as a bar of a
+// bar chart.
+type Bar struct {
+	Title string
+	Id    SeriesId
+	Value float64
+}
+
+// DataToBars makes a bar of the latest value of each of the given series, i.e.
+// the only value of the series of an instant vector, in the same order.  Series
+// without any points are left out.
+func DataToBars(seriesSet SeriesSet) []Bar {
+	bars := make([]Bar, 0, len(seriesSet))
+	for _, series := range seriesSet {
+		summary, ok := Summarize(series)
+		if !ok {
+			continue
+		}
+		bars = append(bars, Bar{Title: series.Title(), Id: series.Id(), Value: summary.Current})
+	}
+	return bars
+}
+
+// BarEighths is how many eighths of a cell each of the given bars reaches across
+// the given number of cells, scaled so that the longest fills them.  Bars of
+// values that aren't positive and finite aren't drawn at all.
+func BarEighths(bars []Bar, cells int) []int {
+	longest := 0.0
+	for _, bar := range bars {
+		if drawable(bar.Value) && bar.Value > longest {
+			longest = bar.Value
+		}
+	}
+	eighths := make([]int, len(bars))
+	if longest == 0 || cells <= 0 {
+		return eighths
+	}
+	for i, bar := range bars {
+		if drawable(bar.Value) {
+			eighths[i] = int(math.Round(bar.Value / longest * float64(cells*barCellEighths)))
+		}
+	}
+	return eighths
+}
+
+// drawable is whether a bar can be drawn for the given value.
+func drawable(value float64) bool {
+	return value > 0 && !math.IsInf(value, 1)
+}
+
+// DrawBar draws a bar reaching the given number of eighths of a cell, as whole
+// blocks and then the partial one at its end, calling output for each cell it
+// covers.
+func DrawBar(eighths int, output func(col Column, cell rune)) {
+	col := Column(0)
+	for ; eighths >= barCellEighths; eighths -= barCellEighths {
+		output(col, partialBlocks[barCellEighths])
+		col++
+	}
+	if eighths > 0 {
+		output(col, partialBlocks[eighths])
+	}
+}
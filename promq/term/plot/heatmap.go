@@ -0,0 +1,104 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plot
+
+import (
+	"math"
+)
+
+// heatShades shade a cell of a heatmap, from the emptiest to the fullest.
+var heatShades = []rune{' ', '░', '▒', '▓', '█'}
+
+// Heatmap is the buckets of a histogram over time, i.e. the _bucket series of a
+// classic histogram, to draw as a grid of shaded cells, a row per bucket and a
+// column per time.
+type Heatmap struct {
+	// Bounds are the upper bounds (i.e. the le labels) of the buckets, ascending.
+	Bounds []float64
+	// Times are when the buckets were counted, ascending.
+	Times []int64
+	// Counts are how many observations fell in each bucket, and not the ones
+	// below it, at each time, indexed by bucket and then time.
+	Counts [][]float64
+}
+
+// ShadedHeatmap is a heatmap laid out on a screen.
+type ShadedHeatmap struct {
+	// Cells are the shades of each cell, from the top row down.
+	Cells [][]rune
+	// Bounds are the upper bound of the buckets of each row, from the top row down.
+	Bounds []float64
+}
+
+// Shade lays the heatmap out over the given number of rows and columns, the
+// lowest bucket at the bottom and the earliest time on the left, shading each
+// cell by how many observations it has compared to the fullest cell.  When there
+// are more buckets than rows, neighbouring buckets share a row, and are added
+// up.  Times are spread out, or skipped, to fit the columns.
+func (h *Heatmap) Shade(size ScreenSize) ShadedHeatmap {
+	rows, cols := int(size.Rows), int(size.Cols)
+	if rows > len(h.Bounds) {
+		rows = len(h.Bounds)
+	}
+	if rows <= 0 || cols <= 0 || len(h.Times) == 0 {
+		return ShadedHeatmap{}
+	}
+
+	// add up the buckets sharing each row, bottom up, and pick a time per column
+	counts := make([][]float64, rows)
+	bounds := make([]float64, rows)
+	fullest := 0.0
+	for row := range counts {
+		firstBucket, lastBucket := row*len(h.Bounds)/rows, (row+1)*len(h.Bounds)/rows-1
+		bounds[row] = h.Bounds[lastBucket]
+		counts[row] = make([]float64, cols)
+		for col := range counts[row] {
+			at := col * len(h.Times) / cols
+			for bucket := firstBucket; bucket <= lastBucket; bucket++ {
+				if bucket < len(h.Counts) && at < len(h.Counts[bucket]) && !math.IsNaN(h.Counts[bucket][at]) {
+					counts[row][col] += h.Counts[bucket][at]
+				}
+			}
+			fullest = math.Max(fullest, counts[row][col])
+		}
+	}
+
+	shaded := ShadedHeatmap{Cells: make([][]rune, rows), Bounds: make([]float64, rows)}
+	for row := range counts {
+		// flip it, so that the lowest bucket is at the bottom
+		screenRow := rows - 1 - row
+		shaded.Bounds[screenRow] = bounds[row]
+		shaded.Cells[screenRow] = make([]rune, cols)
+		for col, count := range counts[row] {
+			shaded.Cells[screenRow][col] = heatShade(count, fullest)
+		}
+	}
+	return shaded
+}
+
+// heatShade shades a cell with the given count, compared to the fullest cell's.
+// Any count at all gets at least the lightest shade.
+func heatShade(count, fullest float64) rune {
+	if count <= 0 || fullest <= 0 {
+		return heatShades[0]
+	}
+	shade := int(math.Ceil(count / fullest * float64(len(heatShades)-1)))
+	if shade >= len(heatShades) {
+		shade = len(heatShades) - 1
+	}
+	return heatShades[shade]
+}
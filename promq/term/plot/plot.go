@@ -21,13 +21,14 @@ import (
 )
 
 const (
-	brailleCellWidth = 2
-	brailleCellHeight = 4
-	brailleCellPositions = brailleCellWidth*brailleCellHeight
+	brailleCellWidth     = 2
+	brailleCellHeight    = 4
+	brailleCellPositions = brailleCellWidth * brailleCellHeight
 )
 
 // SeriesId identifies some series.  The zero value is reserved for unset.
 type SeriesId uint16
+
 const NoSeries = SeriesId(0)
 
 type SeriesSet []Series
@@ -51,22 +52,62 @@ type Series interface {
 	Points() []Point
 }
 
+// Summary sums up the values of a series' points: its current (i.e. latest)
+// value, and its min, max and average. NaNs are left out of the min, max and
+// average, which are NaN if there's nothing else.
+type Summary struct {
+	Current, Min, Max, Avg float64
+}
+
+// Summarize sums up the values of the given series' points, returning false if
+// it doesn't have any.
+func Summarize(series Series) (Summary, bool) {
+	points := series.Points()
+	if len(points) == 0 {
+		return Summary{}, false
+	}
+	summary := Summary{
+		Current: points[len(points)-1].Y(),
+		Min:     math.Inf(1),
+		Max:     math.Inf(-1),
+	}
+	var sum float64
+	var count int
+	for _, pt := range points {
+		y := pt.Y()
+		if math.IsNaN(y) {
+			continue
+		}
+		summary.Min = math.Min(summary.Min, y)
+		summary.Max = math.Max(summary.Max, y)
+		sum += y
+		count++
+	}
+	if count == 0 {
+		summary.Min, summary.Max, summary.Avg = math.NaN(), math.NaN(), math.NaN()
+	} else {
+		summary.Avg = sum / float64(count)
+	}
+	return summary, true
+}
+
 // RangeScale maps a platonic range to another platonic range.
 // Use it to do stuff like apply log scales
 type RangeScale func(float64) float64
 
 type PlatonicAxes struct {
 	DomainMin, DomainMax int64
-	RangeMin, RangeMax float64
+	RangeMin, RangeMax   float64
 }
+
 func AutoAxes() PlatonicAxes {
 	return PlatonicAxes{
 		// NB(sollyross): Min gets set to Max, and vice versa, so that
 		// anything is automatically less/more (respectively) than them.
 		DomainMin: math.MaxInt64,
 		DomainMax: math.MinInt64,
-		RangeMin: math.Inf(1),
-		RangeMax: math.Inf(-1),
+		RangeMin:  math.Inf(1),
+		RangeMax:  math.Inf(-1),
 	}
 }
 func (a PlatonicAxes) WithPreviousRange(oldAxes PlatonicAxes) PlatonicAxes {
@@ -84,7 +125,7 @@ type PlatonicGraph struct {
 
 func DataToPlatonicGraph(seriesSet SeriesSet, baseAxes PlatonicAxes) *PlatonicGraph {
 	res := &PlatonicGraph{
-		Series: seriesSet,
+		Series:       seriesSet,
 		PlatonicAxes: baseAxes,
 	}
 
@@ -129,15 +170,15 @@ func (g PlatonicGraph) ScalePlatonicToScreen(scale RangeScale, size ScreenSize)
 	if rangeDiff == 0 {
 		rangeDiff = 1
 	}
-	domainScaleFactor := float64(size.Cols-1)/float64(domainDiff)
-	rangeScaleFactor := float64(size.Rows-1)/float64(rangeDiff)
+	domainScaleFactor := float64(size.Cols-1) / float64(domainDiff)
+	rangeScaleFactor := float64(size.Rows-1) / float64(rangeDiff)
 
 	// TODO: is this rounding necessary for most data?
 	domain := func(x int64) Column {
-		return Column(math.Round(float64(x-g.DomainMin)*domainScaleFactor))
+		return Column(math.Round(float64(x-g.DomainMin) * domainScaleFactor))
 	}
 	rng := func(y float64) Row {
-		return Row(math.Round(float64(scale(y-g.RangeMin))*rangeScaleFactor))
+		return Row(math.Round(float64(scale(y-g.RangeMin)) * rangeScaleFactor))
 	}
 
 	return domain, rng
@@ -147,7 +188,6 @@ func (g *PlatonicGraph) ToScreen(scale RangeScale, size ScreenSize) *ScreenGraph
 	// first, figure out our scaling functions
 	domain, rng := g.ScalePlatonicToScreen(scale, size)
 
-
 	// then, figure out our points -- map the X and Y for each point, figure
 	// out if the X falls into the last X bucket (in which case take the
 	// average)
@@ -174,7 +214,7 @@ func (g *PlatonicGraph) ToScreen(scale RangeScale, size ScreenSize) *ScreenGraph
 
 				// if we were accumulating, do the final averaging
 				if len(lastPt.OriginalPoints) > 1 {
-					lastPt.Row /= Row(len(lastPt.OriginalPoints))  // WHY? WHY CAN'T GO'S TYPE SYSTEM UNDERSTAND THE EXISTENCE OF UNITLESS TYPES?
+					lastPt.Row /= Row(len(lastPt.OriginalPoints)) // WHY? WHY CAN'T GO'S TYPE SYSTEM UNDERSTAND THE EXISTENCE OF UNITLESS TYPES?
 				}
 			}
 
@@ -190,14 +230,13 @@ func (g *PlatonicGraph) ToScreen(scale RangeScale, size ScreenSize) *ScreenGraph
 		}
 
 		outSeries[i] = ScreenSeries{
-			Id: inSeries.Id(),
+			Id:     inSeries.Id(),
 			Points: pts,
 		}
 	}
 
-
 	return &ScreenGraph{
-		Series: outSeries,
+		Series:     outSeries,
 		ScreenSize: size,
 	}
 }
@@ -222,7 +261,7 @@ type PixelPoint struct {
 
 type ScreenSeries struct {
 	Points []PixelPoint
-	Id SeriesId
+	Id     SeriesId
 }
 
 type ScreenGraph struct {
@@ -239,7 +278,7 @@ type ScreenSize struct {
 type Cell struct {
 	// common path doesn't need to allocate a slice
 	IsPoint bool
-	Series SeriesId
+	Series  SeriesId
 
 	MoreSeries []SeriesId
 }
@@ -260,8 +299,8 @@ func (g *RenderedGraph) setCell(row Row, col Column, isPoint bool, series Series
 
 func (s *ScreenGraph) Render(subCellMapper SubCellMapper) *RenderedGraph {
 	res := &RenderedGraph{
-		ScreenSize: s.ScreenSize,
-		Cells: make([]Cell, int(s.Rows)*int(s.Cols)),
+		ScreenSize:    s.ScreenSize,
+		Cells:         make([]Cell, int(s.Rows)*int(s.Cols)),
 		SubCellMapper: subCellMapper,
 	}
 
@@ -290,7 +329,7 @@ func (s *ScreenGraph) Render(subCellMapper SubCellMapper) *RenderedGraph {
 			// more-or-less
 			row, col := lastPt.Row, lastPt.Col
 			if math.Abs(run) > math.Abs(rise) {
-				slope := rise/run
+				slope := rise / run
 				slopeErr := 0.0
 				var riseInc Row
 				if slope > 0 {
@@ -308,7 +347,7 @@ func (s *ScreenGraph) Render(subCellMapper SubCellMapper) *RenderedGraph {
 					}
 				}
 			} else {
-				slope := run/rise
+				slope := run / rise
 				slopeErr := 0.0
 				var runInc Column
 				if slope > 0 {
@@ -355,15 +394,16 @@ type RenderedGraph struct {
 const (
 	brailleBlockStart = '\u2800'
 )
+
 // brailleMap maps a column-wise layout to the above braille block layout.
-var brailleMap = [8]rune{1<<0, 1<<1, 1<<2, 1<<6, 1<<3, 1<<4, 1<<5, 1<<7}
+var brailleMap = [8]rune{1 << 0, 1 << 1, 1 << 2, 1 << 6, 1 << 3, 1 << 4, 1 << 5, 1 << 7}
 
 func DrawBraille(graph *RenderedGraph, output func(row Row, col Column, cell rune, id SeriesId)) {
 	currRow := Row(-1)
 	currCol := Column(0)
 	screenCols := int(graph.Cols) / brailleCellWidth
 	for chunkStart := 0; chunkStart < len(graph.Cells); chunkStart += brailleCellPositions {
-		if (chunkStart/brailleCellPositions) % screenCols == 0 {
+		if (chunkStart/brailleCellPositions)%screenCols == 0 {
 			currRow++
 			currCol = 0
 		} else {
@@ -404,17 +444,17 @@ func BrailleCellMapper(row Row, col Column, size ScreenSize) int {
 	row = size.Rows - 1 - row
 
 	// find the chunk (row-wise)
-	chunkRow := int(row/brailleCellHeight)
-	chunkCol := int(col/brailleCellWidth)
-	chunkStart := (chunkRow*(int(size.Cols)/brailleCellWidth)+chunkCol)*brailleCellPositions
+	chunkRow := int(row / brailleCellHeight)
+	chunkCol := int(col / brailleCellWidth)
+	chunkStart := (chunkRow*(int(size.Cols)/brailleCellWidth) + chunkCol) * brailleCellPositions
 
 	// find the position in the chunk (column-wise)
-	intraChunkRow := int(row%brailleCellHeight)
-	intraChunkCol := int(col%brailleCellWidth)
-	intraChunkPos := intraChunkCol*brailleCellHeight+intraChunkRow
+	intraChunkRow := int(row % brailleCellHeight)
+	intraChunkCol := int(col % brailleCellWidth)
+	intraChunkPos := intraChunkCol*brailleCellHeight + intraChunkRow
 
 	// compute the index
-	return chunkStart+intraChunkPos
+	return chunkStart + intraChunkPos
 }
 
 func BrailleCellScreenSize(termSize ScreenSize) ScreenSize {
@@ -0,0 +1,71 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plot
+
+import (
+	"math"
+	"testing"
+)
+
+type testPoint struct {
+	x int64
+	y float64
+}
+
+func (p testPoint) X() int64   { return p.x }
+func (p testPoint) Y() float64 { return p.y }
+
+type testSeries []float64
+
+func (s testSeries) Title() string { return "test" }
+func (s testSeries) Id() SeriesId  { return 1 }
+func (s testSeries) Points() []Point {
+	points := make([]Point, len(s))
+	for i, y := range s {
+		points[i] = testPoint{x: int64(i), y: y}
+	}
+	return points
+}
+
+func TestSummarize(t *testing.T) {
+	nan := math.NaN()
+	tests := []struct {
+		name   string
+		series testSeries
+		want   Summary
+		wantOk bool
+	}{
+		{name: "no points", series: nil, wantOk: false},
+		{name: "only NaNs", series: testSeries{nan, nan}, want: Summary{Current: nan, Min: nan, Max: nan, Avg: nan}, wantOk: true},
+		{name: "some NaNs", series: testSeries{2, nan, 4, 0, nan}, want: Summary{Current: nan, Min: 0, Max: 4, Avg: 2}, wantOk: true},
+		{name: "no NaNs", series: testSeries{3, -1, 7}, want: Summary{Current: 7, Min: -1, Max: 7, Avg: 3}, wantOk: true},
+	}
+	same := func(a, b float64) bool {
+		return a == b || math.IsNaN(a) && math.IsNaN(b)
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, ok := Summarize(test.series)
+			if ok != test.wantOk {
+				t.Fatalf("got ok %v, want %v", ok, test.wantOk)
+			}
+			if !same(got.Current, test.want.Current) || !same(got.Min, test.want.Min) || !same(got.Max, test.want.Max) || !same(got.Avg, test.want.Avg) {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
@@ -45,6 +45,7 @@ type View interface {
 // - "Update" events populate a new view and redraw
 // - "Repaint" events repain the current view
 // - "Key" events get sent to the KeyHandler
+// - "Mouse" events get sent to the MouseHandler, if any
 //
 // It's expected that a separate goroutine will receive key events, construct a new
 // view based on their operation or based on outside events (like timers for animation,
@@ -56,6 +57,10 @@ type Runner struct {
 
 	// KeyHandler receives key events produced during Run.  It must be specified.
 	KeyHandler func(*tcell.EventKey)
+
+	// MouseHandler receives mouse events (clicks, the scroll wheel, etc)
+	// produced during Run.  The mouse is only enabled if this is specified.
+	MouseHandler func(*tcell.EventMouse)
 	
 	// MakeScreen allows custom screens to be used.  Mainly useful for testing.
 	// Most cases can use the default value.
@@ -86,6 +91,9 @@ func (r *Runner) Run(ctx context.Context, initialView View) error {
 		}
 	}
 	screen.Init()
+	if r.MouseHandler != nil {
+		screen.EnableMouse()
+	}
 	// TODO(directxman12): we should probably figure out how to call Fini in a
 	// defer but before the waiting for the evtLoopDone
 
@@ -113,6 +121,11 @@ func (r *Runner) Run(ctx context.Context, initialView View) error {
 			case *tcell.EventKey:
 				r.KeyHandler(evt)
 				continue
+			case *tcell.EventMouse:
+				if r.MouseHandler != nil {
+					r.MouseHandler(evt)
+				}
+				continue
 			case *tcell.EventInterrupt:
 				newView, hasNewView := evt.Data().(View)
 				if hasNewView {
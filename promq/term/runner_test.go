@@ -106,6 +106,7 @@ var _ = Describe("The overall Runner", func() {
 		screen *threadSafeishScreen
 		cancel context.CancelFunc
 		keys chan *tcell.EventKey
+		mice chan *tcell.EventMouse
 		done chan struct{}
 		runner *term.Runner
 		mainView *oneRuneView = &oneRuneView{}
@@ -120,7 +121,9 @@ var _ = Describe("The overall Runner", func() {
 
 		startedCh := make(chan struct{})
 		keys = make(chan *tcell.EventKey, 10 /* some buffer to avoid blocking */)
+		mice = make(chan *tcell.EventMouse, 10)
 		localKeys := keys // avoid racing on shutdown, etc
+		localMice := mice
 		runner = &term.Runner{
 			MakeScreen: func() (tcell.Screen, error) {
 				return screen, nil
@@ -128,6 +131,9 @@ var _ = Describe("The overall Runner", func() {
 			KeyHandler: func(key *tcell.EventKey) {
 				localKeys <- key
 			},
+			MouseHandler: func(mouse *tcell.EventMouse) {
+				localMice <- mouse
+			},
 			OnStart: func() {
 				close(startedCh)
 			},
@@ -177,6 +183,21 @@ var _ = Describe("The overall Runner", func() {
 		})
 	})
 
+	Context("when receiving mouse events", func() {
+		It("should dispatch mouse events to the mouse handler", func() {
+			screen.InjectMouse(3, 4, tcell.Button1, tcell.ModNone)
+			screen.InjectMouse(5, 6, tcell.WheelUp, tcell.ModNone)
+
+			Eventually(mice).Should(Receive(SatisfyAll(
+				WithTransform(func(mouse *tcell.EventMouse) tcell.ButtonMask { return mouse.Buttons() }, Equal(tcell.Button1)),
+				WithTransform(func(mouse *tcell.EventMouse) []int { col, row := mouse.Position(); return []int{col, row} }, Equal([]int{3, 4})),
+			)))
+			Eventually(mice).Should(Receive(
+				WithTransform(func(mouse *tcell.EventMouse) tcell.ButtonMask { return mouse.Buttons() }, Equal(tcell.WheelUp)),
+			))
+		})
+	})
+
 	It("should switch views when sent a new view", func() {
 		Expect(screen).To(DisplayLike(10, 10, "*"))
 
@@ -0,0 +1,227 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package term
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gdamore/tcell"
+	"github.com/mattn/go-runewidth"
+)
+
+const (
+	// tableGap is the space between the columns of a table.
+	tableGap = 2
+	// sortMarkerWidth is the room left after each header for the marker that
+	// says the table's sorted by that column.
+	sortMarkerWidth = 2
+)
+
+// TableView is a widget that displays rows of text under a header, in columns
+// as wide as their contents.  It can be scrolled, and sorted by any of its
+// columns (numerically, or by duration, if both cells being compared are
+// numbers or durations).  If the columns are too wide, the last ones get cut off.
+type TableView struct {
+	// Header names the columns.  It stays put when the rows are scrolled.
+	Header []string
+	// Rows are the cells of each row, a cell per column of the header.
+	Rows [][]string
+
+	// SortColumn is the column the rows are sorted by.
+	SortColumn int
+	// SortDescending sorts the rows the other way around.
+	SortDescending bool
+	// Scroll is how many rows are scrolled off the top.  Scrolling past the
+	// last row just shows the last rows.
+	Scroll int
+
+	// widths are how wide each column was as of the last flush
+	widths []int
+
+	pos PositionBox
+}
+
+func (t *TableView) SetBox(box PositionBox) {
+	t.pos = box
+}
+
+// ScrollBy scrolls the rows down by the given number of rows (up, if
+// negative).
+func (t *TableView) ScrollBy(rows int) {
+	t.Scroll = t.clampScroll(t.Scroll + rows)
+}
+
+// SortBy sorts the rows by the given column, or if they're already sorted by
+// it, sorts them the other way around.
+func (t *TableView) SortBy(col int) {
+	if col == t.SortColumn {
+		t.SortDescending = !t.SortDescending
+		return
+	}
+	t.SortColumn = col
+	t.SortDescending = false
+}
+
+// ColumnAt returns the column whose header is at the given cell of the
+// screen, as of the last flush, or false if there's no header there.
+func (t *TableView) ColumnAt(col, row int) (int, bool) {
+	if row != t.pos.StartRow || col < t.pos.StartCol || col >= t.pos.StartCol+t.pos.Cols {
+		return 0, false
+	}
+	start := t.pos.StartCol
+	for i, width := range t.widths {
+		if col < start+width {
+			return i, true
+		}
+		start += width + tableGap
+		if col < start {
+			// in the gap between columns
+			return 0, false
+		}
+	}
+	return 0, false
+}
+
+func (t *TableView) FlushTo(screen tcell.Screen) {
+	if t.pos.Rows == 0 || t.pos.Cols == 0 {
+		// bail, we've effectively been asked not to render
+		return
+	}
+
+	t.widths = make([]int, len(t.Header))
+	for i, name := range t.Header {
+		t.widths[i] = runewidth.StringWidth(name) + sortMarkerWidth
+	}
+	for _, row := range t.Rows {
+		for i, cell := range row {
+			if i < len(t.widths) && runewidth.StringWidth(cell) > t.widths[i] {
+				t.widths[i] = runewidth.StringWidth(cell)
+			}
+		}
+	}
+
+	header := make([]string, len(t.Header))
+	copy(header, t.Header)
+	if t.SortColumn >= 0 && t.SortColumn < len(header) {
+		if t.SortDescending {
+			header[t.SortColumn] += " ▼"
+		} else {
+			header[t.SortColumn] += " ▲"
+		}
+	}
+	t.flushRow(screen, 0, header, tcell.StyleDefault.Bold(true))
+
+	scroll := t.clampScroll(t.Scroll)
+	rows := t.sorted()
+	for i := 1; i < t.pos.Rows; i++ {
+		var row []string
+		if ind := scroll + i - 1; ind < len(rows) {
+			row = rows[ind]
+		}
+		t.flushRow(screen, i, row, tcell.StyleDefault)
+	}
+}
+
+// flushRow writes the given cells on the given row of our box, blanking
+// whatever else was there.
+func (t *TableView) flushRow(screen tcell.Screen, row int, cells []string, sty tcell.Style) {
+	screenRow := t.pos.StartRow + row
+	endCol := t.pos.StartCol + t.pos.Cols
+	for col := t.pos.StartCol; col < endCol; col++ {
+		screen.SetContent(col, screenRow, ' ', nil, tcell.StyleDefault)
+	}
+
+	col := t.pos.StartCol
+	for i, width := range t.widths {
+		if i >= len(cells) || col >= endCol {
+			return
+		}
+		cellCol := col
+		for _, rn := range cells[i] {
+			rnWidth := runewidth.RuneWidth(rn)
+			if cellCol+rnWidth > col+width || cellCol+rnWidth > endCol {
+				break
+			}
+			screen.SetContent(cellCol, screenRow, rn, nil, sty)
+			cellCol += rnWidth
+		}
+		col += width + tableGap
+	}
+}
+
+// clampScroll keeps the given scroll from going past the last row, or before
+// the first.
+func (t *TableView) clampScroll(scroll int) int {
+	// the header takes up a row
+	if maxScroll := len(t.Rows) - (t.pos.Rows - 1); scroll > maxScroll {
+		scroll = maxScroll
+	}
+	if scroll < 0 {
+		scroll = 0
+	}
+	return scroll
+}
+
+// sorted returns the rows, sorted by the sort column.
+func (t *TableView) sorted() [][]string {
+	rows := make([][]string, len(t.Rows))
+	copy(rows, t.Rows)
+	cell := func(row []string) string {
+		if t.SortColumn < 0 || t.SortColumn >= len(row) {
+			return ""
+		}
+		return row[t.SortColumn]
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		if t.SortDescending {
+			return compareCells(cell(rows[j]), cell(rows[i])) < 0
+		}
+		return compareCells(cell(rows[i]), cell(rows[j])) < 0
+	})
+	return rows
+}
+
+// compareCells compares two cells as numbers, or as durations, if they both
+// are, and otherwise as text, returning a negative number if a comes first, a
+// positive one if b does, and zero if neither does.
+func compareCells(a, b string) int {
+	if x, err := strconv.ParseFloat(a, 64); err == nil {
+		if y, err := strconv.ParseFloat(b, 64); err == nil {
+			return compareFloats(x, y)
+		}
+	}
+	if x, err := time.ParseDuration(a); err == nil {
+		if y, err := time.ParseDuration(b); err == nil {
+			return compareFloats(float64(x), float64(y))
+		}
+	}
+	return strings.Compare(a, b)
+}
+
+func compareFloats(x, y float64) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	default:
+		return 0
+	}
+}
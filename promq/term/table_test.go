@@ -0,0 +1,104 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package term_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"sigs.k8s.io/instrumentation-tools/promq/term"
+)
+
+var _ = Describe("The Table widget", func() {
+	var table *term.TableView
+	BeforeEach(func() {
+		table = &term.TableView{
+			Header: []string{"NAME", "VALUE"},
+			Rows: [][]string{
+				{"b", "10"},
+				{"a", "9"},
+				{"c", "100"},
+			},
+		}
+		table.SetBox(term.PositionBox{Rows: 3, Cols: 16})
+	})
+
+	It("should skip rendering if given zero rows", func() {
+		table.SetBox(term.PositionBox{Rows: 0, Cols: 16})
+		Expect(table).To(DisplayLike(16, 1, ""))
+	})
+
+	It("should lay out the rows in columns under the header, sorted by the first column", func() {
+		Expect(table).To(DisplayLike(16, 3,
+			"NAME ▲  VALUE   "+
+				"a       9       "+
+				"b       10      "))
+	})
+
+	It("should sort numbers as numbers, and the other way around when sorted again", func() {
+		table.SortBy(1)
+		Expect(table).To(DisplayLike(16, 3,
+			"NAME    VALUE ▲ "+
+				"a       9       "+
+				"b       10      "))
+
+		table.SortBy(1)
+		Expect(table).To(DisplayLike(16, 3,
+			"NAME    VALUE ▼ "+
+				"c       100     "+
+				"b       10      "))
+	})
+
+	It("should scroll the rows but not the header, and not past the last row", func() {
+		table.ScrollBy(5)
+		Expect(table).To(DisplayLike(16, 3,
+			"NAME ▲  VALUE   "+
+				"b       10      "+
+				"c       100     "))
+
+		table.ScrollBy(-5)
+		Expect(table).To(DisplayLike(16, 3,
+			"NAME ▲  VALUE   "+
+				"a       9       "+
+				"b       10      "))
+	})
+
+	It("should cut off the columns which don't fit", func() {
+		table.SetBox(term.PositionBox{Rows: 2, Cols: 10})
+		Expect(table).To(DisplayLike(10, 2,
+			"NAME ▲  VA"+
+				"a       9 "))
+	})
+
+	It("should say which column's header is where, once drawn", func() {
+		Expect(table).To(DisplayLike(16, 3,
+			"NAME ▲  VALUE   "+
+				"a       9       "+
+				"b       10      "))
+
+		col, isHeader := table.ColumnAt(0, 0)
+		Expect(isHeader).To(BeTrue())
+		Expect(col).To(Equal(0))
+		col, isHeader = table.ColumnAt(9, 0)
+		Expect(isHeader).To(BeTrue())
+		Expect(col).To(Equal(1))
+		_, isHeader = table.ColumnAt(7, 0)
+		Expect(isHeader).To(BeFalse())
+		_, isHeader = table.ColumnAt(9, 1)
+		Expect(isHeader).To(BeFalse())
+	})
+})
@@ -24,22 +24,82 @@ import (
 type styledSpan struct {
 	val string
 	sty tcell.Style
+	tag interface{}
 }
 
+// taggedRows records the rows that a tagged span was drawn on.
+type taggedRows struct {
+	first, last int
+	tag interface{}
+}
+
+// textBoxScrollback is how many lines more than fit a TextBox keeps, to be
+// scrolled back to.
+const textBoxScrollback = 1000
+
 // TextBox is a semi-static (i.e. not a text input widget) text container to
 // which styled text can be written.  It will automatically wrap text as
-// necessary.  If the text doesn't fit, some will be scrolled out of view.
+// necessary.  If the text doesn't fit, the start of it is scrolled out of
+// view, but can be scrolled back to (see HandleKey).
 type TextBox struct {
 	wrapper textWrapper
 	contents []styledSpan
 
+	// Scroll is how many lines back from the latest the text box is scrolled.
+	// Scrolling back past the start just shows the start.
+	Scroll int
+
+	// tagged is where tagged spans ended up as of the last flush
+	tagged []taggedRows
+	// maxScroll is how far back we could scroll as of the last flush
+	maxScroll int
+
 	pos PositionBox
 }
 
 func (t *TextBox) SetBox(box PositionBox) {
 	t.pos = box
+}
+
+// ScrollBy scrolls back by the given number of lines (forward, towards the
+// latest, if negative).
+func (t *TextBox) ScrollBy(lines int) {
+	t.Scroll = t.clampScroll(t.Scroll + lines)
+}
 
-	t.wrapper.Resize(box.Cols, box.Rows)
+// HandleKey scrolls a page back for PgUp, and forward for PgDn, back to the
+// start for Home, and forward to the latest for End, saying whether the key
+// was one of those.
+func (t *TextBox) HandleKey(evt *tcell.EventKey) bool {
+	page := t.pos.Rows - 1
+	if page < 1 {
+		page = 1
+	}
+	switch evt.Key() {
+	case tcell.KeyPgUp:
+		t.ScrollBy(page)
+	case tcell.KeyPgDn:
+		t.ScrollBy(-page)
+	case tcell.KeyHome:
+		t.Scroll = t.maxScroll
+	case tcell.KeyEnd:
+		t.Scroll = 0
+	default:
+		return false
+	}
+	return true
+}
+
+// clampScroll keeps the given scroll from going back past the start, or
+// forward past the latest.
+func (t *TextBox) clampScroll(scroll int) int {
+	if scroll > t.maxScroll {
+		scroll = t.maxScroll
+	}
+	if scroll < 0 {
+		scroll = 0
+	}
+	return scroll
 }
 
 // WriteString writes the given text to the text box in the given style,
@@ -48,15 +108,81 @@ func (t *TextBox) WriteString(str string, sty tcell.Style) {
 	t.contents = append(t.contents, styledSpan{val: str, sty: sty})
 }
 
+// WriteTaggedString is like WriteString, but tags the text, so that TagAt can
+// later say what was drawn where (e.g. which series a line of a key is for).
+func (t *TextBox) WriteTaggedString(str string, sty tcell.Style, tag interface{}) {
+	t.contents = append(t.contents, styledSpan{val: str, sty: sty, tag: tag})
+}
+
+// TagAt returns the tag of the text drawn on the given row of the screen as
+// of the last flush, or nil if that text wasn't tagged (or isn't ours).
+func (t *TextBox) TagAt(col, row int) interface{} {
+	if col < t.pos.StartCol || col >= t.pos.StartCol+t.pos.Cols {
+		return nil
+	}
+	row -= t.pos.StartRow
+	for _, span := range t.tagged {
+		if row >= span.first && row <= span.last {
+			return span.tag
+		}
+	}
+	return nil
+}
+
 func (t *TextBox) FlushTo(screen tcell.Screen) {
 	if t.pos.Rows == 0 || t.pos.Cols == 0 {
 		// bail, we've effectively been asked not to render
 		return
 	}
+
+	// figure out how many lines we need, so that we can keep them all (up to
+	// the scrollback) rather than scroll them away
+	bufRows := t.countLines()
+	if bufRows > t.pos.Rows+textBoxScrollback {
+		bufRows = t.pos.Rows + textBoxScrollback
+	}
+	if bufRows < t.pos.Rows {
+		bufRows = t.pos.Rows
+	}
+	t.wrapper.Resize(t.pos.Cols, bufRows)
+	t.maxScroll = bufRows - t.pos.Rows
+
 	t.wrapper.CursorGoTo(0, 0)
+	t.wrapper.scrolled = 0
+	t.tagged = t.tagged[:0]
 	for _, chunk := range t.contents {
+		first := t.wrapper.cursorRow + t.wrapper.scrolled
 		t.wrapper.WriteString(chunk.val, chunk.sty)
+		if chunk.tag == nil {
+			continue
+		}
+		// a trailing newline leaves us at the start of a row we didn't draw on
+		last := t.wrapper.cursorRow + t.wrapper.scrolled
+		if t.wrapper.cursorCol == 0 && last > first {
+			last--
+		}
+		t.tagged = append(t.tagged, taggedRows{first: first, last: last, tag: chunk.tag})
 	}
 	t.wrapper.EraseDown()
-	t.wrapper.FlushTo(screen, t.pos.StartCol, t.pos.StartRow)
+
+	// we show the box's worth of rows, scrolled back from the bottom
+	top := t.maxScroll - t.clampScroll(t.Scroll)
+
+	// rows are recorded relative to the top of everything written, so shift
+	// them by however much we scrolled to get the rows on screen
+	for i := range t.tagged {
+		t.tagged[i].first -= t.wrapper.scrolled + top
+		t.tagged[i].last -= t.wrapper.scrolled + top
+	}
+	t.wrapper.FlushRowsTo(screen, t.pos.StartCol, t.pos.StartRow, top, t.pos.Rows)
+}
+
+// countLines lays out our contents to see how many lines they take up.
+func (t *TextBox) countLines() int {
+	var counter textWrapper
+	counter.Resize(t.pos.Cols, 1)
+	for _, chunk := range t.contents {
+		counter.WriteString(chunk.val, chunk.sty)
+	}
+	return counter.scrolled + 1
 }
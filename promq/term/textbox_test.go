@@ -159,4 +159,87 @@ and why the sea is boiling hot
 			tcell.SimCell{Runes: []rune{'!'}},
 			tcell.SimCell{Runes: []rune{'!'}}))
 	})
+
+	Context("when the text doesn't fit", func() {
+		var box *term.TextBox
+		BeforeEach(func() {
+			box = &term.TextBox{}
+			box.WriteString("one\ntwo\nthree\nfour", tcell.StyleDefault)
+			box.SetBox(term.PositionBox{Rows: 2, Cols: 5})
+		})
+
+		It("should show the latest text", func() {
+			Expect(box).To(DisplayLike(5, 2,
+				"three"+
+				"four "))
+		})
+
+		It("should keep what's scrolled off the top, to scroll back to", func() {
+			Expect(box).To(DisplayLike(5, 2,
+				"three"+
+				"four "))
+
+			box.ScrollBy(1)
+			Expect(box).To(DisplayLike(5, 2,
+				"two  "+
+				"three"))
+
+			box.ScrollBy(5)
+			Expect(box).To(DisplayLike(5, 2,
+				"one  "+
+				"two  "))
+		})
+
+		It("should scroll by page with PgUp and PgDn, and to either end with Home and End", func() {
+			Expect(box).To(DisplayLike(5, 2,
+				"three"+
+				"four "))
+
+			Expect(box.HandleKey(tcell.NewEventKey(tcell.KeyHome, 0, tcell.ModNone))).To(BeTrue())
+			Expect(box).To(DisplayLike(5, 2,
+				"one  "+
+				"two  "))
+
+			Expect(box.HandleKey(tcell.NewEventKey(tcell.KeyPgDn, 0, tcell.ModNone))).To(BeTrue())
+			Expect(box).To(DisplayLike(5, 2,
+				"two  "+
+				"three"))
+
+			Expect(box.HandleKey(tcell.NewEventKey(tcell.KeyEnd, 0, tcell.ModNone))).To(BeTrue())
+			Expect(box).To(DisplayLike(5, 2,
+				"three"+
+				"four "))
+
+			Expect(box.HandleKey(tcell.NewEventKey(tcell.KeyPgUp, 0, tcell.ModNone))).To(BeTrue())
+			Expect(box).To(DisplayLike(5, 2,
+				"two  "+
+				"three"))
+
+			Expect(box.HandleKey(tcell.NewEventKey(tcell.KeyRune, 'q', tcell.ModNone))).To(BeFalse())
+		})
+	})
+
+	It("should say which tagged text was drawn on a given row", func() {
+		box := &term.TextBox{}
+		box.WriteTaggedString("one", tcell.StyleDefault, "one")
+		box.WriteString("\n\n", tcell.StyleDefault)
+		box.WriteTaggedString("two wraps around", tcell.StyleDefault, "two")
+		box.WriteString("\n", tcell.StyleDefault)
+
+		box.SetBox(term.PositionBox{
+			StartRow: 1, StartCol: 2,
+			Rows: 5, Cols: 10,
+		})
+		screen := tcell.NewSimulationScreen("")
+		screen.Init()
+		screen.SetSize(12, 6)
+		box.FlushTo(screen)
+
+		Expect(box.TagAt(2, 1)).To(Equal("one"))
+		Expect(box.TagAt(2, 2)).To(BeNil())
+		Expect(box.TagAt(5, 3)).To(Equal("two"))
+		Expect(box.TagAt(2, 4)).To(Equal("two"))
+		Expect(box.TagAt(2, 5)).To(BeNil())
+		Expect(box.TagAt(0, 1)).To(BeNil())
+	})
 })
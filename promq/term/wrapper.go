@@ -32,6 +32,10 @@ type textWrapper struct {
 	rows, cols int
 	buf tcell.CellBuffer
 	cursorRow, cursorCol int
+
+	// scrolled counts the lines that have been scrolled off the top, so that
+	// callers can figure out where earlier content ended up.
+	scrolled int
 }
 
 // Resize sets the size of the widget to the given number of rows and columns.
@@ -125,6 +129,18 @@ func (t *textWrapper) writeNextCell(width int, runes []rune, sty tcell.Style) {
 	t.cursorCol += width
 }
 
+// FlushRowsTo writes the given number of rows, starting at the given row, to
+// the screen, whether they've changed or not (i.e. since they're a different
+// part of the content than was last shown there).
+func (t *textWrapper) FlushRowsTo(screen tcell.Screen, startCol, startRow int, fromRow, rows int) {
+	for row := 0; row < rows && fromRow+row < t.rows; row++ {
+		for col := 0; col < t.cols; col++ {
+			mainRune, combRunes, style, _ := t.buf.GetContent(col, fromRow+row)
+			screen.SetContent(startCol+col, startRow+row, mainRune, combRunes, style)
+		}
+	}
+}
+
 func (t *textWrapper) FlushTo(screen tcell.Screen, startCol, startRow int) {
 	for row := 0; row < t.rows; row++ {
 		for col := 0; col < t.cols; col++ {
@@ -178,6 +194,7 @@ func (t *textWrapper) ScrollDown() {
 	}
 	// ... and clear the last line
 	t.clearLinePart(t.rows-1, 0, t.cols, 1)
+	t.scrolled++
 }
 
 // ScrollUp moves the cursor up a line *without* changing the column (i.e.
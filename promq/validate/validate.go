@@ -0,0 +1,237 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package validate checks a query in one go, against our grammar, prometheus' type
+// checks and the metrics we've indexed, so that callers can fail fast rather than
+// sending the engine a query which can't work.
+package validate
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"sigs.k8s.io/instrumentation-tools/promq/autocomplete"
+)
+
+// Kind is the kind of problem a query has.
+type Kind string
+
+const (
+	// SyntaxError is for queries which can't be parsed.
+	SyntaxError Kind = "syntax-error"
+	// TypeError is for queries which parse, but combine things of the wrong types,
+	// i.e. rate() of an instant vector, or a set operator between scalars.
+	TypeError Kind = "type-error"
+	// UnknownMetric is for metrics which we haven't seen any series of.
+	UnknownMetric Kind = "unknown-metric"
+	// UnknownLabel is for labels which no series of a metric has.
+	UnknownLabel Kind = "unknown-label"
+)
+
+// Problem is something wrong with a query.
+type Problem struct {
+	Kind Kind
+	// Offset and Length locate the problem in the query, in bytes.
+	Offset  int
+	Length  int
+	Message string
+	// Expected has the kinds of token which would have been valid instead, for
+	// syntax errors.
+	Expected []string
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s: %s", p.Kind, p.Message)
+}
+
+// Result has all of the problems with a query, in the order they appear in it.
+type Result struct {
+	Query    string
+	Problems []Problem
+}
+
+// Valid is whether the query can be run, queries for metrics we don't know about
+// are valid, they just don't return anything.
+func (r Result) Valid() bool {
+	for _, p := range r.Problems {
+		if p.Kind == SyntaxError || p.Kind == TypeError {
+			return false
+		}
+	}
+	return true
+}
+
+// Err describes why the query can't be run, or is nil if it can.
+func (r Result) Err() error {
+	if r.Valid() {
+		return nil
+	}
+	var problems []string
+	for _, p := range r.Problems {
+		if p.Kind == SyntaxError || p.Kind == TypeError {
+			problems = append(problems, p.String())
+		}
+	}
+	return fmt.Errorf("invalid query %q: %s", r.Query, strings.Join(problems, "; "))
+}
+
+// ValidateQuery reports the syntax and type errors in the query, or if it has none,
+// the metrics and labels it selects which the completer's index doesn't know about (if
+// the index knows about any metrics at all).
+func ValidateQuery(query string, completer autocomplete.PromQLCompleter) Result {
+	result := Result{Query: query}
+	expr, err := parser.ParseExpr(query)
+	if err != nil {
+		result.Problems = parseProblems(err)
+		// our grammar is typed, so it calls type errors syntax errors, but it does a
+		// better job of the actual syntax errors, since it knows what would have been
+		// valid instead
+		if !hasTypeError(result.Problems) {
+			if diagnostics := completer.Diagnose(query); len(diagnostics) > 0 {
+				result.Problems = syntaxProblems(diagnostics)
+			}
+		}
+		return result
+	}
+	result.Problems = indexProblems(expr, completer)
+	sort.SliceStable(result.Problems, func(i, j int) bool {
+		return result.Problems[i].Offset < result.Problems[j].Offset
+	})
+	return result
+}
+
+func syntaxProblems(diagnostics []autocomplete.Diagnostic) []Problem {
+	problems := make([]Problem, 0, len(diagnostics))
+	for _, d := range diagnostics {
+		problems = append(problems, Problem{
+			Kind:     SyntaxError,
+			Offset:   d.Offset,
+			Length:   d.Length,
+			Message:  d.Message,
+			Expected: d.Expected,
+		})
+	}
+	return problems
+}
+
+func parseProblems(err error) []Problem {
+	var parseErrs parser.ParseErrors
+	if !errors.As(err, &parseErrs) {
+		return []Problem{{Kind: SyntaxError, Message: err.Error()}}
+	}
+	problems := make([]Problem, 0, len(parseErrs))
+	for _, e := range parseErrs {
+		kind := SyntaxError
+		if isTypeError(e.Err.Error()) {
+			kind = TypeError
+		}
+		problems = append(problems, Problem{
+			Kind:    kind,
+			Offset:  int(e.PositionRange.Start),
+			Length:  int(e.PositionRange.End - e.PositionRange.Start),
+			Message: e.Err.Error(),
+		})
+	}
+	return problems
+}
+
+func hasTypeError(problems []Problem) bool {
+	for _, p := range problems {
+		if p.Kind == TypeError {
+			return true
+		}
+	}
+	return false
+}
+
+// typeErrors are how the messages of the type errors prometheus' parser checks for
+// start, i.e. 'expected type range vector in call to function "rate", got instant
+// vector'.
+var typeErrors = []string{
+	"expected type ",
+	"binary expression must contain only scalar and instant vector types",
+	"set operator ",
+	"vector matching only allowed between instant vectors",
+	"bool modifier can only be used on comparison operators",
+	"comparisons between scalars must use BOOL modifier",
+	"unary expression only allowed on expressions of type scalar or instant vector",
+	"subquery is only allowed on instant vector",
+}
+
+// prometheus doesn't tell its type errors apart from any other, so we go by their
+// messages, the set operator one being the only one which doesn't start the same way
+// every time, i.e. 'set operator "and" not allowed in binary scalar expression'
+func isTypeError(msg string) bool {
+	for _, prefix := range typeErrors {
+		if !strings.HasPrefix(msg, prefix) {
+			continue
+		}
+		if prefix == "set operator " {
+			return strings.HasSuffix(msg, " not allowed in binary scalar expression")
+		}
+		return true
+	}
+	return false
+}
+
+func indexProblems(expr parser.Expr, index autocomplete.QueryIndex) []Problem {
+	names := index.GetMetricNames()
+	// we haven't scraped anything yet, so we don't know any better
+	if names.Len() == 0 {
+		return nil
+	}
+	var problems []Problem
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		vs, ok := node.(*parser.VectorSelector)
+		if !ok || vs.Name == "" {
+			return nil
+		}
+		pos := vs.PositionRange()
+		if !names.Has(vs.Name) {
+			msg := fmt.Sprintf("no series of %s have been scraped", vs.Name)
+			if hint := autocomplete.DidYouMeanHint(vs.Name, names); hint != "" {
+				msg += ", " + hint
+			}
+			problems = append(problems, Problem{
+				Kind:    UnknownMetric,
+				Offset:  int(pos.Start),
+				Length:  int(pos.End - pos.Start),
+				Message: msg,
+			})
+			return nil
+		}
+		dims := index.GetStoredDimensionsForMetric(vs.Name)
+		for _, m := range vs.LabelMatchers {
+			// a matcher which matches the empty string matches series without the label
+			if m.Name == labels.MetricName || dims.Has(m.Name) || m.Matches("") {
+				continue
+			}
+			problems = append(problems, Problem{
+				Kind:    UnknownLabel,
+				Offset:  int(pos.Start),
+				Length:  int(pos.End - pos.Start),
+				Message: fmt.Sprintf("no series of %s have a %s label", vs.Name, m.Name),
+			})
+		}
+		return nil
+	})
+	return problems
+}
@@ -0,0 +1,168 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package validate
+
+import (
+	"testing"
+	"time"
+
+	"sigs.k8s.io/instrumentation-tools/promq/autocomplete"
+	"sigs.k8s.io/instrumentation-tools/promq/autocomplete/earley"
+	"sigs.k8s.io/instrumentation-tools/promq/prom"
+)
+
+const testMetrics = `
+# TYPE requests_total counter
+requests_total{code="200"} 2
+# TYPE temperature gauge
+temperature{room="kitchen"} 21
+`
+
+func newTestCompleter(t *testing.T, metrics string) autocomplete.PromQLCompleter {
+	index := prom.NewIndex()
+	series, err := prom.ParseTextData([]byte(metrics), time.Now())
+	if err != nil {
+		t.Fatalf("unable to parse test metrics: %v", err)
+	}
+	for _, s := range series {
+		index.UpdateMetric(s)
+	}
+	return earley.NewPromQLCompleter(index)
+}
+
+func TestValidateQuery(t *testing.T) {
+	completer := newTestCompleter(t, testMetrics)
+	testCases := []struct {
+		desc      string
+		query     string
+		wantKinds []Kind
+		wantValid bool
+	}{
+		{
+			desc:      "valid",
+			query:     `sum by (code) (rate(requests_total{code="200"}[5m]))`,
+			wantValid: true,
+		},
+		{
+			desc:      "syntax error",
+			query:     `sum(rate(requests_total[5m])`,
+			wantKinds: []Kind{SyntaxError},
+		},
+		{
+			desc:      "syntax error only prometheus knows about",
+			query:     `requests_total{code=~"("}`,
+			wantKinds: []Kind{SyntaxError},
+		},
+		{
+			desc:      "instant vector instead of a range vector",
+			query:     `rate(requests_total)`,
+			wantKinds: []Kind{TypeError},
+		},
+		{
+			desc:      "set operator between scalars",
+			query:     `1 and 2`,
+			wantKinds: []Kind{TypeError},
+		},
+		{
+			desc:      "unknown metric",
+			query:     `requests_total + temprature`,
+			wantKinds: []Kind{UnknownMetric},
+			wantValid: true,
+		},
+		{
+			desc:      "unknown labels",
+			query:     `temperature{rom="kitchen"} > on (room) requests_total{code="200", handler!=""}`,
+			wantKinds: []Kind{UnknownLabel, UnknownLabel},
+			wantValid: true,
+		},
+		{
+			desc:      "matching the empty string doesn't need the label",
+			query:     `temperature{handler=""}`,
+			wantValid: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			result := ValidateQuery(tc.query, completer)
+			var kinds []Kind
+			for _, p := range result.Problems {
+				kinds = append(kinds, p.Kind)
+			}
+			if len(kinds) != len(tc.wantKinds) {
+				t.Fatalf("got %v, want problems of kinds %v", result.Problems, tc.wantKinds)
+			}
+			for i := range kinds {
+				if kinds[i] != tc.wantKinds[i] {
+					t.Errorf("got %v, want problems of kinds %v", result.Problems, tc.wantKinds)
+				}
+			}
+			if result.Valid() != tc.wantValid {
+				t.Errorf("Valid() = %v, want %v", result.Valid(), tc.wantValid)
+			}
+			if (result.Err() == nil) != tc.wantValid {
+				t.Errorf("Err() = %v, want an error: %v", result.Err(), !tc.wantValid)
+			}
+		})
+	}
+}
+
+func TestValidateQueryWithoutMetrics(t *testing.T) {
+	// we can't tell a metric doesn't exist if we don't know about any
+	result := ValidateQuery(`rate(requests_total[5m])`, newTestCompleter(t, ""))
+	if len(result.Problems) != 0 {
+		t.Errorf("got %v, want no problems", result.Problems)
+	}
+}
+
+func TestUnknownMetricsSayWhatWasMeant(t *testing.T) {
+	result := ValidateQuery(`rate(requsts_total[5m])`, newTestCompleter(t, testMetrics))
+	want := "no series of requsts_total have been scraped, did you mean requests_total?"
+	if len(result.Problems) != 1 || result.Problems[0].Message != want {
+		t.Errorf("got %v, want a problem saying %q", result.Problems, want)
+	}
+}
+
+func TestSyntaxErrorsSayWhatWasExpected(t *testing.T) {
+	result := ValidateQuery(`sum(rate(requests_total[5m])`, newTestCompleter(t, testMetrics))
+	if len(result.Problems) != 1 || len(result.Problems[0].Expected) == 0 {
+		t.Errorf("got %v, want a syntax error with the tokens expected instead", result.Problems)
+	}
+}
+
+func TestIsTypeError(t *testing.T) {
+	testCases := []struct {
+		msg  string
+		want bool
+	}{
+		{msg: `expected type range vector in call to function "rate", got instant vector`, want: true},
+		{msg: `expected type scalar in aggregation parameter, got instant vector`, want: true},
+		{msg: `set operator "and" not allowed in binary scalar expression`, want: true},
+		{msg: `binary expression must contain only scalar and instant vector types`, want: true},
+		{msg: `comparisons between scalars must use BOOL modifier`, want: true},
+		{msg: `unary expression only allowed on expressions of type scalar or instant vector, got "string"`, want: true},
+		{msg: `subquery is only allowed on instant vector, got matrix in "foo[5m][5m:1m]" instead`, want: true},
+		// these only mention types by name
+		{msg: `unknown function with name "scalars"`, want: false},
+		{msg: `unexpected identifier "instant" in aggregation`, want: false},
+		{msg: `unexpected character inside braces: 'type'`, want: false},
+	}
+	for _, tc := range testCases {
+		if got := isTypeError(tc.msg); got != tc.want {
+			t.Errorf("isTypeError(%q) = %v, want %v", tc.msg, got, tc.want)
+		}
+	}
+}